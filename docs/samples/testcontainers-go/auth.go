@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// Verification failure reasons reported to OnVerifyFailure
+const (
+	FailureMalformed        = "malformed"
+	FailureSignature        = "invalid_signature"
+	FailureExpired          = "expired"
+	FailureNotYetValid      = "not_yet_valid"
+	FailureUnknownKID       = "unknown_kid"
+	FailureUnsupportedAlg   = "unsupported_algorithm"
+	FailureJWKSUnavailable  = "jwks_unavailable"
+	FailureMissingClaim     = "missing_claim"
+	FailureAudienceMismatch = "audience_mismatch"
+	FailureInvalidToken     = "invalid_token"
+	FailureInvalidType      = "invalid_type"
+	FailureProofMissing     = "proof_missing"
+	FailureProofInvalid     = "proof_invalid"
+	FailureRefreshToken     = "refresh_token"
+
+	FailureInactive                 = "inactive"
+	FailureIntrospectionUnavailable = "introspection_unavailable"
+)
+
+var (
+	errUnknownKID      = errors.New("key not found in JWKS")
+	errJWKSUnavailable = errors.New("failed to fetch JWKS")
+	errUnsupportedAlg  = errors.New("unexpected signing method")
+
+	errRefreshTokenPresented = errors.New("refresh token presented as an access token")
+)
+
+// defaultRefreshTokenFormat matches ngauth refresh tokens: opaque, hex-encoded
+// and at least 16 random bytes long, after the optional prefix set with
+// NGAUTH_REFRESH_TOKEN_PREFIX (up to 32 letters, digits or underscores).
+// Access tokens are JWTs and never match.
+var defaultRefreshTokenFormat = regexp.MustCompile(`^[A-Za-z0-9_]{0,32}[0-9a-f]{32,}$`)
+
+// VerifyError is returned by Verify and carries the classified failure reason
+type VerifyError struct {
+	Reason string
+	Err    error
+}
+
+func (e *VerifyError) Error() string { return e.Err.Error() }
+
+func (e *VerifyError) Unwrap() error { return e.Err }
+
+// Authenticator verifies JWT access tokens issued by the ngauth server
+type Authenticator struct {
+	IssuerURL  string
+	HTTPClient *http.Client
+
+	// OnVerifyFailure, if set, is called with the classified reason for every
+	// token that fails verification so callers can feed metrics or alerting.
+	// It runs synchronously on the request path and must return quickly.
+	// r is nil for gRPC calls.
+	OnVerifyFailure func(reason string, r *http.Request)
+
+	// OnDeprecatedIssuer, if set, is called with the iss of every accepted
+	// token from a deprecated issuer so operators can track an issuer
+	// migration. When it is nil such tokens are logged instead.
+	OnDeprecatedIssuer func(iss string)
+
+	// Verification policy, configured through AuthenticatorBuilder
+	jwksURL        string
+	requiredClaims []string
+	algorithms     []string
+	issuer         string
+	audience       string
+	leeway         time.Duration
+
+	// requireAccessTokenType rejects tokens whose typ header is not at+jwt
+	requireAccessTokenType bool
+
+	// requireProofOfPossession rejects sender-constrained (cnf) tokens
+	// presented without proof (see pop.go)
+	requireProofOfPossession bool
+
+	// refreshTokenFormat recognizes refresh tokens sent as bearer tokens, so
+	// they fail with FailureRefreshToken instead of a parse error; nil
+	// turns the check off
+	refreshTokenFormat *regexp.Regexp
+
+	// deprecatedIssuers are also accepted during an issuer migration, each
+	// verified against its own JWKS (see issuers.go)
+	deprecatedIssuers map[string]*Authenticator
+
+	// introspection, when set, verifies tokens at the RFC 7662 endpoint
+	// instead of checking the signature locally
+	introspection *introspectionConfig
+
+	// embeddedJWKS pins jwks to the set given to EmbeddedJWKS: a kid missing
+	// from it is rejected without fetching the JWKS
+	embeddedJWKS bool
+
+	mu        sync.Mutex
+	jwks      jwk.Set
+	discovery *discoveryCache
+}
+
+// NewAuthenticator creates an Authenticator for the given issuer
+func NewAuthenticator(issuerURL string) *Authenticator {
+	return &Authenticator{
+		IssuerURL:          strings.TrimSuffix(issuerURL, "/"),
+		HTTPClient:         http.DefaultClient,
+		refreshTokenFormat: defaultRefreshTokenFormat,
+		discovery:          newDiscoveryCache(defaultDiscoveryTTL),
+	}
+}
+
+// fetchJWKS fetches the JWKS from the OAuth server
+func (a *Authenticator) fetchJWKS(ctx context.Context) (jwk.Set, error) {
+	jwksURL := a.resolveJWKSURL(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected JWKS status: %d", resp.StatusCode)
+	}
+
+	return jwk.ParseReader(resp.Body)
+}
+
+// findSigningKey returns the key with the given kid that may verify alg
+// signatures. Some issuers publish a signing and an encryption key under the
+// same kid, so keys marked for encryption (use "enc", or key_ops without
+// "verify") and keys pinned to another alg are skipped rather than taking
+// the first kid match.
+func findSigningKey(set jwk.Set, kid, alg string) (jwk.Key, bool) {
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		if key.KeyID() != kid || key.KeyUsage() == string(jwk.ForEncryption) {
+			continue
+		}
+		if ops := key.KeyOps(); len(ops) > 0 && !slices.Contains(ops, jwk.KeyOpVerify) {
+			continue
+		}
+		if keyAlg := key.Algorithm().String(); keyAlg != "" && keyAlg != alg {
+			continue
+		}
+		return key, true
+	}
+	return nil, false
+}
+
+// lookupKey returns the signing key with the given kid for alg, refreshing the
+// JWKS cache on a miss. The whole published set is cached, so during a rotation
+// overlap tokens signed with either the outgoing or the incoming key verify
+// without a refetch.
+// With an embedded JWKS a miss is final.
+func (a *Authenticator) lookupKey(ctx context.Context, kid, alg string) (jwk.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.jwks != nil {
+		if key, found := findSigningKey(a.jwks, kid, alg); found {
+			return key, nil
+		}
+	}
+
+	if a.embeddedJWKS {
+		return nil, fmt.Errorf("%w: no %s signing key with kid %s in the embedded JWKS", errUnknownKID, alg, kid)
+	}
+
+	// Refresh JWKS cache and try again
+	set, err := a.fetchJWKS(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errJWKSUnavailable, err)
+	}
+	a.jwks = set
+
+	key, found := findSigningKey(a.jwks, kid, alg)
+	if !found {
+		return nil, fmt.Errorf("%w: no %s signing key with kid %s", errUnknownKID, alg, kid)
+	}
+	return key, nil
+}
+
+// Verify validates the JWT token and returns the claims
+func (a *Authenticator) Verify(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	// A common client bug: the refresh token sent where the access token belongs
+	if a.refreshTokenFormat != nil && a.refreshTokenFormat.MatchString(tokenString) {
+		return nil, &VerifyError{Reason: FailureRefreshToken, Err: errRefreshTokenPresented}
+	}
+
+	if a.introspection != nil {
+		claims, err := a.introspect(ctx, tokenString)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.checkIssuer(claims); err != nil {
+			return nil, err
+		}
+		if err := a.checkRequiredClaims(claims); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// Verify signing method
+		if !a.isAllowedMethod(token.Method) {
+			return nil, fmt.Errorf("%w: %v", errUnsupportedAlg, token.Header["alg"])
+		}
+
+		// Get key ID from token header. Keys come only from the configured
+		// JWKS; a jku header is never followed.
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, fmt.Errorf("kid not found in token header")
+		}
+
+		key, err := a.keySource(token).lookupKey(ctx, kid, token.Method.Alg())
+		if err != nil {
+			return nil, err
+		}
+
+		// Convert JWK to RSA public key
+		var rawKey interface{}
+		if err := key.Raw(&rawKey); err != nil {
+			return nil, fmt.Errorf("failed to get raw key: %w", err)
+		}
+
+		rsaKey, ok := rawKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not RSA public key")
+		}
+
+		return rsaKey, nil
+	}, a.parserOptions()...)
+
+	if err != nil {
+		return nil, &VerifyError{Reason: classifyFailure(err), Err: fmt.Errorf("failed to parse token: %w", err)}
+	}
+
+	if !token.Valid {
+		return nil, &VerifyError{Reason: FailureInvalidToken, Err: fmt.Errorf("invalid token")}
+	}
+
+	if a.requireAccessTokenType && !isAccessTokenType(token.Header["typ"]) {
+		return nil, &VerifyError{Reason: FailureInvalidType, Err: fmt.Errorf("token type %v is not an access token (at+jwt)", token.Header["typ"])}
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, &VerifyError{Reason: FailureInvalidToken, Err: fmt.Errorf("failed to parse claims")}
+	}
+
+	if err := a.checkIssuer(claims); err != nil {
+		return nil, err
+	}
+
+	if err := a.checkRequiredClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// checkRequiredClaims rejects claims missing any of the required claims
+func (a *Authenticator) checkRequiredClaims(claims jwt.MapClaims) error {
+	for _, name := range a.requiredClaims {
+		if _, ok := claims[name]; !ok {
+			return &VerifyError{Reason: FailureMissingClaim, Err: fmt.Errorf("required claim %q is missing", name)}
+		}
+	}
+	return nil
+}
+
+// isAccessTokenType reports whether a typ header marks a JWT access token
+// (RFC 9068 2.1). Media types are case-insensitive and the "application/"
+// prefix may be omitted (RFC 7515 4.1.9).
+func isAccessTokenType(typ interface{}) bool {
+	s, _ := typ.(string)
+	s = strings.ToLower(s)
+	return s == "at+jwt" || s == "application/at+jwt"
+}
+
+// isAllowedMethod reports whether the token's signing method may be used.
+// Without an explicit allow-list any RSA PKCS#1 v1.5 algorithm is accepted.
+func (a *Authenticator) isAllowedMethod(method jwt.SigningMethod) bool {
+	if len(a.algorithms) == 0 {
+		_, ok := method.(*jwt.SigningMethodRSA)
+		return ok
+	}
+	for _, alg := range a.algorithms {
+		if alg == method.Alg() {
+			return true
+		}
+	}
+	return false
+}
+
+// parserOptions translates the verification policy into jwt parser options
+func (a *Authenticator) parserOptions() []jwt.ParserOption {
+	var opts []jwt.ParserOption
+	if a.leeway > 0 {
+		opts = append(opts, jwt.WithLeeway(a.leeway))
+	}
+	// With deprecated issuers, checkIssuer applies the issuer policy instead
+	if a.issuer != "" && len(a.deprecatedIssuers) == 0 {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+	return opts
+}
+
+// VerifyRequest validates the token like Verify, checks the proof of
+// possession of sender-constrained tokens against the request and reports
+// failures to OnVerifyFailure together with the originating request
+func (a *Authenticator) VerifyRequest(r *http.Request, tokenString string) (jwt.MapClaims, error) {
+	claims, err := a.Verify(r.Context(), tokenString)
+	if err == nil {
+		err = a.checkConfirmation(r, tokenString, claims)
+	}
+	if err != nil {
+		a.reportFailure(err, r)
+		return nil, err
+	}
+	return claims, nil
+}
+
+// reportFailure invokes OnVerifyFailure with the reason carried by err
+func (a *Authenticator) reportFailure(err error, r *http.Request) {
+	if a.OnVerifyFailure == nil {
+		return
+	}
+	reason := FailureInvalidToken
+	var verifyErr *VerifyError
+	if errors.As(err, &verifyErr) {
+		reason = verifyErr.Reason
+	}
+	a.OnVerifyFailure(reason, r)
+}
+
+// classifyFailure maps a jwt parse error to a failure reason
+func classifyFailure(err error) string {
+	switch {
+	case errors.Is(err, errUnknownKID):
+		return FailureUnknownKID
+	case errors.Is(err, errJWKSUnavailable):
+		return FailureJWKSUnavailable
+	case errors.Is(err, errUnsupportedAlg):
+		return FailureUnsupportedAlg
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return FailureMalformed
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return FailureSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return FailureExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return FailureNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return FailureAudienceMismatch
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return FailureMissingClaim
+	default:
+		return FailureInvalidToken
+	}
+}
+
+// bearerToken extracts the token from an Authorization header value. The
+// scheme is matched case-insensitively (RFC 7235 2.1), so servers emitting
+// token_type "bearer" and clients sending "Bearer" interoperate.
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", false
+	}
+	return token, true
+}
+
+// VersionClaim is the access token claim carrying the token format version.
+// It should match NGAUTH_TOKEN_VERSION_CLAIM on the server.
+var VersionClaim = "ver"
+
+// TokenVersion returns the token format version from the claims, or ""
+// when the token predates format versioning
+func TokenVersion(claims jwt.MapClaims) string {
+	switch v := claims[VersionClaim].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// ScopeHierarchy maps a scope to the finer scopes it implies, e.g.
+// {"admin": {"write"}, "write": {"read"}} lets an admin token satisfy
+// RequireScope("read"). It should mirror NGAUTH_SCOPE_HIERARCHY on the server.
+var ScopeHierarchy = map[string][]string{}
+
+// ScopeClaim is the access token claim carrying the granted scopes. It
+// should match NGAUTH_SCOPE_CLAIM_NAME on the server (e.g. "scp"). Both
+// NGAUTH_SCOPE_FORMAT representations, a space-delimited string and an
+// array, are read.
+var ScopeClaim = "scope"
+
+// scopeClaimName returns the claim holding the token's scopes: ScopeClaim,
+// or "scope" for tokens issued before the claim was renamed
+func scopeClaimName(claims jwt.MapClaims) string {
+	if _, ok := claims[ScopeClaim]; ok {
+		return ScopeClaim
+	}
+	return "scope"
+}
+
+// grantedScopes returns the scopes as issued, without hierarchy expansion.
+// ok is false when the token carries no scope claim in either representation.
+func grantedScopes(claims jwt.MapClaims) (scopes []string, ok bool) {
+	switch v := claims[scopeClaimName(claims)].(type) {
+	case string:
+		return strings.Fields(v), true
+	case []interface{}:
+		for _, item := range v {
+			if s, isString := item.(string); isString && s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+		return scopes, true
+	case []string:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// extractScopes returns the scopes granted by the token, expanded with the
+// scopes they imply
+func extractScopes(claims jwt.MapClaims) []string {
+	scopes, ok := grantedScopes(claims)
+	if !ok {
+		return nil
+	}
+	return expandScopes(scopes, ScopeHierarchy)
+}
+
+// expandScopes adds implied scopes breadth-first; each scope is visited once
+// so cycles in the hierarchy terminate
+func expandScopes(scopes []string, hierarchy map[string][]string) []string {
+	seen := make(map[string]bool, len(scopes))
+	expanded := make([]string, 0, len(scopes))
+	queue := append([]string(nil), scopes...)
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		expanded = append(expanded, current)
+		queue = append(queue, hierarchy[current]...)
+	}
+
+	return expanded
+}
+
+// hasScope reports whether the claims grant the required scope
+func hasScope(claims jwt.MapClaims, requiredScope string) bool {
+	for _, s := range extractScopes(claims) {
+		if s == requiredScope {
+			return true
+		}
+	}
+	return false
+}
+
+// DownscopeClaims returns a copy of the verified claims whose scope is
+// narrowed to the granted scopes (hierarchy included) that are also in
+// allowed. No new token is minted: the narrowed view is for handing to
+// internal handlers that should act with less than the caller's full grant.
+// An allowed scope keeps the scopes it implies through ScopeHierarchy. The
+// narrowed scopes keep the claim name and representation of the token.
+func DownscopeClaims(claims jwt.MapClaims, allowed ...string) jwt.MapClaims {
+	permitted := make(map[string]bool, len(allowed))
+	for _, s := range allowed {
+		permitted[s] = true
+	}
+
+	var kept []string
+	for _, s := range extractScopes(claims) {
+		if permitted[s] {
+			kept = append(kept, s)
+		}
+	}
+
+	narrowed := make(jwt.MapClaims, len(claims))
+	for name, value := range claims {
+		narrowed[name] = value
+	}
+	name := scopeClaimName(claims)
+	switch claims[name].(type) {
+	case []interface{}, []string:
+		list := make([]interface{}, len(kept))
+		for i, s := range kept {
+			list[i] = s
+		}
+		narrowed[name] = list
+	default:
+		narrowed[name] = strings.Join(kept, " ")
+	}
+	return narrowed
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer serves a JWKS for an in-memory RSA key and signs tokens with it
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	issuer := &testIssuer{key: key, kid: "test-key"}
+	issuer.server = serveJWKS(t, nil, issuer)
+
+	return issuer
+}
+
+// serveJWKS starts a server publishing the public keys of the given issuers,
+// counting JWKS fetches in fetches when it is not nil
+func serveJWKS(t *testing.T, fetches *atomic.Int64, issuers ...*testIssuer) *httptest.Server {
+	body := marshalJWKS(t, issuers...)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		if fetches != nil {
+			fetches.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// marshalJWKS returns a JWKS document with the issuers' public keys
+func marshalJWKS(t *testing.T, issuers ...*testIssuer) []byte {
+	set := jwk.NewSet()
+	for _, issuer := range issuers {
+		pub, err := jwk.FromRaw(&issuer.key.PublicKey)
+		require.NoError(t, err)
+		require.NoError(t, pub.Set(jwk.KeyIDKey, issuer.kid))
+		require.NoError(t, pub.Set(jwk.AlgorithmKey, "RS256"))
+		require.NoError(t, pub.Set(jwk.KeyUsageKey, "sig"))
+		require.NoError(t, set.AddKey(pub))
+	}
+	body, err := json.Marshal(set)
+	require.NoError(t, err)
+	return body
+}
+
+func (i *testIssuer) authenticator() *Authenticator {
+	return NewAuthenticator(i.server.URL)
+}
+
+func (i *testIssuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	return i.signWithType(t, "JWT", claims)
+}
+
+// signWithType signs claims with the given typ header (none when empty)
+func (i *testIssuer) signWithType(t *testing.T, typ string, claims jwt.MapClaims) string {
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = i.kid
+	if typ == "" {
+		delete(token.Header, "typ")
+	} else {
+		token.Header["typ"] = typ
+	}
+
+	signed, err := token.SignedString(i.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := issuer.authenticator()
+
+	claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1", "scope": "read"}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+	assert.Equal(t, []string{"read"}, extractScopes(claims))
+}
+
+func TestAuthenticatorVerifyExpired(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := issuer.authenticator()
+
+	_, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{
+		"sub": "user1",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	}))
+	assert.Error(t, err)
+}
+
+func TestRequireScopeHierarchy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	previous := ScopeHierarchy
+	ScopeHierarchy = map[string][]string{"admin": {"write"}, "write": {"read"}, "read": {"admin"}}
+	t.Cleanup(func() { ScopeHierarchy = previous })
+
+	call := func(scope, required string) int {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			c.Set("claims", jwt.MapClaims{"scope": scope})
+		}, RequireScope(required), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	t.Run("admin satisfies read", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call("admin", "read"))
+	})
+
+	t.Run("non-implied scope is rejected", func(t *testing.T) {
+		ScopeHierarchy = map[string][]string{"admin": {"write"}, "write": {"read"}}
+		assert.Equal(t, http.StatusForbidden, call("write", "admin"))
+		assert.Equal(t, http.StatusForbidden, call("profile", "read"))
+	})
+}
+
+func TestExpandScopesCycle(t *testing.T) {
+	hierarchy := map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}
+	assert.Equal(t, []string{"a", "b", "c"}, expandScopes([]string{"a"}, hierarchy))
+}
+
+func TestAuthenticatorOnVerifyFailure(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+	forged.Header["kid"] = issuer.kid
+	forgedToken, err := forged.SignedString(otherKey)
+	require.NoError(t, err)
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+	unknown.Header["kid"] = "rotated-away"
+	unknownToken, err := unknown.SignedString(issuer.key)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"signature", forgedToken, FailureSignature},
+		{"expired", issuer.sign(t, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(-time.Minute).Unix()}), FailureExpired},
+		{"unknown kid", unknownToken, FailureUnknownKID},
+		{"malformed", "not-a-jwt", FailureMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := issuer.authenticator()
+
+			var reasons []string
+			var seen *http.Request
+			auth.OnVerifyFailure = func(reason string, r *http.Request) {
+				reasons = append(reasons, reason)
+				seen = r
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/data", nil)
+			_, err := auth.VerifyRequest(req, tt.token)
+			require.Error(t, err)
+
+			var verifyErr *VerifyError
+			require.ErrorAs(t, err, &verifyErr)
+			assert.Equal(t, tt.reason, verifyErr.Reason)
+			assert.Equal(t, []string{tt.reason}, reasons)
+			assert.Same(t, req, seen)
+		})
+	}
+}
+
+func TestAuthenticatorOnVerifyFailureAudienceMismatch(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).ExpectedAudience("my-api").Build()
+	require.NoError(t, err)
+
+	var reasons []string
+	auth.OnVerifyFailure = func(reason string, _ *http.Request) {
+		reasons = append(reasons, reason)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		reason string
+	}{
+		{"other audience", jwt.MapClaims{"sub": "user1", "aud": "other-api"}, FailureAudienceMismatch},
+		{"array without the audience", jwt.MapClaims{"sub": "user1", "aud": []string{"other-api", "third-api"}}, FailureAudienceMismatch},
+		{"expired for this audience", jwt.MapClaims{"sub": "user1", "aud": "my-api", "exp": time.Now().Add(-time.Minute).Unix()}, FailureExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons = nil
+
+			_, err := auth.VerifyRequest(httptest.NewRequest(http.MethodGet, "/", nil), issuer.sign(t, tt.claims))
+			require.Error(t, err)
+
+			var verifyErr *VerifyError
+			require.ErrorAs(t, err, &verifyErr)
+			assert.Equal(t, tt.reason, verifyErr.Reason)
+			assert.Equal(t, []string{tt.reason}, reasons)
+		})
+	}
+}
+
+func TestAuthenticatorOnVerifyFailureNotCalledOnSuccess(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := issuer.authenticator()
+
+	called := false
+	auth.OnVerifyFailure = func(string, *http.Request) { called = true }
+
+	_, err := auth.VerifyRequest(httptest.NewRequest(http.MethodGet, "/", nil), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.False(t, called)
+}
+
+func TestTokenVersion(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := issuer.authenticator()
+
+	claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1", "ver": "1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "1", TokenVersion(claims))
+
+	assert.Equal(t, "2", TokenVersion(jwt.MapClaims{"ver": float64(2)}))
+	assert.Equal(t, "", TokenVersion(jwt.MapClaims{"sub": "user1"}))
+
+	previous := VersionClaim
+	VersionClaim = "https://ngauth.dev/token_version"
+	t.Cleanup(func() { VersionClaim = previous })
+	assert.Equal(t, "3", TokenVersion(jwt.MapClaims{"https://ngauth.dev/token_version": "3"}))
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer abc", "abc", true},
+		{"BEARER abc", "abc", true},
+		{"Bearer  abc ", "abc", true},
+		{"Basic abc", "", false},
+		{"Bearer", "", false},
+		{"Bearer ", "", false},
+		{"Bearer a b", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		token, ok := bearerToken(tt.header)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.token, token, tt.header)
+	}
+}
+
+func TestAuthenticatorVerifyDuringKeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// During rotation the server publishes both the old and the new key
+	previous := &testIssuer{key: oldKey, kid: "key-2024"}
+	current := &testIssuer{key: newKey, kid: "key-2025"}
+	var fetches atomic.Int64
+	server := serveJWKS(t, &fetches, previous, current)
+	auth := NewAuthenticator(server.URL)
+
+	for _, issuer := range []*testIssuer{current, previous, current, previous} {
+		claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": issuer.kid}))
+		require.NoError(t, err)
+		assert.Equal(t, issuer.kid, claims["sub"])
+	}
+
+	// Both keys come from the first fetch; known kids never trigger a refresh
+	assert.Equal(t, int64(1), fetches.Load())
+}
+
+func TestAuthenticatorIgnoresJKU(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := issuer.authenticator()
+
+	// A key set the token points at but the authenticator was not configured with
+	attackerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	attacker := &testIssuer{key: attackerKey, kid: issuer.kid}
+	var attackerFetches atomic.Int64
+	attacker.server = serveJWKS(t, &attackerFetches, attacker)
+
+	signWithJKU := func(signer *testIssuer) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+		token.Header["kid"] = signer.kid
+		token.Header["jku"] = attacker.server.URL + "/.well-known/jwks.json"
+		signed, err := token.SignedString(signer.key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	// Keys are resolved by kid from the configured JWKS, whatever jku says
+	claims, err := auth.Verify(context.Background(), signWithJKU(issuer))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+
+	_, err = auth.Verify(context.Background(), signWithJKU(attacker))
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), attackerFetches.Load())
+}
+
+func TestAuthenticatorRejectsKeyMissingFromJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	published := newTestIssuer(t)
+	retired := &testIssuer{key: key, kid: "retired-key", server: published.server}
+
+	_, err = published.authenticator().Verify(context.Background(), retired.sign(t, jwt.MapClaims{"sub": "user1"}))
+	var verifyErr *VerifyError
+	require.ErrorAs(t, err, &verifyErr)
+	assert.Equal(t, FailureUnknownKID, verifyErr.Reason)
+}
+
+// serveSharedKIDJWKS publishes an encryption key ahead of a signing key under
+// the same kid, so the first kid match is the wrong key
+func serveSharedKIDJWKS(t *testing.T, signing, encryption *testIssuer) *httptest.Server {
+	set := jwk.NewSet()
+	enc, err := jwk.FromRaw(&encryption.key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, enc.Set(jwk.KeyIDKey, encryption.kid))
+	require.NoError(t, enc.Set(jwk.AlgorithmKey, "RSA-OAEP"))
+	require.NoError(t, enc.Set(jwk.KeyUsageKey, "enc"))
+	require.NoError(t, set.AddKey(enc))
+	sig, err := jwk.FromRaw(&signing.key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, sig.Set(jwk.KeyIDKey, signing.kid))
+	require.NoError(t, sig.Set(jwk.AlgorithmKey, "RS256"))
+	require.NoError(t, sig.Set(jwk.KeyUsageKey, "sig"))
+	require.NoError(t, set.AddKey(sig))
+	body, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAuthenticatorPicksSigningKeyWhenKIDIsShared(t *testing.T) {
+	sigKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signing := &testIssuer{key: sigKey, kid: "shared"}
+	encryption := &testIssuer{key: encKey, kid: "shared"}
+	auth := NewAuthenticator(serveSharedKIDJWKS(t, signing, encryption).URL)
+
+	claims, err := auth.Verify(context.Background(), signing.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+
+	// A token made with the encryption key's private half matches only the
+	// encryption key, which never verifies signatures
+	_, err = auth.Verify(context.Background(), encryption.sign(t, jwt.MapClaims{"sub": "user1"}))
+	var verifyErr *VerifyError
+	require.ErrorAs(t, err, &verifyErr)
+	assert.Equal(t, FailureSignature, verifyErr.Reason)
+}
+
+func TestAuthenticatorRejectsKIDOfEncryptionKeyOnly(t *testing.T) {
+	sigKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signing := &testIssuer{key: sigKey, kid: "sig-key"}
+	encryption := &testIssuer{key: encKey, kid: "enc-key"}
+	auth := NewAuthenticator(serveSharedKIDJWKS(t, signing, encryption).URL)
+
+	_, err = auth.Verify(context.Background(), encryption.sign(t, jwt.MapClaims{"sub": "user1"}))
+	var verifyErr *VerifyError
+	require.ErrorAs(t, err, &verifyErr)
+	assert.Equal(t, FailureUnknownKID, verifyErr.Reason)
+}
+
+func TestFindSigningKey(t *testing.T) {
+	set := jwk.NewSet()
+	for _, fields := range []map[string]interface{}{
+		{jwk.KeyIDKey: "k", jwk.KeyUsageKey: "enc"},
+		{jwk.KeyIDKey: "k", jwk.KeyOpsKey: []string{"encrypt"}},
+		{jwk.KeyIDKey: "k", jwk.AlgorithmKey: "ES256"},
+		{jwk.KeyIDKey: "k", jwk.KeyOpsKey: []string{"verify"}, "label": "match"},
+	} {
+		key, err := jwk.FromRaw([]byte("secret"))
+		require.NoError(t, err)
+		for name, value := range fields {
+			require.NoError(t, key.Set(name, value))
+		}
+		require.NoError(t, set.AddKey(key))
+	}
+
+	key, found := findSigningKey(set, "k", "RS256")
+	require.True(t, found)
+	label, _ := key.Get("label")
+	assert.Equal(t, "match", label)
+
+	_, found = findSigningKey(set, "other", "RS256")
+	assert.False(t, found)
+}
+
+// noNetwork fails the test on any HTTP request
+type noNetwork struct{ t *testing.T }
+
+func (n noNetwork) RoundTrip(r *http.Request) (*http.Response, error) {
+	n.t.Errorf("unexpected request to %s", r.URL)
+	return nil, errors.New("network access is disabled")
+}
+
+// embeddedAuthenticator verifies against the keys of the given issuers,
+// failing the test if it touches the network
+func embeddedAuthenticator(t *testing.T, issuers ...*testIssuer) *Authenticator {
+	set, err := jwk.Parse(marshalJWKS(t, issuers...))
+	require.NoError(t, err)
+
+	auth, err := NewAuthenticatorBuilder("http://issuer.invalid").
+		HTTPClient(&http.Client{Transport: noNetwork{t}}).
+		EmbeddedJWKS(set).
+		Build()
+	require.NoError(t, err)
+	return auth
+}
+
+func TestAuthenticatorVerifiesAgainstEmbeddedJWKS(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := embeddedAuthenticator(t, issuer)
+
+	claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+}
+
+func TestAuthenticatorRejectsKIDMissingFromEmbeddedJWKS(t *testing.T) {
+	embedded := newTestIssuer(t)
+	other := newTestIssuer(t)
+	other.kid = "unexpected-key"
+	auth := embeddedAuthenticator(t, embedded)
+
+	var reasons []string
+	auth.OnVerifyFailure = func(reason string, r *http.Request) { reasons = append(reasons, reason) }
+
+	for i := 0; i < 2; i++ {
+		_, err := auth.VerifyRequest(httptest.NewRequest(http.MethodGet, "/", nil), other.sign(t, jwt.MapClaims{"sub": "user1"}))
+		require.Error(t, err)
+		assert.ErrorIs(t, err, errUnknownKID)
+		assert.Contains(t, err.Error(), "embedded JWKS")
+	}
+	assert.Equal(t, []string{FailureUnknownKID, FailureUnknownKID}, reasons)
+}
+
+func TestEmbeddedJWKSKeepsOnlyPublicKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+	private, err := jwk.FromRaw(issuer.key)
+	require.NoError(t, err)
+	require.NoError(t, private.Set(jwk.KeyIDKey, issuer.kid))
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(private))
+
+	auth, err := NewAuthenticatorBuilder("http://issuer.invalid").
+		HTTPClient(&http.Client{Transport: noNetwork{t}}).
+		EmbeddedJWKS(set).
+		Build()
+	require.NoError(t, err)
+
+	// Changes to the caller's set after Build are not seen
+	require.NoError(t, set.RemoveKey(private))
+
+	key, _ := auth.jwks.Key(0)
+	_, isPrivate := key.(jwk.RSAPrivateKey)
+	assert.False(t, isPrivate)
+	_, err = auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+	assert.NoError(t, err)
+}
+
+func TestDownscopeClaims(t *testing.T) {
+	previous := ScopeHierarchy
+	ScopeHierarchy = map[string][]string{"write": {"read"}}
+	t.Cleanup(func() { ScopeHierarchy = previous })
+
+	claims := jwt.MapClaims{"sub": "user1", "scope": "write profile"}
+
+	t.Run("keeps only allowed granted scopes", func(t *testing.T) {
+		narrowed := DownscopeClaims(claims, "read", "profile", "admin")
+		assert.Equal(t, "profile read", narrowed["scope"])
+		assert.Equal(t, "user1", narrowed["sub"])
+	})
+
+	t.Run("empty intersection", func(t *testing.T) {
+		assert.Equal(t, "", DownscopeClaims(claims, "admin")["scope"])
+	})
+
+	t.Run("original claims are untouched", func(t *testing.T) {
+		DownscopeClaims(claims, "read")
+		assert.Equal(t, "write profile", claims["scope"])
+	})
+}
+
+func TestExtractScopesRepresentations(t *testing.T) {
+	tests := []struct {
+		name       string
+		scopeClaim string
+		claims     jwt.MapClaims
+	}{
+		{"string scope", "scope", jwt.MapClaims{"scope": "read write"}},
+		{"array scope", "scope", jwt.MapClaims{"scope": []interface{}{"read", "write"}}},
+		{"array scp", "scp", jwt.MapClaims{"scp": []interface{}{"read", "write"}}},
+		{"string scp", "scp", jwt.MapClaims{"scp": "read write"}},
+		{"scope before the rename", "scp", jwt.MapClaims{"scope": "read write"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := ScopeClaim
+			ScopeClaim = tt.scopeClaim
+			t.Cleanup(func() { ScopeClaim = previous })
+
+			assert.Equal(t, []string{"read", "write"}, extractScopes(tt.claims))
+			assert.True(t, hasScope(tt.claims, "write"))
+		})
+	}
+
+	assert.Nil(t, extractScopes(jwt.MapClaims{"sub": "user1"}))
+}
+
+func TestDownscopeClaimsKeepsArrayRepresentation(t *testing.T) {
+	previous := ScopeClaim
+	ScopeClaim = "scp"
+	t.Cleanup(func() { ScopeClaim = previous })
+
+	narrowed := DownscopeClaims(jwt.MapClaims{"scp": []interface{}{"read", "write"}}, "read")
+	assert.Equal(t, []interface{}{"read"}, narrowed["scp"])
+	assert.NotContains(t, narrowed, "scope")
+}
+
+func TestRestrictScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	call := func(required string) (int, string) {
+		var seen string
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			c.Set("claims", jwt.MapClaims{"sub": "user1", "scope": "read write admin"})
+		}, RestrictScopes("read"), RequireScope(required), func(c *gin.Context) {
+			claims, _ := c.Get("claims")
+			seen = claims.(jwt.MapClaims)["scope"].(string)
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code, seen
+	}
+
+	code, seen := call("read")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "read", seen)
+
+	// write was granted by the token but is outside the route's subset
+	code, _ = call("write")
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestAuthenticatorDiscoversJWKSUnderBasePath(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	issuer := &testIssuer{key: key, kid: "test-key"}
+	body := marshalJWKS(t, issuer)
+
+	// The server is mounted under /auth and publishes its keys at a custom path
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/auth/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   server.URL + "/auth",
+			"jwks_uri": server.URL + "/auth/keys",
+		})
+	})
+	mux.HandleFunc("/auth/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+
+	auth := NewAuthenticator(server.URL + "/auth/")
+	claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Report validation errors using JSON field names instead of Go struct fields
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
+// FieldError describes one invalid request field in a binding error response
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// BindingErrorResponse is the 400 body written by BindJSON. Errors lists the
+// invalid fields; it is empty when the body as a whole could not be decoded.
+type BindingErrorResponse struct {
+	Error            string       `json:"error"`
+	ErrorDescription string       `json:"error_description"`
+	Errors           []FieldError `json:"errors"`
+}
+
+// BindJSON binds the JSON request body into v. On failure it responds 400
+// with a BindingErrorResponse, aborts the context and returns false.
+//
+//	var item DataItem
+//	if !BindJSON(c, &item) {
+//		return
+//	}
+func BindJSON(c *gin.Context, v interface{}) bool {
+	if err := c.ShouldBindJSON(v); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, bindingError(err))
+		return false
+	}
+	return true
+}
+
+// bindingError maps a gin binding error to a stable OAuth-style error body.
+// The description names the offending parameter without exposing Go types
+// or struct internals.
+func bindingError(err error) BindingErrorResponse {
+	return BindingErrorResponse{
+		Error:            "invalid_request",
+		ErrorDescription: describeBindingError(err),
+		Errors:           fieldErrors(err),
+	}
+}
+
+func describeBindingError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var validationErrs validator.ValidationErrors
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return "Request body is required"
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return "Request body is not valid JSON"
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return "Request body must be a JSON object"
+		}
+		return fmt.Sprintf("Parameter '%s' has an invalid type", typeErr.Field)
+	case errors.As(err, &validationErrs) && len(validationErrs) > 0:
+		fe := validationErrs[0]
+		if fe.Tag() == "required" {
+			return fmt.Sprintf("Missing required parameter: %s", fe.Field())
+		}
+		return fmt.Sprintf("Parameter '%s' is invalid", fe.Field())
+	default:
+		return "Request body is invalid"
+	}
+}
+
+// fieldErrors lists every invalid field carried by a binding error
+func fieldErrors(err error) []FieldError {
+	var typeErr *json.UnmarshalTypeError
+	var validationErrs validator.ValidationErrors
+
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return []FieldError{{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Message: fmt.Sprintf("must be %s", jsonTypeName(typeErr.Type)),
+		}}
+	case errors.As(err, &validationErrs):
+		result := make([]FieldError, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			result = append(result, FieldError{
+				Field:   fieldPath(fe),
+				Rule:    fe.Tag(),
+				Message: ruleMessage(fe),
+			})
+		}
+		return result
+	default:
+		return []FieldError{}
+	}
+}
+
+// fieldPath is the dotted JSON path of the field without the root struct name
+func fieldPath(fe validator.FieldError) string {
+	namespace := fe.Namespace()
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[i+1:]
+	}
+	return fe.Field()
+}
+
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "len":
+		return fmt.Sprintf("must have length %s", fe.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", strings.ReplaceAll(fe.Param(), " ", ", "))
+	case "email":
+		return "must be a valid email address"
+	case "url":
+		return "must be a valid URL"
+	default:
+		return "is invalid"
+	}
+}
+
+// jsonTypeName names the JSON type a Go type decodes from
+func jsonTypeName(t reflect.Type) string {
+	if t == nil {
+		return "a valid value"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	default:
+		return "a valid value"
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateDataBindingErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/data", createData)
+
+	tests := []struct {
+		name        string
+		body        string
+		description string
+	}{
+		{"malformed JSON", `{"name": `, "Request body is not valid JSON"},
+		{"invalid syntax", `{name: "x"}`, "Request body is not valid JSON"},
+		{"empty body", ``, "Request body is required"},
+		{"missing required field", `{}`, "Missing required parameter: name"},
+		{"type mismatch", `{"name": 42}`, "Parameter 'name' has an invalid type"},
+		{"not an object", `["x"]`, "Request body must be a JSON object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/data", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var body BindingErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, "invalid_request", body.Error)
+			assert.Equal(t, tt.description, body.ErrorDescription)
+			// No Go internals such as struct names or decoder messages
+			assert.NotContains(t, w.Body.String(), "DataItem")
+			assert.NotContains(t, w.Body.String(), "json:")
+		})
+	}
+}
+
+func TestCreateDataValidBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/data", createData)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/data", strings.NewReader(`{"name": "widget"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), "Created item: widget")
+}
+
+// postJSON sends body to a handler that binds it with BindJSON
+func postJSON(t *testing.T, handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/", handler)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func decodeBindingError(t *testing.T, w *httptest.ResponseRecorder) BindingErrorResponse {
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var body BindingErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "invalid_request", body.Error)
+	return body
+}
+
+func TestBindJSONMissingRequiredField(t *testing.T) {
+	body := decodeBindingError(t, postJSON(t, createData, `{}`))
+
+	assert.Equal(t, []FieldError{{Field: "name", Rule: "required", Message: "is required"}}, body.Errors)
+}
+
+func TestBindJSONTypeMismatch(t *testing.T) {
+	body := decodeBindingError(t, postJSON(t, createData, `{"name": 42}`))
+
+	assert.Equal(t, []FieldError{{Field: "name", Rule: "type", Message: "must be a string"}}, body.Errors)
+}
+
+func TestBindJSONReportsEveryInvalidField(t *testing.T) {
+	type address struct {
+		City string `json:"city" binding:"required"`
+	}
+	type order struct {
+		Quantity int     `json:"quantity" binding:"min=1"`
+		Status   string  `json:"status" binding:"oneof=open closed"`
+		Address  address `json:"address"`
+	}
+
+	handler := func(c *gin.Context) {
+		var o order
+		if !BindJSON(c, &o) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+
+	body := decodeBindingError(t, postJSON(t, handler, `{"quantity": 0, "status": "lost", "address": {}}`))
+
+	assert.Equal(t, []FieldError{
+		{Field: "quantity", Rule: "min", Message: "must be at least 1"},
+		{Field: "status", Rule: "oneof", Message: "must be one of: open, closed"},
+		{Field: "address.city", Rule: "required", Message: "is required"},
+	}, body.Errors)
+}
+
+func TestBindJSONMalformedBodyHasNoFieldErrors(t *testing.T) {
+	w := postJSON(t, createData, `{"name": `)
+	body := decodeBindingError(t, w)
+
+	assert.Equal(t, "Request body is not valid JSON", body.ErrorDescription)
+	assert.Empty(t, body.Errors)
+	assert.Contains(t, w.Body.String(), `"errors":[]`)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// supportedAlgorithms lists the RSA algorithms the Authenticator can verify
+var supportedAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+}
+
+// AuthenticatorBuilder configures an Authenticator's verification policy.
+// Settings are validated by Build so misconfiguration fails at startup
+// rather than on the first request.
+//
+//	auth, err := NewAuthenticatorBuilder("http://localhost:3000").
+//		RequireClaims("aud", "sub").
+//		ExpectedAudience("my-api").
+//		Leeway(30 * time.Second).
+//		Build()
+type AuthenticatorBuilder struct {
+	issuerURL      string
+	jwksURL        string
+	discoveryTTL   time.Duration
+	httpClient     *http.Client
+	requiredClaims []string
+	algorithms     []string
+	issuer         string
+	audience       string
+	leeway         time.Duration
+
+	requireAccessTokenType   bool
+	requireProofOfPossession bool
+
+	refreshTokenFormat    *regexp.Regexp
+	refreshTokenFormatSet bool
+
+	deprecatedIssuers []string
+
+	embeddedJWKS    jwk.Set
+	embeddedJWKSSet bool
+
+	introspectionURL          string
+	introspectionClientID     string
+	introspectionClientSecret string
+	cacheMaxEntries           int
+	cacheMaxStaleness         time.Duration
+}
+
+// NewAuthenticatorBuilder starts a builder for the given issuer
+func NewAuthenticatorBuilder(issuerURL string) *AuthenticatorBuilder {
+	return &AuthenticatorBuilder{issuerURL: issuerURL}
+}
+
+// RequireClaims rejects tokens that do not carry all of the given claims
+func (b *AuthenticatorBuilder) RequireClaims(claims ...string) *AuthenticatorBuilder {
+	b.requiredClaims = append(b.requiredClaims, claims...)
+	return b
+}
+
+// Leeway allows for clock skew when checking exp, nbf and iat
+func (b *AuthenticatorBuilder) Leeway(d time.Duration) *AuthenticatorBuilder {
+	b.leeway = d
+	return b
+}
+
+// AllowedAlgorithms restricts the accepted signing algorithms
+func (b *AuthenticatorBuilder) AllowedAlgorithms(algs ...string) *AuthenticatorBuilder {
+	b.algorithms = append(b.algorithms, algs...)
+	return b
+}
+
+// ExpectedIssuer requires the iss claim to equal iss
+func (b *AuthenticatorBuilder) ExpectedIssuer(iss string) *AuthenticatorBuilder {
+	b.issuer = iss
+	return b
+}
+
+// DeprecatedIssuers also accepts tokens from the given issuers while
+// clients migrate to a new issuer URL. Each issuer's JWKS is resolved from
+// its own discovery document, and every accepted token from one of them is
+// reported to OnDeprecatedIssuer. Remove them once the migration is done.
+func (b *AuthenticatorBuilder) DeprecatedIssuers(issuers ...string) *AuthenticatorBuilder {
+	b.deprecatedIssuers = append(b.deprecatedIssuers, issuers...)
+	return b
+}
+
+// ExpectedAudience requires the aud claim to contain aud. The claim may be
+// a single string or an array (RFC 7519 4.1.3); an array must list aud as
+// one of its elements.
+func (b *AuthenticatorBuilder) ExpectedAudience(aud string) *AuthenticatorBuilder {
+	b.audience = aud
+	return b
+}
+
+// RequireAccessTokenType rejects tokens whose typ header is not at+jwt
+// (RFC 9068), so an id_token cannot be used as an access token. Only tokens
+// issued by servers that set the header verify; leave it off otherwise. It
+// does not apply to introspected tokens, which carry no header.
+func (b *AuthenticatorBuilder) RequireAccessTokenType() *AuthenticatorBuilder {
+	b.requireAccessTokenType = true
+	return b
+}
+
+// RequireProofOfPossession rejects tokens carrying a cnf claim (issued as
+// DPoP- or mTLS-bound) that are presented as plain bearer tokens. Proofs
+// present on the request are checked either way; only VerifyRequest sees
+// them, so gRPC calls with such tokens are refused.
+func (b *AuthenticatorBuilder) RequireProofOfPossession() *AuthenticatorBuilder {
+	b.requireProofOfPossession = true
+	return b
+}
+
+// RefreshTokenFormat sets the pattern that recognizes refresh tokens presented
+// as access tokens; they are rejected with FailureRefreshToken. The default
+// matches ngauth's opaque hex refresh tokens. Pass nil for servers whose
+// access tokens may look the same, e.g. opaque tokens checked by introspection.
+func (b *AuthenticatorBuilder) RefreshTokenFormat(pattern *regexp.Regexp) *AuthenticatorBuilder {
+	b.refreshTokenFormat = pattern
+	b.refreshTokenFormatSet = true
+	return b
+}
+
+// JWKSURL overrides the JWKS location (default: <issuer>/.well-known/jwks.json)
+func (b *AuthenticatorBuilder) JWKSURL(jwksURL string) *AuthenticatorBuilder {
+	b.jwksURL = jwksURL
+	return b
+}
+
+// EmbeddedJWKS verifies tokens against the given key set only, e.g. one
+// compiled into the binary with go:embed, and never fetches the JWKS or the
+// discovery document. Tokens signed by a key outside the set fail with
+// FailureUnknownKID. Only the public keys are kept, as a copy, so later
+// changes to set have no effect. Cannot be combined with JWKSURL,
+// Introspection or DeprecatedIssuers.
+func (b *AuthenticatorBuilder) EmbeddedJWKS(set jwk.Set) *AuthenticatorBuilder {
+	b.embeddedJWKS = set
+	b.embeddedJWKSSet = true
+	return b
+}
+
+// DiscoveryTTL sets how long the issuer's discovery document is reused
+// before it is revalidated (default one hour). A shorter Cache-Control
+// max-age on the document takes precedence. Not used when JWKSURL is set.
+func (b *AuthenticatorBuilder) DiscoveryTTL(ttl time.Duration) *AuthenticatorBuilder {
+	b.discoveryTTL = ttl
+	return b
+}
+
+// HTTPClient sets the client used to fetch the JWKS and call the introspection endpoint
+func (b *AuthenticatorBuilder) HTTPClient(client *http.Client) *AuthenticatorBuilder {
+	b.httpClient = client
+	return b
+}
+
+// Introspection verifies tokens at the RFC 7662 introspection endpoint,
+// authenticating as the given client, instead of checking signatures locally
+func (b *AuthenticatorBuilder) Introspection(endpoint, clientID, clientSecret string) *AuthenticatorBuilder {
+	b.introspectionURL = endpoint
+	b.introspectionClientID = clientID
+	b.introspectionClientSecret = clientSecret
+	return b
+}
+
+// IntrospectionCache caches up to maxEntries active introspection results.
+// A cached result is reused until the token's exp but never for longer than
+// maxStaleness, which bounds how long a revoked token keeps validating.
+func (b *AuthenticatorBuilder) IntrospectionCache(maxEntries int, maxStaleness time.Duration) *AuthenticatorBuilder {
+	b.cacheMaxEntries = maxEntries
+	b.cacheMaxStaleness = maxStaleness
+	return b
+}
+
+// Build validates the configuration and returns the Authenticator
+func (b *AuthenticatorBuilder) Build() (*Authenticator, error) {
+	var errs []error
+
+	if err := validateURL(b.issuerURL); err != nil {
+		errs = append(errs, fmt.Errorf("issuer URL: %w", err))
+	}
+	if b.jwksURL != "" {
+		if err := validateURL(b.jwksURL); err != nil {
+			errs = append(errs, fmt.Errorf("JWKS URL: %w", err))
+		}
+	}
+	for _, iss := range b.deprecatedIssuers {
+		if err := validateURL(iss); err != nil {
+			errs = append(errs, fmt.Errorf("deprecated issuer: %w", err))
+		} else if iss == b.issuer || strings.TrimSuffix(iss, "/") == strings.TrimSuffix(b.issuerURL, "/") {
+			errs = append(errs, fmt.Errorf("deprecated issuer %q is also the current issuer", iss))
+		}
+	}
+	var embedded jwk.Set
+	if b.embeddedJWKSSet {
+		switch {
+		case b.embeddedJWKS == nil || b.embeddedJWKS.Len() == 0:
+			errs = append(errs, errors.New("embedded JWKS has no keys"))
+		default:
+			public, err := jwk.PublicSetOf(b.embeddedJWKS)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("embedded JWKS: %w", err))
+			}
+			embedded = public
+		}
+		if b.jwksURL != "" {
+			errs = append(errs, errors.New("embedded JWKS cannot be combined with a JWKS URL"))
+		}
+		if b.introspectionURL != "" {
+			errs = append(errs, errors.New("embedded JWKS cannot be combined with introspection"))
+		}
+		if len(b.deprecatedIssuers) > 0 {
+			errs = append(errs, errors.New("embedded JWKS cannot be combined with deprecated issuers, which fetch their own JWKS"))
+		}
+	}
+	if b.discoveryTTL < 0 {
+		errs = append(errs, fmt.Errorf("discovery TTL must not be negative: %s", b.discoveryTTL))
+	}
+	if b.leeway < 0 {
+		errs = append(errs, fmt.Errorf("leeway must not be negative: %s", b.leeway))
+	}
+	for _, alg := range b.algorithms {
+		if !supportedAlgorithms[alg] {
+			errs = append(errs, fmt.Errorf("unsupported algorithm: %q", alg))
+		}
+	}
+	for _, claim := range b.requiredClaims {
+		if strings.TrimSpace(claim) == "" {
+			errs = append(errs, errors.New("required claim names must not be empty"))
+			break
+		}
+	}
+	if b.introspectionURL != "" {
+		if err := validateURL(b.introspectionURL); err != nil {
+			errs = append(errs, fmt.Errorf("introspection URL: %w", err))
+		}
+		if b.introspectionClientID == "" {
+			errs = append(errs, errors.New("introspection requires a client ID"))
+		}
+	}
+	if b.cacheMaxEntries != 0 || b.cacheMaxStaleness != 0 {
+		if b.introspectionURL == "" {
+			errs = append(errs, errors.New("introspection cache requires an introspection endpoint"))
+		}
+		if b.cacheMaxEntries <= 0 {
+			errs = append(errs, fmt.Errorf("introspection cache size must be positive: %d", b.cacheMaxEntries))
+		}
+		if b.cacheMaxStaleness <= 0 {
+			errs = append(errs, fmt.Errorf("introspection cache staleness must be positive: %s", b.cacheMaxStaleness))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid authenticator configuration: %w", errors.Join(errs...))
+	}
+
+	auth := NewAuthenticator(b.issuerURL)
+	if b.httpClient != nil {
+		auth.HTTPClient = b.httpClient
+	}
+	auth.jwksURL = b.jwksURL
+	if b.discoveryTTL > 0 {
+		auth.discovery.ttl = b.discoveryTTL
+	}
+	auth.requiredClaims = append([]string(nil), b.requiredClaims...)
+	auth.algorithms = append([]string(nil), b.algorithms...)
+	auth.issuer = b.issuer
+	auth.audience = b.audience
+	auth.leeway = b.leeway
+	auth.requireAccessTokenType = b.requireAccessTokenType
+	auth.requireProofOfPossession = b.requireProofOfPossession
+	if b.refreshTokenFormatSet {
+		auth.refreshTokenFormat = b.refreshTokenFormat
+	}
+	auth.deprecatedIssuers = newDeprecatedIssuers(b.deprecatedIssuers, auth)
+	if embedded != nil {
+		auth.jwks = embedded
+		auth.embeddedJWKS = true
+	}
+	if b.introspectionURL != "" {
+		auth.introspection = &introspectionConfig{
+			url:          b.introspectionURL,
+			clientID:     b.introspectionClientID,
+			clientSecret: b.introspectionClientSecret,
+		}
+		if b.cacheMaxEntries > 0 {
+			auth.introspection.cache = newIntrospectionCache(b.cacheMaxEntries, b.cacheMaxStaleness)
+		}
+	}
+
+	return auth, nil
+}
+
+// validateURL requires an absolute http(s) URL
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an absolute http(s) URL, got %q", raw)
+	}
+	return nil
+}
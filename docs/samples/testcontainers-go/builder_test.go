@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticatorBuilder(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).
+		RequireClaims("aud", "sub").
+		ExpectedIssuer("https://issuer.example").
+		ExpectedAudience("my-api").
+		AllowedAlgorithms("RS256").
+		Leeway(time.Minute).
+		JWKSURL(issuer.server.URL + "/.well-known/jwks.json").
+		Build()
+	require.NoError(t, err)
+
+	claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{
+		"sub": "user1",
+		"aud": "my-api",
+		"iss": "https://issuer.example",
+		// Expired, but within the configured leeway
+		"exp": time.Now().Add(-30 * time.Second).Unix(),
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+}
+
+func TestAuthenticatorBuilderMissingRequiredClaim(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).RequireClaims("aud", "sub").Build()
+	require.NoError(t, err)
+
+	_, err = auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.Error(t, err)
+
+	var verifyErr *VerifyError
+	require.ErrorAs(t, err, &verifyErr)
+	assert.Equal(t, FailureMissingClaim, verifyErr.Reason)
+	assert.Contains(t, err.Error(), `"aud"`)
+}
+
+func TestAuthenticatorBuilderAudienceMismatch(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).ExpectedAudience("my-api").Build()
+	require.NoError(t, err)
+
+	_, err = auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1", "aud": "other-api"}))
+	assert.Error(t, err)
+}
+
+func TestAuthenticatorBuilderDisallowedAlgorithm(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).AllowedAlgorithms("PS256").Build()
+	require.NoError(t, err)
+
+	_, err = auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.Error(t, err)
+
+	var verifyErr *VerifyError
+	require.ErrorAs(t, err, &verifyErr)
+	assert.Equal(t, FailureUnsupportedAlg, verifyErr.Reason)
+}
+
+// oneKeySet returns a JWKS holding a single RSA public key
+func oneKeySet() jwk.Set {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pub, _ := jwk.FromRaw(&key.PublicKey)
+	set := jwk.NewSet()
+	set.AddKey(pub)
+	return set
+}
+
+func TestAuthenticatorBuilderValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *AuthenticatorBuilder
+	}{
+		{"relative issuer", NewAuthenticatorBuilder("localhost:3000")},
+		{"invalid JWKS URL", NewAuthenticatorBuilder("http://localhost:3000").JWKSURL("/jwks.json")},
+		{"negative leeway", NewAuthenticatorBuilder("http://localhost:3000").Leeway(-time.Second)},
+		{"negative discovery TTL", NewAuthenticatorBuilder("http://localhost:3000").DiscoveryTTL(-time.Second)},
+		{"unsupported algorithm", NewAuthenticatorBuilder("http://localhost:3000").AllowedAlgorithms("none")},
+		{"empty claim", NewAuthenticatorBuilder("http://localhost:3000").RequireClaims("")},
+		{"empty embedded JWKS", NewAuthenticatorBuilder("http://localhost:3000").EmbeddedJWKS(jwk.NewSet())},
+		{"nil embedded JWKS", NewAuthenticatorBuilder("http://localhost:3000").EmbeddedJWKS(nil)},
+		{"embedded JWKS with JWKS URL", NewAuthenticatorBuilder("http://localhost:3000").EmbeddedJWKS(oneKeySet()).JWKSURL("http://localhost:3000/jwks.json")},
+		{"embedded JWKS with introspection", NewAuthenticatorBuilder("http://localhost:3000").EmbeddedJWKS(oneKeySet()).Introspection("http://localhost:3000/introspect", "api", "secret")},
+		{"embedded JWKS with deprecated issuer", NewAuthenticatorBuilder("http://localhost:3000").EmbeddedJWKS(oneKeySet()).DeprecatedIssuers("http://old.example.com")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := tt.builder.Build()
+			assert.Error(t, err)
+			assert.Nil(t, auth)
+		})
+	}
+}
+
+func TestAuthenticatorBuilderMultiAudience(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).ExpectedAudience("https://billing.example.com").Build()
+	require.NoError(t, err)
+
+	claims, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{
+		"sub": "user1",
+		"aud": []string{"https://api.example.com", "https://billing.example.com"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+
+	_, err = auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{
+		"sub": "user1",
+		"aud": []string{"https://api.example.com", "https://other.example.com"},
+	}))
+	assert.Error(t, err)
+
+	// A single audience is serialized as a string
+	_, err = auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1", "aud": "https://billing.example.com"}))
+	assert.NoError(t, err)
+}
+
+func TestAuthenticatorBuilderAudienceClaimForms(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).ExpectedAudience("my-api").Build()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		aud   interface{}
+		valid bool
+	}{
+		{"string", "my-api", true},
+		{"other string", "other-api", false},
+		{"array containing the audience", []interface{}{"other-api", "my-api"}, true},
+		{"array missing the audience", []interface{}{"other-api", "third-api"}, false},
+		{"empty array", []interface{}{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1", "aud": tt.aud}))
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorBuilderRequireAccessTokenType(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	issuer := newTestIssuer(t)
+
+	auth, err := NewAuthenticatorBuilder(issuer.server.URL).RequireAccessTokenType().Build()
+	require.NoError(t, err)
+
+	previous := authenticator
+	authenticator = auth
+	t.Cleanup(func() { authenticator = previous })
+
+	call := func(token string) int {
+		router := gin.New()
+		router.GET("/", AuthMiddleware(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("access token is accepted", func(t *testing.T) {
+		token := issuer.signWithType(t, "at+jwt", jwt.MapClaims{"sub": "user1", "scope": "read"})
+		assert.Equal(t, http.StatusOK, call(token))
+
+		token = issuer.signWithType(t, "application/AT+JWT", jwt.MapClaims{"sub": "user1"})
+		assert.Equal(t, http.StatusOK, call(token))
+	})
+
+	t.Run("id_token is rejected", func(t *testing.T) {
+		token := issuer.sign(t, jwt.MapClaims{"sub": "user1", "aud": "client1", "nonce": "n"})
+		assert.Equal(t, http.StatusUnauthorized, call(token))
+
+		_, err := auth.Verify(context.Background(), token)
+		var verifyErr *VerifyError
+		require.ErrorAs(t, err, &verifyErr)
+		assert.Equal(t, FailureInvalidType, verifyErr.Reason)
+	})
+
+	t.Run("token without typ is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, call(issuer.signWithType(t, "", jwt.MapClaims{"sub": "user1"})))
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		_, err := issuer.authenticator().Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+		require.NoError(t, err)
+	})
+}
+
+func TestAuthenticatorRejectsRefreshTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	issuer := newTestIssuer(t)
+	refreshToken := strings.Repeat("3f", 32)
+
+	t.Run("verify reports the specific reason", func(t *testing.T) {
+		auth := issuer.authenticator()
+		var reasons []string
+		auth.OnVerifyFailure = func(reason string, _ *http.Request) {
+			reasons = append(reasons, reason)
+		}
+
+		_, err := auth.VerifyRequest(httptest.NewRequest(http.MethodGet, "/", nil), refreshToken)
+
+		var verifyErr *VerifyError
+		require.ErrorAs(t, err, &verifyErr)
+		assert.Equal(t, FailureRefreshToken, verifyErr.Reason)
+		assert.ErrorIs(t, err, errRefreshTokenPresented)
+		assert.Equal(t, []string{FailureRefreshToken}, reasons)
+	})
+
+	t.Run("middleware names the mistake", func(t *testing.T) {
+		previous := authenticator
+		authenticator = issuer.authenticator()
+		t.Cleanup(func() { authenticator = previous })
+
+		router := gin.New()
+		router.GET("/", AuthMiddleware(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+refreshToken)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "refresh token presented as an access token")
+	})
+
+	t.Run("prefixed refresh tokens are recognized", func(t *testing.T) {
+		auth := issuer.authenticator()
+
+		_, err := auth.Verify(context.Background(), "ngauth_rt_"+refreshToken)
+		var verifyErr *VerifyError
+		require.ErrorAs(t, err, &verifyErr)
+		assert.Equal(t, FailureRefreshToken, verifyErr.Reason)
+	})
+
+	t.Run("access tokens and other garbage are unaffected", func(t *testing.T) {
+		auth := issuer.authenticator()
+
+		_, err := auth.Verify(context.Background(), issuer.sign(t, jwt.MapClaims{"sub": "user1"}))
+		assert.NoError(t, err)
+
+		// Too short to be an ngauth refresh token
+		_, err = auth.Verify(context.Background(), "3f3f3f3f")
+		var verifyErr *VerifyError
+		require.ErrorAs(t, err, &verifyErr)
+		assert.Equal(t, FailureMalformed, verifyErr.Reason)
+	})
+
+	t.Run("format is configurable", func(t *testing.T) {
+		custom, err := NewAuthenticatorBuilder(issuer.server.URL).RefreshTokenFormat(regexp.MustCompile(`^rt_`)).Build()
+		require.NoError(t, err)
+
+		_, err = custom.Verify(context.Background(), "rt_abc")
+		var verifyErr *VerifyError
+		require.ErrorAs(t, err, &verifyErr)
+		assert.Equal(t, FailureRefreshToken, verifyErr.Reason)
+
+		disabled, err := NewAuthenticatorBuilder(issuer.server.URL).RefreshTokenFormat(nil).Build()
+		require.NoError(t, err)
+
+		_, err = disabled.Verify(context.Background(), refreshToken)
+		require.ErrorAs(t, err, &verifyErr)
+		assert.Equal(t, FailureMalformed, verifyErr.Reason)
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRefreshBefore is how long before expiry a cached token is replaced
+	defaultRefreshBefore = 30 * time.Second
+
+	// defaultClientTokenLifetime is assumed when the token response carries
+	// no expires_in
+	defaultClientTokenLifetime = time.Minute
+)
+
+var errNoTokenEndpoint = errors.New("discovery document has no usable token_endpoint")
+
+// TokenEndpointError is an error response from the token endpoint
+// (RFC 6749 5.2), or a response that was not a usable token
+type TokenEndpointError struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *TokenEndpointError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("token endpoint returned status %d", e.StatusCode)
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("token endpoint: %s (status %d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("token endpoint: %s: %s (status %d)", e.Code, e.Description, e.StatusCode)
+}
+
+// ClientCredentials obtains access tokens with the client_credentials grant
+// (RFC 6749 4.4) for calls this service makes to other services. The token
+// is cached and replaced RefreshBefore its expiry. It is safe for concurrent
+// use: callers that find no usable token wait for a single token request.
+//
+//	creds := NewClientCredentials(issuerURL+"/token", "my-api", secret, "orders:read")
+//	client := creds.Client(nil)
+//	resp, err := client.Get("https://orders.internal/api/orders")
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// RefreshBefore is how long before expiry the token is replaced; tokens
+	// living less than twice as long are replaced halfway through
+	RefreshBefore time.Duration
+	// HTTPClient makes the token requests; http.DefaultClient when nil
+	HTTPClient *http.Client
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	refreshAt time.Time
+}
+
+// NewClientCredentials creates a token source for the given token endpoint
+// and client, authenticating with client_secret_basic
+func NewClientCredentials(tokenURL, clientID, clientSecret string, scopes ...string) *ClientCredentials {
+	return &ClientCredentials{
+		TokenURL:      tokenURL,
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		Scopes:        scopes,
+		RefreshBefore: defaultRefreshBefore,
+		now:           time.Now,
+	}
+}
+
+// ClientCredentialsFromDiscovery creates a token source for the
+// token_endpoint named in the issuer's discovery document, so a server
+// mounted under a base path or with a custom token path needs no extra
+// configuration
+func ClientCredentialsFromDiscovery(ctx context.Context, issuerURL, clientID, clientSecret string, scopes ...string) (*ClientCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuerURL, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery returned status %d", errNoTokenEndpoint, resp.StatusCode)
+	}
+	var discovery struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNoTokenEndpoint, err)
+	}
+	if err := validateURL(discovery.TokenEndpoint); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNoTokenEndpoint, err)
+	}
+	return NewClientCredentials(discovery.TokenEndpoint, clientID, clientSecret, scopes...), nil
+}
+
+// Token returns a cached access token, requesting a new one when it is due
+// for refresh. When the refresh fails but the cached token has not expired
+// yet, the cached token is returned and the next call tries again.
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.token != "" && now.Before(c.refreshAt) {
+		return c.token, nil
+	}
+
+	token, lifetime, err := c.requestToken(ctx)
+	if err != nil {
+		if c.token != "" && now.Before(c.expiresAt) {
+			return c.token, nil
+		}
+		return "", err
+	}
+
+	refreshBefore := c.RefreshBefore
+	if refreshBefore > lifetime/2 {
+		refreshBefore = lifetime / 2
+	}
+	c.token = token
+	c.expiresAt = now.Add(lifetime)
+	c.refreshAt = c.expiresAt.Add(-refreshBefore)
+	return c.token, nil
+}
+
+// Invalidate drops the cached token, e.g. after a service rejected it
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+// requestToken performs the client_credentials token request
+func (c *ClientCredentials) requestToken(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, &TokenEndpointError{StatusCode: resp.StatusCode, Code: body.Error, Description: body.ErrorDescription}
+	}
+	if decodeErr != nil || body.AccessToken == "" {
+		return "", 0, &TokenEndpointError{StatusCode: resp.StatusCode, Code: "invalid_response", Description: "no access_token in the response"}
+	}
+	if !strings.EqualFold(body.TokenType, "Bearer") {
+		return "", 0, &TokenEndpointError{StatusCode: resp.StatusCode, Code: "invalid_response", Description: fmt.Sprintf("unsupported token_type %q", body.TokenType)}
+	}
+
+	lifetime := time.Duration(body.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultClientTokenLifetime
+	}
+	return body.AccessToken, lifetime, nil
+}
+
+// Client returns an http.Client whose requests carry the access token.
+// base sends the requests; http.DefaultTransport when nil.
+func (c *ClientCredentials) Client(base http.RoundTripper) *http.Client {
+	return &http.Client{Transport: c.Transport(base)}
+}
+
+// Transport returns an http.RoundTripper that sets the Authorization header
+// of each request to the current access token. A 401 response drops the
+// cached token so the next request fetches a new one; the request itself
+// is not retried, as its body may already be consumed.
+func (c *ClientCredentials) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &clientCredentialsTransport{source: c, base: base}
+}
+
+type clientCredentialsTransport struct {
+	source *ClientCredentials
+	base   http.RoundTripper
+}
+
+func (t *clientCredentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.Token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the caller's request
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := t.base.RoundTrip(authorized)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.source.Invalidate()
+	}
+	return resp, err
+}
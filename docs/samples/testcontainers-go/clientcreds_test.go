@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTokenEndpoint is a fake token endpoint issuing numbered
+// client_credentials tokens, or failing while fail is set
+type testTokenEndpoint struct {
+	server *httptest.Server
+	calls  atomic.Int64
+	fail   atomic.Bool
+
+	expiresIn int64
+	scopes    chan string
+}
+
+func newTestTokenEndpoint(tb testing.TB, expiresIn int64) *testTokenEndpoint {
+	e := &testTokenEndpoint{expiresIn: expiresIn, scopes: make(chan string, 100)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if id, secret, ok := r.BasicAuth(); !ok || id != "svc" || secret != "svc-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": "Invalid client credentials"})
+			return
+		}
+		if e.fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.PostFormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+			return
+		}
+		e.scopes <- r.PostFormValue("scope")
+
+		n := e.calls.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   e.expiresIn,
+		})
+	})
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token_endpoint": e.server.URL + "/token"})
+	})
+	e.server = httptest.NewServer(mux)
+	tb.Cleanup(e.server.Close)
+
+	return e
+}
+
+// testClock is a settable time source
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// serveAuthorization starts a service that echoes the Authorization header
+// it receives, answering 401 to the tokens in rejected
+func serveAuthorization(tb testing.TB, rejected ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		for _, token := range rejected {
+			if header == "Bearer "+token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		fmt.Fprint(w, header)
+	}))
+	tb.Cleanup(server.Close)
+	return server
+}
+
+func getBody(t *testing.T, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestClientCredentialsAttachesAndRefreshesToken(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t, 300)
+	service := serveAuthorization(t)
+	clock := &testClock{now: time.Now()}
+
+	creds := NewClientCredentials(endpoint.server.URL+"/token", "svc", "svc-secret", "orders:read", "orders:write")
+	creds.now = clock.Now
+	client := creds.Client(nil)
+
+	assert.Equal(t, "Bearer token-1", getBody(t, client, service.URL))
+	assert.Equal(t, "orders:read orders:write", <-endpoint.scopes)
+
+	// Cached until RefreshBefore the expiry
+	clock.Advance(4 * time.Minute)
+	assert.Equal(t, "Bearer token-1", getBody(t, client, service.URL))
+	assert.Equal(t, int64(1), endpoint.calls.Load())
+
+	clock.Advance(31 * time.Second)
+	assert.Equal(t, "Bearer token-2", getBody(t, client, service.URL))
+
+	// Well past expiry
+	clock.Advance(time.Hour)
+	assert.Equal(t, "Bearer token-3", getBody(t, client, service.URL))
+	assert.Equal(t, int64(3), endpoint.calls.Load())
+}
+
+func TestClientCredentialsShortLivedTokens(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t, 20)
+	clock := &testClock{now: time.Now()}
+	creds := NewClientCredentials(endpoint.server.URL+"/token", "svc", "svc-secret")
+	creds.now = clock.Now
+
+	first, err := creds.Token(context.Background())
+	require.NoError(t, err)
+
+	// A 20s token is replaced after 10s rather than never cached
+	clock.Advance(9 * time.Second)
+	cached, err := creds.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, first, cached)
+
+	clock.Advance(2 * time.Second)
+	refreshed, err := creds.Token(context.Background())
+	require.NoError(t, err)
+	assert.NotEqual(t, first, refreshed)
+}
+
+func TestClientCredentialsConcurrentCallers(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t, 300)
+	creds := NewClientCredentials(endpoint.server.URL+"/token", "svc", "svc-secret")
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := creds.Token(context.Background())
+			assert.NoError(t, err)
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), endpoint.calls.Load())
+	for _, token := range tokens {
+		assert.Equal(t, "token-1", token)
+	}
+}
+
+func TestClientCredentialsTokenEndpointErrors(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t, 300)
+	service := serveAuthorization(t)
+
+	t.Run("error response", func(t *testing.T) {
+		creds := NewClientCredentials(endpoint.server.URL+"/token", "svc", "wrong-secret")
+
+		_, err := creds.Client(nil).Get(service.URL)
+
+		var tokenErr *TokenEndpointError
+		require.True(t, errors.As(err, &tokenErr))
+		assert.Equal(t, http.StatusUnauthorized, tokenErr.StatusCode)
+		assert.Equal(t, "invalid_client", tokenErr.Code)
+		assert.Equal(t, "Invalid client credentials", tokenErr.Description)
+	})
+
+	t.Run("cached token outlives a failed refresh", func(t *testing.T) {
+		clock := &testClock{now: time.Now()}
+		creds := NewClientCredentials(endpoint.server.URL+"/token", "svc", "svc-secret")
+		creds.now = clock.Now
+
+		first, err := creds.Token(context.Background())
+		require.NoError(t, err)
+
+		endpoint.fail.Store(true)
+		defer endpoint.fail.Store(false)
+
+		// Due for refresh but not expired: keep using it
+		clock.Advance(280 * time.Second)
+		token, err := creds.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, first, token)
+
+		// Expired: the failure surfaces
+		clock.Advance(time.Minute)
+		_, err = creds.Token(context.Background())
+		var tokenErr *TokenEndpointError
+		require.True(t, errors.As(err, &tokenErr))
+		assert.Equal(t, http.StatusServiceUnavailable, tokenErr.StatusCode)
+
+		// Recovered
+		endpoint.fail.Store(false)
+		token, err = creds.Token(context.Background())
+		require.NoError(t, err)
+		assert.NotEqual(t, first, token)
+	})
+
+	t.Run("unreachable endpoint", func(t *testing.T) {
+		creds := NewClientCredentials("http://127.0.0.1:1/token", "svc", "svc-secret")
+
+		_, err := creds.Token(context.Background())
+		assert.ErrorContains(t, err, "token request failed")
+	})
+}
+
+func TestClientCredentialsRejectedTokenIsReplaced(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t, 300)
+	service := serveAuthorization(t, "token-1")
+	creds := NewClientCredentials(endpoint.server.URL+"/token", "svc", "svc-secret")
+	client := creds.Client(nil)
+
+	resp, err := client.Get(service.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	assert.Equal(t, "Bearer token-2", getBody(t, client, service.URL))
+}
+
+func TestClientCredentialsFromDiscovery(t *testing.T) {
+	endpoint := newTestTokenEndpoint(t, 300)
+
+	creds, err := ClientCredentialsFromDiscovery(context.Background(), endpoint.server.URL, "svc", "svc-secret")
+	require.NoError(t, err)
+	assert.Equal(t, endpoint.server.URL+"/token", creds.TokenURL)
+
+	token, err := creds.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	_, err = ClientCredentialsFromDiscovery(context.Background(), serveAuthorization(t).URL, "svc", "svc-secret")
+	assert.ErrorIs(t, err, errNoTokenEndpoint)
+}
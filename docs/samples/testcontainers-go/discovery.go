@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultDiscoveryTTL bounds how long a discovery document is reused
+	// when the server does not ask for less with Cache-Control
+	defaultDiscoveryTTL = time.Hour
+
+	// discoveryRetryInterval is how long a stale document stays in use after
+	// a failed revalidation before the next attempt
+	discoveryRetryInterval = time.Minute
+)
+
+var errDiscoveryUnusable = errors.New("unusable discovery document")
+
+// discoveryCache remembers the jwks_uri from the issuer's discovery document.
+// It is only consulted when the JWKS is refetched, so a cached document that
+// still validates tokens causes no requests at all. Guarded by Authenticator.mu.
+type discoveryCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	jwksURI   string
+	expiresAt time.Time
+}
+
+func newDiscoveryCache(ttl time.Duration) *discoveryCache {
+	return &discoveryCache{ttl: ttl, now: time.Now}
+}
+
+func (c *discoveryCache) fresh() bool {
+	return c.jwksURI != "" && c.now().Before(c.expiresAt)
+}
+
+func (c *discoveryCache) store(jwksURI string, ttl time.Duration) {
+	c.jwksURI = jwksURI
+	c.expiresAt = c.now().Add(ttl)
+}
+
+// resolveJWKSURL returns the configured JWKS URL, else the jwks_uri from the
+// issuer's discovery document, else <issuer>/.well-known/jwks.json. Discovery
+// keeps working when the server is mounted under a base path or uses a custom
+// JWKS path. The document is cached for the discovery TTL or its
+// Cache-Control max-age, whichever is shorter, and then revalidated so a
+// changed jwks_uri is picked up. When revalidation fails the stale jwks_uri
+// stays in use and is retried after discoveryRetryInterval. Called with a.mu held.
+func (a *Authenticator) resolveJWKSURL(ctx context.Context) string {
+	if a.jwksURL != "" {
+		return a.jwksURL
+	}
+
+	cache := a.discovery
+	if cache.fresh() {
+		return cache.jwksURI
+	}
+
+	fallback := fmt.Sprintf("%s/.well-known/jwks.json", a.IssuerURL)
+	jwksURI, maxAge, err := a.fetchDiscovery(ctx)
+	switch {
+	case err == nil:
+		cache.store(jwksURI, min(cache.ttl, maxAge))
+	case cache.jwksURI != "":
+		// Keep validating with the stale document rather than refetching on every miss
+		cache.store(cache.jwksURI, min(cache.ttl, discoveryRetryInterval))
+	case errors.Is(err, errDiscoveryUnusable):
+		// No usable discovery document: use the conventional location until revalidation
+		cache.store(fallback, cache.ttl)
+	default:
+		// Failed in transit: nothing is cached and the next refresh retries
+		return fallback
+	}
+	return cache.jwksURI
+}
+
+// fetchDiscovery reads jwks_uri and the cache lifetime from the issuer's
+// discovery document. maxAge is the TTL ceiling when the response sets no
+// usable Cache-Control.
+func (a *Authenticator) fetchDiscovery(ctx context.Context) (jwksURI string, maxAge time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.IssuerURL+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("%w: status %d", errDiscoveryUnusable, resp.StatusCode)
+	}
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return "", 0, fmt.Errorf("%w: %w", errDiscoveryUnusable, err)
+	}
+	if err := validateURL(discovery.JWKSURI); err != nil {
+		return "", 0, fmt.Errorf("%w: jwks_uri %w", errDiscoveryUnusable, err)
+	}
+
+	maxAge = a.discovery.ttl
+	if cacheMaxAge, ok := parseCacheMaxAge(resp.Header.Get("Cache-Control")); ok {
+		maxAge = cacheMaxAge
+	}
+	return discovery.JWKSURI, maxAge, nil
+}
+
+// parseCacheMaxAge returns the lifetime a Cache-Control header allows:
+// max-age, or zero for no-cache and no-store
+func parseCacheMaxAge(header string) (time.Duration, bool) {
+	maxAge, found := time.Duration(0), false
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0, true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+				maxAge, found = time.Duration(seconds)*time.Second, true
+			}
+		}
+	}
+	return maxAge, found
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDiscoveryServer publishes a discovery document whose jwks_uri points
+// at one of two key sets and can be switched or broken at runtime
+type testDiscoveryServer struct {
+	server  *httptest.Server
+	fetches atomic.Int64
+
+	mu           sync.Mutex
+	jwksPath     string
+	cacheControl string
+	status       int
+}
+
+func newTestDiscoveryServer(t *testing.T, keysA, keysB *testIssuer) *testDiscoveryServer {
+	d := &testDiscoveryServer{jwksPath: "/keys-a", status: http.StatusOK}
+	bodyA, bodyB := marshalJWKS(t, keysA), marshalJWKS(t, keysB)
+
+	mux := http.NewServeMux()
+	d.server = httptest.NewServer(mux)
+	t.Cleanup(d.server.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		d.fetches.Add(1)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.cacheControl != "" {
+			w.Header().Set("Cache-Control", d.cacheControl)
+		}
+		w.WriteHeader(d.status)
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": d.server.URL + d.jwksPath})
+	})
+	mux.HandleFunc("/keys-a", func(w http.ResponseWriter, r *http.Request) { w.Write(bodyA) })
+	mux.HandleFunc("/keys-b", func(w http.ResponseWriter, r *http.Request) { w.Write(bodyB) })
+
+	return d
+}
+
+func (d *testDiscoveryServer) set(update func(d *testDiscoveryServer)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	update(d)
+}
+
+// newDiscoveryIssuers returns two issuers with distinct keys and kids
+func newDiscoveryIssuers(t *testing.T) (*testIssuer, *testIssuer) {
+	keyA, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyB, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return &testIssuer{key: keyA, kid: "key-a"}, &testIssuer{key: keyB, kid: "key-b"}
+}
+
+// fakeClock lets a test move the discovery cache's notion of time
+func fakeClock(auth *Authenticator) *time.Time {
+	now := time.Now()
+	auth.discovery.now = func() time.Time { return now }
+	return &now
+}
+
+func TestDiscoveryDocumentIsCached(t *testing.T) {
+	issuerA, issuerB := newDiscoveryIssuers(t)
+	discovery := newTestDiscoveryServer(t, issuerA, issuerB)
+	auth := NewAuthenticator(discovery.server.URL)
+
+	// Every token with an unknown kid refetches the JWKS, but the
+	// discovery document is reused within its TTL
+	for n := 0; n < 3; n++ {
+		_, err := auth.Verify(context.Background(), issuerB.sign(t, jwt.MapClaims{"sub": "user1"}))
+		require.Error(t, err)
+	}
+	_, err := auth.Verify(context.Background(), issuerA.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), discovery.fetches.Load())
+}
+
+func TestDiscoveryPicksUpChangedJWKSURIAfterTTL(t *testing.T) {
+	issuerA, issuerB := newDiscoveryIssuers(t)
+	discovery := newTestDiscoveryServer(t, issuerA, issuerB)
+	auth, err := NewAuthenticatorBuilder(discovery.server.URL).DiscoveryTTL(10 * time.Minute).Build()
+	require.NoError(t, err)
+	now := fakeClock(auth)
+
+	_, err = auth.Verify(context.Background(), issuerA.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+
+	// The server moves its keys; within the TTL the old jwks_uri is still used
+	discovery.set(func(d *testDiscoveryServer) { d.jwksPath = "/keys-b" })
+	*now = now.Add(9 * time.Minute)
+	_, err = auth.Verify(context.Background(), issuerB.sign(t, jwt.MapClaims{"sub": "user1"}))
+	var verifyErr *VerifyError
+	require.True(t, errors.As(err, &verifyErr))
+	assert.Equal(t, FailureUnknownKID, verifyErr.Reason)
+
+	// Past the TTL the document is revalidated and the new keys are found
+	*now = now.Add(2 * time.Minute)
+	claims, err := auth.Verify(context.Background(), issuerB.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+	assert.Equal(t, int64(2), discovery.fetches.Load())
+}
+
+func TestDiscoveryHonorsCacheControlMaxAge(t *testing.T) {
+	issuerA, issuerB := newDiscoveryIssuers(t)
+	discovery := newTestDiscoveryServer(t, issuerA, issuerB)
+	discovery.set(func(d *testDiscoveryServer) { d.cacheControl = "public, max-age=60" })
+	auth := NewAuthenticator(discovery.server.URL)
+	now := fakeClock(auth)
+
+	_, err := auth.Verify(context.Background(), issuerA.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+
+	discovery.set(func(d *testDiscoveryServer) { d.jwksPath = "/keys-b" })
+	*now = now.Add(61 * time.Second)
+	_, err = auth.Verify(context.Background(), issuerB.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), discovery.fetches.Load())
+}
+
+func TestDiscoveryKeepsStaleDocumentWhenRevalidationFails(t *testing.T) {
+	issuerA, issuerB := newDiscoveryIssuers(t)
+	discovery := newTestDiscoveryServer(t, issuerA, issuerB)
+	auth := NewAuthenticator(discovery.server.URL)
+	now := fakeClock(auth)
+
+	_, err := auth.Verify(context.Background(), issuerA.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+
+	// Discovery breaks after the TTL: the stale jwks_uri keeps serving keys
+	// and revalidation is not retried on every JWKS refresh
+	discovery.set(func(d *testDiscoveryServer) { d.status = http.StatusServiceUnavailable })
+	*now = now.Add(defaultDiscoveryTTL + time.Second)
+	for n := 0; n < 3; n++ {
+		_, err := auth.Verify(context.Background(), issuerB.sign(t, jwt.MapClaims{"sub": "user1"}))
+		require.Error(t, err)
+	}
+	assert.Equal(t, int64(2), discovery.fetches.Load())
+	assert.Equal(t, discovery.server.URL+"/keys-a", auth.discovery.jwksURI)
+
+	// Once the retry interval has passed and discovery recovers, it is used again
+	discovery.set(func(d *testDiscoveryServer) {
+		d.status = http.StatusOK
+		d.jwksPath = "/keys-b"
+	})
+	*now = now.Add(discoveryRetryInterval + time.Second)
+	_, err = auth.Verify(context.Background(), issuerB.sign(t, jwt.MapClaims{"sub": "user1"}))
+	require.NoError(t, err)
+}
+
+func TestParseCacheMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"public", 0, false},
+		{"public, max-age=300", 300 * time.Second, true},
+		{"Max-Age=\"60\"", 60 * time.Second, true},
+		{"max-age=300, no-cache", 0, true},
+		{"no-store", 0, true},
+		{"max-age=-1", 0, false},
+	}
+
+	for _, tt := range tests {
+		maxAge, ok := parseCacheMaxAge(tt.header)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.maxAge, maxAge, tt.header)
+	}
+}
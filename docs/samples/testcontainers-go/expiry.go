@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ExpiresInHeader carries the remaining token lifetime in whole seconds on
+// responses to tokens that are about to expire, hinting the client to
+// refresh before its next call fails
+const ExpiresInHeader = "X-Token-Expires-In"
+
+// TokenLifetime is the remaining validity of a verified token
+type TokenLifetime struct {
+	ExpiresAt time.Time
+	// Remaining is time.Until(ExpiresAt), negative once expired
+	Remaining time.Duration
+	// NearExpiry reports whether Remaining is within the threshold
+	NearExpiry bool
+}
+
+// RemainingLifetime returns the remaining validity of a token from its
+// verified claims. The server may shorten the whole token when a
+// short-lived scope is granted, so read exp rather than assume the
+// configured access token TTL. ok is false when the claims carry no exp.
+func RemainingLifetime(claims jwt.MapClaims, threshold time.Duration) (lifetime TokenLifetime, ok bool) {
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return TokenLifetime{}, false
+	}
+
+	remaining := time.Until(exp.Time)
+	return TokenLifetime{
+		ExpiresAt:  exp.Time,
+		Remaining:  remaining,
+		NearExpiry: remaining <= threshold,
+	}, true
+}
+
+// ExpiryHint sets ExpiresInHeader when the token's remaining lifetime is
+// within threshold. Use it after AuthMiddleware, or pass WithExpiryHint to
+// AuthMiddleware instead. It never changes the auth decision.
+func ExpiryHint(threshold time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if claimsInterface, exists := c.Get("claims"); exists {
+			setExpiryHint(c, claimsInterface.(jwt.MapClaims), threshold)
+		}
+		c.Next()
+	}
+}
+
+// setExpiryHint adds ExpiresInHeader, exposed to cross-origin scripts, when
+// the token is within threshold of expiring
+func setExpiryHint(c *gin.Context, claims jwt.MapClaims, threshold time.Duration) {
+	lifetime, ok := RemainingLifetime(claims, threshold)
+	if !ok || !lifetime.NearExpiry {
+		return
+	}
+
+	seconds := int64(lifetime.Remaining / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	c.Header(ExpiresInHeader, strconv.FormatInt(seconds, 10))
+	// SPAs on another origin can only read headers listed here
+	c.Writer.Header().Add("Access-Control-Expose-Headers", ExpiresInHeader)
+}
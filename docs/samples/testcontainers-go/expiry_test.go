@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemainingLifetime(t *testing.T) {
+	t.Run("far from expiry", func(t *testing.T) {
+		exp := time.Now().Add(time.Hour)
+		lifetime, ok := RemainingLifetime(jwt.MapClaims{"exp": float64(exp.Unix())}, 5*time.Minute)
+
+		require.True(t, ok)
+		assert.Equal(t, exp.Unix(), lifetime.ExpiresAt.Unix())
+		assert.InDelta(t, time.Hour.Seconds(), lifetime.Remaining.Seconds(), 2)
+		assert.False(t, lifetime.NearExpiry)
+	})
+
+	t.Run("within the threshold", func(t *testing.T) {
+		lifetime, ok := RemainingLifetime(jwt.MapClaims{"exp": float64(time.Now().Add(2 * time.Minute).Unix())}, 5*time.Minute)
+
+		require.True(t, ok)
+		assert.InDelta(t, (2 * time.Minute).Seconds(), lifetime.Remaining.Seconds(), 2)
+		assert.True(t, lifetime.NearExpiry)
+	})
+
+	t.Run("no exp claim", func(t *testing.T) {
+		_, ok := RemainingLifetime(jwt.MapClaims{"sub": "user1"}, 5*time.Minute)
+		assert.False(t, ok)
+	})
+}
+
+func TestExpiryHint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	serve := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			c.Set("claims", claims)
+			c.Next()
+		}, ExpiryHint(5*time.Minute), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	far := serve(jwt.MapClaims{"exp": float64(time.Now().Add(time.Hour).Unix())})
+	assert.Equal(t, http.StatusOK, far.Code)
+	assert.Empty(t, far.Header().Get(ExpiresInHeader))
+
+	near := serve(jwt.MapClaims{"exp": float64(time.Now().Add(90 * time.Second).Unix())})
+	assert.Equal(t, http.StatusOK, near.Code)
+	seconds, err := strconv.Atoi(near.Header().Get(ExpiresInHeader))
+	require.NoError(t, err)
+	assert.InDelta(t, 90, seconds, 2)
+}
+
+func TestAuthMiddlewareExpiryHint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	issuer := newTestIssuer(t)
+
+	previous := authenticator
+	authenticator = issuer.authenticator()
+	t.Cleanup(func() { authenticator = previous })
+
+	call := func(token string, opts ...AuthOption) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/", AuthMiddleware(opts...), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	nearToken := issuer.sign(t, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(time.Minute).Unix()})
+	farToken := issuer.sign(t, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+
+	t.Run("near-expiry token gets the hint", func(t *testing.T) {
+		w := call(nearToken, WithExpiryHint(2*time.Minute))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		seconds, err := strconv.Atoi(w.Header().Get(ExpiresInHeader))
+		require.NoError(t, err)
+		assert.InDelta(t, 60, seconds, 2)
+		assert.Equal(t, ExpiresInHeader, w.Header().Get("Access-Control-Expose-Headers"))
+	})
+
+	t.Run("token far from expiry gets no hint", func(t *testing.T) {
+		w := call(farToken, WithExpiryHint(2*time.Minute))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get(ExpiresInHeader))
+	})
+
+	t.Run("no hint unless enabled", func(t *testing.T) {
+		w := call(nearToken)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get(ExpiresInHeader))
+	})
+
+	t.Run("rejected token gets no hint", func(t *testing.T) {
+		expired := issuer.sign(t, jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(-time.Minute).Unix()})
+		w := call(expired, WithExpiryHint(2*time.Minute))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Empty(t, w.Header().Get(ExpiresInHeader))
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// claimsRecordingHealthServer captures the claims seen by the handler
+type claimsRecordingHealthServer struct {
+	*health.Server
+	claims jwt.MapClaims
+}
+
+func (s *claimsRecordingHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.claims, _ = ClaimsFromContext(ctx)
+	return s.Server.Check(ctx, req)
+}
+
+func startGRPCServer(t *testing.T, auth *Authenticator, scopes MethodScopes) (healthpb.HealthClient, *claimsRecordingHealthServer) {
+	listener := bufconn.Listen(1024 * 1024)
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(scopes)),
+		grpc.StreamInterceptor(auth.StreamServerInterceptor(scopes)),
+	)
+	healthServer := &claimsRecordingHealthServer{Server: health.NewServer()}
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return healthpb.NewHealthClient(conn), healthServer
+}
+
+func withBearer(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCUnaryValidToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, healthServer := startGRPCServer(t, issuer.authenticator(), MethodScopes{
+		"/grpc.health.v1.Health/Check": "read",
+	})
+
+	token := issuer.sign(t, jwt.MapClaims{"sub": "user1", "scope": "read write"})
+	resp, err := client.Check(withBearer(token), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	assert.Equal(t, "user1", healthServer.claims["sub"])
+}
+
+func TestGRPCUnaryLowercaseScheme(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, _ := startGRPCServer(t, issuer.authenticator(), nil)
+
+	token := issuer.sign(t, jwt.MapClaims{"sub": "user1"})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token)
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+}
+
+func TestGRPCUnaryMissingToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, _ := startGRPCServer(t, issuer.authenticator(), nil)
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGRPCUnaryInsufficientScope(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, _ := startGRPCServer(t, issuer.authenticator(), MethodScopes{
+		"/grpc.health.v1.Health/Check": "read",
+	})
+
+	token := issuer.sign(t, jwt.MapClaims{"sub": "user1", "scope": "write"})
+	_, err := client.Check(withBearer(token), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestGRPCStreamValidToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, _ := startGRPCServer(t, issuer.authenticator(), MethodScopes{
+		"/grpc.health.v1.Health/Watch": "read",
+	})
+
+	token := issuer.sign(t, jwt.MapClaims{"sub": "user1", "scope": "read"})
+	stream, err := client.Watch(withBearer(token), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestGRPCStreamMissingToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, _ := startGRPCServer(t, issuer.authenticator(), nil)
+
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGRPCStreamInsufficientScope(t *testing.T) {
+	issuer := newTestIssuer(t)
+	client, _ := startGRPCServer(t, issuer.authenticator(), MethodScopes{
+		"/grpc.health.v1.Health/Watch": "admin",
+	})
+
+	token := issuer.sign(t, jwt.MapClaims{"sub": "user1", "scope": "read"})
+	stream, err := client.Watch(withBearer(token), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	errInactiveToken            = errors.New("token is not active")
+	errIntrospectionUnavailable = errors.New("introspection request failed")
+)
+
+// introspectionConfig holds the RFC 7662 endpoint and client credentials used
+// when an Authenticator verifies tokens by introspection instead of locally
+type introspectionConfig struct {
+	url          string
+	clientID     string
+	clientSecret string
+	cache        *introspectionCache
+}
+
+// introspect asks the authorization server whether the token is active and
+// returns the introspection response as claims. Active results are served
+// from the cache when one is configured.
+func (a *Authenticator) introspect(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	cfg := a.introspection
+	key := tokenHash(tokenString)
+
+	if cfg.cache != nil {
+		if claims, ok := cfg.cache.get(key); ok {
+			return claims, nil
+		}
+	}
+
+	claims, err := a.requestIntrospection(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	active, _ := claims["active"].(bool)
+	if !active {
+		// Drop any cached result so revocations take effect immediately
+		if cfg.cache != nil {
+			cfg.cache.remove(key)
+		}
+		return nil, &VerifyError{Reason: FailureInactive, Err: errInactiveToken}
+	}
+
+	// Apply the same exp/nbf/iss/aud policy as locally verified tokens
+	if err := jwt.NewValidator(a.parserOptions()...).Validate(claims); err != nil {
+		return nil, &VerifyError{Reason: classifyFailure(err), Err: fmt.Errorf("invalid introspection result: %w", err)}
+	}
+
+	// Results without exp are never cached: there is no safe upper bound
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil && cfg.cache != nil {
+		cfg.cache.put(key, claims, exp.Time)
+	}
+
+	return claims, nil
+}
+
+// requestIntrospection performs the RFC 7662 request
+func (a *Authenticator) requestIntrospection(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	cfg := a.introspection
+	form := url.Values{"token": {tokenString}, "token_type_hint": {"access_token"}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, &VerifyError{Reason: FailureIntrospectionUnavailable, Err: fmt.Errorf("%w: %w", errIntrospectionUnavailable, err)}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cfg.clientID), url.QueryEscape(cfg.clientSecret))
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return nil, &VerifyError{Reason: FailureIntrospectionUnavailable, Err: fmt.Errorf("%w: %w", errIntrospectionUnavailable, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &VerifyError{Reason: FailureIntrospectionUnavailable, Err: fmt.Errorf("%w: unexpected status %d", errIntrospectionUnavailable, resp.StatusCode)}
+	}
+
+	var claims jwt.MapClaims
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, &VerifyError{Reason: FailureIntrospectionUnavailable, Err: fmt.Errorf("%w: %w", errIntrospectionUnavailable, err)}
+	}
+	return claims, nil
+}
+
+// tokenHash keys the cache so raw tokens are never held in memory longer than needed
+func tokenHash(tokenString string) string {
+	sum := sha256.Sum256([]byte(tokenString))
+	return hex.EncodeToString(sum[:])
+}
+
+// introspectionCache is a bounded LRU of active introspection results. An
+// entry lives until the token's exp or maxStaleness after it was fetched,
+// whichever comes first, so a revoked token keeps validating for at most
+// maxStaleness.
+type introspectionCache struct {
+	maxEntries   int
+	maxStaleness time.Duration
+	now          func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+type introspectionEntry struct {
+	key       string
+	claims    jwt.MapClaims
+	expiresAt time.Time
+}
+
+func newIntrospectionCache(maxEntries int, maxStaleness time.Duration) *introspectionCache {
+	return &introspectionCache{
+		maxEntries:   maxEntries,
+		maxStaleness: maxStaleness,
+		now:          time.Now,
+		order:        list.New(),
+		entries:      make(map[string]*list.Element),
+	}
+}
+
+func (c *introspectionCache) get(key string) (jwt.MapClaims, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*introspectionEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.claims, true
+}
+
+func (c *introspectionCache) put(key string, claims jwt.MapClaims, exp time.Time) {
+	expiresAt := c.now().Add(c.maxStaleness)
+	if exp.Before(expiresAt) {
+		expiresAt = exp
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &introspectionEntry{key: key, claims: claims, expiresAt: expiresAt}
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&introspectionEntry{key: key, claims: claims, expiresAt: expiresAt})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*introspectionEntry).key)
+	}
+}
+
+func (c *introspectionCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *introspectionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIntrospector is a fake RFC 7662 endpoint that treats every token as
+// active until it is revoked
+type testIntrospector struct {
+	server *httptest.Server
+	calls  atomic.Int64
+
+	mu      sync.Mutex
+	revoked map[string]bool
+	exp     time.Time
+}
+
+func newTestIntrospector(tb testing.TB) *testIntrospector {
+	i := &testIntrospector{revoked: map[string]bool{}, exp: time.Now().Add(time.Hour)}
+
+	i.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.calls.Add(1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "api" || secret != "api-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		token := r.PostFormValue("token")
+		i.mu.Lock()
+		active := !i.revoked[token]
+		exp := i.exp
+		i.mu.Unlock()
+
+		body := map[string]interface{}{"active": false}
+		if active {
+			body = map[string]interface{}{"active": true, "sub": "user-" + token, "scope": "read", "exp": exp.Unix()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}))
+	tb.Cleanup(i.server.Close)
+
+	return i
+}
+
+func (i *testIntrospector) revoke(token string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.revoked[token] = true
+}
+
+func (i *testIntrospector) authenticator(tb testing.TB, cacheSize int, staleness time.Duration) *Authenticator {
+	builder := NewAuthenticatorBuilder(i.server.URL).Introspection(i.server.URL+"/introspect", "api", "api-secret")
+	if cacheSize > 0 {
+		builder.IntrospectionCache(cacheSize, staleness)
+	}
+	auth, err := builder.Build()
+	require.NoError(tb, err)
+	return auth
+}
+
+func TestIntrospectionVerify(t *testing.T) {
+	introspector := newTestIntrospector(t)
+	auth := introspector.authenticator(t, 0, 0)
+
+	claims, err := auth.Verify(context.Background(), "token-1")
+	require.NoError(t, err)
+	assert.Equal(t, "user-token-1", claims["sub"])
+
+	introspector.revoke("token-1")
+	_, err = auth.Verify(context.Background(), "token-1")
+	var verifyErr *VerifyError
+	require.True(t, errors.As(err, &verifyErr))
+	assert.Equal(t, FailureInactive, verifyErr.Reason)
+}
+
+func TestIntrospectionCacheServesActiveResults(t *testing.T) {
+	introspector := newTestIntrospector(t)
+	auth := introspector.authenticator(t, 10, time.Minute)
+
+	for n := 0; n < 3; n++ {
+		_, err := auth.Verify(context.Background(), "token-1")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(1), introspector.calls.Load())
+}
+
+func TestIntrospectionRevokedTokenStopsValidatingWithinStaleness(t *testing.T) {
+	introspector := newTestIntrospector(t)
+	auth := introspector.authenticator(t, 10, 30*time.Second)
+
+	now := time.Now()
+	auth.introspection.cache.now = func() time.Time { return now }
+
+	_, err := auth.Verify(context.Background(), "token-1")
+	require.NoError(t, err)
+
+	// Within the staleness window the cached result is still served
+	introspector.revoke("token-1")
+	now = now.Add(29 * time.Second)
+	_, err = auth.Verify(context.Background(), "token-1")
+	require.NoError(t, err)
+
+	// Past it the token is introspected again and rejected
+	now = now.Add(2 * time.Second)
+	_, err = auth.Verify(context.Background(), "token-1")
+	var verifyErr *VerifyError
+	require.True(t, errors.As(err, &verifyErr))
+	assert.Equal(t, FailureInactive, verifyErr.Reason)
+
+	// The negative result is not cached
+	_, err = auth.Verify(context.Background(), "token-1")
+	require.Error(t, err)
+	assert.Equal(t, int64(3), introspector.calls.Load())
+	assert.Equal(t, 0, auth.introspection.cache.len())
+}
+
+func TestIntrospectionCacheNeverServesPastExp(t *testing.T) {
+	introspector := newTestIntrospector(t)
+	introspector.exp = time.Now().Add(5 * time.Second)
+	auth := introspector.authenticator(t, 10, time.Hour)
+
+	now := time.Now()
+	auth.introspection.cache.now = func() time.Time { return now }
+
+	_, err := auth.Verify(context.Background(), "token-1")
+	require.NoError(t, err)
+
+	now = now.Add(6 * time.Second)
+	_, err = auth.Verify(context.Background(), "token-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), introspector.calls.Load())
+}
+
+func TestIntrospectionCacheIsBounded(t *testing.T) {
+	introspector := newTestIntrospector(t)
+	auth := introspector.authenticator(t, 2, time.Minute)
+
+	for _, token := range []string{"token-1", "token-2", "token-3"} {
+		_, err := auth.Verify(context.Background(), token)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, auth.introspection.cache.len())
+
+	// token-1 was the least recently used and has been evicted
+	_, err := auth.Verify(context.Background(), "token-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), introspector.calls.Load())
+}
+
+func TestIntrospectionAudienceClaimForms(t *testing.T) {
+	tests := []struct {
+		name  string
+		aud   interface{}
+		valid bool
+	}{
+		{"string", "my-api", true},
+		{"array containing the audience", []string{"other-api", "my-api"}, true},
+		{"array missing the audience", []string{"other-api", "third-api"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user1", "aud": tt.aud})
+			}))
+			defer server.Close()
+
+			auth, err := NewAuthenticatorBuilder(server.URL).
+				Introspection(server.URL+"/introspect", "api", "api-secret").
+				ExpectedAudience("my-api").
+				Build()
+			require.NoError(t, err)
+
+			_, err = auth.Verify(context.Background(), "token-1")
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				var verifyErr *VerifyError
+				require.ErrorAs(t, err, &verifyErr)
+				assert.Equal(t, FailureAudienceMismatch, verifyErr.Reason)
+			}
+		})
+	}
+}
+
+func TestIntrospectionBuilderValidation(t *testing.T) {
+	_, err := NewAuthenticatorBuilder("http://localhost:3000").
+		IntrospectionCache(10, time.Minute).
+		Build()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requires an introspection endpoint")
+
+	_, err = NewAuthenticatorBuilder("http://localhost:3000").
+		Introspection("http://localhost:3000/introspect", "api", "secret").
+		IntrospectionCache(0, 0).
+		Build()
+	require.NoError(t, err)
+
+	_, err = NewAuthenticatorBuilder("http://localhost:3000").
+		Introspection("http://localhost:3000/introspect", "api", "secret").
+		IntrospectionCache(-1, time.Minute).
+		Build()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cache size must be positive")
+}
+
+func BenchmarkIntrospectionVerify(b *testing.B) {
+	for _, cacheSize := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("cache=%d", cacheSize), func(b *testing.B) {
+			introspector := newTestIntrospector(b)
+			auth := introspector.authenticator(b, cacheSize, time.Minute)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := auth.Verify(ctx, "token-1"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
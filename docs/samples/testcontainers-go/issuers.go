@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newDeprecatedIssuers returns an Authenticator per deprecated issuer, keyed
+// by iss. Each one discovers and caches its own issuer's JWKS; only its key
+// lookup is used.
+func newDeprecatedIssuers(issuers []string, parent *Authenticator) map[string]*Authenticator {
+	if len(issuers) == 0 {
+		return nil
+	}
+	keySources := make(map[string]*Authenticator, len(issuers))
+	for _, iss := range issuers {
+		source := NewAuthenticator(iss)
+		source.HTTPClient = parent.HTTPClient
+		source.discovery.ttl = parent.discovery.ttl
+		keySources[iss] = source
+	}
+	return keySources
+}
+
+// keySource returns the Authenticator whose JWKS holds the token's signing
+// key: the deprecated issuer named by the (not yet verified) iss claim, or a
+// itself. The choice only selects keys; a forged iss cannot pass the
+// signature check with another issuer's keys.
+func (a *Authenticator) keySource(token *jwt.Token) *Authenticator {
+	if len(a.deprecatedIssuers) == 0 {
+		return a
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	iss, _ := claims["iss"].(string)
+	if source, ok := a.deprecatedIssuers[iss]; ok {
+		return source
+	}
+	return a
+}
+
+// checkIssuer accepts the expected issuer and, during a migration, the
+// deprecated ones, reporting each use of a deprecated issuer. It stands in
+// for jwt.WithIssuer when deprecated issuers are configured.
+func (a *Authenticator) checkIssuer(claims jwt.MapClaims) error {
+	if len(a.deprecatedIssuers) == 0 {
+		return nil
+	}
+	iss, _ := claims["iss"].(string)
+	if _, ok := a.deprecatedIssuers[iss]; ok {
+		a.reportDeprecatedIssuer(iss)
+		return nil
+	}
+	if a.issuer != "" && iss != a.issuer {
+		return &VerifyError{Reason: FailureInvalidToken, Err: fmt.Errorf("%w: %q", jwt.ErrTokenInvalidIssuer, iss)}
+	}
+	return nil
+}
+
+// reportDeprecatedIssuer invokes OnDeprecatedIssuer, or logs when it is not set
+func (a *Authenticator) reportDeprecatedIssuer(iss string) {
+	if a.OnDeprecatedIssuer != nil {
+		a.OnDeprecatedIssuer(iss)
+		return
+	}
+	log.Printf("accepted token from deprecated issuer %s", iss)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMigratingAuthenticator accepts current and, as deprecated, old, and
+// records the deprecated issuers it reports
+func newMigratingAuthenticator(t *testing.T, current, old *testIssuer) (*Authenticator, *[]string) {
+	auth, err := NewAuthenticatorBuilder(current.server.URL).
+		ExpectedIssuer(current.server.URL).
+		DeprecatedIssuers(old.server.URL).
+		Build()
+	require.NoError(t, err)
+
+	var reported []string
+	auth.OnDeprecatedIssuer = func(iss string) { reported = append(reported, iss) }
+	return auth, &reported
+}
+
+func TestDeprecatedIssuerTokensValidate(t *testing.T) {
+	current, old := newTestIssuer(t), newTestIssuer(t)
+	auth, reported := newMigratingAuthenticator(t, current, old)
+
+	claims, err := auth.Verify(context.Background(), current.sign(t, jwt.MapClaims{"sub": "user1", "iss": current.server.URL}))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims["sub"])
+	assert.Empty(t, *reported)
+
+	// Signed with the old issuer's key, found through the old issuer's JWKS
+	claims, err = auth.Verify(context.Background(), old.sign(t, jwt.MapClaims{"sub": "user2", "iss": old.server.URL}))
+	require.NoError(t, err)
+	assert.Equal(t, "user2", claims["sub"])
+	assert.Equal(t, []string{old.server.URL}, *reported)
+}
+
+func TestDeprecatedIssuerCannotBorrowKeys(t *testing.T) {
+	current, old := newTestIssuer(t), newTestIssuer(t)
+	// Both issuers publish kid test-key; a token claiming the old issuer is
+	// only checked against the old issuer's key
+	auth, _ := newMigratingAuthenticator(t, current, old)
+
+	_, err := auth.Verify(context.Background(), current.sign(t, jwt.MapClaims{"sub": "user1", "iss": old.server.URL}))
+	var verifyErr *VerifyError
+	require.True(t, errors.As(err, &verifyErr))
+	assert.Equal(t, FailureSignature, verifyErr.Reason)
+}
+
+func TestDeprecatedIssuerRejectsUnknownIssuer(t *testing.T) {
+	current, old := newTestIssuer(t), newTestIssuer(t)
+	auth, reported := newMigratingAuthenticator(t, current, old)
+
+	_, err := auth.Verify(context.Background(), current.sign(t, jwt.MapClaims{"sub": "user1", "iss": "https://other.example.com"}))
+	require.Error(t, err)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+	assert.Empty(t, *reported)
+}
+
+func TestDeprecatedIssuerRemovedAfterMigration(t *testing.T) {
+	current, old := newTestIssuer(t), newTestIssuer(t)
+	auth, err := NewAuthenticatorBuilder(current.server.URL).
+		ExpectedIssuer(current.server.URL).
+		Build()
+	require.NoError(t, err)
+
+	_, err = auth.Verify(context.Background(), old.sign(t, jwt.MapClaims{"sub": "user2", "iss": old.server.URL}))
+	require.Error(t, err)
+}
+
+func TestDeprecatedIssuerBuilderValidation(t *testing.T) {
+	_, err := NewAuthenticatorBuilder("http://localhost:3000").
+		DeprecatedIssuers("not a url").
+		Build()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "deprecated issuer")
+
+	_, err = NewAuthenticatorBuilder("http://localhost:3000").
+		DeprecatedIssuers("http://localhost:3000/").
+		Build()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "also the current issuer")
+}
@@ -1,22 +1,19 @@
 package main
 
 import (
-	"context"
-	"crypto/rsa"
-	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/lestrrat-go/jwx/v2/jwk"
 )
 
 var (
-	issuerURL string
-	jwksCache jwk.Set
+	issuerURL     string
+	authenticator *Authenticator
 )
 
 type DataItem struct {
@@ -40,90 +37,30 @@ func init() {
 	if issuerURL == "" {
 		issuerURL = "http://localhost:3000"
 	}
+	authenticator = NewAuthenticator(issuerURL)
 }
 
-// fetchJWKS fetches the JWKS from the OAuth server
-func fetchJWKS() (jwk.Set, error) {
-	jwksURL := fmt.Sprintf("%s/.well-known/jwks.json", issuerURL)
-	resp, err := http.Get(jwksURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// AuthOption configures AuthMiddleware
+type AuthOption func(*authOptions)
 
-	return jwk.Parse(resp.Body)
+type authOptions struct {
+	expiryHint time.Duration
 }
 
-// verifyToken validates the JWT token and returns the claims
-func verifyToken(tokenString string) (jwt.MapClaims, error) {
-	// Fetch JWKS if not cached
-	if jwksCache == nil {
-		var err error
-		jwksCache, err = fetchJWKS()
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
-		}
-	}
-
-	// Parse token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Verify signing method
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		// Get key ID from token header
-		kid, ok := token.Header["kid"].(string)
-		if !ok {
-			return nil, fmt.Errorf("kid not found in token header")
-		}
-
-		// Find the key in JWKS
-		key, found := jwksCache.LookupKeyID(kid)
-		if !found {
-			// Refresh JWKS cache and try again
-			jwksCache, err = fetchJWKS()
-			if err != nil {
-				return nil, fmt.Errorf("failed to refresh JWKS: %w", err)
-			}
-			key, found = jwksCache.LookupKeyID(kid)
-			if !found {
-				return nil, fmt.Errorf("key %s not found in JWKS", kid)
-			}
-		}
-
-		// Convert JWK to RSA public key
-		var rawKey interface{}
-		if err := key.Raw(&rawKey); err != nil {
-			return nil, fmt.Errorf("failed to get raw key: %w", err)
-		}
-
-		rsaKey, ok := rawKey.(*rsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("key is not RSA public key")
-		}
-
-		return rsaKey, nil
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse token: %w", err)
-	}
-
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("failed to parse claims")
-	}
-
-	return claims, nil
+// WithExpiryHint makes AuthMiddleware set ExpiresInHeader on requests whose
+// verified token expires within threshold, so clients can refresh early.
+// The hint never changes whether the request is authorized.
+func WithExpiryHint(threshold time.Duration) AuthOption {
+	return func(o *authOptions) { o.expiryHint = threshold }
 }
 
 // AuthMiddleware validates JWT tokens
-func AuthMiddleware() gin.HandlerFunc {
+func AuthMiddleware(opts ...AuthOption) gin.HandlerFunc {
+	var options authOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -132,24 +69,27 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Extract token from "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
+		// Extract token from "Bearer <token>" or "DPoP <token>"
+		tokenString, _, ok := authorizationToken(authHeader)
+		if !ok {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
 			c.Abort()
 			return
 		}
 
-		tokenString := parts[1]
-		claims, err := verifyToken(tokenString)
+		claims, err := authenticator.VerifyRequest(c.Request, tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Invalid token: %v", err)})
 			c.Abort()
 			return
 		}
 
-		// Store claims in context
+		// Store claims and token format version in context
 		c.Set("claims", claims)
+		c.Set("token_version", TokenVersion(claims))
+		if options.expiryHint > 0 {
+			setExpiryHint(c, claims, options.expiryHint)
+		}
 		c.Next()
 	}
 }
@@ -165,33 +105,66 @@ func RequireScope(requiredScope string) gin.HandlerFunc {
 		}
 
 		claims := claimsInterface.(jwt.MapClaims)
-		scope, ok := claims["scope"].(string)
-		if !ok {
+		if _, ok := grantedScopes(claims); !ok {
 			c.JSON(http.StatusForbidden, gin.H{"error": "No scope claim found"})
 			c.Abort()
 			return
 		}
 
-		scopes := strings.Split(scope, " ")
-		hasScope := false
-		for _, s := range scopes {
-			if s == requiredScope {
-				hasScope = true
-				break
-			}
+		if !hasScope(claims, requiredScope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Insufficient scope. Required: %s", requiredScope)})
+			c.Abort()
+			return
 		}
 
-		if !hasScope {
-			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Insufficient scope. Required: %s", requiredScope)})
+		c.Next()
+	}
+}
+
+// RestrictScopes narrows the token's scopes to allowed for the rest of the
+// route (see DownscopeClaims), so later RequireScope checks and handlers only
+// see that subset. Use it after AuthMiddleware.
+func RestrictScopes(allowed ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claimsInterface, exists := c.Get("claims")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "No claims found"})
 			c.Abort()
 			return
 		}
 
+		c.Set("claims", DownscopeClaims(claimsInterface.(jwt.MapClaims), allowed...))
 		c.Next()
 	}
 }
 
+// createData handles POST /api/data
+func createData(c *gin.Context) {
+	var item DataItem
+	if !BindJSON(c, &item) {
+		return
+	}
+
+	// Generate a simple ID
+	id := fmt.Sprintf("%d", len(item.Name)*1000+int(item.Name[0]))
+
+	c.JSON(http.StatusCreated, CreateResponse{
+		Message: fmt.Sprintf("Created item: %s", item.Name),
+		ID:      id,
+	})
+}
+
 func main() {
+	// Hint clients to refresh tokens expiring within TOKEN_EXPIRY_HINT (e.g. "2m")
+	var authOpts []AuthOption
+	if v := os.Getenv("TOKEN_EXPIRY_HINT"); v != "" {
+		threshold, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid TOKEN_EXPIRY_HINT: %v", err)
+		}
+		authOpts = append(authOpts, WithExpiryHint(threshold))
+	}
+
 	r := gin.Default()
 
 	// Health check
@@ -207,33 +180,19 @@ func main() {
 		})
 
 		// Protected endpoint - requires authentication
-		api.GET("/protected", AuthMiddleware(), func(c *gin.Context) {
+		api.GET("/protected", AuthMiddleware(authOpts...), func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"message": "This endpoint requires authentication"})
 		})
 
 		// Data endpoints - require specific scopes
-		api.GET("/data", AuthMiddleware(), RequireScope("read"), func(c *gin.Context) {
+		api.GET("/data", AuthMiddleware(authOpts...), RequireScope("read"), func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"data": []string{"item1", "item2", "item3"}})
 		})
 
-		api.POST("/data", AuthMiddleware(), RequireScope("write"), func(c *gin.Context) {
-			var item DataItem
-			if err := c.ShouldBindJSON(&item); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-
-			// Generate a simple ID
-			id := fmt.Sprintf("%d", len(item.Name)*1000+int(item.Name[0]))
-
-			c.JSON(http.StatusCreated, CreateResponse{
-				Message: fmt.Sprintf("Created item: %s", item.Name),
-				ID:      id,
-			})
-		})
+		api.POST("/data", AuthMiddleware(authOpts...), RequireScope("write"), createData)
 
 		// User info endpoint
-		api.GET("/userinfo", AuthMiddleware(), func(c *gin.Context) {
+		api.GET("/userinfo", AuthMiddleware(authOpts...), func(c *gin.Context) {
 			claimsInterface, _ := c.Get("claims")
 			claims := claimsInterface.(jwt.MapClaims)
 
@@ -253,10 +212,15 @@ func main() {
 		})
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	cfg, err := ServerConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid server configuration: %v", err)
+	}
+	srv, err := NewServer(r, cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure server: %v", err)
+	}
+	if err := ListenAndServe(srv); err != nil {
+		log.Fatal(err)
 	}
-
-	r.Run(fmt.Sprintf(":%s", port))
 }
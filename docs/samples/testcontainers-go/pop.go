@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+// dpopProofMaxAge bounds how far a DPoP proof's iat may be from now
+const dpopProofMaxAge = 5 * time.Minute
+
+var errProofMissing = errors.New("sender-constrained token presented without proof of possession")
+
+// authorizationToken extracts the access token from an Authorization header
+// using the Bearer or the DPoP scheme (RFC 9449 7.1), both matched
+// case-insensitively
+func authorizationToken(header string) (token, scheme string, ok bool) {
+	if token, ok := bearerToken(header); ok {
+		return token, "Bearer", true
+	}
+	scheme, token, ok = strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "DPoP") {
+		return "", "", false
+	}
+	token = strings.TrimSpace(token)
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", "", false
+	}
+	return token, "DPoP", true
+}
+
+// checkConfirmation enforces the cnf claim (RFC 7800) of a sender-constrained
+// token. The proof the request carries is checked: the mTLS client
+// certificate against x5t#S256 (RFC 8705 3) or the DPoP proof against jkt
+// (RFC 9449 7). Without any proof the token was presented as a plain bearer
+// token, which is only accepted when proof of possession is not required.
+// r is nil for gRPC calls, which carry no proof.
+func (a *Authenticator) checkConfirmation(r *http.Request, tokenString string, claims jwt.MapClaims) error {
+	dpopScheme := false
+	if r != nil {
+		_, scheme, _ := authorizationToken(r.Header.Get("Authorization"))
+		dpopScheme = scheme == "DPoP"
+	}
+
+	cnf, ok := claims["cnf"].(map[string]interface{})
+	if !ok {
+		if dpopScheme {
+			return &VerifyError{Reason: FailureProofInvalid, Err: errors.New("DPoP scheme used with a token that is not DPoP-bound")}
+		}
+		return nil
+	}
+
+	if x5t, ok := cnf["x5t#S256"].(string); ok && r != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(x5t)) != 1 {
+			return &VerifyError{Reason: FailureProofInvalid, Err: errors.New("client certificate does not match the token's x5t#S256 confirmation")}
+		}
+		return nil
+	}
+
+	if jkt, ok := cnf["jkt"].(string); ok && r != nil && r.Header.Get("DPoP") != "" {
+		if err := verifyDPoPProof(r, tokenString, jkt); err != nil {
+			return &VerifyError{Reason: FailureProofInvalid, Err: fmt.Errorf("invalid DPoP proof: %w", err)}
+		}
+		return nil
+	}
+
+	if a.requireProofOfPossession || dpopScheme {
+		return &VerifyError{Reason: FailureProofMissing, Err: errProofMissing}
+	}
+	return nil
+}
+
+// verifyDPoPProof checks the DPoP header of r (RFC 9449 4.3): a dpop+jwt
+// signed by the embedded public key whose thumbprint is jkt, for this
+// method and URL, recently issued and bound to the access token via ath.
+// Proof jti values are not tracked, so a captured proof can be replayed
+// within dpopProofMaxAge.
+func verifyDPoPProof(r *http.Request, tokenString, jkt string) error {
+	values := r.Header.Values("DPoP")
+	if len(values) != 1 {
+		return errors.New("exactly one DPoP header is required")
+	}
+	proof := []byte(values[0])
+
+	msg, err := jws.Parse(proof)
+	if err != nil {
+		return err
+	}
+	if len(msg.Signatures()) != 1 {
+		return errors.New("proof must have exactly one signature")
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+	if !strings.EqualFold(headers.Type(), "dpop+jwt") {
+		return fmt.Errorf("typ %q is not dpop+jwt", headers.Type())
+	}
+	alg := headers.Algorithm()
+	if alg == jwa.NoSignature || strings.HasPrefix(alg.String(), "HS") {
+		return fmt.Errorf("algorithm %s is not allowed", alg)
+	}
+	if headers.JWK() == nil {
+		return errors.New("proof carries no jwk header")
+	}
+	key, err := jwk.PublicKeyOf(headers.JWK())
+	if err != nil {
+		return err
+	}
+
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(thumbprint)), []byte(jkt)) != 1 {
+		return errors.New("proof key does not match the token's jkt confirmation")
+	}
+
+	payload, err := jws.Verify(proof, jws.WithKey(alg, key))
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		JTI string `json:"jti"`
+		HTM string `json:"htm"`
+		HTU string `json:"htu"`
+		IAT int64  `json:"iat"`
+		ATH string `json:"ath"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed proof claims: %w", err)
+	}
+
+	if claims.JTI == "" {
+		return errors.New("proof has no jti")
+	}
+	if claims.HTM != r.Method {
+		return fmt.Errorf("htm %q does not match the request method", claims.HTM)
+	}
+	if !sameTargetURI(claims.HTU, requestURI(r)) {
+		return fmt.Errorf("htu %q does not match the request URL", claims.HTU)
+	}
+	if age := time.Since(time.Unix(claims.IAT, 0)); age > dpopProofMaxAge || age < -dpopProofMaxAge {
+		return errors.New("proof iat is outside the accepted window")
+	}
+	ath := sha256.Sum256([]byte(tokenString))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(ath[:])), []byte(claims.ATH)) != 1 {
+		return errors.New("ath does not match the access token")
+	}
+	return nil
+}
+
+// requestURI reconstructs the URL the client called. Behind a proxy that
+// terminates TLS or rewrites the host, the proof's htu names the public URL,
+// which this cannot see.
+func requestURI(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path}
+}
+
+// sameTargetURI compares htu with the request URL ignoring query and
+// fragment, with case-insensitive scheme and host (RFC 9449 4.3)
+func sameTargetURI(htu string, target *url.URL) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, target.Scheme) && strings.EqualFold(u.Host, target.Host) && u.Path == target.Path
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDPoPKey is a client's DPoP key pair
+type testDPoPKey struct {
+	private jwk.Key
+	jkt     string
+}
+
+func newTestDPoPKey(t *testing.T) *testDPoPKey {
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	private, err := jwk.FromRaw(raw)
+	require.NoError(t, err)
+	public, err := jwk.PublicKeyOf(private)
+	require.NoError(t, err)
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	return &testDPoPKey{private: private, jkt: base64.RawURLEncoding.EncodeToString(thumbprint)}
+}
+
+// proof signs a DPoP proof for the request and access token, with overrides
+// applied to the proof claims
+func (k *testDPoPKey) proof(t *testing.T, method, htu, accessToken string, overrides map[string]interface{}) string {
+	ath := sha256.Sum256([]byte(accessToken))
+	claims := map[string]interface{}{
+		"jti": "proof-1",
+		"htm": method,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+		"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+	}
+	for name, value := range overrides {
+		claims[name] = value
+	}
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	public, err := jwk.PublicKeyOf(k.private)
+	require.NoError(t, err)
+	headers := jws.NewHeaders()
+	require.NoError(t, headers.Set(jws.TypeKey, "dpop+jwt"))
+	require.NoError(t, headers.Set(jws.JWKKey, public))
+
+	signed, err := jws.Sign(payload, jws.WithKey(jwa.ES256, k.private, jws.WithProtectedHeaders(headers)))
+	require.NoError(t, err)
+	return string(signed)
+}
+
+func TestProofOfPossession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	issuer := newTestIssuer(t)
+	dpopKey := newTestDPoPKey(t)
+
+	strict, err := NewAuthenticatorBuilder(issuer.server.URL).RequireProofOfPossession().Build()
+	require.NoError(t, err)
+	lenient := issuer.authenticator()
+
+	var reasons []string
+	strict.OnVerifyFailure = func(reason string, r *http.Request) { reasons = append(reasons, reason) }
+
+	call := func(auth *Authenticator, scheme, token, proof string, peer *x509.Certificate) int {
+		previous := authenticator
+		authenticator = auth
+		defer func() { authenticator = previous }()
+
+		router := gin.New()
+		router.GET("/api/data", AuthMiddleware(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://api.example.com/api/data?page=2", nil)
+		req.Header.Set("Authorization", scheme+" "+token)
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		if peer != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer}}
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	dpopBound := issuer.sign(t, jwt.MapClaims{"sub": "user1", "cnf": map[string]interface{}{"jkt": dpopKey.jkt}})
+	htu := "http://api.example.com/api/data"
+
+	t.Run("plain bearer presentation is rejected when strict", func(t *testing.T) {
+		reasons = nil
+		assert.Equal(t, http.StatusUnauthorized, call(strict, "Bearer", dpopBound, "", nil))
+		assert.Equal(t, []string{FailureProofMissing}, reasons)
+
+		_, err := strict.VerifyRequest(httptest.NewRequest(http.MethodGet, "/", nil), dpopBound)
+		var verifyErr *VerifyError
+		require.True(t, errors.As(err, &verifyErr))
+		assert.Equal(t, FailureProofMissing, verifyErr.Reason)
+	})
+
+	t.Run("plain bearer presentation is accepted when lenient", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(lenient, "Bearer", dpopBound, "", nil))
+	})
+
+	t.Run("tokens without cnf are unaffected", func(t *testing.T) {
+		plain := issuer.sign(t, jwt.MapClaims{"sub": "user1"})
+		assert.Equal(t, http.StatusOK, call(strict, "Bearer", plain, "", nil))
+	})
+
+	t.Run("valid DPoP proof is accepted", func(t *testing.T) {
+		proof := dpopKey.proof(t, http.MethodGet, htu, dpopBound, nil)
+		assert.Equal(t, http.StatusOK, call(strict, "DPoP", dpopBound, proof, nil))
+		assert.Equal(t, http.StatusOK, call(lenient, "DPoP", dpopBound, proof, nil))
+	})
+
+	t.Run("invalid DPoP proofs are rejected even when lenient", func(t *testing.T) {
+		otherKey := newTestDPoPKey(t)
+		tests := []struct {
+			name  string
+			proof string
+		}{
+			{"other key", otherKey.proof(t, http.MethodGet, htu, dpopBound, nil)},
+			{"wrong method", dpopKey.proof(t, http.MethodPost, htu, dpopBound, nil)},
+			{"wrong URL", dpopKey.proof(t, http.MethodGet, "http://api.example.com/api/other", dpopBound, nil)},
+			{"stale", dpopKey.proof(t, http.MethodGet, htu, dpopBound, map[string]interface{}{"iat": time.Now().Add(-time.Hour).Unix()})},
+			{"other access token", dpopKey.proof(t, http.MethodGet, htu, "another-token", nil)},
+			{"not a JWS", "not-a-proof"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				reasons = nil
+				assert.Equal(t, http.StatusUnauthorized, call(strict, "DPoP", dpopBound, tt.proof, nil))
+				assert.Equal(t, []string{FailureProofInvalid}, reasons)
+				assert.Equal(t, http.StatusUnauthorized, call(lenient, "DPoP", dpopBound, tt.proof, nil))
+			})
+		}
+	})
+
+	t.Run("DPoP scheme needs a proof", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, call(lenient, "DPoP", dpopBound, "", nil))
+	})
+
+	t.Run("mTLS-bound token checks the client certificate", func(t *testing.T) {
+		cert := &x509.Certificate{Raw: []byte("client certificate")}
+		sum := sha256.Sum256(cert.Raw)
+		mtlsBound := issuer.sign(t, jwt.MapClaims{"sub": "user1", "cnf": map[string]interface{}{"x5t#S256": base64.RawURLEncoding.EncodeToString(sum[:])}})
+
+		assert.Equal(t, http.StatusOK, call(strict, "Bearer", mtlsBound, "", cert))
+		assert.Equal(t, http.StatusUnauthorized, call(strict, "Bearer", mtlsBound, "", &x509.Certificate{Raw: []byte("other certificate")}))
+		assert.Equal(t, http.StatusUnauthorized, call(strict, "Bearer", mtlsBound, "", nil))
+		assert.Equal(t, http.StatusOK, call(lenient, "Bearer", mtlsBound, "", nil))
+	})
+}
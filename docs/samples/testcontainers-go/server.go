@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ServerConfig configures the API listener. TLS is required unless PlainHTTP
+// is set; HTTP/2 is negotiated over TLS through ALPN.
+type ServerConfig struct {
+	Addr string
+
+	// PEM certificate chain and private key
+	CertFile string
+	KeyFile  string
+
+	// TLSConfig, if set, is used as the base configuration, e.g. with
+	// certificates loaded elsewhere or a GetCertificate callback. It is
+	// cloned, never modified.
+	TLSConfig *tls.Config
+
+	// MinTLSVersion is the oldest protocol version accepted, tls.VersionTLS12
+	// when zero. Versions before TLS 1.2 are refused.
+	MinTLSVersion uint16
+
+	// PlainHTTP serves HTTP/1.1 without TLS. Only use it behind a trusted
+	// proxy that terminates TLS: bearer tokens would otherwise cross the
+	// network in the clear.
+	PlainHTTP bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ServerConfigFromEnv reads PORT, TLS_CERT_FILE, TLS_KEY_FILE,
+// TLS_MIN_VERSION ("1.2" or "1.3") and PLAIN_HTTP_BEHIND_PROXY
+func ServerConfigFromEnv() (ServerConfig, error) {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000"
+	}
+	cfg := ServerConfig{
+		Addr:     ":" + port,
+		CertFile: os.Getenv("TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("TLS_KEY_FILE"),
+	}
+
+	if v := os.Getenv("TLS_MIN_VERSION"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return ServerConfig{}, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", v)
+		}
+		cfg.MinTLSVersion = version
+	}
+
+	if v := os.Getenv("PLAIN_HTTP_BEHIND_PROXY"); v != "" {
+		plain, err := strconv.ParseBool(v)
+		if err != nil {
+			return ServerConfig{}, fmt.Errorf("PLAIN_HTTP_BEHIND_PROXY must be a boolean, got %q", v)
+		}
+		cfg.PlainHTTP = plain
+	}
+
+	return cfg, nil
+}
+
+// NewServer builds the HTTP server for handler. It fails on missing or
+// invalid TLS material instead of falling back to plain HTTP.
+func NewServer(handler http.Handler, cfg ServerConfig) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if cfg.PlainHTTP {
+		if cfg.CertFile != "" || cfg.KeyFile != "" || cfg.TLSConfig != nil {
+			return nil, errors.New("plain HTTP cannot be combined with TLS settings")
+		}
+		return srv, nil
+	}
+
+	minVersion := cfg.MinTLSVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	if minVersion < tls.VersionTLS12 {
+		return nil, fmt.Errorf("minimum TLS version %s is too old; use TLS 1.2 or later", tls.VersionName(minVersion))
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.MinVersion < minVersion {
+		tlsConfig.MinVersion = minVersion
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("TLS needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+		return nil, errors.New("TLS needs a certificate: set a certificate and key file or a tls.Config, or serve plain HTTP behind a terminating proxy")
+	}
+
+	// Offer HTTP/2 first, keeping HTTP/1.1 for older clients
+	for _, proto := range []string{"h2", "http/1.1"} {
+		if !slices.Contains(tlsConfig.NextProtos, proto) {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+		}
+	}
+
+	srv.TLSConfig = tlsConfig
+	return srv, nil
+}
+
+// ListenAndServe serves srv over TLS when it has a TLS configuration
+func ListenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key as PEM files, returning their paths and a pool trusting the certificate
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+// startTestServer serves srv on a random local port and returns its address
+func startTestServer(t *testing.T, srv *http.Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	if srv.TLSConfig != nil {
+		go srv.ServeTLS(ln, "", "")
+	} else {
+		go srv.Serve(ln)
+	}
+	return ln.Addr().String()
+}
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+}
+
+// tlsClient trusts roots and negotiates HTTP/2 when the server offers it
+func tlsClient(roots *x509.CertPool, minVersion, maxVersion uint16) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:    roots,
+				MinVersion: minVersion,
+				MaxVersion: maxVersion,
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+}
+
+func TestServerServesHTTP2OverTLS(t *testing.T) {
+	certFile, keyFile, roots := writeTestCertificate(t)
+	srv, err := NewServer(protoHandler(), ServerConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	addr := startTestServer(t, srv)
+
+	resp, err := tlsClient(roots, 0, 0).Get("https://" + addr + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, 2, resp.ProtoMajor)
+	require.NotNil(t, resp.TLS)
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+	assert.GreaterOrEqual(t, resp.TLS.Version, uint16(tls.VersionTLS12))
+}
+
+func TestServerRejectsProtocolsBelowMinimum(t *testing.T) {
+	certFile, keyFile, roots := writeTestCertificate(t)
+
+	t.Run("default minimum is TLS 1.2", func(t *testing.T) {
+		srv, err := NewServer(protoHandler(), ServerConfig{CertFile: certFile, KeyFile: keyFile})
+		require.NoError(t, err)
+		addr := startTestServer(t, srv)
+
+		_, err = tlsClient(roots, tls.VersionTLS10, tls.VersionTLS11).Get("https://" + addr + "/")
+		assert.Error(t, err)
+
+		resp, err := tlsClient(roots, tls.VersionTLS12, tls.VersionTLS12).Get("https://" + addr + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, uint16(tls.VersionTLS12), resp.TLS.Version)
+	})
+
+	t.Run("configured minimum TLS 1.3", func(t *testing.T) {
+		srv, err := NewServer(protoHandler(), ServerConfig{CertFile: certFile, KeyFile: keyFile, MinTLSVersion: tls.VersionTLS13})
+		require.NoError(t, err)
+		addr := startTestServer(t, srv)
+
+		_, err = tlsClient(roots, tls.VersionTLS12, tls.VersionTLS12).Get("https://" + addr + "/")
+		assert.Error(t, err)
+
+		resp, err := tlsClient(roots, 0, 0).Get("https://" + addr + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+	})
+}
+
+func TestServerUsesProvidedTLSConfig(t *testing.T) {
+	certFile, keyFile, roots := writeTestCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	base := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS10}
+	srv, err := NewServer(protoHandler(), ServerConfig{TLSConfig: base})
+	require.NoError(t, err)
+
+	// The minimum version is raised on a copy
+	assert.Equal(t, uint16(tls.VersionTLS12), srv.TLSConfig.MinVersion)
+	assert.Equal(t, uint16(tls.VersionTLS10), base.MinVersion)
+	assert.Empty(t, base.NextProtos)
+
+	addr := startTestServer(t, srv)
+	resp, err := tlsClient(roots, 0, 0).Get("https://" + addr + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+}
+
+func TestServerFailsOnInvalidTLSMaterial(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t)
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a certificate"), 0o600))
+
+	tests := []struct {
+		name string
+		cfg  ServerConfig
+		want string
+	}{
+		{"no certificate", ServerConfig{}, "TLS needs a certificate"},
+		{"missing key file", ServerConfig{CertFile: certFile}, "both a certificate and a key file"},
+		{"unreadable certificate", ServerConfig{CertFile: filepath.Join(t.TempDir(), "missing.pem"), KeyFile: keyFile}, "failed to load TLS certificate"},
+		{"malformed certificate", ServerConfig{CertFile: garbage, KeyFile: keyFile}, "failed to load TLS certificate"},
+		{"mismatched key", ServerConfig{CertFile: keyFile, KeyFile: certFile}, "failed to load TLS certificate"},
+		{"minimum below TLS 1.2", ServerConfig{CertFile: certFile, KeyFile: keyFile, MinTLSVersion: tls.VersionTLS11}, "too old"},
+		{"plain HTTP with TLS settings", ServerConfig{CertFile: certFile, KeyFile: keyFile, PlainHTTP: true}, "cannot be combined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := NewServer(protoHandler(), tt.cfg)
+			assert.Nil(t, srv)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestServerPlainHTTPBehindProxy(t *testing.T) {
+	srv, err := NewServer(protoHandler(), ServerConfig{PlainHTTP: true})
+	require.NoError(t, err)
+	assert.Nil(t, srv.TLSConfig)
+	addr := startTestServer(t, srv)
+
+	resp, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor)
+}
+
+func TestServerConfigFromEnv(t *testing.T) {
+	t.Setenv("PORT", "8443")
+	t.Setenv("TLS_CERT_FILE", "/certs/tls.crt")
+	t.Setenv("TLS_KEY_FILE", "/certs/tls.key")
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	t.Setenv("PLAIN_HTTP_BEHIND_PROXY", "")
+
+	cfg, err := ServerConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, ServerConfig{Addr: ":8443", CertFile: "/certs/tls.crt", KeyFile: "/certs/tls.key", MinTLSVersion: tls.VersionTLS13}, cfg)
+
+	t.Setenv("TLS_MIN_VERSION", "1.1")
+	_, err = ServerConfigFromEnv()
+	assert.ErrorContains(t, err, "TLS_MIN_VERSION")
+
+	t.Setenv("TLS_MIN_VERSION", "")
+	t.Setenv("PLAIN_HTTP_BEHIND_PROXY", "maybe")
+	_, err = ServerConfigFromEnv()
+	assert.ErrorContains(t, err, "PLAIN_HTTP_BEHIND_PROXY")
+}
@@ -300,6 +300,31 @@ describe('OAuth 2.0 Integration Tests with ngauth', () => {
       // Accept 400 (validation error) or 429 (rate limited)
       expect([400, 429]).toContain(response.status)
     })
+
+    test('should identify the issuer in authorization responses', async () => {
+      const discovery = await (await fetch(`${baseUrl}/.well-known/openid-configuration`)).json()
+      expect(discovery.authorization_response_iss_parameter_supported).toBe(true)
+
+      const params = new URLSearchParams({
+        response_type: 'code',
+        client_id: client.client_id,
+        redirect_uri: 'http://localhost:3001/callback',
+        scope: 'openid',
+        state: 'random_state',
+        prompt: 'none'
+      })
+
+      const response = await fetch(`${baseUrl}/authorize?${params}`, {
+        redirect: 'manual'
+      })
+      expect(response.status).toBe(302)
+
+      // Clients must check iss against the issuer they sent the user to
+      // before using the response (RFC 9207 2.4)
+      const location = new URL(response.headers.get('location'))
+      expect(location.searchParams.get('iss')).toBe(discovery.issuer)
+      expect(location.searchParams.get('error')).toBe('login_required')
+    })
   })
 
   describe('Error Handling', () => {
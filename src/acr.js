@@ -0,0 +1,133 @@
+/**
+ * Authentication context (acr/amr) and step-up
+ *
+ * A session records the methods the user authenticated with (amr, RFC 8176).
+ * Clients ask for a stronger context with acr_values; when the session falls
+ * short, the user completes only the missing factor instead of logging in
+ * again.
+ */
+
+const crypto = require('crypto')
+
+// Supported acr values, weakest first, with the methods each requires
+const ACR_LEVELS = [
+  { acr: 'urn:ngauth:acr:pwd', amr: ['pwd'] },
+  { acr: 'urn:ngauth:acr:mfa', amr: ['pwd', 'otp'] }
+]
+
+const ACR_VALUES = ACR_LEVELS.map(level => level.acr)
+
+const satisfies = (amr, level) => level.amr.every(method => amr.includes(method))
+
+/**
+ * The strongest acr a set of authentication methods satisfies
+ * @param {string[]} amr - Methods used in the session
+ * @returns {string|null}
+ */
+function acrForAmr (amr = []) {
+  const met = ACR_LEVELS.filter(level => satisfies(amr, level))
+  return met.length > 0 ? met[met.length - 1].acr : null
+}
+
+/**
+ * The context requested by acr_values: the first supported value in the
+ * client's order of preference (OIDC Core 3.1.2.1)
+ * @param {string} acrValues - Space-separated acr_values
+ * @returns {object|null} { acr, amr } or null when none is supported
+ */
+function requestedAcr (acrValues) {
+  if (typeof acrValues !== 'string') {
+    return null
+  }
+  for (const value of acrValues.split(' ').filter(v => v)) {
+    const level = ACR_LEVELS.find(l => l.acr === value)
+    if (level) {
+      return level
+    }
+  }
+  return null
+}
+
+/**
+ * Methods the session still needs for the requested context. Users without
+ * a second factor enrolled are not asked for one; the issued acr then shows
+ * the weaker context and the client decides.
+ * @param {string[]} amr - Methods used in the session
+ * @param {string} acrValues - Requested acr_values
+ * @param {object} user - Signed-in user
+ * @returns {string[]} Missing methods ([] when satisfied)
+ */
+function missingFactors (amr = [], acrValues, user) {
+  const level = requestedAcr(acrValues)
+  if (!level) {
+    return []
+  }
+  const missing = level.amr.filter(method => !amr.includes(method))
+  if (missing.includes('otp') && !(user && user.totpSecret)) {
+    return []
+  }
+  return missing
+}
+
+// RFC 4648 base32 (no padding), the usual encoding of TOTP secrets
+const BASE32_ALPHABET = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567'
+
+function decodeBase32 (value) {
+  let bits = ''
+  for (const char of value.replace(/=+$/, '').toUpperCase()) {
+    const index = BASE32_ALPHABET.indexOf(char)
+    if (index === -1) {
+      throw new Error('Invalid base32 secret')
+    }
+    bits += index.toString(2).padStart(5, '0')
+  }
+  const bytes = []
+  for (let i = 0; i + 8 <= bits.length; i += 8) {
+    bytes.push(parseInt(bits.slice(i, i + 8), 2))
+  }
+  return Buffer.from(bytes)
+}
+
+const TOTP_STEP = 30
+const TOTP_DIGITS = 6
+
+/**
+ * TOTP code (RFC 6238: HMAC-SHA1, 30-second steps, 6 digits)
+ * @param {string} secret - Base32 secret
+ * @param {number} time - Unix time in milliseconds
+ * @returns {string}
+ */
+function generateTotp (secret, time = Date.now()) {
+  const counter = Buffer.alloc(8)
+  counter.writeBigUInt64BE(BigInt(Math.floor(time / 1000 / TOTP_STEP)))
+  const hmac = crypto.createHmac('sha1', decodeBase32(secret)).update(counter).digest()
+  const offset = hmac[hmac.length - 1] & 0x0f
+  const code = (hmac.readUInt32BE(offset) & 0x7fffffff) % (10 ** TOTP_DIGITS)
+  return String(code).padStart(TOTP_DIGITS, '0')
+}
+
+/**
+ * Check a TOTP code, allowing one step of clock drift either way
+ * @param {string} secret - Base32 secret
+ * @param {string} code - Code entered by the user
+ * @returns {boolean}
+ */
+function verifyTotp (secret, code) {
+  if (typeof code !== 'string' || !/^\d{6}$/.test(code)) {
+    return false
+  }
+  const now = Date.now()
+  return [-1, 0, 1].some(drift => {
+    const expected = generateTotp(secret, now + drift * TOTP_STEP * 1000)
+    return crypto.timingSafeEqual(Buffer.from(expected), Buffer.from(code))
+  })
+}
+
+module.exports = {
+  ACR_VALUES,
+  acrForAmr,
+  requestedAcr,
+  missingFactors,
+  generateTotp,
+  verifyTotp
+}
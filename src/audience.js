@@ -0,0 +1,81 @@
+/**
+ * Access token audience
+ * Resolves the aud claim from resource indicators (RFC 8707), the client's
+ * registered default audience, or the server-wide default
+ */
+
+const config = require('./config')
+const { OAuthError } = require('./errors')
+
+function toList (value) {
+  if (value === undefined || value === null || value === '') {
+    return []
+  }
+  return Array.isArray(value) ? value : [value]
+}
+
+/**
+ * Resolve the audiences for an access token
+ * @param {string|string[]} resource - resource parameter(s) from the request
+ * @param {object} client - Registered client
+ * @returns {string[]} Audiences, possibly empty
+ * @throws {OAuthError} invalid_target for malformed resource indicators
+ */
+function resolveAudience (resource, client) {
+  const resources = toList(resource)
+
+  for (const value of resources) {
+    let url
+    try {
+      url = new URL(value)
+    } catch (err) {
+      url = null
+    }
+    // Resource indicators must be absolute URIs without a fragment (RFC 8707 2)
+    if (typeof value !== 'string' || !url || url.hash) {
+      throw new OAuthError('invalid_target', `Invalid resource indicator: ${value}`)
+    }
+  }
+
+  if (resources.length > 0) {
+    return [...new Set(resources)]
+  }
+
+  const clientAudience = toList(client && client.default_audience)
+  if (clientAudience.length > 0) {
+    return clientAudience
+  }
+
+  return toList(config.tokens.defaultAudience)
+}
+
+/**
+ * Serialize audiences for the aud claim: a single audience is a string,
+ * several are an array (RFC 7519 4.1.3)
+ * @param {string[]} audiences
+ * @returns {string|string[]|undefined}
+ */
+function serializeAudience (audiences) {
+  if (audiences.length === 0) {
+    return undefined
+  }
+  return audiences.length === 1 ? audiences[0] : audiences
+}
+
+/**
+ * Whether a token was issued for a resource server: its aud must name the
+ * server's client_id or one of its registered resource_identifiers
+ * @param {string|string[]} aud - Token aud claim
+ * @param {object} client - Registered client of the resource server
+ * @returns {boolean}
+ */
+function isAudienceOf (aud, client) {
+  const identities = [client.client_id, ...toList(client.resource_identifiers)]
+  return toList(aud).some(a => identities.includes(a))
+}
+
+module.exports = {
+  resolveAudience,
+  serializeAudience,
+  isAudienceOf
+}
@@ -1,29 +1,54 @@
 const jwt = require('jsonwebtoken')
 const { OAuthError } = require('./errors')
+const { isTokenRevoked } = require('./db')
+const { readTokenScope } = require('./scopes')
 
+// PEM public key, or a function returning the key for a token's kid: a PEM
+// or a { publicKey, alg } key record (so tokens signed before a key rotation
+// or with a client's dedicated key keep verifying)
 let publicKey
 
 function setPublicKey (key) {
   publicKey = key
 }
 
+// Public key and algorithm that verify a token
+function verificationKey (token) {
+  let key = publicKey
+  if (typeof publicKey === 'function') {
+    const decoded = jwt.decode(token, { complete: true })
+    key = publicKey(decoded && decoded.header.kid)
+  }
+  return typeof key === 'string' ? { publicKey: key, alg: 'RS256' } : key
+}
+
+// Verify a token's signature and expiry with its verification key
+function verifySignedToken (token) {
+  const key = verificationKey(token)
+  return jwt.verify(token, key.publicKey, { algorithms: [key.alg] })
+}
+
 function getPublicKey () {
   return publicKey
 }
 
+// Extract the token from an Authorization header. The scheme is matched
+// case-insensitively (RFC 7235 2.1), so "Bearer", "bearer" and "BEARER" work.
+function parseBearerToken (authHeader) {
+  const match = /^bearer +(\S+) *$/i.exec(authHeader || '')
+  return match ? match[1] : undefined
+}
+
 // Middleware to verify JWT token from Authorization header
 function authenticateToken (req, res, next) {
-  const authHeader = req.headers.authorization
-  const token = authHeader && authHeader.split(' ')[1]
+  const token = parseBearerToken(req.headers.authorization)
 
   if (!token) {
     return next(new OAuthError('invalid_request', 'Missing authorization token'))
   }
 
   try {
-    const decoded = jwt.verify(token, publicKey, {
-      algorithms: ['RS256']
-    })
+    const decoded = verifySignedToken(token)
     req.user = decoded
     next()
   } catch (err) {
@@ -35,33 +60,40 @@ function authenticateToken (req, res, next) {
 }
 
 // Middleware to verify Bearer token (access token)
-function authenticateBearerToken (req, res, next) {
-  const authHeader = req.headers.authorization
-  const token = authHeader && authHeader.split(' ')[1]
+async function authenticateBearerToken (req, res, next) {
+  const token = parseBearerToken(req.headers.authorization)
 
   if (!token) {
     return next(new OAuthError('invalid_request', 'Missing bearer token'))
   }
 
+  let decoded
   try {
-    const decoded = jwt.verify(token, publicKey, {
-      algorithms: ['RS256']
-    })
+    decoded = verifySignedToken(token)
 
     // Ensure token is an access token (has token_type set or no token_type for backward compat)
     // ID tokens will be verified separately via bearer check
     if (decoded.token_type && decoded.token_type !== 'access') {
       throw new Error('Invalid token type')
     }
-
-    req.user = decoded
-    next()
   } catch (err) {
     if (err.name === 'TokenExpiredError') {
       return next(new OAuthError('invalid_grant', 'Token has expired'))
     }
     return next(new OAuthError('invalid_grant', 'Invalid token'))
   }
+
+  try {
+    // Tokens revoked along with the user's consent for the client
+    if (await isTokenRevoked(decoded)) {
+      return next(new OAuthError('invalid_grant', 'Token has been revoked'))
+    }
+  } catch (err) {
+    return next(err)
+  }
+
+  req.user = decoded
+  next()
 }
 
 // Middleware to verify scope
@@ -71,7 +103,7 @@ function requireScope (...scopes) {
       return next(new OAuthError('invalid_request', 'User not authenticated'))
     }
 
-    const userScopes = (req.user.scope || '').split(' ').filter(s => s)
+    const userScopes = readTokenScope(req.user).split(' ').filter(s => s)
 
     const hasScope = scopes.some(scope =>
       userScopes.includes(scope)
@@ -86,6 +118,7 @@ function requireScope (...scopes) {
 }
 
 module.exports = {
+  parseBearerToken,
   authenticateToken,
   authenticateBearerToken,
   requireScope,
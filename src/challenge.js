@@ -0,0 +1,132 @@
+/**
+ * Bot challenges
+ *
+ * Self-registration, and login after repeated failures, can require a solved
+ * challenge such as hCaptcha or Cloudflare Turnstile. Pick a built-in
+ * provider with NGAUTH_CHALLENGE_PROVIDER or install your own verifier with
+ * setChallengeVerifier. With neither, no challenge is asked for.
+ */
+
+const config = require('./config')
+const { logSecurityEvent } = require('./middleware/auditLog')
+const { getClientIp } = require('./middleware/clientIp')
+
+// Built-in providers: siteverify endpoint, form field and widget
+const PROVIDERS = {
+  hcaptcha: {
+    verifyUrl: 'https://api.hcaptcha.com/siteverify',
+    field: 'h-captcha-response',
+    script: 'https://js.hcaptcha.com/1/api.js',
+    widgetClass: 'h-captcha'
+  },
+  turnstile: {
+    verifyUrl: 'https://challenges.cloudflare.com/turnstile/v0/siteverify',
+    field: 'cf-turnstile-response',
+    script: 'https://challenges.cloudflare.com/turnstile/v0/api.js',
+    widgetClass: 'cf-turnstile'
+  }
+}
+
+let customVerifier = null
+
+/**
+ * Install a challenge verifier, replacing the configured provider
+ * @param {function|null} verifier - async ({ token, ip, action }) => boolean; null removes it
+ */
+function setChallengeVerifier (verifier) {
+  customVerifier = verifier
+}
+
+// Verifier for a provider's siteverify API (shared by hCaptcha and Turnstile)
+function siteverify (provider) {
+  return async ({ token, ip }) => {
+    const body = new URLSearchParams({ secret: config.challenge.secret, response: token })
+    if (ip) {
+      body.set('remoteip', ip)
+    }
+    const res = await fetch(provider.verifyUrl, { method: 'POST', body })
+    if (!res.ok) {
+      throw new Error(`siteverify answered ${res.status}`)
+    }
+    const result = await res.json()
+    return result.success === true
+  }
+}
+
+function getChallengeVerifier () {
+  if (customVerifier) {
+    return customVerifier
+  }
+  const provider = PROVIDERS[config.challenge.provider]
+  return provider ? siteverify(provider) : null
+}
+
+// Whether challenges are on for this deployment
+function challengeEnabled () {
+  return getChallengeVerifier() !== null
+}
+
+// The solved challenge from a form post (provider field) or JSON body (challenge_token)
+function challengeToken (body) {
+  const provider = PROVIDERS[config.challenge.provider]
+  const token = body.challenge_token || (provider && body[provider.field])
+  return typeof token === 'string' && token ? token : null
+}
+
+/**
+ * Check the challenge solved for a request. Passes when challenges are off;
+ * fails closed when the token is missing or the verifier errors.
+ * @param {object} req - Express request
+ * @param {string} action - 'register' or 'login'
+ * @returns {Promise<boolean>}
+ */
+async function verifyChallenge (req, action) {
+  const verifier = getChallengeVerifier()
+  if (!verifier) {
+    return true
+  }
+
+  const ip = getClientIp(req)
+  const token = challengeToken(req.body || {})
+  let passed = false
+  if (token) {
+    try {
+      passed = (await verifier({ token, ip, action })) === true
+    } catch (err) {
+      if (process.env.NODE_ENV !== 'test') {
+        console.warn('Challenge verification failed:', err.message)
+      }
+    }
+  }
+
+  if (!passed) {
+    logSecurityEvent({ type: 'CHALLENGE_FAILED', action, ip, reason: token ? 'rejected' : 'missing' })
+  }
+  return passed
+}
+
+// Login needs a challenge once the account has this many failed attempts
+function loginNeedsChallenge (user) {
+  const threshold = config.challenge.loginAfterFailures
+  return challengeEnabled() && threshold > 0 && !!user && (user.failedLoginAttempts || 0) >= threshold
+}
+
+// Widget markup for the HTML forms (built-in providers with a site key only)
+function challengeWidget () {
+  const provider = PROVIDERS[config.challenge.provider]
+  if (!provider || !config.challenge.siteKey) {
+    return ''
+  }
+  const siteKey = String(config.challenge.siteKey).replace(/[^\w-]/g, '')
+  return `
+    <div class="${provider.widgetClass}" data-sitekey="${siteKey}"></div>
+    <script src="${provider.script}" async defer></script>`
+}
+
+module.exports = {
+  setChallengeVerifier,
+  challengeEnabled,
+  verifyChallenge,
+  loginNeedsChallenge,
+  challengeWidget
+}
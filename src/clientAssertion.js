@@ -0,0 +1,160 @@
+/**
+ * Client assertion authentication (private_key_jwt, RFC 7523 2.2)
+ *
+ * A client with a registered jwks or jwks_uri may authenticate at the token
+ * endpoint with a JWT signed by one of its keys instead of its secret.
+ *
+ * Assertions are short-lived: they must be current, give or take
+ * config.clientAssertions.leeway seconds of clock drift between the client
+ * and this server, and must not be valid for longer than
+ * config.clientAssertions.maxLifetime seconds. An assertion valid for hours
+ * is as good as a static secret to whoever captures it. Replay of a current
+ * assertion is refused by its jti.
+ */
+
+const crypto = require('crypto')
+const jwt = require('jsonwebtoken')
+const config = require('./config')
+const { OAuthError } = require('./errors')
+const { getClient } = require('./db')
+const { fetchJwks } = require('./clientJwks')
+const { isClientActive } = require('./clients')
+
+const JWT_BEARER_ASSERTION_TYPE = 'urn:ietf:params:oauth:client-assertion-type:jwt-bearer'
+const SUPPORTED_ALGS = ['RS256', 'PS256', 'ES256']
+
+// Recently seen assertion jti values per client (replay protection)
+const seenJtis = new Map()
+
+// Drop consumed jti values whose assertion can no longer be accepted
+function purgeExpiredJtis (now = Date.now()) {
+  for (const [key, expiry] of seenJtis) {
+    if (expiry < now) {
+      seenJtis.delete(key)
+    }
+  }
+}
+
+function rememberJti (jti, expiresAt) {
+  purgeExpiredJtis()
+  if (seenJtis.has(jti)) {
+    return false
+  }
+  seenJtis.set(jti, expiresAt)
+  return true
+}
+
+/**
+ * Check the iat, nbf and exp claims of a client assertion
+ * @param {object} payload - Decoded assertion claims
+ * @param {number} now - Current time (seconds)
+ * @throws {OAuthError} invalid_client for stale, future-dated or long-lived assertions
+ */
+function checkAssertionTimes (payload, now = Math.floor(Date.now() / 1000)) {
+  const { leeway, maxLifetime } = config.clientAssertions
+  const { iat, nbf, exp } = payload
+
+  for (const [name, value] of Object.entries({ iat, nbf })) {
+    if (value !== undefined && typeof value !== 'number') {
+      throw new OAuthError('invalid_client', `Client assertion ${name} must be a number`)
+    }
+  }
+  if (typeof exp !== 'number') {
+    throw new OAuthError('invalid_client', 'Client assertion must have an exp claim')
+  }
+
+  if (exp + leeway < now) {
+    throw new OAuthError('invalid_client', 'Client assertion has expired')
+  }
+  if (iat !== undefined && iat - leeway > now) {
+    throw new OAuthError('invalid_client', 'Client assertion iat is in the future')
+  }
+  if (nbf !== undefined && nbf - leeway > now) {
+    throw new OAuthError('invalid_client', 'Client assertion is not valid yet')
+  }
+  // Without iat the lifetime runs from now, which still bounds exp
+  const start = iat !== undefined ? iat : now
+  if (exp - start > maxLifetime) {
+    throw new OAuthError('invalid_client', `Client assertion must not be valid for more than ${maxLifetime} seconds`)
+  }
+}
+
+// Public keys that may have signed the assertion: the key named by kid, or
+// every signing key when the header has none
+async function candidateKeys (client, kid) {
+  let jwks = client.jwks
+  if (client.jwks_uri) {
+    const fetched = await fetchJwks(client.jwks_uri)
+    if (fetched.problem) {
+      throw new OAuthError('invalid_client', 'Client keys could not be retrieved')
+    }
+    jwks = fetched.jwks
+  }
+  if (!jwks || !Array.isArray(jwks.keys)) {
+    return []
+  }
+  return jwks.keys.filter(jwk => jwk && typeof jwk === 'object' && jwk.d === undefined &&
+    (jwk.use === undefined || jwk.use === 'sig') &&
+    (kid === undefined || jwk.kid === kid))
+}
+
+/**
+ * Authenticate a client by its JWT assertion
+ * @param {string} assertion - Value of the client_assertion parameter
+ * @param {string[]} audiences - Accepted aud values (the token endpoint URL and the issuer)
+ * @returns {Promise<object>} The authenticated client
+ * @throws {OAuthError} invalid_client when the assertion does not authenticate a client
+ */
+async function authenticateClientAssertion (assertion, audiences) {
+  const decoded = jwt.decode(assertion, { complete: true })
+  if (!decoded || !decoded.header || !decoded.payload || typeof decoded.payload !== 'object') {
+    throw new OAuthError('invalid_client', 'Client assertion is not a valid JWT')
+  }
+
+  const { header, payload } = decoded
+  if (!SUPPORTED_ALGS.includes(header.alg)) {
+    throw new OAuthError('invalid_client', `Unsupported client assertion algorithm: ${header.alg}`)
+  }
+  // iss and sub both name the client (RFC 7523 3)
+  if (typeof payload.iss !== 'string' || payload.sub !== payload.iss) {
+    throw new OAuthError('invalid_client', 'Client assertion iss and sub must be the client_id')
+  }
+
+  const client = await getClient(payload.iss)
+  if (!client || !isClientActive(client) || (!client.jwks && !client.jwks_uri)) {
+    throw new OAuthError('invalid_client', 'Invalid client credentials')
+  }
+
+  const verified = (await candidateKeys(client, header.kid)).some(jwk => {
+    try {
+      const key = crypto.createPublicKey({ key: jwk, format: 'jwk' })
+      // Time claims are checked below with the configured leeway
+      jwt.verify(assertion, key, { algorithms: [header.alg], audience: audiences, ignoreExpiration: true, ignoreNotBefore: true })
+      return true
+    } catch (err) {
+      return false
+    }
+  })
+  if (!verified) {
+    throw new OAuthError('invalid_client', 'Client assertion signature or audience is invalid')
+  }
+
+  checkAssertionTimes(payload)
+
+  if (typeof payload.jti !== 'string' || !payload.jti) {
+    throw new OAuthError('invalid_client', 'Client assertion is missing jti')
+  }
+  // Remember the jti for as long as the assertion could still be accepted
+  if (!rememberJti(`${client.client_id}:${payload.jti}`, (payload.exp + config.clientAssertions.leeway) * 1000)) {
+    throw new OAuthError('invalid_client', 'Client assertion has already been used')
+  }
+
+  return client
+}
+
+module.exports = {
+  JWT_BEARER_ASSERTION_TYPE,
+  SUPPORTED_ALGS,
+  authenticateClientAssertion,
+  checkAssertionTimes
+}
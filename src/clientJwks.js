@@ -0,0 +1,143 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Client JWKS diagnostics
+ *
+ * Checks the keys a client registered with jwks_uri or jwks, so integrators
+ * find a broken setup before the first client authentication does.
+ */
+
+const crypto = require('crypto')
+const config = require('./config')
+const { isPrivateHost, readLimited } = require('./pairwise')
+
+const FETCH_TIMEOUT_MS = 5000
+
+// A client's key set; anything larger is not one
+const MAX_JWKS_BYTES = 64 * 1024
+
+// Key types that can verify a client's signatures
+const SIGNING_KEY_TYPES = ['RSA', 'EC', 'OKP']
+
+function problem (code, message) {
+  return { code, message }
+}
+
+// Fetch and parse the JWKS document; returns { jwks } or { problem }.
+// Anyone may register a jwks_uri, so it must be https on a public address,
+// redirects are not followed and the document size is capped;
+// allowPrivateJwksUris lifts the first two for development. Problems stay
+// generic so the fetch does not probe hosts for the caller.
+async function fetchJwks (uri) {
+  let url
+  try {
+    url = new URL(uri)
+  } catch (err) {
+    return { problem: problem('invalid_uri', 'The jwks_uri is not a valid URL') }
+  }
+  if (!config.registration.allowPrivateJwksUris) {
+    if (url.protocol !== 'https:') {
+      return { problem: problem('insecure_uri', 'The jwks_uri must be an https URL') }
+    }
+    if (await isPrivateHost(url.hostname)) {
+      return { problem: problem('private_host', 'The jwks_uri must be on a public host') }
+    }
+  }
+
+  let body
+  try {
+    const res = await fetch(uri, { headers: { Accept: 'application/json' }, redirect: 'error', signal: AbortSignal.timeout(FETCH_TIMEOUT_MS) })
+    body = res.ok ? await readLimited(res, MAX_JWKS_BYTES) : null
+  } catch (err) {
+    body = null
+  }
+  if (body === null) {
+    return { problem: problem('unreachable', 'The jwks_uri could not be retrieved') }
+  }
+  try {
+    return { jwks: JSON.parse(body) }
+  } catch (err) {
+    return { problem: problem('invalid_json', 'The jwks_uri did not return JSON') }
+  }
+}
+
+// Describe one key and the problems that make it unusable
+function inspectKey (jwk, index) {
+  const label = jwk && jwk.kid ? `Key '${jwk.kid}'` : `Key ${index}`
+  if (!jwk || typeof jwk !== 'object') {
+    return { key: null, problems: [problem('invalid_key', `${label} is not an object`)] }
+  }
+
+  const key = { kid: jwk.kid || null, kty: jwk.kty || null, alg: jwk.alg || null, use: jwk.use || null }
+  const problems = []
+  if (!SIGNING_KEY_TYPES.includes(jwk.kty)) {
+    problems.push(problem('unsupported_key_type', `${label} has kty '${jwk.kty}'; expected one of ${SIGNING_KEY_TYPES.join(', ')}`))
+  } else if (jwk.d !== undefined) {
+    problems.push(problem('private_key_published', `${label} contains private key material`))
+  } else {
+    try {
+      crypto.createPublicKey({ key: jwk, format: 'jwk' })
+    } catch (err) {
+      problems.push(problem('invalid_key', `${label} cannot be imported: ${err.message}`))
+    }
+  }
+  // Encryption keys are fine to publish but cannot authenticate the client
+  key.usable = problems.length === 0 && (jwk.use === undefined || jwk.use === 'sig')
+  return { key, problems }
+}
+
+/**
+ * Check a client's registered JWKS
+ * @param {object} client - Registered client
+ * @returns {Promise<object>} Report: healthy, source, keys and problems ({ code, message })
+ */
+async function checkClientJwks (client) {
+  const report = { client_id: client.client_id, healthy: false, source: null, keys: [], problems: [] }
+
+  let jwks
+  if (client.jwks_uri) {
+    report.source = 'jwks_uri'
+    report.jwks_uri = client.jwks_uri
+    const fetched = await fetchJwks(client.jwks_uri)
+    if (fetched.problem) {
+      report.problems.push(fetched.problem)
+      return report
+    }
+    jwks = fetched.jwks
+  } else if (client.jwks) {
+    report.source = 'jwks'
+    jwks = client.jwks
+  } else {
+    report.problems.push(problem('no_jwks', 'The client has no jwks_uri or jwks registered'))
+    return report
+  }
+
+  if (!jwks || !Array.isArray(jwks.keys)) {
+    report.problems.push(problem('invalid_jwks', 'The JWKS has no keys array'))
+    return report
+  }
+
+  const kids = new Set()
+  jwks.keys.forEach((jwk, index) => {
+    const { key, problems } = inspectKey(jwk, index)
+    if (key) {
+      report.keys.push(key)
+      if (key.kid && kids.has(key.kid)) {
+        problems.push(problem('duplicate_kid', `kid '${key.kid}' is used by more than one key`))
+      }
+      kids.add(key.kid)
+    }
+    report.problems.push(...problems)
+  })
+
+  if (!report.keys.some(k => k.usable)) {
+    report.problems.push(problem('no_signing_keys', 'The JWKS contains no usable signing key'))
+  }
+  report.healthy = report.problems.length === 0
+  return report
+}
+
+module.exports = {
+  checkClientJwks,
+  fetchJwks
+}
@@ -0,0 +1,348 @@
+/* eslint camelcase: "off" */
+
+/**
+ * OAuth client helpers
+ */
+
+const crypto = require('crypto')
+
+// Supported per-client redirect_uri_matching policies
+const REDIRECT_URI_MATCHING_POLICIES = ['exact', 'exact_ignoring_query']
+
+function parseUrl (value) {
+  try {
+    return new URL(value)
+  } catch (err) {
+    return null
+  }
+}
+
+/**
+ * Check a requested redirect_uri against the client's registered URIs
+ * using the client's redirect_uri_matching policy (default: exact).
+ *
+ * - exact: the URI must equal a registered URI character for character
+ * - exact_ignoring_query: scheme, host, port and path must match;
+ *   the query string may differ
+ *
+ * @param {object} client - Registered client
+ * @param {string} redirectUri - redirect_uri from the request
+ * @returns {boolean} Whether the redirect URI is allowed
+ */
+function isRedirectUriAllowed (client, redirectUri) {
+  const registered = client.redirect_uris || []
+  const policy = client.redirect_uri_matching || 'exact'
+
+  if (typeof redirectUri !== 'string') {
+    return false
+  }
+
+  if (policy === 'exact') {
+    return registered.includes(redirectUri)
+  }
+
+  if (policy === 'exact_ignoring_query') {
+    const requested = parseUrl(redirectUri)
+    // Fragments are never allowed in redirect URIs (RFC 6749 3.1.2)
+    if (!requested || requested.hash) {
+      return false
+    }
+
+    return registered.some(uri => {
+      const candidate = parseUrl(uri)
+      return candidate &&
+        candidate.protocol === requested.protocol &&
+        candidate.host === requested.host &&
+        candidate.pathname === requested.pathname
+    })
+  }
+
+  return false
+}
+
+/**
+ * Check whether a browser origin is registered for the client
+ * @param {object} client - Registered client
+ * @param {string} origin - Origin request header
+ * @returns {boolean} Whether CORS responses may be sent to the origin
+ */
+function isCorsOriginAllowed (client, origin) {
+  if (!client || typeof origin !== 'string') {
+    return false
+  }
+  return (client.allowed_cors_origins || []).includes(origin)
+}
+
+// An origin is scheme://host[:port] with nothing else (RFC 6454)
+function isValidOrigin (value) {
+  const url = parseUrl(value)
+  return !!url && (url.protocol === 'http:' || url.protocol === 'https:') && url.origin === value
+}
+
+// Constant-time string comparison
+function secretsEqual (a, b) {
+  if (typeof a !== 'string' || typeof b !== 'string') {
+    return false
+  }
+  const bufA = Buffer.from(a)
+  const bufB = Buffer.from(b)
+  return bufA.length === bufB.length && crypto.timingSafeEqual(bufA, bufB)
+}
+
+// Random bytes in every generated client_id, whatever its format
+const CLIENT_ID_RANDOM_BYTES = 16
+
+// Characters a generated client_id may use: URL-safe, and no ':' so it
+// survives client_secret_basic
+const CLIENT_ID_PATTERN = /^[A-Za-z0-9._~-]{1,255}$/
+
+// Generated IDs tried before registration gives up on collisions
+const CLIENT_ID_MAX_ATTEMPTS = 5
+
+let clientIdGenerator = null
+
+/**
+ * Install a ClientIDGenerator that formats the client_id of dynamically
+ * registered clients, e.g. to prefix it with an environment or tenant.
+ * The generator must embed the random part it is given, so every ID keeps
+ * 128 bits of entropy; uniqueness is still checked by the server.
+ * @param {function|null} generator - ({ random, client_name, redirect_uris }) => string,
+ *   random being 32 hex characters; null restores the default (random alone)
+ */
+function setClientIdGenerator (generator) {
+  clientIdGenerator = generator
+}
+
+/**
+ * Generate a client_id for a new client, retrying when it is taken
+ *
+ * @param {object} metadata - Registration request metadata passed to the generator
+ * @param {function} isTaken - async (clientId) => whether a client already uses it
+ * @returns {Promise<string>} Unused client_id
+ * @throws {Error} When the generator output is invalid or keeps colliding
+ */
+async function generateClientId (metadata, isTaken) {
+  for (let attempt = 0; attempt < CLIENT_ID_MAX_ATTEMPTS; attempt++) {
+    const random = crypto.randomBytes(CLIENT_ID_RANDOM_BYTES).toString('hex')
+    const clientId = clientIdGenerator
+      ? clientIdGenerator({ random, client_name: metadata.client_name, redirect_uris: metadata.redirect_uris })
+      : random
+
+    if (typeof clientId !== 'string' || !CLIENT_ID_PATTERN.test(clientId)) {
+      throw new Error('ClientIDGenerator must return 1-255 characters from A-Z a-z 0-9 . _ ~ -')
+    }
+    if (!clientId.includes(random)) {
+      throw new Error('ClientIDGenerator must include the random part it is given')
+    }
+    if (!(await isTaken(clientId))) {
+      return clientId
+    }
+  }
+  throw new Error(`No unused client_id after ${CLIENT_ID_MAX_ATTEMPTS} attempts`)
+}
+
+/**
+ * Client credentials from the Authorization header (client_secret_basic) or
+ * the request body (client_secret_post).
+ *
+ * @param {object} req - Express request
+ * @returns {{client_id: string, client_secret: string}}
+ */
+function getClientCredentials (req) {
+  const authHeader = req.headers.authorization
+
+  // Try client_secret_basic (Authorization header)
+  if (authHeader && authHeader.startsWith('Basic ')) {
+    const base64Credentials = authHeader.substring(6)
+    const credentials = Buffer.from(base64Credentials, 'base64').toString('utf8')
+    const [client_id, client_secret] = credentials.split(':')
+    return { client_id, client_secret }
+  }
+
+  // Try client_secret_post (body)
+  return {
+    client_id: req.body.client_id,
+    client_secret: req.body.client_secret
+  }
+}
+
+/**
+ * Authenticate a client secret. During a rotation the previous secret keeps
+ * working until its grace period ends.
+ *
+ * @param {object} client - Registered client
+ * @param {string} secret - Presented client_secret
+ * @param {number} now - Reference time (ms)
+ * @returns {string|null} Id of the matching secret, or null
+ */
+function matchClientSecret (client, secret, now = Date.now()) {
+  if (!client || !isClientActive(client)) {
+    return null
+  }
+  if (secretsEqual(client.client_secret, secret)) {
+    return client.client_secret_id || 'primary'
+  }
+  const previous = client.previous_client_secret
+  if (previous && previous.expiresAt > now && secretsEqual(previous.secret, secret)) {
+    return previous.id
+  }
+  return null
+}
+
+/**
+ * Build the client updates for a secret rotation
+ *
+ * @param {object} client - Registered client
+ * @param {number} gracePeriod - Seconds the current secret keeps working (0 revokes it immediately)
+ * @param {number} now - Reference time (ms)
+ * @returns {object} Fields to store on the client
+ */
+function rotateClientSecret (client, gracePeriod, now = Date.now()) {
+  const updates = {
+    client_secret: crypto.randomBytes(32).toString('hex'),
+    client_secret_id: 'sec_' + crypto.randomBytes(8).toString('hex'),
+    previous_client_secret: null
+  }
+
+  if (gracePeriod > 0) {
+    updates.previous_client_secret = {
+      id: client.client_secret_id || 'primary',
+      secret: client.client_secret,
+      expiresAt: now + gracePeriod * 1000
+    }
+  }
+
+  return updates
+}
+
+// Comparable form of a redirect URI: scheme, host, port and path, ignoring
+// the query, fragment, host case and a trailing slash
+function redirectUriKey (uri) {
+  const url = parseUrl(uri)
+  if (!url) {
+    return null
+  }
+  return `${url.protocol}//${url.host}${url.pathname.replace(/\/+$/, '')}`
+}
+
+/**
+ * Find registered redirect URIs of other clients that overlap the given ones.
+ * URIs overlap when they differ only in query, fragment, host case or a
+ * trailing slash, i.e. when one could pass for the other to a user.
+ *
+ * @param {object[]} clients - Registered clients
+ * @param {string[]} redirectUris - redirect_uris of the new registration
+ * @returns {{ redirect_uri: string, client_id: string }[]} Collisions
+ */
+function findRedirectUriCollisions (clients, redirectUris) {
+  const collisions = []
+  for (const uri of redirectUris) {
+    const key = redirectUriKey(uri)
+    const owner = clients.find(client => (client.redirect_uris || []).some(registered => redirectUriKey(registered) === key))
+    if (key && owner) {
+      collisions.push({ redirect_uri: uri, client_id: owner.client_id })
+    }
+  }
+  return collisions
+}
+
+// Client metadata safe to show operators: never secrets or secret history
+const PUBLIC_CLIENT_FIELDS = [
+  'client_id', 'client_name', 'redirect_uris', 'post_logout_redirect_uris', 'grant_types', 'response_types', 'scope',
+  'redirect_uri_matching', 'allowed_cors_origins', 'authorization_details_types',
+  'default_audience', 'resource_identifiers', 'id_token_signed_response_alg', 'id_token_lifetime',
+  'jwks_uri', 'jwks', 'signing_key_id', 'skip_consent', 'session_bridge', 'default_claims', 'admin_access', 'subject_type',
+  'sector_identifier_uri', 'client_secret_id', 'created_at'
+]
+
+const CLIENT_SORT_FIELDS = ['created_at', 'client_name', 'client_id']
+
+const CLIENT_STATUSES = ['active', 'disabled']
+
+/**
+ * Public view of a registered client
+ *
+ * @param {object} client - Registered client
+ * @returns {object} Client metadata without secrets, with its status
+ */
+function toPublicClient (client) {
+  const view = {}
+  for (const field of PUBLIC_CLIENT_FIELDS) {
+    if (client[field] !== undefined) {
+      view[field] = client[field]
+    }
+  }
+  view.status = clientStatus(client)
+  return view
+}
+
+// Clients are active until an operator disables them through
+// PATCH /admin/clients/:clientId
+function clientStatus (client) {
+  return client.status || 'active'
+}
+
+// Disabled clients cannot authenticate or start an authorization
+function isClientActive (client) {
+  return clientStatus(client) === 'active'
+}
+
+/**
+ * Filter, sort and paginate clients for the admin listing
+ *
+ * @param {object[]} clients - Registered clients
+ * @param {object} options
+ * @param {string} options.name - Case-insensitive substring of client_name
+ * @param {string} options.grantType - Registered grant type
+ * @param {string} options.status - Client status ('active' or 'disabled')
+ * @param {string} options.sort - Sort field, '-' prefix for descending
+ * @param {number} options.offset - Index of the first client returned
+ * @param {number} options.limit - Maximum number of clients returned
+ * @returns {{ clients: object[], total: number, nextOffset: number|null }}
+ */
+function queryClients (clients, { name, grantType, status, sort = 'created_at', offset = 0, limit = 20 } = {}) {
+  const descending = sort.startsWith('-')
+  const field = descending ? sort.slice(1) : sort
+  if (!CLIENT_SORT_FIELDS.includes(field)) {
+    throw new Error(`Cannot sort by '${field}'; use one of ${CLIENT_SORT_FIELDS.join(', ')}`)
+  }
+
+  const needle = name && name.toLowerCase()
+  const matching = clients.filter(client =>
+    (!needle || (client.client_name || '').toLowerCase().includes(needle)) &&
+    (!grantType || (client.grant_types || ['authorization_code']).includes(grantType)) &&
+    (!status || clientStatus(client) === status)
+  )
+
+  // Ties are broken by client_id so pages are stable
+  const key = client => client[field] === undefined || client[field] === null ? '' : client[field]
+  const compare = (a, b) => (a < b ? -1 : a > b ? 1 : 0)
+  matching.sort((a, b) => {
+    const order = compare(key(a), key(b)) || compare(a.client_id, b.client_id)
+    return descending ? -order : order
+  })
+
+  const page = matching.slice(offset, offset + limit)
+  return {
+    clients: page.map(toPublicClient),
+    total: matching.length,
+    nextOffset: offset + limit < matching.length ? offset + limit : null
+  }
+}
+
+module.exports = {
+  REDIRECT_URI_MATCHING_POLICIES,
+  CLIENT_STATUSES,
+  toPublicClient,
+  isClientActive,
+  queryClients,
+  findRedirectUriCollisions,
+  getClientCredentials,
+  matchClientSecret,
+  rotateClientSecret,
+  isRedirectUriAllowed,
+  isCorsOriginAllowed,
+  isValidOrigin,
+  setClientIdGenerator,
+  generateClientId
+}
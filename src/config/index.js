@@ -11,6 +11,173 @@ function parseBoolean (value, defaultValue = false) {
   return value === 'true' || value === '1' || value === 'yes'
 }
 
+function parseList (value) {
+  if (!value) return []
+  return value.split(',').map(v => v.trim()).filter(Boolean)
+}
+
+// "admin:write,write:read" -> { admin: ['write'], write: ['read'] }
+function parseScopeHierarchy (value) {
+  const hierarchy = {}
+  for (const pair of parseList(value)) {
+    const [parent, child] = pair.split(':').map(s => s.trim())
+    if (!parent || !child) continue
+    hierarchy[parent] = hierarchy[parent] || []
+    if (!hierarchy[parent].includes(child)) {
+      hierarchy[parent].push(child)
+    }
+  }
+  return hierarchy
+}
+
+// "/auth/", "auth" -> "/auth"; "" and "/" -> ""
+function parseBasePath (value) {
+  const trimmed = (value || '').trim().replace(/^\/+|\/+$/g, '')
+  return trimmed ? `/${trimmed}` : ''
+}
+
+// Issuer URL including the base path (added unless the issuer already ends with it)
+function resolveIssuer (issuer, basePath) {
+  const base = issuer.replace(/\/+$/, '')
+  return basePath && !base.endsWith(basePath) ? `${base}${basePath}` : base
+}
+
+// bcrypt cost bounds: below 10 is too cheap to brute-force, above 15 makes
+// every login slow enough to be a denial-of-service lever
+const BCRYPT_COST_MIN = 10
+const BCRYPT_COST_MAX = 15
+
+function parseBcryptCost (value) {
+  if (value === undefined || value === '') return BCRYPT_COST_MIN
+  const cost = Number(value)
+  if (!Number.isInteger(cost) || cost < BCRYPT_COST_MIN || cost > BCRYPT_COST_MAX) {
+    throw new Error(`NGAUTH_BCRYPT_COST must be an integer from ${BCRYPT_COST_MIN} to ${BCRYPT_COST_MAX}, got '${value}'`)
+  }
+  return cost
+}
+
+const STORE_ENCRYPTION_KEY_MIN_LENGTH = 32
+
+function parseStoreEncryptionKey (value) {
+  if (value === undefined || value === '') return null
+  if (value.length < STORE_ENCRYPTION_KEY_MIN_LENGTH) {
+    throw new Error(`NGAUTH_STORE_ENCRYPTION_KEY must be at least ${STORE_ENCRYPTION_KEY_MIN_LENGTH} characters`)
+  }
+  return value
+}
+
+const CHALLENGE_PROVIDERS = ['none', 'hcaptcha', 'turnstile']
+
+function parseChallengeProvider (value) {
+  if (value === undefined || value === '') return 'none'
+  if (!CHALLENGE_PROVIDERS.includes(value)) {
+    throw new Error(`NGAUTH_CHALLENGE_PROVIDER must be one of ${CHALLENGE_PROVIDERS.join(', ')}, got '${value}'`)
+  }
+  return value
+}
+
+// Sources of user claims in id_tokens and userinfo (see src/oidc.js)
+const CLAIM_SOURCES = ['enrichment', 'user', 'upstream']
+
+// Comma-separated sources, highest precedence first; a source left out
+// contributes no claims
+function parseClaimSourcePrecedence (value) {
+  if (value === undefined || value === '') return [...CLAIM_SOURCES]
+  const sources = value.split(',').map(s => s.trim()).filter(s => s)
+  const unknown = sources.find(s => !CLAIM_SOURCES.includes(s))
+  if (unknown || sources.length === 0 || new Set(sources).size !== sources.length) {
+    throw new Error(`NGAUTH_CLAIM_SOURCE_PRECEDENCE must list distinct sources from ${CLAIM_SOURCES.join(', ')}, got '${value}'`)
+  }
+  return sources
+}
+
+// JSON object of claim name -> value; a preset may supply the default
+function parseDefaultClaims (value, defaultValue = {}) {
+  if (value === undefined || value === '') return { ...(defaultValue || {}) }
+  let claims
+  try {
+    claims = JSON.parse(value)
+  } catch (err) {
+    throw new Error(`NGAUTH_DEFAULT_CLAIMS must be valid JSON, got '${value}'`)
+  }
+  if (!claims || typeof claims !== 'object' || Array.isArray(claims)) {
+    throw new Error(`NGAUTH_DEFAULT_CLAIMS must be a JSON object, got '${value}'`)
+  }
+  return claims
+}
+
+// The session cookie is Secure unless configured otherwise, except for an
+// http issuer outside production, where browsers would not send it back
+function parseCookieSecure (value, issuer) {
+  return parseBoolean(value, process.env.NODE_ENV === 'production' || /^https:/i.test(issuer || ''))
+}
+
+// Entropy floor for authorization codes, device codes and refresh tokens:
+// 128 bits keeps guessing infeasible whatever the policy asks for
+const CODE_BYTES_MIN = 16
+const CODE_BYTES_MAX = 128
+
+function parseCodeBytes (name, value, defaultValue) {
+  if (value === undefined || value === '') return defaultValue
+  const bytes = Number(value)
+  if (!Number.isInteger(bytes) || bytes < CODE_BYTES_MIN || bytes > CODE_BYTES_MAX) {
+    throw new Error(`${name} must be an integer from ${CODE_BYTES_MIN} to ${CODE_BYTES_MAX}, got '${value}'`)
+  }
+  return bytes
+}
+
+// Device user codes are typed by hand and protected by the entry lockout,
+// but fewer than 8 characters (about 34 bits) is too easy to guess
+const USER_CODE_LENGTH_MIN = 8
+const USER_CODE_LENGTH_MAX = 20
+
+function parseUserCodeLength (value) {
+  if (value === undefined || value === '') return USER_CODE_LENGTH_MIN
+  const length = Number(value)
+  if (!Number.isInteger(length) || length < USER_CODE_LENGTH_MIN || length > USER_CODE_LENGTH_MAX) {
+    throw new Error(`NGAUTH_USER_CODE_LENGTH must be an integer from ${USER_CODE_LENGTH_MIN} to ${USER_CODE_LENGTH_MAX}, got '${value}'`)
+  }
+  return length
+}
+
+// Request body size: bytes, or a number with a kb or mb suffix. At least
+// 1kb, so an ordinary form post always fits.
+const BODY_LIMIT_MIN = 1024
+const BODY_LIMIT_UNITS = { '': 1, b: 1, kb: 1024, mb: 1024 * 1024 }
+
+function parseBodyLimit (name, value, defaultValue) {
+  if (value === undefined || value === '') return defaultValue
+  const match = /^(\d+)\s*(b|kb|mb)?$/i.exec(value.trim())
+  const bytes = match ? Number(match[1]) * BODY_LIMIT_UNITS[(match[2] || '').toLowerCase()] : NaN
+  if (!Number.isSafeInteger(bytes) || bytes < BODY_LIMIT_MIN) {
+    throw new Error(`${name} must be a size of at least 1kb (e.g. 100kb or 1mb), got '${value}'`)
+  }
+  return bytes
+}
+
+// Each endpoint class defaults to NGAUTH_BODY_LIMIT
+function parseBodyLimits (env) {
+  const base = parseBodyLimit('NGAUTH_BODY_LIMIT', env.NGAUTH_BODY_LIMIT, 100 * 1024)
+  return {
+    default: base,
+    token: parseBodyLimit('NGAUTH_BODY_LIMIT_TOKEN', env.NGAUTH_BODY_LIMIT_TOKEN, base),
+    registration: parseBodyLimit('NGAUTH_BODY_LIMIT_REGISTRATION', env.NGAUTH_BODY_LIMIT_REGISTRATION, base),
+    introspection: parseBodyLimit('NGAUTH_BODY_LIMIT_INTROSPECTION', env.NGAUTH_BODY_LIMIT_INTROSPECTION, base)
+  }
+}
+
+// Prefix of opaque refresh tokens for secret scanners; letters, digits and
+// underscores, as scanner patterns usually expect
+const TOKEN_PREFIX_PATTERN = /^[A-Za-z0-9_]{0,32}$/
+
+function parseTokenPrefix (value) {
+  if (value === undefined) return ''
+  if (!TOKEN_PREFIX_PATTERN.test(value)) {
+    throw new Error(`NGAUTH_REFRESH_TOKEN_PREFIX must be at most 32 letters, digits or underscores, got '${value}'`)
+  }
+  return value
+}
+
 function loadConfig () {
   const preset = process.env.NGAUTH_PRESET || 'custom'
 
@@ -33,7 +200,13 @@ function loadConfig () {
     preset,
     name: presetConfig.name,
     port: parseInt(process.env.PORT || '3000'),
-    issuer: process.env.NGAUTH_ISSUER || `http://localhost:${process.env.PORT || '3000'}`,
+    // Path prefix for every route (e.g. /auth when mounted under a sub-path)
+    basePath: parseBasePath(process.env.NGAUTH_BASE_PATH),
+    issuer: resolveIssuer(
+      process.env.NGAUTH_ISSUER || `http://localhost:${process.env.PORT || '3000'}`,
+      parseBasePath(process.env.NGAUTH_BASE_PATH)
+    ),
+    trustedProxies: parseList(process.env.NGAUTH_TRUSTED_PROXIES),
     endpoints: {
       authorize: process.env.NGAUTH_AUTHORIZE_PATH || presetConfig.endpoints.authorize,
       token: process.env.NGAUTH_TOKEN_PATH || presetConfig.endpoints.token,
@@ -66,7 +239,13 @@ function loadConfig () {
         process.env.NGAUTH_USE_RESOURCE_ACCESS,
         presetConfig.claims.useResourceAccess
       ),
-      cognitoPrefix: presetConfig.claims.cognitoPrefix || ''
+      cognitoPrefix: presetConfig.claims.cognitoPrefix || '',
+      // Which claim source wins a conflict, highest first
+      sourcePrecedence: parseClaimSourcePrecedence(process.env.NGAUTH_CLAIM_SOURCE_PRECEDENCE),
+      // Issuer-level claims added to every issued token (see src/tokens.js)
+      defaultClaims: parseDefaultClaims(process.env.NGAUTH_DEFAULT_CLAIMS, presetConfig.claims.defaultClaims),
+      // Keys pairwise subject identifiers; pairwise clients are refused without it
+      pairwiseSecret: process.env.NGAUTH_PAIRWISE_SECRET || ''
     },
     tokens: {
       accessTokenTTL: parseInt(
@@ -78,7 +257,21 @@ function loadConfig () {
       refreshTokenTTL: parseInt(
         process.env.NGAUTH_REFRESH_TOKEN_TTL || presetConfig.tokens.refreshTokenTTL?.toString() || '86400'
       ),
-      signingAlgorithm: process.env.NGAUTH_TOKEN_SIGNING_ALG || presetConfig.tokens.signingAlgorithm
+      // Times a refresh token can be rotated before a new login is needed (0 = unlimited)
+      maxRefreshRotations: parseInt(process.env.NGAUTH_REFRESH_TOKEN_MAX_ROTATIONS || '0'),
+      signingAlgorithm: process.env.NGAUTH_TOKEN_SIGNING_ALG || presetConfig.tokens.signingAlgorithm,
+      defaultAudience: parseList(process.env.NGAUTH_DEFAULT_AUDIENCE),
+      // Add nbf (equal to iat) to every issued token
+      notBefore: parseBoolean(process.env.NGAUTH_TOKEN_NBF, false),
+      // Name the client that obtained an access token in its client_id claim
+      includeClientId: parseBoolean(process.env.NGAUTH_ACCESS_TOKEN_CLIENT_ID, true),
+      // Revoke the tokens issued from an authorization code presented twice
+      revokeOnCodeReuse: parseBoolean(process.env.NGAUTH_REVOKE_ON_CODE_REUSE, true),
+      // Name the JWKS URL in the jku header of issued tokens
+      jkuHeader: parseBoolean(process.env.NGAUTH_TOKEN_JKU, false),
+      // Debug aid: describe the issued access token (jti, iat, exp, scope)
+      // in a Token-Issuance response header of the token endpoint
+      issuanceHeader: parseBoolean(process.env.NGAUTH_TOKEN_ISSUANCE_HEADER, false)
     },
     features: {
       pkce: parseBoolean(process.env.NGAUTH_SUPPORT_PKCE, presetConfig.features.pkce),
@@ -89,7 +282,182 @@ function loadConfig () {
       offlineAccess: parseBoolean(
         process.env.NGAUTH_SUPPORT_OFFLINE_ACCESS,
         presetConfig.features.offlineAccess
-      )
+      ),
+      authorizationCodeGrant: parseBoolean(process.env.NGAUTH_SUPPORT_AUTHORIZATION_CODE_GRANT, true),
+      clientCredentialsGrant: parseBoolean(process.env.NGAUTH_SUPPORT_CLIENT_CREDENTIALS_GRANT, true),
+      deviceCodeGrant: parseBoolean(process.env.NGAUTH_SUPPORT_DEVICE_CODE_GRANT, true)
+    },
+    dpop: {
+      enabled: parseBoolean(process.env.NGAUTH_DPOP_ENABLED, false),
+      requireNonce: parseBoolean(process.env.NGAUTH_DPOP_REQUIRE_NONCE, false),
+      nonceTTL: parseInt(process.env.NGAUTH_DPOP_NONCE_TTL || '300'),
+      proofMaxAge: parseInt(process.env.NGAUTH_DPOP_PROOF_MAX_AGE || '300')
+    },
+    clientAssertions: {
+      leeway: parseInt(process.env.NGAUTH_CLIENT_ASSERTION_LEEWAY || '30'),
+      maxLifetime: parseInt(process.env.NGAUTH_CLIENT_ASSERTION_MAX_LIFETIME || '300')
+    },
+    sweeper: {
+      enabled: parseBoolean(process.env.NGAUTH_SWEEPER_ENABLED, true),
+      interval: parseInt(process.env.NGAUTH_SWEEPER_INTERVAL || '300'),
+      batchSize: parseInt(process.env.NGAUTH_SWEEPER_BATCH_SIZE || '500')
+    },
+    consent: {
+      required: parseBoolean(process.env.NGAUTH_REQUIRE_CONSENT, false)
+    },
+    scopeHierarchy: parseScopeHierarchy(process.env.NGAUTH_SCOPE_HIERARCHY),
+    tokenFormat: {
+      // Bump only together with a documented change to the access token claim set
+      version: process.env.NGAUTH_TOKEN_FORMAT_VERSION || '1',
+      claimName: process.env.NGAUTH_TOKEN_VERSION_CLAIM || 'ver'
+    },
+    clientSecrets: {
+      rotationGracePeriod: parseInt(process.env.NGAUTH_CLIENT_SECRET_GRACE_PERIOD || '86400')
+    },
+    // Largest accepted request body per endpoint class, in bytes
+    bodyLimits: parseBodyLimits(process.env),
+    tokenEndpoint: {
+      // RFC 6749 requires application/x-www-form-urlencoded; off by default for backward compatibility
+      strictContentType: parseBoolean(process.env.NGAUTH_TOKEN_STRICT_CONTENT_TYPE, false),
+      // token_type for bearer tokens: 'Bearer' (RFC 6750 spelling) or 'bearer'
+      tokenType: process.env.NGAUTH_TOKEN_TYPE || 'Bearer'
+    },
+    idempotency: {
+      ttl: parseInt(process.env.NGAUTH_IDEMPOTENCY_TTL || '300')
+    },
+    signingKeys: {
+      idToken: process.env.NGAUTH_ID_TOKEN_KID || null,
+      logoutToken: process.env.NGAUTH_LOGOUT_TOKEN_KID || null,
+      ecKey: process.env.NGAUTH_EC_KEY_KID || null,
+      // Seconds a rotated default key is published in the JWKS before it signs
+      activationDelay: parseInt(process.env.NGAUTH_KEY_ACTIVATION_DELAY || '900')
+    },
+    sessions: {
+      maxPerUser: parseInt(process.env.NGAUTH_MAX_SESSIONS_PER_USER || '0'),
+      limitPolicy: process.env.NGAUTH_SESSION_LIMIT_POLICY || 'evict-oldest'
+    },
+    sessionCookie: {
+      name: process.env.NGAUTH_SESSION_COOKIE_NAME || 'connect.sid',
+      secure: parseCookieSecure(process.env.NGAUTH_SESSION_COOKIE_SECURE, process.env.NGAUTH_ISSUER),
+      httpOnly: parseBoolean(process.env.NGAUTH_SESSION_COOKIE_HTTP_ONLY, true),
+      // Lax lets the cookie through when a client redirects to /authorize
+      sameSite: (process.env.NGAUTH_SESSION_COOKIE_SAMESITE || 'lax').toLowerCase(),
+      // Set a parent domain to share sign-ins across subdomains
+      domain: process.env.NGAUTH_SESSION_COOKIE_DOMAIN || null,
+      path: process.env.NGAUTH_SESSION_COOKIE_PATH || '/'
+    },
+    scopeParsing: {
+      // Legacy clients: also split scope on commas
+      allowCommas: parseBoolean(process.env.NGAUTH_SCOPE_ALLOW_COMMAS, false),
+      // Caps on a normalized scope parameter (0 = unlimited)
+      maxScopes: parseInt(process.env.NGAUTH_MAX_SCOPES || '50'),
+      maxScopeLength: parseInt(process.env.NGAUTH_MAX_SCOPE_LENGTH || '2048')
+    },
+    rateLimit: {
+      store: process.env.NGAUTH_RATE_LIMIT_STORE || 'memory',
+      redisUrl: process.env.NGAUTH_REDIS_URL || 'redis://localhost:6379',
+      failureMode: process.env.NGAUTH_RATE_LIMIT_FAILURE_MODE || 'open',
+      // Requests per window on the token-probing endpoints, per IP and per client (0 = unlimited)
+      endpointWindow: parseInt(process.env.NGAUTH_ENDPOINT_RATE_LIMIT_WINDOW || '60'),
+      userinfo: parseInt(process.env.NGAUTH_USERINFO_RATE_LIMIT || '120'),
+      introspect: parseInt(process.env.NGAUTH_INTROSPECT_RATE_LIMIT || '600'),
+      // Introspections of inactive tokens per window and client before it is blocked
+      introspectInactive: parseInt(process.env.NGAUTH_INTROSPECT_INACTIVE_RATE_LIMIT || '30')
+    },
+    registration: {
+      // Reject a client_name already used by another client (case-insensitive)
+      uniqueClientNames: parseBoolean(process.env.NGAUTH_UNIQUE_CLIENT_NAMES, false),
+      // Redirect URI registered to another client: 'allow', 'warn' (audit log) or 'reject'
+      redirectUriCollisionPolicy: process.env.NGAUTH_REDIRECT_URI_COLLISION_POLICY || 'allow',
+      // Fetch http and private-network sector_identifier_uri documents (development only)
+      allowPrivateSectorUris: parseBoolean(process.env.NGAUTH_ALLOW_PRIVATE_SECTOR_URIS, false),
+      // Fetch http and private-network client jwks_uri documents (development only)
+      allowPrivateJwksUris: parseBoolean(process.env.NGAUTH_ALLOW_PRIVATE_JWKS_URIS, false)
+    },
+    authorizeRequest: {
+      // Maximum length of the /authorize query string in characters (0 = unlimited)
+      maxQueryLength: parseInt(process.env.NGAUTH_AUTHORIZE_MAX_QUERY_LENGTH || '8192'),
+      // Reject unrecognized parameters instead of ignoring (and logging) them
+      strictParameters: parseBoolean(process.env.NGAUTH_AUTHORIZE_STRICT_PARAMS, false),
+      // HTML template for errors shown to browsers ({{error}}, {{error_description}})
+      errorPageTemplate: process.env.NGAUTH_AUTHORIZE_ERROR_PAGE || null
+    },
+    scopePolicy: {
+      // User-identity scopes (openid, profile, ...) on client_credentials: 'strip' or 'reject'
+      clientCredentialsUserScopes: process.env.NGAUTH_CLIENT_CREDENTIALS_USER_SCOPES || 'strip',
+      // Scopes only grantable to machine clients via client_credentials
+      machineOnlyScopes: (process.env.NGAUTH_MACHINE_ONLY_SCOPES || '').split(',').map(s => s.trim()).filter(s => s),
+      // Clients that may be granted the admin scope (besides seed clients with admin_access)
+      adminClients: parseList(process.env.NGAUTH_ADMIN_CLIENTS)
+    },
+    scopeBaseline: {
+      // Audit token requests for scopes outside the client's usual ones:
+      // 'off', 'monitor' (audit only) or 'enforce' (also refuse them)
+      mode: process.env.NGAUTH_SCOPE_BASELINE || 'off',
+      // Token requests of a client learned wholesale before checking starts
+      learningRequests: parseInt(process.env.NGAUTH_SCOPE_BASELINE_LEARNING || '20'),
+      // Grants of a new scope before it joins the baseline
+      adoptAfter: parseInt(process.env.NGAUTH_SCOPE_BASELINE_ADOPT_AFTER || '10'),
+      // Most scopes one client's baseline may hold
+      maxScopes: parseInt(process.env.NGAUTH_SCOPE_BASELINE_MAX_SCOPES || '50')
+    },
+    eventStream: {
+      // Events queued per slow /admin/events consumer before the oldest are dropped
+      bufferSize: parseInt(process.env.NGAUTH_EVENT_STREAM_BUFFER || '100'),
+      // Seconds between keep-alive comments on idle streams
+      heartbeatInterval: parseInt(process.env.NGAUTH_EVENT_STREAM_HEARTBEAT || '30')
+    },
+    passwords: {
+      // bcrypt cost for new hashes; older hashes are upgraded on the next login
+      bcryptCost: parseBcryptCost(process.env.NGAUTH_BCRYPT_COST)
+    },
+    introspection: {
+      // Report tokens as inactive unless their aud names the introspecting client
+      audienceCheck: parseBoolean(process.env.NGAUTH_INTROSPECT_AUDIENCE_CHECK, false)
+    },
+    storeEncryption: {
+      // Secret (32+ characters) for encrypting sensitive fields of stored codes and refresh tokens
+      secret: parseStoreEncryptionKey(process.env.NGAUTH_STORE_ENCRYPTION_KEY)
+    },
+    challenge: {
+      // Bot challenge provider: none, hcaptcha or turnstile (a custom verifier can be installed instead)
+      provider: parseChallengeProvider(process.env.NGAUTH_CHALLENGE_PROVIDER),
+      secret: process.env.NGAUTH_CHALLENGE_SECRET || null,
+      siteKey: process.env.NGAUTH_CHALLENGE_SITE_KEY || null,
+      // Require a solved challenge to create an account
+      onRegistration: parseBoolean(process.env.NGAUTH_CHALLENGE_ON_REGISTRATION, true),
+      // Require a solved challenge to log in after this many failed attempts (0 = never)
+      loginAfterFailures: parseInt(process.env.NGAUTH_CHALLENGE_LOGIN_AFTER_FAILURES || '0')
+    },
+    caching: {
+      // Seconds clients and proxies may cache the discovery documents (0 = revalidate every time)
+      discoveryMaxAge: parseInt(process.env.NGAUTH_DISCOVERY_MAX_AGE || '3600'),
+      // Seconds they may cache the JWKS; keep below the key rotation overlap
+      jwksMaxAge: parseInt(process.env.NGAUTH_JWKS_MAX_AGE || '600')
+    },
+    seed: {
+      // JSON file of clients and users to create or update at startup
+      file: process.env.NGAUTH_SEED_FILE || null
+    },
+    deviceFlow: {
+      // Lifetime of device and user codes in seconds (RFC 8628 3.2)
+      codeTTL: parseInt(process.env.NGAUTH_DEVICE_CODE_TTL || '600'),
+      // Minimum polling interval in seconds; polling faster gets slow_down
+      interval: parseInt(process.env.NGAUTH_DEVICE_POLL_INTERVAL || '5'),
+      // User code entries allowed per IP and per session before a lockout
+      maxAttempts: parseInt(process.env.NGAUTH_DEVICE_MAX_ATTEMPTS || '5'),
+      // Lockout window in seconds
+      lockoutSeconds: parseInt(process.env.NGAUTH_DEVICE_LOCKOUT || '900')
+    },
+    codes: {
+      // Random bytes behind each code and token (at least 16)
+      authorizationCodeBytes: parseCodeBytes('NGAUTH_AUTHORIZATION_CODE_BYTES', process.env.NGAUTH_AUTHORIZATION_CODE_BYTES, 32),
+      deviceCodeBytes: parseCodeBytes('NGAUTH_DEVICE_CODE_BYTES', process.env.NGAUTH_DEVICE_CODE_BYTES, 32),
+      refreshTokenBytes: parseCodeBytes('NGAUTH_REFRESH_TOKEN_BYTES', process.env.NGAUTH_REFRESH_TOKEN_BYTES, 32),
+      // Put in front of the random part of refresh tokens (e.g. ngauth_rt_)
+      refreshTokenPrefix: parseTokenPrefix(process.env.NGAUTH_REFRESH_TOKEN_PREFIX),
+      // Characters in a device user code (at least 8)
+      userCodeLength: parseUserCodeLength(process.env.NGAUTH_USER_CODE_LENGTH)
     }
   }
 
@@ -103,7 +471,13 @@ function loadCustomConfig () {
     preset: 'custom',
     name: 'Custom Configuration',
     port,
-    issuer: process.env.NGAUTH_ISSUER || `http://localhost:${port}`,
+    // Path prefix for every route (e.g. /auth when mounted under a sub-path)
+    basePath: parseBasePath(process.env.NGAUTH_BASE_PATH),
+    issuer: resolveIssuer(
+      process.env.NGAUTH_ISSUER || `http://localhost:${port}`,
+      parseBasePath(process.env.NGAUTH_BASE_PATH)
+    ),
+    trustedProxies: parseList(process.env.NGAUTH_TRUSTED_PROXIES),
     endpoints: {
       authorize: process.env.NGAUTH_AUTHORIZE_PATH || '/authorize',
       token: process.env.NGAUTH_TOKEN_PATH || '/token',
@@ -127,18 +501,213 @@ function loadCustomConfig () {
       namespacePrefix: process.env.NGAUTH_NAMESPACE_PREFIX || '',
       useRealmAccess: parseBoolean(process.env.NGAUTH_USE_REALM_ACCESS, false),
       useResourceAccess: parseBoolean(process.env.NGAUTH_USE_RESOURCE_ACCESS, false),
-      cognitoPrefix: ''
+      cognitoPrefix: '',
+      // Which claim source wins a conflict, highest first
+      sourcePrecedence: parseClaimSourcePrecedence(process.env.NGAUTH_CLAIM_SOURCE_PRECEDENCE),
+      // Issuer-level claims added to every issued token (see src/tokens.js)
+      defaultClaims: parseDefaultClaims(process.env.NGAUTH_DEFAULT_CLAIMS),
+      // Keys pairwise subject identifiers; pairwise clients are refused without it
+      pairwiseSecret: process.env.NGAUTH_PAIRWISE_SECRET || ''
     },
     tokens: {
       accessTokenTTL: parseInt(process.env.NGAUTH_ACCESS_TOKEN_TTL || '3600'),
       idTokenTTL: parseInt(process.env.NGAUTH_ID_TOKEN_TTL || '3600'),
       refreshTokenTTL: parseInt(process.env.NGAUTH_REFRESH_TOKEN_TTL || '86400'),
-      signingAlgorithm: process.env.NGAUTH_TOKEN_SIGNING_ALG || 'RS256'
+      // Times a refresh token can be rotated before a new login is needed (0 = unlimited)
+      maxRefreshRotations: parseInt(process.env.NGAUTH_REFRESH_TOKEN_MAX_ROTATIONS || '0'),
+      signingAlgorithm: process.env.NGAUTH_TOKEN_SIGNING_ALG || 'RS256',
+      defaultAudience: parseList(process.env.NGAUTH_DEFAULT_AUDIENCE),
+      // Add nbf (equal to iat) to every issued token
+      notBefore: parseBoolean(process.env.NGAUTH_TOKEN_NBF, false),
+      // Name the client that obtained an access token in its client_id claim
+      includeClientId: parseBoolean(process.env.NGAUTH_ACCESS_TOKEN_CLIENT_ID, true),
+      // Revoke the tokens issued from an authorization code presented twice
+      revokeOnCodeReuse: parseBoolean(process.env.NGAUTH_REVOKE_ON_CODE_REUSE, true),
+      // Name the JWKS URL in the jku header of issued tokens
+      jkuHeader: parseBoolean(process.env.NGAUTH_TOKEN_JKU, false),
+      // Debug aid: describe the issued access token (jti, iat, exp, scope)
+      // in a Token-Issuance response header of the token endpoint
+      issuanceHeader: parseBoolean(process.env.NGAUTH_TOKEN_ISSUANCE_HEADER, false)
     },
     features: {
       pkce: parseBoolean(process.env.NGAUTH_SUPPORT_PKCE, true),
       refreshTokens: parseBoolean(process.env.NGAUTH_SUPPORT_REFRESH_TOKENS, true),
-      offlineAccess: parseBoolean(process.env.NGAUTH_SUPPORT_OFFLINE_ACCESS, true)
+      offlineAccess: parseBoolean(process.env.NGAUTH_SUPPORT_OFFLINE_ACCESS, true),
+      authorizationCodeGrant: parseBoolean(process.env.NGAUTH_SUPPORT_AUTHORIZATION_CODE_GRANT, true),
+      clientCredentialsGrant: parseBoolean(process.env.NGAUTH_SUPPORT_CLIENT_CREDENTIALS_GRANT, true),
+      deviceCodeGrant: parseBoolean(process.env.NGAUTH_SUPPORT_DEVICE_CODE_GRANT, true)
+    },
+    dpop: {
+      enabled: parseBoolean(process.env.NGAUTH_DPOP_ENABLED, false),
+      requireNonce: parseBoolean(process.env.NGAUTH_DPOP_REQUIRE_NONCE, false),
+      nonceTTL: parseInt(process.env.NGAUTH_DPOP_NONCE_TTL || '300'),
+      proofMaxAge: parseInt(process.env.NGAUTH_DPOP_PROOF_MAX_AGE || '300')
+    },
+    clientAssertions: {
+      leeway: parseInt(process.env.NGAUTH_CLIENT_ASSERTION_LEEWAY || '30'),
+      maxLifetime: parseInt(process.env.NGAUTH_CLIENT_ASSERTION_MAX_LIFETIME || '300')
+    },
+    sweeper: {
+      enabled: parseBoolean(process.env.NGAUTH_SWEEPER_ENABLED, true),
+      interval: parseInt(process.env.NGAUTH_SWEEPER_INTERVAL || '300'),
+      batchSize: parseInt(process.env.NGAUTH_SWEEPER_BATCH_SIZE || '500')
+    },
+    consent: {
+      required: parseBoolean(process.env.NGAUTH_REQUIRE_CONSENT, false)
+    },
+    scopeHierarchy: parseScopeHierarchy(process.env.NGAUTH_SCOPE_HIERARCHY),
+    tokenFormat: {
+      // Bump only together with a documented change to the access token claim set
+      version: process.env.NGAUTH_TOKEN_FORMAT_VERSION || '1',
+      claimName: process.env.NGAUTH_TOKEN_VERSION_CLAIM || 'ver'
+    },
+    clientSecrets: {
+      rotationGracePeriod: parseInt(process.env.NGAUTH_CLIENT_SECRET_GRACE_PERIOD || '86400')
+    },
+    // Largest accepted request body per endpoint class, in bytes
+    bodyLimits: parseBodyLimits(process.env),
+    tokenEndpoint: {
+      // RFC 6749 requires application/x-www-form-urlencoded; off by default for backward compatibility
+      strictContentType: parseBoolean(process.env.NGAUTH_TOKEN_STRICT_CONTENT_TYPE, false),
+      // token_type for bearer tokens: 'Bearer' (RFC 6750 spelling) or 'bearer'
+      tokenType: process.env.NGAUTH_TOKEN_TYPE || 'Bearer'
+    },
+    idempotency: {
+      ttl: parseInt(process.env.NGAUTH_IDEMPOTENCY_TTL || '300')
+    },
+    signingKeys: {
+      idToken: process.env.NGAUTH_ID_TOKEN_KID || null,
+      logoutToken: process.env.NGAUTH_LOGOUT_TOKEN_KID || null,
+      ecKey: process.env.NGAUTH_EC_KEY_KID || null,
+      // Seconds a rotated default key is published in the JWKS before it signs
+      activationDelay: parseInt(process.env.NGAUTH_KEY_ACTIVATION_DELAY || '900')
+    },
+    sessions: {
+      maxPerUser: parseInt(process.env.NGAUTH_MAX_SESSIONS_PER_USER || '0'),
+      limitPolicy: process.env.NGAUTH_SESSION_LIMIT_POLICY || 'evict-oldest'
+    },
+    sessionCookie: {
+      name: process.env.NGAUTH_SESSION_COOKIE_NAME || 'connect.sid',
+      secure: parseCookieSecure(process.env.NGAUTH_SESSION_COOKIE_SECURE, process.env.NGAUTH_ISSUER),
+      httpOnly: parseBoolean(process.env.NGAUTH_SESSION_COOKIE_HTTP_ONLY, true),
+      // Lax lets the cookie through when a client redirects to /authorize
+      sameSite: (process.env.NGAUTH_SESSION_COOKIE_SAMESITE || 'lax').toLowerCase(),
+      // Set a parent domain to share sign-ins across subdomains
+      domain: process.env.NGAUTH_SESSION_COOKIE_DOMAIN || null,
+      path: process.env.NGAUTH_SESSION_COOKIE_PATH || '/'
+    },
+    scopeParsing: {
+      // Legacy clients: also split scope on commas
+      allowCommas: parseBoolean(process.env.NGAUTH_SCOPE_ALLOW_COMMAS, false),
+      // Caps on a normalized scope parameter (0 = unlimited)
+      maxScopes: parseInt(process.env.NGAUTH_MAX_SCOPES || '50'),
+      maxScopeLength: parseInt(process.env.NGAUTH_MAX_SCOPE_LENGTH || '2048')
+    },
+    rateLimit: {
+      store: process.env.NGAUTH_RATE_LIMIT_STORE || 'memory',
+      redisUrl: process.env.NGAUTH_REDIS_URL || 'redis://localhost:6379',
+      failureMode: process.env.NGAUTH_RATE_LIMIT_FAILURE_MODE || 'open',
+      // Requests per window on the token-probing endpoints, per IP and per client (0 = unlimited)
+      endpointWindow: parseInt(process.env.NGAUTH_ENDPOINT_RATE_LIMIT_WINDOW || '60'),
+      userinfo: parseInt(process.env.NGAUTH_USERINFO_RATE_LIMIT || '120'),
+      introspect: parseInt(process.env.NGAUTH_INTROSPECT_RATE_LIMIT || '600'),
+      // Introspections of inactive tokens per window and client before it is blocked
+      introspectInactive: parseInt(process.env.NGAUTH_INTROSPECT_INACTIVE_RATE_LIMIT || '30')
+    },
+    registration: {
+      // Reject a client_name already used by another client (case-insensitive)
+      uniqueClientNames: parseBoolean(process.env.NGAUTH_UNIQUE_CLIENT_NAMES, false),
+      // Redirect URI registered to another client: 'allow', 'warn' (audit log) or 'reject'
+      redirectUriCollisionPolicy: process.env.NGAUTH_REDIRECT_URI_COLLISION_POLICY || 'allow',
+      // Fetch http and private-network sector_identifier_uri documents (development only)
+      allowPrivateSectorUris: parseBoolean(process.env.NGAUTH_ALLOW_PRIVATE_SECTOR_URIS, false),
+      // Fetch http and private-network client jwks_uri documents (development only)
+      allowPrivateJwksUris: parseBoolean(process.env.NGAUTH_ALLOW_PRIVATE_JWKS_URIS, false)
+    },
+    authorizeRequest: {
+      // Maximum length of the /authorize query string in characters (0 = unlimited)
+      maxQueryLength: parseInt(process.env.NGAUTH_AUTHORIZE_MAX_QUERY_LENGTH || '8192'),
+      // Reject unrecognized parameters instead of ignoring (and logging) them
+      strictParameters: parseBoolean(process.env.NGAUTH_AUTHORIZE_STRICT_PARAMS, false),
+      // HTML template for errors shown to browsers ({{error}}, {{error_description}})
+      errorPageTemplate: process.env.NGAUTH_AUTHORIZE_ERROR_PAGE || null
+    },
+    scopePolicy: {
+      // User-identity scopes (openid, profile, ...) on client_credentials: 'strip' or 'reject'
+      clientCredentialsUserScopes: process.env.NGAUTH_CLIENT_CREDENTIALS_USER_SCOPES || 'strip',
+      // Scopes only grantable to machine clients via client_credentials
+      machineOnlyScopes: (process.env.NGAUTH_MACHINE_ONLY_SCOPES || '').split(',').map(s => s.trim()).filter(s => s),
+      // Clients that may be granted the admin scope (besides seed clients with admin_access)
+      adminClients: parseList(process.env.NGAUTH_ADMIN_CLIENTS)
+    },
+    scopeBaseline: {
+      // Audit token requests for scopes outside the client's usual ones:
+      // 'off', 'monitor' (audit only) or 'enforce' (also refuse them)
+      mode: process.env.NGAUTH_SCOPE_BASELINE || 'off',
+      // Token requests of a client learned wholesale before checking starts
+      learningRequests: parseInt(process.env.NGAUTH_SCOPE_BASELINE_LEARNING || '20'),
+      // Grants of a new scope before it joins the baseline
+      adoptAfter: parseInt(process.env.NGAUTH_SCOPE_BASELINE_ADOPT_AFTER || '10'),
+      // Most scopes one client's baseline may hold
+      maxScopes: parseInt(process.env.NGAUTH_SCOPE_BASELINE_MAX_SCOPES || '50')
+    },
+    eventStream: {
+      // Events queued per slow /admin/events consumer before the oldest are dropped
+      bufferSize: parseInt(process.env.NGAUTH_EVENT_STREAM_BUFFER || '100'),
+      // Seconds between keep-alive comments on idle streams
+      heartbeatInterval: parseInt(process.env.NGAUTH_EVENT_STREAM_HEARTBEAT || '30')
+    },
+    passwords: {
+      // bcrypt cost for new hashes; older hashes are upgraded on the next login
+      bcryptCost: parseBcryptCost(process.env.NGAUTH_BCRYPT_COST)
+    },
+    introspection: {
+      // Report tokens as inactive unless their aud names the introspecting client
+      audienceCheck: parseBoolean(process.env.NGAUTH_INTROSPECT_AUDIENCE_CHECK, false)
+    },
+    storeEncryption: {
+      // Secret (32+ characters) for encrypting sensitive fields of stored codes and refresh tokens
+      secret: parseStoreEncryptionKey(process.env.NGAUTH_STORE_ENCRYPTION_KEY)
+    },
+    challenge: {
+      // Bot challenge provider: none, hcaptcha or turnstile (a custom verifier can be installed instead)
+      provider: parseChallengeProvider(process.env.NGAUTH_CHALLENGE_PROVIDER),
+      secret: process.env.NGAUTH_CHALLENGE_SECRET || null,
+      siteKey: process.env.NGAUTH_CHALLENGE_SITE_KEY || null,
+      // Require a solved challenge to create an account
+      onRegistration: parseBoolean(process.env.NGAUTH_CHALLENGE_ON_REGISTRATION, true),
+      // Require a solved challenge to log in after this many failed attempts (0 = never)
+      loginAfterFailures: parseInt(process.env.NGAUTH_CHALLENGE_LOGIN_AFTER_FAILURES || '0')
+    },
+    caching: {
+      // Seconds clients and proxies may cache the discovery documents (0 = revalidate every time)
+      discoveryMaxAge: parseInt(process.env.NGAUTH_DISCOVERY_MAX_AGE || '3600'),
+      // Seconds they may cache the JWKS; keep below the key rotation overlap
+      jwksMaxAge: parseInt(process.env.NGAUTH_JWKS_MAX_AGE || '600')
+    },
+    seed: {
+      // JSON file of clients and users to create or update at startup
+      file: process.env.NGAUTH_SEED_FILE || null
+    },
+    deviceFlow: {
+      // Lifetime of device and user codes in seconds (RFC 8628 3.2)
+      codeTTL: parseInt(process.env.NGAUTH_DEVICE_CODE_TTL || '600'),
+      // Minimum polling interval in seconds; polling faster gets slow_down
+      interval: parseInt(process.env.NGAUTH_DEVICE_POLL_INTERVAL || '5'),
+      // User code entries allowed per IP and per session before a lockout
+      maxAttempts: parseInt(process.env.NGAUTH_DEVICE_MAX_ATTEMPTS || '5'),
+      // Lockout window in seconds
+      lockoutSeconds: parseInt(process.env.NGAUTH_DEVICE_LOCKOUT || '900')
+    },
+    codes: {
+      // Random bytes behind each code and token (at least 16)
+      authorizationCodeBytes: parseCodeBytes('NGAUTH_AUTHORIZATION_CODE_BYTES', process.env.NGAUTH_AUTHORIZATION_CODE_BYTES, 32),
+      deviceCodeBytes: parseCodeBytes('NGAUTH_DEVICE_CODE_BYTES', process.env.NGAUTH_DEVICE_CODE_BYTES, 32),
+      refreshTokenBytes: parseCodeBytes('NGAUTH_REFRESH_TOKEN_BYTES', process.env.NGAUTH_REFRESH_TOKEN_BYTES, 32),
+      // Put in front of the random part of refresh tokens (e.g. ngauth_rt_)
+      refreshTokenPrefix: parseTokenPrefix(process.env.NGAUTH_REFRESH_TOKEN_PREFIX),
+      // Characters in a device user code (at least 8)
+      userCodeLength: parseUserCodeLength(process.env.NGAUTH_USER_CODE_LENGTH)
     }
   }
 }
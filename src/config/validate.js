@@ -0,0 +1,315 @@
+/**
+ * Configuration Validation
+ *
+ * Checks the effective configuration once at startup so misconfiguration is
+ * reported up front, all at once, instead of as runtime errors or silently
+ * applied defaults. Problems with severity 'error' stop the server;
+ * 'warning' problems are logged.
+ */
+
+const crypto = require('crypto')
+const { buildTrustedProxyList } = require('../middleware/clientIp')
+
+const RSA_MIN_MODULUS_LENGTH = 2048
+const SESSION_SECRET_MIN_LENGTH = 32
+const STORE_ENCRYPTION_KEY_MIN_LENGTH = 32
+
+// Allowed values of settings read from free-form environment variables
+const ENUMS = {
+  'claims.scopeFormat': ['string', 'array'],
+  'tokenEndpoint.tokenType': ['Bearer', 'bearer'],
+  'sessions.limitPolicy': ['evict-oldest', 'deny-new'],
+  'rateLimit.store': ['memory', 'redis'],
+  'rateLimit.failureMode': ['open', 'closed'],
+  'registration.redirectUriCollisionPolicy': ['allow', 'warn', 'reject'],
+  'scopePolicy.clientCredentialsUserScopes': ['strip', 'reject'],
+  'scopeBaseline.mode': ['off', 'monitor', 'enforce'],
+  'sessionCookie.sameSite': ['strict', 'lax', 'none']
+}
+
+// Durations and counts; "min" is 0 where 0 disables the limit
+const NUMBERS = {
+  port: { min: 1, max: 65535 },
+  'tokens.accessTokenTTL': { min: 1 },
+  'tokens.idTokenTTL': { min: 1 },
+  'tokens.refreshTokenTTL': { min: 1 },
+  'tokens.maxRefreshRotations': { min: 0 },
+  'clientSecrets.rotationGracePeriod': { min: 0 },
+  'idempotency.ttl': { min: 1 },
+  'sessions.maxPerUser': { min: 0 },
+  'dpop.nonceTTL': { min: 1 },
+  'dpop.proofMaxAge': { min: 1 },
+  'clientAssertions.leeway': { min: 0 },
+  'clientAssertions.maxLifetime': { min: 1 },
+  'sweeper.interval': { min: 1 },
+  'sweeper.batchSize': { min: 1 },
+  'authorizeRequest.maxQueryLength': { min: 0 },
+  'scopeParsing.maxScopes': { min: 0 },
+  'scopeParsing.maxScopeLength': { min: 0 },
+  'challenge.loginAfterFailures': { min: 0 },
+  'caching.discoveryMaxAge': { min: 0 },
+  'caching.jwksMaxAge': { min: 0 },
+  'deviceFlow.codeTTL': { min: 1 },
+  'deviceFlow.interval': { min: 1 },
+  'deviceFlow.maxAttempts': { min: 1 },
+  'deviceFlow.lockoutSeconds': { min: 1 },
+  'signingKeys.activationDelay': { min: 0 },
+  'scopeBaseline.learningRequests': { min: 0 },
+  'scopeBaseline.adoptAfter': { min: 1 },
+  'scopeBaseline.maxScopes': { min: 1 },
+  'bodyLimits.default': { min: 1024 },
+  'bodyLimits.token': { min: 1024 },
+  'bodyLimits.registration': { min: 1024 },
+  'bodyLimits.introspection': { min: 1024 }
+}
+
+const LOOPBACK_HOSTS = ['localhost', '127.0.0.1', '[::1]']
+
+function getPath (config, path) {
+  return path.split('.').reduce((value, key) => (value == null ? undefined : value[key]), config)
+}
+
+function parseUrl (value) {
+  try {
+    return new URL(value)
+  } catch {
+    return null
+  }
+}
+
+function checkUrls (config, report) {
+  const issuer = typeof config.issuer === 'string' ? parseUrl(config.issuer) : null
+  if (!issuer || !['http:', 'https:'].includes(issuer.protocol)) {
+    report('error', 'issuer', `must be an http or https URL, got '${config.issuer}'`)
+  } else {
+    // The issuer identifier has no query or fragment (RFC 8414 2)
+    if (issuer.search || issuer.hash) {
+      report('error', 'issuer', 'must not contain a query or fragment')
+    }
+    if (issuer.protocol === 'http:' && !LOOPBACK_HOSTS.includes(issuer.hostname) && process.env.NODE_ENV === 'production') {
+      report('warning', 'issuer', 'uses http outside localhost; tokens and credentials would travel unencrypted')
+    }
+  }
+
+  for (const [name, path] of Object.entries(config.endpoints || {})) {
+    if (path && (typeof path !== 'string' || !path.startsWith('/'))) {
+      report('error', `endpoints.${name}`, `must be a path starting with '/', got '${path}'`)
+    }
+  }
+
+  if (config.rateLimit && config.rateLimit.store === 'redis') {
+    const redisUrl = parseUrl(config.rateLimit.redisUrl)
+    if (!redisUrl || !['redis:', 'rediss:'].includes(redisUrl.protocol)) {
+      report('error', 'rateLimit.redisUrl', 'must be a redis:// or rediss:// URL when the redis store is used')
+    }
+  }
+}
+
+function checkSigningKeys (config, signingKeys, report) {
+  // A rotated key must be in every cached JWKS before it signs anything
+  const activationDelay = getPath(config, 'signingKeys.activationDelay')
+  const jwksMaxAge = getPath(config, 'caching.jwksMaxAge')
+  if (Number.isInteger(activationDelay) && Number.isInteger(jwksMaxAge) && activationDelay < jwksMaxAge) {
+    report('warning', 'signingKeys.activationDelay', `is shorter than the JWKS cache lifetime (${jwksMaxAge}s), so resource servers may see tokens signed with a rotated key before their cached JWKS lists it`)
+  }
+
+  if (!signingKeys) return
+  if (signingKeys.length === 0) {
+    report('error', 'signingKeys', 'no signing key is loaded')
+    return
+  }
+
+  for (const key of signingKeys) {
+    let publicKey
+    try {
+      publicKey = crypto.createPublicKey(key.publicKey)
+    } catch (err) {
+      report('error', 'signingKeys', `key '${key.kid}' cannot be read: ${err.message}`)
+      continue
+    }
+    const details = publicKey.asymmetricKeyDetails || {}
+    if (key.alg === 'RS256' && publicKey.asymmetricKeyType !== 'rsa') {
+      report('error', 'signingKeys', `key '${key.kid}' must be an RSA key for RS256`)
+    } else if (key.alg === 'RS256' && details.modulusLength < RSA_MIN_MODULUS_LENGTH) {
+      report('error', 'signingKeys', `RSA key '${key.kid}' is ${details.modulusLength} bits; at least ${RSA_MIN_MODULUS_LENGTH} are required`)
+    }
+    if (key.alg === 'ES256' && details.namedCurve !== 'prime256v1') {
+      report('error', 'signingKeys', `key '${key.kid}' must use the P-256 curve for ES256`)
+    }
+  }
+
+  const algorithm = config.tokens && config.tokens.signingAlgorithm
+  if (algorithm && !signingKeys.some(key => key.alg === algorithm)) {
+    report('error', 'tokens.signingAlgorithm', `no ${algorithm} signing key is loaded`)
+  }
+}
+
+function checkGrants (config, report) {
+  const { features = {}, tokens = {}, dpop = {}, clientAssertions = {} } = config
+
+  if (features.offlineAccess && !features.refreshTokens) {
+    report('error', 'features.offlineAccess', 'offline_access needs refresh tokens to be enabled')
+  }
+  if (features.authorizationCodeGrant === false && features.clientCredentialsGrant === false && features.deviceCodeGrant === false) {
+    report('warning', 'features', 'disables the authorization code, client credentials and device code grants, so clients cannot obtain tokens')
+  }
+  if (!features.refreshTokens && tokens.maxRefreshRotations > 0) {
+    report('warning', 'tokens.maxRefreshRotations', 'has no effect while refresh tokens are disabled')
+  }
+  if (features.refreshTokens && tokens.refreshTokenTTL < tokens.accessTokenTTL) {
+    report('warning', 'tokens.refreshTokenTTL', 'is shorter than the access token lifetime, so refresh tokens expire before the tokens they renew')
+  }
+  if (dpop.requireNonce && !dpop.enabled) {
+    report('warning', 'dpop.requireNonce', 'has no effect while DPoP is disabled')
+  }
+  if (clientAssertions.leeway >= clientAssertions.maxLifetime) {
+    report('warning', 'clientAssertions.leeway', 'is not shorter than clientAssertions.maxLifetime, so stale assertions are accepted')
+  }
+}
+
+// Malformed proxy entries would otherwise fail every request that looks up
+// the client IP
+function checkTrustedProxies (config, report) {
+  try {
+    buildTrustedProxyList(config.trustedProxies || [])
+  } catch (err) {
+    report('error', 'trustedProxies', `is invalid: ${err.message}`)
+  }
+}
+
+// Cookie names are RFC 6265 tokens
+const COOKIE_NAME_PATTERN = /^[!#$%&'*+\-.^_`|~0-9A-Za-z]+$/
+
+// Session cookie attributes browsers would reject, or that break the
+// redirect-based flows
+function checkSessionCookie (config, report) {
+  const cookie = config.sessionCookie
+  if (!cookie) return
+
+  if (typeof cookie.name !== 'string' || !COOKIE_NAME_PATTERN.test(cookie.name)) {
+    report('error', 'sessionCookie.name', `must be a valid cookie name, got '${cookie.name}'`)
+  } else if (/^__(Secure|Host)-/.test(cookie.name) && !cookie.secure) {
+    report('error', 'sessionCookie.name', 'has a __Secure- or __Host- prefix, which needs a Secure cookie')
+  } else if (cookie.name.startsWith('__Host-') && (cookie.domain || cookie.path !== '/')) {
+    report('error', 'sessionCookie.name', "has the __Host- prefix, which allows no domain and only the path '/'")
+  }
+
+  if (cookie.sameSite === 'none' && !cookie.secure) {
+    report('error', 'sessionCookie.sameSite', 'none needs a Secure cookie; browsers reject SameSite=None cookies without it')
+  }
+  // A client redirecting the browser here is a cross-site navigation
+  if (cookie.sameSite === 'strict') {
+    report('warning', 'sessionCookie.sameSite', 'strict keeps the session cookie off the redirects from clients to the authorization endpoint, so signed-in users are asked to sign in again and prompt=none fails with login_required; use lax')
+  }
+  if (!cookie.httpOnly) {
+    report('warning', 'sessionCookie.httpOnly', 'is disabled; scripts on the login pages could read the session cookie')
+  }
+
+  const issuer = typeof config.issuer === 'string' ? parseUrl(config.issuer) : null
+  if (!issuer) return
+  if (cookie.secure && issuer.protocol === 'http:' && !LOOPBACK_HOSTS.includes(issuer.hostname)) {
+    report('warning', 'sessionCookie.secure', 'is set but the issuer uses http; browsers will not send the cookie and sign-in will not stick')
+  }
+  if (cookie.domain) {
+    const domain = cookie.domain.replace(/^\./, '').toLowerCase()
+    if (issuer.hostname !== domain && !issuer.hostname.endsWith(`.${domain}`)) {
+      report('error', 'sessionCookie.domain', `must be the issuer host ${issuer.hostname} or a parent domain of it, got '${cookie.domain}'`)
+    }
+  }
+  // The cookie must reach the authorization endpoint under the base path
+  const basePath = config.basePath || '/'
+  if (typeof cookie.path !== 'string' || !cookie.path.startsWith('/')) {
+    report('error', 'sessionCookie.path', `must start with '/', got '${cookie.path}'`)
+  } else if (cookie.path !== '/' && !`${basePath.replace(/\/$/, '')}/`.startsWith(`${cookie.path.replace(/\/$/, '')}/`)) {
+    report('error', 'sessionCookie.path', `must cover the base path ${basePath}, got '${cookie.path}'`)
+  }
+}
+
+function checkSecrets (config, sessionSecret, report) {
+  if (sessionSecret === undefined || sessionSecret === '') {
+    if (process.env.NODE_ENV === 'production') {
+      report('warning', 'SESSION_SECRET', 'is not set; a random secret signs out every user on restart and breaks sessions across instances')
+    }
+  } else if (sessionSecret.length < SESSION_SECRET_MIN_LENGTH) {
+    report('error', 'SESSION_SECRET', `must be at least ${SESSION_SECRET_MIN_LENGTH} characters`)
+  }
+
+  const storeKey = config.storeEncryption && config.storeEncryption.secret
+  if (storeKey && storeKey.length < STORE_ENCRYPTION_KEY_MIN_LENGTH) {
+    report('error', 'storeEncryption.secret', `must be at least ${STORE_ENCRYPTION_KEY_MIN_LENGTH} characters`)
+  }
+
+  const challenge = config.challenge || {}
+  if (challenge.provider && challenge.provider !== 'none') {
+    if (!challenge.secret) {
+      report('error', 'challenge.secret', `is required for the ${challenge.provider} challenge provider`)
+    }
+    if (!challenge.siteKey) {
+      report('error', 'challenge.siteKey', `is required for the ${challenge.provider} challenge provider`)
+    }
+  }
+}
+
+/**
+ * Validate the effective configuration
+ *
+ * @param {object} config - Loaded configuration
+ * @param {object} options
+ * @param {object[]} [options.signingKeys] - Loaded signing keys ({ kid, alg, publicKey }); skipped when omitted
+ * @param {string} [options.sessionSecret] - Session and cookie signing secret
+ * @returns {object[]} Problems as { severity, path, message }, empty when valid
+ */
+function validateConfig (config, { signingKeys, sessionSecret } = {}) {
+  const problems = []
+  const report = (severity, path, message) => problems.push({ severity, path, message })
+
+  for (const [path, allowed] of Object.entries(ENUMS)) {
+    const value = getPath(config, path)
+    if (value !== undefined && !allowed.includes(value)) {
+      report('error', path, `must be one of ${allowed.join(', ')}, got '${value}'`)
+    }
+  }
+
+  for (const [path, { min, max }] of Object.entries(NUMBERS)) {
+    const value = getPath(config, path)
+    if (value !== undefined && (!Number.isInteger(value) || value < min || (max !== undefined && value > max))) {
+      report('error', path, `must be an integer ${max !== undefined ? `from ${min} to ${max}` : `of at least ${min}`}, got '${value}'`)
+    }
+  }
+
+  checkUrls(config, report)
+  checkSigningKeys(config, signingKeys, report)
+  checkGrants(config, report)
+  checkSecrets(config, sessionSecret, report)
+  checkSessionCookie(config, report)
+  checkTrustedProxies(config, report)
+
+  return problems
+}
+
+const formatProblem = ({ path, message }) => `${path} ${message}`
+
+/**
+ * Validate the configuration, log warnings and throw listing every error
+ *
+ * @throws {Error} When any problem has severity 'error'
+ */
+function assertValidConfig (config, options) {
+  const problems = validateConfig(config, options)
+  for (const problem of problems.filter(p => p.severity === 'warning')) {
+    console.warn(`⚠️  Configuration: ${formatProblem(problem)}`)
+  }
+
+  const errors = problems.filter(p => p.severity === 'error')
+  if (errors.length > 0) {
+    const err = new Error(`Invalid configuration:\n${errors.map(e => `  - ${formatProblem(e)}`).join('\n')}`)
+    err.problems = errors
+    throw err
+  }
+  return problems
+}
+
+module.exports = {
+  validateConfig,
+  assertValidConfig
+}
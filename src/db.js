@@ -1,6 +1,7 @@
 const fs = require('fs').promises
 const path = require('path')
 const { hashPassword } = require('./users')
+const { sealRecord, openRecord, recordMatches } = require('./storeCrypto')
 
 let dataDir
 
@@ -37,6 +38,41 @@ async function initDb (dir) {
   } catch {
     await fs.writeFile(codesFile, JSON.stringify([], null, 2))
   }
+
+  const consentsFile = path.join(dataDir, 'consents.json')
+  try {
+    await fs.access(consentsFile)
+  } catch {
+    await fs.writeFile(consentsFile, JSON.stringify([], null, 2))
+  }
+
+  const refreshTokensFile = path.join(dataDir, 'refresh_tokens.json')
+  try {
+    await fs.access(refreshTokensFile)
+  } catch {
+    await fs.writeFile(refreshTokensFile, JSON.stringify([], null, 2))
+  }
+
+  const revocationsFile = path.join(dataDir, 'token_revocations.json')
+  try {
+    await fs.access(revocationsFile)
+  } catch {
+    await fs.writeFile(revocationsFile, JSON.stringify([], null, 2))
+  }
+
+  const issuedTokensFile = path.join(dataDir, 'issued_tokens.json')
+  try {
+    await fs.access(issuedTokensFile)
+  } catch {
+    await fs.writeFile(issuedTokensFile, JSON.stringify([], null, 2))
+  }
+
+  const deviceCodesFile = path.join(dataDir, 'device_codes.json')
+  try {
+    await fs.access(deviceCodesFile)
+  } catch {
+    await fs.writeFile(deviceCodesFile, JSON.stringify([], null, 2))
+  }
 }
 
 async function readJson (filename) {
@@ -70,6 +106,17 @@ async function addClient (client) {
   return client
 }
 
+async function updateClient (clientId, updates) {
+  const clients = await getClients()
+  const clientIndex = clients.findIndex(c => c.client_id === clientId)
+  if (clientIndex === -1) {
+    throw new Error('Client not found')
+  }
+  clients[clientIndex] = { ...clients[clientIndex], ...updates }
+  await writeJson('clients.json', clients)
+  return clients[clientIndex]
+}
+
 async function getUsers () {
   return await readJson('users.json')
 }
@@ -149,27 +196,47 @@ async function clearFailedLoginAttempts (userId) {
   await writeJson('users.json', users)
 }
 
+// Codes and refresh tokens are stored by hash (see storeCrypto); these
+// fields are encrypted when NGAUTH_STORE_ENCRYPTION_KEY is set
+const CODE_SENSITIVE_FIELDS = ['nonce', 'authorization_details']
+const REFRESH_TOKEN_SENSITIVE_FIELDS = ['authorization_details']
+
+// Stored code records: codeHash instead of the code, sensitive fields as stored
 async function getCodes () {
   return await readJson('codes.json')
 }
 
 async function addCode (code) {
   const codes = await getCodes()
-  codes.push(code)
+  codes.push(sealRecord(code, 'code', CODE_SENSITIVE_FIELDS))
   await writeJson('codes.json', codes)
 }
 
 async function getCode (codeValue) {
   const codes = await getCodes()
-  return codes.find(c => c.code === codeValue)
+  const code = codes.find(c => recordMatches(c, 'code', codeValue))
+  return code && openRecord(code, CODE_SENSITIVE_FIELDS)
 }
 
 async function deleteCode (codeValue) {
   const codes = await getCodes()
-  const filtered = codes.filter(c => c.code !== codeValue)
+  const filtered = codes.filter(c => !recordMatches(c, 'code', codeValue))
   await writeJson('codes.json', filtered)
 }
 
+// Keep a redeemed code, marked with the grant its tokens belong to, until
+// keepUntil so a second redemption can be detected (RFC 6749 4.1.2)
+async function markCodeRedeemed (codeValue, grantId, keepUntil) {
+  const codes = await getCodes()
+  const index = codes.findIndex(c => recordMatches(c, 'code', codeValue))
+  if (index === -1) {
+    return false
+  }
+  codes[index] = { ...codes[index], redeemedAt: Date.now(), grantId, expiresAt: Math.max(codes[index].expiresAt, keepUntil) }
+  await writeJson('codes.json', codes)
+  return true
+}
+
 // Cleanup expired codes
 async function cleanupExpiredCodes () {
   const codes = await getCodes()
@@ -178,11 +245,315 @@ async function cleanupExpiredCodes () {
   await writeJson('codes.json', valid)
 }
 
+async function getConsents () {
+  return await readJson('consents.json')
+}
+
+async function getConsent (userId, clientId) {
+  const consents = await getConsents()
+  return consents.find(c => c.userId === userId && c.client_id === clientId)
+}
+
+// Record consent, merging newly granted scopes into any existing grant
+async function saveConsent (userId, clientId, scopes) {
+  const consents = await getConsents()
+  const index = consents.findIndex(c => c.userId === userId && c.client_id === clientId)
+  const existing = index === -1 ? [] : consents[index].scopes
+  const consent = {
+    userId,
+    client_id: clientId,
+    scopes: Array.from(new Set([...existing, ...scopes])),
+    grantedAt: Date.now()
+  }
+
+  if (index === -1) {
+    consents.push(consent)
+  } else {
+    consents[index] = consent
+  }
+
+  await writeJson('consents.json', consents)
+  return consent
+}
+
+// Withdraw a user's consent for a client. The record is kept (without
+// scopes) so the next authorization request asks for consent again.
+async function revokeConsent (userId, clientId) {
+  const consents = await getConsents()
+  const index = consents.findIndex(c => c.userId === userId && c.client_id === clientId && !c.revokedAt)
+  if (index === -1) {
+    return false
+  }
+
+  consents[index] = { userId, client_id: clientId, scopes: [], revokedAt: Date.now() }
+  await writeJson('consents.json', consents)
+
+  // Outstanding authorization codes and refresh tokens must not be redeemable afterwards
+  const codes = await getCodes()
+  await writeJson('codes.json', codes.filter(c => !(c.userId === userId && c.client_id === clientId)))
+  const refreshTokens = await getRefreshTokens()
+  await writeJson('refresh_tokens.json', refreshTokens.filter(t => !(t.userId === userId && t.client_id === clientId)))
+  return true
+}
+
+async function getRefreshTokens () {
+  try {
+    return await readJson('refresh_tokens.json')
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return []
+    }
+    throw err
+  }
+}
+
+async function addRefreshToken (refreshToken) {
+  const refreshTokens = await getRefreshTokens()
+  refreshTokens.push(sealRecord(refreshToken, 'token', REFRESH_TOKEN_SENSITIVE_FIELDS))
+  await writeJson('refresh_tokens.json', refreshTokens)
+}
+
+async function getRefreshToken (tokenValue) {
+  const refreshTokens = await getRefreshTokens()
+  const refreshToken = refreshTokens.find(t => recordMatches(t, 'token', tokenValue))
+  return refreshToken && openRecord(refreshToken, REFRESH_TOKEN_SENSITIVE_FIELDS)
+}
+
+async function deleteRefreshToken (tokenValue) {
+  const refreshTokens = await getRefreshTokens()
+  await writeJson('refresh_tokens.json', refreshTokens.filter(t => !recordMatches(t, 'token', tokenValue)))
+}
+
+// Delete the refresh tokens of one grant, rotated ones included; returns
+// how many were deleted
+async function deleteRefreshTokensByGrant (grantId) {
+  const refreshTokens = await getRefreshTokens()
+  const remaining = refreshTokens.filter(t => t.grantId !== grantId)
+  if (remaining.length !== refreshTokens.length) {
+    await writeJson('refresh_tokens.json', remaining)
+  }
+  return refreshTokens.length - remaining.length
+}
+
+// Delete the refresh tokens issued from one login session (see sessions.js);
+// returns the grant IDs of the deleted tokens
+async function deleteRefreshTokensBySession (sessionRef) {
+  const refreshTokens = await getRefreshTokens()
+  const removed = refreshTokens.filter(t => t.sessionRef === sessionRef)
+  if (removed.length > 0) {
+    await writeJson('refresh_tokens.json', refreshTokens.filter(t => t.sessionRef !== sessionRef))
+  }
+  return removed.map(t => t.grantId || null)
+}
+
+// Device authorization grants (RFC 8628), stored under hashes of the device
+// code and of the normalized user code
+async function getDeviceCodes () {
+  try {
+    return await readJson('device_codes.json')
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return []
+    }
+    throw err
+  }
+}
+
+async function addDeviceCode (deviceCode) {
+  const deviceCodes = await getDeviceCodes()
+  deviceCodes.push(sealRecord(sealRecord(deviceCode, 'device_code', []), 'user_code', []))
+  await writeJson('device_codes.json', deviceCodes)
+}
+
+async function getDeviceCode (deviceCodeValue) {
+  const deviceCodes = await getDeviceCodes()
+  return deviceCodes.find(d => recordMatches(d, 'device_code', deviceCodeValue))
+}
+
+async function getDeviceCodeByUserCode (userCode) {
+  const deviceCodes = await getDeviceCodes()
+  return deviceCodes.find(d => recordMatches(d, 'user_code', userCode))
+}
+
+async function getDeviceCodeById (id) {
+  const deviceCodes = await getDeviceCodes()
+  return deviceCodes.find(d => d.id === id)
+}
+
+async function updateDeviceCode (id, updates) {
+  const deviceCodes = await getDeviceCodes()
+  const index = deviceCodes.findIndex(d => d.id === id)
+  if (index === -1) {
+    throw new Error('Device code not found')
+  }
+  deviceCodes[index] = { ...deviceCodes[index], ...updates }
+  await writeJson('device_codes.json', deviceCodes)
+  return deviceCodes[index]
+}
+
+async function deleteDeviceCode (id) {
+  const deviceCodes = await getDeviceCodes()
+  await writeJson('device_codes.json', deviceCodes.filter(d => d.id !== id))
+}
+
+async function getTokenRevocations () {
+  try {
+    return await readJson('token_revocations.json')
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return []
+    }
+    throw err
+  }
+}
+
+// Tokens issued to the client for the user up to `at` (ms) are revoked
+async function revokeTokens (userId, clientId, at = Date.now()) {
+  const revocations = (await getTokenRevocations())
+    .filter(r => !(r.userId === userId && r.client_id === clientId))
+  revocations.push({ userId, client_id: clientId, revokedBefore: at })
+  await writeJson('token_revocations.json', revocations)
+}
+
+async function getScopeBaselines () {
+  try {
+    return await readJson('scope_baselines.json')
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return []
+    }
+    throw err
+  }
+}
+
+async function getScopeBaseline (clientId) {
+  const baselines = await getScopeBaselines()
+  return baselines.find(b => b.client_id === clientId)
+}
+
+async function saveScopeBaseline (baseline) {
+  const baselines = (await getScopeBaselines()).filter(b => b.client_id !== baseline.client_id)
+  baselines.push(baseline)
+  await writeJson('scope_baselines.json', baselines)
+  return baseline
+}
+
+// Returns whether the client had a baseline
+async function deleteScopeBaseline (clientId) {
+  const baselines = await getScopeBaselines()
+  const remaining = baselines.filter(b => b.client_id !== clientId)
+  if (remaining.length === baselines.length) {
+    return false
+  }
+  await writeJson('scope_baselines.json', remaining)
+  return true
+}
+
+async function getIssuedTokens () {
+  try {
+    return await readJson('issued_tokens.json')
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return []
+    }
+    throw err
+  }
+}
+
+// Metadata of an issued access token (never the token itself), kept until
+// the token expires so it can be revoked by jti
+async function addIssuedToken (record) {
+  const issuedTokens = await getIssuedTokens()
+  issuedTokens.push(record)
+  await writeJson('issued_tokens.json', issuedTokens)
+  return record
+}
+
+async function getIssuedToken (jti) {
+  const issuedTokens = await getIssuedTokens()
+  return issuedTokens.find(t => t.jti === jti)
+}
+
+// Revoke a single access token by jti. Returns the updated record, or null
+// when no unexpired token has that jti.
+async function revokeIssuedToken (jti, at = Date.now()) {
+  const issuedTokens = await getIssuedTokens()
+  const index = issuedTokens.findIndex(t => t.jti === jti)
+  if (index === -1) {
+    return null
+  }
+  issuedTokens[index] = { ...issuedTokens[index], revokedAt: issuedTokens[index].revokedAt || at }
+  await writeJson('issued_tokens.json', issuedTokens)
+  return issuedTokens[index]
+}
+
+// Revoke the access tokens issued from one grant (an authorization code and
+// the refreshes of its refresh tokens); returns how many were revoked
+async function revokeIssuedTokensByGrant (grantId, at = Date.now()) {
+  const issuedTokens = await getIssuedTokens()
+  let revoked = 0
+  const updated = issuedTokens.map(t => {
+    if (t.grantId !== grantId || t.revokedAt) {
+      return t
+    }
+    revoked++
+    return { ...t, revokedAt: at }
+  })
+  if (revoked > 0) {
+    await writeJson('issued_tokens.json', updated)
+  }
+  return revoked
+}
+
+// Whether a decoded access token was revoked, by jti or with the tokens
+// issued to the client for the user (tokens issued in the same second as
+// such a revocation are treated as revoked)
+async function isTokenRevoked (decoded) {
+  if (decoded.jti) {
+    const issued = await getIssuedToken(decoded.jti)
+    if (issued && issued.revokedAt) {
+      return true
+    }
+  }
+  const revocations = await getTokenRevocations()
+  const revocation = revocations.find(r => r.userId === decoded.sub && r.client_id === decoded.client_id)
+  return !!revocation && decoded.iat <= Math.floor(revocation.revokedBefore / 1000)
+}
+
+// Remove up to batchSize expired records (expiresAt in the past) from a data file.
+// Missing files are treated as empty. Returns the number of records removed.
+async function purgeExpiredRecords (filename, now = Date.now(), batchSize = Infinity) {
+  let records
+  try {
+    records = await readJson(filename)
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return 0
+    }
+    throw err
+  }
+
+  let removed = 0
+  const remaining = records.filter(record => {
+    if (removed < batchSize && record.expiresAt !== undefined && record.expiresAt <= now) {
+      removed++
+      return false
+    }
+    return true
+  })
+
+  if (removed > 0) {
+    await writeJson(filename, remaining)
+  }
+  return removed
+}
+
 module.exports = {
   initDb,
   getClients,
   getClient,
   addClient,
+  updateClient,
   getUsers,
   getUser,
   getUserById,
@@ -196,5 +567,33 @@ module.exports = {
   addCode,
   getCode,
   deleteCode,
-  cleanupExpiredCodes
+  markCodeRedeemed,
+  cleanupExpiredCodes,
+  getRefreshTokens,
+  addRefreshToken,
+  getRefreshToken,
+  deleteRefreshToken,
+  deleteRefreshTokensByGrant,
+  deleteRefreshTokensBySession,
+  revokeIssuedTokensByGrant,
+  getDeviceCodes,
+  addDeviceCode,
+  getDeviceCode,
+  getDeviceCodeByUserCode,
+  getDeviceCodeById,
+  updateDeviceCode,
+  deleteDeviceCode,
+  purgeExpiredRecords,
+  getConsents,
+  getConsent,
+  revokeConsent,
+  revokeTokens,
+  isTokenRevoked,
+  addIssuedToken,
+  getIssuedToken,
+  revokeIssuedToken,
+  getScopeBaseline,
+  saveScopeBaseline,
+  deleteScopeBaseline,
+  saveConsent
 }
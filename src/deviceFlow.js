@@ -0,0 +1,94 @@
+/**
+ * Device Authorization Grant (RFC 8628) helpers
+ *
+ * User codes are short enough to type on a phone, so they are also short
+ * enough to guess: entries on the verification page are counted per IP and
+ * per session and locked out after config.deviceFlow.maxAttempts wrong codes.
+ */
+
+const crypto = require('crypto')
+const config = require('./config')
+const { getCounterStore } = require('./middleware/rateLimitStore')
+const { getClientIp } = require('./middleware/clientIp')
+
+const DEVICE_CODE_GRANT = 'urn:ietf:params:oauth:grant-type:device_code'
+
+// Consonants only (RFC 8628 6.1): no vowels to spell words, no digits to
+// confuse with letters (0/O, 1/I/L, 5/S, 8/B)
+const USER_CODE_CHARSET = 'BCDFGHJKLMNPQRSTVWXZ'
+
+/**
+ * Generate a user code of config.codes.userCodeLength characters, shown in
+ * groups of four (XXXX-XXXX)
+ * @returns {string}
+ */
+function generateUserCode () {
+  let code = ''
+  for (let i = 0; i < config.codes.userCodeLength; i++) {
+    code += USER_CODE_CHARSET[crypto.randomInt(USER_CODE_CHARSET.length)]
+  }
+  return code.match(/.{1,4}/g).join('-')
+}
+
+/**
+ * Normalize a typed user code: case, dashes and spaces are ignored
+ * @param {*} input - Code as entered
+ * @returns {string|null} The code characters, or null when it cannot be a code
+ */
+function normalizeUserCode (input) {
+  if (typeof input !== 'string') {
+    return null
+  }
+  const code = input.toUpperCase().replace(/[\s-]/g, '')
+  if (code.length !== config.codes.userCodeLength || ![...code].every(c => USER_CODE_CHARSET.includes(c))) {
+    return null
+  }
+  return code
+}
+
+function entryKeys (req) {
+  const keys = [`device-ip:${getClientIp(req)}`]
+  if (req.sessionID) {
+    keys.push(`device-session:${req.sessionID}`)
+  }
+  return keys
+}
+
+/**
+ * Count a user code entry against the IP and session budgets
+ * @param {object} req - Express request
+ * @returns {Promise<boolean>} false when either budget is exhausted
+ */
+async function countCodeEntry (req) {
+  const { maxAttempts, lockoutSeconds } = config.deviceFlow
+  const counters = getCounterStore()
+  let allowed = true
+  for (const key of entryKeys(req)) {
+    const { totalHits } = await counters.increment(key, lockoutSeconds * 1000)
+    if (totalHits > maxAttempts) {
+      allowed = false
+    }
+  }
+  return allowed
+}
+
+/**
+ * Take back the entry of a correct code, so only wrong codes lead to a
+ * lockout. Counters are never reset: a known-good code cannot clear them.
+ * @param {object} req - Express request
+ */
+async function refundCodeEntry (req) {
+  const counters = getCounterStore()
+  for (const key of entryKeys(req)) {
+    await counters.decrement(key)
+  }
+}
+
+module.exports = {
+  DEVICE_CODE_GRANT,
+  USER_CODE_CHARSET,
+  generateUserCode,
+  normalizeUserCode,
+  countCodeEntry,
+  refundCodeEntry
+}
@@ -0,0 +1,186 @@
+/* eslint camelcase: "off" */
+
+/**
+ * DPoP (Demonstrating Proof of Possession) - RFC 9449
+ * Validates DPoP proofs and manages server-provided nonces
+ */
+
+const crypto = require('crypto')
+const jwt = require('jsonwebtoken')
+const config = require('./config')
+const { OAuthError } = require('./errors')
+
+const SUPPORTED_ALGS = ['RS256', 'PS256', 'ES256']
+
+// Server nonces rotate every nonceTTL seconds; the previous nonce stays valid
+// for one more period so in-flight clients are not rejected during rotation
+let currentNonce = null
+let previousNonce = null
+
+// Recently seen proof jti values (replay protection)
+const seenJtis = new Map()
+
+function rotateNonce () {
+  previousNonce = currentNonce
+  currentNonce = {
+    value: crypto.randomBytes(16).toString('base64url'),
+    issuedAt: Date.now()
+  }
+  return currentNonce.value
+}
+
+function getNonce () {
+  if (!currentNonce || Date.now() - currentNonce.issuedAt >= config.dpop.nonceTTL * 1000) {
+    rotateNonce()
+  }
+  return currentNonce.value
+}
+
+function isValidNonce (nonce) {
+  if (!nonce) {
+    return false
+  }
+  const current = getNonce()
+  return nonce === current || (previousNonce !== null && nonce === previousNonce.value)
+}
+
+/**
+ * Compute the RFC 7638 JWK thumbprint
+ * @param {object} jwk - Public JWK
+ * @returns {string} base64url-encoded SHA-256 thumbprint
+ */
+function jwkThumbprint (jwk) {
+  let members
+  if (jwk.kty === 'RSA') {
+    members = { e: jwk.e, kty: jwk.kty, n: jwk.n }
+  } else if (jwk.kty === 'EC') {
+    members = { crv: jwk.crv, kty: jwk.kty, x: jwk.x, y: jwk.y }
+  } else {
+    throw new Error(`Unsupported key type: ${jwk.kty}`)
+  }
+  return crypto.createHash('sha256').update(JSON.stringify(members)).digest('base64url')
+}
+
+// Drop consumed proof jti values whose replay window has passed
+function purgeExpiredJtis (now = Date.now()) {
+  let removed = 0
+  for (const [key, expiry] of seenJtis) {
+    if (expiry < now) {
+      seenJtis.delete(key)
+      removed++
+    }
+  }
+  return removed
+}
+
+function rememberJti (jti, expiresAt) {
+  purgeExpiredJtis()
+  if (seenJtis.has(jti)) {
+    return false
+  }
+  seenJtis.set(jti, expiresAt)
+  return true
+}
+
+/**
+ * Validate a DPoP proof JWT
+ * @param {string} proof - Value of the DPoP header
+ * @param {string} method - HTTP method of the request
+ * @param {string} url - Target URI of the request (without query/fragment)
+ * @returns {string} JWK thumbprint of the proof key
+ * @throws {OAuthError} invalid_dpop_proof or use_dpop_nonce
+ */
+function verifyDpopProof (proof, method, url) {
+  const decoded = jwt.decode(proof, { complete: true })
+  if (!decoded || !decoded.header || !decoded.payload) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof is not a valid JWT')
+  }
+
+  const { header, payload } = decoded
+  if (header.typ !== 'dpop+jwt') {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof must have typ dpop+jwt')
+  }
+  if (!SUPPORTED_ALGS.includes(header.alg)) {
+    throw new OAuthError('invalid_dpop_proof', `Unsupported DPoP proof algorithm: ${header.alg}`)
+  }
+  if (!header.jwk || header.jwk.d) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof must contain a public jwk header')
+  }
+
+  let key
+  try {
+    key = crypto.createPublicKey({ key: header.jwk, format: 'jwk' })
+    jwt.verify(proof, key, { algorithms: [header.alg] })
+  } catch (err) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof signature is invalid')
+  }
+
+  if (payload.htm !== method) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof htm does not match request method')
+  }
+  if (typeof payload.htu !== 'string' || payload.htu.split(/[?#]/)[0] !== url) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof htu does not match request URI')
+  }
+
+  const now = Math.floor(Date.now() / 1000)
+  const maxAge = config.dpop.proofMaxAge
+  if (typeof payload.iat !== 'number' || Math.abs(now - payload.iat) > maxAge) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof iat is outside the acceptable window')
+  }
+  if (!payload.jti) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof is missing jti')
+  }
+
+  if (config.dpop.requireNonce && !isValidNonce(payload.nonce)) {
+    throw new OAuthError('use_dpop_nonce', 'Authorization server requires nonce in DPoP proof')
+  }
+
+  if (!rememberJti(payload.jti, (payload.iat + maxAge) * 1000)) {
+    throw new OAuthError('invalid_dpop_proof', 'DPoP proof has already been used')
+  }
+
+  return jwkThumbprint(header.jwk)
+}
+
+/**
+ * Express middleware validating the DPoP header when DPoP is enabled.
+ * Sets req.dpopJkt to the proof key thumbprint and always advertises the
+ * current nonce via the DPoP-Nonce response header.
+ */
+function dpopProof (req, res, next) {
+  if (!config.dpop.enabled) {
+    return next()
+  }
+
+  if (config.dpop.requireNonce) {
+    res.set('DPoP-Nonce', getNonce())
+  }
+
+  const proof = req.headers.dpop
+  if (!proof) {
+    return next()
+  }
+
+  try {
+    // The issuer already ends with the base path, which req.baseUrl repeats
+    const mountPath = config.basePath && req.baseUrl.startsWith(config.basePath)
+      ? req.baseUrl.slice(config.basePath.length)
+      : req.baseUrl
+    const url = `${config.issuer}${mountPath}${req.path === '/' ? '' : req.path}`
+    req.dpopJkt = verifyDpopProof(proof, req.method, url)
+    next()
+  } catch (err) {
+    next(err)
+  }
+}
+
+module.exports = {
+  dpopProof,
+  verifyDpopProof,
+  jwkThumbprint,
+  getNonce,
+  isValidNonce,
+  rotateNonce,
+  purgeExpiredJtis,
+  SUPPORTED_ALGS
+}
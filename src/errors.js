@@ -8,6 +8,16 @@ class OAuthError extends Error {
   }
 }
 
+// Safe descriptions for body-parser failures (never echo parser internals)
+const BODY_PARSER_ERRORS = {
+  'entity.parse.failed': 'Request body is not valid JSON',
+  'entity.verify.failed': 'Request body could not be verified',
+  'encoding.unsupported': 'Unsupported content encoding',
+  'charset.unsupported': 'Unsupported charset',
+  'request.aborted': 'Request body was aborted',
+  'request.size.invalid': 'Request body size does not match Content-Length'
+}
+
 // Error handler middleware
 function errorHandler (err, req, res, next) {
   if (err instanceof OAuthError) {
@@ -17,6 +27,20 @@ function errorHandler (err, req, res, next) {
     })
   }
 
+  // Malformed request bodies rejected by express.json()/urlencoded()
+  if (err && BODY_PARSER_ERRORS[err.type]) {
+    return res.status(400).json({
+      error: 'invalid_request',
+      error_description: BODY_PARSER_ERRORS[err.type]
+    })
+  }
+  if (err && err.type === 'entity.too.large') {
+    return res.status(413).json({
+      error: 'invalid_request',
+      error_description: 'Request body is too large'
+    })
+  }
+
   // Generic error
   console.error(err)
   res.status(500).json({
@@ -25,7 +49,17 @@ function errorHandler (err, req, res, next) {
   })
 }
 
+// Handler for paths no route serves, answering a JSON 404 instead of the
+// Express default page
+function notFoundHandler (req, res) {
+  res.status(404).json({
+    error: 'not_found',
+    error_description: 'The requested resource does not exist'
+  })
+}
+
 module.exports = {
   OAuthError,
-  errorHandler
+  errorHandler,
+  notFoundHandler
 }
@@ -0,0 +1,127 @@
+/**
+ * Audit event stream
+ *
+ * Fans the structured events written by the audit logger out to live
+ * subscribers (the admin SSE endpoint). Events are redacted before they leave
+ * the process, and each subscriber has a bounded queue so a slow consumer
+ * loses its oldest events instead of holding memory or slowing the server.
+ */
+
+const config = require('./config')
+
+// Event fields that may carry credentials
+const SECRET_FIELD_PATTERN = /(secret|password|token|assertion|authorization|cookie)$|^code$/i
+
+// JWTs embedded in free-text values
+const JWT_PATTERN = /eyJ[\w-]+\.[\w-]+\.[\w-]*/g
+
+const REDACTED = '[REDACTED]'
+
+const subscribers = new Set()
+
+function redactEvent (value) {
+  if (Array.isArray(value)) {
+    return value.map(redactEvent)
+  }
+  if (value && typeof value === 'object') {
+    const result = {}
+    for (const [key, nested] of Object.entries(value)) {
+      result[key] = SECRET_FIELD_PATTERN.test(key) ? REDACTED : redactEvent(nested)
+    }
+    return result
+  }
+  if (typeof value === 'string') {
+    return value.replace(JWT_PATTERN, REDACTED)
+  }
+  return value
+}
+
+/**
+ * Deliver an audit event to every subscriber whose filter matches.
+ *
+ * @param {object} event - Audit log entry (timestamp, type, ...)
+ */
+function publishEvent (event) {
+  if (subscribers.size === 0) {
+    return
+  }
+  const redacted = redactEvent(event)
+  for (const subscriber of subscribers) {
+    if (!subscriber.types || subscriber.types.includes(redacted.type)) {
+      subscriber.push(redacted)
+    }
+  }
+}
+
+/**
+ * Subscribe to audit events. write(event) delivers an event and returns false
+ * when the consumer is backed up; events then queue (up to bufferSize, oldest
+ * dropped first) until drained() is called, which first reports the number of
+ * dropped events as an EVENTS_DROPPED event.
+ *
+ * @param {object} options
+ * @param {string[]} options.types - Event types to receive (all when empty)
+ * @param {number} options.bufferSize - Maximum queued events while backed up
+ * @param {function} options.write - Deliver one event, false when backed up
+ * @param {function} [options.close] - End the consumer, see closeSubscriptions
+ * @returns {{drained: function, unsubscribe: function}}
+ */
+function subscribeEvents ({ types, bufferSize = config.eventStream.bufferSize, write, close }) {
+  const queue = []
+  let backedUp = false
+  let dropped = 0
+
+  const subscriber = {
+    types: types && types.length > 0 ? types : null,
+    close,
+    push (event) {
+      if (!backedUp) {
+        backedUp = write(event) === false
+        return
+      }
+      queue.push(event)
+      if (queue.length > bufferSize) {
+        queue.shift()
+        dropped++
+      }
+    }
+  }
+  subscribers.add(subscriber)
+
+  return {
+    // The consumer caught up: flush the queue until it backs up again
+    drained () {
+      backedUp = false
+      if (dropped > 0) {
+        backedUp = write({ timestamp: new Date().toISOString(), type: 'EVENTS_DROPPED', count: dropped }) === false
+        dropped = 0
+      }
+      while (queue.length > 0 && !backedUp) {
+        backedUp = write(queue.shift()) === false
+      }
+    },
+    unsubscribe () {
+      subscribers.delete(subscriber)
+    }
+  }
+}
+
+/**
+ * End every subscription, calling each subscriber's close callback. Used on
+ * shutdown, where open SSE responses would otherwise keep the server up.
+ */
+function closeSubscriptions () {
+  for (const subscriber of [...subscribers]) {
+    subscribers.delete(subscriber)
+    if (subscriber.close) {
+      subscriber.close()
+    }
+  }
+}
+
+module.exports = {
+  publishEvent,
+  subscribeEvents,
+  closeSubscriptions,
+  redactEvent
+}
@@ -0,0 +1,42 @@
+/**
+ * Grant type switches
+ *
+ * Each grant type the token endpoint implements has a feature flag. A
+ * disabled grant is refused at the token endpoint, left out of discovery and
+ * cannot be registered for.
+ */
+
+const config = require('./config')
+const { DEVICE_CODE_GRANT } = require('./deviceFlow')
+
+// Grant type -> config.features flag, in the order discovery lists them
+const GRANT_TYPE_FEATURES = {
+  authorization_code: 'authorizationCodeGrant',
+  client_credentials: 'clientCredentialsGrant',
+  refresh_token: 'refreshTokens',
+  [DEVICE_CODE_GRANT]: 'deviceCodeGrant'
+}
+
+/**
+ * Whether the token endpoint accepts a grant type
+ * @param {string} grantType
+ * @returns {boolean} false for disabled and unknown grant types
+ */
+function grantTypeEnabled (grantType) {
+  const feature = Object.prototype.hasOwnProperty.call(GRANT_TYPE_FEATURES, grantType) && GRANT_TYPE_FEATURES[grantType]
+  return Boolean(feature) && config.features[feature] !== false
+}
+
+/**
+ * The grant types currently accepted, for grant_types_supported
+ * @returns {string[]}
+ */
+function enabledGrantTypes () {
+  return Object.keys(GRANT_TYPE_FEATURES).filter(grantTypeEnabled)
+}
+
+module.exports = {
+  GRANT_TYPE_FEATURES,
+  grantTypeEnabled,
+  enabledGrantTypes
+}
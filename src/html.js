@@ -0,0 +1,19 @@
+/**
+ * HTML helpers for the server-rendered pages
+ */
+
+/**
+ * Escape a value for HTML text and double- or single-quoted attributes
+ * @param {*} value - Value to interpolate (converted to a string)
+ * @returns {string}
+ */
+const escapeHtml = (value) => String(value)
+  .replace(/&/g, '&amp;')
+  .replace(/"/g, '&quot;')
+  .replace(/</g, '&lt;')
+  .replace(/>/g, '&gt;')
+  .replace(/'/g, '&#39;')
+
+module.exports = {
+  escapeHtml
+}
@@ -0,0 +1,95 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Idempotency keys for token requests
+ *
+ * A client retrying a token request with the same Idempotency-Key header and
+ * identical parameters gets the original response back instead of consuming
+ * a single-use authorization code twice. Keys are scoped to the client.
+ */
+
+const crypto = require('crypto')
+const config = require('./config')
+const { OAuthError } = require('./errors')
+
+const MAX_KEY_LENGTH = 255
+
+// `${client_id}\n${key}` -> { fingerprint, pending, status, body, expiresAt }
+const entries = new Map()
+
+// Hash of the request parameters (the client secret is excluded)
+function requestFingerprint (body) {
+  const params = { ...(body || {}) }
+  delete params.client_secret
+  const canonical = JSON.stringify(Object.keys(params).sort().map(k => [k, params[k]]))
+  return crypto.createHash('sha256').update(canonical).digest('hex')
+}
+
+function purgeExpiredIdempotencyKeys (now = Date.now()) {
+  let removed = 0
+  for (const [key, entry] of entries) {
+    if (entry.expiresAt <= now) {
+      entries.delete(key)
+      removed++
+    }
+  }
+  return removed
+}
+
+/**
+ * Apply the Idempotency-Key header of a token request
+ * @param {object} req - Express request
+ * @param {object} res - Express response
+ * @param {string} clientId - Authenticated client
+ * @returns {boolean} true when a cached response was replayed
+ * @throws {OAuthError} when the key is reused with different parameters or is still in flight
+ */
+function applyIdempotencyKey (req, res, clientId) {
+  const key = req.get('Idempotency-Key')
+  if (key === undefined) {
+    return false
+  }
+  if (!key || key.length > MAX_KEY_LENGTH) {
+    throw new OAuthError('invalid_request', `Idempotency-Key must be 1-${MAX_KEY_LENGTH} characters`)
+  }
+
+  const now = Date.now()
+  purgeExpiredIdempotencyKeys(now)
+
+  const cacheKey = `${clientId}\n${key}`
+  const fingerprint = requestFingerprint(req.body)
+  const entry = entries.get(cacheKey)
+
+  if (entry) {
+    if (entry.fingerprint !== fingerprint) {
+      throw new OAuthError('invalid_request', 'Idempotency-Key was already used with different request parameters', 422)
+    }
+    if (entry.pending) {
+      throw new OAuthError('invalid_request', 'A request with this Idempotency-Key is still being processed', 409)
+    }
+    res.set('Idempotent-Replayed', 'true')
+    res.status(entry.status).json(entry.body)
+    return true
+  }
+
+  const expiresAt = now + config.idempotency.ttl * 1000
+  entries.set(cacheKey, { fingerprint, pending: true, expiresAt })
+
+  // Remember successful responses; failed requests may be retried with the same key
+  const originalJson = res.json.bind(res)
+  res.json = (body) => {
+    if (res.statusCode >= 200 && res.statusCode < 300) {
+      entries.set(cacheKey, { fingerprint, pending: false, status: res.statusCode, body, expiresAt })
+    } else {
+      entries.delete(cacheKey)
+    }
+    return originalJson(body)
+  }
+
+  return false
+}
+
+module.exports = {
+  applyIdempotencyKey,
+  purgeExpiredIdempotencyKeys
+}
@@ -6,11 +6,14 @@ const crypto = require('crypto')
 const fs = require('fs').promises
 const path = require('path')
 const config = require('./config')
+const { assertValidConfig } = require('./config/validate')
 const { initDb, cleanupExpiredCodes } = require('./db')
-const { ensurePrivateKey, getPublicKeyPem } = require('./tokens')
+const { ensurePrivateKey, verificationKeyFor, getSigningKeys } = require('./tokens')
 const { setPublicKey } = require('./auth')
 const { auditMiddleware, initAuditLog } = require('./middleware/auditLog')
 const { loginLimiter, registerLimiter } = require('./middleware/rateLimit')
+const { clientCors, tokenCors } = require('./middleware/clientCors')
+const { parseBody } = require('./middleware/bodyLimit')
 const healthRouter = require('./routes/health')
 const wellKnownRouter = require('./routes/well-known')
 const jwksRouter = require('./routes/jwks')
@@ -18,13 +21,22 @@ const authorizeRouter = require('./routes/authorize')
 const tokenRouter = require('./routes/token')
 const registerRouter = require('./routes/register')
 const userinfoRouter = require('./routes/userinfo')
+const introspectRouter = require('./routes/introspect')
 const usersRouter = require('./routes/users')
-const { errorHandler } = require('./errors')
+const adminRouter = require('./routes/admin')
+const deviceRouter = require('./routes/device')
+const logoutRouter = require('./routes/logout')
+const { errorHandler, notFoundHandler } = require('./errors')
+const { startSweeper, stopSweeper } = require('./sweeper')
+const { closeSubscriptions } = require('./eventStream')
+const { seedFromFile } = require('./seed')
+const { sessionCookieOptions } = require('./sessions')
 
 const PORT = config.port
 const NGAUTH_DATA = process.env.NGAUTH_DATA || './data'
 
 const app = express()
+const sessionStore = new session.MemoryStore()
 
 // Async initialization function
 async function initialize () {
@@ -41,9 +53,12 @@ async function initialize () {
   // Validate private key file permissions
   validateKeyFilePermissions(NGAUTH_DATA)
 
-  // Initialize auth module with public key
-  const publicKeyPem = getPublicKeyPem()
-  setPublicKey(publicKeyPem)
+  // Refuse to start on invalid settings, listing every problem at once
+  assertValidConfig(config, { signingKeys: getSigningKeys(), sessionSecret: process.env.SESSION_SECRET })
+
+  // Initialize auth module with the key lookup verifyToken uses, so it follows
+  // key rotations and accepts tokens signed with a client's dedicated key
+  setPublicKey(verificationKeyFor)
 
   // Initialize audit logging
   initAuditLog(NGAUTH_DATA)
@@ -51,6 +66,12 @@ async function initialize () {
   // Initialize database
   await initDb(NGAUTH_DATA)
 
+  // Create or update the declaratively seeded clients and users
+  if (config.seed.file) {
+    const { clients, users } = await seedFromFile(config.seed.file)
+    console.log(`🌱 Seeded clients (${clients.created} created, ${clients.updated} updated) and users (${users.created} created, ${users.updated} updated)`)
+  }
+
   // Cleanup expired authorization codes on startup (skip in test environment)
   if (process.env.NODE_ENV !== 'test') {
     try {
@@ -85,8 +106,12 @@ initialize().catch(err => {
   process.exit(1)
 })
 
-// Health checks first (no middleware required)
+// Health checks first (no middleware required); also reachable under the
+// base path for proxies that only forward the prefix
 app.use(healthRouter)
+if (config.basePath) {
+  app.use(config.basePath, healthRouter)
+}
 
 // Security headers with helmet
 app.use(helmet({
@@ -97,23 +122,19 @@ app.use(helmet({
   }
 }))
 
-// Body parsing middleware
-app.use(express.json())
-app.use(express.urlencoded({ extended: true }))
-
 // Cookie and CSRF protection
 app.use(cookieParser(process.env.SESSION_SECRET || crypto.randomBytes(32).toString('hex')))
 
-// Session middleware
+// Session middleware; cookie attributes from config.sessionCookie
 app.use(session({
+  store: sessionStore,
   secret: process.env.SESSION_SECRET || crypto.randomBytes(32).toString('hex'),
   resave: false,
   saveUninitialized: false,
-  cookie: {
-    secure: process.env.NODE_ENV === 'production', // Set to true if behind HTTPS reverse proxy
-    httpOnly: true,
-    sameSite: 'strict'
-  }
+  // Behind a trusted TLS-terminating proxy, X-Forwarded-Proto tells whether
+  // a Secure cookie can be set
+  proxy: config.trustedProxies.length > 0 || undefined,
+  ...sessionCookieOptions()
 }))
 
 // Audit logging
@@ -129,7 +150,9 @@ if (process.env.NODE_ENV === 'production') {
   })
 }
 
-// Routes (using preset-configured endpoints)
+// Routes (using preset-configured endpoints), mounted under the base path
+const routes = express.Router()
+
 // Well-known routes need special handling for nested paths
 const oidcPath = config.endpoints.oidc
 const jwksPath = config.endpoints.jwks
@@ -137,32 +160,46 @@ const jwksPath = config.endpoints.jwks
 // Extract base path and route
 if (oidcPath.includes('/.well-known/')) {
   const basePath = oidcPath.substring(0, oidcPath.indexOf('/.well-known/') + '/.well-known'.length)
-  app.use(basePath, wellKnownRouter)
+  routes.use(basePath, wellKnownRouter)
 } else {
-  app.use(oidcPath, wellKnownRouter)
+  routes.use(oidcPath, wellKnownRouter)
 }
 
 if (jwksPath.includes('/.well-known/')) {
   const basePath = jwksPath.substring(0, jwksPath.indexOf('/.well-known/') + '/.well-known'.length)
-  app.use(basePath, jwksRouter)
+  routes.use(basePath, jwksRouter)
 } else {
-  app.use(jwksPath, jwksRouter)
+  routes.use(jwksPath, jwksRouter)
 }
 
-app.use(config.endpoints.authorize, loginLimiter, authorizeRouter)
-app.use(config.endpoints.token, loginLimiter, tokenRouter)
+// Other well-known documents are not served; answer 404 before any other route
+routes.use('/.well-known', notFoundHandler)
+
+// Request bodies are parsed per endpoint, each class with its own size limit
+routes.use(config.endpoints.authorize, parseBody(), clientCors, loginLimiter, authorizeRouter)
+routes.use(config.endpoints.token, parseBody('token'), tokenCors, loginLimiter, tokenRouter)
 if (config.endpoints.userinfo) {
-  app.use(config.endpoints.userinfo, userinfoRouter)
+  routes.use(config.endpoints.userinfo, parseBody(), userinfoRouter)
 }
-app.use('/register', registerLimiter, registerRouter)
-app.use('/users', usersRouter)
+if (config.endpoints.introspect) {
+  routes.use(config.endpoints.introspect, parseBody('introspection'), introspectRouter)
+}
+if (config.endpoints.logout) {
+  routes.use(config.endpoints.logout, parseBody(), logoutRouter)
+}
+routes.use('/register', registerLimiter, parseBody('registration'), registerRouter)
+routes.use('/device', parseBody(), deviceRouter)
+routes.use('/users', parseBody(), usersRouter)
+routes.use('/admin', parseBody(), adminRouter)
+
+app.use(config.basePath || '/', routes)
 
 // Error handler
 app.use(errorHandler)
 
 if (require.main === module) {
   initialize().then(() => {
-    app.listen(PORT, () => {
+    const server = app.listen(PORT, () => {
       console.log(`🚀 ngauth server listening on port ${PORT}`)
       console.log(`📁 Data directory: ${NGAUTH_DATA}`)
       console.log(`🌐 Issuer: ${config.issuer}`)
@@ -170,6 +207,20 @@ if (require.main === module) {
         console.log(`🎭 Preset: ${config.name}`)
       }
     })
+
+    // Periodically purge expired codes, refresh tokens, sessions and jtis
+    if (config.sweeper.enabled) {
+      startSweeper({ sessionStore })
+    }
+
+    const shutdown = () => {
+      stopSweeper()
+      server.close(() => process.exit(0))
+      // Open /admin/events streams would keep server.close from finishing
+      closeSubscriptions()
+    }
+    process.on('SIGTERM', shutdown)
+    process.on('SIGINT', shutdown)
   }).catch(err => {
     console.error('Failed to start server:', err)
     process.exit(1)
@@ -1,5 +1,7 @@
 const fs = require('fs')
 const path = require('path')
+const { getClientIp } = require('./clientIp')
+const { publishEvent } = require('../eventStream')
 
 let auditLogPath
 
@@ -8,15 +10,19 @@ function initAuditLog (dataDir) {
 }
 
 function logSecurityEvent (event) {
+  const entry = {
+    timestamp: new Date().toISOString(),
+    ...event
+  }
+
+  // Live subscribers (GET /admin/events) see events even without a log file
+  publishEvent(entry)
+
   if (!auditLogPath) {
     return
   }
 
-  const timestamp = new Date().toISOString()
-  const logEntry = JSON.stringify({
-    timestamp,
-    ...event
-  })
+  const logEntry = JSON.stringify(entry)
 
   fs.appendFile(auditLogPath, logEntry + '\n', (err) => {
     if (err && process.env.NODE_ENV !== 'test') {
@@ -38,7 +44,7 @@ function auditMiddleware (req, res, next) {
           type: 'AUTH_FAILED',
           method: req.method,
           path: req.path,
-          ip: req.ip || req.connection.remoteAddress,
+          ip: getClientIp(req),
           statusCode
         })
       }
@@ -49,7 +55,7 @@ function auditMiddleware (req, res, next) {
           type: 'USER_OPERATION',
           method: req.method,
           path: req.path,
-          ip: req.ip || req.connection.remoteAddress,
+          ip: getClientIp(req),
           statusCode,
           userId: req.user?.sub || 'anonymous'
         })
@@ -0,0 +1,30 @@
+/**
+ * Request body parsing with per-endpoint size limits
+ *
+ * JSON and form bodies are parsed only up to config.bodyLimits for the
+ * endpoint class, so an oversized payload cannot exhaust memory. A body over
+ * the limit is refused from its Content-Length, or as soon as it streams past
+ * the limit, with 413 invalid_request (see errorHandler). Other content types
+ * are not read at all.
+ */
+
+const express = require('express')
+const config = require('../config')
+
+/**
+ * JSON and form body parsers limited for an endpoint class
+ * @param {string} endpointClass - Key in config.bodyLimits ('default',
+ *   'token', 'registration', 'introspection')
+ * @returns {Function[]}
+ */
+function parseBody (endpointClass = 'default') {
+  const limit = config.bodyLimits[endpointClass]
+  return [
+    express.json({ limit }),
+    express.urlencoded({ extended: true, limit })
+  ]
+}
+
+module.exports = {
+  parseBody
+}
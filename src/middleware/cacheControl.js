@@ -0,0 +1,32 @@
+/**
+ * Response caching headers
+ *
+ * Responses carrying tokens, credentials or user data must never be stored
+ * by browsers or proxies (RFC 6749 5.1, OIDC Core 5.3.2). Public metadata
+ * (discovery, JWKS) may be cached for a configurable time.
+ */
+
+const config = require('../config')
+
+function noStore (req, res, next) {
+  res.set('Cache-Control', 'no-store')
+  res.set('Pragma', 'no-cache')
+  next()
+}
+
+/**
+ * Allow caching for the configured number of seconds
+ * @param {string} setting - Key in config.caching ('discoveryMaxAge', 'jwksMaxAge')
+ */
+function cacheFor (setting) {
+  return (req, res, next) => {
+    const maxAge = config.caching[setting]
+    res.set('Cache-Control', maxAge > 0 ? `public, max-age=${maxAge}` : 'no-cache')
+    next()
+  }
+}
+
+module.exports = {
+  noStore,
+  cacheFor
+}
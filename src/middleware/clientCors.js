@@ -0,0 +1,103 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Per-client CORS
+ *
+ * Browser clients calling the authorize or token endpoints via fetch only get
+ * CORS headers when the request Origin is listed in the client's registered
+ * allowed_cors_origins. Unregistered origins get no CORS headers at all, so
+ * the browser blocks the response.
+ */
+
+const { getClient } = require('../db')
+const { isCorsOriginAllowed } = require('../clients')
+
+const ALLOWED_METHODS = 'GET, POST, OPTIONS'
+const ALLOWED_HEADERS = 'Authorization, Content-Type, DPoP, X-CSRF-Token'
+
+// client_id from the query, the body or HTTP Basic credentials
+function getRequestClientId (req) {
+  if (req.query && req.query.client_id) {
+    return req.query.client_id
+  }
+  if (req.body && req.body.client_id) {
+    return req.body.client_id
+  }
+
+  const authHeader = req.headers.authorization
+  if (authHeader && authHeader.startsWith('Basic ')) {
+    const credentials = Buffer.from(authHeader.substring(6), 'base64').toString('utf8')
+    return credentials.split(':')[0]
+  }
+
+  return null
+}
+
+// The client a request names, for the authorize and token endpoints
+async function requestClient (req) {
+  const clientId = getRequestClientId(req)
+  return clientId ? getClient(clientId) : null
+}
+
+// Session bridge paths, relative to the token endpoint
+const SESSION_BRIDGE_PATHS = ['/session', '/session/csrf']
+
+// POST /session issues tokens to the body's client_id, so CORS follows that
+// value. GET /session/csrf and preflights have no body and name the client in
+// the query. Only clients allowed the bridge get CORS headers on these paths.
+async function sessionBridgeClient (req) {
+  const clientId = req.method === 'POST' ? req.body && req.body.client_id : req.query && req.query.client_id
+  const client = typeof clientId === 'string' && clientId ? await getClient(clientId) : null
+  return client && client.session_bridge ? client : null
+}
+
+// CORS middleware for the client resolveClient finds for a request
+function corsFor (resolveClient) {
+  return async function (req, res, next) {
+    const origin = req.headers.origin
+    if (!origin) {
+      return next()
+    }
+
+    // Responses differ per Origin, so caches must key on it
+    res.vary('Origin')
+
+    try {
+      const client = await resolveClient(req)
+      const allowed = isCorsOriginAllowed(client, origin)
+
+      if (allowed) {
+        res.set('Access-Control-Allow-Origin', origin)
+        res.set('Access-Control-Allow-Credentials', 'true')
+      }
+
+      // Answer preflight requests here; unregistered origins get no CORS headers
+      if (req.method === 'OPTIONS') {
+        if (allowed) {
+          res.set('Access-Control-Allow-Methods', ALLOWED_METHODS)
+          res.set('Access-Control-Allow-Headers', ALLOWED_HEADERS)
+        }
+        return res.sendStatus(204)
+      }
+
+      next()
+    } catch (err) {
+      next(err)
+    }
+  }
+}
+
+const clientCors = corsFor(requestClient)
+const sessionBridgeCors = corsFor(sessionBridgeClient)
+
+// Token endpoint CORS: the session bridge paths follow the bridge's rules
+function tokenCors (req, res, next) {
+  const cors = SESSION_BRIDGE_PATHS.includes(req.path) ? sessionBridgeCors : clientCors
+  return cors(req, res, next)
+}
+
+module.exports = {
+  clientCors,
+  tokenCors,
+  getRequestClientId
+}
@@ -0,0 +1,107 @@
+const net = require('net')
+const config = require('../config')
+
+// Strip the IPv4-mapped IPv6 prefix (::ffff:10.0.0.1 -> 10.0.0.1)
+function normalizeIp (ip) {
+  if (!ip) return ip
+  const trimmed = ip.trim()
+  return trimmed.startsWith('::ffff:') && net.isIPv4(trimmed.substring(7))
+    ? trimmed.substring(7)
+    : trimmed
+}
+
+// Build a BlockList from a list of CIDRs or single addresses
+function buildTrustedProxyList (proxies) {
+  const list = new net.BlockList()
+
+  for (const entry of proxies) {
+    const [address, prefix] = entry.split('/')
+    const type = net.isIPv6(address) ? 'ipv6' : 'ipv4'
+
+    if (!net.isIP(address)) {
+      throw new Error(`Invalid trusted proxy address: ${entry}`)
+    }
+
+    if (prefix === undefined) {
+      list.addAddress(address, type)
+    } else {
+      const bits = /^\d{1,3}$/.test(prefix) ? parseInt(prefix, 10) : NaN
+      if (!(bits <= (type === 'ipv6' ? 128 : 32))) {
+        throw new Error(`Invalid trusted proxy prefix: ${entry}`)
+      }
+      list.addSubnet(address, bits, type)
+    }
+  }
+
+  return list
+}
+
+// Parsed lists by proxy list, so the configured list is parsed once rather
+// than on every request
+const parsedLists = new WeakMap()
+
+function trustedProxyList (proxies) {
+  let list = parsedLists.get(proxies)
+  if (!list) {
+    list = buildTrustedProxyList(proxies)
+    parsedLists.set(proxies, list)
+  }
+  return list
+}
+
+function isTrusted (list, ip) {
+  if (!net.isIP(ip)) {
+    return false
+  }
+  return list.check(ip, net.isIPv6(ip) ? 'ipv6' : 'ipv4')
+}
+
+/**
+ * Extract the real client IP address.
+ *
+ * X-Forwarded-For is only honoured when the direct peer is a trusted proxy,
+ * and is walked from right to left through trusted hops only. The first
+ * untrusted hop is the client. Falls back to the socket address.
+ *
+ * @param {object} req - Express request
+ * @param {string[]} trustedProxies - CIDRs or addresses of trusted proxies
+ * @returns {string} Client IP address
+ */
+function getClientIp (req, trustedProxies = config.trustedProxies) {
+  const remoteAddress = normalizeIp(req.socket?.remoteAddress || req.connection?.remoteAddress)
+
+  if (!trustedProxies || trustedProxies.length === 0) {
+    return remoteAddress
+  }
+
+  const list = trustedProxyList(trustedProxies)
+  if (!isTrusted(list, remoteAddress)) {
+    // Forwarding headers from untrusted peers are ignored
+    return remoteAddress
+  }
+
+  const forwardedFor = req.headers['x-forwarded-for']
+  if (!forwardedFor) {
+    return remoteAddress
+  }
+
+  const hops = forwardedFor.split(',').map(normalizeIp).filter(Boolean)
+  let clientIp = remoteAddress
+
+  for (let i = hops.length - 1; i >= 0; i--) {
+    if (!net.isIP(hops[i])) {
+      break
+    }
+    clientIp = hops[i]
+    if (!isTrusted(list, hops[i])) {
+      break
+    }
+  }
+
+  return clientIp
+}
+
+module.exports = {
+  getClientIp,
+  buildTrustedProxyList
+}
@@ -1,4 +1,7 @@
 const rateLimit = require('express-rate-limit')
+const config = require('../config')
+const { getClientIp } = require('./clientIp')
+const { createRateLimitStore, getCounterStore } = require('./rateLimitStore')
 
 const loginLimiter = rateLimit({
   windowMs: 15 * 60 * 1000, // 15 minutes
@@ -9,6 +12,9 @@ const loginLimiter = rateLimit({
   },
   standardHeaders: true, // Return rate limit info in `RateLimit-*` headers
   legacyHeaders: false, // Disable `X-RateLimit-*` headers
+  keyGenerator: (req) => getClientIp(req),
+  // Shared across instances when NGAUTH_RATE_LIMIT_STORE=redis
+  store: createRateLimitStore(getCounterStore(), { prefix: 'login:' }),
   skip: (req) => process.env.NODE_ENV === 'test' // Skip in test environment
 })
 
@@ -21,10 +27,56 @@ const registerLimiter = rateLimit({
   },
   standardHeaders: true,
   legacyHeaders: false,
+  keyGenerator: (req) => getClientIp(req),
+  store: createRateLimitStore(getCounterStore(), { prefix: 'register:' }),
   skip: (req) => process.env.NODE_ENV === 'test'
 })
 
+// Limiter for the endpoints that can be used to probe tokens (userinfo,
+// introspection). The limit is read from config.rateLimit on every request
+// (0 disables it); blocked requests get 429 with Retry-After.
+function endpointLimiter (prefix, setting, options) {
+  const limit = () => config.rateLimit[setting]
+  return rateLimit({
+    windowMs: config.rateLimit.endpointWindow * 1000,
+    limit,
+    message: {
+      error: 'too_many_requests',
+      error_description: 'Too many requests, please try again later'
+    },
+    standardHeaders: true,
+    legacyHeaders: false,
+    keyGenerator: (req) => getClientIp(req),
+    store: createRateLimitStore(getCounterStore(), { prefix }),
+    skip: () => limit() === 0,
+    ...options
+  })
+}
+
+// Per-IP limits run before authentication, per-client limits after it
+const userinfoIpLimiter = endpointLimiter('userinfo-ip:', 'userinfo')
+const userinfoClientLimiter = endpointLimiter('userinfo-client:', 'userinfo', {
+  keyGenerator: (req) => req.token.client_id || req.token.sub
+})
+const introspectIpLimiter = endpointLimiter('introspect-ip:', 'introspect')
+const introspectClientLimiter = endpointLimiter('introspect-client:', 'introspect', {
+  keyGenerator: (req) => req.client.client_id
+})
+
+// Only introspections that found the token inactive count, so a client
+// probing for valid tokens is blocked long before its overall limit
+const inactiveIntrospectLimiter = endpointLimiter('introspect-inactive:', 'introspectInactive', {
+  keyGenerator: (req) => req.client.client_id,
+  skipSuccessfulRequests: true,
+  requestWasSuccessful: (req, res) => res.locals.tokenActive === true
+})
+
 module.exports = {
   loginLimiter,
-  registerLimiter
+  registerLimiter,
+  userinfoIpLimiter,
+  userinfoClientLimiter,
+  introspectIpLimiter,
+  introspectClientLimiter,
+  inactiveIntrospectLimiter
 }
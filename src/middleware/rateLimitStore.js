@@ -0,0 +1,183 @@
+/**
+ * Rate limit stores
+ *
+ * Hit counters behind express-rate-limit. The in-memory store limits each
+ * instance on its own; the Redis store keeps the counters in Redis with an
+ * atomic INCR + PEXPIRE so every instance draws from the same budget.
+ */
+
+const config = require('../config')
+
+// Fixed-window counters kept in process memory
+class MemoryCounterStore {
+  constructor () {
+    this.counters = new Map()
+    this.increments = 0
+  }
+
+  async increment (key, windowMs, now = Date.now()) {
+    // Drop expired windows now and then so idle keys do not accumulate
+    if (++this.increments % 1000 === 0) {
+      this.purgeExpired(now)
+    }
+
+    let entry = this.counters.get(key)
+    if (!entry || entry.resetTime <= now) {
+      entry = { hits: 0, resetTime: now + windowMs }
+      this.counters.set(key, entry)
+    }
+    entry.hits++
+    return { totalHits: entry.hits, resetTime: new Date(entry.resetTime) }
+  }
+
+  async decrement (key) {
+    const entry = this.counters.get(key)
+    if (entry && entry.hits > 0) {
+      entry.hits--
+    }
+  }
+
+  async reset (key) {
+    this.counters.delete(key)
+  }
+
+  purgeExpired (now = Date.now()) {
+    for (const [key, entry] of this.counters) {
+      if (entry.resetTime <= now) {
+        this.counters.delete(key)
+      }
+    }
+  }
+}
+
+// Start the window on the first hit and report the hits and remaining TTL
+const INCREMENT_SCRIPT = `
+local hits = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+  ttl = tonumber(ARGV[1])
+end
+return { hits, ttl }`
+
+// Only decrement live windows, never below zero
+const DECREMENT_SCRIPT = `
+if tonumber(redis.call('GET', KEYS[1]) or '0') > 0 then
+  return redis.call('DECR', KEYS[1])
+end
+return 0`
+
+// Fixed-window counters shared through Redis. Takes a connected node-redis
+// (v4+) client, so the server itself does not depend on a Redis driver.
+class RedisCounterStore {
+  constructor (client, { keyPrefix = 'ngauth:rl:' } = {}) {
+    this.client = client
+    this.keyPrefix = keyPrefix
+  }
+
+  async increment (key, windowMs, now = Date.now()) {
+    const [hits, ttl] = await this.client.eval(INCREMENT_SCRIPT, {
+      keys: [this.keyPrefix + key],
+      arguments: [String(windowMs)]
+    })
+    return { totalHits: Number(hits), resetTime: new Date(now + Number(ttl)) }
+  }
+
+  async decrement (key) {
+    await this.client.eval(DECREMENT_SCRIPT, { keys: [this.keyPrefix + key], arguments: [] })
+  }
+
+  async reset (key) {
+    await this.client.del(this.keyPrefix + key)
+  }
+}
+
+/**
+ * Adapt a counter store to the express-rate-limit Store interface. When the
+ * counter store is unreachable the request is allowed (failureMode 'open')
+ * or rejected as over the limit (failureMode 'closed').
+ *
+ * @param {object} counters - MemoryCounterStore, RedisCounterStore or compatible
+ * @param {object} options
+ * @param {string} options.prefix - Key prefix separating this limiter's counters
+ * @param {string} options.failureMode - 'open' or 'closed'
+ * @returns {object} express-rate-limit store
+ */
+function createRateLimitStore (counters, { prefix = '', failureMode = config.rateLimit.failureMode } = {}) {
+  let windowMs = 60 * 1000
+
+  const onStoreError = (err) => {
+    if (process.env.NODE_ENV !== 'test') {
+      console.warn(`Rate limit store unavailable (failing ${failureMode}):`, err.message)
+    }
+  }
+
+  return {
+    init (options) {
+      windowMs = options.windowMs
+    },
+
+    async increment (key) {
+      try {
+        return await counters.increment(prefix + key, windowMs)
+      } catch (err) {
+        onStoreError(err)
+        return {
+          totalHits: failureMode === 'closed' ? Number.MAX_SAFE_INTEGER : 1,
+          resetTime: new Date(Date.now() + windowMs)
+        }
+      }
+    },
+
+    async decrement (key) {
+      try {
+        await counters.decrement(prefix + key)
+      } catch (err) {
+        onStoreError(err)
+      }
+    },
+
+    async resetKey (key) {
+      try {
+        await counters.reset(prefix + key)
+      } catch (err) {
+        onStoreError(err)
+      }
+    }
+  }
+}
+
+let sharedCounters
+
+// Counter store selected by NGAUTH_RATE_LIMIT_STORE, shared by all limiters
+function getCounterStore () {
+  if (sharedCounters) {
+    return sharedCounters
+  }
+
+  if (config.rateLimit.store === 'redis') {
+    let redis
+    try {
+      redis = require('redis')
+    } catch (err) {
+      throw new Error('NGAUTH_RATE_LIMIT_STORE=redis requires the "redis" package (npm install redis)')
+    }
+    const client = redis.createClient({ url: config.rateLimit.redisUrl })
+    client.on('error', (err) => console.warn('Rate limit Redis error:', err.message))
+    client.connect().catch(() => {
+      // Reported through the error event; the limiter applies failureMode meanwhile
+    })
+    sharedCounters = new RedisCounterStore(client)
+  } else {
+    sharedCounters = new MemoryCounterStore()
+  }
+
+  return sharedCounters
+}
+
+module.exports = {
+  MemoryCounterStore,
+  RedisCounterStore,
+  createRateLimitStore,
+  getCounterStore
+}
@@ -5,6 +5,16 @@
  * Implements OIDC Core 1.0 specification claims
  */
 
+const config = require('./config')
+const { OAuthError } = require('./errors')
+
+// prompt values understood by the authorization endpoint
+// (OIDC Core 3.1.2.1, Initiating User Registration 1.0)
+const PROMPT_VALUES = ['none', 'login', 'consent', 'select_account', 'create']
+
+// display values for the login and consent pages (OIDC Core 3.1.2.1)
+const DISPLAY_VALUES = ['page', 'popup', 'touch', 'wap']
+
 const STANDARD_CLAIMS = {
   profile: [
     'name',
@@ -35,37 +45,92 @@ const STANDARD_CLAIMS = {
   ]
 }
 
-/**
- * Get claims based on requested scope
- * @param {string} scope - Space-separated scope string
- * @param {object} user - User object from database
- * @returns {object} Claims object
- */
-function getClaimsForScope (scope, user) {
-  const claims = {
-    sub: user.id // subject claim - unique user identifier
-  }
+// Claims that describe the token or the authentication rather than the
+// user; no claim source may set them
+const PROTECTED_CLAIMS = [
+  'iss', 'sub', 'aud', 'exp', 'iat', 'nbf', 'jti', 'azp',
+  'nonce', 'auth_time', 'acr', 'amr', 'at_hash', 'c_hash', 'sid', 'cnf'
+]
 
-  if (!scope) {
-    return claims
-  }
+// Scope that releases each standard claim (OIDC Core 5.4)
+const CLAIM_SCOPES = Object.fromEntries(
+  Object.entries(STANDARD_CLAIMS).flatMap(([scope, names]) => names.map(name => [name, scope]))
+)
+
+let claimsEnricher = null
 
-  const scopes = scope.split(' ')
+/**
+ * Install a claims enricher, consulted for every id_token and userinfo
+ * response. It runs synchronously on the token path.
+ * @param {function|null} enricher - ({ user, clientId, scope, target }) => claims object,
+ *   target being 'id_token' or 'userinfo'; null removes it
+ */
+function setClaimsEnricher (enricher) {
+  claimsEnricher = enricher
+}
 
+// Claims the user record itself provides for the granted scopes
+function userRecordClaims (user, scopes) {
+  const claims = {}
   if (scopes.includes('profile')) {
     claims.name = user.name || user.username
     claims.preferred_username = user.username
     claims.updated_at = Math.floor(new Date(user.created_at).getTime() / 1000)
+    claims.locale = user.locale
   }
-
   if (scopes.includes('email')) {
     claims.email = user.email
     claims.email_verified = user.email_verified || false
   }
-
   return claims
 }
 
+function claimsFromSource (source, user, scopes, context) {
+  switch (source) {
+    case 'user':
+      return userRecordClaims(user, scopes)
+    case 'upstream':
+      // As asserted by an upstream identity provider, stored on the user
+      return user.upstream_claims || {}
+    case 'enrichment':
+      return (claimsEnricher && claimsEnricher({ user, scope: scopes.join(' '), ...context })) || {}
+    default:
+      return {}
+  }
+}
+
+/**
+ * Get claims based on requested scope, merged from the claim sources in
+ * config.claims.sourcePrecedence: a source overrides the claims of every
+ * source listed after it. Standard claims are only released for their
+ * scope, and protected claims such as iss, sub and exp never come from a
+ * source.
+ * @param {string} scope - Space-separated scope string
+ * @param {object} user - User object from database
+ * @param {object} context - { clientId, target } passed to the enricher
+ * @returns {object} Claims object
+ */
+function getClaimsForScope (scope, user, context = {}) {
+  const scopes = scope ? scope.split(' ') : []
+  const releasable = (name) => !PROTECTED_CLAIMS.includes(name) &&
+    (!CLAIM_SCOPES[name] || scopes.includes(CLAIM_SCOPES[name]))
+
+  const merged = {}
+  // Lowest precedence first, so each source overwrites the ones below it
+  for (const source of [...config.claims.sourcePrecedence].reverse()) {
+    for (const [name, value] of Object.entries(claimsFromSource(source, user, scopes, context))) {
+      if (value !== undefined && releasable(name)) {
+        merged[name] = value
+      }
+    }
+  }
+
+  return {
+    sub: user.id, // subject claim - unique user identifier
+    ...merged
+  }
+}
+
 /**
  * Build ID token claims
  * @param {object} user - User object
@@ -73,11 +138,11 @@ function getClaimsForScope (scope, user) {
  * @param {string} issuer - Token issuer URL
  * @param {string} scope - Requested scopes
  * @param {string} nonce - Optional nonce from authorization request
+ * @param {number} expiresIn - Lifetime in seconds (default 1 hour)
  * @returns {object} ID token claims
  */
-function buildIdTokenClaims (user, clientId, issuer, scope, nonce) {
+function buildIdTokenClaims (user, clientId, issuer, scope, nonce, expiresIn = 3600) {
   const now = Math.floor(Date.now() / 1000)
-  const expiresIn = 3600 // 1 hour
 
   const claims = {
     iss: issuer,
@@ -92,47 +157,103 @@ function buildIdTokenClaims (user, clientId, issuer, scope, nonce) {
     claims.nonce = nonce
   }
 
-  // Add user claims based on scope
-  const userClaims = getClaimsForScope(scope, user)
-  Object.assign(claims, userClaims)
-
-  return claims
+  // Add user claims based on scope; they cannot replace the claims above
+  const userClaims = getClaimsForScope(scope, user, { clientId, target: 'id_token' })
+  return { ...userClaims, ...claims }
 }
 
 /**
  * Build userinfo response
  * @param {object} user - User object
  * @param {string} scope - Authorized scopes
+ * @param {string} clientId - Client the access token was issued to
  * @returns {object} Userinfo response
  */
-function buildUserinfoResponse (user, scope) {
-  const userinfo = {
-    sub: user.id
-  }
+function buildUserinfoResponse (user, scope, clientId) {
+  return getClaimsForScope(scope, user, { clientId, target: 'userinfo' })
+}
 
-  if (!scope) {
-    return userinfo
+/**
+ * Parse the claims request parameter (OIDC Core 5.5)
+ * @param {string|object} raw - JSON string (query/form) or object (JSON body)
+ * @returns {object|null} Claims request, or null when absent
+ * @throws {OAuthError} invalid_request
+ */
+function parseClaimsRequest (raw) {
+  if (raw === undefined || raw === null || raw === '') {
+    return null
   }
 
-  const scopes = scope.split(' ')
-
-  if (scopes.includes('profile')) {
-    userinfo.name = user.name || user.username
-    userinfo.preferred_username = user.username
-    userinfo.updated_at = Math.floor(new Date(user.created_at).getTime() / 1000)
+  let request = raw
+  if (typeof raw === 'string') {
+    try {
+      request = JSON.parse(raw)
+    } catch (err) {
+      throw new OAuthError('invalid_request', 'claims must be valid JSON')
+    }
   }
 
-  if (scopes.includes('email')) {
-    userinfo.email = user.email
-    userinfo.email_verified = user.email_verified || false
+  const isObject = (value) => !!value && typeof value === 'object' && !Array.isArray(value)
+  if (!isObject(request)) {
+    throw new OAuthError('invalid_request', 'claims must be a JSON object')
+  }
+  for (const target of ['userinfo', 'id_token']) {
+    if (request[target] === undefined) {
+      continue
+    }
+    if (!isObject(request[target])) {
+      throw new OAuthError('invalid_request', `claims.${target} must be a JSON object`)
+    }
+    for (const [name, spec] of Object.entries(request[target])) {
+      // Each member is null or an object such as { "essential": true }
+      if (spec !== null && !isObject(spec)) {
+        throw new OAuthError('invalid_request', `claims.${target}.${name} must be null or a JSON object`)
+      }
+    }
   }
 
-  return userinfo
+  return request
+}
+
+/**
+ * Claims the claims request marks as essential for one target
+ * @param {object|null} claimsRequest - Parsed claims request
+ * @param {string} target - 'userinfo' or 'id_token'
+ * @returns {string[]} Essential claim names
+ */
+function essentialClaims (claimsRequest, target) {
+  const requested = (claimsRequest && claimsRequest[target]) || {}
+  return Object.keys(requested).filter(name => requested[name] && requested[name].essential === true)
+}
+
+/**
+ * Essential userinfo claims the userinfo response would not carry, because
+ * the user has no value for them or their scope was not granted
+ * @param {object|null} claimsRequest - Parsed claims request
+ * @param {object} user - User object
+ * @param {string} scope - Scope being granted
+ * @param {string} clientId - Client the tokens are issued to
+ * @returns {string[]} Claim names that cannot be provided
+ */
+function unavailableEssentialClaims (claimsRequest, user, scope, clientId) {
+  const essential = essentialClaims(claimsRequest, 'userinfo')
+  if (essential.length === 0) {
+    return []
+  }
+  const userinfo = buildUserinfoResponse(user, scope, clientId)
+  return essential.filter(name => userinfo[name] === undefined || userinfo[name] === null)
 }
 
 module.exports = {
   getClaimsForScope,
   buildIdTokenClaims,
   buildUserinfoResponse,
-  STANDARD_CLAIMS
+  setClaimsEnricher,
+  parseClaimsRequest,
+  essentialClaims,
+  unavailableEssentialClaims,
+  PROTECTED_CLAIMS,
+  STANDARD_CLAIMS,
+  PROMPT_VALUES,
+  DISPLAY_VALUES
 }
@@ -0,0 +1,165 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Pairwise subject identifiers (OIDC Core 8.1)
+ *
+ * A client registered with subject_type 'pairwise' sees a sub of its own
+ * for each user, derived from the client's sector: the host of its
+ * sector_identifier_uri, or of its redirect URIs when they share one host.
+ * Clients in the same sector see the same sub; other clients cannot
+ * correlate it.
+ */
+
+const crypto = require('crypto')
+const dns = require('dns').promises
+const net = require('net')
+const config = require('./config')
+const { OAuthError } = require('./errors')
+
+const SUBJECT_TYPES = ['public', 'pairwise']
+
+const FETCH_TIMEOUT_MS = 5000
+
+// A sector document lists redirect URIs; anything larger is not one
+const MAX_SECTOR_DOCUMENT_BYTES = 64 * 1024
+
+// Addresses a registration must not make the server fetch from: loopback,
+// private, link-local, unspecified and multicast ranges
+const PRIVATE_ADDRESSES = new net.BlockList()
+for (const [address, prefix] of [['0.0.0.0', 8], ['10.0.0.0', 8], ['100.64.0.0', 10], ['127.0.0.0', 8], ['169.254.0.0', 16], ['172.16.0.0', 12], ['192.168.0.0', 16], ['224.0.0.0', 4], ['240.0.0.0', 4]]) {
+  PRIVATE_ADDRESSES.addSubnet(address, prefix, 'ipv4')
+}
+for (const [address, prefix] of [['::', 127], ['fc00::', 7], ['fe80::', 10], ['ff00::', 8], ['::ffff:0:0', 96]]) {
+  PRIVATE_ADDRESSES.addSubnet(address, prefix, 'ipv6')
+}
+
+const FETCH_FAILED = 'sector_identifier_uri could not be retrieved'
+
+// Pairwise subjects need a stable secret, or every sub would change on restart
+function pairwiseSupported () {
+  return !!config.claims.pairwiseSecret
+}
+
+function hostOf (uri) {
+  return new URL(uri).host
+}
+
+// Whether a host resolves to a private address. Hosts that do not resolve
+// count as private, since they cannot be checked.
+async function isPrivateHost (hostname) {
+  const host = hostname.replace(/^\[|\]$/g, '')
+  let addresses
+  try {
+    addresses = net.isIP(host) ? [{ address: host, family: net.isIPv6(host) ? 6 : 4 }] : await dns.lookup(host, { all: true })
+  } catch (err) {
+    return true
+  }
+  return addresses.some(({ address, family }) => PRIVATE_ADDRESSES.check(address, family === 6 ? 'ipv6' : 'ipv4'))
+}
+
+// Read a response body, giving up past maxBytes
+async function readLimited (res, maxBytes) {
+  if (Number(res.headers.get('content-length')) > maxBytes) {
+    return null
+  }
+  const chunks = []
+  let size = 0
+  for await (const chunk of res.body) {
+    size += chunk.length
+    if (size > maxBytes) {
+      return null
+    }
+    chunks.push(chunk)
+  }
+  return Buffer.concat(chunks).toString('utf8')
+}
+
+/**
+ * Fetch a sector_identifier_uri and check that it lists every redirect URI
+ * of the client (OIDC Registration 5). Registration is open, so the URI must
+ * be https on a public address, redirects are not followed and the document
+ * size is capped; allowPrivateSectorUris lifts the first two for development.
+ * @param {string} uri - sector_identifier_uri
+ * @param {string[]} redirectUris - Redirect URIs being registered
+ * @returns {Promise<string>} The sector identifier (host of the URI)
+ * @throws {OAuthError} invalid_client_metadata
+ */
+async function resolveSectorIdentifier (uri, redirectUris) {
+  const url = new URL(uri)
+  if (!config.registration.allowPrivateSectorUris) {
+    if (url.protocol !== 'https:') {
+      throw new OAuthError('invalid_client_metadata', 'sector_identifier_uri must be an https URL')
+    }
+    if (await isPrivateHost(url.hostname)) {
+      throw new OAuthError('invalid_client_metadata', 'sector_identifier_uri must be on a public host')
+    }
+  }
+
+  let body
+  try {
+    const res = await fetch(uri, { headers: { Accept: 'application/json' }, redirect: 'error', signal: AbortSignal.timeout(FETCH_TIMEOUT_MS) })
+    body = res.ok ? await readLimited(res, MAX_SECTOR_DOCUMENT_BYTES) : null
+  } catch (err) {
+    body = null
+  }
+  if (body === null) {
+    throw new OAuthError('invalid_client_metadata', FETCH_FAILED)
+  }
+
+  let listed
+  try {
+    listed = JSON.parse(body)
+  } catch (err) {
+    listed = null
+  }
+  if (!Array.isArray(listed) || !listed.every(u => typeof u === 'string')) {
+    throw new OAuthError('invalid_client_metadata', 'sector_identifier_uri must return a JSON array of redirect URIs')
+  }
+
+  const missing = redirectUris.find(u => !listed.includes(u))
+  if (missing) {
+    throw new OAuthError('invalid_client_metadata', `redirect_uri ${missing} is not listed at the sector_identifier_uri`)
+  }
+  return hostOf(uri)
+}
+
+/**
+ * Sector identifier of a pairwise client without a sector_identifier_uri:
+ * the host its redirect URIs share (OIDC Core 8.1)
+ * @param {string[]} redirectUris - Registered redirect URIs
+ * @returns {string}
+ * @throws {OAuthError} invalid_client_metadata when the hosts differ
+ */
+function sectorFromRedirectUris (redirectUris) {
+  const hosts = [...new Set(redirectUris.map(hostOf))]
+  if (hosts.length > 1) {
+    throw new OAuthError('invalid_client_metadata', 'Pairwise clients with redirect_uris on several hosts must register a sector_identifier_uri')
+  }
+  return hosts[0]
+}
+
+/**
+ * The sub a client sees for a user: the user ID, or for a pairwise client a
+ * hash of its sector and the user ID keyed with the pairwise secret
+ * @param {object|null} client - Registered client
+ * @param {string} userId - Local user ID
+ * @returns {string}
+ */
+function subjectFor (client, userId) {
+  if (!client || client.subject_type !== 'pairwise') {
+    return userId
+  }
+  return crypto.createHmac('sha256', config.claims.pairwiseSecret)
+    .update(`${client.sector_identifier}\n${userId}`)
+    .digest('base64url')
+}
+
+module.exports = {
+  SUBJECT_TYPES,
+  isPrivateHost,
+  pairwiseSupported,
+  readLimited,
+  resolveSectorIdentifier,
+  sectorFromRedirectUris,
+  subjectFor
+}
@@ -0,0 +1,51 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Rich Authorization Requests (RFC 9396)
+ * Parses and validates authorization_details against the client's
+ * registered authorization_details_types
+ */
+
+const { OAuthError } = require('./errors')
+
+/**
+ * Parse the authorization_details request parameter
+ * @param {string|Array} raw - JSON string (query/form) or array (JSON body)
+ * @param {object} client - Registered client
+ * @returns {Array|null} Validated authorization details, or null when absent
+ * @throws {OAuthError} invalid_authorization_details
+ */
+function parseAuthorizationDetails (raw, client) {
+  if (raw === undefined || raw === null || raw === '') {
+    return null
+  }
+
+  let details = raw
+  if (typeof raw === 'string') {
+    try {
+      details = JSON.parse(raw)
+    } catch (err) {
+      throw new OAuthError('invalid_authorization_details', 'authorization_details must be valid JSON')
+    }
+  }
+
+  if (!Array.isArray(details) || details.length === 0) {
+    throw new OAuthError('invalid_authorization_details', 'authorization_details must be a non-empty JSON array')
+  }
+
+  const allowedTypes = client.authorization_details_types || []
+  for (const detail of details) {
+    if (!detail || typeof detail !== 'object' || Array.isArray(detail) || typeof detail.type !== 'string') {
+      throw new OAuthError('invalid_authorization_details', 'Each authorization_details entry must be an object with a type')
+    }
+    if (!allowedTypes.includes(detail.type)) {
+      throw new OAuthError('invalid_authorization_details', `Unsupported authorization_details type: ${detail.type}`)
+    }
+  }
+
+  return details
+}
+
+module.exports = {
+  parseAuthorizationDetails
+}
@@ -0,0 +1,518 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Admin Endpoints
+ * Operational endpoints for server operators (requires scope: admin)
+ */
+
+const express = require('express')
+const config = require('../config')
+const { getClient, getClients, updateClient, getUser, getUserById, revokeIssuedToken, deleteScopeBaseline, isTokenRevoked } = require('../db')
+const { CLIENT_STATUSES, rotateClientSecret, queryClients, toPublicClient } = require('../clients')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { OAuthError } = require('../errors')
+const { getEffectiveConfig, getConfigFingerprint } = require('../config/fingerprint')
+const { authenticateBearerToken, requireScope } = require('../auth')
+const { getSweeperStats } = require('../sweeper')
+const { subscribeEvents } = require('../eventStream')
+const { checkClientJwks } = require('../clientJwks')
+const { noStore } = require('../middleware/cacheControl')
+const { buildAccessTokenPayload, previewTokenClaims, withDefaultClaims, validateDefaultClaims, rotateDefaultKey, getKeyRotation } = require('../tokens')
+const { buildIdTokenClaims, buildUserinfoResponse } = require('../oidc')
+const { normalizeScope, expandScopes, findMachineOnlyScopes } = require('../scopes')
+const { resolveAudience, serializeAudience } = require('../audience')
+const { acrForAmr } = require('../acr')
+const { subjectFor } = require('../pairwise')
+
+const router = express.Router()
+
+// Admin responses carry secrets and client data; never cache them
+router.use(noStore)
+
+router.use(authenticateBearerToken, requireScope('admin'))
+
+// GET /admin/config - Redacted effective configuration and its fingerprint
+router.get('/config', (req, res) => {
+  res.json({
+    fingerprint: getConfigFingerprint(config),
+    config: getEffectiveConfig(config)
+  })
+})
+
+// GET /admin/sweeper - Expired-record sweeper metrics
+router.get('/sweeper', (req, res) => {
+  res.json(getSweeperStats())
+})
+
+// GET /admin/keys - Default signing key rotation: the current kid, the next
+// key waiting to activate and the replaced keys still verifying tokens
+router.get('/keys', (req, res) => {
+  const { current, next, previous } = getKeyRotation()
+  const iso = (ms) => new Date(ms).toISOString()
+  res.json({
+    current,
+    next: next ? { kid: next.kid, activates_at: iso(next.activatesAt) } : null,
+    previous: previous.map(k => ({ kid: k.kid, retires_at: iso(k.retiresAt) }))
+  })
+})
+
+// POST /admin/keys/rotate - Publish a new default key now; it starts signing
+// after config.signingKeys.activationDelay seconds
+router.post('/keys/rotate', async (req, res, next) => {
+  try {
+    if (process.env.NGAUTH_KEY) {
+      return next(new OAuthError('invalid_request', 'The default key is set by NGAUTH_KEY and cannot be rotated'))
+    }
+    const pending = getKeyRotation().next
+    if (pending) {
+      return next(new OAuthError('invalid_request', `Key ${pending.kid} is already waiting to be activated`))
+    }
+
+    const { kid, activatesAt } = await rotateDefaultKey()
+
+    logSecurityEvent({
+      type: 'SIGNING_KEY_ROTATION_STARTED',
+      kid,
+      activates_at: new Date(activatesAt).toISOString(),
+      actor: req.user.sub
+    })
+
+    res.status(202).json({ kid, activates_at: new Date(activatesAt).toISOString() })
+  } catch (err) {
+    next(err)
+  }
+})
+
+// Longest delay setTimeout accepts (about 24.8 days)
+const MAX_TIMEOUT = 2 ** 31 - 1
+
+// GET /admin/events - Live audit events as Server-Sent Events (redacted)
+// ?types=LOGIN_SUCCEEDED,TOKEN_ISSUED limits the stream to those event types
+router.get('/events', (req, res, next) => {
+  const { types } = req.query
+  if (types !== undefined && typeof types !== 'string') {
+    return next(new OAuthError('invalid_request', "Parameter 'types' must be a string"))
+  }
+
+  res.writeHead(200, {
+    'Content-Type': 'text/event-stream',
+    'Cache-Control': 'no-cache',
+    Connection: 'keep-alive',
+    'X-Accel-Buffering': 'no'
+  })
+  res.write(': connected\n\n')
+
+  let id = 0
+  const subscription = subscribeEvents({
+    types: (types || '').split(',').map(t => t.trim()).filter(t => t),
+    write: (event) => res.write(`id: ${++id}\nevent: ${event.type}\ndata: ${JSON.stringify(event)}\n\n`),
+    close: () => res.end()
+  })
+  res.on('drain', () => subscription.drained())
+
+  // The stream lasts no longer than the token that opened it
+  let expiry = null
+  if (req.user.exp) {
+    expiry = setTimeout(() => res.end(), Math.min(req.user.exp * 1000 - Date.now(), MAX_TIMEOUT))
+    expiry.unref()
+  }
+
+  // Comments keep proxies from closing an idle stream. Each one rechecks
+  // that the token has not been revoked since.
+  const heartbeat = setInterval(async () => {
+    try {
+      if (await isTokenRevoked(req.user)) {
+        return res.end()
+      }
+    } catch (err) {
+      return res.end()
+    }
+    res.write(': keep-alive\n\n')
+  }, config.eventStream.heartbeatInterval * 1000)
+  heartbeat.unref()
+
+  res.on('close', () => {
+    clearTimeout(expiry)
+    clearInterval(heartbeat)
+    subscription.unsubscribe()
+  })
+})
+
+const MAX_PAGE_SIZE = 100
+
+// Opaque page cursor (the offset of the next page)
+function encodeCursor (offset) {
+  return Buffer.from(JSON.stringify({ offset })).toString('base64url')
+}
+
+function decodeCursor (cursor) {
+  try {
+    const { offset } = JSON.parse(Buffer.from(cursor, 'base64url').toString('utf8'))
+    return Number.isInteger(offset) && offset >= 0 ? offset : null
+  } catch (err) {
+    return null
+  }
+}
+
+// GET /admin/clients - Registered clients without secrets
+// ?name=&grant_type=&status= filter, ?sort=[-]created_at|client_name|client_id,
+// ?limit= (max 100) and ?cursor= (next_cursor of the previous page) paginate
+router.get('/clients', async (req, res, next) => {
+  try {
+    const { name, grant_type, status, sort, cursor } = req.query
+
+    for (const [param, value] of Object.entries({ name, grant_type, status, sort, cursor, limit: req.query.limit })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${param}' must be a string`))
+      }
+    }
+
+    let limit = 20
+    if (req.query.limit !== undefined) {
+      limit = /^\d+$/.test(req.query.limit) ? parseInt(req.query.limit, 10) : 0
+      if (limit < 1 || limit > MAX_PAGE_SIZE) {
+        return next(new OAuthError('invalid_request', `limit must be between 1 and ${MAX_PAGE_SIZE}`))
+      }
+    }
+
+    let offset = 0
+    if (cursor !== undefined) {
+      offset = decodeCursor(cursor)
+      if (offset === null) {
+        return next(new OAuthError('invalid_request', 'Invalid cursor'))
+      }
+    }
+
+    if (status !== undefined && !CLIENT_STATUSES.includes(status)) {
+      return next(new OAuthError('invalid_request', "status must be 'active' or 'disabled'"))
+    }
+
+    const clients = await getClients()
+    let page
+    try {
+      page = queryClients(clients, { name, grantType: grant_type, status, sort, offset, limit })
+    } catch (err) {
+      return next(new OAuthError('invalid_request', err.message))
+    }
+
+    res.json({
+      clients: page.clients,
+      total: page.total,
+      next_cursor: page.nextOffset === null ? null : encodeCursor(page.nextOffset)
+    })
+  } catch (err) {
+    next(err)
+  }
+})
+
+// GET /admin/clients/:clientId/jwks - Diagnose the client's jwks_uri or jwks:
+// reachable, parseable and holding at least one usable signing key
+router.get('/clients/:clientId/jwks', async (req, res, next) => {
+  try {
+    const client = await getClient(req.params.clientId)
+    if (!client) {
+      return next(new OAuthError('invalid_request', 'Client not found'))
+    }
+
+    res.json(await checkClientJwks(client))
+  } catch (err) {
+    next(err)
+  }
+})
+
+// PATCH /admin/clients/:clientId - Mark a first-party client as trusted
+// (skip_consent), so its users are not asked for consent, let a trusted
+// client exchange the login session for tokens (session_bridge), and set the
+// claims added to every token issued to it (default_claims, overriding the
+// issuer-level defaults), and disable or re-enable it (status). Deliberately
+// not available through dynamic registration.
+router.patch('/clients/:clientId', async (req, res, next) => {
+  try {
+    const { skip_consent, session_bridge, default_claims, status } = req.body || {}
+
+    const client = await getClient(req.params.clientId)
+    if (!client) {
+      return next(new OAuthError('invalid_request', 'Client not found'))
+    }
+
+    if (skip_consent === undefined && session_bridge === undefined && default_claims === undefined && status === undefined) {
+      return next(new OAuthError('invalid_request', 'skip_consent, session_bridge, default_claims or status is required'))
+    }
+    if (status !== undefined && !CLIENT_STATUSES.includes(status)) {
+      return next(new OAuthError('invalid_request', "status must be 'active' or 'disabled'"))
+    }
+    if (skip_consent !== undefined && typeof skip_consent !== 'boolean') {
+      return next(new OAuthError('invalid_request', 'skip_consent must be a boolean'))
+    }
+    if (session_bridge !== undefined && typeof session_bridge !== 'boolean') {
+      return next(new OAuthError('invalid_request', 'session_bridge must be a boolean'))
+    }
+    // Only first-party clients may skip the authorization redirect
+    const trusted = skip_consent !== undefined ? skip_consent : !!client.skip_consent
+    if (session_bridge && !trusted) {
+      return next(new OAuthError('invalid_request', 'session_bridge needs a trusted client (skip_consent)'))
+    }
+    if (default_claims !== undefined) {
+      try {
+        validateDefaultClaims(default_claims)
+      } catch (err) {
+        return next(new OAuthError('invalid_request', err.message))
+      }
+    }
+
+    const changes = {}
+    if (skip_consent !== undefined) {
+      changes.skip_consent = skip_consent
+    }
+    // A client losing its trust loses the bridge with it
+    if (session_bridge !== undefined || (client.session_bridge && !trusted)) {
+      changes.session_bridge = !!session_bridge && trusted
+    }
+    if (default_claims !== undefined) {
+      changes.default_claims = default_claims
+    }
+    if (status !== undefined) {
+      changes.status = status
+    }
+    const updated = await updateClient(client.client_id, changes)
+
+    if (skip_consent !== undefined || changes.session_bridge !== undefined) {
+      logSecurityEvent({
+        type: 'CLIENT_TRUST_CHANGED',
+        client_id: client.client_id,
+        skip_consent: trusted,
+        session_bridge: !!updated.session_bridge,
+        actor: req.user.sub
+      })
+    }
+    if (default_claims !== undefined) {
+      logSecurityEvent({
+        type: 'CLIENT_DEFAULT_CLAIMS_CHANGED',
+        client_id: client.client_id,
+        claims: Object.keys(default_claims),
+        actor: req.user.sub
+      })
+    }
+    if (status !== undefined) {
+      logSecurityEvent({
+        type: 'CLIENT_STATUS_CHANGED',
+        client_id: client.client_id,
+        status,
+        actor: req.user.sub
+      })
+    }
+
+    res.json(toPublicClient(updated))
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /admin/clients/:clientId/secrets - Rotate the client secret
+// The previous secret keeps working for grace_period seconds; revoke_current
+// drops it immediately (use when the secret is compromised)
+router.post('/clients/:clientId/secrets', async (req, res, next) => {
+  try {
+    const { grace_period, revoke_current } = req.body || {}
+
+    const client = await getClient(req.params.clientId)
+    if (!client) {
+      return next(new OAuthError('invalid_request', 'Client not found'))
+    }
+
+    let gracePeriod = revoke_current ? 0 : config.clientSecrets.rotationGracePeriod
+    if (!revoke_current && grace_period !== undefined) {
+      gracePeriod = parseInt(grace_period, 10)
+      if (Number.isNaN(gracePeriod) || gracePeriod < 0) {
+        return next(new OAuthError('invalid_request', 'grace_period must be a non-negative number of seconds'))
+      }
+    }
+
+    // At most two secrets are active at once
+    const pending = client.previous_client_secret
+    if (!revoke_current && pending && pending.expiresAt > Date.now()) {
+      return next(new OAuthError('invalid_request', 'A secret rotation is already in progress; remove the previous secret first'))
+    }
+
+    const updated = await updateClient(client.client_id, rotateClientSecret(client, gracePeriod))
+    const previous = updated.previous_client_secret
+
+    logSecurityEvent({
+      type: 'CLIENT_SECRET_ROTATED',
+      client_id: client.client_id,
+      secret_id: updated.client_secret_id,
+      previous_secret_id: client.client_secret_id || 'primary',
+      revoked: !previous,
+      actor: req.user.sub
+    })
+
+    res.status(201).json({
+      client_id: updated.client_id,
+      client_secret: updated.client_secret,
+      client_secret_id: updated.client_secret_id,
+      previous_client_secret_id: previous ? previous.id : null,
+      previous_client_secret_expires_at: previous ? Math.floor(previous.expiresAt / 1000) : null
+    })
+  } catch (err) {
+    next(err)
+  }
+})
+
+// DELETE /admin/clients/:clientId/secrets/:secretId - Remove the previous secret
+router.delete('/clients/:clientId/secrets/:secretId', async (req, res, next) => {
+  try {
+    const client = await getClient(req.params.clientId)
+    if (!client) {
+      return next(new OAuthError('invalid_request', 'Client not found'))
+    }
+
+    const previous = client.previous_client_secret
+    if (!previous || previous.id !== req.params.secretId) {
+      return next(new OAuthError('invalid_request', 'Only the previous secret of a rotation can be removed'))
+    }
+
+    await updateClient(client.client_id, { previous_client_secret: null })
+
+    logSecurityEvent({
+      type: 'CLIENT_SECRET_REMOVED',
+      client_id: client.client_id,
+      secret_id: previous.id,
+      actor: req.user.sub
+    })
+
+    res.status(204).end()
+  } catch (err) {
+    next(err)
+  }
+})
+
+// DELETE /admin/clients/:clientId/scope-baseline - Forget the client's usual
+// scopes so its baseline is learned again (see src/scopeBaseline.js)
+router.delete('/clients/:clientId/scope-baseline', async (req, res, next) => {
+  try {
+    const client = await getClient(req.params.clientId)
+    if (!client) {
+      return next(new OAuthError('invalid_request', 'Client not found'))
+    }
+
+    const existed = await deleteScopeBaseline(client.client_id)
+
+    logSecurityEvent({
+      type: 'SCOPE_BASELINE_RESET',
+      client_id: client.client_id,
+      existed,
+      actor: req.user.sub
+    })
+
+    res.status(204).end()
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /admin/tokens/:jti/revoke - Revoke a single access token by the jti
+// recorded in its TOKEN_ISSUED audit event
+router.post('/tokens/:jti/revoke', async (req, res, next) => {
+  try {
+    const token = await revokeIssuedToken(req.params.jti)
+    if (!token) {
+      return next(new OAuthError('invalid_request', 'Token not found or already expired'))
+    }
+
+    logSecurityEvent({
+      type: 'TOKEN_REVOKED',
+      jti: token.jti,
+      client_id: token.client_id,
+      sub: token.sub,
+      actor: req.user.sub
+    })
+
+    res.status(204).end()
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /admin/claims/preview - The claims a grant to the client would put in
+// the access token, id_token and userinfo response, computed the same way as
+// at the token endpoint for a password sign-in now. Nothing is signed, so the
+// preview cannot be used as a token.
+router.post('/claims/preview', async (req, res, next) => {
+  try {
+    const { user, client_id, resource } = req.body || {}
+    const scope = normalizeScope((req.body || {}).scope)
+
+    for (const [name, value] of Object.entries({ user, client_id, scope })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be a string`))
+      }
+    }
+    if (!user || !client_id) {
+      return next(new OAuthError('invalid_request', 'user and client_id are required'))
+    }
+
+    const client = await getClient(client_id)
+    if (!client) {
+      return next(new OAuthError('invalid_request', 'Client not found'))
+    }
+    // The user may be given by ID or username
+    const subject = (await getUserById(user)) || (await getUser(user))
+    if (!subject) {
+      return next(new OAuthError('invalid_request', 'User not found'))
+    }
+
+    // Scope checks of the authorization endpoint
+    if (scope && client.scope && client.scope.trim()) {
+      const allowed = [...client.scope.split(' ').filter(s => s), 'openid', 'profile', 'email', 'offline_access']
+      const unknown = scope.split(' ').find(s => !allowed.includes(s))
+      if (unknown) {
+        return next(new OAuthError('invalid_scope', `Scope '${unknown}' not registered for this client`))
+      }
+    }
+    const machineOnly = findMachineOnlyScopes(scope)
+    if (machineOnly.length > 0) {
+      return next(new OAuthError('invalid_scope', `Scope '${machineOnly[0]}' is only available for client_credentials`))
+    }
+
+    const grantedScope = expandScopes(scope || '')
+    const accessToken = previewTokenClaims(withDefaultClaims(buildAccessTokenPayload({
+      userId: subject.id,
+      clientId: client.client_id,
+      scope: grantedScope,
+      aud: serializeAudience(resolveAudience(resource, client))
+    }), client), config.tokens.accessTokenTTL)
+
+    let idToken = null
+    if ((scope || '').split(' ').includes('openid')) {
+      const issuer = process.env.ISSUER || `http://${req.get('host')}${config.basePath}`
+      const lifetime = client.id_token_lifetime || config.tokens.idTokenTTL
+      const amr = ['pwd']
+      idToken = previewTokenClaims({
+        ...withDefaultClaims(buildIdTokenClaims(subject, client.client_id, issuer, scope, null, lifetime), client),
+        sub: subjectFor(client, subject.id),
+        auth_time: Math.floor(Date.now() / 1000),
+        amr,
+        acr: acrForAmr(amr)
+      }, lifetime)
+    }
+
+    logSecurityEvent({
+      type: 'CLAIMS_PREVIEWED',
+      userId: subject.id,
+      client_id: client.client_id,
+      scope: grantedScope,
+      actor: req.user.sub
+    })
+
+    res.json({
+      scope: grantedScope,
+      access_token_claims: accessToken,
+      id_token_claims: idToken,
+      userinfo: { ...buildUserinfoResponse(subject, grantedScope, client.client_id), sub: subjectFor(client, subject.id) }
+    })
+  } catch (err) {
+    next(err)
+  }
+})
+
+module.exports = router
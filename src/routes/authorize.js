@@ -1,22 +1,78 @@
 /* eslint camelcase: "off" */
+const crypto = require('crypto')
+const fs = require('fs').promises
 const express = require('express')
 const csrf = require('csurf')
-const { getClient, getUser, addCode, recordFailedLogin, clearFailedLoginAttempts } = require('../db')
-const { generateRandomToken } = require('../tokens')
+const config = require('../config')
+const { getClient, getUser, getUserById, addCode, recordFailedLogin, clearFailedLoginAttempts, getConsent, saveConsent } = require('../db')
+const { generateCode } = require('../tokens')
 const { OAuthError } = require('../errors')
-const { verifyPassword } = require('../users')
+const { verifyUserPassword, createUser } = require('../users')
+const { isRedirectUriAllowed, isClientActive } = require('../clients')
+const { PROMPT_VALUES, DISPLAY_VALUES, parseClaimsRequest, unavailableEssentialClaims } = require('../oidc')
+const { parseAuthorizationDetails } = require('../rar')
+const { startUserSession, sessionRef, sessionAccounts, switchAccount, bindNonce, consumeNonce } = require('../sessions')
+const { normalizeScope, scopeLimitError, findMachineOnlyScopes, adminScopeError } = require('../scopes')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { getClientIp } = require('../middleware/clientIp')
+const { verifyChallenge, loginNeedsChallenge, challengeWidget } = require('../challenge')
+const { acrForAmr, missingFactors, verifyTotp } = require('../acr')
+const { grantTypeEnabled } = require('../grantTypes')
+const { escapeHtml } = require('../html')
 
 const router = express.Router()
 const csrfProtection = csrf({ cookie: false })
 
-// HTML login form with CSRF token
-const loginForm = (clientId, redirectUri, scope, state, nonce, error, csrfToken) => `
-<!DOCTYPE html>
-<html>
+// Page layout for each display value (OIDC Core 3.1.2.1): popup fits a
+// small window, touch and wap size the page to the device
+const DISPLAY_LAYOUTS = {
+  page: {
+    style: 'body { font-family: sans-serif; max-width: 400px; margin: 50px auto; padding: 20px; }'
+  },
+  popup: {
+    style: 'body { font-family: sans-serif; max-width: 360px; margin: 0 auto; padding: 12px; }'
+  },
+  touch: {
+    viewport: true,
+    style: `body { font-family: sans-serif; max-width: 480px; margin: 0 auto; padding: 16px; font-size: 18px; }
+    input, button { min-height: 44px; font-size: 18px; }`
+  },
+  wap: {
+    viewport: true,
+    style: 'body { font-family: sans-serif; margin: 0; padding: 4px; font-size: 14px; }'
+  }
+}
+
+// <html> tag, title and layout styles for the requested display
+const pageHead = (params, title) => {
+  const display = params.display || 'page'
+  const layout = DISPLAY_LAYOUTS[display]
+  return `<html data-display="${escapeHtml(display)}">
 <head>
-  <title>OAuth Login</title>
+  <title>${escapeHtml(title)}</title>${layout.viewport ? '\n  <meta name="viewport" content="width=device-width, initial-scale=1" />' : ''}
   <style>
-    body { font-family: sans-serif; max-width: 400px; margin: 50px auto; padding: 20px; }
+    ${layout.style}`
+}
+
+// Hidden inputs carrying the original authorization request through the forms
+const requestFields = (params) => `
+    <input type="hidden" name="client_id" value="${escapeHtml(params.client_id)}" />
+    <input type="hidden" name="redirect_uri" value="${escapeHtml(params.redirect_uri)}" />
+    <input type="hidden" name="scope" value="${escapeHtml(params.scope || '')}" />
+    <input type="hidden" name="state" value="${escapeHtml(params.state || '')}" />
+    ${params.nonce ? `<input type="hidden" name="nonce" value="${escapeHtml(params.nonce)}" />` : ''}
+    ${params.prompt ? `<input type="hidden" name="prompt" value="${escapeHtml(params.prompt)}" />` : ''}
+    ${params.display ? `<input type="hidden" name="display" value="${escapeHtml(params.display)}" />` : ''}
+    ${params.response_mode ? `<input type="hidden" name="response_mode" value="${escapeHtml(params.response_mode)}" />` : ''}
+    ${params.login_hint ? `<input type="hidden" name="login_hint" value="${escapeHtml(params.login_hint)}" />` : ''}
+    ${params.acr_values ? `<input type="hidden" name="acr_values" value="${escapeHtml(params.acr_values)}" />` : ''}
+    ${params.authorization_details ? `<input type="hidden" name="authorization_details" value="${escapeHtml(params.authorization_details)}" />` : ''}
+    ${params.claims ? `<input type="hidden" name="claims" value="${escapeHtml(params.claims)}" />` : ''}`
+
+// HTML login form with CSRF token
+const loginForm = (params, error, csrfToken) => `
+<!DOCTYPE html>
+${pageHead(params, 'OAuth Login')}
     input { width: 100%; padding: 8px; margin: 8px 0; box-sizing: border-box; }
     button { width: 100%; padding: 10px; background: #007bff; color: white; border: none; cursor: pointer; }
     button:hover { background: #0056b3; }
@@ -25,16 +81,11 @@ const loginForm = (clientId, redirectUri, scope, state, nonce, error, csrfToken)
 </head>
 <body>
   <h2>Sign In</h2>
-  ${error ? `<div class="error">${error}</div>` : ''}
+  ${error ? `<div class="error">${escapeHtml(error)}</div>` : ''}
   <form method="POST">
-    <input type="hidden" name="_csrf" value="${csrfToken}" />
-    <input type="hidden" name="client_id" value="${clientId}" />
-    <input type="hidden" name="redirect_uri" value="${redirectUri}" />
-    <input type="hidden" name="scope" value="${scope || ''}" />
-    <input type="hidden" name="state" value="${state || ''}" />
-    ${nonce ? `<input type="hidden" name="nonce" value="${nonce}" />` : ''}
-    <input type="text" name="username" placeholder="Username" required />
-    <input type="password" name="password" placeholder="Password" required />
+    <input type="hidden" name="_csrf" value="${escapeHtml(csrfToken)}" />${requestFields(params)}
+    <input type="text" name="username" placeholder="Username" value="${escapeHtml(params.login_hint || '')}" required />
+    <input type="password" name="password" placeholder="Password" required />${config.challenge.loginAfterFailures > 0 ? challengeWidget() : ''}
     <button type="submit">Sign In</button>
   </form>
   <p style="font-size: 12px; color: #666;">Test credentials: testuser / testpass</p>
@@ -42,9 +93,463 @@ const loginForm = (clientId, redirectUri, scope, state, nonce, error, csrfToken)
 </html>
 `
 
+// HTML registration form with CSRF token (prompt=create)
+const registrationForm = (params, error, action, csrfToken) => `
+<!DOCTYPE html>
+${pageHead(params, 'Create Account')}
+    input { width: 100%; padding: 8px; margin: 8px 0; box-sizing: border-box; }
+    button { width: 100%; padding: 10px; background: #007bff; color: white; border: none; cursor: pointer; }
+    button:hover { background: #0056b3; }
+    .error { color: red; margin-bottom: 10px; }
+  </style>
+</head>
+<body>
+  <h2>Create Account</h2>
+  ${error ? `<div class="error">${escapeHtml(error)}</div>` : ''}
+  <form method="POST" action="${escapeHtml(action)}">
+    <input type="hidden" name="_csrf" value="${escapeHtml(csrfToken)}" />${requestFields(params)}
+    <input type="text" name="username" placeholder="Username" required />
+    <input type="email" name="email" placeholder="Email" required />
+    <input type="text" name="name" placeholder="Full name" />
+    <input type="password" name="password" placeholder="Password" required />${challengeWidget()}
+    <button type="submit">Create Account</button>
+  </form>
+</body>
+</html>
+`
+
+// HTML one-time code form with CSRF token (step-up to a stronger acr)
+const otpForm = (params, error, action, csrfToken) => `
+<!DOCTYPE html>
+${pageHead(params, "Verify It's You")}
+    input { width: 100%; padding: 8px; margin: 8px 0; box-sizing: border-box; }
+    button { width: 100%; padding: 10px; background: #007bff; color: white; border: none; cursor: pointer; }
+    button:hover { background: #0056b3; }
+    .error { color: red; margin-bottom: 10px; }
+  </style>
+</head>
+<body>
+  <h2>Verify It's You</h2>
+  <p>Enter the code from your authenticator app to continue.</p>
+  ${error ? `<div class="error">${escapeHtml(error)}</div>` : ''}
+  <form method="POST" action="${escapeHtml(action)}">
+    <input type="hidden" name="_csrf" value="${escapeHtml(csrfToken)}" />${requestFields(params)}
+    <input type="text" name="otp" placeholder="6-digit code" inputmode="numeric" autocomplete="one-time-code" required />
+    <button type="submit">Verify</button>
+  </form>
+</body>
+</html>
+`
+
+// HTML account chooser with CSRF token (prompt=select_account)
+const accountChooser = (params, users, action, anotherAccountUrl, csrfToken) => `
+<!DOCTYPE html>
+${pageHead(params, 'Choose an Account')}
+    button { width: 100%; padding: 10px; margin: 4px 0; background: #fff; border: 1px solid #ccc; cursor: pointer; text-align: left; }
+    button:hover { background: #f0f0f0; }
+    .email { color: #666; font-size: 12px; }
+  </style>
+</head>
+<body>
+  <h2>Choose an Account</h2>
+  <form method="POST" action="${escapeHtml(action)}">
+    <input type="hidden" name="_csrf" value="${escapeHtml(csrfToken)}" />${requestFields(params)}
+    ${users.map(u => `<button type="submit" name="account" value="${escapeHtml(u.id)}">${escapeHtml(u.name || u.username)}${u.email ? ` <span class="email">${escapeHtml(u.email)}</span>` : ''}</button>`).join('\n    ')}
+  </form>
+  <p><a href="${escapeHtml(anotherAccountUrl)}">Use another account</a></p>
+</body>
+</html>
+`
+
+// HTML consent form with CSRF token
+const consentForm = (params, client, action, csrfToken) => `
+<!DOCTYPE html>
+${pageHead(params, 'Authorize Application')}
+    button { width: 48%; padding: 10px; border: none; cursor: pointer; }
+    .allow { background: #007bff; color: white; }
+    .deny { background: #eee; }
+  </style>
+</head>
+<body>
+  <h2>Authorize ${escapeHtml(client.client_name || client.client_id)}</h2>
+  <p>This application is requesting access to:</p>
+  <ul>
+    ${splitScope(params.scope).map(s => `<li>${scopeLabel(s)}</li>`).join('\n    ') || '<li>Basic access</li>'}
+  </ul>
+  <form method="POST" action="${escapeHtml(action)}">
+    <input type="hidden" name="_csrf" value="${escapeHtml(csrfToken)}" />${requestFields(params)}
+    <button type="submit" name="decision" value="allow" class="allow">Allow</button>
+    <button type="submit" name="decision" value="deny" class="deny">Deny</button>
+  </form>
+</body>
+</html>
+`
+
+// HTML error page for requests that cannot be redirected back to the client
+const DEFAULT_ERROR_PAGE = `
+<!DOCTYPE html>
+<html>
+<head>
+  <title>Authorization Error</title>
+  <style>
+    body { font-family: sans-serif; max-width: 400px; margin: 50px auto; padding: 20px; }
+    .error { color: red; margin-bottom: 10px; }
+    code { background: #eee; padding: 2px 4px; }
+  </style>
+</head>
+<body>
+  <h2>Authorization Error</h2>
+  <div class="error">{{error_description}}</div>
+  <p>Error code: <code>{{error}}</code></p>
+  <p>Return to the application and try again.</p>
+</body>
+</html>
+`
+
+// offline_access is spelled out: it lets the app act while the user is away
+function scopeLabel (scope) {
+  if (scope === 'offline_access' && config.features.offlineAccess) {
+    return '<strong>Offline access</strong>: keep access to your data when you are not signed in'
+  }
+  return escapeHtml(scope)
+}
+
+function splitScope (scope) {
+  return (scope || '').split(' ').filter(s => s)
+}
+
+function parsePrompt (prompt) {
+  return (prompt || '').split(' ').filter(p => p)
+}
+
+// Unrecognized display values fall back to the page layout rather than
+// failing the request
+function parseDisplay (value) {
+  return DISPLAY_VALUES.includes(value) ? value : undefined
+}
+
+// login_hint is untrusted: only a trimmed string of sane length is kept, and
+// it is never looked up, so the login page looks the same for any account
+const MAX_LOGIN_HINT_LENGTH = 254
+
+function parseLoginHint (value) {
+  if (typeof value !== 'string') {
+    return undefined
+  }
+  const hint = value.trim()
+  if (!hint || hint.length > MAX_LOGIN_HINT_LENGTH) {
+    return undefined
+  }
+  return hint
+}
+
+// Whether the signed-in user is the account named by login_hint (username or email)
+async function sessionMatchesHint (userId, hint) {
+  if (!hint) {
+    return true
+  }
+  const user = await getUserById(userId)
+  if (!user) {
+    return false
+  }
+  const wanted = hint.toLowerCase()
+  return user.username.toLowerCase() === wanted || (!!user.email && user.email.toLowerCase() === wanted)
+}
+
+// Users of the accounts signed in within this browser session, active one first
+async function signedInUsers (session) {
+  const users = []
+  for (const { userId } of sessionAccounts(session)) {
+    const user = await getUserById(userId)
+    if (user) {
+      users.push(user)
+    }
+  }
+  return users
+}
+
+// Authorization request parameters to carry through login/consent
+function pickParams (source) {
+  const { client_id, redirect_uri, response_mode, state, nonce, prompt, acr_values } = source
+  const scope = normalizeScope(source.scope)
+  const login_hint = parseLoginHint(source.login_hint)
+  const display = parseDisplay(source.display)
+  let { authorization_details, claims } = source
+  // JSON bodies may carry the array itself; forms and queries carry a string
+  if (authorization_details !== undefined && typeof authorization_details !== 'string') {
+    authorization_details = JSON.stringify(authorization_details)
+  }
+  if (claims !== undefined && typeof claims !== 'string') {
+    claims = JSON.stringify(claims)
+  }
+  return { client_id, redirect_uri, response_mode, scope, state, nonce, prompt, display, login_hint, acr_values, authorization_details, claims }
+}
+
+// Authorization request parameters this server recognizes (RFC 6749 4.1.1,
+// OIDC Core 3.1.2.1, RFC 7636, RFC 8707, RFC 9396)
+const AUTHORIZATION_PARAMETERS = [
+  'client_id', 'redirect_uri', 'response_type', 'response_mode', 'scope', 'state', 'nonce',
+  'prompt', 'max_age', 'display', 'ui_locales', 'claims_locales', 'id_token_hint', 'login_hint',
+  'acr_values', 'claims', 'request', 'request_uri', 'code_challenge', 'code_challenge_method',
+  'resource', 'authorization_details'
+]
+
+// Parameters that may legitimately repeat (RFC 8707 2)
+const REPEATABLE_PARAMETERS = ['resource']
+
+// Bound the request size and reject parameter pollution before any other
+// processing. Unknown parameters are ignored and logged (OIDC Core 3.1.2.1)
+// unless strict mode rejects them.
+function checkRequestParameters (req, res, next) {
+  const { maxQueryLength, strictParameters } = config.authorizeRequest
+  const queryIndex = req.originalUrl.indexOf('?')
+  const queryLength = queryIndex === -1 ? 0 : req.originalUrl.length - queryIndex - 1
+  if (maxQueryLength > 0 && queryLength > maxQueryLength) {
+    return next(new OAuthError('invalid_request', `Authorization request exceeds ${maxQueryLength} characters`))
+  }
+
+  for (const [name, value] of Object.entries(req.query)) {
+    if (AUTHORIZATION_PARAMETERS.includes(name) && !REPEATABLE_PARAMETERS.includes(name) && typeof value !== 'string') {
+      return next(new OAuthError('invalid_request', `Parameter '${name}' must be a single value`))
+    }
+  }
+
+  const unknown = Object.keys(req.query).filter(name => !AUTHORIZATION_PARAMETERS.includes(name))
+  if (unknown.length > 0) {
+    logSecurityEvent({
+      type: 'AUTHORIZE_UNKNOWN_PARAMETERS',
+      client_id: typeof req.query.client_id === 'string' ? req.query.client_id : undefined,
+      parameters: unknown,
+      rejected: strictParameters
+    })
+    if (strictParameters) {
+      return next(new OAuthError('invalid_request', `Unrecognized parameter: ${unknown[0]}`))
+    }
+  }
+
+  next()
+}
+
+// Methods the session authenticated with; sessions from before amr was
+// recorded were all password logins
+function sessionAmr (session) {
+  return session.amr || ['pwd']
+}
+
+// Session is fresh enough unless max_age (seconds) has elapsed since login (OIDC Core 3.1.2.1)
+function isSessionFresh (session, maxAge) {
+  if (maxAge === undefined || maxAge === '') {
+    return true
+  }
+  const seconds = parseInt(maxAge, 10)
+  if (Number.isNaN(seconds) || !session.authTime) {
+    return false
+  }
+  return (Date.now() - session.authTime) / 1000 <= seconds
+}
+
+// Whether the user's stored consent covers all requested scopes. A revoked
+// consent forces the consent screen even when consent is not otherwise required,
+// and so does offline access until the user has explicitly granted it.
+async function hasConsent (userId, clientId, scope) {
+  const consent = await getConsent(userId, clientId)
+  if (consent && consent.revokedAt) {
+    return false
+  }
+  const scopes = splitScope(scope)
+  if (config.features.offlineAccess && scopes.includes('offline_access') &&
+      !(consent && consent.scopes.includes('offline_access'))) {
+    return false
+  }
+  if (!config.consent.required) {
+    return true
+  }
+  return !!consent && scopes.every(s => consent.scopes.includes(s))
+}
+
+// Whether to show the consent screen. Trusted (first-party) clients registered
+// with skip_consent get an audited auto-grant instead, unless the request
+// forces consent or the user revoked their earlier consent.
+async function needsConsent (req, params, userId, client) {
+  if (parsePrompt(params.prompt).includes('consent')) {
+    return true
+  }
+  if (client.skip_consent) {
+    const consent = await getConsent(userId, client.client_id)
+    if (!(consent && consent.revokedAt)) {
+      logSecurityEvent({ type: 'CONSENT_AUTO_GRANTED', userId, client_id: client.client_id, scope: params.scope || '', ip: getClientIp(req) })
+      return false
+    }
+  }
+  return !(await hasConsent(userId, client.client_id, params.scope))
+}
+
+// Response modes for the authorization response (OAuth 2.0 Multiple Response
+// Type Encoding Practices, OAuth 2.0 Form Post Response Mode)
+const RESPONSE_MODES = ['query', 'fragment', 'form_post']
+
+// Auto-submitting form that posts the response to the client. The page gets
+// its own CSP so the inline script runs and the form may leave this origin.
+function sendFormPost (res, redirectUri, response) {
+  const nonce = crypto.randomBytes(16).toString('base64')
+  const inputs = Object.entries(response)
+    .map(([name, value]) => `<input type="hidden" name="${escapeHtml(name)}" value="${escapeHtml(value)}" />`)
+    .join('\n    ')
+  res.set('Cache-Control', 'no-store')
+  res.set('Content-Security-Policy', `default-src 'none'; script-src 'nonce-${nonce}'; form-action ${new URL(redirectUri).origin}`)
+  res.send(`<!DOCTYPE html>
+<html>
+<head><title>Submit This Form</title></head>
+<body>
+  <form method="POST" action="${escapeHtml(redirectUri)}">
+    ${inputs}
+    <noscript><button type="submit">Continue</button></noscript>
+  </form>
+  <script nonce="${nonce}">document.forms[0].submit()</script>
+</body>
+</html>
+`)
+}
+
+// Return the authorization response to the client in the requested response
+// mode. iss names this server so a client using several can detect mix-up
+// attacks (RFC 9207).
+function sendAuthorizationResponse (res, params, fields) {
+  const response = { ...fields }
+  if (params.state) {
+    response.state = params.state
+  }
+  response.iss = config.issuer
+
+  if (params.response_mode === 'form_post') {
+    return sendFormPost(res, params.redirect_uri, response)
+  }
+
+  const redirectUrl = new URL(params.redirect_uri)
+  if (params.response_mode === 'fragment') {
+    redirectUrl.hash = new URLSearchParams(response).toString()
+  } else {
+    for (const [name, value] of Object.entries(response)) {
+      redirectUrl.searchParams.set(name, value)
+    }
+  }
+  res.redirect(redirectUrl.toString())
+}
+
+// Response types that return tokens from the authorization endpoint (the
+// implicit and hybrid flows). They are not implemented: tokens in the front
+// channel leak through history, referrers and logs (RFC 9700 2.1.2), and
+// every client here is confidential and can redeem a code.
+const IMPLICIT_RESPONSE_TYPES = ['token', 'id_token']
+
+function isImplicitResponseType (responseType) {
+  return typeof responseType === 'string' && responseType.split(' ').some(t => IMPLICIT_RESPONSE_TYPES.includes(t))
+}
+
+// Return an error to the client (RFC 6749 4.1.2.1)
+function redirectWithError (res, params, error, description) {
+  sendAuthorizationResponse(res, params, { error, error_description: description })
+}
+
+// Standard OIDC scopes every client may request, registered or not
+const STANDARD_SCOPES = ['openid', 'profile', 'email', 'offline_access']
+
+// Why a requested scope cannot be granted to the client: over the caps, not
+// registered (when the client registered scopes), reserved for
+// client_credentials, or admin for a client that is not allow-listed
+function requestedScopeError (scope, client) {
+  if (scope !== undefined && typeof scope !== 'string') {
+    return "Parameter 'scope' must be a string"
+  }
+  const limitError = scopeLimitError(scope)
+  if (limitError) {
+    return limitError
+  }
+  if (scope && client.scope && client.scope.trim()) {
+    const allowedScopes = client.scope.split(' ').filter(s => s)
+    const unregistered = splitScope(scope).find(s => !STANDARD_SCOPES.includes(s) && !allowedScopes.includes(s))
+    if (unregistered) {
+      return `Scope '${unregistered}' not registered for this client`
+    }
+  }
+  const machineOnly = findMachineOnlyScopes(scope)
+  if (machineOnly.length > 0) {
+    return `Scope '${machineOnly[0]}' is only available for client_credentials`
+  }
+  return adminScopeError(scope, client)
+}
+
+// Generate an authorization code and redirect back to the client. The
+// scope is checked again here: the consent, step-up, account and signup
+// forms carry it in a hidden field the browser can change.
+async function issueCode (req, res, params, userId, client) {
+  const scopeProblem = requestedScopeError(params.scope, client)
+  if (scopeProblem) {
+    return redirectWithError(res, params, 'invalid_scope', scopeProblem)
+  }
+
+  const authorizationDetails = parseAuthorizationDetails(params.authorization_details, client)
+
+  // Essential userinfo claims must be deliverable, or the flow fails here
+  // rather than the claim going missing from userinfo (OIDC Core 5.5.1)
+  const user = await getUserById(userId)
+  const unavailable = unavailableEssentialClaims(parseClaimsRequest(params.claims), user, params.scope, client.client_id)
+  if (unavailable.length > 0) {
+    return redirectWithError(res, params, 'invalid_request', `Essential claim '${unavailable[0]}' cannot be provided`)
+  }
+
+  // The nonce must come from a request made in this browser session, and
+  // only one code may carry it
+  if (params.nonce) {
+    const problem = consumeNonce(req.session, client.client_id, params.nonce)
+    if (problem) {
+      logSecurityEvent({ type: 'NONCE_REJECTED', userId, client_id: client.client_id, reason: problem, ip: getClientIp(req) })
+      return redirectWithError(res, params, 'invalid_request', problem === 'replayed'
+        ? 'nonce has already been used'
+        : 'nonce does not belong to an authorization request of this session')
+    }
+  }
+
+  const code = generateCode('authorization_code')
+  const expiresAt = Date.now() + (10 * 60 * 1000) // 10 minutes
+
+  // Record the grant so the user can review and revoke it later
+  await saveConsent(userId, client.client_id, splitScope(params.scope))
+
+  await addCode({
+    code,
+    client_id: params.client_id,
+    redirect_uri: params.redirect_uri,
+    scope: params.scope || '',
+    userId,
+    nonce: params.nonce || null,
+    authTime: req.session.authTime || null,
+    amr: sessionAmr(req.session),
+    acr: acrForAmr(sessionAmr(req.session)),
+    authorization_details: authorizationDetails,
+    sessionRef: sessionRef(req.sessionID),
+    expiresAt
+  })
+
+  // Return the code to the client
+  sendAuthorizationResponse(res, params, { code })
+}
+
+// Finish the authorization of a signed-in user: ask for consent when forced,
+// or when the client isn't trusted and the stored consent doesn't cover the
+// request; issue the code otherwise
+async function continueAuthorization (req, res, params, userId, client) {
+  if (await needsConsent(req, params, userId, client)) {
+    return res.send(consentForm(params, client, `${req.baseUrl}/consent`, req.csrfToken()))
+  }
+  await issueCode(req, res, params, userId, client)
+}
+
 // GET /authorize - Show login form or redirect with code
-router.get('/', csrfProtection, async (req, res, next) => {
-  const { client_id, redirect_uri, response_type, scope, state, nonce } = req.query
+router.get('/', checkRequestParameters, csrfProtection, async (req, res, next) => {
+  const { client_id, redirect_uri, response_type, response_mode, max_age } = req.query
+  const params = pickParams(req.query)
+  const { scope } = params
 
   // Validate required parameters (RFC 6749 4.1.1, OIDC Core 3.1.2.1)
   if (!client_id) {
@@ -54,64 +559,113 @@ router.get('/', csrfProtection, async (req, res, next) => {
     return next(new OAuthError('invalid_request', 'Missing redirect_uri parameter'))
   }
   if (response_type !== 'code') {
-    return next(new OAuthError('unsupported_response_type', 'Only response_type=code is supported'))
+    return next(new OAuthError('unsupported_response_type', isImplicitResponseType(response_type)
+      ? 'The implicit flow is not supported; use response_type=code'
+      : 'Only response_type=code is supported'))
+  }
+  if (!grantTypeEnabled('authorization_code')) {
+    return next(new OAuthError('unsupported_response_type', 'The authorization code grant is disabled'))
+  }
+  if (response_mode && !RESPONSE_MODES.includes(response_mode)) {
+    return next(new OAuthError('invalid_request', `Unsupported response_mode: ${response_mode}`))
   }
 
   try {
     // Validate client
     const client = await getClient(client_id)
-    if (!client) {
+    if (!client || !isClientActive(client)) {
       return next(new OAuthError('unauthorized_client', 'Invalid client_id'))
     }
 
     // Validate redirect_uri
-    if (!client.redirect_uris.includes(redirect_uri)) {
+    if (!isRedirectUriAllowed(client, redirect_uri)) {
       return next(new OAuthError('invalid_request', 'Invalid redirect_uri'))
     }
 
-    // Validate scope - check if requested scopes are allowed by client registration
-    // Only validate if client has specific scopes registered
-    if (scope && client.scope && client.scope.trim()) {
-      const requestedScopes = scope.split(' ').filter(s => s)
-      const allowedScopes = client.scope.split(' ').filter(s => s)
-      // Allow standard OIDC scopes even if not in client registration
-      const standardScopes = ['openid', 'profile', 'email', 'offline_access']
+    const scopeProblem = requestedScopeError(scope, client)
+    if (scopeProblem) {
+      return next(new OAuthError('invalid_scope', scopeProblem))
+    }
+
+    // Validate authorization_details against the client's registered types (RFC 9396 5)
+    try {
+      parseAuthorizationDetails(params.authorization_details, client)
+    } catch (err) {
+      return redirectWithError(res, params, err.error, err.error_description)
+    }
+
+    // The claims parameter must be well-formed (OIDC Core 5.5)
+    try {
+      parseClaimsRequest(params.claims)
+    } catch (err) {
+      return redirectWithError(res, params, err.error, err.error_description)
+    }
 
-      for (const requestedScope of requestedScopes) {
-        if (!standardScopes.includes(requestedScope) && !allowedScopes.includes(requestedScope)) {
-          return next(new OAuthError('invalid_scope', `Scope '${requestedScope}' not registered for this client`))
-        }
+    // prompt=none must not be combined with other values (OIDC Core 3.1.2.1)
+    const prompt = parsePrompt(params.prompt)
+    const unsupported = prompt.find(p => !PROMPT_VALUES.includes(p))
+    if (unsupported) {
+      return redirectWithError(res, params, 'invalid_request', `Unsupported prompt value: ${unsupported}`)
+    }
+    if (prompt.includes('none') && prompt.length > 1) {
+      return redirectWithError(res, params, 'invalid_request', 'prompt=none cannot be combined with other values')
+    }
+
+    // Bind the nonce to this browser session until the code carrying it is
+    // issued; one already used here is a replay (OIDC Core 15.5.2)
+    if (params.nonce && !bindNonce(req.session, client.client_id, params.nonce)) {
+      return redirectWithError(res, params, 'invalid_request', 'nonce has already been used')
+    }
+
+    // prompt=create sends the user to account registration first
+    if (prompt.includes('create')) {
+      return res.send(registrationForm(params, null, `${req.baseUrl}/register`, req.csrfToken()))
+    }
+
+    // prompt=select_account lets the user pick among the accounts signed in
+    // in this browser, or sign in with another one
+    if (prompt.includes('select_account') && !prompt.includes('login')) {
+      const users = await signedInUsers(req.session)
+      if (users.length > 0) {
+        const query = new URLSearchParams(req.originalUrl.split('?')[1])
+        query.set('prompt', 'login')
+        return res.send(accountChooser(params, users, `${req.baseUrl}/select-account`, `${req.baseUrl}?${query}`, req.csrfToken()))
       }
     }
 
-    // Check if user is authenticated
-    if (!req.session.userId) {
+    // Check if user is authenticated with a session fresh enough for max_age,
+    // for the account named by login_hint when one is given
+    const authenticated = req.session.userId &&
+      !prompt.includes('login') &&
+      isSessionFresh(req.session, max_age) &&
+      await sessionMatchesHint(req.session.userId, params.login_hint)
+
+    if (!authenticated) {
+      if (prompt.includes('none')) {
+        return redirectWithError(res, params, 'login_required', 'User authentication is required')
+      }
       // Show login form with CSRF token
-      return res.send(loginForm(client_id, redirect_uri, scope, state, nonce, null, req.csrfToken()))
+      return res.send(loginForm(params, null, req.csrfToken()))
     }
 
-    // User is authenticated, generate authorization code
-    const code = generateRandomToken()
-    const expiresAt = Date.now() + (10 * 60 * 1000) // 10 minutes
-
-    await addCode({
-      code,
-      client_id,
-      redirect_uri,
-      scope: scope || '',
-      userId: req.session.userId,
-      nonce: nonce || null,
-      expiresAt
-    })
+    // A stronger acr than the session provides: ask only for the missing factor
+    const user = await getUserById(req.session.userId)
+    if (missingFactors(sessionAmr(req.session), params.acr_values, user).length > 0) {
+      if (prompt.includes('none')) {
+        return redirectWithError(res, params, 'interaction_required', 'Additional authentication is required')
+      }
+      return res.send(otpForm(params, null, `${req.baseUrl}/step-up`, req.csrfToken()))
+    }
 
-    // Redirect back to client with code
-    const redirectUrl = new URL(redirect_uri)
-    redirectUrl.searchParams.set('code', code)
-    if (state) {
-      redirectUrl.searchParams.set('state', state)
+    // Silent fast-path: valid session and consent already covers the requested scopes
+    if (await needsConsent(req, params, req.session.userId, client)) {
+      if (prompt.includes('none')) {
+        return redirectWithError(res, params, 'consent_required', 'User consent is required')
+      }
+      return res.send(consentForm(params, client, `${req.baseUrl}/consent`, req.csrfToken()))
     }
 
-    res.redirect(redirectUrl.toString())
+    await issueCode(req, res, params, req.session.userId, client)
   } catch (err) {
     next(err)
   }
@@ -119,86 +673,265 @@ router.get('/', csrfProtection, async (req, res, next) => {
 
 // POST /authorize - Process login
 router.post('/', csrfProtection, async (req, res, next) => {
-  const { username, password, client_id, redirect_uri, scope, state, nonce } = req.body
+  const { username, password, client_id, redirect_uri } = req.body
+  const params = pickParams(req.body)
+  const { scope } = params
 
   try {
     // Validate input
     if (!username || !password) {
-      return res.send(loginForm(client_id, redirect_uri, scope, state, nonce, 'Username and password are required', req.csrfToken()))
+      return res.send(loginForm(params, 'Username and password are required', req.csrfToken()))
     }
 
     // Validate client
     const client = await getClient(client_id)
-    if (!client) {
+    if (!client || !isClientActive(client)) {
       return next(new OAuthError('unauthorized_client', 'Invalid client_id'))
     }
 
     // Validate redirect_uri
-    if (!client.redirect_uris.includes(redirect_uri)) {
+    if (!isRedirectUriAllowed(client, redirect_uri)) {
       return next(new OAuthError('invalid_request', 'Invalid redirect_uri'))
     }
 
-    // Validate scope - check if requested scopes are allowed by client registration
-    // Only validate if client has specific scopes registered
-    if (scope && client.scope && client.scope.trim()) {
-      const requestedScopes = scope.split(' ').filter(s => s)
-      const allowedScopes = client.scope.split(' ').filter(s => s)
-      // Allow standard OIDC scopes even if not in client registration
-      const standardScopes = ['openid', 'profile', 'email', 'offline_access']
+    // Bound the normalized scope before looking at each entry
+    const limitError = scopeLimitError(scope)
+    if (limitError) {
+      return next(new OAuthError('invalid_scope', limitError))
+    }
 
-      for (const requestedScope of requestedScopes) {
-        if (!standardScopes.includes(requestedScope) && !allowedScopes.includes(requestedScope)) {
-          return res.send(loginForm(client_id, redirect_uri, scope, state, nonce, `Scope '${requestedScope}' not registered for this client`, req.csrfToken()))
-        }
-      }
+    const scopeProblem = requestedScopeError(scope, client)
+    if (scopeProblem) {
+      return res.send(loginForm(params, scopeProblem, req.csrfToken()))
     }
 
-    // Authenticate user
+    // Authenticate user, asking for a challenge after repeated failures
     const user = await getUser(username)
-    if (!user || !(await verifyPassword(password, user.password))) {
+    if (loginNeedsChallenge(user) && !(await verifyChallenge(req, 'login'))) {
+      return res.send(loginForm(params, 'Please complete the challenge', req.csrfToken()))
+    }
+    if (!user || !(await verifyUserPassword(user, password))) {
       // Record failed login attempt for rate limiting
       if (user) {
         await recordFailedLogin(user.id)
       }
-      return res.send(loginForm(client_id, redirect_uri, scope, state, nonce, 'Invalid username or password', req.csrfToken()))
+      logSecurityEvent({ type: 'LOGIN_FAILED', username, client_id, ip: getClientIp(req), reason: 'invalid_credentials' })
+      return res.send(loginForm(params, 'Invalid username or password', req.csrfToken()))
     }
 
     // Check if user account is locked
     if (user.lockedUntil && user.lockedUntil > Date.now()) {
-      return res.send(loginForm(client_id, redirect_uri, scope, state, nonce, 'Account temporarily locked. Please try again later.', req.csrfToken()))
+      logSecurityEvent({ type: 'LOGIN_FAILED', username, client_id, ip: getClientIp(req), reason: 'locked' })
+      return res.send(loginForm(params, 'Account temporarily locked. Please try again later.', req.csrfToken()))
     }
 
-    // Set session
-    req.session.userId = user.id
+    // Set session (subject to the per-user session limit)
+    if (!(await startUserSession(req, user.id))) {
+      return res.send(loginForm(params, 'Too many active sessions. Sign out elsewhere and try again.', req.csrfToken()))
+    }
 
     // Clear failed login attempts on successful login
     await clearFailedLoginAttempts(user.id)
+    logSecurityEvent({ type: 'LOGIN_SUCCEEDED', userId: user.id, client_id, ip: getClientIp(req) })
 
-    // Generate authorization code
-    const code = generateRandomToken()
-    const expiresAt = Date.now() + (10 * 60 * 1000) // 10 minutes
-
-    await addCode({
-      code,
-      client_id,
-      redirect_uri,
-      scope: scope || '',
-      userId: user.id,
-      nonce: nonce || null,
-      expiresAt
-    })
+    // The requested acr may need a second factor on top of the password
+    if (missingFactors(sessionAmr(req.session), params.acr_values, user).length > 0) {
+      return res.send(otpForm(params, null, `${req.baseUrl}/step-up`, req.csrfToken()))
+    }
+
+    await continueAuthorization(req, res, params, user.id, client)
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /authorize/step-up - Complete the second factor of a signed-in session,
+// then resume the authorization request
+router.post('/step-up', csrfProtection, async (req, res, next) => {
+  const { otp, client_id, redirect_uri } = req.body
+  const params = pickParams(req.body)
+  const action = `${req.baseUrl}/step-up`
+
+  try {
+    if (!req.session.userId) {
+      return next(new OAuthError('invalid_request', 'User is not authenticated'))
+    }
+
+    // Validate client
+    const client = await getClient(client_id)
+    if (!client || !isClientActive(client)) {
+      return next(new OAuthError('unauthorized_client', 'Invalid client_id'))
+    }
+
+    // Validate redirect_uri
+    if (!isRedirectUriAllowed(client, redirect_uri)) {
+      return next(new OAuthError('invalid_request', 'Invalid redirect_uri'))
+    }
+
+    const user = await getUserById(req.session.userId)
+    if (!user || !user.totpSecret) {
+      return next(new OAuthError('invalid_request', 'No second factor is enrolled'))
+    }
+
+    if (user.lockedUntil && user.lockedUntil > Date.now()) {
+      return res.send(otpForm(params, 'Account temporarily locked. Please try again later.', action, req.csrfToken()))
+    }
+
+    // Wrong codes count toward the same lockout as wrong passwords
+    if (!verifyTotp(user.totpSecret, otp)) {
+      await recordFailedLogin(user.id)
+      logSecurityEvent({ type: 'STEP_UP_FAILED', userId: user.id, client_id, ip: getClientIp(req) })
+      return res.send(otpForm(params, 'Invalid code', action, req.csrfToken()))
+    }
+
+    // Keep the session; add the factor and restart auth_time (OIDC Core 2)
+    req.session.amr = [...new Set([...sessionAmr(req.session), 'otp'])]
+    req.session.authTime = Date.now()
+    await clearFailedLoginAttempts(user.id)
+    logSecurityEvent({ type: 'STEP_UP_SUCCEEDED', userId: user.id, client_id, ip: getClientIp(req), acr: acrForAmr(req.session.amr) })
+
+    await continueAuthorization(req, res, params, user.id, client)
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /authorize/select-account - Switch to the chosen account, then resume
+// the authorization request
+router.post('/select-account', csrfProtection, async (req, res, next) => {
+  const { account, client_id, redirect_uri } = req.body
+  const params = pickParams(req.body)
+
+  try {
+    // Validate client
+    const client = await getClient(client_id)
+    if (!client || !isClientActive(client)) {
+      return next(new OAuthError('unauthorized_client', 'Invalid client_id'))
+    }
 
-    // Redirect back to client with code
-    const redirectUrl = new URL(redirect_uri)
-    redirectUrl.searchParams.set('code', code)
-    if (state) {
-      redirectUrl.searchParams.set('state', state)
+    // Validate redirect_uri
+    if (!isRedirectUriAllowed(client, redirect_uri)) {
+      return next(new OAuthError('invalid_request', 'Invalid redirect_uri'))
     }
 
-    res.redirect(redirectUrl.toString())
+    // Only accounts signed in within this browser session can be chosen
+    if (typeof account !== 'string' || !switchAccount(req.session, account)) {
+      return next(new OAuthError('invalid_request', 'The chosen account is not signed in'))
+    }
+    const user = await getUserById(account)
+    if (!user) {
+      return next(new OAuthError('invalid_request', 'The chosen account is not signed in'))
+    }
+    logSecurityEvent({ type: 'ACCOUNT_SELECTED', userId: user.id, client_id, ip: getClientIp(req) })
+
+    // The chosen account may not have the factors the requested acr needs yet
+    if (missingFactors(sessionAmr(req.session), params.acr_values, user).length > 0) {
+      return res.send(otpForm(params, null, `${req.baseUrl}/step-up`, req.csrfToken()))
+    }
+
+    await continueAuthorization(req, res, params, user.id, client)
   } catch (err) {
     next(err)
   }
 })
 
+// POST /authorize/register - Create an account, then resume the authorization request
+router.post('/register', csrfProtection, async (req, res, next) => {
+  const { username, email, password, name, client_id, redirect_uri } = req.body
+  const params = pickParams(req.body)
+  const action = `${req.baseUrl}/register`
+
+  try {
+    // Validate client
+    const client = await getClient(client_id)
+    if (!client || !isClientActive(client)) {
+      return next(new OAuthError('unauthorized_client', 'Invalid client_id'))
+    }
+
+    // Validate redirect_uri
+    if (!isRedirectUriAllowed(client, redirect_uri)) {
+      return next(new OAuthError('invalid_request', 'Invalid redirect_uri'))
+    }
+
+    if (!username || !email || !password) {
+      return res.send(registrationForm(params, 'Username, email and password are required', action, req.csrfToken()))
+    }
+
+    if (config.challenge.onRegistration && !(await verifyChallenge(req, 'register'))) {
+      return res.send(registrationForm(params, 'Please complete the challenge', action, req.csrfToken()))
+    }
+
+    let user
+    try {
+      user = await createUser({ username, email, password, name })
+    } catch (err) {
+      return res.send(registrationForm(params, err.error_description || err.message, action, req.csrfToken()))
+    }
+
+    // Sign the new user in; the account exists even if the session cap refuses it
+    if (!(await startUserSession(req, user.id))) {
+      return res.send(loginForm(params, 'Too many active sessions. Sign out elsewhere and try again.', req.csrfToken()))
+    }
+
+    await continueAuthorization(req, res, params, user.id, client)
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /authorize/consent - Record the user's consent decision
+router.post('/consent', csrfProtection, async (req, res, next) => {
+  const { client_id, redirect_uri, decision } = req.body
+  const params = pickParams(req.body)
+
+  try {
+    if (!req.session.userId) {
+      return next(new OAuthError('invalid_request', 'User is not authenticated'))
+    }
+
+    // Validate client
+    const client = await getClient(client_id)
+    if (!client || !isClientActive(client)) {
+      return next(new OAuthError('unauthorized_client', 'Invalid client_id'))
+    }
+
+    // Validate redirect_uri
+    if (!isRedirectUriAllowed(client, redirect_uri)) {
+      return next(new OAuthError('invalid_request', 'Invalid redirect_uri'))
+    }
+
+    if (decision !== 'allow') {
+      return redirectWithError(res, params, 'access_denied', 'The user denied the request')
+    }
+
+    // issueCode records the consent once the scope has been checked
+    await issueCode(req, res, params, req.session.userId, client)
+  } catch (err) {
+    next(err)
+  }
+})
+
+// Fill an error page template; the values may echo request parameters
+async function renderErrorPage (err) {
+  const template = config.authorizeRequest.errorPageTemplate
+    ? await fs.readFile(config.authorizeRequest.errorPageTemplate, 'utf8')
+    : DEFAULT_ERROR_PAGE
+  const values = { error: err.error, error_description: err.error_description }
+  return template.replace(/\{\{(error|error_description)\}\}/g, (match, name) => escapeHtml(values[name] || ''))
+}
+
+// Errors that cannot be redirected to the client (RFC 6749 4.1.2.1) are shown
+// to browsers as a page; API clients get the JSON error from errorHandler
+router.use(async (err, req, res, next) => {
+  if (!(err instanceof OAuthError) || req.accepts(['json', 'html']) !== 'html') {
+    return next(err)
+  }
+  try {
+    res.status(err.statusCode).type('html').send(await renderErrorPage(err))
+  } catch (renderErr) {
+    console.error('Cannot render authorization error page:', renderErr.message)
+    next(err)
+  }
+})
+
 module.exports = router
@@ -0,0 +1,238 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Device Authorization Grant (RFC 8628)
+ *
+ * POST /device/code starts a grant for an input-constrained device; the user
+ * then enters the user code at GET /device, signs in and approves. The
+ * device polls the token endpoint with the device code meanwhile.
+ */
+
+const express = require('express')
+const csrf = require('csurf')
+const config = require('../config')
+const { getClient, getUser, addDeviceCode, getDeviceCodeByUserCode, getDeviceCodeById, updateDeviceCode, recordFailedLogin, clearFailedLoginAttempts } = require('../db')
+const { generateRandomToken, generateCode } = require('../tokens')
+const { OAuthError } = require('../errors')
+const { getClientCredentials, matchClientSecret } = require('../clients')
+const { verifyUserPassword } = require('../users')
+const { startUserSession, sessionRef } = require('../sessions')
+const { normalizeScope, scopeLimitError, findMachineOnlyScopes } = require('../scopes')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { getClientIp } = require('../middleware/clientIp')
+const { noStore } = require('../middleware/cacheControl')
+const { DEVICE_CODE_GRANT, generateUserCode, normalizeUserCode, countCodeEntry, refundCodeEntry } = require('../deviceFlow')
+const { grantTypeEnabled } = require('../grantTypes')
+const { escapeHtml } = require('../html')
+
+const router = express.Router()
+const csrfProtection = csrf({ cookie: false })
+
+const page = (title, body) => `
+<!DOCTYPE html>
+<html>
+<head>
+  <title>${title}</title>
+  <style>
+    body { font-family: sans-serif; max-width: 400px; margin: 50px auto; padding: 20px; }
+    input { width: 100%; padding: 8px; margin: 8px 0; box-sizing: border-box; }
+    button { width: 100%; padding: 10px; background: #007bff; color: white; border: none; cursor: pointer; }
+    .deny { background: #eee; color: black; margin-top: 8px; }
+    .error { color: red; margin-bottom: 10px; }
+  </style>
+</head>
+<body>
+  <h2>${title}</h2>
+${body}
+</body>
+</html>
+`
+
+// HTML user code form; signed-out users sign in on the same form
+const codeForm = (error, signedIn, userCode, action, csrfToken) => page('Connect a Device', `
+  <p>Enter the code shown on your device.</p>
+  ${error ? `<div class="error">${escapeHtml(error)}</div>` : ''}
+  <form method="POST" action="${action}">
+    <input type="hidden" name="_csrf" value="${csrfToken}" />
+    <input type="text" name="user_code" placeholder="XXXX-XXXX" value="${escapeHtml(userCode || '')}" autocomplete="off" autocapitalize="characters" required />
+    ${signedIn
+      ? ''
+      : `<input type="text" name="username" placeholder="Username" required />
+    <input type="password" name="password" placeholder="Password" required />`}
+    <button type="submit">Continue</button>
+  </form>`)
+
+// HTML approval page naming the client, so users notice a code that was
+// phished from another device (RFC 8628 5.4)
+const confirmForm = (client, scope, action, csrfToken) => page('Connect a Device', `
+  <p>Allow <strong>${escapeHtml(client.client_name || client.client_id)}</strong> on your device to access:</p>
+  <ul>
+    ${(scope ? scope.split(' ') : []).map(s => `<li>${escapeHtml(s)}</li>`).join('\n    ') || '<li>Basic access</li>'}
+  </ul>
+  <form method="POST" action="${action}">
+    <input type="hidden" name="_csrf" value="${csrfToken}" />
+    <button type="submit" name="decision" value="allow">Allow</button>
+    <button type="submit" name="decision" value="deny" class="deny">Deny</button>
+  </form>`)
+
+const donePage = (message) => page('Connect a Device', `  <p>${escapeHtml(message)}</p>`)
+
+// POST /device/code - Device authorization request (RFC 8628 3.1)
+router.post('/code', noStore, async (req, res, next) => {
+  try {
+    if (!grantTypeEnabled(DEVICE_CODE_GRANT)) {
+      return next(new OAuthError('unsupported_grant_type', 'The device code grant is disabled'))
+    }
+    const { client_id, client_secret } = getClientCredentials(req)
+    const scope = normalizeScope(req.body.scope)
+
+    for (const [name, value] of Object.entries({ client_id, client_secret, scope })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be a string`))
+      }
+    }
+    const limitError = scopeLimitError(scope)
+    if (limitError) {
+      return next(new OAuthError('invalid_scope', limitError))
+    }
+    if (!client_id || !client_secret) {
+      return next(new OAuthError('invalid_client', 'Missing client credentials'))
+    }
+
+    const client = await getClient(client_id)
+    if (!matchClientSecret(client, client_secret)) {
+      return next(new OAuthError('invalid_client', 'Invalid client credentials'))
+    }
+    if (!(client.grant_types || []).includes(DEVICE_CODE_GRANT)) {
+      return next(new OAuthError('unauthorized_client', 'The client is not registered for the device code grant'))
+    }
+
+    // Requested scopes must be registered for the client, as at /authorize
+    if (scope && client.scope && client.scope.trim()) {
+      const allowed = client.scope.split(' ').filter(s => s)
+      const unknown = scope.split(' ').find(s => !allowed.includes(s))
+      if (unknown) {
+        return next(new OAuthError('invalid_scope', `Scope '${unknown}' not registered for this client`))
+      }
+    }
+    // The device flow is interactive, so machine-only scopes are refused
+    const machineOnly = findMachineOnlyScopes(scope)
+    if (machineOnly.length > 0) {
+      return next(new OAuthError('invalid_scope', `Scope '${machineOnly[0]}' is only available for client_credentials`))
+    }
+
+    const { codeTTL, interval } = config.deviceFlow
+    const device_code = generateCode('device_code')
+    const user_code = generateUserCode()
+    await addDeviceCode({
+      id: generateRandomToken(16),
+      device_code,
+      user_code: normalizeUserCode(user_code),
+      client_id: client.client_id,
+      scope: scope || '',
+      status: 'pending',
+      interval,
+      expiresAt: Date.now() + codeTTL * 1000
+    })
+
+    const verification_uri = `${config.issuer}/device`
+    res.json({
+      device_code,
+      user_code,
+      verification_uri,
+      verification_uri_complete: `${verification_uri}?user_code=${user_code}`,
+      expires_in: codeTTL,
+      interval
+    })
+  } catch (err) {
+    next(err)
+  }
+})
+
+// GET /device - User code entry (verification_uri)
+router.get('/', csrfProtection, (req, res) => {
+  const userCode = typeof req.query.user_code === 'string' ? req.query.user_code : ''
+  res.send(codeForm(null, !!req.session.userId, userCode, req.baseUrl, req.csrfToken()))
+})
+
+// POST /device - Check the user code (counted against the lockout budget),
+// sign the user in if needed and ask for approval
+router.post('/', csrfProtection, async (req, res, next) => {
+  const { user_code, username, password } = req.body
+  const signedIn = !!req.session.userId
+
+  try {
+    if (!(await countCodeEntry(req))) {
+      logSecurityEvent({ type: 'DEVICE_CODE_LOCKED_OUT', ip: getClientIp(req) })
+      res.set('Retry-After', String(config.deviceFlow.lockoutSeconds))
+      return res.status(429).send(codeForm('Too many attempts. Please wait and try again later.', signedIn, '', req.baseUrl, req.csrfToken()))
+    }
+
+    const userCode = normalizeUserCode(user_code)
+    const grant = userCode && await getDeviceCodeByUserCode(userCode)
+    if (!grant || grant.status !== 'pending' || grant.expiresAt <= Date.now()) {
+      logSecurityEvent({ type: 'DEVICE_CODE_REJECTED', ip: getClientIp(req) })
+      return res.status(400).send(codeForm('Invalid or expired code', signedIn, '', req.baseUrl, req.csrfToken()))
+    }
+    await refundCodeEntry(req)
+
+    if (!signedIn) {
+      const user = typeof username === 'string' ? await getUser(username) : null
+      if (!user || typeof password !== 'string' || !(await verifyUserPassword(user, password))) {
+        if (user) {
+          await recordFailedLogin(user.id)
+        }
+        logSecurityEvent({ type: 'LOGIN_FAILED', username, client_id: grant.client_id, ip: getClientIp(req), reason: 'invalid_credentials' })
+        return res.send(codeForm('Invalid username or password', false, user_code, req.baseUrl, req.csrfToken()))
+      }
+      if (user.lockedUntil && user.lockedUntil > Date.now()) {
+        logSecurityEvent({ type: 'LOGIN_FAILED', username, client_id: grant.client_id, ip: getClientIp(req), reason: 'locked' })
+        return res.send(codeForm('Account temporarily locked. Please try again later.', false, user_code, req.baseUrl, req.csrfToken()))
+      }
+      if (!(await startUserSession(req, user.id))) {
+        return res.send(codeForm('Too many active sessions. Sign out elsewhere and try again.', false, user_code, req.baseUrl, req.csrfToken()))
+      }
+      await clearFailedLoginAttempts(user.id)
+      logSecurityEvent({ type: 'LOGIN_SUCCEEDED', userId: user.id, client_id: grant.client_id, ip: getClientIp(req) })
+    }
+
+    // The approval step acts on the grant found here, never on a new entry
+    req.session.deviceGrantId = grant.id
+    const client = await getClient(grant.client_id)
+    res.send(confirmForm(client || { client_id: grant.client_id }, grant.scope, `${req.baseUrl}/confirm`, req.csrfToken()))
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /device/confirm - Approve or deny the device
+router.post('/confirm', csrfProtection, async (req, res, next) => {
+  try {
+    const grantId = req.session.deviceGrantId
+    delete req.session.deviceGrantId
+    const grant = grantId && await getDeviceCodeById(grantId)
+    if (!req.session.userId || !grant || grant.status !== 'pending' || grant.expiresAt <= Date.now()) {
+      return res.status(400).send(codeForm('Invalid or expired code', !!req.session.userId, '', req.baseUrl, req.csrfToken()))
+    }
+
+    if (req.body.decision !== 'allow') {
+      await updateDeviceCode(grant.id, { status: 'denied' })
+      logSecurityEvent({ type: 'DEVICE_DENIED', userId: req.session.userId, client_id: grant.client_id, ip: getClientIp(req) })
+      return res.send(donePage('The device was not connected. You can close this window.'))
+    }
+
+    await updateDeviceCode(grant.id, {
+      status: 'approved',
+      userId: req.session.userId,
+      authTime: req.session.authTime || null,
+      amr: req.session.amr || ['pwd'],
+      sessionRef: sessionRef(req.sessionID)
+    })
+    logSecurityEvent({ type: 'DEVICE_AUTHORIZED', userId: req.session.userId, client_id: grant.client_id, ip: getClientIp(req) })
+    res.send(donePage('Your device is connected. You can close this window and return to it.'))
+  } catch (err) {
+    next(err)
+  }
+})
+
+module.exports = router
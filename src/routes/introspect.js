@@ -0,0 +1,105 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Token Introspection Endpoint (RFC 7662)
+ * Lets authenticated clients (resource servers) check whether an access
+ * token is active and read its claims
+ */
+
+const express = require('express')
+const config = require('../config')
+const { getClient, isTokenRevoked } = require('../db')
+const { verifyToken } = require('../tokens')
+const { OAuthError } = require('../errors')
+const { getClientCredentials, matchClientSecret } = require('../clients')
+const { isAudienceOf } = require('../audience')
+const { readTokenScope } = require('../scopes')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { introspectIpLimiter, introspectClientLimiter, inactiveIntrospectLimiter } = require('../middleware/rateLimit')
+const { noStore } = require('../middleware/cacheControl')
+
+const router = express.Router()
+
+// Introspection responses describe live tokens; never cache them
+router.use(noStore)
+
+// Only registered clients may introspect (RFC 7662 2.1)
+async function authenticateClient (req, res, next) {
+  try {
+    const { client_id, client_secret } = getClientCredentials(req)
+    if (!client_id || !client_secret) {
+      return next(new OAuthError('invalid_client', 'Missing client credentials', 401))
+    }
+    const client = await getClient(client_id)
+    if (!matchClientSecret(client, client_secret)) {
+      return next(new OAuthError('invalid_client', 'Invalid client credentials', 401))
+    }
+    req.client = client
+    next()
+  } catch (err) {
+    next(err)
+  }
+}
+
+// Claims of an active access token, or null when it is not active
+async function introspectToken (token) {
+  let decoded
+  try {
+    decoded = verifyToken(token)
+  } catch (err) {
+    return null
+  }
+  if (decoded.token_type && decoded.token_type !== 'access') {
+    return null
+  }
+  if (await isTokenRevoked(decoded)) {
+    return null
+  }
+  return decoded
+}
+
+router.post('/', introspectIpLimiter, authenticateClient, introspectClientLimiter, inactiveIntrospectLimiter, async (req, res, next) => {
+  try {
+    const { token } = req.body
+    if (!token || typeof token !== 'string') {
+      return next(new OAuthError('invalid_request', 'Missing token parameter'))
+    }
+
+    const claims = await introspectToken(token)
+    if (!claims) {
+      return res.json({ active: false })
+    }
+
+    // A token meant for another resource server is not active for this caller
+    if (config.introspection.audienceCheck && !isAudienceOf(claims.aud, req.client)) {
+      logSecurityEvent({
+        type: 'INTROSPECTION_AUDIENCE_MISMATCH',
+        client_id: req.client.client_id,
+        token_client_id: claims.client_id,
+        aud: claims.aud
+      })
+      return res.json({ active: false })
+    }
+
+    res.locals.tokenActive = true
+    res.json({
+      active: true,
+      scope: readTokenScope(claims),
+      client_id: claims.client_id,
+      username: claims.username,
+      token_type: claims.cnf ? 'DPoP' : 'Bearer',
+      exp: claims.exp,
+      iat: claims.iat,
+      nbf: claims.nbf,
+      sub: claims.sub,
+      aud: claims.aud,
+      iss: claims.iss,
+      jti: claims.jti,
+      cnf: claims.cnf
+    })
+  } catch (err) {
+    next(err)
+  }
+})
+
+module.exports = router
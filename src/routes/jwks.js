@@ -1,14 +1,32 @@
 const express = require('express')
-const { getPublicKeyJwk } = require('../tokens')
+const { getPublicKeyJwks, getClientJwks } = require('../tokens')
+const { getClient } = require('../db')
+const { OAuthError } = require('../errors')
+const { cacheFor } = require('../middleware/cacheControl')
 
 const router = express.Router()
 
-router.get('/jwks.json', (req, res) => {
-  const jwk = getPublicKeyJwk()
-
+router.get('/jwks.json', cacheFor('jwksMaxAge'), (req, res) => {
   res.json({
-    keys: [jwk]
+    keys: getPublicKeyJwks()
   })
 })
 
+// JWKS of a client's dedicated access token signing key, for tenants that
+// validate only tokens issued to their own clients
+router.get('/jwks/:clientId.json', cacheFor('jwksMaxAge'), async (req, res, next) => {
+  try {
+    const client = await getClient(req.params.clientId)
+    if (!client || !client.signing_key_id) {
+      return next(new OAuthError('not_found', 'The client has no dedicated signing key', 404))
+    }
+
+    res.json({
+      keys: await getClientJwks(client.signing_key_id)
+    })
+  } catch (err) {
+    next(err)
+  }
+})
+
 module.exports = router
@@ -0,0 +1,137 @@
+/* eslint camelcase: "off" */
+
+/**
+ * RP-Initiated Logout (OpenID Connect RP-Initiated Logout 1.0)
+ *
+ * Ends the user's login session and sends the browser back to the client's
+ * registered post_logout_redirect_uri. The id_token_hint names the client and
+ * the user; its signature and issuer are checked, but an expired hint is
+ * accepted, since the session it names may well have outlived it.
+ */
+
+const express = require('express')
+const config = require('../config')
+const { getClient } = require('../db')
+const { verifyIdTokenHint } = require('../tokens')
+const { subjectFor } = require('../pairwise')
+const { sessionAccounts } = require('../sessions')
+const { OAuthError } = require('../errors')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { getClientIp } = require('../middleware/clientIp')
+const { noStore } = require('../middleware/cacheControl')
+
+const router = express.Router()
+
+router.use(noStore)
+
+const SIGNED_OUT_PAGE = `
+<!DOCTYPE html>
+<html>
+<head>
+  <title>Signed Out</title>
+  <style>
+    body { font-family: sans-serif; max-width: 400px; margin: 50px auto; padding: 20px; }
+  </style>
+</head>
+<body>
+  <h2>Signed Out</h2>
+  <p>You have been signed out. You can close this window.</p>
+</body>
+</html>
+`
+
+// Issuers an ID token of this server may carry: the configured one, and the
+// one derived from the request as the token endpoint does
+function acceptedIssuers (req) {
+  return [...new Set([config.issuer, process.env.ISSUER || `http://${req.get('host')}${config.basePath}`])]
+}
+
+// The client the ID token was issued to (OIDC Core 2: azp when aud has several)
+function hintClientId (claims) {
+  if (Array.isArray(claims.aud)) {
+    return claims.azp || (claims.aud.length === 1 ? claims.aud[0] : null)
+  }
+  return claims.aud
+}
+
+function destroySession (req) {
+  return new Promise((resolve, reject) => {
+    req.session.destroy(err => (err ? reject(err) : resolve()))
+  })
+}
+
+async function logout (req, res, next) {
+  try {
+    const params = req.method === 'POST' ? req.body || {} : req.query
+    const { id_token_hint, client_id, post_logout_redirect_uri, state } = params
+    for (const [name, value] of Object.entries({ id_token_hint, client_id, post_logout_redirect_uri, state })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be a string`))
+      }
+    }
+
+    let hint = null
+    if (id_token_hint) {
+      try {
+        hint = verifyIdTokenHint(id_token_hint, acceptedIssuers(req))
+      } catch (err) {
+        logSecurityEvent({ type: 'LOGOUT_HINT_REJECTED', reason: err.message, ip: getClientIp(req) })
+        return next(new OAuthError('invalid_request', 'Invalid id_token_hint'))
+      }
+    }
+
+    // The hint and client_id, when both given, must name the same client
+    const clientId = hint ? hintClientId(hint) : client_id
+    if (hint && client_id && client_id !== clientId) {
+      return next(new OAuthError('invalid_request', 'client_id does not match the id_token_hint'))
+    }
+    const client = clientId ? await getClient(clientId) : null
+    if (clientId && !client) {
+      return next(new OAuthError('invalid_request', 'Unknown client'))
+    }
+
+    // Only a URI the client registered for logout, compared exactly
+    if (post_logout_redirect_uri) {
+      if (!client) {
+        return next(new OAuthError('invalid_request', 'post_logout_redirect_uri needs an id_token_hint or client_id'))
+      }
+      if (!(client.post_logout_redirect_uris || []).includes(post_logout_redirect_uri)) {
+        return next(new OAuthError('invalid_request', 'post_logout_redirect_uri is not registered for this client'))
+      }
+    }
+
+    // A hint for someone not signed in here must not end another user's session
+    const accounts = req.session ? sessionAccounts(req.session) : []
+    if (hint && accounts.length > 0 && !accounts.some(a => subjectFor(client, a.userId) === hint.sub)) {
+      return next(new OAuthError('invalid_request', 'id_token_hint does not belong to a user signed in here'))
+    }
+
+    if (accounts.length > 0) {
+      await destroySession(req)
+      logSecurityEvent({
+        type: 'USER_LOGGED_OUT',
+        userIds: accounts.map(a => a.userId),
+        client_id: clientId || null,
+        hint_expired: hint ? hint.exp * 1000 < Date.now() : null,
+        ip: getClientIp(req)
+      })
+    }
+
+    if (post_logout_redirect_uri) {
+      const target = new URL(post_logout_redirect_uri)
+      if (state) {
+        target.searchParams.set('state', state)
+      }
+      return res.redirect(target.toString())
+    }
+    res.type('html').send(SIGNED_OUT_PAGE)
+  } catch (err) {
+    next(err)
+  }
+}
+
+// Both methods are defined for the end_session_endpoint (RP-Initiated Logout 1.0 2)
+router.get('/', logout)
+router.post('/', logout)
+
+module.exports = router
@@ -1,14 +1,40 @@
 /* eslint camelcase: "off" */
 const express = require('express')
 const crypto = require('crypto')
-const { addClient } = require('../db')
+const config = require('../config')
+const { addClient, getClients } = require('../db')
 const { OAuthError } = require('../errors')
+const { REDIRECT_URI_MATCHING_POLICIES, isValidOrigin, findRedirectUriCollisions, generateClientId } = require('../clients')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { getSupportedAlgorithms } = require('../tokens')
+const { noStore } = require('../middleware/cacheControl')
+const { SUBJECT_TYPES, pairwiseSupported, resolveSectorIdentifier, sectorFromRedirectUris } = require('../pairwise')
+const { GRANT_TYPE_FEATURES, grantTypeEnabled } = require('../grantTypes')
+const { ADMIN_SCOPE, normalizeScope, expandScopes } = require('../scopes')
 
 const router = express.Router()
 
+// Registration responses carry the client secret; never cache them
+router.use(noStore)
+
+// Bounds for a client's id_token_lifetime in seconds
+const ID_TOKEN_LIFETIME_MIN = 60
+const ID_TOKEN_LIFETIME_MAX = 86400
+
+function isHttpUrl (value) {
+  if (typeof value !== 'string') {
+    return false
+  }
+  try {
+    return ['http:', 'https:'].includes(new URL(value).protocol)
+  } catch (err) {
+    return false
+  }
+}
+
 router.post('/', async (req, res, next) => {
   try {
-    const { redirect_uris, client_name, grant_types, response_types, scope } = req.body
+    const { redirect_uris, client_name, grant_types, response_types, scope, redirect_uri_matching, allowed_cors_origins, authorization_details_types, default_audience, resource_identifiers, id_token_signed_response_alg, id_token_lifetime, jwks_uri, jwks, dedicated_signing_key, subject_type, sector_identifier_uri, post_logout_redirect_uris } = req.body
 
     // Validate required parameters (RFC 7591)
     if (!redirect_uris || !Array.isArray(redirect_uris) || redirect_uris.length === 0) {
@@ -28,13 +54,171 @@ router.post('/', async (req, res, next) => {
       }
     }
 
+    // Validate post_logout_redirect_uris (OIDC RP-Initiated Logout 1.0 3.1)
+    if (post_logout_redirect_uris !== undefined) {
+      if (!Array.isArray(post_logout_redirect_uris)) {
+        return next(new OAuthError('invalid_client_metadata', 'post_logout_redirect_uris must be an array'))
+      }
+      for (const uri of post_logout_redirect_uris) {
+        if (!isHttpUrl(uri) || new URL(uri).hash) {
+          return next(new OAuthError('invalid_client_metadata', `Invalid post_logout_redirect_uri: ${uri}`))
+        }
+      }
+    }
+
+    // Validate scalar metadata types
+    for (const [name, value] of Object.entries({ client_name, scope, redirect_uri_matching })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be a string`))
+      }
+    }
+    for (const [name, value] of Object.entries({ grant_types, response_types })) {
+      if (value !== undefined && (!Array.isArray(value) || !value.every(v => typeof v === 'string'))) {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be an array of strings`))
+      }
+    }
+
+    // The admin scope is for operator-configured clients only
+    if (scope && expandScopes(normalizeScope(scope)).split(' ').includes(ADMIN_SCOPE)) {
+      return next(new OAuthError('invalid_client_metadata', `Scope '${ADMIN_SCOPE}' cannot be registered`))
+    }
+
+    // Only the code flow is implemented; the implicit flow is refused rather
+    // than registered and then failing at the authorization endpoint
+    if (response_types !== undefined && response_types.some(t => t !== 'code')) {
+      return next(new OAuthError('invalid_client_metadata', "response_types must only contain 'code'; use the authorization code flow instead of the implicit flow"))
+    }
+    if (grant_types !== undefined && grant_types.includes('implicit')) {
+      return next(new OAuthError('invalid_client_metadata', 'The implicit grant is not supported; use authorization_code'))
+    }
+    // Grant types switched off on this server cannot be registered for,
+    // including the authorization_code default
+    const disabledGrant = (grant_types || ['authorization_code'])
+      .find(g => Object.prototype.hasOwnProperty.call(GRANT_TYPE_FEATURES, g) && !grantTypeEnabled(g))
+    if (disabledGrant) {
+      return next(new OAuthError('invalid_client_metadata', `The ${disabledGrant} grant is disabled on this server`))
+    }
+
     // Validate client_name length
     if (client_name && typeof client_name === 'string' && client_name.length > 255) {
       return next(new OAuthError('invalid_request', 'client_name must not exceed 255 characters'))
     }
 
+    // Validate redirect_uri_matching policy
+    if (redirect_uri_matching !== undefined && !REDIRECT_URI_MATCHING_POLICIES.includes(redirect_uri_matching)) {
+      return next(new OAuthError('invalid_request', `redirect_uri_matching must be one of: ${REDIRECT_URI_MATCHING_POLICIES.join(', ')}`))
+    }
+
+    // Validate allowed_cors_origins
+    if (allowed_cors_origins !== undefined) {
+      if (!Array.isArray(allowed_cors_origins)) {
+        return next(new OAuthError('invalid_request', 'allowed_cors_origins must be an array'))
+      }
+      for (const origin of allowed_cors_origins) {
+        if (!isValidOrigin(origin)) {
+          return next(new OAuthError('invalid_request', `Invalid allowed_cors_origins entry: ${origin}`))
+        }
+      }
+    }
+
+    // Validate authorization_details_types (RFC 9396 10)
+    if (authorization_details_types !== undefined &&
+      (!Array.isArray(authorization_details_types) || !authorization_details_types.every(t => typeof t === 'string' && t))) {
+      return next(new OAuthError('invalid_request', 'authorization_details_types must be an array of strings'))
+    }
+
+    // Validate default_audience (a string or an array of strings)
+    if (default_audience !== undefined) {
+      const audiences = Array.isArray(default_audience) ? default_audience : [default_audience]
+      if (audiences.length === 0 || !audiences.every(a => typeof a === 'string' && a)) {
+        return next(new OAuthError('invalid_request', 'default_audience must be a string or an array of strings'))
+      }
+    }
+
+    // Validate resource_identifiers (audiences naming this client as a resource server)
+    if (resource_identifiers !== undefined &&
+      (!Array.isArray(resource_identifiers) || !resource_identifiers.every(r => typeof r === 'string' && r))) {
+      return next(new OAuthError('invalid_client_metadata', 'resource_identifiers must be an array of strings'))
+    }
+
+    // Validate the signing algorithms against what the server can produce
+    // or verify, id_token ones against the available keys (OIDC Registration 2)
+    for (const [field, algs] of Object.entries(getSupportedAlgorithms())) {
+      const value = req.body[field]
+      if (value === undefined || algs.includes(value)) {
+        continue
+      }
+      return next(new OAuthError('invalid_client_metadata', algs.length > 0
+        ? `${field} must be one of: ${algs.join(', ')}`
+        : `${field} is not supported`))
+    }
+
+    // Validate id_token_lifetime (seconds, independent of the access token TTL)
+    if (id_token_lifetime !== undefined &&
+      (!Number.isInteger(id_token_lifetime) || id_token_lifetime < ID_TOKEN_LIFETIME_MIN || id_token_lifetime > ID_TOKEN_LIFETIME_MAX)) {
+      return next(new OAuthError('invalid_client_metadata', `id_token_lifetime must be an integer from ${ID_TOKEN_LIFETIME_MIN} to ${ID_TOKEN_LIFETIME_MAX} seconds`))
+    }
+
+    // Validate the client's public keys: jwks_uri or jwks, not both (RFC 7591 2)
+    if (jwks_uri !== undefined && jwks !== undefined) {
+      return next(new OAuthError('invalid_client_metadata', 'jwks_uri and jwks must not both be present'))
+    }
+    if (jwks_uri !== undefined && !isHttpUrl(jwks_uri)) {
+      return next(new OAuthError('invalid_client_metadata', 'jwks_uri must be an http(s) URL'))
+    }
+    if (jwks !== undefined && (!jwks || typeof jwks !== 'object' || !Array.isArray(jwks.keys))) {
+      return next(new OAuthError('invalid_client_metadata', 'jwks must be a JWK Set with a keys array'))
+    }
+
+    if (dedicated_signing_key !== undefined && typeof dedicated_signing_key !== 'boolean') {
+      return next(new OAuthError('invalid_client_metadata', 'dedicated_signing_key must be a boolean'))
+    }
+
+    // Validate subject_type and sector_identifier_uri (OIDC Registration 2, 5)
+    if (subject_type !== undefined && !SUBJECT_TYPES.includes(subject_type)) {
+      return next(new OAuthError('invalid_client_metadata', `subject_type must be one of: ${SUBJECT_TYPES.join(', ')}`))
+    }
+    if (subject_type === 'pairwise' && !pairwiseSupported()) {
+      return next(new OAuthError('invalid_client_metadata', 'Pairwise subject identifiers are not enabled on this server'))
+    }
+    if (sector_identifier_uri !== undefined && !isHttpUrl(sector_identifier_uri)) {
+      return next(new OAuthError('invalid_client_metadata', 'sector_identifier_uri must be an http(s) URL'))
+    }
+    // The sector document must cover every redirect URI, whatever the subject type
+    let sector_identifier = null
+    try {
+      if (sector_identifier_uri !== undefined) {
+        sector_identifier = await resolveSectorIdentifier(sector_identifier_uri, redirect_uris)
+      } else if (subject_type === 'pairwise') {
+        sector_identifier = sectorFromRedirectUris(redirect_uris)
+      }
+    } catch (err) {
+      return next(err)
+    }
+
+    // Optional uniqueness rules against already registered clients
+    const { uniqueClientNames, redirectUriCollisionPolicy } = config.registration
+    let collisions = []
+    if ((uniqueClientNames && client_name) || redirectUriCollisionPolicy !== 'allow') {
+      const clients = await getClients()
+
+      if (uniqueClientNames && client_name) {
+        const name = client_name.trim().toLowerCase()
+        if (clients.some(c => (c.client_name || '').trim().toLowerCase() === name)) {
+          return next(new OAuthError('invalid_client_metadata', `client_name '${client_name}' is already registered`))
+        }
+      }
+
+      if (redirectUriCollisionPolicy !== 'allow') {
+        collisions = findRedirectUriCollisions(clients, redirect_uris)
+      }
+      if (collisions.length > 0 && redirectUriCollisionPolicy === 'reject') {
+        return next(new OAuthError('invalid_client_metadata', `redirect_uri ${collisions[0].redirect_uri} overlaps a URI registered to another client`))
+      }
+    }
+
     // Generate client credentials
-    const client_id = crypto.randomBytes(16).toString('hex')
+    const client_id = await generateClientId({ client_name, redirect_uris }, async (id) => (await getClients()).some(c => c.client_id === id))
     const client_secret = crypto.randomBytes(32).toString('hex')
 
     const client = {
@@ -42,23 +226,63 @@ router.post('/', async (req, res, next) => {
       client_secret,
       client_name: client_name || `Client ${client_id}`,
       redirect_uris,
+      post_logout_redirect_uris: post_logout_redirect_uris || [],
       grant_types: grant_types || ['authorization_code'],
       response_types: response_types || ['code'],
       scope: scope || '',
+      redirect_uri_matching: redirect_uri_matching || 'exact',
+      allowed_cors_origins: allowed_cors_origins || [],
+      authorization_details_types: authorization_details_types || [],
+      default_audience: default_audience || null,
+      resource_identifiers: resource_identifiers || [],
+      id_token_signed_response_alg: id_token_signed_response_alg || 'RS256',
+      id_token_lifetime: id_token_lifetime || null,
+      jwks_uri: jwks_uri || null,
+      jwks: jwks || null,
+      // Access tokens signed with a key of the client's own, published at
+      // /.well-known/jwks/<client_id>.json
+      signing_key_id: dedicated_signing_key ? `client-${client_id}` : null,
+      subject_type: subject_type || 'public',
+      sector_identifier_uri: sector_identifier_uri || null,
+      // Host pairwise subjects are computed for (src/pairwise.js)
+      sector_identifier,
       created_at: Date.now()
     }
 
     await addClient(client)
 
+    // 'warn' policy: register anyway but leave a trail for operators
+    if (collisions.length > 0) {
+      logSecurityEvent({
+        type: 'CLIENT_REDIRECT_URI_COLLISION',
+        client_id: client.client_id,
+        redirect_uris: collisions.map(c => c.redirect_uri),
+        colliding_client_ids: collisions.map(c => c.client_id)
+      })
+    }
+
     // Return client metadata (RFC 7591 3.2.1)
     res.status(201).json({
       client_id: client.client_id,
       client_secret: client.client_secret,
       client_name: client.client_name,
       redirect_uris: client.redirect_uris,
+      post_logout_redirect_uris: client.post_logout_redirect_uris,
       grant_types: client.grant_types,
       response_types: client.response_types,
-      scope: client.scope
+      scope: client.scope,
+      redirect_uri_matching: client.redirect_uri_matching,
+      allowed_cors_origins: client.allowed_cors_origins,
+      authorization_details_types: client.authorization_details_types,
+      default_audience: client.default_audience,
+      resource_identifiers: client.resource_identifiers,
+      id_token_signed_response_alg: client.id_token_signed_response_alg,
+      id_token_lifetime: client.id_token_lifetime,
+      jwks_uri: client.jwks_uri,
+      jwks: client.jwks,
+      signing_key_id: client.signing_key_id,
+      subject_type: client.subject_type,
+      sector_identifier_uri: client.sector_identifier_uri
     })
   } catch (err) {
     next(err)
@@ -1,54 +1,205 @@
 /* eslint camelcase: "off" */
 const express = require('express')
+const csrf = require('csurf')
+const jwt = require('jsonwebtoken')
 const config = require('../config')
-const { getClient, getCode, deleteCode, cleanupExpiredCodes, getUserById } = require('../db')
-const { generateToken, generateIdToken } = require('../tokens')
+const { getClient, getCode, deleteCode, markCodeRedeemed, addIssuedToken, deleteRefreshTokensByGrant, revokeIssuedTokensByGrant, cleanupExpiredCodes, getUserById, addRefreshToken, getRefreshToken, deleteRefreshToken, getDeviceCode, updateDeviceCode, deleteDeviceCode, saveConsent } = require('../db')
+const { generateToken, generateIdToken, generateCode, generateRandomToken, ensureClientKey, buildAccessTokenPayload, defaultClaimsFor, withDefaultClaims } = require('../tokens')
 const { buildIdTokenClaims } = require('../oidc')
+const { subjectFor } = require('../pairwise')
 const { OAuthError } = require('../errors')
+const { dpopProof } = require('../dpop')
+const { normalizeScope, scopeLimitError, expandScopes, splitUserScopes, findMachineOnlyScopes, adminScopeError } = require('../scopes')
+const { getClientCredentials, matchClientSecret, isClientActive } = require('../clients')
+const { JWT_BEARER_ASSERTION_TYPE, authenticateClientAssertion } = require('../clientAssertion')
+const { parseAuthorizationDetails } = require('../rar')
+const { resolveAudience, serializeAudience } = require('../audience')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { applyIdempotencyKey } = require('../idempotency')
+const { noStore } = require('../middleware/cacheControl')
+const { DEVICE_CODE_GRANT } = require('../deviceFlow')
+const { grantTypeEnabled } = require('../grantTypes')
+const { acrForAmr } = require('../acr')
+const { checkScopeBaseline } = require('../scopeBaseline')
 
 const router = express.Router()
+const csrfProtection = csrf({ cookie: false })
 
-// Parse client credentials from Authorization header or body
-function getClientCredentials (req) {
-  const authHeader = req.headers.authorization
+// Token responses must not be cached (RFC 6749 5.1)
+router.use(noStore)
 
-  // Try client_secret_basic (Authorization header)
-  if (authHeader && authHeader.startsWith('Basic ')) {
-    const base64Credentials = authHeader.substring(6)
-    const credentials = Buffer.from(base64Credentials, 'base64').toString('utf8')
-    const [client_id, client_secret] = credentials.split(':')
-    return { client_id, client_secret }
+// Reject non form-encoded bodies when strict content-type checking is on (RFC 6749 3.2).
+// Media type parameters such as charset are ignored by req.is().
+function requireFormEncoded (req, res, next) {
+  if (!config.tokenEndpoint.strictContentType) {
+    return next()
   }
+  if (!req.is('application/x-www-form-urlencoded')) {
+    return next(new OAuthError('invalid_request', 'Content-Type must be application/x-www-form-urlencoded'))
+  }
+  next()
+}
+
+// token_type for issued tokens: DPoP-bound tokens use "DPoP", bearer tokens
+// the configured casing (clients must compare it case-insensitively)
+function tokenTypeFor (req) {
+  if (req.dpopJkt) {
+    return 'DPoP'
+  }
+  const configured = config.tokenEndpoint.tokenType
+  return /^bearer$/i.test(configured) ? configured : 'Bearer'
+}
+
+// Refresh tokens are only issued when offline_access was requested and
+// consented (OIDC Core 11), never on the strength of the grant type alone
+function offlineAccessGranted (scope) {
+  return config.features.refreshTokens && config.features.offlineAccess &&
+    (scope || '').split(' ').includes('offline_access')
+}
+
+// Audit trail of issued tokens (never the tokens themselves). The access
+// token's jti is stored until it expires, so it can be revoked on its own,
+// along with the grant (redeemed code) it came from, if any.
+async function logTokenIssued (req, res, client, sub, scope, accessToken, { grantType = req.body.grant_type, grantId = null } = {}) {
+  const { jti, iat, exp } = jwt.decode(accessToken)
+  await addIssuedToken({ jti, client_id: client.client_id, sub, scope, iat, expiresAt: exp * 1000, grantId })
+  logSecurityEvent({
+    type: 'TOKEN_ISSUED',
+    client_id: client.client_id,
+    grant_type: grantType,
+    sub,
+    scope,
+    jti,
+    iat,
+    exp
+  })
+  if (config.tokens.issuanceHeader) {
+    res.set('Token-Issuance', JSON.stringify({ jti, iat, exp, scope }))
+  }
+}
+
+// Check the scopes about to be granted against the client's usual ones
+// (src/scopeBaseline.js). Refresh grants are not checked: they cannot widen
+// the scope of the grant they come from.
+async function scopeBaselineError (client, scope) {
+  const { unusual, blocked } = await checkScopeBaseline(client, scope)
+  return blocked ? new OAuthError('invalid_scope', `Scope '${unusual[0]}' is outside the usual scopes of this client`) : null
+}
 
-  // Try client_secret_post (body)
-  return {
-    client_id: req.body.client_id,
-    client_secret: req.body.client_secret
+// The admin scope unlocks the /admin API, so every grant refuses it to
+// clients that are not allow-listed (NGAUTH_ADMIN_CLIENTS, admin_access)
+function adminScopeDenied (client, scope) {
+  const message = adminScopeError(scope, client)
+  return message ? new OAuthError('invalid_scope', message) : null
+}
+
+// Machine-only scopes are reserved for client_credentials. The user grants
+// check them again at redemption, where the expanded scope is known.
+function machineOnlyScopeDenied (scope) {
+  const machineOnly = findMachineOnlyScopes(scope)
+  return machineOnly.length > 0
+    ? new OAuthError('invalid_scope', `Scope '${machineOnly[0]}' is only available for client_credentials`)
+    : null
+}
+
+// Key ID for the client's access tokens: its dedicated key when it has one
+async function accessTokenKeyId (client) {
+  if (!client.signing_key_id) {
+    return null
   }
+  await ensureClientKey(client.signing_key_id)
+  return client.signing_key_id
+}
+
+// Store a refresh token for the grant. Rotated tokens keep the original expiry.
+async function issueRefreshToken (grant, expiresAt = Date.now() + config.tokens.refreshTokenTTL * 1000) {
+  const token = generateCode('refresh_token')
+  await addRefreshToken({ ...grant, token, createdAt: Date.now(), expiresAt })
+  return token
 }
 
-router.post('/', async (req, res, next) => {
+router.post('/', requireFormEncoded, dpopProof, async (req, res, next) => {
   try {
     await cleanupExpiredCodes()
 
-    const { grant_type, code, redirect_uri, scope } = req.body
+    const { grant_type, code, redirect_uri, refresh_token, device_code, client_assertion_type, client_assertion } = req.body
+    // Normalized scope drives validation, granting and the echoed scope
+    const scope = normalizeScope(req.body.scope)
     const { client_id, client_secret } = getClientCredentials(req)
 
+    // Parameters must be single string values (RFC 6749 3.2)
+    for (const [name, value] of Object.entries({ grant_type, code, redirect_uri, refresh_token, device_code, scope, client_id, client_secret, client_assertion_type, client_assertion })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be a string`))
+      }
+    }
+    if (!grant_type) {
+      return next(new OAuthError('invalid_request', 'Missing required parameter: grant_type'))
+    }
+    const limitError = scopeLimitError(scope)
+    if (limitError) {
+      return next(new OAuthError('invalid_scope', limitError))
+    }
+
     // Validate client credentials
-    if (!client_id || !client_secret) {
-      return next(new OAuthError('invalid_client', 'Missing client credentials'))
+    let client
+    if (client_assertion_type !== undefined || client_assertion !== undefined) {
+      // private_key_jwt (RFC 7523 2.2); a client uses one method only (RFC 6749 2.3)
+      if (client_assertion_type !== JWT_BEARER_ASSERTION_TYPE || !client_assertion) {
+        return next(new OAuthError('invalid_client', 'Unsupported client assertion type'))
+      }
+      if (client_secret) {
+        return next(new OAuthError('invalid_request', 'Use only one client authentication method'))
+      }
+
+      client = await authenticateClientAssertion(client_assertion, [`${config.issuer}${config.endpoints.token}`, config.issuer])
+      if (client_id && client_id !== client.client_id) {
+        return next(new OAuthError('invalid_client', 'client_id does not match the client assertion'))
+      }
+      logSecurityEvent({
+        type: 'CLIENT_AUTHENTICATED',
+        client_id: client.client_id,
+        method: 'private_key_jwt'
+      })
+    } else {
+      if (!client_id || !client_secret) {
+        return next(new OAuthError('invalid_client', 'Missing client credentials'))
+      }
+
+      client = await getClient(client_id)
+      const secretId = matchClientSecret(client, client_secret)
+      if (!secretId) {
+        return next(new OAuthError('invalid_client', 'Invalid client credentials'))
+      }
+
+      // Record which secret authenticated the client (useful during rotation)
+      req.clientSecretId = secretId
+      logSecurityEvent({
+        type: 'CLIENT_AUTHENTICATED',
+        client_id: client.client_id,
+        secret_id: secretId
+      })
     }
 
-    const client = await getClient(client_id)
-    if (!client || client.client_secret !== client_secret) {
-      return next(new OAuthError('invalid_client', 'Invalid client credentials'))
+    // Replay the original response for a retried request (Idempotency-Key header)
+    if (applyIdempotencyKey(req, res, client.client_id)) {
+      return
+    }
+
+    // Disabled grant types are refused like unknown ones (NGAUTH_SUPPORT_*_GRANT)
+    if (!grantTypeEnabled(grant_type)) {
+      return next(new OAuthError('unsupported_grant_type', 'Unsupported grant type'))
     }
 
     // Handle grant types
     if (grant_type === 'authorization_code') {
       return await handleAuthorizationCodeGrant(req, res, next, client, code, redirect_uri)
     } else if (grant_type === 'client_credentials') {
-      return handleClientCredentialsGrant(req, res, next, client, scope)
+      return await handleClientCredentialsGrant(req, res, next, client, scope)
+    } else if (grant_type === 'refresh_token') {
+      return await handleRefreshTokenGrant(req, res, next, client, refresh_token, scope)
+    } else if (grant_type === DEVICE_CODE_GRANT) {
+      return await handleDeviceCodeGrant(req, res, next, client, device_code)
     } else {
       return next(new OAuthError('unsupported_grant_type', 'Unsupported grant type'))
     }
@@ -57,6 +208,21 @@ router.post('/', async (req, res, next) => {
   }
 })
 
+// Revoke what was issued from a redeemed code: its refresh tokens, rotated
+// ones included, and the access tokens of the code and of those refreshes.
+// Tokens from the user's other grants stay valid.
+async function revokeCodeGrant (authCode) {
+  const refreshTokensRevoked = authCode.grantId ? await deleteRefreshTokensByGrant(authCode.grantId) : 0
+  const accessTokensRevoked = authCode.grantId ? await revokeIssuedTokensByGrant(authCode.grantId) : 0
+  logSecurityEvent({
+    type: 'AUTHORIZATION_CODE_REUSED',
+    userId: authCode.userId,
+    client_id: authCode.client_id,
+    refresh_tokens_revoked: refreshTokensRevoked,
+    access_tokens_revoked: accessTokensRevoked
+  })
+}
+
 async function handleAuthorizationCodeGrant (req, res, next, client, code, redirect_uri) {
   if (!code) {
     return next(new OAuthError('invalid_request', 'Missing code parameter'))
@@ -71,6 +237,15 @@ async function handleAuthorizationCodeGrant (req, res, next, client, code, redir
     return next(new OAuthError('invalid_grant', 'Invalid authorization code'))
   }
 
+  // A code presented again after its redemption may have been stolen: the
+  // tokens issued from it are revoked (RFC 6749 4.1.2, 10.5)
+  if (authCode.redeemedAt) {
+    if (authCode.client_id === client.client_id) {
+      await revokeCodeGrant(authCode)
+    }
+    return next(new OAuthError('invalid_grant', 'Authorization code has already been used'))
+  }
+
   // Check if code is expired
   if (authCode.expiresAt < Date.now()) {
     await deleteCode(code)
@@ -87,48 +262,289 @@ async function handleAuthorizationCodeGrant (req, res, next, client, code, redir
     return next(new OAuthError('invalid_grant', 'Redirect URI mismatch'))
   }
 
-  // Delete code (single-use only per RFC 6749 4.1.2)
-  await deleteCode(code)
+  // Resolve the token audience before consuming the code
+  const audience = serializeAudience(resolveAudience(req.body.resource, client))
+
+  // Single-use only (RFC 6749 4.1.2). With reuse detection the code is kept
+  // as redeemed while the access token issued from it is valid.
+  let grantId = null
+  if (config.tokens.revokeOnCodeReuse) {
+    grantId = generateRandomToken(16)
+    await markCodeRedeemed(code, grantId, Date.now() + config.tokens.accessTokenTTL * 1000)
+  } else {
+    await deleteCode(code)
+  }
 
   // Get issuer from environment or derive from request
-  const issuer = process.env.ISSUER || `http://${req.get('host')}`
+  const issuer = process.env.ISSUER || `http://${req.get('host')}${config.basePath}`
 
-  // Generate access token
-  const accessTokenPayload = {
-    sub: authCode.userId,
-    client_id: client.client_id,
-    scope: authCode.scope,
-    token_type: 'access'
+  // Granted scopes include those implied by the scope hierarchy
+  const grantedScope = expandScopes(authCode.scope)
+
+  const machineOnlyError = machineOnlyScopeDenied(grantedScope)
+  if (machineOnlyError) {
+    return next(machineOnlyError)
+  }
+  const adminError = adminScopeDenied(client, grantedScope)
+  if (adminError) {
+    return next(adminError)
   }
+  const baselineError = await scopeBaselineError(client, grantedScope)
+  if (baselineError) {
+    return next(baselineError)
+  }
+
+  // Generate access token
+  const accessTokenPayload = withDefaultClaims(buildAccessTokenPayload({
+    userId: authCode.userId,
+    clientId: client.client_id,
+    scope: grantedScope,
+    aud: audience,
+    authorizationDetails: authCode.authorization_details,
+    jkt: req.dpopJkt
+  }), client)
 
-  const accessToken = generateToken(accessTokenPayload, '1h')
+  const accessToken = generateToken(accessTokenPayload, config.tokens.accessTokenTTL, await accessTokenKeyId(client))
 
   const response = {
     access_token: accessToken,
-    token_type: 'Bearer',
-    expires_in: 3600,
-    scope: authCode.scope
+    token_type: tokenTypeFor(req),
+    expires_in: config.tokens.accessTokenTTL,
+    scope: grantedScope
+  }
+
+  if (authCode.authorization_details) {
+    response.authorization_details = authCode.authorization_details
+  }
+
+  if (offlineAccessGranted(authCode.scope)) {
+    response.refresh_token = await issueRefreshToken({
+      client_id: client.client_id,
+      userId: authCode.userId,
+      scope: authCode.scope,
+      aud: audience || null,
+      authorization_details: authCode.authorization_details || null,
+      grantId,
+      sessionRef: authCode.sessionRef || null
+    })
   }
 
   // Generate ID token if openid scope is present (OIDC Core 1.0)
   if (authCode.scope && authCode.scope.includes('openid')) {
     const user = await getUserById(authCode.userId)
     if (user) {
-      const idTokenClaims = buildIdTokenClaims(
+      // The client may register an id_token lifetime apart from the access token TTL
+      const idTokenLifetime = client.id_token_lifetime || config.tokens.idTokenTTL
+      const idTokenClaims = withDefaultClaims(buildIdTokenClaims(
         user,
         client.client_id,
         issuer,
         authCode.scope,
-        authCode.nonce
-      )
-      response.id_token = generateIdToken(idTokenClaims, '1h')
+        authCode.nonce,
+        idTokenLifetime
+      ), client)
+      // Pairwise clients get the sub of their sector (OIDC Core 8.1)
+      idTokenClaims.sub = subjectFor(client, user.id)
+      if (authCode.authTime) {
+        idTokenClaims.auth_time = Math.floor(authCode.authTime / 1000)
+      }
+      // Authentication context of the session, including any step-up (OIDC Core 2)
+      if (authCode.amr) {
+        idTokenClaims.amr = authCode.amr
+      }
+      if (authCode.acr) {
+        idTokenClaims.acr = authCode.acr
+      }
+      response.id_token = generateIdToken(idTokenClaims, idTokenLifetime, client.id_token_signed_response_alg)
+    }
+  }
+
+  await logTokenIssued(req, res, client, authCode.userId, grantedScope, response.access_token, { grantId })
+  res.json(response)
+}
+
+// Poll for the tokens of a device authorization grant (RFC 8628 3.4, 3.5).
+// Until the user decides, the device gets authorization_pending, or
+// slow_down (with the interval raised by 5 seconds) when polling too fast.
+async function handleDeviceCodeGrant (req, res, next, client, deviceCode) {
+  if (!deviceCode) {
+    return next(new OAuthError('invalid_request', 'Missing required parameter: device_code'))
+  }
+
+  const grant = await getDeviceCode(deviceCode)
+  if (!grant || grant.client_id !== client.client_id) {
+    return next(new OAuthError('invalid_grant', 'Invalid device_code'))
+  }
+  if (grant.expiresAt <= Date.now()) {
+    await deleteDeviceCode(grant.id)
+    return next(new OAuthError('expired_token', 'The device_code has expired'))
+  }
+  if (grant.status === 'denied') {
+    await deleteDeviceCode(grant.id)
+    return next(new OAuthError('access_denied', 'The user denied the request'))
+  }
+  if (grant.status !== 'approved') {
+    const now = Date.now()
+    const tooFast = grant.lastPolledAt && now - grant.lastPolledAt < grant.interval * 1000
+    await updateDeviceCode(grant.id, { lastPolledAt: now, interval: tooFast ? grant.interval + 5 : grant.interval })
+    return tooFast
+      ? next(new OAuthError('slow_down', 'Polling too frequently'))
+      : next(new OAuthError('authorization_pending', 'The user has not yet completed the authorization'))
+  }
+
+  // Single-use like an authorization code
+  await deleteDeviceCode(grant.id)
+
+  const audience = serializeAudience(resolveAudience(req.body.resource, client))
+  const issuer = process.env.ISSUER || `http://${req.get('host')}${config.basePath}`
+  const grantedScope = expandScopes(grant.scope)
+
+  const machineOnlyError = machineOnlyScopeDenied(grantedScope)
+  if (machineOnlyError) {
+    return next(machineOnlyError)
+  }
+  const adminError = adminScopeDenied(client, grantedScope)
+  if (adminError) {
+    return next(adminError)
+  }
+  const baselineError = await scopeBaselineError(client, grantedScope)
+  if (baselineError) {
+    return next(baselineError)
+  }
+
+  const payload = withDefaultClaims(buildAccessTokenPayload({
+    userId: grant.userId,
+    clientId: client.client_id,
+    scope: grantedScope,
+    aud: audience,
+    jkt: req.dpopJkt
+  }), client)
+
+  const response = {
+    access_token: generateToken(payload, config.tokens.accessTokenTTL, await accessTokenKeyId(client)),
+    token_type: tokenTypeFor(req),
+    expires_in: config.tokens.accessTokenTTL,
+    scope: grantedScope
+  }
+
+  if (offlineAccessGranted(grant.scope)) {
+    response.refresh_token = await issueRefreshToken({
+      client_id: client.client_id,
+      userId: grant.userId,
+      scope: grant.scope,
+      aud: audience || null,
+      authorization_details: null,
+      sessionRef: grant.sessionRef || null
+    })
+  }
+
+  if (grant.scope.split(' ').includes('openid')) {
+    const user = await getUserById(grant.userId)
+    if (user) {
+      const idTokenLifetime = client.id_token_lifetime || config.tokens.idTokenTTL
+      const idTokenClaims = withDefaultClaims(buildIdTokenClaims(user, client.client_id, issuer, grant.scope, null, idTokenLifetime), client)
+      idTokenClaims.sub = subjectFor(client, user.id)
+      if (grant.authTime) {
+        idTokenClaims.auth_time = Math.floor(grant.authTime / 1000)
+      }
+      idTokenClaims.amr = grant.amr
+      idTokenClaims.acr = acrForAmr(grant.amr)
+      response.id_token = generateIdToken(idTokenClaims, idTokenLifetime, client.id_token_signed_response_alg)
     }
   }
 
+  await logTokenIssued(req, res, client, grant.userId, grantedScope, response.access_token)
   res.json(response)
 }
 
-function handleClientCredentialsGrant (req, res, next, client, scope) {
+// Exchange a refresh token for a new access token (RFC 6749 6). The refresh
+// token is rotated: the presented one is consumed and a new one returned,
+// carrying the rotation count of the chain.
+async function handleRefreshTokenGrant (req, res, next, client, refreshToken, scope) {
+  if (!refreshToken) {
+    return next(new OAuthError('invalid_request', 'Missing refresh_token parameter'))
+  }
+
+  const grant = await getRefreshToken(refreshToken)
+  if (!grant || grant.client_id !== client.client_id) {
+    return next(new OAuthError('invalid_grant', 'Invalid refresh token'))
+  }
+  if (grant.expiresAt <= Date.now()) {
+    await deleteRefreshToken(refreshToken)
+    return next(new OAuthError('invalid_grant', 'Refresh token expired'))
+  }
+
+  // Past the rotation cap the chain ends, even for a token rotated all along
+  const rotations = grant.rotations || 0
+  const { maxRefreshRotations } = config.tokens
+  if (maxRefreshRotations > 0 && rotations >= maxRefreshRotations) {
+    await deleteRefreshToken(refreshToken)
+    logSecurityEvent({ type: 'REFRESH_ROTATION_LIMIT_REACHED', userId: grant.userId, client_id: client.client_id, rotations })
+    return next(new OAuthError('invalid_grant', 'Refresh token rotation limit reached; the user must sign in again'))
+  }
+
+  // The client may narrow the original scope but not widen it
+  const grantedScopes = grant.scope.split(' ').filter(s => s)
+  for (const requestedScope of (scope || '').split(' ').filter(s => s)) {
+    if (!grantedScopes.includes(requestedScope)) {
+      return next(new OAuthError('invalid_scope', `Scope '${requestedScope}' was not granted`))
+    }
+  }
+
+  await deleteRefreshToken(refreshToken)
+
+  // Granted scopes include those implied by the scope hierarchy
+  const grantedScope = expandScopes(scope || grant.scope)
+  const adminError = adminScopeDenied(client, grantedScope)
+  if (adminError) {
+    return next(adminError)
+  }
+
+  const payload = withDefaultClaims(buildAccessTokenPayload({
+    userId: grant.userId,
+    clientId: client.client_id,
+    scope: grantedScope,
+    aud: grant.aud,
+    authorizationDetails: grant.authorization_details,
+    jkt: req.dpopJkt
+  }), client)
+
+  const response = {
+    access_token: generateToken(payload, config.tokens.accessTokenTTL, await accessTokenKeyId(client)),
+    token_type: tokenTypeFor(req),
+    expires_in: config.tokens.accessTokenTTL,
+    scope: grantedScope,
+    refresh_token: await issueRefreshToken({
+      client_id: grant.client_id,
+      userId: grant.userId,
+      scope: grant.scope,
+      aud: grant.aud,
+      authorization_details: grant.authorization_details,
+      rotations: rotations + 1,
+      grantId: grant.grantId || null,
+      sessionRef: grant.sessionRef || null
+    }, grant.expiresAt)
+  }
+
+  if (grant.authorization_details) {
+    response.authorization_details = grant.authorization_details
+  }
+
+  await logTokenIssued(req, res, client, grant.userId, grantedScope, response.access_token, { grantId: grant.grantId || null })
+  res.json(response)
+}
+
+async function handleClientCredentialsGrant (req, res, next, client, scope) {
+  // There is no end user: user-identity scopes are stripped or rejected, so
+  // machine tokens never carry openid and never come with an id_token
+  const { scope: machineScope, userScopes } = splitUserScopes(scope)
+  if (userScopes.length > 0) {
+    if (config.scopePolicy.clientCredentialsUserScopes === 'reject') {
+      return next(new OAuthError('invalid_scope', `Scope '${userScopes[0]}' is not available for client_credentials`))
+    }
+    scope = machineScope
+  }
+
   // Validate scope - check if requested scopes are allowed by client registration
   // Only validate if client has specific scopes registered
   if (scope && client.scope && client.scope.trim()) {
@@ -144,23 +560,190 @@ function handleClientCredentialsGrant (req, res, next, client, scope) {
     }
   }
 
+  // Validate authorization_details (RFC 9396 6) and resource indicators (RFC 8707)
+  let authorizationDetails
+  let audience
+  try {
+    authorizationDetails = parseAuthorizationDetails(req.body.authorization_details, client)
+    audience = serializeAudience(resolveAudience(req.body.resource, client))
+  } catch (err) {
+    return next(err)
+  }
+
+  // Granted scopes include those implied by the scope hierarchy
+  const grantedScope = expandScopes(scope)
+
+  const adminError = adminScopeDenied(client, grantedScope)
+  if (adminError) {
+    return next(adminError)
+  }
+  const baselineError = await scopeBaselineError(client, grantedScope)
+  if (baselineError) {
+    return next(baselineError)
+  }
+
   // Generate access token for client
   const payload = {
+    ...defaultClaimsFor(client),
     iss: config.issuer,
     sub: client.client_id,
     client_id: client.client_id,
-    scope: scope || '',
+    scope: grantedScope,
     token_type: 'access'
   }
 
-  const accessToken = generateToken(payload, '1h')
+  if (audience) {
+    payload.aud = audience
+  }
+
+  if (authorizationDetails) {
+    payload.authorization_details = authorizationDetails
+  }
+
+  // Bind the token to the DPoP proof key (RFC 9449 6)
+  if (req.dpopJkt) {
+    payload.cnf = { jkt: req.dpopJkt }
+  }
 
-  res.json({
+  const accessToken = generateToken(payload, config.tokens.accessTokenTTL, await accessTokenKeyId(client))
+
+  const response = {
     access_token: accessToken,
-    token_type: 'Bearer',
-    expires_in: 3600,
-    scope: scope || ''
+    token_type: tokenTypeFor(req),
+    expires_in: config.tokens.accessTokenTTL,
+    scope: grantedScope
+  }
+
+  if (authorizationDetails) {
+    response.authorization_details = authorizationDetails
+  }
+
+  await logTokenIssued(req, res, client, client.client_id, grantedScope, response.access_token)
+  res.json(response)
+}
+
+// Session-to-token bridge: a first-party SPA whose user already signed in
+// here gets tokens for the login session without the authorize redirect.
+// Only clients an admin marked as trusted (skip_consent) and allowed the
+// bridge (session_bridge) qualify. The session cookie authenticates the
+// request, so it must carry the session's CSRF token, fetched from
+// GET /session/csrf and sent in the X-CSRF-Token header or as _csrf.
+const SESSION_BRIDGE_STANDARD_SCOPES = ['openid', 'profile', 'email']
+
+// CSRF failures are client errors, not server errors
+function sessionCsrfProtection (req, res, next) {
+  csrfProtection(req, res, (err) => {
+    if (err && err.code === 'EBADCSRFTOKEN') {
+      logSecurityEvent({ type: 'SESSION_BRIDGE_CSRF_REJECTED', client_id: req.body && req.body.client_id })
+      return next(new OAuthError('invalid_request', 'Missing or invalid CSRF token', 403))
+    }
+    next(err)
   })
 }
 
+// GET /session/csrf - CSRF token of the current login session
+router.get('/session/csrf', sessionCsrfProtection, (req, res) => {
+  res.json({ csrf_token: req.csrfToken() })
+})
+
+// POST /session - Tokens for the current login session
+router.post('/session', sessionCsrfProtection, dpopProof, async (req, res, next) => {
+  try {
+    const { client_id } = req.body
+    const scope = normalizeScope(req.body.scope)
+    for (const [name, value] of Object.entries({ client_id, scope })) {
+      if (value !== undefined && typeof value !== 'string') {
+        return next(new OAuthError('invalid_request', `Parameter '${name}' must be a string`))
+      }
+    }
+    if (!client_id) {
+      return next(new OAuthError('invalid_request', 'Missing required parameter: client_id'))
+    }
+    if (!req.session.userId) {
+      return next(new OAuthError('login_required', 'No signed-in user in this session', 401))
+    }
+
+    const client = await getClient(client_id)
+    if (!client || !isClientActive(client) || !client.skip_consent || !client.session_bridge) {
+      return next(new OAuthError('unauthorized_client', 'Client may not exchange a session for tokens'))
+    }
+    const user = await getUserById(req.session.userId)
+    if (!user) {
+      return next(new OAuthError('login_required', 'No signed-in user in this session', 401))
+    }
+
+    // The client's registered scopes, narrowed by the request. No refresh
+    // tokens: the session is the long-lived credential here.
+    const allowedScopes = [...(client.scope || '').split(' ').filter(s => s), ...SESSION_BRIDGE_STANDARD_SCOPES]
+    const requestedScope = scope === undefined || scope === '' ? normalizeScope(client.scope || '') : scope
+    const limitError = scopeLimitError(requestedScope)
+    if (limitError) {
+      return next(new OAuthError('invalid_scope', limitError))
+    }
+    for (const requested of requestedScope.split(' ').filter(s => s)) {
+      if (requested === 'offline_access' || !allowedScopes.includes(requested)) {
+        return next(new OAuthError('invalid_scope', `Scope '${requested}' is not available through the session bridge`))
+      }
+    }
+    const machineOnlyError = machineOnlyScopeDenied(requestedScope)
+    if (machineOnlyError) {
+      return next(machineOnlyError)
+    }
+
+    let audience
+    try {
+      audience = serializeAudience(resolveAudience(req.body.resource, client))
+    } catch (err) {
+      return next(err)
+    }
+
+    const grantedScope = expandScopes(requestedScope)
+    const adminError = adminScopeDenied(client, grantedScope)
+    if (adminError) {
+      return next(adminError)
+    }
+    const baselineError = await scopeBaselineError(client, grantedScope)
+    if (baselineError) {
+      return next(baselineError)
+    }
+
+    const accessTokenPayload = withDefaultClaims(buildAccessTokenPayload({
+      userId: user.id,
+      clientId: client.client_id,
+      scope: grantedScope,
+      aud: audience,
+      jkt: req.dpopJkt
+    }), client)
+    const response = {
+      access_token: generateToken(accessTokenPayload, config.tokens.accessTokenTTL, await accessTokenKeyId(client)),
+      token_type: tokenTypeFor(req),
+      expires_in: config.tokens.accessTokenTTL,
+      scope: grantedScope
+    }
+
+    if (requestedScope.split(' ').includes('openid')) {
+      const issuer = process.env.ISSUER || `http://${req.get('host')}${config.basePath}`
+      const idTokenLifetime = client.id_token_lifetime || config.tokens.idTokenTTL
+      const idTokenClaims = withDefaultClaims(buildIdTokenClaims(user, client.client_id, issuer, requestedScope, undefined, idTokenLifetime), client)
+      idTokenClaims.sub = subjectFor(client, user.id)
+      if (req.session.authTime) {
+        idTokenClaims.auth_time = Math.floor(req.session.authTime / 1000)
+      }
+      const amr = req.session.amr || ['pwd']
+      idTokenClaims.amr = amr
+      if (acrForAmr(amr)) {
+        idTokenClaims.acr = acrForAmr(amr)
+      }
+      response.id_token = generateIdToken(idTokenClaims, idTokenLifetime, client.id_token_signed_response_alg)
+    }
+
+    // Record the grant so the user can review and revoke it later
+    await saveConsent(user.id, client.client_id, requestedScope.split(' ').filter(s => s))
+    await logTokenIssued(req, res, client, user.id, grantedScope, response.access_token, { grantType: 'session' })
+    res.json(response)
+  } catch (err) {
+    next(err)
+  }
+})
+
 module.exports = router
@@ -7,29 +7,61 @@
 
 const express = require('express')
 const { verifyToken } = require('../tokens')
-const { getUserById } = require('../db')
+const { getClient, getUserById, isTokenRevoked } = require('../db')
 const { buildUserinfoResponse } = require('../oidc')
+const { parseBearerToken } = require('../auth')
+const { readTokenScope } = require('../scopes')
+const { subjectFor } = require('../pairwise')
+const { userinfoIpLimiter, userinfoClientLimiter } = require('../middleware/rateLimit')
+const { noStore } = require('../middleware/cacheControl')
 
 const router = express.Router()
 
+// Userinfo responses must not be cached (OIDC Core 5.3.2)
+router.use(noStore)
+
+// Extract the access token from the Authorization header or, for POST, the
+// form-encoded body (RFC 6750 2.1, 2.2). Returns { token } or { error }.
+function extractAccessToken (req) {
+  const headerToken = parseBearerToken(req.headers.authorization)
+  const bodyToken = req.method === 'POST' && req.is('application/x-www-form-urlencoded') && req.body
+    ? req.body.access_token
+    : undefined
+
+  // Clients must not use more than one method to transmit the token (RFC 6750 2)
+  if (headerToken !== undefined && bodyToken !== undefined) {
+    return { status: 400, error: 'invalid_request', description: 'Access token must be sent in only one place' }
+  }
+  if (bodyToken !== undefined && typeof bodyToken !== 'string') {
+    return { status: 400, error: 'invalid_request', description: "Parameter 'access_token' must be a string" }
+  }
+
+  const token = headerToken || bodyToken
+  if (!token) {
+    return { status: 401, error: 'invalid_token', description: 'Missing or invalid authorization header' }
+  }
+  return { token }
+}
+
 // Middleware to verify access token
 async function verifyAccessToken (req, res, next) {
-  const authHeader = req.headers.authorization
+  const { token, status, error, description } = extractAccessToken(req)
 
-  if (!authHeader || !authHeader.startsWith('Bearer ')) {
-    return res.status(401).json({
-      error: 'invalid_token',
-      error_description: 'Missing or invalid authorization header'
+  if (!token) {
+    return res.status(status).json({
+      error,
+      error_description: description
     })
   }
 
-  const token = authHeader.substring(7)
-
   try {
     const decoded = verifyToken(token)
+    if (await isTokenRevoked(decoded)) {
+      throw new Error('Token has been revoked')
+    }
     req.token = decoded
     req.userId = decoded.sub
-    req.scope = decoded.scope || ''
+    req.scope = readTokenScope(decoded)
     next()
   } catch (err) {
     return res.status(401).json({
@@ -39,8 +71,8 @@ async function verifyAccessToken (req, res, next) {
   }
 }
 
-// GET /userinfo - Return user information
-router.get('/', verifyAccessToken, async (req, res, next) => {
+// Return user information (same response for GET and POST)
+async function sendUserinfo (req, res, next) {
   try {
     if (!req.userId) {
       return res.status(400).json({
@@ -57,11 +89,19 @@ router.get('/', verifyAccessToken, async (req, res, next) => {
       })
     }
 
-    const userinfo = buildUserinfoResponse(user, req.scope)
+    const userinfo = buildUserinfoResponse(user, req.scope, req.token.client_id)
+    // The same sub as the client's id_token, pairwise or not (OIDC Core 5.3.2)
+    userinfo.sub = subjectFor(await getClient(req.token.client_id), user.id)
     res.json(userinfo)
   } catch (err) {
     next(err)
   }
-})
+}
+
+// GET /userinfo - Return user information
+router.get('/', userinfoIpLimiter, verifyAccessToken, userinfoClientLimiter, sendUserinfo)
+
+// POST /userinfo - Same as GET; the token may also be sent as the access_token form parameter
+router.post('/', userinfoIpLimiter, verifyAccessToken, userinfoClientLimiter, sendUserinfo)
 
 module.exports = router
@@ -1,13 +1,41 @@
 const express = require('express')
-const crypto = require('crypto')
-const { getUserById, getUser, addUser, updateUser, deleteUser, getUsers, recordFailedLogin, clearFailedLoginAttempts } = require('../db')
-const { hashPassword, verifyPassword, validatePassword, validateUsername, validateEmail } = require('../users')
+const config = require('../config')
+const {
+  getUserById,
+  getUser,
+  updateUser,
+  deleteUser,
+  getUsers,
+  recordFailedLogin,
+  clearFailedLoginAttempts,
+  getClient,
+  getConsents,
+  revokeConsent,
+  revokeTokens
+} = require('../db')
+const {
+  createUser,
+  hashPassword,
+  verifyUserPassword,
+  validatePassword,
+  validateEmail,
+  validateLocale,
+  requestEmailVerification,
+  matchEmailVerification
+} = require('../users')
 const { authenticateBearerToken, requireScope } = require('../auth')
 const { loginLimiter, registerLimiter } = require('../middleware/rateLimit')
 const { OAuthError } = require('../errors')
+const { readTokenScope } = require('../scopes')
+const { logSecurityEvent } = require('../middleware/auditLog')
+const { verifyChallenge, loginNeedsChallenge } = require('../challenge')
+const { noStore } = require('../middleware/cacheControl')
 
 const router = express.Router()
 
+// User data and login tokens; never cache them
+router.use(noStore)
+
 // GET /users - List all users (requires scope: user:read)
 router.get('/', authenticateBearerToken, requireScope('user:read'), async (req, res, next) => {
   try {
@@ -26,6 +54,119 @@ router.get('/', authenticateBearerToken, requireScope('user:read'), async (req,
   }
 })
 
+// Profile fields users may change themselves; everything else (id, username,
+// roles, verification state, ...) is refused
+const PROFILE_FIELDS = ['name', 'email', 'locale']
+
+const toProfile = (user) => ({
+  sub: user.id,
+  username: user.username,
+  name: user.name,
+  email: user.email,
+  email_verified: user.email_verified || false,
+  locale: user.locale || null
+})
+
+// GET /users/me/profile - The caller's own profile (requires scope: user:read)
+router.get('/me/profile', authenticateBearerToken, requireScope('user:read'), async (req, res, next) => {
+  try {
+    const user = await getUserById(req.user.sub)
+    if (!user) {
+      return next(new OAuthError('invalid_request', 'User not found'))
+    }
+    res.json(toProfile(user))
+  } catch (err) {
+    next(err)
+  }
+})
+
+// PATCH /users/me/profile - Update the caller's profile (requires scope: user:write)
+// A new email address is unverified until the token sent to it is confirmed
+router.patch('/me/profile', authenticateBearerToken, requireScope('user:write'), async (req, res, next) => {
+  try {
+    const body = req.body || {}
+    const blocked = Object.keys(body).filter(field => !PROFILE_FIELDS.includes(field))
+    if (blocked.length > 0) {
+      logSecurityEvent({ type: 'PROFILE_UPDATE_REJECTED', userId: req.user.sub, fields: blocked })
+      return next(new OAuthError('invalid_request', `Field '${blocked[0]}' cannot be changed`))
+    }
+
+    const user = await getUserById(req.user.sub)
+    if (!user) {
+      return next(new OAuthError('invalid_request', 'User not found'))
+    }
+
+    const { name, email, locale } = body
+    const changes = {}
+    if (name !== undefined) {
+      if (typeof name !== 'string' || !name.trim() || name.length > 100) {
+        return next(new OAuthError('invalid_request', 'Name must be 1 to 100 characters'))
+      }
+      changes.name = name.trim()
+    }
+    if (locale !== undefined) {
+      validateLocale(locale)
+      changes.locale = locale
+    }
+    if (email !== undefined && email !== user.email) {
+      if (typeof email !== 'string') {
+        return next(new OAuthError('invalid_request', 'Invalid email format'))
+      }
+      validateEmail(email)
+      const users = await getUsers()
+      if (users.some(u => u.id !== user.id && u.email === email)) {
+        return next(new OAuthError('invalid_request', 'Email already exists'))
+      }
+      Object.assign(changes, await requestEmailVerification(user, email))
+    }
+
+    const fields = PROFILE_FIELDS.filter(field => field in changes)
+    if (fields.length === 0) {
+      return res.json(toProfile(user))
+    }
+
+    const updated = await updateUser(user.id, changes)
+    logSecurityEvent({
+      type: 'PROFILE_UPDATED',
+      userId: user.id,
+      fields,
+      email_verification_sent: 'email_verified' in changes
+    })
+    res.json(toProfile(updated))
+  } catch (err) {
+    if (err.message && (err.message.includes('Invalid') || err.message.includes('too long'))) {
+      return next(new OAuthError('invalid_request', err.message))
+    }
+    next(err)
+  }
+})
+
+// POST /users/me/email/verify - Confirm a new email address with the token
+// sent to it (requires scope: user:write)
+router.post('/me/email/verify', authenticateBearerToken, requireScope('user:write'), async (req, res, next) => {
+  try {
+    const { token } = req.body || {}
+    if (typeof token !== 'string' || !token) {
+      return next(new OAuthError('invalid_request', 'Missing required parameter: token'))
+    }
+
+    const user = await getUserById(req.user.sub)
+    if (!user) {
+      return next(new OAuthError('invalid_request', 'User not found'))
+    }
+    if (!matchEmailVerification(user, token)) {
+      logSecurityEvent({ type: 'EMAIL_VERIFICATION_FAILED', userId: user.id })
+      return next(new OAuthError('invalid_grant', 'Invalid or expired verification token'))
+    }
+
+    const updated = await updateUser(user.id, { email_verified: true, emailVerification: null })
+    logSecurityEvent({ type: 'EMAIL_VERIFIED', userId: user.id })
+    res.json(toProfile(updated))
+  } catch (err) {
+    next(err)
+  }
+})
+
 // GET /users/:id - Get specific user (requires scope: user:read)
 router.get('/:id', authenticateBearerToken, requireScope('user:read'), async (req, res, next) => {
   try {
@@ -35,7 +176,7 @@ router.get('/:id', authenticateBearerToken, requireScope('user:read'), async (re
     }
 
     // Users can only read their own data unless they have admin scope
-    const userScopes = (req.user.scope || '').split(' ').filter(s => s)
+    const userScopes = readTokenScope(req.user).split(' ').filter(s => s)
     if (req.user.sub !== req.params.id && !userScopes.includes('user:admin')) {
       return next(new OAuthError('invalid_request', 'Unauthorized to access this user'))
     }
@@ -52,47 +193,84 @@ router.get('/:id', authenticateBearerToken, requireScope('user:read'), async (re
   }
 })
 
-// POST /users - Create new user (with rate limiting)
-router.post('/', registerLimiter, async (req, res, next) => {
+// GET /users/:id/consents - Clients the user has granted access to (requires scope: user:read)
+router.get('/:id/consents', authenticateBearerToken, requireScope('user:read'), async (req, res, next) => {
   try {
-    const { username, email, password, name } = req.body
+    // Users can only read their own consents unless they have admin scope
+    const userScopes = readTokenScope(req.user).split(' ').filter(s => s)
+    if (req.user.sub !== req.params.id && !userScopes.includes('user:admin')) {
+      return next(new OAuthError('invalid_request', 'Unauthorized to access this user'))
+    }
 
-    // Validate input
-    if (!username || !email || !password) {
-      return next(new OAuthError('invalid_request', 'Missing required fields: username, email, password'))
+    const consents = (await getConsents())
+      .filter(c => c.userId === req.params.id && !c.revokedAt)
+
+    const result = []
+    for (const consent of consents) {
+      const client = await getClient(consent.client_id)
+      result.push({
+        client_id: consent.client_id,
+        client_name: client ? client.client_name || null : null,
+        scopes: consent.scopes,
+        granted_at: Math.floor(consent.grantedAt / 1000)
+      })
     }
+    res.json(result)
+  } catch (err) {
+    next(err)
+  }
+})
 
-    validateUsername(username)
-    validateEmail(email)
-    validatePassword(password)
+// DELETE /users/:id/consents/:clientId - Revoke a client's consent (requires scope: user:write)
+// The client must ask for consent again; revoke_tokens=true also invalidates
+// the access tokens already issued to it for this user
+router.delete('/:id/consents/:clientId', authenticateBearerToken, requireScope('user:write'), async (req, res, next) => {
+  try {
+    // Users can only revoke their own consents unless they have admin scope
+    const userScopes = readTokenScope(req.user).split(' ').filter(s => s)
+    if (req.user.sub !== req.params.id && !userScopes.includes('user:admin')) {
+      return next(new OAuthError('invalid_request', 'Unauthorized to update this user'))
+    }
 
-    // Check if user already exists
-    const existingUser = await getUser(username)
-    if (existingUser) {
-      return next(new OAuthError('invalid_request', 'Username already exists'))
+    const revoked = await revokeConsent(req.params.id, req.params.clientId)
+    if (!revoked) {
+      return next(new OAuthError('invalid_request', 'No consent found for this client'))
     }
 
-    // Check if email already exists
-    const users = await getUsers()
-    if (users.some(u => u.email === email)) {
-      return next(new OAuthError('invalid_request', 'Email already exists'))
+    const revokeExistingTokens = req.query.revoke_tokens === 'true'
+    if (revokeExistingTokens) {
+      await revokeTokens(req.params.id, req.params.clientId)
     }
 
-    // Hash password
-    const passwordHash = await hashPassword(password)
+    logSecurityEvent({
+      type: 'CONSENT_REVOKED',
+      userId: req.params.id,
+      client_id: req.params.clientId,
+      tokens_revoked: revokeExistingTokens,
+      actor: req.user.sub
+    })
+
+    res.status(204).end()
+  } catch (err) {
+    next(err)
+  }
+})
+
+// POST /users - Create new user (with rate limiting)
+router.post('/', registerLimiter, async (req, res, next) => {
+  try {
+    const { username, email, password, name } = req.body
+
+    // Validate input
+    if (!username || !email || !password) {
+      return next(new OAuthError('invalid_request', 'Missing required fields: username, email, password'))
+    }
 
-    // Create user
-    const user = {
-      id: 'user_' + crypto.randomBytes(8).toString('hex'),
-      username,
-      email,
-      name: name || username,
-      password: passwordHash,
-      createdAt: new Date().toISOString(),
-      failedLoginAttempts: 0
+    if (config.challenge.onRegistration && !(await verifyChallenge(req, 'register'))) {
+      return next(new OAuthError('invalid_request', 'Challenge verification failed'))
     }
 
-    await addUser(user)
+    const user = await createUser({ username, email, password, name })
 
     // Return sanitized user
     res.status(201).json({
@@ -116,7 +294,7 @@ router.put('/:id', authenticateBearerToken, requireScope('user:write'), async (r
     const { email, name, password } = req.body
 
     // Users can only update their own data unless they have admin scope
-    const userScopes = (req.user.scope || '').split(' ').filter(s => s)
+    const userScopes = readTokenScope(req.user).split(' ').filter(s => s)
     if (req.user.sub !== req.params.id && !userScopes.includes('user:admin')) {
       return next(new OAuthError('invalid_request', 'Unauthorized to update this user'))
     }
@@ -135,7 +313,9 @@ router.put('/:id', authenticateBearerToken, requireScope('user:write'), async (r
       if (users.some(u => u.id !== req.params.id && u.email === email)) {
         return next(new OAuthError('invalid_request', 'Email already exists'))
       }
-      updates.email = email
+      if (email !== user.email) {
+        Object.assign(updates, await requestEmailVerification(user, email))
+      }
     }
 
     if (name) {
@@ -198,12 +378,17 @@ router.post('/login', loginLimiter, async (req, res, next) => {
       return next(new OAuthError('invalid_grant', 'Invalid credentials'))
     }
 
+    // Ask for a challenge after repeated failures
+    if (loginNeedsChallenge(user) && !(await verifyChallenge(req, 'login'))) {
+      return next(new OAuthError('invalid_request', 'Challenge verification failed'))
+    }
+
     // Check if account is locked
     if (user.lockedUntil && user.lockedUntil > Date.now()) {
       return next(new OAuthError('invalid_grant', 'Account locked due to too many failed login attempts. Try again later.'))
     }
 
-    const validPassword = await verifyPassword(password, user.password)
+    const validPassword = await verifyUserPassword(user, password)
     if (!validPassword) {
       await recordFailedLogin(user.id)
       return next(new OAuthError('invalid_grant', 'Invalid credentials'))
@@ -213,14 +398,14 @@ router.post('/login', loginLimiter, async (req, res, next) => {
     await clearFailedLoginAttempts(user.id)
 
     // Generate access token with user scope
-    const { generateToken } = require('../tokens')
-    const token = generateToken({
+    const { generateToken, withDefaultClaims } = require('../tokens')
+    const token = generateToken(withDefaultClaims({
       sub: user.id,
       username: user.username,
       email: user.email,
       token_type: 'access',
       scope: 'user:read user:write'
-    })
+    }, null))
 
     res.json({
       access_token: token,
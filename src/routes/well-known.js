@@ -3,6 +3,15 @@
 const express = require('express')
 const config = require('../config')
 const { getClients } = require('../db')
+const { SUPPORTED_ALGS } = require('../dpop')
+const { SUPPORTED_ALGS: ASSERTION_ALGS } = require('../clientAssertion')
+const { PROMPT_VALUES, DISPLAY_VALUES } = require('../oidc')
+const { ACR_VALUES } = require('../acr')
+const { SUBJECT_TYPES, pairwiseSupported } = require('../pairwise')
+const { DEVICE_CODE_GRANT } = require('../deviceFlow')
+const { grantTypeEnabled, enabledGrantTypes } = require('../grantTypes')
+const { getSupportedAlgorithms } = require('../tokens')
+const { cacheFor } = require('../middleware/cacheControl')
 
 const router = express.Router()
 
@@ -20,71 +29,53 @@ async function getAllScopes () {
   return Array.from(clientScopes).sort()
 }
 
-router.get('/oauth-authorization-server', async (req, res) => {
+// Authorization server metadata (RFC 8414). The OIDC discovery document is a
+// superset of it, so the two always agree where they overlap.
+async function authorizationServerMetadata () {
   const issuer = config.issuer
   const scopes_supported = await getAllScopes()
 
-  res.json({
+  return {
     issuer,
     authorization_endpoint: `${issuer}${config.endpoints.authorize}`,
     token_endpoint: `${issuer}${config.endpoints.token}`,
-    userinfo_endpoint: config.endpoints.userinfo ? `${issuer}${config.endpoints.userinfo}` : undefined,
     jwks_uri: `${issuer}${config.endpoints.jwks}`,
     registration_endpoint: `${issuer}/register`,
+    revocation_endpoint: config.endpoints.revoke ? `${issuer}${config.endpoints.revoke}` : undefined,
+    introspection_endpoint: config.endpoints.introspect ? `${issuer}${config.endpoints.introspect}` : undefined,
+    device_authorization_endpoint: grantTypeEnabled(DEVICE_CODE_GRANT) ? `${issuer}/device/code` : undefined,
     scopes_supported,
-    response_types_supported: ['code', 'token', 'id_token', 'code id_token'],
-    grant_types_supported: ['authorization_code', 'client_credentials', 'refresh_token'],
-    token_endpoint_auth_methods_supported: ['client_secret_basic', 'client_secret_post', 'none'],
+    // The implicit and hybrid flows are not offered (see routes/authorize.js)
+    response_types_supported: ['code'],
+    response_modes_supported: ['query', 'fragment', 'form_post'],
+    authorization_response_iss_parameter_supported: true,
+    grant_types_supported: enabledGrantTypes(),
+    token_endpoint_auth_methods_supported: ['client_secret_basic', 'client_secret_post', 'private_key_jwt', 'none'],
+    token_endpoint_auth_signing_alg_values_supported: ASSERTION_ALGS,
     code_challenge_methods_supported: config.features.pkce ? ['S256', 'plain'] : [],
-    claims_supported: [
-      'sub',
-      'iss',
-      'aud',
-      'exp',
-      'iat',
-      'nonce',
-      'auth_time',
-      'name',
-      'given_name',
-      'family_name',
-      'preferred_username',
-      'email',
-      'email_verified',
-      'picture',
-      'updated_at',
-      config.claims.scopeClaimName,
-      config.claims.rolesClaimName,
-      config.claims.groupsClaimName,
-      config.claims.permissionsClaimName
-    ].filter(Boolean),
-    subject_types_supported: ['public']
-  })
+    dpop_signing_alg_values_supported: config.dpop.enabled ? SUPPORTED_ALGS : undefined
+  }
+}
+
+// OAuth 2.0 authorization server metadata endpoint (RFC 8414)
+router.get('/oauth-authorization-server', cacheFor('discoveryMaxAge'), async (req, res) => {
+  res.json(await authorizationServerMetadata())
 })
 
-// OIDC discovery endpoint (same as oauth-authorization-server)
-router.get('/openid-configuration', async (req, res) => {
+// OIDC discovery endpoint: the RFC 8414 metadata plus the OpenID Connect fields
+router.get('/openid-configuration', cacheFor('discoveryMaxAge'), async (req, res) => {
   const issuer = config.issuer
-  const scopes_supported = await getAllScopes()
+  const algorithms = getSupportedAlgorithms()
+  // A capability without algorithms is left out rather than advertised empty
+  const advertised = (algs) => algs.length > 0 ? algs : undefined
 
   res.json({
-    issuer,
-    authorization_endpoint: `${issuer}${config.endpoints.authorize}`,
-    token_endpoint: `${issuer}${config.endpoints.token}`,
+    ...(await authorizationServerMetadata()),
     userinfo_endpoint: config.endpoints.userinfo ? `${issuer}${config.endpoints.userinfo}` : undefined,
-    jwks_uri: `${issuer}${config.endpoints.jwks}`,
-    registration_endpoint: `${issuer}/register`,
-    revocation_endpoint: config.endpoints.revoke ? `${issuer}${config.endpoints.revoke}` : undefined,
-    introspection_endpoint: config.endpoints.introspect ? `${issuer}${config.endpoints.introspect}` : undefined,
     end_session_endpoint: config.endpoints.logout ? `${issuer}${config.endpoints.logout}` : undefined,
-    scopes_supported,
-    response_types_supported: ['code', 'token', 'id_token', 'code id_token'],
-    response_modes_supported: ['query', 'fragment'],
-    grant_types_supported: config.features.refreshTokens
-      ? ['authorization_code', 'client_credentials', 'refresh_token']
-      : ['authorization_code', 'client_credentials'],
-    token_endpoint_auth_methods_supported: ['client_secret_basic', 'client_secret_post', 'none'],
-    token_endpoint_auth_signing_alg_values_supported: [config.tokens.signingAlgorithm],
-    code_challenge_methods_supported: config.features.pkce ? ['S256', 'plain'] : [],
+    prompt_values_supported: PROMPT_VALUES,
+    display_values_supported: DISPLAY_VALUES,
+    acr_values_supported: ACR_VALUES,
     claims_supported: [
       'sub',
       'iss',
@@ -93,6 +84,8 @@ router.get('/openid-configuration', async (req, res) => {
       'iat',
       'nonce',
       'auth_time',
+      'acr',
+      'amr',
       'name',
       'given_name',
       'family_name',
@@ -106,12 +99,17 @@ router.get('/openid-configuration', async (req, res) => {
       config.claims.groupsClaimName,
       config.claims.permissionsClaimName
     ].filter(Boolean),
-    subject_types_supported: ['public'],
-    id_token_signing_alg_values_supported: [config.tokens.signingAlgorithm],
+    // Essential userinfo claims are enforced at authorization (OIDC Core 5.5)
+    claims_parameter_supported: true,
+    subject_types_supported: pairwiseSupported() ? SUBJECT_TYPES : ['public'],
+    id_token_signing_alg_values_supported: algorithms.id_token_signed_response_alg,
     id_token_encryption_alg_values_supported: [],
     id_token_encryption_enc_values_supported: [],
-    userinfo_signing_alg_values_supported: [config.tokens.signingAlgorithm],
-    request_object_signing_alg_values_supported: [config.tokens.signingAlgorithm]
+    userinfo_signing_alg_values_supported: advertised(algorithms.userinfo_signed_response_alg),
+    request_object_signing_alg_values_supported: advertised(algorithms.request_object_signing_alg),
+    // Request objects are not accepted, by value or by reference (OIDC Core 6)
+    request_parameter_supported: false,
+    request_uri_parameter_supported: false
   })
 })
 
@@ -0,0 +1,83 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Per-client scope baselines
+ *
+ * Learns the scopes each client is usually granted and flags token requests
+ * asking for others, which may mean the client's credentials are being
+ * abused. In 'monitor' mode such requests are only audited; in 'enforce'
+ * mode they are refused.
+ *
+ * A baseline learns every scope of a client's first learningRequests token
+ * requests. After that, a new scope joins the baseline once it has been
+ * granted adoptAfter times, up to maxScopes scopes. Refused requests never
+ * count, so an enforced baseline only grows through an admin reset.
+ */
+
+const config = require('./config')
+const { getScopeBaseline, saveScopeBaseline } = require('./db')
+const { logSecurityEvent } = require('./middleware/auditLog')
+
+const SCOPE_BASELINE_MODES = ['off', 'monitor', 'enforce']
+
+function newBaseline (clientId) {
+  return { client_id: clientId, requests: 0, scopes: [], candidates: {} }
+}
+
+/**
+ * Check a token request's scopes against the client's baseline and learn
+ * from it
+ * @param {object} client - Registered client
+ * @param {string} scope - Space-separated scopes about to be granted
+ * @returns {Promise<object>} { unusual, blocked }: the scopes outside the
+ *   baseline, and whether the request must be refused
+ */
+async function checkScopeBaseline (client, scope) {
+  const { mode, learningRequests, adoptAfter, maxScopes } = config.scopeBaseline
+  if (mode === 'off') {
+    return { unusual: [], blocked: false }
+  }
+
+  const scopes = [...new Set((scope || '').split(' ').filter(s => s))]
+  const baseline = (await getScopeBaseline(client.client_id)) || newBaseline(client.client_id)
+  const learning = baseline.requests < learningRequests
+  const unusual = learning ? [] : scopes.filter(s => !baseline.scopes.includes(s))
+
+  if (unusual.length > 0) {
+    logSecurityEvent({
+      type: 'SCOPE_BASELINE_EXCEEDED',
+      client_id: client.client_id,
+      scope,
+      unusual_scopes: unusual,
+      mode
+    })
+    if (mode === 'enforce') {
+      return { unusual, blocked: true }
+    }
+  }
+
+  baseline.requests++
+  for (const s of scopes) {
+    if (baseline.scopes.includes(s) || baseline.scopes.length >= maxScopes) {
+      continue
+    }
+    if (learning) {
+      baseline.scopes.push(s)
+      continue
+    }
+    baseline.candidates[s] = (baseline.candidates[s] || 0) + 1
+    if (baseline.candidates[s] >= adoptAfter) {
+      baseline.scopes.push(s)
+      delete baseline.candidates[s]
+      logSecurityEvent({ type: 'SCOPE_BASELINE_ADOPTED', client_id: client.client_id, scope: s })
+    }
+  }
+  await saveScopeBaseline(baseline)
+
+  return { unusual, blocked: false }
+}
+
+module.exports = {
+  SCOPE_BASELINE_MODES,
+  checkScopeBaseline
+}
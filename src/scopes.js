@@ -0,0 +1,183 @@
+/**
+ * Scope helpers
+ */
+
+const config = require('./config')
+
+/**
+ * Normalize a requested scope parameter: split on whitespace (and on commas
+ * when the legacy compatibility flag is on), drop empty entries and
+ * duplicates, and rejoin with single spaces in first-seen order.
+ *
+ * @param {string} scope - Raw scope parameter
+ * @param {boolean} allowCommas - Also treat commas as delimiters
+ * @returns {string|undefined} Normalized scope, or the input when it is not a string
+ */
+function normalizeScope (scope, allowCommas = config.scopeParsing.allowCommas) {
+  if (typeof scope !== 'string') {
+    return scope
+  }
+  const delimiter = allowCommas ? /[\s,]+/ : /\s+/
+  return [...new Set(scope.split(delimiter).filter(s => s))].join(' ')
+}
+
+/**
+ * Check a normalized scope against the configured caps on the number of
+ * scopes and the length of the whole parameter. Duplicates are already
+ * collapsed, so repeating a scope does not count against the caps.
+ *
+ * @param {string} scope - Normalized scope
+ * @param {object} limits - maxScopes and maxScopeLength (0 = unlimited)
+ * @returns {string|null} Why the scope is rejected, or null when it is within the caps
+ */
+function scopeLimitError (scope, { maxScopes, maxScopeLength } = config.scopeParsing) {
+  if (typeof scope !== 'string') {
+    return null
+  }
+  const count = scope.split(' ').filter(s => s).length
+  if (maxScopes > 0 && count > maxScopes) {
+    return `At most ${maxScopes} scopes may be requested, got ${count}`
+  }
+  if (maxScopeLength > 0 && scope.length > maxScopeLength) {
+    return `The scope parameter may be at most ${maxScopeLength} characters, got ${scope.length}`
+  }
+  return null
+}
+
+/**
+ * Expand a scope string using the configured scope hierarchy so that coarse
+ * scopes also grant the finer scopes they imply (e.g. admin -> write -> read).
+ * Cycles in the hierarchy are tolerated: each scope is visited once.
+ *
+ * @param {string} scope - Space-separated granted scopes
+ * @param {object} hierarchy - Map of scope -> implied scopes
+ * @returns {string} Space-separated scopes including implied ones
+ */
+function expandScopes (scope, hierarchy = config.scopeHierarchy || {}) {
+  const granted = (scope || '').split(' ').filter(s => s)
+  const expanded = []
+  const queue = [...granted]
+
+  while (queue.length > 0) {
+    const current = queue.shift()
+    if (expanded.includes(current)) {
+      continue
+    }
+    expanded.push(current)
+    for (const implied of hierarchy[current] || []) {
+      queue.push(implied)
+    }
+  }
+
+  return expanded.join(' ')
+}
+
+// Scopes that describe the end user and only make sense with one present
+const USER_IDENTITY_SCOPES = ['openid', 'profile', 'email', 'address', 'phone', 'offline_access']
+
+/**
+ * Split a scope string into the scopes a client_credentials grant may carry
+ * and the user-identity scopes it may not (there is no end user).
+ *
+ * @param {string} scope - Space-separated requested scopes
+ * @returns {{scope: string, userScopes: string[]}} Remaining scope and removed user scopes
+ */
+function splitUserScopes (scope) {
+  const scopes = (scope || '').split(' ').filter(s => s)
+  return {
+    scope: scopes.filter(s => !USER_IDENTITY_SCOPES.includes(s)).join(' '),
+    userScopes: scopes.filter(s => USER_IDENTITY_SCOPES.includes(s))
+  }
+}
+
+/**
+ * Requested scopes that are configured as client_credentials-only and so
+ * must not be granted through an interactive flow.
+ *
+ * @param {string} scope - Space-separated requested scopes
+ * @param {string[]} machineOnly - Machine-only scopes
+ * @returns {string[]} The machine-only scopes present in scope
+ */
+function findMachineOnlyScopes (scope, machineOnly = config.scopePolicy.machineOnlyScopes) {
+  return (scope || '').split(' ').filter(s => s && machineOnly.includes(s))
+}
+
+// Scope that unlocks the /admin API
+const ADMIN_SCOPE = 'admin'
+
+/**
+ * Whether a client may be granted the admin scope: only clients listed in
+ * NGAUTH_ADMIN_CLIENTS or seeded with admin_access. Dynamic registration
+ * cannot set either.
+ *
+ * @param {object} client - Client record
+ * @param {string[]} adminClients - Allow-listed client IDs
+ * @returns {boolean}
+ */
+function adminScopeAllowed (client, adminClients = config.scopePolicy.adminClients) {
+  return Boolean(client) && (adminClients.includes(client.client_id) || client.admin_access === true)
+}
+
+/**
+ * Check a scope, including the scopes it implies through the hierarchy,
+ * for an admin scope the client may not be granted
+ *
+ * @param {string} scope - Space-separated scopes
+ * @param {object} client - Client record
+ * @returns {string|null} Why the scope is rejected, or null when it may be granted
+ */
+function adminScopeError (scope, client) {
+  if (!expandScopes(scope).split(' ').includes(ADMIN_SCOPE) || adminScopeAllowed(client)) {
+    return null
+  }
+  return `Scope '${ADMIN_SCOPE}' is not available to this client`
+}
+
+/**
+ * Access token claim for the granted scopes, named and shaped as configured
+ * (NGAUTH_SCOPE_CLAIM_NAME, NGAUTH_SCOPE_FORMAT): a space-delimited string or
+ * an array. The token response scope is always a string (RFC 6749 5.1).
+ *
+ * @param {string} scope - Space-separated granted scopes
+ * @param {object} claims - Claim settings (scopeClaimName, scopeFormat)
+ * @returns {{name: string, value: string|string[]}} Claim name and value
+ */
+function toScopeClaim (scope, { scopeClaimName, scopeFormat } = config.claims) {
+  const name = scopeClaimName || 'scope'
+  if (scopeFormat === 'array') {
+    return { name, value: (scope || '').split(' ').filter(s => s) }
+  }
+  return { name, value: scope || '' }
+}
+
+/**
+ * Granted scopes of a decoded access token as a space-separated string,
+ * whichever representation it was issued with. Tokens issued before the
+ * claim settings changed are read from the plain scope claim.
+ *
+ * @param {object} claims - Decoded access token
+ * @param {object} settings - Claim settings (scopeClaimName)
+ * @returns {string} Space-separated scopes
+ */
+function readTokenScope (claims, { scopeClaimName } = config.claims) {
+  const name = scopeClaimName || 'scope'
+  const value = claims[name] !== undefined ? claims[name] : claims.scope
+  if (Array.isArray(value)) {
+    return value.filter(s => typeof s === 'string' && s).join(' ')
+  }
+  return typeof value === 'string' ? value : ''
+}
+
+module.exports = {
+  USER_IDENTITY_SCOPES,
+  normalizeScope,
+  scopeLimitError,
+  expandScopes,
+  splitUserScopes,
+  findMachineOnlyScopes,
+  ADMIN_SCOPE,
+  adminScopeAllowed,
+  adminScopeError,
+  toScopeClaim,
+  readTokenScope
+}
@@ -0,0 +1,215 @@
+/* eslint camelcase: "off" */
+
+/**
+ * Declarative seeding of clients and users
+ *
+ * NGAUTH_SEED_FILE names a JSON file with { clients: [...], users: [...] }
+ * that is applied at startup. Entries are matched by client_id and username:
+ * missing ones are created, changed ones updated, so restarts never create
+ * duplicates. Secrets may be given inline or read from an environment
+ * variable (client_secret_env, password_env) or a file (client_secret_file,
+ * password_file) as mounted by a secrets manager. Secrets are never logged.
+ */
+
+const fs = require('fs').promises
+const { getClient, addClient, updateClient, getUser, addUser, updateUser } = require('./db')
+const { hashPassword, verifyPassword, validateUsername, validateEmail, validatePassword } = require('./users')
+const { validateClientKeyId, validateDefaultClaims } = require('./tokens')
+
+// Client metadata a seed may set (secrets are resolved separately)
+const CLIENT_FIELDS = [
+  'client_name', 'redirect_uris', 'post_logout_redirect_uris', 'grant_types', 'response_types', 'scope', 'redirect_uri_matching',
+  'allowed_cors_origins', 'authorization_details_types', 'default_audience', 'resource_identifiers',
+  'id_token_signed_response_alg', 'id_token_lifetime', 'jwks_uri', 'jwks', 'signing_key_id',
+  'skip_consent', 'session_bridge', 'default_claims', 'admin_access'
+]
+
+// Defaults for new clients, as for dynamic registration
+const CLIENT_DEFAULTS = {
+  grant_types: ['authorization_code'],
+  response_types: ['code'],
+  scope: '',
+  redirect_uri_matching: 'exact',
+  allowed_cors_origins: [],
+  authorization_details_types: []
+}
+
+const USER_FIELDS = ['email', 'name', 'totpSecret', 'upstream_claims']
+
+/**
+ * Resolve a secret given inline, by environment variable or by file
+ * @param {object} entry - Seed entry
+ * @param {string} field - Secret field name ('client_secret', 'password')
+ * @param {string} label - Entry label for error messages
+ * @returns {Promise<string|undefined>}
+ */
+async function resolveSecret (entry, field, label) {
+  const envName = entry[`${field}_env`]
+  if (envName !== undefined) {
+    const value = process.env[envName]
+    if (!value) {
+      throw new Error(`${label}: environment variable ${envName} for ${field} is not set`)
+    }
+    return value
+  }
+  const file = entry[`${field}_file`]
+  if (file !== undefined) {
+    try {
+      return (await fs.readFile(file, 'utf8')).trim()
+    } catch (err) {
+      throw new Error(`${label}: cannot read ${field} from ${file}`)
+    }
+  }
+  return entry[field]
+}
+
+// Fields of `wanted` whose values differ from `current`
+function changedFields (current, wanted) {
+  const changes = {}
+  for (const [name, value] of Object.entries(wanted)) {
+    if (value !== undefined && JSON.stringify(current[name]) !== JSON.stringify(value)) {
+      changes[name] = value
+    }
+  }
+  return changes
+}
+
+async function seedClient (entry, summary) {
+  if (!entry || typeof entry.client_id !== 'string' || !entry.client_id) {
+    throw new Error('Seed client without client_id')
+  }
+  const label = `Seed client ${entry.client_id}`
+  if (!Array.isArray(entry.redirect_uris) && !(entry.grant_types || []).includes('client_credentials')) {
+    throw new Error(`${label}: redirect_uris is required`)
+  }
+  // Clients of one tenant may share a signing key by sharing its ID
+  if (entry.signing_key_id !== undefined) {
+    validateClientKeyId(entry.signing_key_id)
+  }
+  if (entry.admin_access !== undefined && typeof entry.admin_access !== 'boolean') {
+    throw new Error(`${label}: admin_access must be a boolean`)
+  }
+  if (entry.session_bridge && !entry.skip_consent) {
+    throw new Error(`${label}: session_bridge needs skip_consent`)
+  }
+  if (entry.default_claims !== undefined) {
+    try {
+      validateDefaultClaims(entry.default_claims)
+    } catch (err) {
+      throw new Error(`${label}: ${err.message}`)
+    }
+  }
+
+  const wanted = {}
+  for (const field of CLIENT_FIELDS) {
+    wanted[field] = entry[field]
+  }
+  wanted.client_secret = await resolveSecret(entry, 'client_secret', label)
+
+  const existing = await getClient(entry.client_id)
+  if (!existing) {
+    await addClient({
+      client_id: entry.client_id,
+      client_name: `Client ${entry.client_id}`,
+      redirect_uris: [],
+      ...CLIENT_DEFAULTS,
+      ...Object.fromEntries(Object.entries(wanted).filter(([, v]) => v !== undefined)),
+      created_at: Date.now()
+    })
+    summary.clients.created++
+    return
+  }
+
+  const changes = changedFields(existing, wanted)
+  if (Object.keys(changes).length > 0) {
+    await updateClient(existing.client_id, changes)
+    summary.clients.updated++
+  }
+}
+
+async function seedUser (entry, summary) {
+  if (!entry || typeof entry.username !== 'string') {
+    throw new Error('Seed user without username')
+  }
+  const label = `Seed user ${entry.username}`
+  validateUsername(entry.username)
+  if (entry.email !== undefined) {
+    validateEmail(entry.email)
+  }
+  const upstream = entry.upstream_claims
+  if (upstream !== undefined && (!upstream || typeof upstream !== 'object' || Array.isArray(upstream))) {
+    throw new Error(`${label}: upstream_claims must be an object`)
+  }
+  const password = await resolveSecret(entry, 'password', label)
+
+  const wanted = {}
+  for (const field of USER_FIELDS) {
+    wanted[field] = entry[field]
+  }
+
+  const existing = await getUser(entry.username)
+  if (!existing) {
+    if (!password) {
+      throw new Error(`${label}: password is required`)
+    }
+    validatePassword(password)
+    await addUser({
+      id: entry.id || `user_seed_${entry.username}`,
+      username: entry.username,
+      ...Object.fromEntries(Object.entries(wanted).filter(([, v]) => v !== undefined)),
+      name: entry.name || entry.username,
+      password: await hashPassword(password),
+      createdAt: new Date().toISOString(),
+      failedLoginAttempts: 0
+    })
+    summary.users.created++
+    return
+  }
+
+  const changes = changedFields(existing, wanted)
+  if (password && !(await verifyPassword(password, existing.password))) {
+    validatePassword(password)
+    changes.password = await hashPassword(password)
+  }
+  if (Object.keys(changes).length > 0) {
+    await updateUser(existing.id, changes)
+    summary.users.updated++
+  }
+}
+
+/**
+ * Create or update the seeded clients and users
+ * @param {object} seed - { clients, users }
+ * @returns {Promise<object>} Counts of created and updated entries
+ */
+async function applySeed (seed) {
+  const summary = { clients: { created: 0, updated: 0 }, users: { created: 0, updated: 0 } }
+  for (const entry of seed.clients || []) {
+    await seedClient(entry, summary)
+  }
+  for (const entry of seed.users || []) {
+    await seedUser(entry, summary)
+  }
+  return summary
+}
+
+/**
+ * Read and apply a seed file
+ * @param {string} file - Path to the JSON seed file
+ * @returns {Promise<object>} Counts of created and updated entries
+ */
+async function seedFromFile (file) {
+  let seed
+  try {
+    seed = JSON.parse(await fs.readFile(file, 'utf8'))
+  } catch (err) {
+    // The parser's message may quote the file, secrets included
+    throw new Error(`Cannot load seed file ${file}: ${err instanceof SyntaxError ? 'invalid JSON' : err.code}`)
+  }
+  return applySeed(seed)
+}
+
+module.exports = {
+  applySeed,
+  seedFromFile
+}
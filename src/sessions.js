@@ -0,0 +1,214 @@
+/**
+ * Per-user session limits
+ *
+ * Tracks the sessions each user is signed in with so operators can cap
+ * concurrent sessions (NGAUTH_MAX_SESSIONS_PER_USER). Past the cap the oldest
+ * session is destroyed (evict-oldest) or the new login is refused (deny-new).
+ * Codes and device grants approved in a session carry its sessionRef into
+ * their refresh tokens, so evicting the session revokes those too; otherwise
+ * a refresh token would outlive the cap.
+ *
+ * A browser session can hold several signed-in accounts (prompt=select_account).
+ * The active one is kept in session.userId, authTime and amr; the others wait
+ * in session.accounts until the user switches to them.
+ *
+ * Authorization request nonces are bound to the browser session that made
+ * the request and consumed when the code carrying them is issued, so a nonce
+ * cannot be replayed or carried into another session.
+ *
+ * The session cookie's name and attributes come from config.sessionCookie.
+ */
+
+const crypto = require('crypto')
+const config = require('./config')
+const { deleteRefreshTokensBySession, revokeIssuedTokensByGrant } = require('./db')
+const { logSecurityEvent } = require('./middleware/auditLog')
+
+/**
+ * express-session name and cookie options from config.sessionCookie
+ * @param {object} cookieConfig - Defaults to config.sessionCookie
+ * @returns {object} { name, cookie }
+ */
+function sessionCookieOptions (cookieConfig = config.sessionCookie) {
+  const { name, secure, httpOnly, sameSite, domain, path } = cookieConfig
+  const cookie = { secure, httpOnly, sameSite, path }
+  if (domain) {
+    cookie.domain = domain
+  }
+  return { name, cookie }
+}
+
+// userId -> [{ sid, createdAt }], oldest first
+const sessionsByUser = new Map()
+
+function getStoredSession (store, sid) {
+  return new Promise(resolve => {
+    store.get(sid, (err, sess) => resolve(err ? null : sess))
+  })
+}
+
+/**
+ * Accounts signed in within a browser session, the active one first
+ * @param {object} session - express-session session
+ * @returns {Array<{userId: string, authTime: number, amr: string[]}>}
+ */
+function sessionAccounts (session) {
+  const others = (session.accounts || []).filter(a => a.userId !== session.userId)
+  if (!session.userId) {
+    return others
+  }
+  return [{ userId: session.userId, authTime: session.authTime, amr: session.amr }, ...others]
+}
+
+/**
+ * Make another account of the browser session the active one
+ * @param {object} session - express-session session
+ * @param {string} userId - Account to switch to
+ * @returns {boolean} false when the account is not signed in here
+ */
+function switchAccount (session, userId) {
+  const accounts = sessionAccounts(session)
+  const chosen = accounts.find(a => a.userId === userId)
+  if (!chosen) {
+    return false
+  }
+  session.accounts = accounts.filter(a => a !== chosen)
+  session.userId = chosen.userId
+  session.authTime = chosen.authTime
+  session.amr = chosen.amr
+  return true
+}
+
+// Nonces remembered per browser session, pending and consumed alike; the
+// oldest are forgotten first
+const MAX_SESSION_NONCES = 20
+
+const nonceKey = (clientId, nonce) => `${clientId} ${nonce}`
+
+function remember (list, key) {
+  return [...list.filter(k => k !== key), key].slice(-MAX_SESSION_NONCES)
+}
+
+/**
+ * Bind an authorization request nonce to the browser session
+ * @param {object} session - express-session session
+ * @param {string} clientId - Client that sent the request
+ * @param {string} nonce - The request's nonce
+ * @returns {boolean} false when the nonce was already consumed in this session
+ */
+function bindNonce (session, clientId, nonce) {
+  const key = nonceKey(clientId, nonce)
+  const { pending = [], consumed = [] } = session.nonces || {}
+  if (consumed.includes(key)) {
+    return false
+  }
+  session.nonces = { pending: remember(pending, key), consumed }
+  return true
+}
+
+/**
+ * Consume a nonce bound with bindNonce as its code is issued
+ * @param {object} session - express-session session
+ * @param {string} clientId - Client the code is issued to
+ * @param {string} nonce - Nonce the code carries
+ * @returns {string|null} Why the nonce cannot be used ('replayed' or
+ *   'unbound'), or null once consumed
+ */
+function consumeNonce (session, clientId, nonce) {
+  const key = nonceKey(clientId, nonce)
+  const { pending = [], consumed = [] } = session.nonces || {}
+  if (consumed.includes(key)) {
+    return 'replayed'
+  }
+  if (!pending.includes(key)) {
+    return 'unbound'
+  }
+  session.nonces = { pending: pending.filter(k => k !== key), consumed: remember(consumed, key) }
+  return null
+}
+
+// Forget tracked sessions that expired, were destroyed or no longer hold the user
+async function dropStaleSessions (store, userId) {
+  const stale = new Set()
+  for (const { sid } of sessionsByUser.get(userId) || []) {
+    const sess = await getStoredSession(store, sid)
+    if (!sess || !sessionAccounts(sess).some(a => a.userId === userId)) {
+      stale.add(sid)
+    }
+  }
+  if (stale.size > 0) {
+    sessionsByUser.set(userId, (sessionsByUser.get(userId) || []).filter(e => !stale.has(e.sid)))
+  }
+}
+
+/**
+ * Reference to a login session kept with what it issues. A hash, so the data
+ * files never hold a session ID.
+ * @param {string} sid - express-session ID
+ * @returns {string}
+ */
+function sessionRef (sid) {
+  return crypto.createHash('sha256').update(sid).digest('base64url')
+}
+
+// Revoke the refresh tokens issued from a session and the access tokens of
+// their grants; returns how many refresh tokens were revoked
+async function revokeSessionGrants (sid) {
+  const grantIds = await deleteRefreshTokensBySession(sessionRef(sid))
+  for (const grantId of new Set(grantIds.filter(Boolean))) {
+    await revokeIssuedTokensByGrant(grantId)
+  }
+  return grantIds.length
+}
+
+/**
+ * Sign a user into the request's session, enforcing the per-user session cap
+ * @param {object} req - Express request (with express-session)
+ * @param {string} userId - User to sign in
+ * @returns {Promise<boolean>} false when the deny-new policy refused the login
+ */
+async function startUserSession (req, userId) {
+  const { maxPerUser, limitPolicy } = config.sessions
+
+  if (maxPerUser > 0) {
+    await dropStaleSessions(req.sessionStore, userId)
+
+    // No awaits from here on, so the check and the bookkeeping happen atomically
+    const active = (sessionsByUser.get(userId) || []).filter(e => e.sid !== req.sessionID)
+    let evicted = []
+    if (active.length >= maxPerUser) {
+      if (limitPolicy === 'deny-new') {
+        logSecurityEvent({ type: 'SESSION_LIMIT_REACHED', userId, limit: maxPerUser })
+        return false
+      }
+      evicted = active.splice(0, active.length - maxPerUser + 1)
+    }
+    active.push({ sid: req.sessionID, createdAt: Date.now() })
+    sessionsByUser.set(userId, active)
+
+    // Revoke evicted sessions immediately, with the grants issued from them
+    for (const { sid } of evicted) {
+      req.sessionStore.destroy(sid, () => {})
+      const refreshTokensRevoked = await revokeSessionGrants(sid)
+      logSecurityEvent({ type: 'SESSION_EVICTED', userId, limit: maxPerUser, refresh_tokens_revoked: refreshTokensRevoked })
+    }
+  }
+
+  // Accounts already signed in here stay available for switching
+  req.session.accounts = sessionAccounts(req.session).filter(a => a.userId !== userId)
+  req.session.userId = userId
+  req.session.authTime = Date.now()
+  // Signed in with a password (RFC 8176); step-up adds further methods
+  req.session.amr = ['pwd']
+  return true
+}
+
+module.exports = {
+  sessionCookieOptions,
+  sessionRef,
+  startUserSession,
+  sessionAccounts,
+  switchAccount,
+  bindNonce,
+  consumeNonce
+}
@@ -0,0 +1,133 @@
+/**
+ * Protection of stored tokens
+ *
+ * Authorization codes and refresh tokens are stored under a SHA-256 hash of
+ * their value, so a dump of the data files yields nothing that can be
+ * redeemed. With NGAUTH_STORE_ENCRYPTION_KEY set, the sensitive fields kept
+ * alongside them are also encrypted with AES-256-GCM.
+ */
+
+const crypto = require('crypto')
+const config = require('./config')
+
+const ENCRYPTED_PREFIX = 'enc:v1:'
+
+// Hash of a token value, used as its lookup key in the store
+function hashTokenValue (value) {
+  return crypto.createHash('sha256').update(String(value)).digest('hex')
+}
+
+let derivedKey
+let derivedFrom
+
+// 256-bit key derived from the configured secret (cached until the secret changes)
+function encryptionKey () {
+  const secret = config.storeEncryption.secret
+  if (!secret) {
+    return null
+  }
+  if (secret !== derivedFrom) {
+    derivedKey = Buffer.from(crypto.hkdfSync('sha256', secret, '', 'ngauth store encryption', 32))
+    derivedFrom = secret
+  }
+  return derivedKey
+}
+
+/**
+ * Encrypt a field value for storage. Without a configured key the value is
+ * returned unchanged.
+ * @param {*} value - Any JSON-serializable value
+ * @returns {*} 'enc:v1:<iv>.<tag>.<ciphertext>' (base64url parts) or the value
+ */
+function encryptField (value) {
+  const key = encryptionKey()
+  if (!key || value === undefined || value === null) {
+    return value
+  }
+  const iv = crypto.randomBytes(12)
+  const cipher = crypto.createCipheriv('aes-256-gcm', key, iv)
+  const data = Buffer.concat([cipher.update(JSON.stringify(value), 'utf8'), cipher.final()])
+  return ENCRYPTED_PREFIX + [iv, cipher.getAuthTag(), data].map(b => b.toString('base64url')).join('.')
+}
+
+/**
+ * Decrypt a stored field value. Values stored without encryption are
+ * returned unchanged.
+ * @param {*} value - Stored value
+ * @returns {*} Original value
+ * @throws {Error} When the value is encrypted and no (or the wrong) key is configured
+ */
+function decryptField (value) {
+  if (typeof value !== 'string' || !value.startsWith(ENCRYPTED_PREFIX)) {
+    return value
+  }
+  const key = encryptionKey()
+  if (!key) {
+    throw new Error('Stored data is encrypted but NGAUTH_STORE_ENCRYPTION_KEY is not set')
+  }
+  const [iv, tag, data] = value.slice(ENCRYPTED_PREFIX.length).split('.').map(p => Buffer.from(p, 'base64url'))
+  const decipher = crypto.createDecipheriv('aes-256-gcm', key, iv)
+  decipher.setAuthTag(tag)
+  return JSON.parse(Buffer.concat([decipher.update(data), decipher.final()]).toString('utf8'))
+}
+
+/**
+ * Prepare a record for storage: the token value in `field` is replaced by
+ * its hash in `<field>Hash` and the sensitive fields are encrypted
+ * @param {object} record - Record holding the plaintext token
+ * @param {string} field - Name of the token field ('code', 'token')
+ * @param {string[]} sensitiveFields - Fields to encrypt
+ * @returns {object} Record to store
+ */
+function sealRecord (record, field, sensitiveFields) {
+  const { [field]: value, ...rest } = record
+  const sealed = { [`${field}Hash`]: hashTokenValue(value), ...rest }
+  for (const name of sensitiveFields) {
+    if (name in sealed) {
+      sealed[name] = encryptField(sealed[name])
+    }
+  }
+  return sealed
+}
+
+/**
+ * Decrypt the sensitive fields of a stored record
+ * @param {object} record - Stored record
+ * @param {string[]} sensitiveFields - Fields that may be encrypted
+ * @returns {object} Record with plaintext fields
+ */
+function openRecord (record, sensitiveFields) {
+  const opened = { ...record }
+  for (const name of sensitiveFields) {
+    if (name in opened) {
+      opened[name] = decryptField(opened[name])
+    }
+  }
+  return opened
+}
+
+/**
+ * Whether a stored record belongs to a token value. Records written before
+ * hashing was introduced still carry the plaintext value and keep matching
+ * until they expire.
+ * @param {object} record - Stored record
+ * @param {string} field - Name of the token field ('code', 'token')
+ * @param {string} value - Presented token value
+ * @returns {boolean}
+ */
+function recordMatches (record, field, value) {
+  const hash = record[`${field}Hash`]
+  if (hash) {
+    return hash === hashTokenValue(value)
+  }
+  return record[field] !== undefined && record[field] === value
+}
+
+module.exports = {
+  hashTokenValue,
+  encryptField,
+  decryptField,
+  sealRecord,
+  openRecord,
+  recordMatches
+}
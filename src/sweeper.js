@@ -0,0 +1,135 @@
+/**
+ * Background sweeper
+ *
+ * Periodically purges expired authorization codes, refresh tokens, sessions
+ * consumed DPoP proof jti values and idempotency keys so the store does not
+ * grow unbounded.
+ */
+
+const config = require('./config')
+const { purgeExpiredRecords } = require('./db')
+const { purgeExpiredJtis } = require('./dpop')
+const { purgeExpiredIdempotencyKeys } = require('./idempotency')
+
+const stats = {
+  runs: 0,
+  lastRunAt: null,
+  purged: {
+    codes: 0,
+    refreshTokens: 0,
+    deviceCodes: 0,
+    issuedTokens: 0,
+    sessions: 0,
+    jtis: 0,
+    idempotencyKeys: 0
+  }
+}
+
+let timer = null
+
+// Destroy expired sessions from an express-session store that supports all()
+function purgeExpiredSessions (store, now, batchSize) {
+  if (!store || typeof store.all !== 'function') {
+    return Promise.resolve(0)
+  }
+
+  return new Promise((resolve, reject) => {
+    store.all((err, sessions) => {
+      if (err) {
+        return reject(err)
+      }
+
+      const entries = Array.isArray(sessions)
+        ? sessions.map(s => [s.id, s])
+        : Object.entries(sessions || {})
+
+      const expired = entries
+        .filter(([, sess]) => sess && sess.cookie && sess.cookie.expires && new Date(sess.cookie.expires).getTime() <= now)
+        .slice(0, batchSize)
+
+      if (expired.length === 0) {
+        return resolve(0)
+      }
+
+      let pending = expired.length
+      for (const [sid] of expired) {
+        store.destroy(sid, () => {
+          pending--
+          if (pending === 0) {
+            resolve(expired.length)
+          }
+        })
+      }
+    })
+  })
+}
+
+/**
+ * Run a single sweep
+ * @param {object} options
+ * @param {object} options.sessionStore - express-session store to prune
+ * @param {number} options.batchSize - Maximum records removed per collection
+ * @param {number} options.now - Reference time (ms), defaults to Date.now()
+ * @returns {Promise<object>} Number of records purged per collection
+ */
+async function runSweep ({ sessionStore, batchSize = config.sweeper.batchSize, now = Date.now() } = {}) {
+  const purged = {
+    codes: await purgeExpiredRecords('codes.json', now, batchSize),
+    refreshTokens: await purgeExpiredRecords('refresh_tokens.json', now, batchSize),
+    deviceCodes: await purgeExpiredRecords('device_codes.json', now, batchSize),
+    issuedTokens: await purgeExpiredRecords('issued_tokens.json', now, batchSize),
+    sessions: await purgeExpiredSessions(sessionStore, now, batchSize),
+    jtis: purgeExpiredJtis(now),
+    idempotencyKeys: purgeExpiredIdempotencyKeys(now)
+  }
+
+  stats.runs++
+  stats.lastRunAt = new Date(now).toISOString()
+  for (const [key, count] of Object.entries(purged)) {
+    stats.purged[key] += count
+  }
+
+  return purged
+}
+
+/**
+ * Start the periodic sweeper
+ * @param {object} options - Same options as runSweep, plus interval (seconds)
+ * @returns {function} stop function
+ */
+function startSweeper ({ sessionStore, interval = config.sweeper.interval, batchSize = config.sweeper.batchSize } = {}) {
+  stopSweeper()
+
+  timer = setInterval(() => {
+    runSweep({ sessionStore, batchSize }).catch(err => {
+      console.warn('Sweeper run failed:', err.message)
+    })
+  }, interval * 1000)
+
+  // Never keep the process alive just for the sweeper
+  timer.unref()
+
+  return stopSweeper
+}
+
+function stopSweeper () {
+  if (timer) {
+    clearInterval(timer)
+    timer = null
+  }
+}
+
+function getSweeperStats () {
+  return {
+    runs: stats.runs,
+    lastRunAt: stats.lastRunAt,
+    purged: { ...stats.purged }
+  }
+}
+
+module.exports = {
+  runSweep,
+  startSweeper,
+  stopSweeper,
+  getSweeperStats
+}
@@ -3,120 +3,846 @@ const fs = require('fs').promises
 const path = require('path')
 const jwt = require('jsonwebtoken')
 const { promisify } = require('util')
+const config = require('./config')
+const { toScopeClaim } = require('./scopes')
+const { PROTECTED_CLAIMS } = require('./oidc')
 
 const generateKeyPair = promisify(crypto.generateKeyPair)
 
 let privateKey
 let publicKey
+// X.509 chain (leaf first) published as x5c for the default key, if configured
+let certificateChain = null
+
+// Dedicated signing keys per token purpose ({ kid, privateKey, publicKey, certificateChain }).
+// Purposes without a configured key ID are signed with the default key.
+let purposeKeys = {}
+
+// Additional ES256 (P-256) key for clients registered with
+// id_token_signed_response_alg ES256, or null when not configured
+let ecKey = null
+
+// Dedicated access token signing keys of clients or tenants, by the key ID
+// stored in client.signing_key_id. They are kept out of the server JWKS and
+// published per client instead. Loads in progress are shared via pending.
+let clientKeys = new Map()
+let pendingClientKeys = new Map()
+let keyDir = null
+
+// Two-phase rotation of the default key (rotateDefaultKey): the next key is
+// published in the JWKS config.signingKeys.activationDelay seconds before it
+// starts signing, so resource servers have fetched it before they see a
+// token signed with it. Replaced keys stay published and verifiable until
+// the tokens they signed have expired.
+let nextKey = null
+let previousKeys = []
+
+const ROTATION_FILE = 'key-rotation.json'
+const NEXT_KEY_FILE = 'private-key.next.pem'
+const PREVIOUS_KEY_FILE = /^private-key\.previous-([A-Za-z0-9._-]+)\.pem$/
+
+// Token purpose -> config.signingKeys entry holding its key ID
+const KEY_PURPOSES = {
+  id_token: 'idToken',
+  logout_token: 'logoutToken'
+}
+
+const BACKCHANNEL_LOGOUT_EVENT = 'http://schemas.openid.net/event/backchannel-logout'
+
+function derivePublicKey (pem) {
+  return crypto.createPublicKey(crypto.createPrivateKey(pem)).export({
+    type: 'spki',
+    format: 'pem'
+  })
+}
+
+// Parse a PEM certificate chain (leaf first) and check that the leaf
+// certifies the signing key. Returns the certificates.
+function parseCertificateChain (pem, keyPem, source) {
+  const blocks = pem.match(/-----BEGIN CERTIFICATE-----[\s\S]+?-----END CERTIFICATE-----/g)
+  if (!blocks) {
+    throw new Error(`No certificates found in ${source}`)
+  }
+  const chain = blocks.map(block => new crypto.X509Certificate(block))
+  if (!chain[0].publicKey.equals(crypto.createPublicKey(keyPem))) {
+    throw new Error(`The first certificate in ${source} does not match its signing key`)
+  }
+  return chain
+}
+
+// Certificate chain stored next to a key file (<name>.crt), or null
+async function loadCertificateChain (certPath, keyPem) {
+  let pem
+  try {
+    pem = await fs.readFile(certPath, 'utf8')
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return null
+    }
+    throw err
+  }
+  return parseCertificateChain(pem, keyPem, certPath)
+}
+
+async function generateRsaKeyPair () {
+  return generateKeyPair('rsa', {
+    modulusLength: 2048,
+    publicKeyEncoding: {
+      type: 'spki',
+      format: 'pem'
+    },
+    privateKeyEncoding: {
+      type: 'pkcs8',
+      format: 'pem'
+    }
+  })
+}
+
+async function generateEcKeyPair () {
+  return generateKeyPair('ec', {
+    namedCurve: 'P-256',
+    publicKeyEncoding: {
+      type: 'spki',
+      format: 'pem'
+    },
+    privateKeyEncoding: {
+      type: 'pkcs8',
+      format: 'pem'
+    }
+  })
+}
 
 async function ensurePrivateKey (dataDir) {
+  await ensureDefaultKey(dataDir)
+  await ensurePurposeKeys(dataDir)
+  await ensureEcKey(dataDir)
+  await loadClientKeys(dataDir)
+}
+
+async function ensureDefaultKey (dataDir) {
   const keyPath = path.join(dataDir, 'private-key.pem')
 
+  const certPath = path.join(dataDir, 'private-key.crt')
+  certificateChain = null
+
   // Check if NGAUTH_KEY env variable is set
   if (process.env.NGAUTH_KEY) {
     privateKey = process.env.NGAUTH_KEY
     // Derive public key from private key
-    const keyObject = crypto.createPrivateKey(privateKey)
-    publicKey = crypto.createPublicKey(keyObject).export({
-      type: 'spki',
-      format: 'pem'
-    })
+    publicKey = derivePublicKey(privateKey)
+    certificateChain = process.env.NGAUTH_KEY_CERT
+      ? parseCertificateChain(process.env.NGAUTH_KEY_CERT, publicKey, 'NGAUTH_KEY_CERT')
+      : null
+    nextKey = null
+    previousKeys = []
     return
   }
 
   // Check if key file exists
+  let existingKey = null
   try {
-    privateKey = await fs.readFile(keyPath, 'utf8')
+    existingKey = await fs.readFile(keyPath, 'utf8')
+  } catch (err) {
+    // Key file doesn't exist, generate new one
+  }
+
+  if (existingKey) {
+    privateKey = existingKey
     // Derive public key from private key
-    const keyObject = crypto.createPrivateKey(privateKey)
-    publicKey = crypto.createPublicKey(keyObject).export({
-      type: 'spki',
-      format: 'pem'
-    })
+    publicKey = derivePublicKey(privateKey)
+    certificateChain = await loadCertificateChain(certPath, publicKey)
     console.log('Loaded existing private key from', keyPath)
+    await loadKeyRotation(dataDir)
     return
-  } catch (err) {
-    // Key file doesn't exist, generate new one
   }
 
   // Generate new RSA key pair
   console.log('Generating new RSA key pair...')
-  const { privateKey: newPrivateKey, publicKey: newPublicKey } = await generateKeyPair('rsa', {
-    modulusLength: 2048,
-    publicKeyEncoding: {
-      type: 'spki',
-      format: 'pem'
-    },
-    privateKeyEncoding: {
-      type: 'pkcs8',
-      format: 'pem'
-    }
-  })
+  const { privateKey: newPrivateKey, publicKey: newPublicKey } = await generateRsaKeyPair()
 
   privateKey = newPrivateKey
   publicKey = newPublicKey
+  nextKey = null
+  previousKeys = []
 
   // Persist private key
   await fs.writeFile(keyPath, privateKey)
   console.log('Generated and saved new private key to', keyPath)
 }
 
-function getPublicKeyJwk () {
-  const keyObject = crypto.createPublicKey(publicKey)
-  const jwk = keyObject.export({ format: 'jwk' })
+function rsaKeyFromPem (pem) {
+  const keyPublicKey = derivePublicKey(pem)
+  return { kid: kidOf(keyPublicKey), alg: 'RS256', privateKey: pem, publicKey: keyPublicKey, certificateChain: null }
+}
+
+// Seconds a replaced default key stays verifiable: the longest lifetime of
+// a token it may have signed
+function retiredKeyRetention () {
+  return Math.max(config.tokens.accessTokenTTL, config.tokens.idTokenTTL)
+}
+
+// Make the next key the default key once its activation time has come, and
+// forget replaced keys whose tokens have all expired
+function activateNextKey (now = Date.now()) {
+  if (nextKey && now >= nextKey.activatesAt) {
+    previousKeys.push({ kid: defaultKid(), alg: 'RS256', privateKey, publicKey, certificateChain, retiresAt: nextKey.activatesAt + retiredKeyRetention() * 1000 })
+    privateKey = nextKey.privateKey
+    publicKey = nextKey.publicKey
+    certificateChain = null
+    nextKey = null
+  }
+  previousKeys = previousKeys.filter(k => now < k.retiresAt)
+}
+
+// Write the rotation state: the default key, the next key and the replaced
+// keys still in use, described by key-rotation.json
+async function saveKeyRotation (dataDir) {
+  await fs.writeFile(path.join(dataDir, 'private-key.pem'), privateKey)
+  if (nextKey) {
+    await fs.writeFile(path.join(dataDir, NEXT_KEY_FILE), nextKey.privateKey)
+  } else {
+    await fs.rm(path.join(dataDir, NEXT_KEY_FILE), { force: true })
+  }
+  for (const key of previousKeys) {
+    await fs.writeFile(path.join(dataDir, `private-key.previous-${key.kid}.pem`), key.privateKey)
+  }
+  for (const file of await fs.readdir(dataDir)) {
+    const match = PREVIOUS_KEY_FILE.exec(file)
+    if (match && !previousKeys.some(k => k.kid === match[1])) {
+      await fs.rm(path.join(dataDir, file), { force: true })
+    }
+  }
+  await fs.writeFile(path.join(dataDir, ROTATION_FILE), JSON.stringify({
+    next: nextKey ? { kid: nextKey.kid, activatesAt: nextKey.activatesAt } : null,
+    previous: previousKeys.map(({ kid, retiresAt }) => ({ kid, retiresAt }))
+  }, null, 2))
+}
+
+// Resume a rotation in progress. One that activated while the server was
+// stopped is completed, so the files match the keys in use.
+async function loadKeyRotation (dataDir, now = Date.now()) {
+  nextKey = null
+  previousKeys = []
+
+  let state
+  try {
+    state = JSON.parse(await fs.readFile(path.join(dataDir, ROTATION_FILE), 'utf8'))
+  } catch (err) {
+    if (err.code === 'ENOENT') {
+      return
+    }
+    throw err
+  }
+
+  if (state.next) {
+    nextKey = { ...rsaKeyFromPem(await fs.readFile(path.join(dataDir, NEXT_KEY_FILE), 'utf8')), activatesAt: state.next.activatesAt }
+  }
+  for (const { kid, retiresAt } of state.previous || []) {
+    previousKeys.push({ ...rsaKeyFromPem(await fs.readFile(path.join(dataDir, `private-key.previous-${kid}.pem`), 'utf8')), retiresAt })
+  }
+  activateNextKey(now)
+  await saveKeyRotation(dataDir)
+}
+
+/**
+ * Start a two-phase rotation of the default signing key: a new key is
+ * published in the JWKS now and signs tokens once
+ * config.signingKeys.activationDelay seconds have passed
+ * @returns {Promise<object>} kid and activatesAt (ms) of the new key
+ * @throws {Error} When the default key comes from NGAUTH_KEY or a rotation
+ *   is already waiting to activate
+ */
+async function rotateDefaultKey (now = Date.now()) {
+  if (process.env.NGAUTH_KEY) {
+    throw new Error('The default key is set by NGAUTH_KEY and cannot be rotated')
+  }
+  activateNextKey(now)
+  if (nextKey) {
+    throw new Error(`Key ${nextKey.kid} is already waiting to be activated`)
+  }
+
+  nextKey = { ...rsaKeyFromPem((await generateRsaKeyPair()).privateKey), activatesAt: now + config.signingKeys.activationDelay * 1000 }
+  await saveKeyRotation(keyDir)
+  return { kid: nextKey.kid, activatesAt: nextKey.activatesAt }
+}
+
+// State of the default key rotation, for the admin API
+function getKeyRotation (now = Date.now()) {
+  activateNextKey(now)
+  return {
+    current: defaultKid(),
+    next: nextKey ? { kid: nextKey.kid, activatesAt: nextKey.activatesAt } : null,
+    previous: previousKeys.map(({ kid, retiresAt }) => ({ kid, retiresAt }))
+  }
+}
+
+// Load or generate the keys configured in config.signingKeys. Each key is
+// stored as signing-key-<kid>.pem (with an optional signing-key-<kid>.crt
+// certificate chain); purposes sharing a key ID share the key.
+async function ensurePurposeKeys (dataDir) {
+  const keysByKid = {}
+  purposeKeys = {}
+
+  for (const [purpose, setting] of Object.entries(KEY_PURPOSES)) {
+    const kid = config.signingKeys[setting]
+    if (!kid) {
+      continue
+    }
+    if (!/^[A-Za-z0-9._-]+$/.test(kid)) {
+      throw new Error(`Invalid ${purpose} signing key ID '${kid}': use letters, digits, '.', '_' or '-'`)
+    }
+    if (kid === defaultKid()) {
+      throw new Error(`The ${purpose} signing key ID must differ from the default key ID`)
+    }
+
+    if (!keysByKid[kid]) {
+      const keyPath = path.join(dataDir, `signing-key-${kid}.pem`)
+      let pem
+      try {
+        pem = await fs.readFile(keyPath, 'utf8')
+      } catch (err) {
+        console.log(`Generating ${purpose} signing key ${kid}...`)
+        pem = (await generateRsaKeyPair()).privateKey
+        await fs.writeFile(keyPath, pem)
+      }
+      const keyPublicKey = derivePublicKey(pem)
+      keysByKid[kid] = {
+        kid,
+        alg: 'RS256',
+        privateKey: pem,
+        publicKey: keyPublicKey,
+        certificateChain: await loadCertificateChain(path.join(dataDir, `signing-key-${kid}.crt`), keyPublicKey)
+      }
+    }
+    purposeKeys[purpose] = keysByKid[kid]
+  }
+}
+
+// Load or generate the ES256 key configured in config.signingKeys.ecKey,
+// stored as signing-key-<kid>.pem like the purpose keys
+async function ensureEcKey (dataDir) {
+  const kid = config.signingKeys.ecKey
+  ecKey = null
+  if (!kid) {
+    return
+  }
+  if (!/^[A-Za-z0-9._-]+$/.test(kid)) {
+    throw new Error(`Invalid EC signing key ID '${kid}': use letters, digits, '.', '_' or '-'`)
+  }
+  if (kid === defaultKid() || Object.values(purposeKeys).some(k => k.kid === kid)) {
+    throw new Error('The EC signing key ID must differ from the RSA signing key IDs')
+  }
+
+  const keyPath = path.join(dataDir, `signing-key-${kid}.pem`)
+  let pem
+  try {
+    pem = await fs.readFile(keyPath, 'utf8')
+  } catch (err) {
+    console.log(`Generating EC signing key ${kid}...`)
+    pem = (await generateEcKeyPair()).privateKey
+    await fs.writeFile(keyPath, pem)
+  }
+
+  const details = crypto.createPrivateKey(pem).asymmetricKeyDetails
+  if (!details || details.namedCurve !== 'prime256v1') {
+    throw new Error(`${keyPath} must be an EC P-256 key`)
+  }
 
+  const keyPublicKey = derivePublicKey(pem)
+  ecKey = {
+    kid,
+    alg: 'ES256',
+    privateKey: pem,
+    publicKey: keyPublicKey,
+    certificateChain: await loadCertificateChain(path.join(dataDir, `signing-key-${kid}.crt`), keyPublicKey)
+  }
+}
+
+// Load the client keys stored as client-key-<kid>.pem, so tokens issued
+// before a restart still verify
+async function loadClientKeys (dataDir) {
+  keyDir = dataDir
+  clientKeys = new Map()
+  pendingClientKeys = new Map()
+
+  for (const file of await fs.readdir(dataDir)) {
+    const match = /^client-key-([A-Za-z0-9._-]+)\.pem$/.exec(file)
+    if (match) {
+      const pem = await fs.readFile(path.join(dataDir, file), 'utf8')
+      clientKeys.set(match[1], { kid: match[1], alg: 'RS256', privateKey: pem, publicKey: derivePublicKey(pem), certificateChain: null })
+    }
+  }
+}
+
+// Client key IDs share the kid namespace with the server keys
+function validateClientKeyId (kid) {
+  if (typeof kid !== 'string' || !/^[A-Za-z0-9._-]{1,64}$/.test(kid)) {
+    throw new Error(`Invalid client signing key ID '${kid}': use up to 64 letters, digits, '.', '_' or '-'`)
+  }
+  if (allSigningKeys().some(k => k.kid === kid)) {
+    throw new Error(`Client signing key ID '${kid}' is used by a server signing key`)
+  }
+}
+
+/**
+ * Load or generate the dedicated signing key with the given ID
+ * @param {string} kid - The client's signing_key_id
+ * @returns {Promise<object>} The signing key
+ */
+async function ensureClientKey (kid) {
+  if (clientKeys.has(kid)) {
+    return clientKeys.get(kid)
+  }
+  validateClientKeyId(kid)
+
+  // Concurrent first uses must not generate two different keys
+  if (!pendingClientKeys.has(kid)) {
+    pendingClientKeys.set(kid, (async () => {
+      const keyPath = path.join(keyDir, `client-key-${kid}.pem`)
+      console.log(`Generating client signing key ${kid}...`)
+      const pem = (await generateRsaKeyPair()).privateKey
+      await fs.writeFile(keyPath, pem)
+      const key = { kid, alg: 'RS256', privateKey: pem, publicKey: derivePublicKey(pem), certificateChain: null }
+      clientKeys.set(kid, key)
+      return key
+    })().finally(() => {
+      pendingClientKeys.delete(kid)
+    }))
+  }
+  return pendingClientKeys.get(kid)
+}
+
+// Public JWKS of a client's dedicated key
+async function getClientJwks (kid) {
+  return [toPublicJwk(await ensureClientKey(kid))]
+}
+
+function kidOf (publicKeyPem) {
+  return crypto.createHash('sha256').update(publicKeyPem).digest('hex').substring(0, 16)
+}
+
+function defaultKid () {
+  return kidOf(publicKey)
+}
+
+// Signing key for a token purpose, falling back to the default key
+function signingKeyFor (purpose) {
+  activateNextKey()
+  return purposeKeys[purpose] || { kid: defaultKid(), alg: 'RS256', privateKey, publicKey, certificateChain }
+}
+
+// Every key a token may be signed with: the default key first, then the
+// dedicated purpose keys and the EC key (once each), then the replaced
+// default keys still verifying tokens
+function allSigningKeys () {
+  const keys = [signingKeyFor()]
+  for (const key of [...Object.values(purposeKeys), ecKey, ...previousKeys].filter(Boolean)) {
+    if (!keys.some(k => k.kid === key.kid)) {
+      keys.push(key)
+    }
+  }
+  return keys
+}
+
+// Public view of the signing keys, for startup validation
+function getSigningKeys () {
+  return allSigningKeys().map(({ kid, alg, publicKey }) => ({ kid, alg, publicKey }))
+}
+
+// Algorithms tokens can be signed with, for discovery and client registration
+function getSigningAlgorithms () {
+  return [...new Set(allSigningKeys().map(k => k.alg))]
+}
+
+// Algorithms a client may register per signing metadata field (OIDC
+// Registration 2). Userinfo responses are plain JSON and request objects
+// are not accepted, so those fields have none.
+function getSupportedAlgorithms () {
   return {
+    id_token_signed_response_alg: getSigningAlgorithms(),
+    userinfo_signed_response_alg: [],
+    request_object_signing_alg: []
+  }
+}
+
+// Signing key for a token purpose and the client's registered algorithm.
+// The purpose key is kept when its algorithm matches; otherwise the first
+// key of the requested algorithm is used.
+function signingKeyForAlg (purpose, alg) {
+  const key = signingKeyFor(purpose)
+  if (!alg || key.alg === alg) {
+    return key
+  }
+  const match = allSigningKeys().find(k => k.alg === alg)
+  if (!match) {
+    throw new Error(`No signing key available for ${alg}`)
+  }
+  return match
+}
+
+function toPublicJwk (key) {
+  const jwk = crypto.createPublicKey(key.publicKey).export({ format: 'jwk' })
+
+  const publicJwk = {
     ...jwk,
     use: 'sig',
-    alg: 'RS256',
-    kid: crypto.createHash('sha256').update(publicKey).digest('hex').substring(0, 16)
+    alg: key.alg,
+    kid: key.kid
+  }
+
+  // Certificate chain and leaf thumbprint (RFC 7517 4.7, 4.9)
+  if (key.certificateChain) {
+    publicJwk.x5c = key.certificateChain.map(cert => cert.raw.toString('base64'))
+    publicJwk['x5t#S256'] = crypto.createHash('sha256').update(key.certificateChain[0].raw).digest('base64url')
+  }
+
+  return publicJwk
+}
+
+function getPublicKeyJwk () {
+  return toPublicJwk(signingKeyFor())
+}
+
+// Public keys of all signing keys, for the JWKS endpoint, and of the next
+// default key ahead of its activation
+function getPublicKeyJwks () {
+  return [...allSigningKeys(), nextKey].filter(Boolean).map(toPublicJwk)
+}
+
+// Public key of the default key, or of the replaced default key with the
+// given kid while it still verifies tokens
+function getPublicKeyPem (kid) {
+  const current = signingKeyFor()
+  const previous = kid && previousKeys.find(k => k.kid === kid)
+  return previous ? previous.publicKey : current.publicKey
+}
+
+// Stamp access tokens with the configured format version so resource
+// servers can branch on the claim set during migrations
+function withFormatVersion (payload) {
+  const { version, claimName } = config.tokenFormat
+  if (payload.token_type !== 'access' || !version || claimName in payload) {
+    return payload
   }
+  return { ...payload, [claimName]: version }
 }
 
-function getPublicKeyPem () {
-  return publicKey
+// client_id is kept in access tokens unless configured off, for resource
+// servers mirroring providers whose tokens do not carry it
+function withClientIdClaim (payload) {
+  if (payload.token_type !== 'access' || config.tokens.includeClientId !== false || !('client_id' in payload)) {
+    return payload
+  }
+  const { client_id: clientId, ...rest } = payload
+  return rest
 }
 
-function generateToken (payload, expiresIn = '1h') {
-  const kid = crypto.createHash('sha256').update(publicKey).digest('hex').substring(0, 16)
-  return jwt.sign(payload, privateKey, {
-    algorithm: 'RS256',
-    expiresIn,
-    header: {
-      kid
-    }
-  })
+// Put the granted scopes of access tokens in the configured claim
+// representation (the token response keeps the scope string)
+function withScopeClaim (payload) {
+  if (payload.token_type !== 'access' || typeof payload.scope !== 'string') {
+    return payload
+  }
+  const { scope, ...rest } = payload
+  const { name, value } = toScopeClaim(scope)
+  return { ...rest, [name]: value }
+}
+
+// iat (and nbf = iat when configured) taken from the same clock reading, so
+// every token type carries consistent time claims. Claims that already set
+// iat (e.g. built ID token claims) keep it.
+function withTimeClaims (payload) {
+  const iat = typeof payload.iat === 'number' ? payload.iat : Math.floor(Date.now() / 1000)
+  const claims = { ...payload, iat }
+  if (config.tokens.notBefore) {
+    claims.nbf = iat
+  }
+  return claims
+}
+
+// URL of the JWKS that publishes a key: the server set, or for a client's
+// dedicated key the client's own set (mounted as in index.js)
+function jwksUrl (clientId = null) {
+  const jwksPath = config.endpoints.jwks
+  if (!clientId) {
+    return `${config.issuer}${jwksPath}`
+  }
+  const wellKnown = jwksPath.indexOf('/.well-known/')
+  const base = wellKnown === -1 ? jwksPath : jwksPath.substring(0, wellKnown + '/.well-known'.length)
+  return `${config.issuer}${base}/jwks/${encodeURIComponent(clientId)}.json`
+}
+
+// JWT header of an issued token. Only alg, typ, kid and (when enabled) jku
+// are ever set, so nothing about the key storage or the request leaks.
+// jku is a hint for tooling: verifiers must not fetch keys from a URL the
+// token names, and the Go sample resolves keys by kid alone.
+function jwtHeader (key, typ, jkuClientId = null) {
+  const header = { kid: key.kid, typ }
+  if (config.tokens.jkuHeader) {
+    header.jku = jwksUrl(jkuClientId)
+  }
+  return header
+}
+
+// Sign a token with its time claims. Claims that already set exp keep it.
+function signJwt (payload, key, expiresIn, header) {
+  const claims = withTimeClaims(payload)
+
+  const options = {
+    algorithm: key.alg,
+    header
+  }
+  // jsonwebtoken refuses expiresIn when the payload already has exp
+  if (claims.exp === undefined) {
+    options.expiresIn = expiresIn
+  }
+  return jwt.sign(claims, key.privateKey, options)
+}
+
+// keyId selects a client's dedicated key, loaded with ensureClientKey
+function generateToken (payload, expiresIn = '1h', keyId = null) {
+  const key = keyId ? clientKeys.get(keyId) : signingKeyFor()
+  if (!key) {
+    throw new Error(`Client signing key ${keyId} is not loaded`)
+  }
+  // A dedicated key is published in the JWKS of the client the token is for
+  const jkuClientId = keyId ? payload.client_id : null
+  payload = withClientIdClaim(withScopeClaim(withFormatVersion(payload)))
+  // Every access token gets its own ID, so it can be audited and revoked alone (RFC 9068 2.2)
+  if (payload.token_type === 'access' && payload.jti === undefined) {
+    payload = { ...payload, jti: generateRandomToken(16) }
+  }
+  // Mark access tokens so resource servers can tell them from ID tokens (RFC 9068 2.1)
+  const typ = payload.token_type === 'access' ? 'at+jwt' : 'JWT'
+  return signJwt(payload, key, expiresIn, jwtHeader(key, typ, jkuClientId))
+}
+
+// Claims describing the grant itself, in addition to the protected claims
+const GRANT_CLAIMS = ['client_id', 'scope', 'token_type', 'authorization_details']
+
+// Whether a default claim may not be set under this name
+function isReservedClaim (name) {
+  return PROTECTED_CLAIMS.includes(name) || GRANT_CLAIMS.includes(name) ||
+    name === config.claims.scopeClaimName || name === config.tokenFormat.claimName
+}
+
+/**
+ * Check a client's default_claims: a JSON object that sets no protected or
+ * grant claim, so a misconfiguration is reported rather than ignored
+ * @param {*} claims - Candidate default_claims
+ * @throws {Error} When the claims are unusable
+ */
+function validateDefaultClaims (claims) {
+  if (!claims || typeof claims !== 'object' || Array.isArray(claims)) {
+    throw new Error('default_claims must be a JSON object')
+  }
+  const reserved = Object.keys(claims).find(isReservedClaim)
+  if (reserved) {
+    throw new Error(`default_claims must not set the '${reserved}' claim`)
+  }
+}
+
+/**
+ * Default claims for tokens issued to a client: the issuer-level
+ * config.claims.defaultClaims overridden by the client's default_claims.
+ * Protected and grant claims are dropped, so a default can never change
+ * who or what a token is for.
+ * @param {object|null} client - Registered client, or null for tokens not
+ *   issued to a client
+ * @returns {object}
+ */
+function defaultClaimsFor (client) {
+  const merged = { ...config.claims.defaultClaims, ...((client && client.default_claims) || {}) }
+  return Object.fromEntries(Object.entries(merged).filter(([name, value]) => value !== undefined && !isReservedClaim(name)))
+}
+
+/**
+ * Add the default claims beneath a token payload or ID token claims: the
+ * payload wins every conflict
+ * @param {object} payload - Token payload or ID token claims
+ * @param {object|null} client - Registered client the token is issued to
+ * @returns {object}
+ */
+function withDefaultClaims (payload, client) {
+  return { ...defaultClaimsFor(client), ...payload }
+}
+
+/**
+ * Access token payload for a grant made by a user, shared by the token
+ * endpoint grants and the admin claims preview
+ * @param {object} grant - userId, clientId, scope (expanded), and optional
+ *   aud, authorizationDetails and jkt (DPoP key thumbprint)
+ * @returns {object}
+ */
+function buildAccessTokenPayload ({ userId, clientId, scope, aud, authorizationDetails, jkt }) {
+  const payload = {
+    sub: userId,
+    client_id: clientId,
+    scope,
+    token_type: 'access'
+  }
+  if (aud) {
+    payload.aud = aud
+  }
+  // Granted authorization details (RFC 9396 7)
+  if (authorizationDetails) {
+    payload.authorization_details = authorizationDetails
+  }
+  // Bind the token to the DPoP proof key (RFC 9449 6)
+  if (jkt) {
+    payload.cnf = { jkt }
+  }
+  return payload
+}
+
+/**
+ * Claims generateToken or generateIdToken would sign, left unsigned so a
+ * preview can never be used as a token
+ * @param {object} payload - Token payload or ID token claims
+ * @param {number} expiresIn - Lifetime in seconds
+ * @returns {object}
+ */
+function previewTokenClaims (payload, expiresIn) {
+  const claims = withTimeClaims(withClientIdClaim(withScopeClaim(withFormatVersion(payload))))
+  if (claims.exp === undefined) {
+    claims.exp = claims.iat + expiresIn
+  }
+  return claims
 }
 
-function generateIdToken (claims, expiresIn = '1h') {
+// alg is the client's id_token_signed_response_alg; RS256 when not registered
+function generateIdToken (claims, expiresIn = '1h', alg = null) {
   // ID tokens must include these required OIDC claims
-  // iss, sub, aud, exp, iat are added by generateToken via expiresIn
-  const kid = crypto.createHash('sha256').update(publicKey).digest('hex').substring(0, 16)
-  return jwt.sign(claims, privateKey, {
-    algorithm: 'RS256',
-    expiresIn,
-    header: {
-      kid
-    }
-  })
+  // iss, sub, aud come from the claims; exp and iat are added by signJwt
+  const key = signingKeyForAlg('id_token', alg)
+  return signJwt(claims, key, expiresIn, jwtHeader(key, 'JWT'))
 }
 
+// Logout token (OIDC Back-Channel Logout 1.0 2.4). Also the purpose key for
+// other machine-to-machine tokens such as JARM responses.
+function generateLogoutToken (claims, expiresIn = '2m') {
+  const key = signingKeyFor('logout_token')
+  const payload = {
+    ...claims,
+    jti: generateRandomToken(16),
+    events: { [BACKCHANNEL_LOGOUT_EVENT]: {} }
+  }
+  return signJwt(payload, key, expiresIn, jwtHeader(key, 'logout+jwt'))
+}
+
+// Key named by a token's kid: a server key or a client's dedicated key, the
+// default key when absent or unknown
+function verificationKeyFor (kid) {
+  return allSigningKeys().find(k => k.kid === kid) || clientKeys.get(kid) || signingKeyFor()
+}
+
+// Verify with the key named by the token's kid (default key when absent)
 function verifyToken (token) {
-  return jwt.verify(token, publicKey, {
-    algorithms: ['RS256']
+  const decoded = jwt.decode(token, { complete: true })
+  const key = verificationKeyFor(decoded && decoded.header.kid)
+
+  return jwt.verify(token, key.publicKey, {
+    algorithms: [key.alg]
+  })
+}
+
+// Header types of the server's tokens that are not ID tokens
+const NON_ID_TOKEN_TYPES = ['at+jwt', 'logout+jwt']
+
+/**
+ * Verify an id_token_hint (OIDC RP-Initiated Logout 1.0 2). The signature
+ * and issuer must check out, but an expired ID token is accepted: the
+ * session it names may well have outlived it.
+ * @param {string} token - The hint
+ * @param {string[]} issuers - Accepted iss values
+ * @returns {object} The ID token claims
+ * @throws {Error} When the hint is not an ID token issued here
+ */
+function verifyIdTokenHint (token, issuers) {
+  const decoded = jwt.decode(token, { complete: true })
+  if (!decoded || typeof decoded.payload !== 'object') {
+    throw new Error('id_token_hint is not a JWT')
+  }
+  // ID tokens are only ever signed with the server's keys, never a client's
+  const key = allSigningKeys().find(k => k.kid === decoded.header.kid)
+  if (!key) {
+    throw new Error('id_token_hint was not signed by a key of this server')
+  }
+  const claims = jwt.verify(token, key.publicKey, {
+    algorithms: [key.alg],
+    issuer: issuers,
+    ignoreExpiration: true
   })
+  if (NON_ID_TOKEN_TYPES.includes(decoded.header.typ) || claims.token_type || !claims.aud || !claims.sub) {
+    throw new Error('id_token_hint is not an ID token')
+  }
+  return claims
 }
 
 function generateRandomToken (bytes = 32) {
   return crypto.randomBytes(bytes).toString('hex')
 }
 
+// Artifact type -> config.codes entry holding its random byte length
+const CODE_LENGTHS = {
+  authorization_code: 'authorizationCodeBytes',
+  device_code: 'deviceCodeBytes',
+  refresh_token: 'refreshTokenBytes'
+}
+
+// Artifact type -> config.codes entry holding its prefix for secret scanners
+const CODE_PREFIXES = {
+  refresh_token: 'refreshTokenPrefix'
+}
+
+// Same floor as the config loader, rechecked in case config was changed at runtime
+const CODE_BYTES_MIN = 16
+
+/**
+ * Generate an authorization code, device code or refresh token with the
+ * configured entropy, hex-encoded so it is URL-safe. Refresh tokens start
+ * with the configured prefix, which adds to the random part rather than
+ * replacing any of it.
+ * @param {string} type - authorization_code, device_code or refresh_token
+ * @returns {string}
+ */
+function generateCode (type) {
+  const setting = CODE_LENGTHS[type]
+  if (!setting) {
+    throw new Error(`Unknown code type '${type}'`)
+  }
+  const bytes = config.codes[setting]
+  if (!Number.isInteger(bytes) || bytes < CODE_BYTES_MIN) {
+    throw new Error(`${type} must use at least ${CODE_BYTES_MIN} random bytes, got ${bytes}`)
+  }
+  const prefix = (CODE_PREFIXES[type] && config.codes[CODE_PREFIXES[type]]) || ''
+  return `${prefix}${generateRandomToken(bytes)}`
+}
+
 module.exports = {
   ensurePrivateKey,
   getPublicKeyJwk,
+  getPublicKeyJwks,
   getPublicKeyPem,
+  getSigningAlgorithms,
+  getSupportedAlgorithms,
+  getSigningKeys,
+  ensureClientKey,
+  validateClientKeyId,
+  rotateDefaultKey,
+  getKeyRotation,
+  getClientJwks,
   generateToken,
   generateIdToken,
+  buildAccessTokenPayload,
+  defaultClaimsFor,
+  withDefaultClaims,
+  validateDefaultClaims,
+  previewTokenClaims,
+  generateLogoutToken,
   verifyToken,
-  generateRandomToken
+  verificationKeyFor,
+  verifyIdTokenHint,
+  generateRandomToken,
+  generateCode
 }
@@ -1,15 +1,45 @@
 const bcrypt = require('bcrypt')
+const crypto = require('crypto')
+const config = require('./config')
+const { OAuthError } = require('./errors')
 
-const SALT_ROUNDS = 10
-
-async function hashPassword (password) {
-  return await bcrypt.hash(password, SALT_ROUNDS)
+async function hashPassword (password, cost = config.passwords.bcryptCost) {
+  return await bcrypt.hash(password, cost)
 }
 
 async function verifyPassword (password, hash) {
   return await bcrypt.compare(password, hash)
 }
 
+// Whether a stored hash was made at a lower cost than currently configured
+function needsRehash (hash, cost = config.passwords.bcryptCost) {
+  try {
+    return bcrypt.getRounds(hash) < cost
+  } catch (err) {
+    return false
+  }
+}
+
+/**
+ * Check a user's password and, when it matches a hash made at a lower cost,
+ * store a new hash at the configured cost (the plaintext is only available
+ * at login).
+ * @param {object} user - Stored user
+ * @param {string} password - Password to check
+ * @returns {Promise<boolean>} Whether the password matches
+ */
+async function verifyUserPassword (user, password) {
+  if (!(await verifyPassword(password, user.password))) {
+    return false
+  }
+  if (needsRehash(user.password)) {
+    // Required lazily: db depends on this module for hashPassword
+    const { updateUser } = require('./db')
+    await updateUser(user.id, { password: await hashPassword(password) })
+  }
+  return true
+}
+
 function validatePassword (password) {
   if (!password || password.length < 8) {
     throw new Error('Password must be at least 8 characters long')
@@ -62,10 +92,124 @@ function validateEmail (email) {
   return true
 }
 
+// BCP 47 language tag, as used by the locale claim (OIDC Core 5.1)
+const LOCALE_PATTERN = /^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$/
+
+function validateLocale (locale) {
+  if (typeof locale !== 'string' || !LOCALE_PATTERN.test(locale)) {
+    throw new Error('Invalid locale format')
+  }
+  return true
+}
+
+// How long a token sent to a new email address stays valid
+const EMAIL_VERIFICATION_TTL = 24 * 60 * 60 * 1000
+
+let emailVerificationSender = null
+
+/**
+ * Install the sender of email verification messages. Without one, the
+ * address cannot be verified; the token is never logged, as logs are read
+ * by more people than the address owner.
+ * @param {function|null} sender - async ({ user, email, token }) => void; null removes it
+ */
+function setEmailVerificationSender (sender) {
+  emailVerificationSender = sender
+}
+
+const hashVerificationToken = (token) => crypto.createHash('sha256').update(token).digest('hex')
+
+/**
+ * Send a verification token to a new email address
+ * @param {object} user - Stored user
+ * @param {string} email - New address, already validated
+ * @returns {Promise<object>} Fields to store on the user: the address stays
+ *   unverified until the token is confirmed
+ */
+async function requestEmailVerification (user, email) {
+  const token = crypto.randomBytes(32).toString('base64url')
+  if (emailVerificationSender) {
+    await emailVerificationSender({ user, email, token })
+  } else {
+    console.warn(`📧 Email verification requested for ${user.username}, but no sender is installed`)
+  }
+  return {
+    email,
+    email_verified: false,
+    emailVerification: {
+      tokenHash: hashVerificationToken(token),
+      expiresAt: Date.now() + EMAIL_VERIFICATION_TTL
+    }
+  }
+}
+
+/**
+ * Check a token against the user's pending email verification
+ * @param {object} user - Stored user
+ * @param {string} token - Token from the verification message
+ * @returns {boolean}
+ */
+function matchEmailVerification (user, token) {
+  const pending = user.emailVerification
+  if (!pending || pending.expiresAt <= Date.now() || typeof token !== 'string') {
+    return false
+  }
+  const expected = Buffer.from(pending.tokenHash, 'hex')
+  const actual = Buffer.from(hashVerificationToken(token), 'hex')
+  return crypto.timingSafeEqual(expected, actual)
+}
+
+/**
+ * Validate and store a new user
+ * @param {object} fields - username, email, password and optional name
+ * @returns {Promise<object>} The stored user (including password hash)
+ * @throws {Error} on validation failure, OAuthError on duplicates
+ */
+async function createUser ({ username, email, password, name }) {
+  // Required lazily: db depends on this module for hashPassword
+  const { getUser, getUsers, addUser } = require('./db')
+
+  validateUsername(username)
+  validateEmail(email)
+  validatePassword(password)
+
+  // Check if user already exists
+  const existingUser = await getUser(username)
+  if (existingUser) {
+    throw new OAuthError('invalid_request', 'Username already exists')
+  }
+
+  // Check if email already exists
+  const users = await getUsers()
+  if (users.some(u => u.email === email)) {
+    throw new OAuthError('invalid_request', 'Email already exists')
+  }
+
+  const user = {
+    id: 'user_' + crypto.randomBytes(8).toString('hex'),
+    username,
+    email,
+    name: name || username,
+    password: await hashPassword(password),
+    createdAt: new Date().toISOString(),
+    failedLoginAttempts: 0
+  }
+
+  await addUser(user)
+  return user
+}
+
 module.exports = {
+  createUser,
   hashPassword,
   verifyPassword,
+  verifyUserPassword,
+  needsRehash,
   validatePassword,
   validateUsername,
-  validateEmail
+  validateEmail,
+  validateLocale,
+  setEmailVerificationSender,
+  requestEmailVerification,
+  matchEmailVerification
 }
@@ -0,0 +1,559 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const fs = require('fs')
+const http = require('http')
+const crypto = require('crypto')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, addClient, getClient, addCode, addIssuedToken, getIssuedToken } = require('../../src/db')
+const { ensurePrivateKey, generateToken, getPublicKeyPem, verifyToken, getKeyRotation } = require('../../src/tokens')
+const { setPublicKey } = require('../../src/auth')
+const { getConfigFingerprint } = require('../../src/config/fingerprint')
+const adminRouter = require('../../src/routes/admin')
+const tokenRouter = require('../../src/routes/token')
+const userinfoRouter = require('../../src/routes/userinfo')
+const { acrForAmr } = require('../../src/acr')
+const { errorHandler } = require('../../src/errors')
+
+describe('Admin Endpoints', () => {
+  let app
+  let testDir
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+    setPublicKey(getPublicKeyPem())
+
+    app = express()
+    app.use(express.json())
+    app.use('/admin', adminRouter)
+    app.use(errorHandler)
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  describe('GET /admin/config', () => {
+    test('should return the redacted configuration and fingerprint', async () => {
+      const token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+
+      const res = await request(app)
+        .get('/admin/config')
+        .set('Authorization', `Bearer ${token}`)
+
+      expect(res.status).toBe(200)
+      expect(res.body.fingerprint).toBe(getConfigFingerprint(config))
+      expect(res.body.config.issuer).toBe(config.issuer)
+      expect(res.body.config.tokens.signingAlgorithm).toBe(config.tokens.signingAlgorithm)
+    })
+
+    test('should not return the store encryption key', async () => {
+      const original = config.storeEncryption.secret
+      config.storeEncryption.secret = 'store-encryption-key-0123456789abcdef'
+      try {
+        const token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+
+        const res = await request(app)
+          .get('/admin/config')
+          .set('Authorization', `Bearer ${token}`)
+
+        expect(res.status).toBe(200)
+        expect(res.text).not.toContain('store-encryption-key-0123456789abcdef')
+        expect(res.body.config.storeEncryption).toEqual({})
+      } finally {
+        config.storeEncryption.secret = original
+      }
+    })
+
+    test('should require a bearer token', async () => {
+      const res = await request(app).get('/admin/config')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('should require the admin scope', async () => {
+      const token = generateToken({ sub: 'user1', scope: 'user:read', token_type: 'access' })
+
+      const res = await request(app)
+        .get('/admin/config')
+        .set('Authorization', `Bearer ${token}`)
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('insufficient_scope')
+    })
+  })
+  describe('GET /admin/clients', () => {
+    let token
+
+    beforeEach(async () => {
+      token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+      for (let i = 1; i <= 5; i++) {
+        await addClient({
+          client_id: `client-${i}`,
+          client_secret: `secret-${i}`,
+          client_name: i % 2 ? `Mobile App ${i}` : `Backend ${i}`,
+          grant_types: i % 2 ? ['authorization_code'] : ['client_credentials'],
+          created_at: i
+        })
+      }
+    })
+
+    const list = (query) => request(app)
+      .get('/admin/clients')
+      .set('Authorization', `Bearer ${token}`)
+      .query(query)
+
+    test('should page through all clients with the next cursor', async () => {
+      const first = await list({ limit: 2 })
+      expect(first.status).toBe(200)
+      expect(first.body.total).toBe(5)
+      expect(first.body.clients.map(c => c.client_id)).toEqual(['client-1', 'client-2'])
+
+      const second = await list({ limit: 2, cursor: first.body.next_cursor })
+      expect(second.body.clients.map(c => c.client_id)).toEqual(['client-3', 'client-4'])
+
+      const last = await list({ limit: 2, cursor: second.body.next_cursor })
+      expect(last.body.clients.map(c => c.client_id)).toEqual(['client-5'])
+      expect(last.body.next_cursor).toBeNull()
+    })
+
+    test('should return no next cursor when the page is exactly full', async () => {
+      const res = await list({ limit: 5 })
+
+      expect(res.body.clients.length).toBe(5)
+      expect(res.body.next_cursor).toBeNull()
+    })
+
+    test('should filter by name', async () => {
+      const res = await list({ name: 'mobile', sort: '-created_at' })
+
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(3)
+      expect(res.body.clients.map(c => c.client_id)).toEqual(['client-5', 'client-3', 'client-1'])
+    })
+
+    test('should filter by grant type', async () => {
+      const res = await list({ grant_type: 'client_credentials' })
+
+      expect(res.body.clients.map(c => c.client_id)).toEqual(['client-2', 'client-4'])
+    })
+
+    test('should never return client secrets', async () => {
+      const res = await list({ limit: 100 })
+
+      expect(res.status).toBe(200)
+      for (const client of res.body.clients) {
+        expect(client).not.toHaveProperty('client_secret')
+        expect(client).not.toHaveProperty('previous_client_secret')
+      }
+      expect(res.text).not.toContain('secret-1')
+    })
+
+    test('should reject invalid paging parameters', async () => {
+      for (const query of [{ limit: '0' }, { limit: '101' }, { limit: 'ten' }, { cursor: 'not-a-cursor' }, { sort: 'client_secret' }]) {
+        const res = await list(query)
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_request')
+      }
+    })
+
+    test('should require the admin scope', async () => {
+      token = generateToken({ sub: 'user1', scope: 'user:read', token_type: 'access' })
+
+      const res = await list({})
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('insufficient_scope')
+    })
+  })
+
+  describe('PATCH /admin/clients/:clientId', () => {
+    let token
+
+    beforeEach(async () => {
+      token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+      await addClient({ client_id: 'first-party', client_secret: 'secret', redirect_uris: [] })
+    })
+
+    const patch = (clientId, body) => request(app)
+      .patch(`/admin/clients/${clientId}`)
+      .set('Authorization', `Bearer ${token}`)
+      .send(body)
+
+    test('should mark a client as trusted', async () => {
+      const res = await patch('first-party', { skip_consent: true })
+
+      expect(res.status).toBe(200)
+      expect(res.body.skip_consent).toBe(true)
+      expect(res.body.client_secret).toBeUndefined()
+      expect((await getClient('first-party')).skip_consent).toBe(true)
+    })
+
+    test('should reject a non-boolean flag', async () => {
+      const res = await patch('first-party', { skip_consent: 'yes' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('should allow the session bridge only for a trusted client', async () => {
+      const refused = await patch('first-party', { session_bridge: true })
+      expect(refused.status).toBe(400)
+      expect(refused.body.error).toBe('invalid_request')
+
+      const res = await patch('first-party', { skip_consent: true, session_bridge: true })
+      expect(res.status).toBe(200)
+      expect(res.body.session_bridge).toBe(true)
+
+      await patch('first-party', { skip_consent: false })
+      expect((await getClient('first-party')).session_bridge).toBe(false)
+    })
+
+    test('should reject an unknown client', async () => {
+      const res = await patch('missing', { skip_consent: true })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('should set client default claims', async () => {
+      const res = await patch('first-party', { default_claims: { tenant: 'acme' } })
+
+      expect(res.status).toBe(200)
+      expect(res.body.default_claims).toEqual({ tenant: 'acme' })
+      expect((await getClient('first-party')).default_claims).toEqual({ tenant: 'acme' })
+      expect((await getClient('first-party')).skip_consent).toBeUndefined()
+    })
+
+    test('should reject default claims that set a protected claim', async () => {
+      const res = await patch('first-party', { default_claims: { sub: 'admin' } })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error_description).toBe("default_claims must not set the 'sub' claim")
+    })
+
+    test('should disable and re-enable a client', async () => {
+      const tokenApp = express()
+      tokenApp.use(express.urlencoded({ extended: true }))
+      tokenApp.use('/token', tokenRouter)
+      tokenApp.use(errorHandler)
+      const authenticate = () => request(tokenApp)
+        .post('/token')
+        .type('form')
+        .send({ grant_type: 'client_credentials', client_id: 'first-party', client_secret: 'secret' })
+
+      const res = await patch('first-party', { status: 'disabled' })
+      expect(res.status).toBe(200)
+      expect(res.body.status).toBe('disabled')
+
+      const refused = await authenticate()
+      expect(refused.status).toBe(400)
+      expect(refused.body.error).toBe('invalid_client')
+
+      await patch('first-party', { status: 'active' })
+      expect((await authenticate()).body.error).not.toBe('invalid_client')
+    })
+
+    test('should reject an unknown status', async () => {
+      const res = await patch('first-party', { status: 'suspended' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('should require a change', async () => {
+      const res = await patch('first-party', {})
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+  })
+
+  describe('POST /admin/keys/rotate', () => {
+    const originalDelay = config.signingKeys.activationDelay
+    let token
+
+    beforeEach(() => {
+      config.signingKeys.activationDelay = 600
+      // Resolve the verification key per token, as the server does
+      setPublicKey(getPublicKeyPem)
+      token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+    })
+
+    afterEach(() => {
+      config.signingKeys.activationDelay = originalDelay
+    })
+
+    const rotate = (bearer = token) => request(app)
+      .post('/admin/keys/rotate')
+      .set('Authorization', `Bearer ${bearer}`)
+
+    test('should publish a new key that activates after the delay', async () => {
+      const before = Date.now()
+      const res = await rotate()
+
+      expect(res.status).toBe(202)
+      const activatesAt = Date.parse(res.body.activates_at)
+      expect(activatesAt).toBeGreaterThanOrEqual(before + 600 * 1000)
+
+      const keys = await request(app).get('/admin/keys').set('Authorization', `Bearer ${token}`)
+      expect(keys.body.next.kid).toBe(res.body.kid)
+      expect(keys.body.current).not.toBe(res.body.kid)
+    })
+
+    test('should refuse a second rotation while one is pending', async () => {
+      await rotate()
+
+      const res = await rotate()
+
+      expect(res.status).toBe(400)
+      expect(res.body.error_description).toContain('is already waiting to be activated')
+    })
+
+    test('should accept tokens signed before and after activation', async () => {
+      const { kid } = (await rotate()).body
+      getKeyRotation(Date.now() + 600 * 1000)
+      const newToken = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+
+      expect(verifyToken(newToken).sub).toBe('admin')
+      expect((await request(app).get('/admin/keys').set('Authorization', `Bearer ${newToken}`)).body.current).toBe(kid)
+      expect((await request(app).get('/admin/keys').set('Authorization', `Bearer ${token}`)).status).toBe(200)
+    })
+  })
+
+  describe('POST /admin/tokens/:jti/revoke', () => {
+    let token
+
+    beforeEach(async () => {
+      token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+      await addIssuedToken({ jti: 'issued-jti', client_id: 'app', sub: 'user1', scope: 'read', expiresAt: Date.now() + 60000 })
+    })
+
+    const revoke = (jti) => request(app)
+      .post(`/admin/tokens/${jti}/revoke`)
+      .set('Authorization', `Bearer ${token}`)
+
+    test('should revoke the token with the jti', async () => {
+      const res = await revoke('issued-jti')
+
+      expect(res.status).toBe(204)
+      expect((await getIssuedToken('issued-jti')).revokedAt).toBeDefined()
+    })
+
+    test('should reject an unknown jti', async () => {
+      const res = await revoke('missing-jti')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error_description).toBe('Token not found or already expired')
+    })
+  })
+
+  describe('GET /admin/clients/:clientId/jwks', () => {
+    const signingKey = {
+      ...crypto.generateKeyPairSync('ec', { namedCurve: 'P-256' }).publicKey.export({ format: 'jwk' }),
+      kid: 'client-key',
+      use: 'sig'
+    }
+    let token
+    let server
+    let baseUrl
+
+    beforeEach(async () => {
+      token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+      config.registration.allowPrivateJwksUris = true
+      server = http.createServer((req, res) => {
+        res.writeHead(req.url === '/jwks' ? 200 : 404, { 'Content-Type': 'application/json' })
+        res.end(req.url === '/jwks' ? JSON.stringify({ keys: [signingKey] }) : '{}')
+      })
+      await new Promise(resolve => server.listen(0, '127.0.0.1', resolve))
+      baseUrl = `http://127.0.0.1:${server.address().port}`
+    })
+
+    afterEach(async () => {
+      config.registration.allowPrivateJwksUris = false
+      await new Promise(resolve => server.close(resolve))
+    })
+
+    const check = (clientId) => request(app)
+      .get(`/admin/clients/${clientId}/jwks`)
+      .set('Authorization', `Bearer ${token}`)
+
+    test('should report a valid jwks_uri as healthy', async () => {
+      await addClient({ client_id: 'jwt-client', jwks_uri: `${baseUrl}/jwks` })
+
+      const res = await check('jwt-client')
+
+      expect(res.status).toBe(200)
+      expect(res.body.healthy).toBe(true)
+      expect(res.body.jwks_uri).toBe(`${baseUrl}/jwks`)
+      expect(res.body.keys[0].kid).toBe('client-key')
+    })
+
+    test('should report the problem with a broken jwks_uri', async () => {
+      await addClient({ client_id: 'jwt-client', jwks_uri: `${baseUrl}/moved` })
+
+      const res = await check('jwt-client')
+
+      expect(res.status).toBe(200)
+      expect(res.body.healthy).toBe(false)
+      expect(res.body.problems).toEqual([{ code: 'unreachable', message: 'The jwks_uri could not be retrieved' }])
+    })
+
+    test('should report an unreachable jwks_uri', async () => {
+      await addClient({ client_id: 'jwt-client', jwks_uri: `${baseUrl}/jwks` })
+      await new Promise(resolve => server.close(resolve))
+      server = http.createServer()
+      server.listen(0)
+
+      const res = await check('jwt-client')
+
+      expect(res.body.healthy).toBe(false)
+      expect(res.body.problems.map(p => p.code)).toEqual(['unreachable'])
+    })
+
+    test('should answer invalid_request for an unknown client', async () => {
+      const res = await check('nope')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+  })
+
+  describe('POST /admin/claims/preview', () => {
+    const scope = 'openid profile email read'
+    let token
+    let fullApp
+
+    // Time claims differ between any two issuances
+    const withoutTimes = ({ iat, exp, nbf, auth_time, ...claims }) => claims
+
+    beforeEach(async () => {
+      token = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+      await addClient({
+        client_id: 'web-app',
+        client_secret: 'web-secret',
+        redirect_uris: ['http://localhost:3000/callback'],
+        scope: 'openid profile email read'
+      })
+
+      fullApp = express()
+      fullApp.use(express.json())
+      fullApp.use(express.urlencoded({ extended: true }))
+      fullApp.use('/admin', adminRouter)
+      fullApp.use('/token', tokenRouter)
+      fullApp.use('/userinfo', userinfoRouter)
+      fullApp.use(errorHandler)
+    })
+
+    const preview = (body) => request(fullApp)
+      .post('/admin/claims/preview')
+      .set('Authorization', `Bearer ${token}`)
+      .send(body)
+
+    const originalIssuer = process.env.ISSUER
+
+    afterEach(() => {
+      if (originalIssuer === undefined) {
+        delete process.env.ISSUER
+      } else {
+        process.env.ISSUER = originalIssuer
+      }
+    })
+
+    test('should match the claims of a real issuance', async () => {
+      // Each supertest request listens on its own port, so pin the issuer
+      process.env.ISSUER = 'http://localhost:3000'
+      const res = await preview({ user: 'testuser', client_id: 'web-app', scope })
+      expect(res.status).toBe(200)
+
+      await addCode({
+        code: 'preview-code',
+        client_id: 'web-app',
+        redirect_uri: 'http://localhost:3000/callback',
+        scope,
+        userId: 'user1',
+        authTime: Date.now(),
+        amr: ['pwd'],
+        acr: acrForAmr(['pwd']),
+        expiresAt: Date.now() + 600000
+      })
+      const issued = await request(fullApp)
+        .post('/token')
+        .type('form')
+        .send({
+          grant_type: 'authorization_code',
+          code: 'preview-code',
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: 'web-app',
+          client_secret: 'web-secret'
+        })
+      expect(issued.status).toBe(200)
+
+      expect(res.body.scope).toBe(issued.body.scope)
+      expect(withoutTimes(res.body.access_token_claims)).toEqual(withoutTimes(verifyToken(issued.body.access_token)))
+      expect(withoutTimes(res.body.id_token_claims)).toEqual(withoutTimes(verifyToken(issued.body.id_token)))
+
+      const userinfo = await request(fullApp)
+        .get('/userinfo')
+        .set('Authorization', `Bearer ${issued.body.access_token}`)
+      expect(res.body.userinfo).toEqual(userinfo.body)
+    })
+
+    test('should follow the configured scope claim', async () => {
+      const original = { ...config.claims }
+      config.claims.scopeClaimName = 'scp'
+      config.claims.scopeFormat = 'array'
+      try {
+        const res = await preview({ user: 'user1', client_id: 'web-app', scope: 'read' })
+
+        expect(res.body.access_token_claims.scp).toEqual(['read'])
+        expect(res.body.access_token_claims).not.toHaveProperty('scope')
+        expect(res.body.id_token_claims).toBeNull()
+      } finally {
+        Object.assign(config.claims, original)
+      }
+    })
+
+    test('should not return anything usable as a token', async () => {
+      const res = await preview({ user: 'testuser', client_id: 'web-app', scope })
+
+      expect(JSON.stringify(res.body)).not.toMatch(/eyJ[\w-]+\.[\w-]+\./)
+      expect(res.body).not.toHaveProperty('access_token')
+      expect(res.body).not.toHaveProperty('id_token')
+    })
+
+    test('should reject scopes the client cannot get', async () => {
+      const res = await preview({ user: 'testuser', client_id: 'web-app', scope: 'openid admin' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+    })
+
+    test('should reject unknown users and clients', async () => {
+      const noUser = await preview({ user: 'nobody', client_id: 'web-app', scope })
+      const noClient = await preview({ user: 'testuser', client_id: 'missing', scope })
+
+      expect(noUser.status).toBe(400)
+      expect(noUser.body.error_description).toBe('User not found')
+      expect(noClient.status).toBe(400)
+      expect(noClient.body.error_description).toBe('Client not found')
+    })
+
+    test('should require the admin scope', async () => {
+      token = generateToken({ sub: 'user1', scope: 'user:read', token_type: 'access' })
+
+      const res = await preview({ user: 'testuser', client_id: 'web-app', scope })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('insufficient_scope')
+    })
+  })
+})
@@ -8,10 +8,16 @@ const crypto = require('crypto')
 const fs = require('fs')
 const path = require('path')
 const os = require('os')
-const { initDb, addClient, getCodes } = require('../../src/db')
+const config = require('../../src/config')
+const bcrypt = require('bcrypt')
+const { initDb, addClient, addUser, getCodes, getCode, getConsent, getUser, addRefreshToken, getRefreshToken, addIssuedToken, getIssuedToken } = require('../../src/db')
 const { ensurePrivateKey } = require('../../src/tokens')
 const authorizeRouter = require('../../src/routes/authorize')
+const { setChallengeVerifier } = require('../../src/challenge')
+const { generateTotp } = require('../../src/acr')
 const { errorHandler } = require('../../src/errors')
+const { subscribeEvents } = require('../../src/eventStream')
+const { sessionCookieOptions } = require('../../src/sessions')
 
 describe('Authorization Endpoint', () => {
   let app
@@ -105,6 +111,36 @@ describe('Authorization Endpoint', () => {
       expect(res.body.error).toBe('unsupported_response_type')
     })
 
+    test('should reject the implicit flow for a confidential client', async () => {
+      for (const response_type of ['token', 'id_token', 'id_token token', 'code id_token']) {
+        const res = await request(app)
+          .get('/authorize')
+          .query({
+            client_id: 'test-client',
+            redirect_uri: 'http://localhost:3000/callback',
+            response_type,
+            nonce: 'n-1'
+          })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('unsupported_response_type')
+        expect(res.body.error_description).toBe('The implicit flow is not supported; use response_type=code')
+      }
+    })
+
+    test('should accept the code flow for the same client', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({
+          client_id: 'test-client',
+          redirect_uri: 'http://localhost:3000/callback',
+          response_type: 'code'
+        })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Sign In')
+    })
+
     test('should reject invalid client_id', async () => {
       const res = await request(app)
         .get('/authorize')
@@ -161,6 +197,168 @@ describe('Authorization Endpoint', () => {
     })
   })
 
+  describe('machine-only scopes', () => {
+    afterEach(() => {
+      config.scopePolicy.machineOnlyScopes = []
+    })
+
+    test('should reject a machine-only scope in an interactive flow', async () => {
+      config.scopePolicy.machineOnlyScopes = ['jobs:run']
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({
+          client_id: 'test-client',
+          redirect_uri: 'http://localhost:3000/callback',
+          response_type: 'code',
+          scope: 'read jobs:run'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.error_description).toContain("'jobs:run'")
+    })
+
+    test('should reject a machine-only scope posted with the login form', async () => {
+      config.scopePolicy.machineOnlyScopes = ['jobs:run']
+      const query = { client_id: 'test-client', redirect_uri: 'http://localhost:3000/callback', response_type: 'code' }
+      const form = await request(app).get('/authorize').query(query)
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({
+          _csrf: form.text.match(/name="_csrf" value="([^"]+)"/)[1],
+          username: 'testuser',
+          password: 'testpass',
+          ...query,
+          scope: 'read jobs:run'
+        })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Scope &#39;jobs:run&#39; is only available for client_credentials')
+      expect(await getCodes()).toEqual([])
+    })
+  })
+
+  describe('GET /authorize request limits', () => {
+    const baseQuery = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code'
+    }
+    let original
+
+    let originalScopeParsing
+
+    beforeEach(() => {
+      original = { ...config.authorizeRequest }
+      originalScopeParsing = { ...config.scopeParsing }
+    })
+
+    afterEach(() => {
+      Object.assign(config.authorizeRequest, original)
+      Object.assign(config.scopeParsing, originalScopeParsing)
+    })
+
+    test('should reject a query string over the maximum length', async () => {
+      config.authorizeRequest.maxQueryLength = 512
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, scope: 'read '.repeat(200) })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toContain('exceeds 512 characters')
+    })
+
+    test('should accept a query string within the maximum length', async () => {
+      config.authorizeRequest.maxQueryLength = 512
+
+      const res = await request(app)
+        .get('/authorize')
+        .query(baseQuery)
+
+      expect(res.status).toBe(200)
+    })
+
+    test('should reject more scopes than the maximum count', async () => {
+      config.scopeParsing.maxScopes = 3
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, scope: 'openid profile email offline_access' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.error_description).toBe('At most 3 scopes may be requested, got 4')
+    })
+
+    test('should count scopes after removing duplicates', async () => {
+      config.scopeParsing.maxScopes = 3
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, scope: 'openid profile openid email profile' })
+
+      expect(res.status).toBe(200)
+    })
+
+    test('should reject a scope longer than the maximum length', async () => {
+      config.scopeParsing.maxScopeLength = 16
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, scope: 'openid profile email' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.error_description).toContain('at most 16 characters')
+    })
+
+    test('should reject a repeated parameter', async () => {
+      const res = await request(app)
+        .get('/authorize?client_id=test-client&redirect_uri=http%3A%2F%2Flocalhost%3A3000%2Fcallback' +
+          '&redirect_uri=http%3A%2F%2Fevil.example.com%2Fcallback&response_type=code')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toContain("'redirect_uri' must be a single value")
+    })
+
+    test('should ignore unknown parameters by default', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, utm_source: 'newsletter' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Sign In')
+    })
+
+    test('should reject unknown parameters in strict mode', async () => {
+      config.authorizeRequest.strictParameters = true
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, utm_source: 'newsletter' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toBe('Unrecognized parameter: utm_source')
+    })
+
+    test('should accept recognized parameters in strict mode', async () => {
+      config.authorizeRequest.strictParameters = true
+
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...baseQuery, scope: 'openid', state: 'abc', nonce: 'n-1', login_hint: 'testuser' })
+
+      expect(res.status).toBe(200)
+    })
+  })
+
   describe('POST /authorize', () => {
     // Helper function to extract CSRF token from login form
     // This must maintain cookies across requests
@@ -209,6 +407,30 @@ describe('Authorization Endpoint', () => {
       expect(code.length).toBeGreaterThan(0)
     })
 
+    test('should store the normalized scope on the code', async () => {
+      const { token: csrfToken, cookies } = await getCsrfTokenAndCookies({
+        client_id: 'test-client',
+        redirect_uri: 'http://localhost:3000/callback',
+        response_type: 'code'
+      })
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrfToken,
+          username: 'testuser',
+          password: 'testpass',
+          client_id: 'test-client',
+          redirect_uri: 'http://localhost:3000/callback',
+          scope: ' openid  profile openid '
+        })
+
+      expect(res.status).toBe(302)
+      const codes = await getCodes()
+      expect(codes[codes.length - 1].scope).toBe('openid profile')
+    })
+
     test('should preserve state parameter in redirect', async () => {
       const { token: csrfToken, cookies } = await getCsrfTokenAndCookies({
         client_id: 'test-client',
@@ -405,4 +627,1614 @@ describe('Authorization Endpoint', () => {
       expect(res.body.error).toBe('invalid_request')
     })
   })
+
+  describe('response modes', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      state: 'mode-1'
+    }
+
+    const login = async (responseMode) => {
+      const form = await request(app).get('/authorize').query({ ...query, response_mode: responseMode })
+      return request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({
+          ...query,
+          response_mode: responseMode,
+          _csrf: form.text.match(/name="_csrf" value="([^"]+)"/)[1],
+          username: 'testuser',
+          password: 'testpass'
+        })
+    }
+
+    // Authorization response parameters, however they were delivered
+    const responseParams = (res) => {
+      if (res.status === 200) {
+        const params = new URLSearchParams()
+        for (const [, name, value] of res.text.matchAll(/<input type="hidden" name="([^"]+)" value="([^"]*)" \/>/g)) {
+          params.set(name, value.replace(/&quot;/g, '"').replace(/&lt;/g, '<').replace(/&gt;/g, '>').replace(/&amp;/g, '&'))
+        }
+        return params
+      }
+      const url = new URL(res.headers.location)
+      return url.hash ? new URLSearchParams(url.hash.slice(1)) : url.searchParams
+    }
+
+    test.each(['query', 'fragment', 'form_post'])('should include iss in a %s response', async (mode) => {
+      const res = await login(mode)
+      const params = responseParams(res)
+
+      expect(params.get('code')).toBeTruthy()
+      expect(params.get('state')).toBe('mode-1')
+      expect(params.get('iss')).toBe(config.issuer)
+    })
+
+    test('should default to the query response mode', async () => {
+      const res = await login(undefined)
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('iss')).toBe(config.issuer)
+    })
+
+    test('should put the response in the fragment', async () => {
+      const res = await login('fragment')
+      const url = new URL(res.headers.location)
+
+      expect(url.search).toBe('')
+      expect(new URLSearchParams(url.hash.slice(1)).get('code')).toBeTruthy()
+    })
+
+    test('should post the response to the redirect_uri', async () => {
+      const res = await login('form_post')
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('action="http://localhost:3000/callback"')
+      expect(res.headers['cache-control']).toBe('no-store')
+      expect(res.headers['content-security-policy']).toContain('form-action http://localhost:3000')
+    })
+
+    test.each(['query', 'fragment', 'form_post'])('should include iss in a %s error response', async (mode) => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, response_mode: mode, prompt: 'none' })
+      const params = responseParams(res)
+
+      expect(params.get('error')).toBe('login_required')
+      expect(params.get('state')).toBe('mode-1')
+      expect(params.get('iss')).toBe(config.issuer)
+    })
+
+    test('should reject an unsupported response_mode', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, response_mode: 'query.jwt' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+  })
+
+  describe('error pages', () => {
+    const invalidRedirect = {
+      client_id: 'test-client',
+      redirect_uri: 'http://evil.example.com/callback',
+      response_type: 'code'
+    }
+
+    test('should return a JSON error to API clients', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .set('Accept', 'application/json')
+        .query(invalidRedirect)
+
+      expect(res.status).toBe(400)
+      expect(res.headers['content-type']).toMatch(/application\/json/)
+      expect(res.body).toEqual({ error: 'invalid_request', error_description: 'Invalid redirect_uri' })
+    })
+
+    test('should render an HTML error page for browsers', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .set('Accept', 'text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8')
+        .query(invalidRedirect)
+
+      expect(res.status).toBe(400)
+      expect(res.headers['content-type']).toMatch(/text\/html/)
+      expect(res.text).toContain('Authorization Error')
+      expect(res.text).toContain('invalid_request')
+      expect(res.text).toContain('Invalid redirect_uri')
+    })
+
+    test('should escape request parameters echoed in the page', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .set('Accept', 'text/html')
+        .query({
+          client_id: 'test-client',
+          redirect_uri: 'http://localhost:3000/callback',
+          response_type: 'code',
+          response_mode: '<script>alert("xss")</script>'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.text).not.toContain('<script>')
+      expect(res.text).toContain('&lt;script&gt;alert(&quot;xss&quot;)&lt;/script&gt;')
+    })
+
+    test('should use the configured template', async () => {
+      const template = path.join(testDir, 'error.html')
+      fs.writeFileSync(template, '<html><body><h1>Sign-in problem</h1><p>{{error}}: {{error_description}}</p></body></html>')
+      config.authorizeRequest.errorPageTemplate = template
+
+      try {
+        const res = await request(app)
+          .get('/authorize')
+          .set('Accept', 'text/html')
+          .query(invalidRedirect)
+
+        expect(res.status).toBe(400)
+        expect(res.text).toContain('<h1>Sign-in problem</h1>')
+        expect(res.text).toContain('<p>invalid_request: Invalid redirect_uri</p>')
+      } finally {
+        config.authorizeRequest.errorPageTemplate = null
+      }
+    })
+  })
+
+  describe('bcrypt cost upgrade', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code'
+    }
+
+    beforeEach(async () => {
+      await addUser({
+        id: 'user_legacy',
+        username: 'legacyuser',
+        email: 'legacy@example.com',
+        name: 'Legacy User',
+        password: await bcrypt.hash('legacypass', 4),
+        failedLoginAttempts: 0
+      })
+    })
+
+    const login = async (password) => {
+      const form = await request(app).get('/authorize').query(query)
+      const csrfToken = form.text.match(/name="_csrf" value="([^"]+)"/)[1]
+      return request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, _csrf: csrfToken, username: 'legacyuser', password })
+    }
+
+    test('should rehash a lower-cost hash at the configured cost on login', async () => {
+      const res = await login('legacypass')
+      expect(res.status).toBe(302)
+
+      const user = await getUser('legacyuser')
+      expect(bcrypt.getRounds(user.password)).toBe(config.passwords.bcryptCost)
+      expect(await bcrypt.compare('legacypass', user.password)).toBe(true)
+    })
+
+    test('should keep the hash after a failed login', async () => {
+      const before = (await getUser('legacyuser')).password
+
+      const res = await login('wrong-password')
+      expect(res.status).toBe(200)
+
+      expect((await getUser('legacyuser')).password).toBe(before)
+    })
+  })
+
+  describe('redirect_uri_matching policy', () => {
+    beforeEach(async () => {
+      await addClient({
+        client_id: 'exact-client',
+        client_secret: 'test-secret',
+        redirect_uris: ['http://localhost:3000/callback?tenant=acme'],
+        redirect_uri_matching: 'exact'
+      })
+      await addClient({
+        client_id: 'lenient-client',
+        client_secret: 'test-secret',
+        redirect_uris: ['http://localhost:3000/callback?tenant=acme'],
+        redirect_uri_matching: 'exact_ignoring_query'
+      })
+    })
+
+    const authorizeAndLogin = async (clientId, redirectUri) => {
+      const form = await request(app)
+        .get('/authorize')
+        .query({ client_id: clientId, redirect_uri: redirectUri, response_type: 'code' })
+
+      const match = form.text.match(/name="_csrf" value="([^"]+)"/)
+
+      return request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({
+          _csrf: match ? match[1] : null,
+          username: 'testuser',
+          password: 'testpass',
+          client_id: clientId,
+          redirect_uri: redirectUri,
+          state: 'xyz'
+        })
+    }
+
+    test('exact: should accept the registered URI and keep its query', async () => {
+      const res = await authorizeAndLogin('exact-client', 'http://localhost:3000/callback?tenant=acme')
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('tenant')).toBe('acme')
+      expect(url.searchParams.get('code')).toBeTruthy()
+      expect(url.searchParams.get('state')).toBe('xyz')
+    })
+
+    test('exact: should reject an unexpected extra query parameter', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({
+          client_id: 'exact-client',
+          redirect_uri: 'http://localhost:3000/callback?tenant=acme&next=http://evil.com',
+          response_type: 'code'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('exact: should reject a deviating query value', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({
+          client_id: 'exact-client',
+          redirect_uri: 'http://localhost:3000/callback?tenant=other',
+          response_type: 'code'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('exact_ignoring_query: should accept the registered URI', async () => {
+      const res = await authorizeAndLogin('lenient-client', 'http://localhost:3000/callback?tenant=acme')
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('code')).toBeTruthy()
+    })
+
+    test('exact_ignoring_query: should accept a deviating query and append OAuth params', async () => {
+      const res = await authorizeAndLogin('lenient-client', 'http://localhost:3000/callback?tenant=other&page=2')
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.origin + url.pathname).toBe('http://localhost:3000/callback')
+      expect(url.searchParams.get('tenant')).toBe('other')
+      expect(url.searchParams.get('page')).toBe('2')
+      expect(url.searchParams.get('code')).toBeTruthy()
+      expect(url.searchParams.get('state')).toBe('xyz')
+    })
+
+    test('exact_ignoring_query: should escape markup in the query on the login form', async () => {
+      const redirectUri = 'http://localhost:3000/callback?x="><script>alert(1)</script>'
+      const res = await request(app)
+        .get('/authorize')
+        .query({ client_id: 'lenient-client', redirect_uri: redirectUri, response_type: 'code' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).not.toContain('<script>alert(1)')
+      expect(res.text).toContain('name="redirect_uri" value="http://localhost:3000/callback?x=&quot;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"')
+    })
+
+    test('exact_ignoring_query: should reject a different path', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({
+          client_id: 'lenient-client',
+          redirect_uri: 'http://localhost:3000/other?tenant=acme',
+          response_type: 'code'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+  })
+
+  describe('existing session', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid profile',
+      state: 'st-1'
+    }
+
+    const csrfFrom = (res) => {
+      const match = res.text.match(/name="_csrf" value="([^"]+)"/)
+      return match ? match[1] : null
+    }
+
+    // Log in and return the session cookies
+    const login = async () => {
+      const form = await request(app).get('/authorize').query(query)
+      const cookies = form.headers['set-cookie'] || []
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrfFrom(form),
+          username: 'testuser',
+          password: 'testpass',
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          scope: query.scope,
+          state: query.state
+        })
+
+      return { res, cookies }
+    }
+
+    afterEach(() => {
+      config.consent.required = false
+    })
+
+    test('should redirect with a code without interaction', async () => {
+      const { cookies } = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query(query)
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('code')).toBeTruthy()
+      expect(url.searchParams.get('state')).toBe('st-1')
+    })
+
+    test('should record auth time on the code', async () => {
+      const { cookies } = await login()
+
+      await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query(query)
+
+      const codes = await getCodes()
+      expect(codes.length).toBe(2)
+      expect(codes[1].authTime).toBe(codes[0].authTime)
+    })
+
+    test('should show the login form again with prompt=login', async () => {
+      const { cookies } = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, prompt: 'login' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Sign In')
+      expect(res.text).toContain('name="prompt" value="login"')
+    })
+
+    test('should show the login form when max_age has elapsed', async () => {
+      const { cookies } = await login()
+      await new Promise(resolve => setTimeout(resolve, 1100))
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, max_age: '0' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Sign In')
+    })
+
+    test('should force the consent screen with prompt=consent', async () => {
+      const { cookies } = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, prompt: 'consent' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Authorize test-client')
+      expect(res.text).toContain('<li>profile</li>')
+      expect(res.text).toContain('action="/authorize/consent"')
+    })
+
+    test('should escape the client name and request values on the consent page', async () => {
+      await addClient({
+        client_id: 'registered-app',
+        client_secret: 'secret',
+        client_name: '<script>alert(1)</script>',
+        redirect_uris: ['http://localhost:3000/callback']
+      })
+      const { cookies } = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, client_id: 'registered-app', prompt: 'consent', scope: 'openid <b>x</b>', state: '"><script>alert(2)</script>', nonce: '"><img src=x>' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).not.toContain('<script>alert')
+      expect(res.text).not.toContain('<b>x</b>')
+      expect(res.text).not.toContain('"><img')
+      expect(res.text).toContain('Authorize &lt;script&gt;alert(1)&lt;/script&gt;')
+      expect(res.text).toContain('name="state" value="&quot;&gt;&lt;script&gt;alert(2)&lt;/script&gt;"')
+    })
+
+    test('should issue a code once consent is granted', async () => {
+      const { cookies } = await login()
+
+      const form = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, prompt: 'consent' })
+
+      const res = await request(app)
+        .post('/authorize/consent')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrfFrom(form),
+          decision: 'allow',
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          scope: query.scope,
+          state: query.state
+        })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('code')).toBeTruthy()
+
+      const consent = await getConsent((await getCodes())[0].userId, 'test-client')
+      expect(consent.scopes).toEqual(['openid', 'profile'])
+    })
+
+    test('should check the scope again when the consent form is submitted', async () => {
+      config.scopePolicy.machineOnlyScopes = ['jobs:run']
+      try {
+        const { cookies } = await login()
+
+        const form = await request(app)
+          .get('/authorize')
+          .set('Cookie', cookies)
+          .query({ ...query, prompt: 'consent' })
+
+        for (const scope of ['openid admin', 'openid jobs:run']) {
+          const res = await request(app)
+            .post('/authorize/consent')
+            .set('Cookie', cookies)
+            .send({
+              _csrf: csrfFrom(form),
+              decision: 'allow',
+              client_id: query.client_id,
+              redirect_uri: query.redirect_uri,
+              scope,
+              state: query.state
+            })
+
+          expect(res.status).toBe(302)
+          const url = new URL(res.headers.location)
+          expect(url.searchParams.get('error')).toBe('invalid_scope')
+          expect(url.searchParams.get('code')).toBeNull()
+        }
+        const codes = await getCodes()
+        expect(codes.length).toBe(1)
+        expect((await getConsent(codes[0].userId, 'test-client')).scopes).toEqual(['openid', 'profile'])
+      } finally {
+        config.scopePolicy.machineOnlyScopes = []
+      }
+    })
+
+    test('should redirect with access_denied when consent is denied', async () => {
+      const { cookies } = await login()
+
+      const form = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, prompt: 'consent' })
+
+      const res = await request(app)
+        .post('/authorize/consent')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrfFrom(form),
+          decision: 'deny',
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          scope: query.scope,
+          state: query.state
+        })
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('access_denied')
+      expect(url.searchParams.get('state')).toBe('st-1')
+    })
+
+    test('should ask for consent after login when consent is required', async () => {
+      config.consent.required = true
+
+      const { res } = await login()
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Authorize test-client')
+    })
+
+    test('should skip consent when stored consent covers the scopes', async () => {
+      config.consent.required = true
+      const { res: consentPage, cookies } = await login()
+
+      await request(app)
+        .post('/authorize/consent')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrfFrom(consentPage),
+          decision: 'allow',
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          scope: query.scope,
+          state: query.state
+        })
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query(query)
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('code')).toBeTruthy()
+
+      const wider = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, scope: 'openid profile email' })
+
+      expect(wider.status).toBe(200)
+      expect(wider.text).toContain('<li>email</li>')
+    })
+
+    test('should ask for explicit consent to offline access', async () => {
+      const { cookies } = await login()
+      const offlineQuery = { ...query, scope: 'openid profile offline_access' }
+
+      const form = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query(offlineQuery)
+
+      expect(form.status).toBe(200)
+      expect(form.text).toContain('<strong>Offline access</strong>')
+
+      const res = await request(app)
+        .post('/authorize/consent')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrfFrom(form),
+          decision: 'allow',
+          client_id: offlineQuery.client_id,
+          redirect_uri: offlineQuery.redirect_uri,
+          scope: offlineQuery.scope,
+          state: offlineQuery.state
+        })
+
+      expect(res.status).toBe(302)
+      const code = new URL(res.headers.location).searchParams.get('code')
+      expect((await getCode(code)).scope).toBe('openid profile offline_access')
+
+      // Once granted, offline access no longer needs interaction
+      const again = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query(offlineQuery)
+
+      expect(again.status).toBe(302)
+    })
+
+    test('should return login_required for prompt=none without a session', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, prompt: 'none' })
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('login_required')
+      expect(url.searchParams.get('state')).toBe('st-1')
+    })
+
+    test('should return consent_required for prompt=none without consent', async () => {
+      const { cookies } = await login()
+      config.consent.required = true
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, prompt: 'none' })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('error')).toBe('consent_required')
+    })
+
+    test('should reject prompt=none combined with other values', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, prompt: 'none login' })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('error')).toBe('invalid_request')
+    })
+  })
+
+  describe('trusted clients', () => {
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    const login = async (clientId, extra = {}) => {
+      const query = { client_id: clientId, redirect_uri: 'http://localhost:3000/callback', response_type: 'code', scope: 'openid profile', state: 'st-1', ...extra }
+      const form = await request(app).get('/authorize').query(query)
+
+      return request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ _csrf: csrfFrom(form), username: 'testuser', password: 'testpass', ...query })
+    }
+
+    let subscription
+    let events
+
+    beforeEach(async () => {
+      config.consent.required = true
+      await addClient({
+        client_id: 'first-party',
+        client_secret: 'first-party-secret',
+        redirect_uris: ['http://localhost:3000/callback'],
+        skip_consent: true
+      })
+      events = []
+      subscription = subscribeEvents({ types: ['CONSENT_AUTO_GRANTED'], write: (event) => events.push(event) })
+    })
+
+    afterEach(() => {
+      config.consent.required = false
+      subscription.unsubscribe()
+    })
+
+    test('should skip consent for a trusted client and audit the auto-grant', async () => {
+      const res = await login('first-party')
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('code')).toBeTruthy()
+      expect(events).toHaveLength(1)
+      expect(events[0]).toMatchObject({ client_id: 'first-party', scope: 'openid profile' })
+      expect(events[0].userId).toBeTruthy()
+    })
+
+    test('should still prompt for consent for a normal client', async () => {
+      const res = await login('test-client')
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Authorize test-client')
+      expect(events).toHaveLength(0)
+    })
+
+    test('should show consent to a trusted client that asks with prompt=consent', async () => {
+      const res = await login('first-party', { prompt: 'consent' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Authorize first-party')
+    })
+
+    test('should still require login', async () => {
+      const form = await request(app).get('/authorize').query({
+        client_id: 'first-party',
+        redirect_uri: 'http://localhost:3000/callback',
+        response_type: 'code'
+      })
+      expect(form.status).toBe(200)
+      expect(form.text).toContain('Sign In')
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ _csrf: csrfFrom(form), username: 'testuser', password: 'wrong', client_id: 'first-party', redirect_uri: 'http://localhost:3000/callback' })
+      expect(res.headers.location).toBeUndefined()
+      expect(events).toHaveLength(0)
+    })
+  })
+
+  describe('session limits', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      state: 'st-1'
+    }
+
+    // Log in from a fresh browser and return the response and its cookies
+    const login = async () => {
+      const form = await request(app).get('/authorize').query(query)
+      const cookies = form.headers['set-cookie'] || []
+      const csrf = form.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: csrf,
+          username: 'testuser',
+          password: 'testpass',
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          state: query.state
+        })
+
+      return { res, cookies }
+    }
+
+    // Whether the session behind the cookies is still signed in
+    const isSignedIn = async (cookies) => {
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query(query)
+      return res.status === 302
+    }
+
+    let original
+
+    beforeEach(() => {
+      original = { ...config.sessions }
+      config.sessions.maxPerUser = 2
+    })
+
+    afterEach(() => {
+      Object.assign(config.sessions, original)
+    })
+
+    test('should evict the oldest session past the limit', async () => {
+      config.sessions.limitPolicy = 'evict-oldest'
+
+      const first = await login()
+      const second = await login()
+      const third = await login()
+
+      expect(third.res.status).toBe(302)
+      expect(await isSignedIn(first.cookies)).toBe(false)
+      expect(await isSignedIn(second.cookies)).toBe(true)
+      expect(await isSignedIn(third.cookies)).toBe(true)
+    })
+
+    test('should revoke the refresh tokens issued from an evicted session', async () => {
+      config.sessions.limitPolicy = 'evict-oldest'
+
+      const first = await login()
+      const authCode = await getCode(new URL(first.res.headers.location).searchParams.get('code'))
+      await addRefreshToken({ token: 'first-session-refresh', client_id: 'test-client', userId: authCode.userId, scope: 'offline_access', grantId: 'grant-1', sessionRef: authCode.sessionRef, createdAt: Date.now(), expiresAt: Date.now() + 60000 })
+      await addIssuedToken({ jti: 'first-session-access', client_id: 'test-client', sub: authCode.userId, scope: '', iat: Math.floor(Date.now() / 1000), expiresAt: Date.now() + 60000, grantId: 'grant-1' })
+      await addRefreshToken({ token: 'other-refresh', client_id: 'test-client', userId: authCode.userId, scope: 'offline_access', grantId: 'grant-2', sessionRef: 'other-session', createdAt: Date.now(), expiresAt: Date.now() + 60000 })
+
+      await login()
+      await login()
+
+      expect(await getRefreshToken('first-session-refresh')).toBeUndefined()
+      expect((await getIssuedToken('first-session-access')).revokedAt).toBeDefined()
+      expect(await getRefreshToken('other-refresh')).toBeDefined()
+    })
+
+    test('should refuse a new login past the limit with deny-new', async () => {
+      config.sessions.limitPolicy = 'deny-new'
+
+      const first = await login()
+      const second = await login()
+      const third = await login()
+
+      expect(third.res.status).toBe(200)
+      expect(third.res.text).toContain('Too many active sessions')
+      expect(await isSignedIn(third.cookies)).toBe(false)
+      expect(await isSignedIn(first.cookies)).toBe(true)
+      expect(await isSignedIn(second.cookies)).toBe(true)
+    })
+
+    test('should not count signing in again on the same session', async () => {
+      config.sessions.limitPolicy = 'deny-new'
+      config.sessions.maxPerUser = 1
+
+      const { cookies } = await login()
+      const form = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, prompt: 'login' })
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({
+          _csrf: form.text.match(/name="_csrf" value="([^"]+)"/)[1],
+          username: 'testuser',
+          password: 'testpass',
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          state: query.state
+        })
+
+      expect(res.status).toBe(302)
+    })
+  })
+
+  describe('prompt=create', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid',
+      state: 'signup-1',
+      prompt: 'create'
+    }
+
+    const register = async (fields) => {
+      const form = await request(app).get('/authorize').query(query)
+      const match = form.text.match(/name="_csrf" value="([^"]+)"/)
+
+      return request(app)
+        .post('/authorize/register')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({
+          _csrf: match ? match[1] : null,
+          client_id: query.client_id,
+          redirect_uri: query.redirect_uri,
+          scope: query.scope,
+          state: query.state,
+          prompt: query.prompt,
+          ...fields
+        })
+    }
+
+    test('should land on the registration form', async () => {
+      const res = await request(app).get('/authorize').query(query)
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Create Account')
+      expect(res.text).toContain('action="/authorize/register"')
+      expect(res.text).toContain('name="state" value="signup-1"')
+    })
+
+    test('should resume the authorization request after signup', async () => {
+      const res = await register({ username: 'newuser', email: 'new@example.com', password: 'Str0ngPass!' })
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.origin + url.pathname).toBe('http://localhost:3000/callback')
+      expect(url.searchParams.get('code')).toBeTruthy()
+      expect(url.searchParams.get('state')).toBe('signup-1')
+
+      const user = await getUser('newuser')
+      const codes = await getCodes()
+      expect(codes[0].userId).toBe(user.id)
+    })
+
+    test('should show the form again when signup fails', async () => {
+      const res = await register({ username: 'testuser', email: 'other@example.com', password: 'Str0ngPass!' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Create Account')
+      expect(res.text).toContain('Username already exists')
+    })
+
+    describe('with a challenge', () => {
+      beforeEach(() => {
+        setChallengeVerifier(async ({ token }) => token === 'solved')
+      })
+
+      afterEach(() => {
+        setChallengeVerifier(null)
+      })
+
+      test('should create the account when the challenge is solved', async () => {
+        const res = await register({ username: 'newuser', email: 'new@example.com', password: 'Str0ngPass!', challenge_token: 'solved' })
+
+        expect(res.status).toBe(302)
+        expect(await getUser('newuser')).toBeTruthy()
+      })
+
+      test('should show the form again when the challenge fails', async () => {
+        const res = await register({ username: 'newuser', email: 'new@example.com', password: 'Str0ngPass!', challenge_token: 'guessed' })
+
+        expect(res.status).toBe(200)
+        expect(res.text).toContain('Please complete the challenge')
+        expect(await getUser('newuser')).toBeFalsy()
+      })
+    })
+
+    test('should reject unsupported prompt values', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, prompt: 'create bogus' })
+
+      expect(res.status).toBe(302)
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('invalid_request')
+      expect(url.searchParams.get('error_description')).toContain('bogus')
+    })
+
+    test('should reject prompt=create combined with none', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, prompt: 'none create' })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('error')).toBe('invalid_request')
+    })
+  })
+
+  describe('acr step-up', () => {
+    const TOTP_SECRET = 'GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ'
+    const MFA = 'urn:ngauth:acr:mfa'
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid',
+      state: 'step-1'
+    }
+
+    beforeEach(async () => {
+      await addUser({
+        id: 'user_otp',
+        username: 'otpuser',
+        email: 'otp@example.com',
+        password: await bcrypt.hash('otppass', 4),
+        totpSecret: TOTP_SECRET,
+        failedLoginAttempts: 0
+      })
+    })
+
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+    const codeFrom = (res) => new URL(res.headers.location).searchParams.get('code')
+
+    // Password-only session
+    const login = async () => {
+      const form = await request(app).get('/authorize').query(query)
+      const cookies = form.headers['set-cookie'] || []
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({ ...query, _csrf: csrfFrom(form), username: 'otpuser', password: 'otppass' })
+      return { res, cookies }
+    }
+
+    const stepUp = (cookies, form, otp) => request(app)
+      .post('/authorize/step-up')
+      .set('Cookie', cookies)
+      .send({ ...query, acr_values: MFA, _csrf: csrfFrom(form), otp })
+
+    test('should step a password session up to pwd+otp', async () => {
+      const { res: first, cookies } = await login()
+      const pwdCode = await getCode(codeFrom(first))
+      expect(pwdCode.amr).toEqual(['pwd'])
+      expect(pwdCode.acr).toBe('urn:ngauth:acr:pwd')
+
+      // Only the second factor is asked for, not the password
+      const form = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, acr_values: MFA })
+      expect(form.status).toBe(200)
+      expect(form.text).toContain('name="otp"')
+      expect(form.text).not.toContain('name="password"')
+
+      await new Promise(resolve => setTimeout(resolve, 5))
+      const res = await stepUp(cookies, form, generateTotp(TOTP_SECRET))
+
+      expect(res.status).toBe(302)
+      const mfaCode = await getCode(codeFrom(res))
+      expect(mfaCode.userId).toBe('user_otp')
+      expect(mfaCode.amr).toEqual(['pwd', 'otp'])
+      expect(mfaCode.acr).toBe(MFA)
+      expect(mfaCode.authTime).toBeGreaterThan(pwdCode.authTime)
+    })
+
+    test('should keep the stepped-up session for later requests', async () => {
+      const { cookies } = await login()
+      const form = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, acr_values: MFA })
+      await stepUp(cookies, form, generateTotp(TOTP_SECRET))
+
+      const res = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, acr_values: MFA })
+
+      expect(res.status).toBe(302)
+      expect((await getCode(codeFrom(res))).acr).toBe(MFA)
+    })
+
+    test('should ask for the second factor right after the password when acr_values asks for it', async () => {
+      const form = await request(app).get('/authorize').query({ ...query, acr_values: MFA })
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, acr_values: MFA, _csrf: csrfFrom(form), username: 'otpuser', password: 'otppass' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('name="otp"')
+      expect(res.text).toContain(`name="acr_values" value="${MFA}"`)
+    })
+
+    test('should reject a wrong code and keep the session at pwd', async () => {
+      const { cookies } = await login()
+      const form = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, acr_values: MFA })
+
+      const res = await stepUp(cookies, form, '000000' === generateTotp(TOTP_SECRET) ? '111111' : '000000')
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Invalid code')
+      const again = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, acr_values: MFA })
+      expect(again.text).toContain('name="otp"')
+    })
+
+    test('should answer interaction_required for prompt=none', async () => {
+      const { cookies } = await login()
+
+      const res = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, acr_values: MFA, prompt: 'none' })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('error')).toBe('interaction_required')
+    })
+
+    test('should not ask users without a second factor', async () => {
+      const form = await request(app).get('/authorize').query({ ...query, acr_values: MFA })
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, acr_values: MFA, _csrf: csrfFrom(form), username: 'testuser', password: 'testpass' })
+
+      expect(res.status).toBe(302)
+      expect((await getCode(codeFrom(res))).acr).toBe('urn:ngauth:acr:pwd')
+    })
+  })
+
+  describe('login challenge', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code'
+    }
+    const originalThreshold = config.challenge.loginAfterFailures
+
+    beforeEach(async () => {
+      setChallengeVerifier(async ({ token }) => token === 'solved')
+      config.challenge.loginAfterFailures = 2
+      await addUser({
+        id: 'user_challenged',
+        username: 'challenged',
+        email: 'challenged@example.com',
+        password: await bcrypt.hash('rightpass', 4),
+        failedLoginAttempts: 2
+      })
+    })
+
+    afterEach(() => {
+      setChallengeVerifier(null)
+      config.challenge.loginAfterFailures = originalThreshold
+    })
+
+    const login = async (username, password, fields = {}) => {
+      const form = await request(app).get('/authorize').query(query)
+      return request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, _csrf: form.text.match(/name="_csrf" value="([^"]+)"/)[1], username, password, ...fields })
+    }
+
+    test('should ask for a challenge after repeated failures', async () => {
+      const res = await login('challenged', 'rightpass')
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Please complete the challenge')
+    })
+
+    test('should sign in once the challenge is solved', async () => {
+      const res = await login('challenged', 'rightpass', { challenge_token: 'solved' })
+
+      expect(res.status).toBe(302)
+    })
+
+    test('should not ask below the failure threshold', async () => {
+      const res = await login('testuser', 'testpass')
+
+      expect(res.status).toBe(302)
+    })
+  })
+
+  describe('login_hint', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid',
+      state: 'st-1'
+    }
+
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    // Log in as testuser and return the session cookies
+    const login = async () => {
+      const form = await request(app).get('/authorize').query(query)
+      const cookies = form.headers['set-cookie'] || []
+      await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({ ...query, _csrf: csrfFrom(form), username: 'testuser', password: 'testpass' })
+      return cookies
+    }
+
+    test('should prefill the username field', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, login_hint: 'testuser' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('name="username" placeholder="Username" value="testuser"')
+      expect(res.text).toContain('name="login_hint" value="testuser"')
+    })
+
+    test('should escape the hint', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, login_hint: '"><script>alert(1)</script>' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).not.toContain('<script>alert(1)</script>')
+      expect(res.text).toContain('value="&quot;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"')
+    })
+
+    test('should ignore an oversized hint', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, login_hint: 'a'.repeat(300) })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('name="username" placeholder="Username" value=""')
+      expect(res.text).not.toContain('name="login_hint"')
+    })
+
+    test('should not reveal whether the hinted account exists', async () => {
+      const page = async (hint) => {
+        const res = await request(app).get('/authorize').query({ ...query, login_hint: hint })
+        return { status: res.status, body: res.text.replace(/name="_csrf" value="[^"]+"/, '').split(`value="${hint}"`).join('value="HINT"') }
+      }
+
+      const existing = await page('testuser')
+      const missing = await page('nobody-here')
+
+      expect(existing).toEqual(missing)
+    })
+
+    test('should keep the hint when the login fails', async () => {
+      const form = await request(app).get('/authorize').query({ ...query, login_hint: 'testuser' })
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, _csrf: csrfFrom(form), login_hint: 'testuser', username: 'testuser', password: 'wrong' })
+
+      expect(res.text).toContain('Invalid username or password')
+      expect(res.text).toContain('name="username" placeholder="Username" value="testuser"')
+    })
+
+    test('should skip the login form when the session matches the hint', async () => {
+      const cookies = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, login_hint: 'TestUser' })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('code')).toBeTruthy()
+    })
+
+    test('should ask to sign in when the session is for another account', async () => {
+      const cookies = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, login_hint: 'someone-else' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Sign In')
+      expect(res.text).toContain('value="someone-else"')
+    })
+
+    test('should answer login_required for prompt=none with another account', async () => {
+      const cookies = await login()
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, prompt: 'none', login_hint: 'someone-else' })
+
+      expect(res.status).toBe(302)
+      expect(new URL(res.headers.location).searchParams.get('error')).toBe('login_required')
+    })
+  })
+
+  describe('display', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid',
+      state: 'st-1'
+    }
+
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    test.each(['page', 'popup', 'touch', 'wap'])('should render the login page for display=%s', async (display) => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, display })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain(`<html data-display="${display}">`)
+      expect(res.text).toContain(`name="display" value="${display}"`)
+    })
+
+    test('should size touch and wap pages to the device', async () => {
+      const touch = await request(app).get('/authorize').query({ ...query, display: 'touch' })
+      const page = await request(app).get('/authorize').query({ ...query, display: 'page' })
+
+      expect(touch.text).toContain('<meta name="viewport"')
+      expect(touch.text).toContain('min-height: 44px')
+      expect(page.text).not.toContain('<meta name="viewport"')
+    })
+
+    test('should fall back to the page layout', async () => {
+      for (const display of [undefined, 'hologram', '"><script>alert(1)</script>']) {
+        const res = await request(app)
+          .get('/authorize')
+          .query({ ...query, display })
+
+        expect(res.status).toBe(200)
+        expect(res.text).toContain('<html data-display="page">')
+        expect(res.text).not.toContain('name="display"')
+      }
+    })
+
+    test('should keep the layout after a failed login', async () => {
+      const form = await request(app).get('/authorize').query({ ...query, display: 'popup' })
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, _csrf: csrfFrom(form), display: 'popup', username: 'testuser', password: 'wrong' })
+
+      expect(res.text).toContain('Invalid username or password')
+      expect(res.text).toContain('<html data-display="popup">')
+    })
+
+    test('should render the consent page for the requested display', async () => {
+      const form = await request(app).get('/authorize').query({ ...query, prompt: 'consent', display: 'touch' })
+
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, _csrf: csrfFrom(form), prompt: 'consent', display: 'touch', username: 'testuser', password: 'testpass' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('action="/authorize/consent"')
+      expect(res.text).toContain('<html data-display="touch">')
+    })
+  })
+
+  describe('claims parameter', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      state: 'st-1'
+    }
+
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    // Sign in as testuser (who has no email) with the given request
+    const authorize = async (scope, claims) => {
+      const form = await request(app).get('/authorize').query({ ...query, scope, claims })
+      return request(app)
+        .post('/authorize')
+        .set('Cookie', form.headers['set-cookie'] || [])
+        .send({ ...query, scope, claims, _csrf: csrfFrom(form), username: 'testuser', password: 'testpass' })
+    }
+
+    test('should carry the claims request through the login form', async () => {
+      const claims = JSON.stringify({ userinfo: { email: { essential: true } } })
+
+      const res = await request(app).get('/authorize').query({ ...query, scope: 'openid email', claims })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('name="claims" value="{&quot;userinfo&quot;')
+    })
+
+    test('should issue a code when essential userinfo claims can be provided', async () => {
+      const claims = JSON.stringify({ userinfo: { preferred_username: { essential: true }, email: null } })
+
+      const res = await authorize('openid profile', claims)
+
+      expect(res.status).toBe(302)
+      expect(res.headers.location).toMatch(/^http:\/\/localhost:3000\/callback\?code=/)
+    })
+
+    test('should fail when the scope for an essential claim is not granted', async () => {
+      const claims = JSON.stringify({ userinfo: { preferred_username: { essential: true } } })
+
+      const res = await authorize('openid', claims)
+
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('invalid_request')
+      expect(url.searchParams.get('error_description')).toBe("Essential claim 'preferred_username' cannot be provided")
+      expect(url.searchParams.get('state')).toBe('st-1')
+      expect(url.searchParams.has('code')).toBe(false)
+      expect(await getCodes()).toHaveLength(0)
+    })
+
+    test('should fail when the user has no value for an essential claim', async () => {
+      const claims = JSON.stringify({ userinfo: { email: { essential: true } } })
+
+      const res = await authorize('openid email', claims)
+
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('invalid_request')
+      expect(url.searchParams.get('error_description')).toBe("Essential claim 'email' cannot be provided")
+    })
+
+    test('should reject a malformed claims parameter', async () => {
+      const res = await request(app)
+        .get('/authorize')
+        .query({ ...query, scope: 'openid', claims: '{"userinfo":' })
+
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('invalid_request')
+      expect(url.searchParams.get('error_description')).toBe('claims must be valid JSON')
+    })
+  })
+
+  describe('nonce binding', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid',
+      state: 'st-1'
+    }
+
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    // Start a request with the nonce and sign in, returning the redirect and the session cookies
+    const signIn = async (nonce, postedNonce = nonce) => {
+      const form = await request(app).get('/authorize').query({ ...query, nonce })
+      const cookies = form.headers['set-cookie'] || []
+      const res = await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({ ...query, nonce: postedNonce, _csrf: csrfFrom(form), username: 'testuser', password: 'testpass' })
+      return { res, cookies }
+    }
+
+    test('should bind the nonce to the session and consume it with the code', async () => {
+      const { res } = await signIn('n-bound')
+
+      expect(res.status).toBe(302)
+      const code = new URL(res.headers.location).searchParams.get('code')
+      expect(code).toBeTruthy()
+      expect((await getCode(code)).nonce).toBe('n-bound')
+    })
+
+    test('should reject a replayed nonce', async () => {
+      const { cookies } = await signIn('n-replayed')
+
+      // The signed-in session would otherwise get a code straight away
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, nonce: 'n-replayed' })
+
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('invalid_request')
+      expect(url.searchParams.get('error_description')).toBe('nonce has already been used')
+      expect(url.searchParams.has('code')).toBe(false)
+    })
+
+    test('should issue a code for a fresh nonce in the same session', async () => {
+      const { cookies } = await signIn('n-first')
+
+      const res = await request(app)
+        .get('/authorize')
+        .set('Cookie', cookies)
+        .query({ ...query, nonce: 'n-second' })
+
+      expect(new URL(res.headers.location).searchParams.has('code')).toBe(true)
+    })
+
+    test('should reject a nonce that was not requested in this session', async () => {
+      const { res } = await signIn('n-requested', 'n-swapped')
+
+      const url = new URL(res.headers.location)
+      expect(url.searchParams.get('error')).toBe('invalid_request')
+      expect(url.searchParams.get('error_description')).toBe('nonce does not belong to an authorization request of this session')
+      expect(await getCodes()).toHaveLength(0)
+    })
+
+    test('should not accept a nonce bound in another session', async () => {
+      await request(app).get('/authorize').query({ ...query, nonce: 'n-other' })
+
+      const { res } = await signIn('n-mine', 'n-other')
+
+      expect(new URL(res.headers.location).searchParams.get('error')).toBe('invalid_request')
+    })
+  })
+
+  describe('prompt=select_account', () => {
+    const query = {
+      client_id: 'test-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      scope: 'openid',
+      state: 'st-1'
+    }
+
+    const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    beforeEach(async () => {
+      await addUser({
+        id: 'user_second',
+        username: 'seconduser',
+        email: 'second@example.com',
+        name: 'Second User',
+        password: await bcrypt.hash('secondpass', 4),
+        failedLoginAttempts: 0
+      })
+    })
+
+    // Sign in with the given account in the browser session of cookies
+    const login = async (cookies, username, password) => {
+      const form = await request(app).get('/authorize').set('Cookie', cookies).query({ ...query, prompt: 'login' })
+      cookies = cookies.length > 0 ? cookies : form.headers['set-cookie'] || []
+      await request(app)
+        .post('/authorize')
+        .set('Cookie', cookies)
+        .send({ ...query, prompt: 'login', _csrf: csrfFrom(form), username, password })
+      return cookies
+    }
+
+    const chooser = (cookies) => request(app)
+      .get('/authorize')
+      .set('Cookie', cookies)
+      .query({ ...query, prompt: 'select_account' })
+
+    test('should list both signed-in accounts', async () => {
+      let cookies = await login([], 'testuser', 'testpass')
+      cookies = await login(cookies, 'seconduser', 'secondpass')
+
+      const res = await chooser(cookies)
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Choose an Account')
+      expect(res.text).toContain('name="account" value="user1"')
+      expect(res.text).toContain('name="account" value="user_second"')
+      expect(res.text).toContain('Use another account')
+      expect(res.text).toContain('prompt=login')
+    })
+
+    test('should issue the code for the selected account', async () => {
+      let cookies = await login([], 'testuser', 'testpass')
+      cookies = await login(cookies, 'seconduser', 'secondpass')
+      const page = await chooser(cookies)
+
+      const res = await request(app)
+        .post('/authorize/select-account')
+        .set('Cookie', cookies)
+        .send({ ...query, prompt: 'select_account', _csrf: csrfFrom(page), account: 'user1' })
+
+      expect(res.status).toBe(302)
+      const code = await getCode(new URL(res.headers.location).searchParams.get('code'))
+      expect(code.userId).toBe('user1')
+
+      // The selected account stays active for later requests
+      const next = await request(app).get('/authorize').set('Cookie', cookies).query(query)
+      const nextCode = await getCode(new URL(next.headers.location).searchParams.get('code'))
+      expect(nextCode.userId).toBe('user1')
+    })
+
+    test('should use the active account without prompt=select_account', async () => {
+      let cookies = await login([], 'testuser', 'testpass')
+      cookies = await login(cookies, 'seconduser', 'secondpass')
+
+      const res = await request(app).get('/authorize').set('Cookie', cookies).query(query)
+
+      expect(res.status).toBe(302)
+      const code = await getCode(new URL(res.headers.location).searchParams.get('code'))
+      expect(code.userId).toBe('user_second')
+    })
+
+    test('should show the chooser for a single account when requested', async () => {
+      const cookies = await login([], 'testuser', 'testpass')
+
+      const res = await chooser(cookies)
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('name="account" value="user1"')
+    })
+
+    test('should show the login form without a signed-in account', async () => {
+      const res = await request(app).get('/authorize').query({ ...query, prompt: 'select_account' })
+
+      expect(res.status).toBe(200)
+      expect(res.text).toContain('Sign In')
+    })
+
+    test('should refuse an account not signed in to the browser session', async () => {
+      const cookies = await login([], 'testuser', 'testpass')
+      const page = await chooser(cookies)
+
+      const res = await request(app)
+        .post('/authorize/select-account')
+        .set('Cookie', cookies)
+        .send({ ...query, prompt: 'select_account', _csrf: csrfFrom(page), account: 'user_second' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+  })
+
+  describe('session cookie attributes', () => {
+    const loginForm = (cookieApp) => request(cookieApp)
+      .get('/authorize')
+      .set('X-Forwarded-Proto', 'https')
+      .query({ client_id: 'test-client', redirect_uri: 'http://localhost:3000/callback', response_type: 'code' })
+
+    const appWithCookie = (cookieConfig) => {
+      const cookieApp = express()
+      cookieApp.set('trust proxy', 1)
+      cookieApp.use(express.urlencoded({ extended: true }))
+      cookieApp.use(session({
+        secret: crypto.randomBytes(32).toString('hex'),
+        resave: false,
+        saveUninitialized: false,
+        ...sessionCookieOptions(cookieConfig)
+      }))
+      cookieApp.use('/authorize', authorizeRouter)
+      cookieApp.use(errorHandler)
+      return cookieApp
+    }
+
+    test('should set the configured attributes on the login session cookie', async () => {
+      const res = await loginForm(appWithCookie({
+        name: 'ngauth.sid',
+        secure: true,
+        httpOnly: true,
+        sameSite: 'lax',
+        domain: 'auth.example.com',
+        path: '/'
+      }))
+
+      const cookie = (res.headers['set-cookie'] || []).find(c => c.startsWith('ngauth.sid='))
+      expect(cookie).toBeDefined()
+      expect(cookie).toContain('Path=/')
+      expect(cookie).toContain('Domain=auth.example.com')
+      expect(cookie).toContain('HttpOnly')
+      expect(cookie).toContain('Secure')
+      expect(cookie).toContain('SameSite=Lax')
+    })
+
+    test('should default to HttpOnly and SameSite=Lax', async () => {
+      const res = await loginForm(appWithCookie({ ...config.sessionCookie, secure: true }))
+
+      const cookie = (res.headers['set-cookie'] || []).find(c => c.startsWith(`${config.sessionCookie.name}=`))
+      expect(config.sessionCookie.sameSite).toBe('lax')
+      expect(cookie).toContain('HttpOnly')
+      expect(cookie).toContain('SameSite=Lax')
+      expect(cookie).not.toContain('Domain=')
+    })
+  })
 })
@@ -0,0 +1,93 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, addClient } = require('../../src/db')
+const { ensurePrivateKey, verifyToken } = require('../../src/tokens')
+const wellKnownRouter = require('../../src/routes/well-known')
+const jwksRouter = require('../../src/routes/jwks')
+const tokenRouter = require('../../src/routes/token')
+const { errorHandler } = require('../../src/errors')
+
+describe('Base path', () => {
+  let app
+  let testDir
+  const original = { basePath: config.basePath, issuer: config.issuer }
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    // As configured by NGAUTH_BASE_PATH=/auth
+    config.basePath = '/auth'
+    config.issuer = 'http://localhost:3000/auth'
+
+    // Mounted the way src/index.js mounts the routes
+    const routes = express.Router()
+    routes.use('/.well-known', wellKnownRouter)
+    routes.use('/.well-known', jwksRouter)
+    routes.use(config.endpoints.token, tokenRouter)
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use(config.basePath, routes)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'test-client',
+      client_secret: 'test-secret',
+      redirect_uris: ['http://localhost:3000/callback']
+    })
+  })
+
+  afterEach(() => {
+    Object.assign(config, original)
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should serve discovery under the base path with prefixed URLs', async () => {
+    const res = await request(app).get('/auth/.well-known/openid-configuration')
+
+    expect(res.status).toBe(200)
+    expect(res.body.issuer).toBe('http://localhost:3000/auth')
+    expect(res.body.authorization_endpoint).toBe('http://localhost:3000/auth/authorize')
+    expect(res.body.token_endpoint).toBe('http://localhost:3000/auth/token')
+    expect(res.body.jwks_uri).toBe('http://localhost:3000/auth/.well-known/jwks.json')
+    expect(res.body.registration_endpoint).toBe('http://localhost:3000/auth/register')
+  })
+
+  test('should serve the JWKS at the advertised jwks_uri', async () => {
+    const discovery = await request(app).get('/auth/.well-known/openid-configuration')
+    const res = await request(app).get(new URL(discovery.body.jwks_uri).pathname)
+
+    expect(res.status).toBe(200)
+    expect(res.body.keys.length).toBeGreaterThan(0)
+  })
+
+  test('should not serve routes at the root', async () => {
+    const res = await request(app).get('/.well-known/openid-configuration')
+
+    expect(res.status).toBe(404)
+  })
+
+  test('should issue tokens whose iss includes the base path', async () => {
+    const res = await request(app)
+      .post('/auth/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret'
+      })
+
+    expect(res.status).toBe(200)
+    expect(verifyToken(res.body.access_token).iss).toBe('http://localhost:3000/auth')
+  })
+})
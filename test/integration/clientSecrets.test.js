@@ -0,0 +1,119 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb, addClient, updateClient } = require('../../src/db')
+const { ensurePrivateKey, generateToken, getPublicKeyPem } = require('../../src/tokens')
+const { setPublicKey } = require('../../src/auth')
+const adminRouter = require('../../src/routes/admin')
+const tokenRouter = require('../../src/routes/token')
+const { errorHandler } = require('../../src/errors')
+
+describe('Client Secret Rotation', () => {
+  let app
+  let testDir
+  let adminToken
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+    setPublicKey(getPublicKeyPem())
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use('/admin', adminRouter)
+    app.use('/token', tokenRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'rotating-client',
+      client_secret: 'old-secret',
+      redirect_uris: ['http://localhost:3000/callback']
+    })
+
+    adminToken = generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  const rotate = (body = {}) => request(app)
+    .post('/admin/clients/rotating-client/secrets')
+    .set('Authorization', `Bearer ${adminToken}`)
+    .send(body)
+
+  const clientCredentials = (secret) => request(app)
+    .post('/token')
+    .send({ grant_type: 'client_credentials', client_id: 'rotating-client', client_secret: secret })
+
+  test('should authenticate with both secrets during the grace period', async () => {
+    const rotated = await rotate({ grace_period: 3600 })
+
+    expect(rotated.status).toBe(201)
+    expect(rotated.body.client_secret).not.toBe('old-secret')
+    expect(rotated.body.client_secret_id).toMatch(/^sec_/)
+    expect(rotated.body.previous_client_secret_id).toBe('primary')
+    expect(rotated.body.previous_client_secret_expires_at).toBeGreaterThan(Math.floor(Date.now() / 1000))
+
+    expect((await clientCredentials('old-secret')).status).toBe(200)
+    expect((await clientCredentials(rotated.body.client_secret)).status).toBe(200)
+  })
+
+  test('should reject the old secret once the grace period ends', async () => {
+    const rotated = await rotate({ grace_period: 3600 })
+    await updateClient('rotating-client', {
+      previous_client_secret: { id: 'primary', secret: 'old-secret', expiresAt: Date.now() - 1000 }
+    })
+
+    expect((await clientCredentials('old-secret')).status).toBe(400)
+    expect((await clientCredentials(rotated.body.client_secret)).status).toBe(200)
+  })
+
+  test('should reject the old secret immediately when revoked', async () => {
+    const rotated = await rotate({ revoke_current: true })
+
+    expect(rotated.status).toBe(201)
+    expect(rotated.body.previous_client_secret_id).toBeNull()
+
+    const res = await clientCredentials('old-secret')
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_client')
+    expect((await clientCredentials(rotated.body.client_secret)).status).toBe(200)
+  })
+
+  test('should remove the previous secret on demand', async () => {
+    await rotate({ grace_period: 3600 })
+
+    const res = await request(app)
+      .delete('/admin/clients/rotating-client/secrets/primary')
+      .set('Authorization', `Bearer ${adminToken}`)
+
+    expect(res.status).toBe(204)
+    expect((await clientCredentials('old-secret')).status).toBe(400)
+  })
+
+  test('should refuse a second rotation while one is in progress', async () => {
+    await rotate({ grace_period: 3600 })
+
+    const res = await rotate({ grace_period: 3600 })
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_request')
+  })
+
+  test('should reject unknown clients', async () => {
+    const res = await request(app)
+      .post('/admin/clients/missing/secrets')
+      .set('Authorization', `Bearer ${adminToken}`)
+      .send({})
+
+    expect(res.status).toBe(400)
+    expect(res.body.error_description).toBe('Client not found')
+  })
+})
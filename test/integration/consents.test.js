@@ -0,0 +1,219 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const session = require('express-session')
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, addClient, getCodes } = require('../../src/db')
+const { ensurePrivateKey, generateToken, getPublicKeyPem } = require('../../src/tokens')
+const { setPublicKey } = require('../../src/auth')
+const authorizeRouter = require('../../src/routes/authorize')
+const usersRouter = require('../../src/routes/users')
+const { errorHandler } = require('../../src/errors')
+
+describe('Consent Revocation', () => {
+  let app
+  let testDir
+  let userToken
+
+  const query = {
+    client_id: 'test-client',
+    redirect_uri: 'http://localhost:3000/callback',
+    response_type: 'code',
+    scope: 'openid profile',
+    state: 'st-1'
+  }
+
+  // Log in through the authorization endpoint and return the session cookies
+  const login = async () => {
+    const form = await request(app).get('/authorize').query(query)
+    const cookies = form.headers['set-cookie'] || []
+
+    await request(app)
+      .post('/authorize')
+      .set('Cookie', cookies)
+      .send({
+        _csrf: form.text.match(/name="_csrf" value="([^"]+)"/)[1],
+        username: 'testuser',
+        password: 'testpass',
+        client_id: query.client_id,
+        redirect_uri: query.redirect_uri,
+        scope: query.scope,
+        state: query.state
+      })
+
+    return cookies
+  }
+
+  const silentAuthorize = (cookies) => request(app)
+    .get('/authorize')
+    .set('Cookie', cookies)
+    .query({ ...query, prompt: 'none' })
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+    setPublicKey(getPublicKeyPem())
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use(session({
+      secret: crypto.randomBytes(32).toString('hex'),
+      resave: false,
+      saveUninitialized: false,
+      cookie: { secure: false }
+    }))
+    app.use('/authorize', authorizeRouter)
+    app.use('/users', usersRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'test-client',
+      client_secret: 'test-secret',
+      client_name: 'Test App',
+      redirect_uris: ['http://localhost:3000/callback']
+    })
+
+    // Token the user manages their account with (issued to a different client)
+    userToken = generateToken({
+      sub: 'user1',
+      client_id: 'account',
+      scope: 'user:read user:write',
+      token_type: 'access'
+    }, '1h')
+  })
+
+  afterEach(() => {
+    config.consent.required = false
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should list the clients the user has authorized', async () => {
+    await login()
+
+    const res = await request(app)
+      .get('/users/user1/consents')
+      .set('Authorization', `Bearer ${userToken}`)
+
+    expect(res.status).toBe(200)
+    expect(res.body).toHaveLength(1)
+    expect(res.body[0].client_id).toBe('test-client')
+    expect(res.body[0].client_name).toBe('Test App')
+    expect(res.body[0].scopes).toEqual(['openid', 'profile'])
+  })
+
+  test('should force re-consent after revocation', async () => {
+    const cookies = await login()
+
+    const before = await silentAuthorize(cookies)
+    expect(new URL(before.headers.location).searchParams.get('code')).toBeTruthy()
+
+    const revoke = await request(app)
+      .delete('/users/user1/consents/test-client')
+      .set('Authorization', `Bearer ${userToken}`)
+    expect(revoke.status).toBe(204)
+
+    const after = await silentAuthorize(cookies)
+    expect(after.status).toBe(302)
+    expect(new URL(after.headers.location).searchParams.get('error')).toBe('consent_required')
+
+    // Outstanding codes can no longer be redeemed
+    expect(await getCodes()).toHaveLength(0)
+
+    const list = await request(app)
+      .get('/users/user1/consents')
+      .set('Authorization', `Bearer ${userToken}`)
+    expect(list.body).toHaveLength(0)
+  })
+
+  test('should force re-consent when consent is required', async () => {
+    config.consent.required = true
+    const cookies = await login()
+    const form = await request(app).get('/authorize').set('Cookie', cookies).query(query)
+
+    await request(app)
+      .post('/authorize/consent')
+      .set('Cookie', cookies)
+      .send({
+        _csrf: form.text.match(/name="_csrf" value="([^"]+)"/)[1],
+        decision: 'allow',
+        client_id: query.client_id,
+        redirect_uri: query.redirect_uri,
+        scope: query.scope,
+        state: query.state
+      })
+    expect((await silentAuthorize(cookies)).headers.location).toContain('code=')
+
+    await request(app)
+      .delete('/users/user1/consents/test-client')
+      .set('Authorization', `Bearer ${userToken}`)
+
+    const after = await silentAuthorize(cookies)
+    expect(new URL(after.headers.location).searchParams.get('error')).toBe('consent_required')
+  })
+
+  test('should keep existing tokens valid by default', async () => {
+    await login()
+    const clientToken = generateToken({ sub: 'user1', client_id: 'test-client', scope: 'user:read', token_type: 'access' }, '1h')
+
+    await request(app)
+      .delete('/users/user1/consents/test-client')
+      .set('Authorization', `Bearer ${userToken}`)
+
+    const res = await request(app)
+      .get('/users/user1/consents')
+      .set('Authorization', `Bearer ${clientToken}`)
+    expect(res.status).toBe(200)
+  })
+
+  test('should revoke existing tokens with revoke_tokens=true', async () => {
+    await login()
+    const clientToken = generateToken({ sub: 'user1', client_id: 'test-client', scope: 'user:read', token_type: 'access' }, '1h')
+
+    const revoke = await request(app)
+      .delete('/users/user1/consents/test-client')
+      .query({ revoke_tokens: 'true' })
+      .set('Authorization', `Bearer ${userToken}`)
+    expect(revoke.status).toBe(204)
+
+    const res = await request(app)
+      .get('/users/user1/consents')
+      .set('Authorization', `Bearer ${clientToken}`)
+    expect(res.status).toBe(400)
+    expect(res.body.error_description).toBe('Token has been revoked')
+
+    // Tokens of other clients are unaffected
+    const own = await request(app)
+      .get('/users/user1/consents')
+      .set('Authorization', `Bearer ${userToken}`)
+    expect(own.status).toBe(200)
+  })
+
+  test('should not let users revoke consents of other users', async () => {
+    await login()
+    const otherToken = generateToken({ sub: 'user2', client_id: 'account', scope: 'user:read user:write', token_type: 'access' }, '1h')
+
+    const res = await request(app)
+      .delete('/users/user1/consents/test-client')
+      .set('Authorization', `Bearer ${otherToken}`)
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_request')
+  })
+
+  test('should reject revoking a consent that does not exist', async () => {
+    const res = await request(app)
+      .delete('/users/user1/consents/unknown-client')
+      .set('Authorization', `Bearer ${userToken}`)
+
+    expect(res.status).toBe(400)
+  })
+})
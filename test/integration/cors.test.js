@@ -0,0 +1,115 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const session = require('express-session')
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb, addClient } = require('../../src/db')
+const { ensurePrivateKey } = require('../../src/tokens')
+const { clientCors } = require('../../src/middleware/clientCors')
+const authorizeRouter = require('../../src/routes/authorize')
+const { errorHandler } = require('../../src/errors')
+
+describe('Per-client CORS', () => {
+  let app
+  let testDir
+
+  const query = {
+    client_id: 'spa-client',
+    redirect_uri: 'http://localhost:3000/callback',
+    response_type: 'code'
+  }
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use(session({
+      secret: crypto.randomBytes(32).toString('hex'),
+      resave: false,
+      saveUninitialized: false
+    }))
+    app.use('/authorize', clientCors, authorizeRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'spa-client',
+      client_secret: 'test-secret',
+      redirect_uris: ['http://localhost:3000/callback'],
+      allowed_cors_origins: ['https://spa.example.com']
+    })
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should send CORS headers to a registered origin', async () => {
+    const res = await request(app)
+      .get('/authorize')
+      .set('Origin', 'https://spa.example.com')
+      .query(query)
+
+    expect(res.headers['access-control-allow-origin']).toBe('https://spa.example.com')
+    expect(res.headers['access-control-allow-credentials']).toBe('true')
+    expect(res.headers.vary).toContain('Origin')
+  })
+
+  test('should send no CORS headers to an unregistered origin', async () => {
+    const res = await request(app)
+      .get('/authorize')
+      .set('Origin', 'https://evil.example.com')
+      .query(query)
+
+    expect(res.headers['access-control-allow-origin']).toBeUndefined()
+    expect(res.headers['access-control-allow-credentials']).toBeUndefined()
+  })
+
+  test('should not honor an origin registered to another client', async () => {
+    await addClient({
+      client_id: 'other-client',
+      client_secret: 'test-secret',
+      redirect_uris: ['http://localhost:3000/callback'],
+      allowed_cors_origins: ['https://other.example.com']
+    })
+
+    const res = await request(app)
+      .get('/authorize')
+      .set('Origin', 'https://other.example.com')
+      .query(query)
+
+    expect(res.headers['access-control-allow-origin']).toBeUndefined()
+  })
+
+  test('should answer preflight requests for a registered origin', async () => {
+    const res = await request(app)
+      .options('/authorize')
+      .set('Origin', 'https://spa.example.com')
+      .set('Access-Control-Request-Method', 'GET')
+      .query(query)
+
+    expect(res.status).toBe(204)
+    expect(res.headers['access-control-allow-origin']).toBe('https://spa.example.com')
+    expect(res.headers['access-control-allow-methods']).toContain('GET')
+  })
+
+  test('should answer preflight requests without CORS headers for an unregistered origin', async () => {
+    const res = await request(app)
+      .options('/authorize')
+      .set('Origin', 'https://evil.example.com')
+      .set('Access-Control-Request-Method', 'GET')
+      .query(query)
+
+    expect(res.status).toBe(204)
+    expect(res.headers['access-control-allow-origin']).toBeUndefined()
+    expect(res.headers['access-control-allow-methods']).toBeUndefined()
+  })
+})
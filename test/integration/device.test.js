@@ -0,0 +1,252 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const session = require('express-session')
+const cookieParser = require('cookie-parser')
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, addClient } = require('../../src/db')
+const { ensurePrivateKey, verifyToken } = require('../../src/tokens')
+const { getCounterStore } = require('../../src/middleware/rateLimitStore')
+const deviceRouter = require('../../src/routes/device')
+const tokenRouter = require('../../src/routes/token')
+const { errorHandler } = require('../../src/errors')
+
+const DEVICE_CODE_GRANT = 'urn:ietf:params:oauth:grant-type:device_code'
+
+describe('Device Authorization Grant', () => {
+  let app
+  let testDir
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use(cookieParser(crypto.randomBytes(32).toString('hex')))
+    app.use(session({
+      secret: crypto.randomBytes(32).toString('hex'),
+      resave: false,
+      saveUninitialized: false,
+      cookie: { secure: false }
+    }))
+    app.use('/device', deviceRouter)
+    app.use('/token', tokenRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'tv-app',
+      client_secret: 'tv-secret',
+      client_name: 'TV App',
+      redirect_uris: [],
+      grant_types: [DEVICE_CODE_GRANT],
+      scope: 'openid profile'
+    })
+    await addClient({
+      client_id: 'web-app',
+      client_secret: 'web-secret',
+      redirect_uris: ['http://localhost:3000/callback']
+    })
+  })
+
+  afterEach(async () => {
+    await getCounterStore().reset('device-ip:127.0.0.1')
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  const startGrant = (scope = 'openid profile') => request(app)
+    .post('/device/code')
+    .type('form')
+    .send({ client_id: 'tv-app', client_secret: 'tv-secret', scope })
+
+  const poll = (deviceCode) => request(app)
+    .post('/token')
+    .type('form')
+    .send({ grant_type: DEVICE_CODE_GRANT, device_code: deviceCode, client_id: 'tv-app', client_secret: 'tv-secret' })
+
+  const csrfFrom = (res) => res.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+  // Open the verification page and submit a code with the test user's credentials
+  const enterCode = async (userCode, cookies) => {
+    const form = await request(app).get('/device').set('Cookie', cookies || [])
+    cookies = cookies || form.headers['set-cookie'] || []
+    const res = await request(app)
+      .post('/device')
+      .set('Cookie', cookies)
+      .type('form')
+      .send({ _csrf: csrfFrom(form), user_code: userCode, username: 'testuser', password: 'testpass' })
+    return { res, cookies: res.headers['set-cookie'] || cookies }
+  }
+
+  describe('POST /device/code', () => {
+    test('should return device and user codes', async () => {
+      const res = await startGrant()
+
+      expect(res.status).toBe(200)
+      expect(res.headers['cache-control']).toBe('no-store')
+      expect(res.body.device_code).toBeTruthy()
+      expect(res.body.user_code).toMatch(/^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$/)
+      expect(res.body.verification_uri).toBe(`${config.issuer}/device`)
+      expect(res.body.verification_uri_complete).toBe(`${config.issuer}/device?user_code=${res.body.user_code}`)
+      expect(res.body.expires_in).toBe(config.deviceFlow.codeTTL)
+      expect(res.body.interval).toBe(config.deviceFlow.interval)
+    })
+
+    test('should reject clients not registered for the grant', async () => {
+      const res = await request(app)
+        .post('/device/code')
+        .type('form')
+        .send({ client_id: 'web-app', client_secret: 'web-secret' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('unauthorized_client')
+    })
+
+    test('should reject a machine-only scope', async () => {
+      config.scopePolicy.machineOnlyScopes = ['profile']
+      try {
+        const res = await startGrant('openid profile')
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_scope')
+        expect(res.body.error_description).toContain("'profile'")
+      } finally {
+        config.scopePolicy.machineOnlyScopes = []
+      }
+    })
+
+    test('should reject invalid client credentials', async () => {
+      const res = await request(app)
+        .post('/device/code')
+        .type('form')
+        .send({ client_id: 'tv-app', client_secret: 'wrong' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client')
+    })
+  })
+
+  describe('user code entry', () => {
+    test('should approve the device with the correct code', async () => {
+      const { body: grant } = await startGrant()
+
+      const pending = await poll(grant.device_code)
+      expect(pending.status).toBe(400)
+      expect(pending.body.error).toBe('authorization_pending')
+
+      // Typed in lower case without the dash
+      const { res: confirmPage, cookies } = await enterCode(grant.user_code.toLowerCase().replace('-', ''))
+      expect(confirmPage.status).toBe(200)
+      expect(confirmPage.text).toContain('TV App')
+
+      const done = await request(app)
+        .post('/device/confirm')
+        .set('Cookie', cookies)
+        .type('form')
+        .send({ _csrf: csrfFrom(confirmPage), decision: 'allow' })
+      expect(done.status).toBe(200)
+      expect(done.text).toContain('Your device is connected')
+
+      const res = await poll(grant.device_code)
+      expect(res.status).toBe(200)
+      expect(verifyToken(res.body.access_token).sub).toBe('user1')
+      expect(res.body.scope).toBe('openid profile')
+      expect(verifyToken(res.body.id_token).aud).toBe('tv-app')
+
+      // The device code is single-use
+      const again = await poll(grant.device_code)
+      expect(again.body.error).toBe('invalid_grant')
+    })
+
+    test('should reject a wrong code', async () => {
+      await startGrant()
+
+      const { res } = await enterCode('BCDF-GHJK')
+
+      expect(res.status).toBe(400)
+      expect(res.text).toContain('Invalid or expired code')
+    })
+
+    test('should lock out after repeated wrong codes, even for the correct one', async () => {
+      const { body: grant } = await startGrant()
+      const form = await request(app).get('/device')
+      const cookies = form.headers['set-cookie'] || []
+
+      for (let i = 0; i < config.deviceFlow.maxAttempts; i++) {
+        const res = await request(app)
+          .post('/device')
+          .set('Cookie', cookies)
+          .type('form')
+          .send({ _csrf: csrfFrom(form), user_code: 'BCDF-GHJK', username: 'testuser', password: 'testpass' })
+        expect(res.status).toBe(400)
+      }
+
+      const locked = await request(app)
+        .post('/device')
+        .set('Cookie', cookies)
+        .type('form')
+        .send({ _csrf: csrfFrom(form), user_code: grant.user_code, username: 'testuser', password: 'testpass' })
+
+      expect(locked.status).toBe(429)
+      expect(locked.headers['retry-after']).toBe(String(config.deviceFlow.lockoutSeconds))
+      expect(locked.text).toContain('Too many attempts')
+      expect((await poll(grant.device_code)).body.error).toBe('authorization_pending')
+    })
+
+    test('should escape the code echoed into the page', async () => {
+      const res = await request(app).get('/device').query({ user_code: '"><script>alert(1)</script>' })
+
+      expect(res.text).not.toContain('<script>alert(1)</script>')
+    })
+  })
+
+  describe('polling', () => {
+    test('should report a denied device', async () => {
+      const { body: grant } = await startGrant()
+      const { res: confirmPage, cookies } = await enterCode(grant.user_code)
+
+      await request(app)
+        .post('/device/confirm')
+        .set('Cookie', cookies)
+        .type('form')
+        .send({ _csrf: csrfFrom(confirmPage), decision: 'deny' })
+
+      const res = await poll(grant.device_code)
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('access_denied')
+    })
+
+    test('should ask a device polling too fast to slow down', async () => {
+      const { body: grant } = await startGrant()
+
+      await poll(grant.device_code)
+      const res = await poll(grant.device_code)
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('slow_down')
+    })
+
+    test('should report an expired device code', async () => {
+      const original = config.deviceFlow.codeTTL
+      config.deviceFlow.codeTTL = -1
+      try {
+        const { body: grant } = await startGrant()
+
+        const res = await poll(grant.device_code)
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('expired_token')
+      } finally {
+        config.deviceFlow.codeTTL = original
+      }
+    })
+  })
+})
@@ -0,0 +1,166 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const crypto = require('crypto')
+const jwt = require('jsonwebtoken')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, addClient } = require('../../src/db')
+const { ensurePrivateKey, verifyToken } = require('../../src/tokens')
+const { jwkThumbprint, rotateNonce } = require('../../src/dpop')
+const tokenRouter = require('../../src/routes/token')
+const { errorHandler } = require('../../src/errors')
+
+describe('DPoP Nonce Challenge', () => {
+  let app
+  let testDir
+  let originalDpop
+  let keyPair
+  let publicJwk
+
+  const tokenUrl = () => `${config.issuer}/token`
+
+  function createProof (claims = {}) {
+    return jwt.sign({
+      htm: 'POST',
+      htu: tokenUrl(),
+      jti: crypto.randomUUID(),
+      ...claims
+    }, keyPair.privateKey, {
+      algorithm: 'ES256',
+      header: { typ: 'dpop+jwt', jwk: publicJwk }
+    })
+  }
+
+  function tokenRequest (proof) {
+    return request(app)
+      .post('/token')
+      .set('DPoP', proof)
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret'
+      })
+  }
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    originalDpop = { ...config.dpop }
+    config.dpop.enabled = true
+    config.dpop.requireNonce = true
+    rotateNonce()
+
+    keyPair = crypto.generateKeyPairSync('ec', { namedCurve: 'P-256' })
+    publicJwk = keyPair.publicKey.export({ format: 'jwk' })
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use('/token', tokenRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'test-client',
+      client_secret: 'test-secret',
+      redirect_uris: ['http://localhost:3000/callback']
+    })
+  })
+
+  afterEach(() => {
+    Object.assign(config.dpop, originalDpop)
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should challenge a proof without nonce and accept the echoed nonce', async () => {
+    const challenge = await tokenRequest(createProof())
+
+    expect(challenge.status).toBe(400)
+    expect(challenge.body.error).toBe('use_dpop_nonce')
+    const nonce = challenge.headers['dpop-nonce']
+    expect(nonce).toBeDefined()
+
+    const res = await tokenRequest(createProof({ nonce }))
+
+    expect(res.status).toBe(200)
+    expect(res.body.token_type).toBe('DPoP')
+    expect(res.headers['dpop-nonce']).toBeDefined()
+
+    const decoded = verifyToken(res.body.access_token)
+    expect(decoded.cnf.jkt).toBe(jwkThumbprint(publicJwk))
+  })
+
+  test('should reject a proof missing the required nonce', async () => {
+    const res = await tokenRequest(createProof())
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('use_dpop_nonce')
+  })
+
+  test('should reject a proof with a stale nonce', async () => {
+    const challenge = await tokenRequest(createProof())
+    const staleNonce = challenge.headers['dpop-nonce']
+
+    // Two rotations push the nonce out of the accepted window
+    rotateNonce()
+    rotateNonce()
+
+    const res = await tokenRequest(createProof({ nonce: staleNonce }))
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('use_dpop_nonce')
+    expect(res.headers['dpop-nonce']).not.toBe(staleNonce)
+  })
+
+  test('should accept the previous nonce after a single rotation', async () => {
+    const challenge = await tokenRequest(createProof())
+    const nonce = challenge.headers['dpop-nonce']
+
+    rotateNonce()
+
+    const res = await tokenRequest(createProof({ nonce }))
+    expect(res.status).toBe(200)
+  })
+
+  test('should reject a proof for a different method', async () => {
+    const challenge = await tokenRequest(createProof())
+    const nonce = challenge.headers['dpop-nonce']
+
+    const res = await tokenRequest(createProof({ htm: 'GET', nonce }))
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_dpop_proof')
+  })
+
+  test('should reject a replayed proof', async () => {
+    const challenge = await tokenRequest(createProof())
+    const proof = createProof({ nonce: challenge.headers['dpop-nonce'] })
+
+    const first = await tokenRequest(proof)
+    expect(first.status).toBe(200)
+
+    const replay = await tokenRequest(proof)
+    expect(replay.status).toBe(400)
+    expect(replay.body.error).toBe('invalid_dpop_proof')
+  })
+
+  test('should issue bearer tokens when no DPoP header is sent', async () => {
+    const res = await request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret'
+      })
+
+    expect(res.status).toBe(200)
+    expect(res.body.token_type).toBe('Bearer')
+  })
+})
@@ -0,0 +1,195 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const session = require('express-session')
+const http = require('http')
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, addClient, addIssuedToken, revokeIssuedToken } = require('../../src/db')
+const { ensurePrivateKey, generateToken, getPublicKeyPem } = require('../../src/tokens')
+const { setPublicKey } = require('../../src/auth')
+const { closeSubscriptions } = require('../../src/eventStream')
+const adminRouter = require('../../src/routes/admin')
+const authorizeRouter = require('../../src/routes/authorize')
+const { errorHandler } = require('../../src/errors')
+
+// Minimal SSE client: collects parsed events until closed
+function connectEvents (server, query, token) {
+  return new Promise((resolve, reject) => {
+    const events = []
+    const waiters = []
+    const req = http.get({
+      port: server.address().port,
+      path: `/admin/events${query}`,
+      headers: { Authorization: `Bearer ${token}`, Accept: 'text/event-stream' }
+    }, (res) => {
+      const ended = new Promise(resolve => res.on('end', resolve))
+      let buffer = ''
+      res.setEncoding('utf8')
+      res.on('data', (chunk) => {
+        buffer += chunk
+        let end
+        while ((end = buffer.indexOf('\n\n')) !== -1) {
+          const message = buffer.slice(0, end)
+          buffer = buffer.slice(end + 2)
+          const data = message.split('\n').find(line => line.startsWith('data: '))
+          if (data) {
+            events.push(JSON.parse(data.slice(6)))
+            waiters.splice(0).forEach(check => check())
+          }
+        }
+      })
+      resolve({
+        status: res.statusCode,
+        contentType: res.headers['content-type'],
+        events,
+        // Resolve with the first event of the given type
+        waitFor: (type) => new Promise(resolve => {
+          const check = () => {
+            const event = events.find(e => e.type === type)
+            if (event) {
+              resolve(event)
+            } else {
+              waiters.push(check)
+            }
+          }
+          check()
+        }),
+        // Resolves when the server ends the stream
+        ended,
+        close: () => req.destroy()
+      })
+    })
+    req.on('error', reject)
+  })
+}
+
+describe('Admin event stream', () => {
+  let app
+  let server
+  let testDir
+  let stream
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+    setPublicKey(getPublicKeyPem())
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use(session({
+      secret: crypto.randomBytes(32).toString('hex'),
+      resave: false,
+      saveUninitialized: false,
+      cookie: { secure: false }
+    }))
+    app.use('/authorize', authorizeRouter)
+    app.use('/admin', adminRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'test-client',
+      client_secret: 'test-secret',
+      redirect_uris: ['http://localhost:3000/callback']
+    })
+
+    server = app.listen(0)
+    await new Promise(resolve => server.once('listening', resolve))
+  })
+
+  afterEach(async () => {
+    if (stream) {
+      stream.close()
+      stream = null
+    }
+    server.closeAllConnections()
+    await new Promise(resolve => server.close(resolve))
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  const adminToken = () => generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' })
+
+  // Sign in through the login form
+  async function login (password) {
+    const query = { client_id: 'test-client', redirect_uri: 'http://localhost:3000/callback', response_type: 'code' }
+    const form = await request(server).get('/authorize').query(query)
+    const csrfToken = form.text.match(/name="_csrf" value="([^"]+)"/)[1]
+
+    return request(server)
+      .post('/authorize')
+      .set('Cookie', form.headers['set-cookie'] || [])
+      .send({ ...query, _csrf: csrfToken, username: 'testuser', password })
+  }
+
+  test('should stream a login event to a connected client', async () => {
+    stream = await connectEvents(server, '', adminToken())
+    expect(stream.status).toBe(200)
+    expect(stream.contentType).toContain('text/event-stream')
+
+    const res = await login('testpass')
+    expect(res.status).toBe(302)
+
+    const event = await stream.waitFor('LOGIN_SUCCEEDED')
+    expect(event.client_id).toBe('test-client')
+    expect(event.timestamp).toBeDefined()
+  })
+
+  test('should filter events by type and redact credentials', async () => {
+    stream = await connectEvents(server, '?types=LOGIN_FAILED', adminToken())
+
+    await login('wrong-password')
+    await login('testpass')
+
+    const event = await stream.waitFor('LOGIN_FAILED')
+    expect(event.username).toBe('testuser')
+    expect(event.reason).toBe('invalid_credentials')
+    expect(JSON.stringify(stream.events)).not.toContain('wrong-password')
+    expect(stream.events.every(e => e.type === 'LOGIN_FAILED')).toBe(true)
+  })
+
+  test('should end the stream when the token expires', async () => {
+    stream = await connectEvents(server, '', generateToken({ sub: 'admin', scope: 'admin', token_type: 'access' }, '1s'))
+    expect(stream.status).toBe(200)
+
+    await stream.ended
+  })
+
+  test('should end the stream once the token is revoked', async () => {
+    const original = config.eventStream.heartbeatInterval
+    config.eventStream.heartbeatInterval = 0.05
+    try {
+      await addIssuedToken({ jti: 'admin-jti', client_id: 'ops', sub: 'admin', scope: 'admin', expiresAt: Date.now() + 60000 })
+      stream = await connectEvents(server, '', generateToken({ sub: 'admin', scope: 'admin', token_type: 'access', jti: 'admin-jti' }))
+      expect(stream.status).toBe(200)
+
+      await revokeIssuedToken('admin-jti')
+      await stream.ended
+    } finally {
+      config.eventStream.heartbeatInterval = original
+    }
+  })
+
+  test('should end open streams when subscriptions are closed for shutdown', async () => {
+    stream = await connectEvents(server, '', adminToken())
+    expect(stream.status).toBe(200)
+
+    closeSubscriptions()
+    await stream.ended
+  })
+
+  test('should require an admin token', async () => {
+    const token = generateToken({ sub: 'user1', scope: 'user:read', token_type: 'access' })
+
+    const res = await request(server).get('/admin/events').set('Authorization', `Bearer ${token}`)
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('insufficient_scope')
+  })
+})
@@ -0,0 +1,193 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb, addClient } = require('../../src/db')
+const config = require('../../src/config')
+const { ensurePrivateKey, generateToken } = require('../../src/tokens')
+const { getCounterStore } = require('../../src/middleware/rateLimitStore')
+const introspectRouter = require('../../src/routes/introspect')
+const { errorHandler } = require('../../src/errors')
+
+describe('Introspection Endpoint', () => {
+  let app
+  let testDir
+  let accessToken
+  let originalLimits
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use('/introspect', introspectRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'resource-server',
+      client_secret: 'rs-secret',
+      redirect_uris: ['http://localhost:3000/callback'],
+      resource_identifiers: ['https://api.example.com']
+    })
+
+    accessToken = generateToken({
+      sub: 'user-123',
+      username: 'testuser',
+      client_id: 'test-client',
+      scope: 'openid profile',
+      token_type: 'access'
+    })
+
+    originalLimits = { ...config.rateLimit }
+    getCounterStore().purgeExpired(Infinity)
+  })
+
+  afterEach(() => {
+    Object.assign(config.rateLimit, originalLimits)
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  const introspect = (token, secret = 'rs-secret') => request(app)
+    .post('/introspect')
+    .type('form')
+    .send({ token, client_id: 'resource-server', client_secret: secret })
+
+  test('should describe an active access token', async () => {
+    const res = await introspect(accessToken)
+
+    expect(res.status).toBe(200)
+    expect(res.body.active).toBe(true)
+    expect(res.body.sub).toBe('user-123')
+    expect(res.body.client_id).toBe('test-client')
+    expect(res.body.scope).toBe('openid profile')
+    expect(res.body.token_type).toBe('Bearer')
+  })
+
+  test('should report an invalid token as inactive', async () => {
+    const res = await introspect('not-a-token')
+
+    expect(res.status).toBe(200)
+    expect(res.body).toEqual({ active: false })
+  })
+
+  test('should report a refresh token as inactive', async () => {
+    const refreshToken = generateToken({ sub: 'user-123', client_id: 'test-client', token_type: 'refresh' })
+
+    const res = await introspect(refreshToken)
+
+    expect(res.body).toEqual({ active: false })
+  })
+
+  test('should require client authentication', async () => {
+    const res = await introspect(accessToken, 'wrong-secret')
+
+    expect(res.status).toBe(401)
+    expect(res.body.error).toBe('invalid_client')
+  })
+
+  test('should require the token parameter', async () => {
+    const res = await request(app)
+      .post('/introspect')
+      .send({ client_id: 'resource-server', client_secret: 'rs-secret' })
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_request')
+  })
+
+  describe('audience check', () => {
+    afterEach(() => {
+      config.introspection.audienceCheck = false
+    })
+
+    const tokenFor = (aud) => generateToken({ sub: 'user-123', client_id: 'test-client', aud, token_type: 'access' })
+
+    test('should include aud in the response', async () => {
+      const res = await introspect(tokenFor('https://api.example.com'))
+
+      expect(res.body.aud).toBe('https://api.example.com')
+    })
+
+    test('should report a token for the caller as active', async () => {
+      config.introspection.audienceCheck = true
+
+      const byResource = await introspect(tokenFor('https://api.example.com'))
+      const byClientId = await introspect(tokenFor(['https://other.example.com', 'resource-server']))
+
+      expect(byResource.body.active).toBe(true)
+      expect(byClientId.body.active).toBe(true)
+    })
+
+    test('should report a token for another audience as inactive', async () => {
+      config.introspection.audienceCheck = true
+
+      const res = await introspect(tokenFor('https://other.example.com'))
+
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({ active: false })
+    })
+
+    test('should report a token without aud as inactive', async () => {
+      config.introspection.audienceCheck = true
+
+      const res = await introspect(accessToken)
+
+      expect(res.body).toEqual({ active: false })
+    })
+
+    test('should not check the audience when disabled', async () => {
+      const res = await introspect(tokenFor('https://other.example.com'))
+
+      expect(res.body.active).toBe(true)
+    })
+  })
+
+  describe('rate limiting', () => {
+    test('should answer 429 with Retry-After once the limit is exceeded', async () => {
+      config.rateLimit.introspect = 2
+
+      for (let i = 0; i < 2; i++) {
+        const res = await introspect(accessToken)
+        expect(res.status).toBe(200)
+      }
+      const res = await introspect(accessToken)
+
+      expect(res.status).toBe(429)
+      expect(res.body.error).toBe('too_many_requests')
+      expect(Number(res.headers['retry-after'])).toBeGreaterThan(0)
+    })
+
+    test('should throttle inactive introspections separately', async () => {
+      config.rateLimit.introspectInactive = 2
+
+      for (let i = 0; i < 2; i++) {
+        const res = await introspect(`guess-${i}`)
+        expect(res.body.active).toBe(false)
+      }
+      const res = await introspect('guess-2')
+
+      expect(res.status).toBe(429)
+      expect(Number(res.headers['retry-after'])).toBeGreaterThan(0)
+    })
+
+    test('should not count active introspections against the inactive limit', async () => {
+      config.rateLimit.introspectInactive = 2
+
+      for (let i = 0; i < 4; i++) {
+        const res = await introspect(accessToken)
+        expect(res.status).toBe(200)
+        expect(res.body.active).toBe(true)
+      }
+      const res = await introspect('guess-0')
+
+      expect(res.status).toBe(200)
+      expect(res.body.active).toBe(false)
+    })
+  })
+})
@@ -0,0 +1,141 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const session = require('express-session')
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const jwt = require('jsonwebtoken')
+const config = require('../../src/config')
+const { initDb, addClient } = require('../../src/db')
+const { ensurePrivateKey, generateIdToken } = require('../../src/tokens')
+const logoutRouter = require('../../src/routes/logout')
+const { errorHandler } = require('../../src/errors')
+const { subscribeEvents } = require('../../src/eventStream')
+
+describe('RP-Initiated Logout', () => {
+  let app
+  let agent
+  let testDir
+  const now = Math.floor(Date.now() / 1000)
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    app = express()
+    app.use(express.urlencoded({ extended: true }))
+    app.use(session({ secret: crypto.randomBytes(32).toString('hex'), resave: false, saveUninitialized: false }))
+    // Stands in for a login through the authorization endpoint
+    app.post('/sign-in', (req, res) => {
+      req.session.userId = req.body.userId || 'user1'
+      req.session.authTime = Date.now()
+      res.sendStatus(204)
+    })
+    app.get('/whoami', (req, res) => res.json({ userId: req.session.userId || null }))
+    app.use('/logout', logoutRouter)
+    app.use(errorHandler)
+    agent = request.agent(app)
+
+    await addClient({
+      client_id: 'app',
+      client_secret: 'secret',
+      redirect_uris: ['https://app.example.com/callback'],
+      post_logout_redirect_uris: ['https://app.example.com/signed-out']
+    })
+    await agent.post('/sign-in').type('form').send({ userId: 'user1' })
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  const idToken = (claims = {}) => generateIdToken({ iss: config.issuer, sub: 'user1', aud: 'app', ...claims })
+  const expiredIdToken = () => idToken({ iat: now - 7200, exp: now - 3600 })
+
+  test('should sign out with an expired id_token_hint and redirect with state', async () => {
+    const events = []
+    const subscription = subscribeEvents({ types: ['USER_LOGGED_OUT'], write: (event) => events.push(event) })
+    try {
+      const res = await agent.get('/logout').query({
+        id_token_hint: expiredIdToken(),
+        post_logout_redirect_uri: 'https://app.example.com/signed-out',
+        state: 'xyz'
+      })
+
+      expect(res.status).toBe(302)
+      expect(res.headers.location).toBe('https://app.example.com/signed-out?state=xyz')
+      expect((await agent.get('/whoami')).body.userId).toBeNull()
+      expect(events[0]).toMatchObject({ userIds: ['user1'], client_id: 'app', hint_expired: true })
+    } finally {
+      subscription.unsubscribe()
+    }
+  })
+
+  test('should accept the hint in a POST body', async () => {
+    const res = await agent.post('/logout').type('form').send({ id_token_hint: idToken() })
+
+    expect(res.status).toBe(200)
+    expect(res.text).toContain('You have been signed out')
+    expect((await agent.get('/whoami')).body.userId).toBeNull()
+  })
+
+  test('should reject a forged id_token_hint and keep the session', async () => {
+    const { privateKey } = crypto.generateKeyPairSync('rsa', { modulusLength: 2048 })
+    const { header } = jwt.decode(idToken(), { complete: true })
+    const forged = jwt.sign({ iss: config.issuer, sub: 'user1', aud: 'app', exp: now - 3600 }, privateKey, { algorithm: 'RS256', keyid: header.kid })
+
+    const res = await agent.get('/logout').query({
+      id_token_hint: forged,
+      post_logout_redirect_uri: 'https://app.example.com/signed-out'
+    })
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_request')
+    expect(res.headers.location).toBeUndefined()
+    expect((await agent.get('/whoami')).body.userId).toBe('user1')
+  })
+
+  test('should reject a hint from another issuer', async () => {
+    const res = await agent.get('/logout').query({ id_token_hint: idToken({ iss: 'https://evil.example.com' }) })
+
+    expect(res.status).toBe(400)
+    expect((await agent.get('/whoami')).body.userId).toBe('user1')
+  })
+
+  test('should refuse an unregistered post_logout_redirect_uri even with a valid hint', async () => {
+    const res = await agent.get('/logout').query({
+      id_token_hint: expiredIdToken(),
+      post_logout_redirect_uri: 'https://evil.example.com/'
+    })
+
+    expect(res.status).toBe(400)
+    expect(res.body.error_description).toBe('post_logout_redirect_uri is not registered for this client')
+    expect((await agent.get('/whoami')).body.userId).toBe('user1')
+  })
+
+  test('should refuse a post_logout_redirect_uri without a client', async () => {
+    const res = await agent.get('/logout').query({ post_logout_redirect_uri: 'https://app.example.com/signed-out' })
+
+    expect(res.status).toBe(400)
+  })
+
+  test('should refuse a client_id that contradicts the hint', async () => {
+    const res = await agent.get('/logout').query({ id_token_hint: idToken(), client_id: 'other' })
+
+    expect(res.status).toBe(400)
+    expect(res.body.error_description).toBe('client_id does not match the id_token_hint')
+  })
+
+  test('should not end the session of another user', async () => {
+    const res = await agent.get('/logout').query({ id_token_hint: idToken({ sub: 'user2' }) })
+
+    expect(res.status).toBe(400)
+    expect((await agent.get('/whoami')).body.userId).toBe('user1')
+  })
+})
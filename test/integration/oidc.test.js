@@ -49,6 +49,9 @@ describe('OIDC Integration Tests', () => {
       expect(response.body.claims_supported).toContain('sub')
       expect(response.body.claims_supported).toContain('email')
       expect(response.body.claims_supported).toContain('name')
+      expect(response.body.claims_supported).toContain('acr')
+      expect(response.body.claims_supported).toContain('amr')
+      expect(response.body.acr_values_supported).toEqual(['urn:ngauth:acr:pwd', 'urn:ngauth:acr:mfa'])
     })
 
     test('should include OIDC-specific metadata fields', async () => {
@@ -60,6 +63,21 @@ describe('OIDC Integration Tests', () => {
       expect(response.body.id_token_signing_alg_values_supported).toContain('RS256')
       expect(response.body).toHaveProperty('subject_types_supported')
       expect(response.body.subject_types_supported).toContain('public')
+      expect(response.body.display_values_supported).toEqual(['page', 'popup', 'touch', 'wap'])
+      expect(response.body.claims_parameter_supported).toBe(true)
+    })
+
+    test('should advertise only the signing algorithms the server implements', async () => {
+      const response = await request(app)
+        .get('/.well-known/openid-configuration')
+        .expect(200)
+
+      expect(response.body.id_token_signing_alg_values_supported).toEqual(['RS256'])
+      // Userinfo responses are never signed and request objects are not accepted
+      expect(response.body).not.toHaveProperty('userinfo_signing_alg_values_supported')
+      expect(response.body).not.toHaveProperty('request_object_signing_alg_values_supported')
+      expect(response.body.request_parameter_supported).toBe(false)
+      expect(response.body.request_uri_parameter_supported).toBe(false)
     })
   })
 
@@ -0,0 +1,145 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const session = require('express-session')
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb, addClient } = require('../../src/db')
+const { ensurePrivateKey, verifyToken } = require('../../src/tokens')
+const authorizeRouter = require('../../src/routes/authorize')
+const tokenRouter = require('../../src/routes/token')
+const { errorHandler } = require('../../src/errors')
+
+describe('Rich Authorization Requests (RFC 9396)', () => {
+  let app
+  let testDir
+
+  const payment = {
+    type: 'payment_initiation',
+    actions: ['initiate'],
+    instructedAmount: { currency: 'EUR', amount: '123.50' },
+    creditorName: 'Merchant A'
+  }
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use(session({
+      secret: crypto.randomBytes(32).toString('hex'),
+      resave: false,
+      saveUninitialized: false
+    }))
+    app.use('/authorize', authorizeRouter)
+    app.use('/token', tokenRouter)
+    app.use(errorHandler)
+
+    await addClient({
+      client_id: 'rar-client',
+      client_secret: 'test-secret',
+      redirect_uris: ['http://localhost:3000/callback'],
+      authorization_details_types: ['payment_initiation']
+    })
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should carry authorization_details from authorize into the token', async () => {
+    const query = {
+      client_id: 'rar-client',
+      redirect_uri: 'http://localhost:3000/callback',
+      response_type: 'code',
+      authorization_details: JSON.stringify([payment])
+    }
+
+    const form = await request(app).get('/authorize').query(query)
+    expect(form.status).toBe(200)
+    expect(form.text).toContain('name="authorization_details"')
+
+    // Submit exactly what the browser would post back from the hidden inputs
+    const hidden = {}
+    for (const [, name, value] of form.text.matchAll(/name="([^"]+)" value="([^"]*)"/g)) {
+      hidden[name] = value.replace(/&quot;/g, '"').replace(/&lt;/g, '<').replace(/&gt;/g, '>').replace(/&amp;/g, '&')
+    }
+
+    const login = await request(app)
+      .post('/authorize')
+      .set('Cookie', form.headers['set-cookie'] || [])
+      .type('form')
+      .send({ ...hidden, username: 'testuser', password: 'testpass' })
+
+    expect(login.status).toBe(302)
+    const code = new URL(login.headers.location).searchParams.get('code')
+
+    const res = await request(app)
+      .post('/token')
+      .send({
+        grant_type: 'authorization_code',
+        code,
+        redirect_uri: 'http://localhost:3000/callback',
+        client_id: 'rar-client',
+        client_secret: 'test-secret'
+      })
+
+    expect(res.status).toBe(200)
+    expect(res.body.authorization_details).toEqual([payment])
+    expect(verifyToken(res.body.access_token).authorization_details).toEqual([payment])
+  })
+
+  test('should include authorization_details in client_credentials tokens', async () => {
+    const res = await request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'rar-client',
+        client_secret: 'test-secret',
+        authorization_details: [payment]
+      })
+
+    expect(res.status).toBe(200)
+    expect(res.body.authorization_details).toEqual([payment])
+    expect(verifyToken(res.body.access_token).authorization_details).toEqual([payment])
+  })
+
+  test('should reject an unsupported type at the authorization endpoint', async () => {
+    const res = await request(app)
+      .get('/authorize')
+      .query({
+        client_id: 'rar-client',
+        redirect_uri: 'http://localhost:3000/callback',
+        response_type: 'code',
+        state: 'rar-1',
+        authorization_details: JSON.stringify([{ type: 'account_information' }])
+      })
+
+    expect(res.status).toBe(302)
+    const url = new URL(res.headers.location)
+    expect(url.searchParams.get('error')).toBe('invalid_authorization_details')
+    expect(url.searchParams.get('state')).toBe('rar-1')
+  })
+
+  test('should reject an unsupported type at the token endpoint', async () => {
+    const res = await request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'rar-client',
+        client_secret: 'test-secret',
+        authorization_details: [{ type: 'account_information' }]
+      })
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_authorization_details')
+  })
+})
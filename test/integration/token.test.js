@@ -2,13 +2,23 @@
 /* global describe, test, expect, beforeEach, afterEach */
 const request = require('supertest')
 const express = require('express')
+const session = require('express-session')
+const crypto = require('crypto')
 const fs = require('fs')
 const path = require('path')
 const os = require('os')
-const { initDb, addClient, addCode } = require('../../src/db')
-const { ensurePrivateKey } = require('../../src/tokens')
+const jwt = require('jsonwebtoken')
+const config = require('../../src/config')
+const { initDb, addClient, addCode, addUser, getIssuedToken, revokeIssuedToken, updateClient } = require('../../src/db')
+const { ensurePrivateKey, verifyToken } = require('../../src/tokens')
 const tokenRouter = require('../../src/routes/token')
+const introspectRouter = require('../../src/routes/introspect')
+const jwksRouter = require('../../src/routes/jwks')
+const registerRouter = require('../../src/routes/register')
 const { errorHandler } = require('../../src/errors')
+const { parseBody } = require('../../src/middleware/bodyLimit')
+const { subscribeEvents } = require('../../src/eventStream')
+const { tokenCors } = require('../../src/middleware/clientCors')
 
 describe('Token Endpoint', () => {
   let app
@@ -108,6 +118,93 @@ describe('Token Endpoint', () => {
       expect(res.status).toBe(200)
       expect(res.body.scope).toBe('')
     })
+
+    test('should serialize a single resource as a string audience', async () => {
+      const res = await request(app)
+        .post('/token')
+        .type('form')
+        .send('grant_type=client_credentials&client_id=test-client&client_secret=test-secret&resource=https://api.example.com')
+
+      expect(res.status).toBe(200)
+      expect(verifyToken(res.body.access_token).aud).toBe('https://api.example.com')
+    })
+
+    test('should serialize multiple resources as an audience array', async () => {
+      const res = await request(app)
+        .post('/token')
+        .type('form')
+        .send('grant_type=client_credentials&client_id=test-client&client_secret=test-secret' +
+          '&resource=https://api.example.com&resource=https://billing.example.com')
+
+      expect(res.status).toBe(200)
+      expect(verifyToken(res.body.access_token).aud).toEqual(['https://api.example.com', 'https://billing.example.com'])
+    })
+
+    test('should reject an invalid resource indicator', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          resource: 'not-a-uri'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_target')
+    })
+  })
+
+  describe('POST /token - client_credentials scope policy', () => {
+    const requestScope = (scope) => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret',
+        scope
+      })
+
+    afterEach(() => {
+      config.scopePolicy.clientCredentialsUserScopes = 'strip'
+      config.scopePolicy.machineOnlyScopes = []
+    })
+
+    test('should strip user-identity scopes and not issue an id_token', async () => {
+      const res = await requestScope('openid profile email read')
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read')
+      expect(res.body.id_token).toBeUndefined()
+      expect(verifyToken(res.body.access_token).scope).toBe('read')
+    })
+
+    test('should issue a scopeless token when only openid was requested', async () => {
+      const res = await requestScope('openid')
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('')
+      expect(res.body.id_token).toBeUndefined()
+    })
+
+    test('should reject user-identity scopes under the reject policy', async () => {
+      config.scopePolicy.clientCredentialsUserScopes = 'reject'
+
+      const res = await requestScope('read openid')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.error_description).toContain("'openid'")
+    })
+
+    test('should grant machine-only scopes', async () => {
+      config.scopePolicy.machineOnlyScopes = ['jobs:run']
+
+      const res = await requestScope('jobs:run')
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('jobs:run')
+    })
   })
 
   describe('POST /token - authorization_code grant', () => {
@@ -141,6 +238,73 @@ describe('Token Endpoint', () => {
       expect(res.body.scope).toBe('read')
     })
 
+    test('should name the user and the client in the access token', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code: 'valid-code',
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: 'test-client',
+          client_secret: 'test-secret'
+        })
+
+      const decoded = verifyToken(res.body.access_token)
+      expect(decoded.sub).toBe('user1')
+      expect(decoded.client_id).toBe('test-client')
+
+      // Introspection reports the same client
+      addClient({ client_id: 'resource-server', client_secret: 'rs-secret', redirect_uris: [] })
+      const introspectApp = express()
+      introspectApp.use(express.urlencoded({ extended: true }))
+      introspectApp.use('/introspect', introspectRouter)
+      const introspection = await request(introspectApp)
+        .post('/introspect')
+        .type('form')
+        .send({ token: res.body.access_token, client_id: 'resource-server', client_secret: 'rs-secret' })
+      expect(introspection.body.active).toBe(true)
+      expect(introspection.body.sub).toBe('user1')
+      expect(introspection.body.client_id).toBe('test-client')
+    })
+
+    test('should leave client_id out of access tokens when disabled', async () => {
+      config.tokens.includeClientId = false
+      try {
+        const res = await request(app)
+          .post('/token')
+          .send({
+            grant_type: 'authorization_code',
+            code: 'valid-code',
+            redirect_uri: 'http://localhost:3000/callback',
+            client_id: 'test-client',
+            client_secret: 'test-secret'
+          })
+
+        const decoded = verifyToken(res.body.access_token)
+        expect(decoded.sub).toBe('user1')
+        expect(decoded.client_id).toBeUndefined()
+      } finally {
+        config.tokens.includeClientId = true
+      }
+    })
+
+    test('should mark token and error responses as not cacheable', async () => {
+      const send = (code) => request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code,
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: 'test-client',
+          client_secret: 'test-secret'
+        })
+
+      for (const res of [await send('valid-code'), await send('unknown-code')]) {
+        expect(res.headers['cache-control']).toBe('no-store')
+        expect(res.headers.pragma).toBe('no-cache')
+      }
+    })
+
     test('should reject code reuse (single-use)', async () => {
       // First request should succeed
       await request(app)
@@ -273,31 +437,1526 @@ describe('Token Endpoint', () => {
     })
   })
 
-  describe('POST /token - unsupported grant types', () => {
-    test('should reject unsupported grant_type', async () => {
+  describe('POST /token - malformed requests', () => {
+    test('should reject a malformed JSON body with a safe description', async () => {
+      const res = await request(app)
+        .post('/token')
+        .set('Content-Type', 'application/json')
+        .send('{"grant_type": "client_credentials",')
+
+      expect(res.status).toBe(400)
+      expect(res.body).toEqual({
+        error: 'invalid_request',
+        error_description: 'Request body is not valid JSON'
+      })
+    })
+
+    test('should name a missing grant_type', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({ client_id: 'test-client', client_secret: 'test-secret' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toBe('Missing required parameter: grant_type')
+    })
+
+    test('should reject non-string parameters', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({ grant_type: ['client_credentials'], client_id: 'test-client', client_secret: 'test-secret' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toBe("Parameter 'grant_type' must be a string")
+    })
+  })
+
+  describe('POST /token - strict content type', () => {
+    beforeEach(() => {
+      config.tokenEndpoint.strictContentType = true
+    })
+
+    afterEach(() => {
+      config.tokenEndpoint.strictContentType = false
+    })
+
+    test('should accept application/x-www-form-urlencoded', async () => {
+      const res = await request(app)
+        .post('/token')
+        .set('Content-Type', 'application/x-www-form-urlencoded')
+        .send('grant_type=client_credentials&client_id=test-client&client_secret=test-secret')
+
+      expect(res.status).toBe(200)
+      expect(res.body).toHaveProperty('access_token')
+    })
+
+    test('should accept a charset parameter', async () => {
+      const res = await request(app)
+        .post('/token')
+        .set('Content-Type', 'application/x-www-form-urlencoded; charset=UTF-8')
+        .send('grant_type=client_credentials&client_id=test-client&client_secret=test-secret')
+
+      expect(res.status).toBe(200)
+      expect(res.body).toHaveProperty('access_token')
+    })
+
+    test('should reject a JSON body', async () => {
       const res = await request(app)
         .post('/token')
         .send({
-          grant_type: 'password',
+          grant_type: 'client_credentials',
           client_id: 'test-client',
           client_secret: 'test-secret'
         })
 
       expect(res.status).toBe(400)
-      expect(res.body.error).toBe('unsupported_grant_type')
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toContain('application/x-www-form-urlencoded')
     })
 
-    test('should reject implicit grant', async () => {
+    test('should accept a JSON body when strict mode is off', async () => {
+      config.tokenEndpoint.strictContentType = false
+
       const res = await request(app)
         .post('/token')
         .send({
-          grant_type: 'implicit',
+          grant_type: 'client_credentials',
           client_id: 'test-client',
           client_secret: 'test-secret'
         })
 
+      expect(res.status).toBe(200)
+    })
+  })
+
+  describe('POST /token - scope normalization', () => {
+    afterEach(() => {
+      config.scopeParsing.allowCommas = false
+      config.scopeParsing.maxScopes = 50
+      config.scopeParsing.maxScopeLength = 2048
+    })
+
+    test('should collapse duplicate scopes', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          scope: 'read  write read'
+        })
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read write')
+      expect(verifyToken(res.body.access_token).scope).toBe('read write')
+    })
+
+    test('should split comma-delimited scopes under the compatibility flag', async () => {
+      config.scopeParsing.allowCommas = true
+
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          scope: 'read,write, read'
+        })
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read write')
+    })
+
+    test('should reject more scopes than the maximum count', async () => {
+      config.scopeParsing.maxScopes = 2
+
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          scope: 'read write admin'
+        })
+
       expect(res.status).toBe(400)
-      expect(res.body.error).toBe('unsupported_grant_type')
+      expect(res.body.error).toBe('invalid_scope')
+    })
+
+    test('should reject a scope longer than the maximum length', async () => {
+      config.scopeParsing.maxScopeLength = 64
+
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          scope: `read ${'x'.repeat(64)} read`
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.error_description).toBe('The scope parameter may be at most 64 characters, got 69')
+    })
+
+    test('should apply the caps after collapsing duplicates', async () => {
+      config.scopeParsing.maxScopes = 2
+      config.scopeParsing.maxScopeLength = 10
+
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          scope: 'read write read write read'
+        })
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read write')
+    })
+  })
+
+  describe('POST /token - scope claim representation', () => {
+    const original = { ...config.claims }
+
+    afterEach(() => {
+      Object.assign(config.claims, original)
+    })
+
+    const issue = () => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret',
+        scope: 'read write'
+      })
+
+    test.each([
+      ['scope', 'string', 'read write'],
+      ['scope', 'array', ['read', 'write']],
+      ['scp', 'array', ['read', 'write']],
+      ['scp', 'string', 'read write']
+    ])('should put the scopes in %s as a %s', async (name, format, expected) => {
+      config.claims.scopeClaimName = name
+      config.claims.scopeFormat = format
+
+      const res = await issue()
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read write')
+      const decoded = verifyToken(res.body.access_token)
+      expect(decoded[name]).toEqual(expected)
+      if (name !== 'scope') {
+        expect(decoded).not.toHaveProperty('scope')
+      }
+    })
+  })
+
+  describe('POST /token - id_token lifetime', () => {
+    const originalTokens = { ...config.tokens }
+
+    beforeEach(async () => {
+      await addClient({
+        client_id: 'short-id-client',
+        client_secret: 'test-secret',
+        redirect_uris: ['http://localhost:3000/callback'],
+        id_token_lifetime: 300
+      })
+    })
+
+    afterEach(() => {
+      Object.assign(config.tokens, originalTokens)
+    })
+
+    const exchange = async (clientId) => {
+      await addCode({
+        code: `code-${clientId}`,
+        client_id: clientId,
+        redirect_uri: 'http://localhost:3000/callback',
+        scope: 'openid',
+        userId: 'user1',
+        expiresAt: Date.now() + 600000
+      })
+      return request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code: `code-${clientId}`,
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: clientId,
+          client_secret: 'test-secret'
+        })
+    }
+
+    const lifetime = (token) => {
+      const { exp, iat } = verifyToken(token)
+      return exp - iat
+    }
+
+    test('should give the id_token the client lifetime and the access token the configured TTL', async () => {
+      config.tokens.accessTokenTTL = 1800
+
+      const res = await exchange('short-id-client')
+
+      expect(res.status).toBe(200)
+      expect(res.body.expires_in).toBe(1800)
+      expect(lifetime(res.body.access_token)).toBe(1800)
+      expect(lifetime(res.body.id_token)).toBe(300)
+    })
+
+    test('should fall back to the configured id_token TTL', async () => {
+      config.tokens.idTokenTTL = 900
+
+      const res = await exchange('test-client')
+
+      expect(lifetime(res.body.id_token)).toBe(900)
+      expect(lifetime(res.body.access_token)).toBe(config.tokens.accessTokenTTL)
+    })
+  })
+
+  describe('POST /token - pairwise subjects', () => {
+    const redirectUris = ['https://app.example.com/callback', 'https://m.example.com/callback']
+
+    beforeEach(async () => {
+      config.claims.pairwiseSecret = 'test-pairwise-secret'
+      await addClient({
+        client_id: 'web-client',
+        client_secret: 'test-secret',
+        redirect_uris: redirectUris,
+        subject_type: 'pairwise',
+        sector_identifier: 'sector.example.com'
+      })
+      await addClient({
+        client_id: 'mobile-client',
+        client_secret: 'test-secret',
+        redirect_uris: ['https://m.example.com/callback'],
+        subject_type: 'pairwise',
+        sector_identifier: 'sector.example.com'
+      })
+      await addClient({
+        client_id: 'other-client',
+        client_secret: 'test-secret',
+        redirect_uris: ['https://other.example.com/callback'],
+        subject_type: 'pairwise',
+        sector_identifier: 'other.example.com'
+      })
+    })
+
+    afterEach(() => {
+      config.claims.pairwiseSecret = ''
+    })
+
+    const subjectOf = async (clientId, redirectUri) => {
+      const code = `code-${clientId}-${redirectUri}`
+      await addCode({ code, client_id: clientId, redirect_uri: redirectUri, scope: 'openid', userId: 'user1', expiresAt: Date.now() + 600000 })
+      const res = await request(app)
+        .post('/token')
+        .send({ grant_type: 'authorization_code', code, redirect_uri: redirectUri, client_id: clientId, client_secret: 'test-secret' })
+      expect(res.status).toBe(200)
+      return verifyToken(res.body.id_token).sub
+    }
+
+    test('should give the same sub across the redirect hosts of a sector', async () => {
+      const web = await subjectOf('web-client', redirectUris[0])
+      const mobile = await subjectOf('web-client', redirectUris[1])
+
+      expect(web).not.toBe('user1')
+      expect(mobile).toBe(web)
+      expect(await subjectOf('mobile-client', redirectUris[1])).toBe(web)
+    })
+
+    test('should give clients of another sector a different sub', async () => {
+      const web = await subjectOf('web-client', redirectUris[0])
+
+      expect(await subjectOf('other-client', 'https://other.example.com/callback')).not.toBe(web)
+    })
+
+    test('should keep the local user ID in the sub of public clients', async () => {
+      expect(await subjectOf('test-client', 'http://localhost:3000/callback')).toBe('user1')
+    })
+  })
+
+  describe('POST /token - default claims', () => {
+    beforeEach(async () => {
+      config.claims.defaultClaims = { tenant: 'acme', env: 'prod', aud: 'https://evil.example.com', sub: 'admin' }
+      await addClient({
+        client_id: 'staging-client',
+        client_secret: 'test-secret',
+        redirect_uris: ['http://localhost:3000/callback'],
+        grant_types: ['authorization_code', 'client_credentials'],
+        default_claims: { env: 'staging', region: 'eu' }
+      })
+    })
+
+    afterEach(() => {
+      config.claims.defaultClaims = {}
+    })
+
+    const exchange = async (clientId) => {
+      await addCode({
+        code: `code-${clientId}`,
+        client_id: clientId,
+        redirect_uri: 'http://localhost:3000/callback',
+        scope: 'openid',
+        userId: 'user1',
+        expiresAt: Date.now() + 600000
+      })
+      return request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code: `code-${clientId}`,
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: clientId,
+          client_secret: 'test-secret'
+        })
+    }
+
+    test('should add the issuer defaults to access and ID tokens', async () => {
+      const res = await exchange('test-client')
+
+      expect(res.status).toBe(200)
+      for (const token of [res.body.access_token, res.body.id_token]) {
+        const claims = verifyToken(token)
+        expect(claims.tenant).toBe('acme')
+        expect(claims.env).toBe('prod')
+        expect(claims.sub).toBe('user1')
+      }
+      // A default never sets a protected claim the token does not carry
+      expect(verifyToken(res.body.access_token)).not.toHaveProperty('aud')
+    })
+
+    test('should let client defaults override the issuer defaults', async () => {
+      const res = await exchange('staging-client')
+
+      const claims = verifyToken(res.body.access_token)
+      expect(claims.tenant).toBe('acme')
+      expect(claims.env).toBe('staging')
+      expect(claims.region).toBe('eu')
+      expect(verifyToken(res.body.id_token).env).toBe('staging')
+    })
+
+    test('should add the defaults to client_credentials tokens', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({ grant_type: 'client_credentials', client_id: 'staging-client', client_secret: 'test-secret' })
+
+      const claims = verifyToken(res.body.access_token)
+      expect(claims.env).toBe('staging')
+      expect(claims.tenant).toBe('acme')
+      expect(claims.sub).toBe('staging-client')
+    })
+  })
+
+  describe('POST /token - authentication context', () => {
+    test('should put the session amr, acr and auth_time in the id_token', async () => {
+      const authTime = Date.now() - 1000
+      await addCode({
+        code: 'stepped-up-code',
+        client_id: 'test-client',
+        redirect_uri: 'http://localhost:3000/callback',
+        scope: 'openid',
+        userId: 'user1',
+        authTime,
+        amr: ['pwd', 'otp'],
+        acr: 'urn:ngauth:acr:mfa',
+        expiresAt: Date.now() + 600000
+      })
+
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code: 'stepped-up-code',
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: 'test-client',
+          client_secret: 'test-secret'
+        })
+
+      expect(res.status).toBe(200)
+      const idToken = verifyToken(res.body.id_token)
+      expect(idToken.amr).toEqual(['pwd', 'otp'])
+      expect(idToken.acr).toBe('urn:ngauth:acr:mfa')
+      expect(idToken.auth_time).toBe(Math.floor(authTime / 1000))
+    })
+  })
+
+  describe('POST /token - token_type casing', () => {
+    const params = {
+      grant_type: 'client_credentials',
+      client_id: 'test-client',
+      client_secret: 'test-secret'
+    }
+
+    afterEach(() => {
+      config.tokenEndpoint.tokenType = 'Bearer'
+    })
+
+    test('should emit the configured casing', async () => {
+      config.tokenEndpoint.tokenType = 'bearer'
+
+      const res = await request(app)
+        .post('/token')
+        .send(params)
+
+      expect(res.status).toBe(200)
+      expect(res.body.token_type).toBe('bearer')
+    })
+
+    test('should fall back to Bearer for values other than bearer', async () => {
+      config.tokenEndpoint.tokenType = 'mac'
+
+      const res = await request(app)
+        .post('/token')
+        .send(params)
+
+      expect(res.body.token_type).toBe('Bearer')
+    })
+  })
+
+  describe('POST /token - idempotency keys', () => {
+    const params = {
+      grant_type: 'authorization_code',
+      code: 'idempotent-code',
+      redirect_uri: 'http://localhost:3000/callback',
+      client_id: 'test-client',
+      client_secret: 'test-secret'
+    }
+
+    beforeEach(async () => {
+      await addCode({
+        code: 'idempotent-code',
+        client_id: 'test-client',
+        redirect_uri: 'http://localhost:3000/callback',
+        scope: 'read',
+        userId: 'user1',
+        expiresAt: Date.now() + 600000
+      })
+    })
+
+    test('should replay the original response for a retried request', async () => {
+      const first = await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-1')
+        .send(params)
+
+      expect(first.status).toBe(200)
+
+      const retry = await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-1')
+        .send(params)
+
+      expect(retry.status).toBe(200)
+      expect(retry.headers['idempotent-replayed']).toBe('true')
+      expect(retry.body).toEqual(first.body)
+    })
+
+    test('should still treat a reused code without a key as invalid', async () => {
+      await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-2')
+        .send(params)
+
+      const res = await request(app)
+        .post('/token')
+        .send(params)
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_grant')
+    })
+
+    test('should reject a different request with the same key', async () => {
+      await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-3')
+        .send(params)
+
+      const res = await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-3')
+        .send({ ...params, redirect_uri: 'http://localhost:3000/other' })
+
+      expect(res.status).toBe(422)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    test('should not share keys between clients', async () => {
+      addClient({
+        client_id: 'other-client',
+        client_secret: 'other-secret',
+        redirect_uris: ['http://localhost:3000/callback']
+      })
+
+      await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-4')
+        .send(params)
+
+      const res = await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-4')
+        .send({ ...params, client_id: 'other-client', client_secret: 'other-secret' })
+
+      expect(res.headers['idempotent-replayed']).toBeUndefined()
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_grant')
+    })
+
+    test('should not cache failed responses', async () => {
+      const failed = await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-5')
+        .send({ ...params, code: 'unknown-code' })
+
+      expect(failed.status).toBe(400)
+
+      const retry = await request(app)
+        .post('/token')
+        .set('Idempotency-Key', 'retry-key-5')
+        .send({ ...params, code: 'unknown-code' })
+
+      expect(retry.status).toBe(400)
+      expect(retry.headers['idempotent-replayed']).toBeUndefined()
+    })
+  })
+
+  describe('POST /token - offline_access and refresh tokens', () => {
+    const exchange = (code) => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'authorization_code',
+        code,
+        redirect_uri: 'http://localhost:3000/callback',
+        client_id: 'test-client',
+        client_secret: 'test-secret'
+      })
+
+    const refresh = (refreshToken, extra = {}) => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'refresh_token',
+        refresh_token: refreshToken,
+        client_id: 'test-client',
+        client_secret: 'test-secret',
+        ...extra
+      })
+
+    beforeEach(async () => {
+      for (const [code, scope] of [['plain-code', 'read'], ['offline-code', 'read write offline_access']]) {
+        await addCode({
+          code,
+          client_id: 'test-client',
+          redirect_uri: 'http://localhost:3000/callback',
+          scope,
+          userId: 'user1',
+          expiresAt: Date.now() + 600000
+        })
+      }
+    })
+
+    afterEach(() => {
+      config.features.refreshTokens = true
+      config.features.offlineAccess = true
+      config.tokens.maxRefreshRotations = 0
+      config.codes.refreshTokenPrefix = ''
+    })
+
+    test('should not issue a refresh token without offline_access', async () => {
+      const res = await exchange('plain-code')
+
+      expect(res.status).toBe(200)
+      expect(res.body.refresh_token).toBeUndefined()
+    })
+
+    test('should issue a refresh token for consented offline_access', async () => {
+      const res = await exchange('offline-code')
+
+      expect(res.status).toBe(200)
+      expect(typeof res.body.refresh_token).toBe('string')
+    })
+
+    test('should issue prefixed refresh tokens that rotate and revoke as usual', async () => {
+      config.codes.refreshTokenPrefix = 'ngauth_rt_'
+      const { body: issued } = await exchange('offline-code')
+
+      expect(issued.refresh_token).toMatch(/^ngauth_rt_[0-9a-f]{64}$/)
+
+      const res = await refresh(issued.refresh_token)
+      expect(res.status).toBe(200)
+      expect(res.body.refresh_token).toMatch(/^ngauth_rt_[0-9a-f]{64}$/)
+      expect((await refresh(issued.refresh_token)).body.error).toBe('invalid_grant')
+    })
+
+    test('should keep accepting refresh tokens issued before the prefix was set', async () => {
+      const { body: issued } = await exchange('offline-code')
+      config.codes.refreshTokenPrefix = 'ngauth_rt_'
+
+      const res = await refresh(issued.refresh_token)
+
+      expect(res.status).toBe(200)
+      expect(res.body.refresh_token).toMatch(/^ngauth_rt_/)
+    })
+
+    test('should not issue a refresh token when offline access is disabled', async () => {
+      config.features.offlineAccess = false
+
+      const res = await exchange('offline-code')
+
+      expect(res.status).toBe(200)
+      expect(res.body.refresh_token).toBeUndefined()
+    })
+
+    test('should not issue refresh tokens for client_credentials', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'client_credentials',
+          client_id: 'test-client',
+          client_secret: 'test-secret',
+          scope: 'read offline_access'
+        })
+
+      expect(res.status).toBe(200)
+      expect(res.body.refresh_token).toBeUndefined()
+    })
+
+    test('should exchange and rotate a refresh token', async () => {
+      const { body: issued } = await exchange('offline-code')
+
+      const res = await refresh(issued.refresh_token)
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read write offline_access')
+      expect(res.body.refresh_token).toBeDefined()
+      expect(res.body.refresh_token).not.toBe(issued.refresh_token)
+      expect(verifyToken(res.body.access_token).sub).toBe('user1')
+
+      const reused = await refresh(issued.refresh_token)
+      expect(reused.status).toBe(400)
+      expect(reused.body.error).toBe('invalid_grant')
+    })
+
+    test('should allow narrowing but not widening the scope', async () => {
+      const { body: issued } = await exchange('offline-code')
+
+      const wider = await refresh(issued.refresh_token, { scope: 'read admin' })
+      expect(wider.status).toBe(400)
+      expect(wider.body.error).toBe('invalid_scope')
+
+      const narrower = await refresh(issued.refresh_token, { scope: 'read' })
+      expect(narrower.status).toBe(200)
+      expect(verifyToken(narrower.body.access_token).scope).toBe('read')
+    })
+
+    test('should rotate up to the configured limit and then require a new login', async () => {
+      config.tokens.maxRefreshRotations = 3
+      let { body: { refresh_token: current } } = await exchange('offline-code')
+
+      for (let i = 0; i < 3; i++) {
+        const res = await refresh(current)
+        expect(res.status).toBe(200)
+        current = res.body.refresh_token
+      }
+
+      const res = await refresh(current)
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_grant')
+      expect(res.body.error_description).toContain('sign in again')
+
+      // The exhausted token is gone rather than left to retry
+      const retried = await refresh(current)
+      expect(retried.body.error_description).toBe('Invalid refresh token')
+    })
+
+    test('should count rotations across a narrowed scope', async () => {
+      config.tokens.maxRefreshRotations = 1
+      const { body: issued } = await exchange('offline-code')
+
+      const first = await refresh(issued.refresh_token, { scope: 'read' })
+      expect(first.status).toBe(200)
+
+      const second = await refresh(first.body.refresh_token)
+      expect(second.status).toBe(400)
+      expect(second.body.error).toBe('invalid_grant')
+    })
+
+    test('should rotate without limit by default', async () => {
+      let { body: { refresh_token: current } } = await exchange('offline-code')
+
+      for (let i = 0; i < 5; i++) {
+        const res = await refresh(current)
+        expect(res.status).toBe(200)
+        current = res.body.refresh_token
+      }
+    })
+
+    test('should reject a refresh token issued to another client', async () => {
+      const { body: issued } = await exchange('offline-code')
+      await addClient({ client_id: 'other-client', client_secret: 'other-secret', redirect_uris: [] })
+
+      const res = await refresh(issued.refresh_token, { client_id: 'other-client', client_secret: 'other-secret' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_grant')
+    })
+  })
+
+  describe('POST /token - authorization code reuse', () => {
+    const exchange = () => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'authorization_code',
+        code: 'offline-code',
+        redirect_uri: 'http://localhost:3000/callback',
+        client_id: 'test-client',
+        client_secret: 'test-secret'
+      })
+
+    const refresh = (refreshToken) => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'refresh_token',
+        refresh_token: refreshToken,
+        client_id: 'test-client',
+        client_secret: 'test-secret'
+      })
+
+    const introspect = async (token) => {
+      await addClient({ client_id: 'resource-server', client_secret: 'rs-secret', redirect_uris: [] })
+      const introspectApp = express()
+      introspectApp.use(express.urlencoded({ extended: true }))
+      introspectApp.use('/introspect', introspectRouter)
+      const res = await request(introspectApp)
+        .post('/introspect')
+        .type('form')
+        .send({ token, client_id: 'resource-server', client_secret: 'rs-secret' })
+      return res.body
+    }
+
+    beforeEach(async () => {
+      await addCode({
+        code: 'offline-code',
+        client_id: 'test-client',
+        redirect_uri: 'http://localhost:3000/callback',
+        scope: 'read offline_access',
+        userId: 'user1',
+        expiresAt: Date.now() + 600000
+      })
+    })
+
+    afterEach(() => {
+      config.tokens.revokeOnCodeReuse = true
+    })
+
+    test('should revoke the tokens issued from a reused code', async () => {
+      const { body: issued } = await exchange()
+      expect((await introspect(issued.access_token)).active).toBe(true)
+
+      const reused = await exchange()
+
+      expect(reused.status).toBe(400)
+      expect(reused.body.error).toBe('invalid_grant')
+      expect(reused.body.error_description).toBe('Authorization code has already been used')
+      expect((await introspect(issued.access_token)).active).toBe(false)
+      expect((await refresh(issued.refresh_token)).body.error).toBe('invalid_grant')
+    })
+
+    test('should revoke refresh tokens rotated from the code', async () => {
+      const { body: issued } = await exchange()
+      const rotated = await refresh(issued.refresh_token)
+      expect(rotated.status).toBe(200)
+
+      await exchange()
+
+      expect((await introspect(rotated.body.access_token)).active).toBe(false)
+      expect((await refresh(rotated.body.refresh_token)).body.error).toBe('invalid_grant')
+    })
+
+    test('should keep tokens from another code of the same user valid', async () => {
+      await addCode({
+        code: 'second-code',
+        client_id: 'test-client',
+        redirect_uri: 'http://localhost:3000/callback',
+        scope: 'read offline_access',
+        userId: 'user1',
+        expiresAt: Date.now() + 600000
+      })
+      const { body: first } = await exchange()
+      const { body: second } = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code: 'second-code',
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: 'test-client',
+          client_secret: 'test-secret'
+        })
+
+      await exchange()
+
+      expect((await introspect(first.access_token)).active).toBe(false)
+      expect((await introspect(second.access_token)).active).toBe(true)
+      expect((await refresh(second.refresh_token)).status).toBe(200)
+    })
+
+    test('should leave the tokens alone when another client presents the code', async () => {
+      const { body: issued } = await exchange()
+      await addClient({ client_id: 'other-client', client_secret: 'other-secret', redirect_uris: ['http://localhost:3000/callback'] })
+
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'authorization_code',
+          code: 'offline-code',
+          redirect_uri: 'http://localhost:3000/callback',
+          client_id: 'other-client',
+          client_secret: 'other-secret'
+        })
+
+      expect(res.body.error).toBe('invalid_grant')
+      expect((await refresh(issued.refresh_token)).status).toBe(200)
+    })
+
+    test('should only reject the reused code when revocation is disabled', async () => {
+      config.tokens.revokeOnCodeReuse = false
+      const { body: issued } = await exchange()
+
+      const reused = await exchange()
+
+      expect(reused.status).toBe(400)
+      expect(reused.body.error).toBe('invalid_grant')
+      expect((await introspect(issued.access_token)).active).toBe(true)
+      expect((await refresh(issued.refresh_token)).status).toBe(200)
+    })
+  })
+
+  describe('POST /token - scope baselines', () => {
+    const originalBaseline = { ...config.scopeBaseline }
+    let events
+    let subscription
+
+    const issue = (scope) => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret',
+        scope
+      })
+
+    beforeEach(async () => {
+      Object.assign(config.scopeBaseline, { mode: 'monitor', learningRequests: 2 })
+      events = []
+      subscription = subscribeEvents({ types: ['SCOPE_BASELINE_EXCEEDED'], write: (event) => events.push(event) })
+      await issue('read')
+      await issue('read write')
+    })
+
+    afterEach(() => {
+      Object.assign(config.scopeBaseline, originalBaseline)
+      subscription.unsubscribe()
+    })
+
+    test('should stay silent for a usual scope request', async () => {
+      const res = await issue('write')
+
+      expect(res.status).toBe(200)
+      expect(events).toEqual([])
+    })
+
+    test('should audit an unusual scope request without blocking it', async () => {
+      const res = await issue('read delete')
+
+      expect(res.status).toBe(200)
+      expect(events).toHaveLength(1)
+      expect(events[0]).toMatchObject({ client_id: 'test-client', unusual_scopes: ['delete'], mode: 'monitor' })
+    })
+
+    test('should refuse an unusual scope request when enforcing', async () => {
+      config.scopeBaseline.mode = 'enforce'
+
+      const res = await issue('read delete')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.error_description).toBe("Scope 'delete' is outside the usual scopes of this client")
+      expect(events).toHaveLength(1)
+    })
+  })
+
+  describe('POST /token - issuance metadata', () => {
+    let events
+    let subscription
+
+    const issue = () => request(app)
+      .post('/token')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret',
+        scope: 'read'
+      })
+
+    const introspect = async (token) => {
+      await addClient({ client_id: 'resource-server', client_secret: 'rs-secret', redirect_uris: [] })
+      const introspectApp = express()
+      introspectApp.use(express.urlencoded({ extended: true }))
+      introspectApp.use('/introspect', introspectRouter)
+      const res = await request(introspectApp)
+        .post('/introspect')
+        .type('form')
+        .send({ token, client_id: 'resource-server', client_secret: 'rs-secret' })
+      return res.body
+    }
+
+    beforeEach(() => {
+      events = []
+      subscription = subscribeEvents({ types: ['TOKEN_ISSUED'], write: (event) => events.push(event) })
+    })
+
+    afterEach(() => {
+      config.tokens.issuanceHeader = false
+      subscription.unsubscribe()
+    })
+
+    test('should give each access token a unique jti surfaced in audit and introspection', async () => {
+      const first = await issue()
+      const second = await issue()
+
+      const jtis = [first, second].map(res => jwt.decode(res.body.access_token).jti)
+      expect(jtis[0]).toMatch(/^[0-9a-f]{32}$/)
+      expect(jtis[1]).not.toBe(jtis[0])
+
+      expect(events.map(event => event.jti)).toEqual(jtis)
+      const { iat, exp } = jwt.decode(first.body.access_token)
+      expect(events[0]).toMatchObject({ client_id: 'test-client', grant_type: 'client_credentials', scope: 'read', iat, exp })
+
+      expect((await introspect(first.body.access_token)).jti).toBe(jtis[0])
+      expect((await introspect(second.body.access_token)).jti).toBe(jtis[1])
+    })
+
+    test('should store the jti until the token expires', async () => {
+      const res = await issue()
+      const { jti, exp } = jwt.decode(res.body.access_token)
+
+      const record = await getIssuedToken(jti)
+
+      expect(record).toMatchObject({ jti, client_id: 'test-client', sub: 'test-client', scope: 'read', expiresAt: exp * 1000 })
+    })
+
+    test('should only revoke the token with the revoked jti', async () => {
+      const revoked = await issue()
+      const kept = await issue()
+
+      await revokeIssuedToken(jwt.decode(revoked.body.access_token).jti)
+
+      expect((await introspect(revoked.body.access_token)).active).toBe(false)
+      expect((await introspect(kept.body.access_token)).active).toBe(true)
+    })
+
+    test('should describe the token in a debug header only when enabled', async () => {
+      const plain = await issue()
+      expect(plain.headers['token-issuance']).toBeUndefined()
+
+      config.tokens.issuanceHeader = true
+      const res = await issue()
+
+      const { jti, iat, exp } = jwt.decode(res.body.access_token)
+      expect(JSON.parse(res.headers['token-issuance'])).toEqual({ jti, iat, exp, scope: 'read' })
+    })
+  })
+
+  describe('POST /token - client signing keys', () => {
+    beforeEach(async () => {
+      app = express()
+      app.use(express.json())
+      app.use(express.urlencoded({ extended: true }))
+      app.use('/token', tokenRouter)
+      app.use('/.well-known', jwksRouter)
+      app.use(errorHandler)
+
+      await addClient({ client_id: 'tenant-a-api', client_secret: 'tenant-a-secret', redirect_uris: [], grant_types: ['client_credentials'], signing_key_id: 'tenant-a' })
+      await addClient({ client_id: 'tenant-a-web', client_secret: 'tenant-a-secret', redirect_uris: [], grant_types: ['client_credentials'], signing_key_id: 'tenant-a' })
+    })
+
+    const issue = (clientId, secret) => request(app)
+      .post('/token')
+      .send({ grant_type: 'client_credentials', client_id: clientId, client_secret: secret })
+
+    test("should sign the client's tokens with its own key, verifiable via its JWKS", async () => {
+      const res = await issue('tenant-a-api', 'tenant-a-secret')
+      expect(res.status).toBe(200)
+      const { header } = jwt.decode(res.body.access_token, { complete: true })
+      expect(header.kid).toBe('tenant-a')
+
+      const jwksRes = await request(app).get('/.well-known/jwks/tenant-a-api.json')
+      expect(jwksRes.status).toBe(200)
+      expect(jwksRes.body.keys.map(k => k.kid)).toEqual(['tenant-a'])
+
+      const key = crypto.createPublicKey({ key: jwksRes.body.keys[0], format: 'jwk' })
+      expect(jwt.verify(res.body.access_token, key, { algorithms: ['RS256'] }).client_id).toBe('tenant-a-api')
+    })
+
+    test('should share the key between the clients of a tenant', async () => {
+      const api = await issue('tenant-a-api', 'tenant-a-secret')
+      const web = await issue('tenant-a-web', 'tenant-a-secret')
+
+      expect(jwt.decode(web.body.access_token, { complete: true }).header.kid).toBe('tenant-a')
+      const [apiJwks, webJwks] = await Promise.all([
+        request(app).get('/.well-known/jwks/tenant-a-api.json'),
+        request(app).get('/.well-known/jwks/tenant-a-web.json')
+      ])
+      expect(webJwks.body).toEqual(apiJwks.body)
+      expect(verifyToken(api.body.access_token).client_id).toBe('tenant-a-api')
+    })
+
+    test('should keep other clients on the server key', async () => {
+      const res = await issue('test-client', 'test-secret')
+      const { header } = jwt.decode(res.body.access_token, { complete: true })
+
+      const jwksRes = await request(app).get('/.well-known/jwks.json')
+      expect(jwksRes.body.keys.map(k => k.kid)).toEqual([header.kid])
+      expect(jwksRes.body.keys.map(k => k.kid)).not.toContain('tenant-a')
+    })
+
+    test('should not serve a JWKS for a client without a dedicated key', async () => {
+      const res = await request(app).get('/.well-known/jwks/test-client.json')
+
+      expect(res.status).toBe(404)
+      expect(res.body.error).toBe('not_found')
+    })
+  })
+
+  describe('POST /token - private_key_jwt', () => {
+    const assertionType = 'urn:ietf:params:oauth:client-assertion-type:jwt-bearer'
+    const { privateKey, publicKey } = crypto.generateKeyPairSync('ec', { namedCurve: 'P-256' })
+
+    beforeEach(async () => {
+      await addClient({
+        client_id: 'jwt-client',
+        client_secret: 'jwt-secret',
+        redirect_uris: [],
+        grant_types: ['client_credentials'],
+        jwks: { keys: [{ ...publicKey.export({ format: 'jwk' }), kid: 'jwt-key', use: 'sig' }] }
+      })
+    })
+
+    const sign = (claims = {}, key = privateKey) => {
+      const now = Math.floor(Date.now() / 1000)
+      return jwt.sign({
+        iss: 'jwt-client',
+        sub: 'jwt-client',
+        aud: `${config.issuer}${config.endpoints.token}`,
+        jti: crypto.randomUUID(),
+        iat: now,
+        exp: now + 60,
+        ...claims
+      }, key, { algorithm: 'ES256', keyid: 'jwt-key' })
+    }
+
+    const authenticate = (assertion, extra = {}) => request(app)
+      .post('/token')
+      .send({ grant_type: 'client_credentials', client_assertion_type: assertionType, client_assertion: assertion, ...extra })
+
+    test('should issue a token to a client authenticated by its assertion', async () => {
+      const events = []
+      const subscription = subscribeEvents({ types: ['CLIENT_AUTHENTICATED'], write: (event) => events.push(event) })
+
+      const res = await authenticate(sign())
+      subscription.unsubscribe()
+
+      expect(res.status).toBe(200)
+      expect(verifyToken(res.body.access_token).client_id).toBe('jwt-client')
+      expect(events).toEqual([expect.objectContaining({ client_id: 'jwt-client', method: 'private_key_jwt' })])
+    })
+
+    test('should accept the issuer as audience', async () => {
+      const res = await authenticate(sign({ aud: config.issuer }))
+
+      expect(res.status).toBe(200)
+    })
+
+    test('should refuse a replayed assertion', async () => {
+      const assertion = sign()
+      await authenticate(assertion)
+      const res = await authenticate(assertion)
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client')
+      expect(res.body.error_description).toContain('already been used')
+    })
+
+    test('should refuse stale, future-dated and long-lived assertions', async () => {
+      const now = Math.floor(Date.now() / 1000)
+      for (const claims of [
+        { iat: now - 600, exp: now - 300 },
+        { iat: now + 600, exp: now + 660 },
+        { exp: now + 3600 }
+      ]) {
+        const res = await authenticate(sign(claims))
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_client')
+      }
+    })
+
+    test('should refuse an assertion signed by another key or for another audience', async () => {
+      const other = crypto.generateKeyPairSync('ec', { namedCurve: 'P-256' }).privateKey
+
+      for (const assertion of [sign({}, other), sign({ aud: 'https://elsewhere.example/token' })]) {
+        const res = await authenticate(assertion)
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_client')
+      }
+    })
+
+    test('should refuse an assertion for a client without registered keys', async () => {
+      const res = await authenticate(sign({ iss: 'test-client', sub: 'test-client' }))
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client')
+    })
+
+    test('should refuse an assertion sent together with a secret', async () => {
+      const res = await authenticate(sign(), { client_id: 'jwt-client', client_secret: 'jwt-secret' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+  })
+
+  describe('POST /token - admin scope', () => {
+    const originalAdminClients = config.scopePolicy.adminClients
+
+    afterEach(() => {
+      config.scopePolicy.adminClients = originalAdminClients
+    })
+
+    const clientCredentials = (clientId, clientSecret, scope) => request(app)
+      .post('/token')
+      .send({ grant_type: 'client_credentials', client_id: clientId, client_secret: clientSecret, scope })
+
+    test('should not let a dynamically registered client obtain an admin token', async () => {
+      const registration = express()
+      registration.use(express.json())
+      registration.use('/register', registerRouter)
+      registration.use(errorHandler)
+
+      const rejected = await request(registration)
+        .post('/register')
+        .send({ redirect_uris: ['https://app.example.com/callback'], grant_types: ['client_credentials'], scope: 'read admin' })
+      expect(rejected.status).toBe(400)
+      expect(rejected.body.error).toBe('invalid_client_metadata')
+
+      // Without a registered scope every scope used to be grantable
+      const registered = await request(registration)
+        .post('/register')
+        .send({ redirect_uris: ['https://app.example.com/callback'], grant_types: ['client_credentials'] })
+      expect(registered.status).toBe(201)
+
+      const res = await clientCredentials(registered.body.client_id, registered.body.client_secret, 'admin')
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_scope')
+      expect(res.body.access_token).toBeUndefined()
+    })
+
+    test('should refuse scopes that imply admin through the hierarchy', async () => {
+      const originalHierarchy = config.scopeHierarchy
+      config.scopeHierarchy = { ops: ['admin'] }
+      try {
+        const res = await clientCredentials('test-client', 'test-secret', 'ops')
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_scope')
+      } finally {
+        config.scopeHierarchy = originalHierarchy
+      }
+    })
+
+    test('should issue admin tokens to allow-listed clients', async () => {
+      config.scopePolicy.adminClients = ['test-client']
+
+      const res = await clientCredentials('test-client', 'test-secret', 'admin')
+
+      expect(res.status).toBe(200)
+      expect(verifyToken(res.body.access_token).scope).toBe('admin')
+    })
+
+    test('should issue admin tokens to clients seeded with admin_access', async () => {
+      await addClient({ client_id: 'ops-console', client_secret: 'ops-secret', grant_types: ['client_credentials'], admin_access: true })
+
+      const res = await clientCredentials('ops-console', 'ops-secret', 'admin')
+
+      expect(res.status).toBe(200)
+    })
+  })
+
+  describe('POST /token - unsupported grant types', () => {
+    test('should reject unsupported grant_type', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'password',
+          client_id: 'test-client',
+          client_secret: 'test-secret'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('unsupported_grant_type')
+    })
+
+    test('should reject implicit grant', async () => {
+      const res = await request(app)
+        .post('/token')
+        .send({
+          grant_type: 'implicit',
+          client_id: 'test-client',
+          client_secret: 'test-secret'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('unsupported_grant_type')
+    })
+
+    test('should reject a grant type disabled by configuration', async () => {
+      const original = config.features.clientCredentialsGrant
+      config.features.clientCredentialsGrant = false
+      try {
+        const res = await request(app)
+          .post('/token')
+          .send({
+            grant_type: 'client_credentials',
+            client_id: 'test-client',
+            client_secret: 'test-secret'
+          })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('unsupported_grant_type')
+        expect(res.body.access_token).toBeUndefined()
+      } finally {
+        config.features.clientCredentialsGrant = original
+      }
+    })
+  })
+
+  describe('POST /token/session - session bridge', () => {
+    let sessionApp
+    let agent
+
+    beforeEach(async () => {
+      sessionApp = express()
+      sessionApp.use(express.json())
+      sessionApp.use(session({ secret: crypto.randomBytes(32).toString('hex'), resave: false, saveUninitialized: false }))
+      // Stands in for a login through the authorization endpoint
+      sessionApp.post('/sign-in', (req, res) => {
+        req.session.userId = 'user-1'
+        req.session.authTime = Date.now()
+        res.sendStatus(204)
+      })
+      sessionApp.use('/token', tokenCors, tokenRouter)
+      sessionApp.use(errorHandler)
+      agent = request.agent(sessionApp)
+
+      await addUser({ id: 'user-1', username: 'alice', email: 'alice@example.com', password: 'x' })
+      await addClient({
+        client_id: 'spa',
+        redirect_uris: ['https://app.example.com/callback'],
+        scope: 'read write',
+        skip_consent: true,
+        session_bridge: true,
+        allowed_cors_origins: ['https://app.example.com']
+      })
+      await agent.post('/sign-in')
+    })
+
+    const csrfToken = async () => (await agent.get('/token/session/csrf')).body.csrf_token
+
+    test('should issue tokens for the signed-in session', async () => {
+      const events = []
+      const subscription = subscribeEvents({ types: ['TOKEN_ISSUED'], write: (event) => events.push(event) })
+      try {
+        const res = await agent
+          .post('/token/session')
+          .set('X-CSRF-Token', await csrfToken())
+          .send({ client_id: 'spa', scope: 'openid read' })
+
+        expect(res.status).toBe(200)
+        expect(res.headers['cache-control']).toBe('no-store')
+        expect(res.body.scope).toBe('openid read')
+        expect(res.body.refresh_token).toBeUndefined()
+        const accessToken = verifyToken(res.body.access_token)
+        expect(accessToken.sub).toBe('user-1')
+        expect(accessToken.client_id).toBe('spa')
+        expect(jwt.decode(res.body.id_token)).toMatchObject({ sub: 'user-1', aud: 'spa', amr: ['pwd'] })
+        expect(events[0]).toMatchObject({ client_id: 'spa', grant_type: 'session', sub: 'user-1' })
+      } finally {
+        subscription.unsubscribe()
+      }
+    })
+
+    test('should default to the client scopes', async () => {
+      const res = await agent
+        .post('/token/session')
+        .send({ client_id: 'spa', _csrf: await csrfToken() })
+
+      expect(res.status).toBe(200)
+      expect(res.body.scope).toBe('read write')
+      expect(res.body.id_token).toBeUndefined()
+    })
+
+    test('should reject a request without the CSRF token', async () => {
+      await csrfToken()
+
+      const res = await agent
+        .post('/token/session')
+        .send({ client_id: 'spa', scope: 'read' })
+
+      expect(res.status).toBe(403)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.access_token).toBeUndefined()
+    })
+
+    test('should reject a client not allowed the bridge', async () => {
+      await updateClient('spa', { session_bridge: false })
+
+      const res = await agent
+        .post('/token/session')
+        .set('X-CSRF-Token', await csrfToken())
+        .send({ client_id: 'spa' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('unauthorized_client')
+    })
+
+    test('should reject scopes outside the client registration and offline access', async () => {
+      const token = await csrfToken()
+
+      for (const scope of ['admin', 'read offline_access']) {
+        const res = await agent
+          .post('/token/session')
+          .set('X-CSRF-Token', token)
+          .send({ client_id: 'spa', scope })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_scope')
+      }
+    })
+
+    test('should send CORS headers for the client named in the body', async () => {
+      const res = await agent
+        .post('/token/session')
+        .set('Origin', 'https://app.example.com')
+        .set('X-CSRF-Token', await csrfToken())
+        .send({ client_id: 'spa' })
+
+      expect(res.status).toBe(200)
+      expect(res.headers['access-control-allow-origin']).toBe('https://app.example.com')
+    })
+
+    test('should decide CORS by the body client_id, not the query', async () => {
+      await addClient({
+        client_id: 'other',
+        redirect_uris: ['https://other.example.com/callback'],
+        allowed_cors_origins: ['https://other.example.com']
+      })
+
+      const res = await agent
+        .post('/token/session')
+        .query({ client_id: 'other' })
+        .set('Origin', 'https://other.example.com')
+        .set('X-CSRF-Token', await csrfToken())
+        .send({ client_id: 'spa' })
+
+      expect(res.headers['access-control-allow-origin']).toBeUndefined()
+    })
+
+    test('should send CORS headers only to clients allowed the bridge', async () => {
+      await addClient({
+        client_id: 'other',
+        redirect_uris: ['https://other.example.com/callback'],
+        allowed_cors_origins: ['https://other.example.com']
+      })
+
+      const denied = await agent
+        .get('/token/session/csrf')
+        .query({ client_id: 'other' })
+        .set('Origin', 'https://other.example.com')
+      const allowed = await agent
+        .get('/token/session/csrf')
+        .query({ client_id: 'spa' })
+        .set('Origin', 'https://app.example.com')
+
+      expect(denied.headers['access-control-allow-origin']).toBeUndefined()
+      expect(allowed.headers['access-control-allow-origin']).toBe('https://app.example.com')
+    })
+
+    test('should require a signed-in user', async () => {
+      const anonymous = request.agent(sessionApp)
+      const token = (await anonymous.get('/token/session/csrf')).body.csrf_token
+
+      const res = await anonymous
+        .post('/token/session')
+        .set('X-CSRF-Token', token)
+        .send({ client_id: 'spa' })
+
+      expect(res.status).toBe(401)
+      expect(res.body.error).toBe('login_required')
+    })
+  })
+
+  describe('POST /token - body size limit', () => {
+    const original = { ...config.bodyLimits }
+    let limitedApp
+
+    beforeEach(() => {
+      config.bodyLimits.token = 4096
+      limitedApp = express()
+      limitedApp.use('/token', parseBody('token'), tokenRouter)
+      limitedApp.use(errorHandler)
+    })
+
+    afterEach(() => {
+      Object.assign(config.bodyLimits, original)
+    })
+
+    const clientCredentials = (authorizationDetails) => request(limitedApp)
+      .post('/token')
+      .type('form')
+      .send({
+        grant_type: 'client_credentials',
+        client_id: 'test-client',
+        client_secret: 'test-secret',
+        authorization_details: authorizationDetails
+      })
+
+    test('should refuse an oversized form body with 413', async () => {
+      const res = await clientCredentials(JSON.stringify([{ type: 'payment', note: 'x'.repeat(8192) }]))
+
+      expect(res.status).toBe(413)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.access_token).toBeUndefined()
+    })
+
+    test('should refuse an oversized JSON body with 413', async () => {
+      const res = await request(limitedApp)
+        .post('/token')
+        .send({ grant_type: 'client_credentials', client_id: 'test-client', client_secret: 'test-secret', scope: 'x'.repeat(8192) })
+
+      expect(res.status).toBe(413)
+    })
+
+    test('should accept a body within the limit', async () => {
+      const res = await request(limitedApp)
+        .post('/token')
+        .type('form')
+        .send({ grant_type: 'client_credentials', client_id: 'test-client', client_secret: 'test-secret', scope: 'read' })
+
+      expect(res.status).toBe(200)
     })
   })
 })
@@ -0,0 +1,176 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const request = require('supertest')
+const express = require('express')
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb } = require('../../src/db')
+const config = require('../../src/config')
+const { ensurePrivateKey, generateToken } = require('../../src/tokens')
+const { getCounterStore } = require('../../src/middleware/rateLimitStore')
+const userinfoRouter = require('../../src/routes/userinfo')
+const { errorHandler } = require('../../src/errors')
+
+describe('Userinfo Endpoint', () => {
+  let app
+  let testDir
+  let accessToken
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    await ensurePrivateKey(testDir)
+
+    app = express()
+    app.use(express.json())
+    app.use(express.urlencoded({ extended: true }))
+    app.use('/userinfo', userinfoRouter)
+    app.use(errorHandler)
+
+    accessToken = generateToken({
+      sub: 'user1',
+      client_id: 'test-client',
+      scope: 'openid profile',
+      token_type: 'access'
+    }, '1h')
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should return claims for a token in the Authorization header', async () => {
+    const res = await request(app)
+      .get('/userinfo')
+      .set('Authorization', `Bearer ${accessToken}`)
+
+    expect(res.status).toBe(200)
+    expect(res.body.sub).toBe('user1')
+    expect(res.body.preferred_username).toBe('testuser')
+  })
+
+  test('should mark the response as not cacheable', async () => {
+    const res = await request(app)
+      .get('/userinfo')
+      .set('Authorization', `Bearer ${accessToken}`)
+
+    expect(res.headers['cache-control']).toBe('no-store')
+    expect(res.headers.pragma).toBe('no-cache')
+  })
+
+  test('should accept the bearer scheme in any casing', async () => {
+    for (const scheme of ['bearer', 'BEARER']) {
+      const res = await request(app)
+        .get('/userinfo')
+        .set('Authorization', `${scheme} ${accessToken}`)
+
+      expect(res.status).toBe(200)
+      expect(res.body.sub).toBe('user1')
+    }
+  })
+
+  test('should accept POST with the token in the Authorization header', async () => {
+    const res = await request(app)
+      .post('/userinfo')
+      .set('Authorization', `Bearer ${accessToken}`)
+
+    expect(res.status).toBe(200)
+    expect(res.body.sub).toBe('user1')
+  })
+
+  test('should accept POST with the token in the form body', async () => {
+    const get = await request(app)
+      .get('/userinfo')
+      .set('Authorization', `Bearer ${accessToken}`)
+
+    const res = await request(app)
+      .post('/userinfo')
+      .type('form')
+      .send({ access_token: accessToken })
+
+    expect(res.status).toBe(200)
+    expect(res.body).toEqual(get.body)
+  })
+
+  test('should reject a token sent in both the header and the body', async () => {
+    const res = await request(app)
+      .post('/userinfo')
+      .set('Authorization', `Bearer ${accessToken}`)
+      .type('form')
+      .send({ access_token: accessToken })
+
+    expect(res.status).toBe(400)
+    expect(res.body.error).toBe('invalid_request')
+  })
+
+  test('should ignore access_token in a JSON body', async () => {
+    const res = await request(app)
+      .post('/userinfo')
+      .send({ access_token: accessToken })
+
+    expect(res.status).toBe(401)
+    expect(res.body.error).toBe('invalid_token')
+  })
+
+  test('should reject an invalid token in the body', async () => {
+    const res = await request(app)
+      .post('/userinfo')
+      .type('form')
+      .send({ access_token: 'invalid.token.here' })
+
+    expect(res.status).toBe(401)
+    expect(res.body.error).toBe('invalid_token')
+  })
+
+  describe('rate limiting', () => {
+    let original
+
+    beforeEach(() => {
+      original = config.rateLimit.userinfo
+      // Start every test with empty counters
+      getCounterStore().purgeExpired(Infinity)
+    })
+
+    afterEach(() => {
+      config.rateLimit.userinfo = original
+    })
+
+    test('should answer 429 with Retry-After once the limit is exceeded', async () => {
+      config.rateLimit.userinfo = 2
+
+      for (let i = 0; i < 2; i++) {
+        const res = await request(app).get('/userinfo').set('Authorization', `Bearer ${accessToken}`)
+        expect(res.status).toBe(200)
+      }
+      const res = await request(app).get('/userinfo').set('Authorization', `Bearer ${accessToken}`)
+
+      expect(res.status).toBe(429)
+      expect(res.body.error).toBe('too_many_requests')
+      expect(Number(res.headers['retry-after'])).toBeGreaterThan(0)
+    })
+
+    test('should count requests with invalid tokens against the IP', async () => {
+      config.rateLimit.userinfo = 2
+
+      for (let i = 0; i < 2; i++) {
+        const res = await request(app).get('/userinfo').set('Authorization', 'Bearer forged')
+        expect(res.status).toBe(401)
+      }
+      const res = await request(app).get('/userinfo').set('Authorization', `Bearer ${accessToken}`)
+
+      expect(res.status).toBe(429)
+    })
+
+    test('should not limit when set to 0', async () => {
+      config.rateLimit.userinfo = 0
+
+      for (let i = 0; i < 5; i++) {
+        const res = await request(app).get('/userinfo').set('Authorization', `Bearer ${accessToken}`)
+        expect(res.status).toBe(200)
+      }
+    })
+  })
+})
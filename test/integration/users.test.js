@@ -1,10 +1,16 @@
-/* global describe, expect, beforeAll, afterAll, it */
+/* global describe, expect, beforeAll, afterAll, beforeEach, afterEach, it, jest */
+/* eslint camelcase: "off" */
 const request = require('supertest')
+const jwt = require('jsonwebtoken')
 const path = require('path')
 const fs = require('fs').promises
 const { initDb } = require('../../src/db')
-const { ensurePrivateKey } = require('../../src/tokens')
+const { ensurePrivateKey, ensureClientKey, generateToken } = require('../../src/tokens')
 const { setPublicKey } = require('../../src/auth')
+const config = require('../../src/config')
+const { setChallengeVerifier } = require('../../src/challenge')
+const { setEmailVerificationSender } = require('../../src/users')
+const { subscribeEvents } = require('../../src/eventStream')
 
 const testDataDir = path.join(__dirname, '../test-data-users')
 
@@ -26,9 +32,9 @@ beforeAll(async () => {
   await ensurePrivateKey(testDataDir)
   await initDb(testDataDir)
 
-  // Set public key for auth
-  const { getPublicKeyPem } = require('../../src/tokens')
-  setPublicKey(getPublicKeyPem())
+  // Resolve verification keys per token, as the server does
+  const { verificationKeyFor } = require('../../src/tokens')
+  setPublicKey(verificationKeyFor)
 })
 
 afterAll(async () => {
@@ -299,4 +305,238 @@ describe('Users API', () => {
       }
     })
   })
+
+  describe('Bot challenge', () => {
+    const originalThreshold = config.challenge.loginAfterFailures
+
+    beforeAll(() => {
+      setChallengeVerifier(async ({ token }) => token === 'solved')
+    })
+
+    afterAll(() => {
+      setChallengeVerifier(null)
+    })
+
+    afterEach(() => {
+      config.challenge.loginAfterFailures = originalThreshold
+    })
+
+    it('should register with a solved challenge', async () => {
+      const res = await request(app)
+        .post('/users')
+        .send({
+          username: 'challengeuser',
+          email: 'challenge@example.com',
+          password: 'ValidPassword123',
+          challenge_token: 'solved'
+        })
+
+      expect(res.status).toBe(201)
+    })
+
+    it('should reject registration with a failed challenge', async () => {
+      const res = await request(app)
+        .post('/users')
+        .send({
+          username: 'botuser',
+          email: 'bot@example.com',
+          password: 'ValidPassword123',
+          challenge_token: 'guessed'
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    it('should reject registration without a challenge', async () => {
+      const res = await request(app)
+        .post('/users')
+        .send({
+          username: 'botuser',
+          email: 'bot@example.com',
+          password: 'ValidPassword123'
+        })
+
+      expect(res.status).toBe(400)
+    })
+
+    it('should ask for a challenge at login after repeated failures', async () => {
+      config.challenge.loginAfterFailures = 1
+      await request(app)
+        .post('/users/login')
+        .send({ username: 'challengeuser', password: 'WrongPassword' })
+
+      const withoutChallenge = await request(app)
+        .post('/users/login')
+        .send({ username: 'challengeuser', password: 'ValidPassword123' })
+      const withChallenge = await request(app)
+        .post('/users/login')
+        .send({ username: 'challengeuser', password: 'ValidPassword123', challenge_token: 'solved' })
+
+      expect(withoutChallenge.status).toBe(400)
+      expect(withoutChallenge.body.error_description).toBe('Challenge verification failed')
+      expect(withChallenge.status).toBe(200)
+    })
+  })
+
+  describe('Self-service profile', () => {
+    let profileToken
+    let sent
+    let events
+    let subscription
+
+    beforeAll(async () => {
+      await request(app)
+        .post('/users')
+        .send({ username: 'profileuser', email: 'profile@example.com', password: 'ValidPassword123' })
+      const loginRes = await request(app)
+        .post('/users/login')
+        .send({ username: 'profileuser', password: 'ValidPassword123' })
+      profileToken = loginRes.body.access_token
+    })
+
+    beforeEach(() => {
+      sent = []
+      events = []
+      setEmailVerificationSender(async (message) => { sent.push(message) })
+      subscription = subscribeEvents({ write: (event) => events.push(event) })
+    })
+
+    afterEach(() => {
+      setEmailVerificationSender(null)
+      subscription.unsubscribe()
+    })
+
+    it('should return the caller profile', async () => {
+      const res = await request(app)
+        .get('/users/me/profile')
+        .set('Authorization', `Bearer ${profileToken}`)
+
+      expect(res.status).toBe(200)
+      expect(res.body.username).toBe('profileuser')
+      expect(res.body.email).toBe('profile@example.com')
+      expect(res.body).not.toHaveProperty('password')
+    })
+
+    it('should accept a token signed with a client dedicated key', async () => {
+      const { sub } = jwt.decode(profileToken)
+      await ensureClientKey('profile-client-key')
+      const token = generateToken({ sub, client_id: 'profile-client', scope: 'user:read', token_type: 'access' }, '1h', 'profile-client-key')
+
+      const res = await request(app)
+        .get('/users/me/profile')
+        .set('Authorization', `Bearer ${token}`)
+
+      expect(res.status).toBe(200)
+      expect(res.body.username).toBe('profileuser')
+    })
+
+    it('should update name and locale', async () => {
+      const res = await request(app)
+        .patch('/users/me/profile')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ name: 'Profile User', locale: 'de-CH' })
+
+      expect(res.status).toBe(200)
+      expect(res.body.name).toBe('Profile User')
+      expect(res.body.locale).toBe('de-CH')
+      expect(sent).toHaveLength(0)
+      expect(events.find(e => e.type === 'PROFILE_UPDATED').fields).toEqual(['name', 'locale'])
+    })
+
+    it('should reject an invalid locale', async () => {
+      const res = await request(app)
+        .patch('/users/me/profile')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ locale: 'not a locale' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_request')
+    })
+
+    it('should require re-verification when the email changes', async () => {
+      const res = await request(app)
+        .patch('/users/me/profile')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ email: 'changed@example.com' })
+
+      expect(res.status).toBe(200)
+      expect(res.body.email).toBe('changed@example.com')
+      expect(res.body.email_verified).toBe(false)
+      expect(sent).toHaveLength(1)
+      expect(sent[0].email).toBe('changed@example.com')
+      expect(events.find(e => e.type === 'PROFILE_UPDATED').email_verification_sent).toBe(true)
+
+      const wrong = await request(app)
+        .post('/users/me/email/verify')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ token: 'guessed' })
+      expect(wrong.status).toBe(400)
+      expect(wrong.body.error).toBe('invalid_grant')
+
+      const verified = await request(app)
+        .post('/users/me/email/verify')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ token: sent[0].token })
+      expect(verified.status).toBe(200)
+      expect(verified.body.email_verified).toBe(true)
+
+      // The token is single-use
+      const again = await request(app)
+        .post('/users/me/email/verify')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ token: sent[0].token })
+      expect(again.status).toBe(400)
+    })
+
+    it('should not log the verification token without a sender', async () => {
+      setEmailVerificationSender(null)
+      const output = []
+      const log = jest.spyOn(console, 'log').mockImplementation((...args) => output.push(args.join(' ')))
+      const warn = jest.spyOn(console, 'warn').mockImplementation((...args) => output.push(args.join(' ')))
+      try {
+        const res = await request(app)
+          .patch('/users/me/profile')
+          .set('Authorization', `Bearer ${profileToken}`)
+          .send({ email: 'unsent@example.com' })
+
+        expect(res.status).toBe(200)
+        expect(res.body.email_verified).toBe(false)
+        expect(output.some(line => line.includes('no sender is installed'))).toBe(true)
+        // Tokens are 32 random bytes in base64url
+        expect(output.some(line => /[\w-]{43}/.test(line))).toBe(false)
+      } finally {
+        log.mockRestore()
+        warn.mockRestore()
+      }
+    })
+
+    it('should refuse to set roles', async () => {
+      const res = await request(app)
+        .patch('/users/me/profile')
+        .set('Authorization', `Bearer ${profileToken}`)
+        .send({ name: 'Admin', roles: ['admin'] })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error_description).toBe("Field 'roles' cannot be changed")
+      expect(events.find(e => e.type === 'PROFILE_UPDATE_REJECTED').fields).toEqual(['roles'])
+
+      // Nothing from the rejected request was applied
+      const profile = await request(app)
+        .get('/users/me/profile')
+        .set('Authorization', `Bearer ${profileToken}`)
+      expect(profile.body.name).not.toBe('Admin')
+    })
+
+    it('should refuse to change the subject or verification state', async () => {
+      for (const body of [{ id: 'user_other' }, { sub: 'user_other' }, { email_verified: true }]) {
+        const res = await request(app)
+          .patch('/users/me/profile')
+          .set('Authorization', `Bearer ${profileToken}`)
+          .send(body)
+
+        expect(res.status).toBe(400)
+      }
+    })
+  })
 })
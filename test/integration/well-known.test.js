@@ -2,15 +2,19 @@
 /* global describe, test, expect, beforeEach, afterEach */
 const request = require('supertest')
 const express = require('express')
+const http = require('http')
 const fs = require('fs')
 const path = require('path')
 const os = require('os')
-const { initDb } = require('../../src/db')
+const config = require('../../src/config')
+const { initDb, getClient } = require('../../src/db')
 const { ensurePrivateKey: ensureTokenKey } = require('../../src/tokens')
 const wellKnownRouter = require('../../src/routes/well-known')
 const jwksRouter = require('../../src/routes/jwks')
 const registerRouter = require('../../src/routes/register')
-const { errorHandler } = require('../../src/errors')
+const { setClientIdGenerator } = require('../../src/clients')
+const { errorHandler, notFoundHandler } = require('../../src/errors')
+const { parseBody } = require('../../src/middleware/bodyLimit')
 
 describe('Well-Known Routes', () => {
   let app
@@ -25,6 +29,7 @@ describe('Well-Known Routes', () => {
     app.use(express.json())
     app.use('/.well-known', wellKnownRouter)
     app.use('/.well-known', jwksRouter)
+    app.use('/.well-known', notFoundHandler)
     app.use(errorHandler)
   })
 
@@ -59,7 +64,7 @@ describe('Well-Known Routes', () => {
       const res = await request(app)
         .get('/.well-known/oauth-authorization-server')
 
-      expect(res.body.response_types_supported).toContain('code')
+      expect(res.body.response_types_supported).toEqual(['code'])
     })
 
     test('should include supported auth methods', async () => {
@@ -68,6 +73,7 @@ describe('Well-Known Routes', () => {
 
       expect(res.body.token_endpoint_auth_methods_supported).toContain('client_secret_basic')
       expect(res.body.token_endpoint_auth_methods_supported).toContain('client_secret_post')
+      expect(res.body.token_endpoint_auth_methods_supported).toContain('private_key_jwt')
     })
 
     test('should include registration endpoint', async () => {
@@ -77,6 +83,86 @@ describe('Well-Known Routes', () => {
       expect(res.body.registration_endpoint).toBeDefined()
       expect(res.body.registration_endpoint).toContain('/register')
     })
+
+    test('should return the RFC 8414 metadata fields', async () => {
+      const res = await request(app)
+        .get('/.well-known/oauth-authorization-server')
+
+      expect(res.body.issuer).toBe(config.issuer)
+      expect(res.body.authorization_endpoint).toBe(`${config.issuer}${config.endpoints.authorize}`)
+      expect(res.body.token_endpoint).toBe(`${config.issuer}${config.endpoints.token}`)
+      expect(res.body.jwks_uri).toBe(`${config.issuer}${config.endpoints.jwks}`)
+      expect(res.body.scopes_supported).toContain('openid')
+      expect(res.body.response_modes_supported).toEqual(['query', 'fragment', 'form_post'])
+      expect(res.body.authorization_response_iss_parameter_supported).toBe(true)
+      expect(res.body.token_endpoint_auth_signing_alg_values_supported).toEqual(['RS256', 'PS256', 'ES256'])
+      expect(res.body.code_challenge_methods_supported).toBeDefined()
+    })
+
+    test('should leave out the OpenID Connect fields', async () => {
+      const res = await request(app)
+        .get('/.well-known/oauth-authorization-server')
+
+      expect(res.body).not.toHaveProperty('userinfo_endpoint')
+      expect(res.body).not.toHaveProperty('id_token_signing_alg_values_supported')
+      expect(res.body).not.toHaveProperty('subject_types_supported')
+    })
+
+    test('should agree with the OIDC discovery document', async () => {
+      const oauth = await request(app).get('/.well-known/oauth-authorization-server')
+      const oidc = await request(app).get('/.well-known/openid-configuration')
+
+      for (const [field, value] of Object.entries(oauth.body)) {
+        expect(oidc.body[field]).toEqual(value)
+      }
+      expect(oidc.body.userinfo_endpoint).toBeDefined()
+    })
+
+    test('should follow the refresh token feature flag', async () => {
+      const original = config.features.refreshTokens
+      config.features.refreshTokens = false
+      try {
+        const res = await request(app)
+          .get('/.well-known/oauth-authorization-server')
+
+        expect(res.body.grant_types_supported).not.toContain('refresh_token')
+      } finally {
+        config.features.refreshTokens = original
+      }
+    })
+
+    test('should leave out disabled grant types', async () => {
+      const original = config.features.deviceCodeGrant
+      config.features.deviceCodeGrant = false
+      try {
+        const res = await request(app)
+          .get('/.well-known/openid-configuration')
+
+        expect(res.body.grant_types_supported).toContain('authorization_code')
+        expect(res.body.grant_types_supported).not.toContain('urn:ietf:params:oauth:grant-type:device_code')
+        expect(res.body).not.toHaveProperty('device_authorization_endpoint')
+      } finally {
+        config.features.deviceCodeGrant = original
+      }
+    })
+  })
+
+  describe('unknown well-known paths', () => {
+    test('should return a JSON 404', async () => {
+      const res = await request(app)
+        .get('/.well-known/webfinger')
+
+      expect(res.status).toBe(404)
+      expect(res.headers['content-type']).toMatch(/json/)
+      expect(res.body.error).toBe('not_found')
+    })
+
+    test('should still serve the known documents', async () => {
+      const res = await request(app)
+        .get('/.well-known/jwks.json')
+
+      expect(res.status).toBe(200)
+    })
   })
 
   describe('GET /.well-known/jwks.json', () => {
@@ -104,6 +190,41 @@ describe('Well-Known Routes', () => {
       expect(jwk).toHaveProperty('e')
     })
   })
+
+  describe('caching headers', () => {
+    const original = { ...config.caching }
+
+    afterEach(() => {
+      Object.assign(config.caching, original)
+    })
+
+    test.each([
+      '/.well-known/openid-configuration',
+      '/.well-known/oauth-authorization-server'
+    ])('should let clients cache %s', async (url) => {
+      config.caching.discoveryMaxAge = 3600
+
+      const res = await request(app).get(url)
+
+      expect(res.headers['cache-control']).toBe('public, max-age=3600')
+    })
+
+    test('should let clients cache the JWKS for its own max age', async () => {
+      config.caching.jwksMaxAge = 300
+
+      const res = await request(app).get('/.well-known/jwks.json')
+
+      expect(res.headers['cache-control']).toBe('public, max-age=300')
+    })
+
+    test('should ask for revalidation when the max age is 0', async () => {
+      config.caching.jwksMaxAge = 0
+
+      const res = await request(app).get('/.well-known/jwks.json')
+
+      expect(res.headers['cache-control']).toBe('no-cache')
+    })
+  })
 })
 
 describe('Client Registration Route', () => {
@@ -127,6 +248,14 @@ describe('Client Registration Route', () => {
   })
 
   describe('POST /register', () => {
+    test('should mark registration responses as not cacheable', async () => {
+      const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'] })
+
+      expect(res.status).toBe(201)
+      expect(res.headers['cache-control']).toBe('no-store')
+      expect(res.headers.pragma).toBe('no-cache')
+    })
+
     test('should register new client with redirect_uris', async () => {
       const res = await request(app)
         .post('/register')
@@ -153,6 +282,49 @@ describe('Client Registration Route', () => {
       expect(res1.body.client_secret).not.toBe(res2.body.client_secret)
     })
 
+    test('should register post_logout_redirect_uris', async () => {
+      const res = await request(app)
+        .post('/register')
+        .send({
+          redirect_uris: ['https://app.example.com/callback'],
+          post_logout_redirect_uris: ['https://app.example.com/signed-out']
+        })
+
+      expect(res.status).toBe(201)
+      expect(res.body.post_logout_redirect_uris).toEqual(['https://app.example.com/signed-out'])
+    })
+
+    test('should reject post_logout_redirect_uris with a fragment', async () => {
+      const res = await request(app)
+        .post('/register')
+        .send({
+          redirect_uris: ['https://app.example.com/callback'],
+          post_logout_redirect_uris: ['https://app.example.com/signed-out#done']
+        })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+
+    test('should reject grant types disabled on the server', async () => {
+      const original = config.features.clientCredentialsGrant
+      config.features.clientCredentialsGrant = false
+      try {
+        const res = await request(app)
+          .post('/register')
+          .send({
+            redirect_uris: ['https://app.example.com/callback'],
+            grant_types: ['authorization_code', 'client_credentials']
+          })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_client_metadata')
+        expect(res.body.error_description).toBe('The client_credentials grant is disabled on this server')
+      } finally {
+        config.features.clientCredentialsGrant = original
+      }
+    })
+
     test('should accept optional client_name', async () => {
       const res = await request(app)
         .post('/register')
@@ -223,4 +395,391 @@ describe('Client Registration Route', () => {
       expect(res.body.redirect_uris).toEqual(uris)
     })
   })
+
+  describe('POST /register - client_id generator', () => {
+    afterEach(() => setClientIdGenerator(null))
+
+    test('should format the client_id with the installed generator', async () => {
+      setClientIdGenerator(({ random }) => `staging-${random}`)
+
+      const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'] })
+
+      expect(res.status).toBe(201)
+      expect(res.body.client_id).toMatch(/^staging-[0-9a-f]{32}$/)
+      expect(await getClient(res.body.client_id)).toBeTruthy()
+    })
+
+    test('should fail registration when the generator output is unusable', async () => {
+      setClientIdGenerator(() => 'staging-client')
+
+      const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'] })
+
+      expect(res.status).toBe(500)
+    })
+  })
+
+  describe('POST /register - uniqueness policies', () => {
+    const register = (body) => request(app).post('/register').send(body)
+
+    afterEach(() => {
+      config.registration.uniqueClientNames = false
+      config.registration.redirectUriCollisionPolicy = 'allow'
+    })
+
+    test('should allow duplicate names and redirect URIs by default', async () => {
+      const body = { client_name: 'Shared App', redirect_uris: ['https://app.example.com/callback'] }
+
+      expect((await register(body)).status).toBe(201)
+      expect((await register(body)).status).toBe(201)
+    })
+
+    test('should reject a duplicate client_name when names must be unique', async () => {
+      config.registration.uniqueClientNames = true
+      await register({ client_name: 'Payroll', redirect_uris: ['https://payroll.example.com/callback'] })
+
+      const res = await register({ client_name: ' payroll ', redirect_uris: ['https://other.example.com/callback'] })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+      expect(res.body.error_description).toContain('already registered')
+    })
+
+    test('should reject an overlapping redirect URI under the reject policy', async () => {
+      config.registration.redirectUriCollisionPolicy = 'reject'
+      await register({ redirect_uris: ['https://app.example.com/callback'] })
+
+      const res = await register({ redirect_uris: ['https://APP.example.com/callback/?next=/admin'] })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+      expect(res.body.error_description).toContain('https://APP.example.com/callback/?next=/admin')
+
+      const distinct = await register({ redirect_uris: ['https://app.example.com/other-callback'] })
+      expect(distinct.status).toBe(201)
+    })
+
+    test('should register an overlapping redirect URI under the warn policy', async () => {
+      config.registration.redirectUriCollisionPolicy = 'warn'
+      await register({ redirect_uris: ['https://app.example.com/callback'] })
+
+      const res = await register({ redirect_uris: ['https://app.example.com/callback'] })
+
+      expect(res.status).toBe(201)
+    })
+  })
+
+  describe('POST /register - id_token_signed_response_alg', () => {
+    const register = (body) => request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], ...body })
+    let original
+
+    beforeEach(() => {
+      original = { ...config.signingKeys }
+    })
+
+    afterEach(() => {
+      Object.assign(config.signingKeys, original)
+    })
+
+    test('should default to RS256', async () => {
+      await ensureTokenKey(testDir)
+
+      const res = await register({})
+
+      expect(res.status).toBe(201)
+      expect(res.body.id_token_signed_response_alg).toBe('RS256')
+    })
+
+    test('should reject ES256 when no EC signing key is configured', async () => {
+      await ensureTokenKey(testDir)
+
+      const res = await register({ id_token_signed_response_alg: 'ES256' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+
+    test('should accept ES256 when an EC signing key is configured', async () => {
+      config.signingKeys.ecKey = 'ec-key'
+      await ensureTokenKey(testDir)
+
+      const res = await register({ id_token_signed_response_alg: 'ES256' })
+
+      expect(res.status).toBe(201)
+      expect(res.body.id_token_signed_response_alg).toBe('ES256')
+    })
+
+    test('should reject none and unknown algorithms', async () => {
+      await ensureTokenKey(testDir)
+
+      for (const alg of ['none', 'HS256', 'PS512']) {
+        const res = await register({ id_token_signed_response_alg: alg })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error_description).toBe('id_token_signed_response_alg must be one of: RS256')
+      }
+    })
+
+    test('should reject signed userinfo and request object algorithms', async () => {
+      await ensureTokenKey(testDir)
+
+      const userinfo = await register({ userinfo_signed_response_alg: 'RS256' })
+      const requestObject = await register({ request_object_signing_alg: 'RS256' })
+
+      expect(userinfo.status).toBe(400)
+      expect(userinfo.body.error).toBe('invalid_client_metadata')
+      expect(userinfo.body.error_description).toBe('userinfo_signed_response_alg is not supported')
+      expect(requestObject.status).toBe(400)
+      expect(requestObject.body.error_description).toBe('request_object_signing_alg is not supported')
+    })
+
+    test('should list the registrable algorithms in discovery', async () => {
+      config.signingKeys.ecKey = 'ec-key'
+      await ensureTokenKey(testDir)
+      const discoveryApp = express()
+      discoveryApp.use('/.well-known', wellKnownRouter)
+
+      const discovery = await request(discoveryApp).get('/.well-known/openid-configuration')
+      const registered = await register({ id_token_signed_response_alg: 'ES256' })
+
+      expect(discovery.body.id_token_signing_alg_values_supported).toEqual(['RS256', 'ES256'])
+      expect(registered.status).toBe(201)
+    })
+  })
+
+  describe('POST /register - id_token_lifetime', () => {
+    const register = (body) => request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], ...body })
+
+    test('should store the id_token lifetime', async () => {
+      const res = await register({ id_token_lifetime: 600 })
+
+      expect(res.status).toBe(201)
+      expect(res.body.id_token_lifetime).toBe(600)
+    })
+
+    test('should leave it unset by default', async () => {
+      const res = await register({})
+
+      expect(res.body.id_token_lifetime).toBeNull()
+    })
+
+    test.each([0, 30, 86401, 1.5, '600'])('should reject id_token_lifetime %p', async (lifetime) => {
+      const res = await register({ id_token_lifetime: lifetime })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+  })
+
+  describe('POST /register - dedicated_signing_key', () => {
+    const register = (body) => request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], ...body })
+
+    test('should assign a signing key ID derived from the client_id', async () => {
+      const res = await register({ dedicated_signing_key: true })
+
+      expect(res.status).toBe(201)
+      expect(res.body.signing_key_id).toBe(`client-${res.body.client_id}`)
+    })
+
+    test('should use the server key by default', async () => {
+      const res = await register({})
+
+      expect(res.body.signing_key_id).toBeNull()
+    })
+
+    test('should reject a non-boolean value', async () => {
+      const res = await register({ dedicated_signing_key: 'tenant-a' })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+  })
+
+  describe('POST /register - skip_consent', () => {
+    test('should not let a client mark itself trusted', async () => {
+      const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], skip_consent: true })
+
+      expect(res.status).toBe(201)
+      expect(res.body.skip_consent).toBeUndefined()
+      expect((await getClient(res.body.client_id)).skip_consent).toBeUndefined()
+    })
+  })
+
+  describe('POST /register - implicit flow', () => {
+    test('should reject implicit and hybrid response types', async () => {
+      for (const responseTypes of [['token'], ['code', 'id_token'], ['code id_token']]) {
+        const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], response_types: responseTypes })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error).toBe('invalid_client_metadata')
+      }
+    })
+
+    test('should reject the implicit grant', async () => {
+      const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], grant_types: ['implicit'] })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error_description).toBe('The implicit grant is not supported; use authorization_code')
+    })
+
+    test('should register a code flow client', async () => {
+      const res = await request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], response_types: ['code'] })
+
+      expect(res.status).toBe(201)
+      expect(res.body.response_types).toEqual(['code'])
+    })
+  })
+
+  describe('POST /register - jwks_uri and jwks', () => {
+    const register = (body) => request(app).post('/register').send({ redirect_uris: ['https://app.example.com/callback'], ...body })
+
+    test('should store jwks_uri', async () => {
+      const res = await register({ jwks_uri: 'https://app.example.com/jwks.json' })
+
+      expect(res.status).toBe(201)
+      expect(res.body.jwks_uri).toBe('https://app.example.com/jwks.json')
+    })
+
+    test('should reject both jwks_uri and jwks', async () => {
+      const res = await register({ jwks_uri: 'https://app.example.com/jwks.json', jwks: { keys: [] } })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+
+    test.each([
+      { jwks_uri: 'not a url' },
+      { jwks_uri: 'ftp://app.example.com/jwks.json' },
+      { jwks: { keys: 'none' } }
+    ])('should reject invalid key metadata %j', async (metadata) => {
+      const res = await register(metadata)
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+  })
+
+  describe('POST /register - pairwise subjects', () => {
+    const redirectUris = ['https://app.example.com/callback', 'https://m.example.com/callback']
+    let server
+    let sectorUri
+
+    beforeEach(async () => {
+      config.claims.pairwiseSecret = 'test-pairwise-secret'
+      // The test server is plain http on loopback
+      config.registration.allowPrivateSectorUris = true
+      server = http.createServer((req, res) => {
+        if (req.url === '/missing.json') {
+          res.writeHead(404)
+          return res.end()
+        }
+        res.writeHead(200, { 'Content-Type': 'application/json' })
+        res.end(JSON.stringify(req.url === '/large.json' ? Array(5000).fill(redirectUris[0]) : redirectUris))
+      })
+      await new Promise(resolve => server.listen(0, '127.0.0.1', resolve))
+      sectorUri = `http://127.0.0.1:${server.address().port}/sector.json`
+    })
+
+    afterEach(async () => {
+      config.claims.pairwiseSecret = ''
+      config.registration.allowPrivateSectorUris = false
+      await new Promise(resolve => server.close(resolve))
+    })
+
+    const register = (body) => request(app).post('/register').send({ subject_type: 'pairwise', ...body })
+
+    test('should register redirect hosts covered by the sector_identifier_uri', async () => {
+      const res = await register({ redirect_uris: redirectUris, sector_identifier_uri: sectorUri })
+
+      expect(res.status).toBe(201)
+      expect(res.body.subject_type).toBe('pairwise')
+      expect(res.body.sector_identifier_uri).toBe(sectorUri)
+      expect((await getClient(res.body.client_id)).sector_identifier).toBe(new URL(sectorUri).host)
+    })
+
+    test('should reject a redirect URI the sector_identifier_uri does not list', async () => {
+      const res = await register({ redirect_uris: [...redirectUris, 'https://evil.example.com/callback'], sector_identifier_uri: sectorUri })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+      expect(res.body.error_description).toBe('redirect_uri https://evil.example.com/callback is not listed at the sector_identifier_uri')
+    })
+
+    test('should refuse http and private sector_identifier_uri hosts', async () => {
+      config.registration.allowPrivateSectorUris = false
+
+      const insecure = await register({ redirect_uris: redirectUris, sector_identifier_uri: sectorUri })
+      const loopback = await register({ redirect_uris: redirectUris, sector_identifier_uri: 'https://127.0.0.1/sector.json' })
+
+      expect(insecure.status).toBe(400)
+      expect(insecure.body.error_description).toBe('sector_identifier_uri must be an https URL')
+      expect(loopback.status).toBe(400)
+      expect(loopback.body.error_description).toBe('sector_identifier_uri must be on a public host')
+    })
+
+    test('should not reveal how the sector_identifier_uri fetch failed', async () => {
+      for (const file of ['missing.json', 'large.json']) {
+        const res = await register({ redirect_uris: redirectUris, sector_identifier_uri: sectorUri.replace('sector.json', file) })
+
+        expect(res.status).toBe(400)
+        expect(res.body.error_description).toBe('sector_identifier_uri could not be retrieved')
+      }
+    })
+
+    test('should require a sector_identifier_uri for several redirect hosts', async () => {
+      const res = await register({ redirect_uris: redirectUris })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error).toBe('invalid_client_metadata')
+    })
+
+    test('should use the redirect host as the sector of a single-host client', async () => {
+      const res = await register({ redirect_uris: ['https://app.example.com/callback'] })
+
+      expect(res.status).toBe(201)
+      expect((await getClient(res.body.client_id)).sector_identifier).toBe('app.example.com')
+    })
+
+    test('should refuse pairwise clients without a pairwise secret', async () => {
+      config.claims.pairwiseSecret = ''
+
+      const res = await register({ redirect_uris: ['https://app.example.com/callback'] })
+
+      expect(res.status).toBe(400)
+      expect(res.body.error_description).toBe('Pairwise subject identifiers are not enabled on this server')
+    })
+  })
+
+  describe('POST /register - body size limit', () => {
+    const original = { ...config.bodyLimits }
+    let limitedApp
+
+    beforeEach(() => {
+      config.bodyLimits.registration = 2048
+      limitedApp = express()
+      limitedApp.use('/register', parseBody('registration'), registerRouter)
+      limitedApp.use(errorHandler)
+    })
+
+    afterEach(() => {
+      Object.assign(config.bodyLimits, original)
+    })
+
+    test('should refuse an oversized body with 413 before registering', async () => {
+      const res = await request(limitedApp)
+        .post('/register')
+        .send({ redirect_uris: ['https://app.example.com/callback'], client_name: 'x'.repeat(4096) })
+
+      expect(res.status).toBe(413)
+      expect(res.body.error).toBe('invalid_request')
+      expect(res.body.error_description).toBe('Request body is too large')
+    })
+
+    test('should accept a body within the limit', async () => {
+      const res = await request(limitedApp)
+        .post('/register')
+        .send({ redirect_uris: ['https://app.example.com/callback'], client_name: 'x'.repeat(1024) })
+
+      expect(res.status).toBe(201)
+    })
+  })
 })
@@ -0,0 +1,62 @@
+/* global describe, test, expect */
+const { acrForAmr, requestedAcr, missingFactors, generateTotp, verifyTotp } = require('../../src/acr')
+
+describe('Authentication context', () => {
+  const MFA = 'urn:ngauth:acr:mfa'
+  const PWD = 'urn:ngauth:acr:pwd'
+  // RFC 6238 Appendix B SHA-1 seed "12345678901234567890"
+  const SECRET = 'GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ'
+
+  describe('acrForAmr', () => {
+    test('should return the strongest context the methods satisfy', () => {
+      expect(acrForAmr(['pwd'])).toBe(PWD)
+      expect(acrForAmr(['pwd', 'otp'])).toBe(MFA)
+      expect(acrForAmr([])).toBeNull()
+    })
+  })
+
+  describe('requestedAcr', () => {
+    test('should pick the first supported value', () => {
+      expect(requestedAcr(`urn:other ${MFA} ${PWD}`).acr).toBe(MFA)
+      expect(requestedAcr('urn:other')).toBeNull()
+      expect(requestedAcr(undefined)).toBeNull()
+    })
+  })
+
+  describe('missingFactors', () => {
+    const enrolled = { totpSecret: SECRET }
+
+    test('should ask a password session for otp when mfa is requested', () => {
+      expect(missingFactors(['pwd'], MFA, enrolled)).toEqual(['otp'])
+    })
+
+    test('should ask for nothing when the session already satisfies the request', () => {
+      expect(missingFactors(['pwd', 'otp'], MFA, enrolled)).toEqual([])
+      expect(missingFactors(['pwd'], PWD, enrolled)).toEqual([])
+      expect(missingFactors(['pwd'], undefined, enrolled)).toEqual([])
+    })
+
+    test('should not ask users without a second factor enrolled', () => {
+      expect(missingFactors(['pwd'], MFA, {})).toEqual([])
+    })
+  })
+
+  describe('TOTP', () => {
+    test('should match the RFC 6238 test vectors', () => {
+      expect(generateTotp(SECRET, 59 * 1000)).toBe('287082')
+      expect(generateTotp(SECRET, 1111111109 * 1000)).toBe('081804')
+      expect(generateTotp(SECRET, 2000000000 * 1000)).toBe('279037')
+    })
+
+    test('should accept the current code and one step of drift', () => {
+      expect(verifyTotp(SECRET, generateTotp(SECRET))).toBe(true)
+      expect(verifyTotp(SECRET, generateTotp(SECRET, Date.now() - 30 * 1000))).toBe(true)
+    })
+
+    test('should reject stale and malformed codes', () => {
+      expect(verifyTotp(SECRET, generateTotp(SECRET, Date.now() - 120 * 1000))).toBe(false)
+      expect(verifyTotp(SECRET, '12345')).toBe(false)
+      expect(verifyTotp(SECRET, undefined)).toBe(false)
+    })
+  })
+})
@@ -0,0 +1,78 @@
+/* global describe, test, expect, afterEach */
+const config = require('../../src/config')
+const { resolveAudience, serializeAudience, isAudienceOf } = require('../../src/audience')
+
+describe('Access token audience', () => {
+  const originalDefault = config.tokens.defaultAudience
+
+  afterEach(() => {
+    config.tokens.defaultAudience = originalDefault
+  })
+
+  describe('resolveAudience', () => {
+    test('should prefer resource indicators', () => {
+      const client = { default_audience: 'https://client-default.example.com' }
+      expect(resolveAudience(['https://a.example.com', 'https://b.example.com'], client))
+        .toEqual(['https://a.example.com', 'https://b.example.com'])
+    })
+
+    test('should deduplicate resource indicators', () => {
+      expect(resolveAudience(['https://a.example.com', 'https://a.example.com'], {})).toEqual(['https://a.example.com'])
+    })
+
+    test('should fall back to the client default audience', () => {
+      expect(resolveAudience(undefined, { default_audience: ['https://api.example.com'] })).toEqual(['https://api.example.com'])
+    })
+
+    test('should fall back to the configured default audience', () => {
+      config.tokens.defaultAudience = ['https://default.example.com']
+      expect(resolveAudience(undefined, {})).toEqual(['https://default.example.com'])
+    })
+
+    test('should return no audience when nothing is configured', () => {
+      config.tokens.defaultAudience = []
+      expect(resolveAudience(undefined, {})).toEqual([])
+    })
+
+    test('should reject relative or fragment resource indicators', () => {
+      expect(() => resolveAudience('api', {})).toThrow('Invalid resource indicator')
+      expect(() => resolveAudience('https://api.example.com#frag', {})).toThrow('Invalid resource indicator')
+    })
+  })
+
+  describe('serializeAudience', () => {
+    test('should serialize a single audience as a string', () => {
+      expect(serializeAudience(['https://api.example.com'])).toBe('https://api.example.com')
+    })
+
+    test('should serialize multiple audiences as an array', () => {
+      expect(serializeAudience(['https://a.example.com', 'https://b.example.com']))
+        .toEqual(['https://a.example.com', 'https://b.example.com'])
+    })
+
+    test('should omit an empty audience', () => {
+      expect(serializeAudience([])).toBeUndefined()
+    })
+  })
+
+  describe('isAudienceOf', () => {
+    const client = { client_id: 'orders-api', resource_identifiers: ['https://orders.example.com'] }
+
+    test('should match the client_id', () => {
+      expect(isAudienceOf('orders-api', client)).toBe(true)
+    })
+
+    test('should match a registered resource identifier in an audience list', () => {
+      expect(isAudienceOf(['https://billing.example.com', 'https://orders.example.com'], client)).toBe(true)
+    })
+
+    test('should not match other audiences', () => {
+      expect(isAudienceOf('https://billing.example.com', client)).toBe(false)
+    })
+
+    test('should not match a token without an audience', () => {
+      expect(isAudienceOf(undefined, client)).toBe(false)
+      expect(isAudienceOf(undefined, { client_id: 'legacy' })).toBe(false)
+    })
+  })
+})
@@ -0,0 +1,104 @@
+/* global describe, test, expect, afterEach */
+const config = require('../../src/config')
+const {
+  setChallengeVerifier,
+  challengeEnabled,
+  verifyChallenge,
+  loginNeedsChallenge,
+  challengeWidget
+} = require('../../src/challenge')
+
+describe('Bot challenges', () => {
+  const original = { ...config.challenge }
+
+  afterEach(() => {
+    setChallengeVerifier(null)
+    Object.assign(config.challenge, original)
+  })
+
+  const requestWith = (body) => ({ body, headers: {}, socket: { remoteAddress: '203.0.113.7' } })
+
+  describe('verifyChallenge', () => {
+    test('should pass without asking when challenges are disabled', async () => {
+      expect(challengeEnabled()).toBe(false)
+      expect(await verifyChallenge(requestWith({}), 'register')).toBe(true)
+    })
+
+    test('should pass a token the verifier accepts', async () => {
+      const calls = []
+      setChallengeVerifier(async (args) => {
+        calls.push(args)
+        return args.token === 'solved'
+      })
+
+      expect(await verifyChallenge(requestWith({ challenge_token: 'solved' }), 'register')).toBe(true)
+      expect(calls).toEqual([{ token: 'solved', ip: '203.0.113.7', action: 'register' }])
+    })
+
+    test('should fail a token the verifier rejects', async () => {
+      setChallengeVerifier(async () => false)
+
+      expect(await verifyChallenge(requestWith({ challenge_token: 'bogus' }), 'register')).toBe(false)
+    })
+
+    test('should fail without calling the verifier when the token is missing', async () => {
+      let called = false
+      setChallengeVerifier(async () => { called = true; return true })
+
+      expect(await verifyChallenge(requestWith({}), 'login')).toBe(false)
+      expect(called).toBe(false)
+    })
+
+    test('should fail closed when the verifier throws', async () => {
+      setChallengeVerifier(async () => { throw new Error('provider unreachable') })
+
+      expect(await verifyChallenge(requestWith({ challenge_token: 'solved' }), 'login')).toBe(false)
+    })
+
+    test('should read the provider form field', async () => {
+      config.challenge.provider = 'turnstile'
+      setChallengeVerifier(async ({ token }) => token === 'solved')
+
+      expect(await verifyChallenge(requestWith({ 'cf-turnstile-response': 'solved' }), 'register')).toBe(true)
+    })
+  })
+
+  describe('loginNeedsChallenge', () => {
+    test('should ask once the failure threshold is reached', () => {
+      setChallengeVerifier(async () => true)
+      config.challenge.loginAfterFailures = 3
+
+      expect(loginNeedsChallenge({ failedLoginAttempts: 2 })).toBe(false)
+      expect(loginNeedsChallenge({ failedLoginAttempts: 3 })).toBe(true)
+      expect(loginNeedsChallenge(null)).toBe(false)
+    })
+
+    test('should never ask when the threshold is 0', () => {
+      setChallengeVerifier(async () => true)
+      config.challenge.loginAfterFailures = 0
+
+      expect(loginNeedsChallenge({ failedLoginAttempts: 10 })).toBe(false)
+    })
+
+    test('should never ask when challenges are disabled', () => {
+      config.challenge.loginAfterFailures = 3
+
+      expect(loginNeedsChallenge({ failedLoginAttempts: 10 })).toBe(false)
+    })
+  })
+
+  describe('challengeWidget', () => {
+    test('should render the provider widget with the site key', () => {
+      config.challenge.provider = 'hcaptcha'
+      config.challenge.siteKey = 'site-key-123'
+
+      const html = challengeWidget()
+      expect(html).toContain('class="h-captcha"')
+      expect(html).toContain('data-sitekey="site-key-123"')
+    })
+
+    test('should render nothing without a provider', () => {
+      expect(challengeWidget()).toBe('')
+    })
+  })
+})
@@ -0,0 +1,55 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const config = require('../../src/config')
+const { checkAssertionTimes } = require('../../src/clientAssertion')
+
+describe('Client assertion times', () => {
+  const original = { ...config.clientAssertions }
+  const now = 1700000000
+
+  beforeEach(() => {
+    Object.assign(config.clientAssertions, { leeway: 30, maxLifetime: 300 })
+  })
+
+  afterEach(() => {
+    Object.assign(config.clientAssertions, original)
+  })
+
+  test('should accept a current assertion', () => {
+    expect(() => checkAssertionTimes({ iat: now, exp: now + 60 }, now)).not.toThrow()
+  })
+
+  test('should tolerate clock drift within the leeway', () => {
+    expect(() => checkAssertionTimes({ iat: now + 30, nbf: now + 30, exp: now + 90 }, now)).not.toThrow()
+    expect(() => checkAssertionTimes({ iat: now - 90, exp: now - 30 }, now)).not.toThrow()
+  })
+
+  test('should reject an assertion too far in the future', () => {
+    expect(() => checkAssertionTimes({ iat: now + 31, exp: now + 91 }, now)).toThrow('Client assertion iat is in the future')
+    expect(() => checkAssertionTimes({ nbf: now + 31, exp: now + 91 }, now)).toThrow('Client assertion is not valid yet')
+  })
+
+  test('should reject an expired assertion', () => {
+    expect(() => checkAssertionTimes({ iat: now - 91, exp: now - 31 }, now)).toThrow('Client assertion has expired')
+  })
+
+  test('should reject an excessive lifetime', () => {
+    expect(() => checkAssertionTimes({ iat: now, exp: now + 301 }, now)).toThrow('must not be valid for more than 300 seconds')
+    expect(() => checkAssertionTimes({ exp: now + 3600 }, now)).toThrow('must not be valid for more than 300 seconds')
+  })
+
+  test('should require a numeric exp', () => {
+    expect(() => checkAssertionTimes({ iat: now }, now)).toThrow('must have an exp claim')
+    expect(() => checkAssertionTimes({ iat: String(now), exp: now + 60 }, now)).toThrow('iat must be a number')
+  })
+
+  test('should fail as invalid_client', () => {
+    let error
+    try {
+      checkAssertionTimes({ iat: now, exp: now + 3600 }, now)
+    } catch (err) {
+      error = err
+    }
+
+    expect(error.error).toBe('invalid_client')
+  })
+})
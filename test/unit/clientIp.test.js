@@ -0,0 +1,62 @@
+/* global describe, test, expect */
+const { getClientIp, buildTrustedProxyList } = require('../../src/middleware/clientIp')
+
+function mockRequest (remoteAddress, forwardedFor) {
+  return {
+    socket: { remoteAddress },
+    headers: forwardedFor ? { 'x-forwarded-for': forwardedFor } : {}
+  }
+}
+
+describe('Client IP Extraction', () => {
+  test('should use the socket address when no proxies are trusted', () => {
+    const req = mockRequest('203.0.113.7', '198.51.100.1')
+    expect(getClientIp(req, [])).toBe('203.0.113.7')
+  })
+
+  test('should normalize IPv4-mapped IPv6 addresses', () => {
+    const req = mockRequest('::ffff:203.0.113.7')
+    expect(getClientIp(req, [])).toBe('203.0.113.7')
+  })
+
+  test('should honour X-Forwarded-For from a single trusted proxy', () => {
+    const req = mockRequest('10.0.0.5', '198.51.100.23')
+    expect(getClientIp(req, ['10.0.0.0/8'])).toBe('198.51.100.23')
+  })
+
+  test('should walk a chain of trusted proxies', () => {
+    const req = mockRequest('10.0.0.5', '198.51.100.23, 192.168.1.10, 10.0.0.9')
+    expect(getClientIp(req, ['10.0.0.0/8', '192.168.1.10'])).toBe('198.51.100.23')
+  })
+
+  test('should stop at the first untrusted hop in the chain', () => {
+    // The client prepended a fake address; only the hop added by the trusted proxy counts
+    const req = mockRequest('10.0.0.5', '1.2.3.4, 198.51.100.23')
+    expect(getClientIp(req, ['10.0.0.0/8'])).toBe('198.51.100.23')
+  })
+
+  test('should ignore spoofed headers from an untrusted source', () => {
+    const req = mockRequest('203.0.113.7', '127.0.0.1')
+    expect(getClientIp(req, ['10.0.0.0/8'])).toBe('203.0.113.7')
+  })
+
+  test('should fall back to the socket address when header is missing', () => {
+    const req = mockRequest('10.0.0.5')
+    expect(getClientIp(req, ['10.0.0.0/8'])).toBe('10.0.0.5')
+  })
+
+  test('should support IPv6 proxy ranges', () => {
+    const req = mockRequest('fd00::1', '2001:db8::42')
+    expect(getClientIp(req, ['fd00::/8'])).toBe('2001:db8::42')
+  })
+
+  test('should reject invalid trusted proxy entries', () => {
+    expect(() => buildTrustedProxyList(['not-an-ip'])).toThrow('Invalid trusted proxy address')
+  })
+
+  test('should reject malformed prefixes', () => {
+    for (const entry of ['10.0.0.0/abc', '10.0.0.0/33', 'fd00::/129', '10.0.0.0/']) {
+      expect(() => buildTrustedProxyList([entry])).toThrow('Invalid trusted proxy prefix')
+    }
+  })
+})
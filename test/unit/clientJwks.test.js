@@ -0,0 +1,139 @@
+/* global describe, test, expect, beforeAll, afterAll */
+const http = require('http')
+const crypto = require('crypto')
+const config = require('../../src/config')
+const { checkClientJwks } = require('../../src/clientJwks')
+
+describe('Client JWKS diagnostics', () => {
+  const { publicKey, privateKey } = crypto.generateKeyPairSync('ec', { namedCurve: 'P-256' })
+  const signingKey = { ...publicKey.export({ format: 'jwk' }), kid: 'sig-1', use: 'sig', alg: 'ES256' }
+
+  // Local JWKS host: each path answers with its own document
+  const documents = {
+    '/valid': { status: 200, body: JSON.stringify({ keys: [signingKey] }) },
+    '/not-json': { status: 200, body: '<html>oops</html>' },
+    '/missing': { status: 404, body: 'not found' },
+    '/no-keys': { status: 200, body: JSON.stringify({ issuer: 'x' }) },
+    '/redirect': { status: 302, body: '', headers: { Location: '/valid' } },
+    '/large': { status: 200, body: JSON.stringify({ keys: [signingKey], padding: 'x'.repeat(70 * 1024) }) }
+  }
+  let server
+  let baseUrl
+
+  beforeAll(async () => {
+    config.registration.allowPrivateJwksUris = true
+    server = http.createServer((req, res) => {
+      const doc = documents[req.url] || documents['/missing']
+      res.writeHead(doc.status, { 'Content-Type': 'application/json', ...doc.headers })
+      res.end(doc.body)
+    })
+    await new Promise(resolve => server.listen(0, '127.0.0.1', resolve))
+    baseUrl = `http://127.0.0.1:${server.address().port}`
+  })
+
+  afterAll(() => {
+    config.registration.allowPrivateJwksUris = false
+    server.close()
+  })
+
+  const codes = (report) => report.problems.map(p => p.code)
+
+  test('should report a reachable JWKS with a signing key as healthy', async () => {
+    const report = await checkClientJwks({ client_id: 'c1', jwks_uri: `${baseUrl}/valid` })
+
+    expect(report.healthy).toBe(true)
+    expect(report.source).toBe('jwks_uri')
+    expect(report.problems).toEqual([])
+    expect(report.keys).toEqual([{ kid: 'sig-1', kty: 'EC', alg: 'ES256', use: 'sig', usable: true }])
+  })
+
+  test('should report an unreachable jwks_uri', async () => {
+    const closed = http.createServer()
+    await new Promise(resolve => closed.listen(0, '127.0.0.1', resolve))
+    const uri = `http://127.0.0.1:${closed.address().port}/jwks`
+    await new Promise(resolve => closed.close(resolve))
+
+    const report = await checkClientJwks({ client_id: 'c1', jwks_uri: uri })
+
+    expect(report.healthy).toBe(false)
+    expect(codes(report)).toEqual(['unreachable'])
+  })
+
+  test('should report an HTTP error without its details', async () => {
+    const report = await checkClientJwks({ client_id: 'c1', jwks_uri: `${baseUrl}/missing` })
+
+    expect(codes(report)).toEqual(['unreachable'])
+    expect(report.problems[0].message).toBe('The jwks_uri could not be retrieved')
+  })
+
+  test('should not follow redirects or read oversized documents', async () => {
+    for (const path of ['/redirect', '/large']) {
+      const report = await checkClientJwks({ client_id: 'c1', jwks_uri: `${baseUrl}${path}` })
+
+      expect(codes(report)).toEqual(['unreachable'])
+    }
+  })
+
+  test('should refuse http and private jwks_uri values without the development opt-out', async () => {
+    config.registration.allowPrivateJwksUris = false
+    try {
+      const insecure = await checkClientJwks({ client_id: 'c1', jwks_uri: `${baseUrl}/valid` })
+      const privateHost = await checkClientJwks({ client_id: 'c1', jwks_uri: 'https://10.0.0.1/jwks' })
+
+      expect(codes(insecure)).toEqual(['insecure_uri'])
+      expect(codes(privateHost)).toEqual(['private_host'])
+    } finally {
+      config.registration.allowPrivateJwksUris = true
+    }
+  })
+
+  test('should report a response that is not JSON', async () => {
+    const report = await checkClientJwks({ client_id: 'c1', jwks_uri: `${baseUrl}/not-json` })
+
+    expect(codes(report)).toEqual(['invalid_json'])
+  })
+
+  test('should report a document without keys', async () => {
+    const report = await checkClientJwks({ client_id: 'c1', jwks_uri: `${baseUrl}/no-keys` })
+
+    expect(codes(report)).toEqual(['invalid_jwks'])
+  })
+
+  test('should check inline jwks', async () => {
+    const report = await checkClientJwks({ client_id: 'c1', jwks: { keys: [signingKey] } })
+
+    expect(report.healthy).toBe(true)
+    expect(report.source).toBe('jwks')
+  })
+
+  test('should report a client without keys', async () => {
+    const report = await checkClientJwks({ client_id: 'c1' })
+
+    expect(codes(report)).toEqual(['no_jwks'])
+  })
+
+  test('should report published private keys', async () => {
+    const leaked = { ...privateKey.export({ format: 'jwk' }), kid: 'leaked' }
+
+    const report = await checkClientJwks({ client_id: 'c1', jwks: { keys: [leaked] } })
+
+    expect(codes(report)).toEqual(['private_key_published', 'no_signing_keys'])
+  })
+
+  test('should report a JWKS holding only encryption keys', async () => {
+    const report = await checkClientJwks({ client_id: 'c1', jwks: { keys: [{ ...signingKey, use: 'enc' }] } })
+
+    expect(report.keys[0].usable).toBe(false)
+    expect(codes(report)).toEqual(['no_signing_keys'])
+  })
+
+  test('should report broken keys and duplicate kids', async () => {
+    const report = await checkClientJwks({
+      client_id: 'c1',
+      jwks: { keys: [signingKey, { ...signingKey }, { kty: 'EC', kid: 'bad', crv: 'P-256', x: 'AA', y: 'AA' }, { kty: 'oct', k: 'c2VjcmV0' }] }
+    })
+
+    expect(report.healthy).toBe(false)
+    expect(codes(report)).toEqual(['duplicate_kid', 'invalid_key', 'unsupported_key_type'])
+  })
+})
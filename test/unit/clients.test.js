@@ -0,0 +1,214 @@
+/* global describe, test, expect, afterEach */
+const { isRedirectUriAllowed, isCorsOriginAllowed, isValidOrigin, matchClientSecret, rotateClientSecret, queryClients, findRedirectUriCollisions, setClientIdGenerator, generateClientId } = require('../../src/clients')
+
+describe('Client Helpers', () => {
+  describe('isRedirectUriAllowed', () => {
+    const client = (policy) => ({
+      redirect_uris: ['https://app.example.com/callback?tenant=acme'],
+      redirect_uri_matching: policy
+    })
+
+    test('should default to exact matching', () => {
+      expect(isRedirectUriAllowed(client(undefined), 'https://app.example.com/callback?tenant=acme')).toBe(true)
+      expect(isRedirectUriAllowed(client(undefined), 'https://app.example.com/callback')).toBe(false)
+    })
+
+    test('exact should reject an extra query parameter', () => {
+      expect(isRedirectUriAllowed(client('exact'), 'https://app.example.com/callback?tenant=acme&x=1')).toBe(false)
+    })
+
+    test('exact_ignoring_query should accept a deviating query string', () => {
+      expect(isRedirectUriAllowed(client('exact_ignoring_query'), 'https://app.example.com/callback?tenant=other')).toBe(true)
+      expect(isRedirectUriAllowed(client('exact_ignoring_query'), 'https://app.example.com/callback')).toBe(true)
+    })
+
+    test('exact_ignoring_query should reject a different host or path', () => {
+      expect(isRedirectUriAllowed(client('exact_ignoring_query'), 'https://evil.example.com/callback')).toBe(false)
+      expect(isRedirectUriAllowed(client('exact_ignoring_query'), 'https://app.example.com/other')).toBe(false)
+    })
+
+    test('exact_ignoring_query should reject fragments', () => {
+      expect(isRedirectUriAllowed(client('exact_ignoring_query'), 'https://app.example.com/callback#frag')).toBe(false)
+    })
+
+    test('should reject unknown policies', () => {
+      expect(isRedirectUriAllowed(client('prefix'), 'https://app.example.com/callback?tenant=acme')).toBe(false)
+    })
+  })
+
+  describe('isCorsOriginAllowed', () => {
+    const client = { allowed_cors_origins: ['https://spa.example.com'] }
+
+    test('should allow a registered origin', () => {
+      expect(isCorsOriginAllowed(client, 'https://spa.example.com')).toBe(true)
+    })
+
+    test('should reject an unregistered origin', () => {
+      expect(isCorsOriginAllowed(client, 'https://evil.example.com')).toBe(false)
+      expect(isCorsOriginAllowed({}, 'https://spa.example.com')).toBe(false)
+      expect(isCorsOriginAllowed(null, 'https://spa.example.com')).toBe(false)
+    })
+  })
+
+  describe('isValidOrigin', () => {
+    test('should accept scheme, host and port only', () => {
+      expect(isValidOrigin('https://spa.example.com')).toBe(true)
+      expect(isValidOrigin('http://localhost:3000')).toBe(true)
+    })
+
+    test('should reject paths, trailing slashes and other schemes', () => {
+      expect(isValidOrigin('https://spa.example.com/')).toBe(false)
+      expect(isValidOrigin('https://spa.example.com/app')).toBe(false)
+      expect(isValidOrigin('ftp://spa.example.com')).toBe(false)
+      expect(isValidOrigin('not a url')).toBe(false)
+    })
+  })
+
+  describe('client secret rotation', () => {
+    const client = { client_id: 'c1', client_secret: 'old-secret' }
+
+    test('should match the current secret', () => {
+      expect(matchClientSecret(client, 'old-secret')).toBe('primary')
+      expect(matchClientSecret(client, 'wrong')).toBeNull()
+      expect(matchClientSecret(null, 'old-secret')).toBeNull()
+    })
+
+    test('should not authenticate a disabled client', () => {
+      expect(matchClientSecret({ ...client, status: 'disabled' }, 'old-secret')).toBeNull()
+    })
+
+    test('should keep the previous secret valid during the grace period', () => {
+      const now = Date.now()
+      const rotated = { ...client, ...rotateClientSecret(client, 60, now) }
+
+      expect(matchClientSecret(rotated, rotated.client_secret, now)).toBe(rotated.client_secret_id)
+      expect(matchClientSecret(rotated, 'old-secret', now)).toBe('primary')
+      expect(matchClientSecret(rotated, 'old-secret', now + 61 * 1000)).toBeNull()
+    })
+
+    test('should drop the previous secret without a grace period', () => {
+      const rotated = { ...client, ...rotateClientSecret(client, 0) }
+
+      expect(rotated.previous_client_secret).toBeNull()
+      expect(matchClientSecret(rotated, 'old-secret')).toBeNull()
+    })
+  })
+
+  describe('queryClients', () => {
+    const clients = [
+      { client_id: 'c3', client_name: 'Billing API', client_secret: 's3', grant_types: ['client_credentials'], created_at: 3 },
+      { client_id: 'c1', client_name: 'Web App', client_secret: 's1', grant_types: ['authorization_code'], created_at: 1 },
+      { client_id: 'c2', client_name: 'billing worker', client_secret: 's2', created_at: 2, status: 'disabled' }
+    ]
+
+    test('should sort by creation time and paginate', () => {
+      const first = queryClients(clients, { limit: 2 })
+      expect(first.clients.map(c => c.client_id)).toEqual(['c1', 'c2'])
+      expect(first.total).toBe(3)
+      expect(first.nextOffset).toBe(2)
+
+      const last = queryClients(clients, { limit: 2, offset: 2 })
+      expect(last.clients.map(c => c.client_id)).toEqual(['c3'])
+      expect(last.nextOffset).toBeNull()
+    })
+
+    test('should filter by name, grant type and status', () => {
+      expect(queryClients(clients, { name: 'BILLING' }).clients.map(c => c.client_id)).toEqual(['c2', 'c3'])
+      expect(queryClients(clients, { grantType: 'authorization_code' }).total).toBe(2)
+      expect(queryClients(clients, { status: 'disabled' }).clients.map(c => c.client_id)).toEqual(['c2'])
+    })
+
+    test('should sort descending and reject unknown sort fields', () => {
+      expect(queryClients(clients, { sort: '-client_id' }).clients.map(c => c.client_id)).toEqual(['c3', 'c2', 'c1'])
+      expect(() => queryClients(clients, { sort: 'client_secret' })).toThrow('Cannot sort by')
+    })
+
+    test('should never return secrets', () => {
+      const withHistory = [{ ...clients[0], previous_client_secret: { id: 'primary', secret: 'old', expiresAt: 1 } }]
+      const [client] = queryClients(withHistory).clients
+
+      expect(client).not.toHaveProperty('client_secret')
+      expect(client).not.toHaveProperty('previous_client_secret')
+      expect(client.status).toBe('active')
+    })
+  })
+
+  describe('findRedirectUriCollisions', () => {
+    const clients = [{ client_id: 'c1', redirect_uris: ['https://app.example.com/callback?tenant=acme'] }]
+
+    test('should match URIs differing only in query, host case or trailing slash', () => {
+      expect(findRedirectUriCollisions(clients, ['https://App.Example.com/callback/'])).toEqual([
+        { redirect_uri: 'https://App.Example.com/callback/', client_id: 'c1' }
+      ])
+    })
+
+    test('should not match a different scheme, port or path', () => {
+      expect(findRedirectUriCollisions(clients, [
+        'http://app.example.com/callback',
+        'https://app.example.com:8443/callback',
+        'https://app.example.com/callback2'
+      ])).toEqual([])
+    })
+  })
+
+  describe('generateClientId', () => {
+    const metadata = { client_name: 'Billing', redirect_uris: ['https://billing.example.com/callback'] }
+    const never = async () => false
+
+    afterEach(() => setClientIdGenerator(null))
+
+    test('should default to 32 random hex characters', async () => {
+      const first = await generateClientId(metadata, never)
+      const second = await generateClientId(metadata, never)
+
+      expect(first).toMatch(/^[0-9a-f]{32}$/)
+      expect(second).not.toBe(first)
+    })
+
+    test('should use a custom generator', async () => {
+      const calls = []
+      setClientIdGenerator((input) => {
+        calls.push(input)
+        return `prod-acme-${input.random}`
+      })
+
+      const clientId = await generateClientId(metadata, never)
+
+      expect(clientId).toMatch(/^prod-acme-[0-9a-f]{32}$/)
+      expect(calls[0].client_name).toBe('Billing')
+      expect(calls[0].redirect_uris).toEqual(metadata.redirect_uris)
+    })
+
+    test('should retry when the generated ID is taken', async () => {
+      setClientIdGenerator(({ random }) => `prod-${random}`)
+      const taken = []
+      const isTaken = async (id) => {
+        if (taken.length < 2) {
+          taken.push(id)
+          return true
+        }
+        return false
+      }
+
+      const clientId = await generateClientId(metadata, isTaken)
+
+      expect(taken).toHaveLength(2)
+      expect(taken).not.toContain(clientId)
+      expect(clientId).toMatch(/^prod-[0-9a-f]{32}$/)
+    })
+
+    test('should give up when every ID collides', async () => {
+      setClientIdGenerator(({ random }) => `prod-${random}`)
+
+      await expect(generateClientId(metadata, async () => true)).rejects.toThrow('No unused client_id after 5 attempts')
+    })
+
+    test('should reject IDs without the random part or with unsafe characters', async () => {
+      setClientIdGenerator(() => 'prod-fixed-id')
+      await expect(generateClientId(metadata, never)).rejects.toThrow('must include the random part')
+
+      setClientIdGenerator(({ random }) => `prod:${random}`)
+      await expect(generateClientId(metadata, never)).rejects.toThrow('must return 1-255 characters')
+    })
+  })
+})
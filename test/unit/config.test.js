@@ -181,3 +181,100 @@ describe('Configuration Presets', () => {
     })
   })
 })
+
+describe('Code Entropy Settings', () => {
+  const CONFIG_PATH = require.resolve('../../src/config')
+  const VARIABLES = ['NGAUTH_AUTHORIZATION_CODE_BYTES', 'NGAUTH_DEVICE_CODE_BYTES', 'NGAUTH_REFRESH_TOKEN_BYTES', 'NGAUTH_USER_CODE_LENGTH', 'NGAUTH_REFRESH_TOKEN_PREFIX']
+
+  // Load a fresh configuration with the given environment
+  const loadWith = (env) => {
+    const saved = {}
+    for (const name of VARIABLES) {
+      saved[name] = process.env[name]
+      delete process.env[name]
+    }
+    Object.assign(process.env, env)
+    const cached = require.cache[CONFIG_PATH]
+    delete require.cache[CONFIG_PATH]
+    try {
+      return require('../../src/config')
+    } finally {
+      for (const name of VARIABLES) {
+        if (saved[name] === undefined) delete process.env[name]
+        else process.env[name] = saved[name]
+      }
+      require.cache[CONFIG_PATH] = cached
+    }
+  }
+
+  test('should default to 32 random bytes and 8-character user codes', () => {
+    expect(loadWith({}).codes).toEqual({
+      authorizationCodeBytes: 32,
+      deviceCodeBytes: 32,
+      refreshTokenBytes: 32,
+      refreshTokenPrefix: '',
+      userCodeLength: 8
+    })
+  })
+
+  test('should accept lengths at or above the floor', () => {
+    const { codes } = loadWith({ NGAUTH_AUTHORIZATION_CODE_BYTES: '16', NGAUTH_REFRESH_TOKEN_BYTES: '64', NGAUTH_USER_CODE_LENGTH: '12' })
+
+    expect(codes.authorizationCodeBytes).toBe(16)
+    expect(codes.refreshTokenBytes).toBe(64)
+    expect(codes.userCodeLength).toBe(12)
+  })
+
+  test('should reject lengths below the floor', () => {
+    expect(() => loadWith({ NGAUTH_AUTHORIZATION_CODE_BYTES: '15' })).toThrow('NGAUTH_AUTHORIZATION_CODE_BYTES must be an integer from 16 to 128')
+    expect(() => loadWith({ NGAUTH_DEVICE_CODE_BYTES: '8' })).toThrow('NGAUTH_DEVICE_CODE_BYTES must be an integer from 16 to 128')
+    expect(() => loadWith({ NGAUTH_REFRESH_TOKEN_BYTES: 'lots' })).toThrow('NGAUTH_REFRESH_TOKEN_BYTES must be an integer')
+    expect(() => loadWith({ NGAUTH_USER_CODE_LENGTH: '6' })).toThrow('NGAUTH_USER_CODE_LENGTH must be an integer from 8 to 20')
+  })
+
+  test('should accept a refresh token prefix of scanner-friendly characters', () => {
+    expect(loadWith({ NGAUTH_REFRESH_TOKEN_PREFIX: 'ngauth_rt_' }).codes.refreshTokenPrefix).toBe('ngauth_rt_')
+    expect(() => loadWith({ NGAUTH_REFRESH_TOKEN_PREFIX: 'ngauth-rt.' })).toThrow('NGAUTH_REFRESH_TOKEN_PREFIX must be at most 32 letters, digits or underscores')
+  })
+})
+
+describe('Body Size Limits', () => {
+  const CONFIG_PATH = require.resolve('../../src/config')
+  const VARIABLES = ['NGAUTH_BODY_LIMIT', 'NGAUTH_BODY_LIMIT_TOKEN', 'NGAUTH_BODY_LIMIT_REGISTRATION', 'NGAUTH_BODY_LIMIT_INTROSPECTION']
+
+  // Load a fresh configuration with the given environment
+  const loadWith = (env) => {
+    const saved = {}
+    for (const name of VARIABLES) {
+      saved[name] = process.env[name]
+      delete process.env[name]
+    }
+    Object.assign(process.env, env)
+    const cached = require.cache[CONFIG_PATH]
+    delete require.cache[CONFIG_PATH]
+    try {
+      return require('../../src/config')
+    } finally {
+      for (const name of VARIABLES) {
+        if (saved[name] === undefined) delete process.env[name]
+        else process.env[name] = saved[name]
+      }
+      require.cache[CONFIG_PATH] = cached
+    }
+  }
+
+  test('should default every endpoint class to 100kb', () => {
+    expect(loadWith({}).bodyLimits).toEqual({ default: 102400, token: 102400, registration: 102400, introspection: 102400 })
+  })
+
+  test('should let classes override the base limit', () => {
+    const { bodyLimits } = loadWith({ NGAUTH_BODY_LIMIT: '64kb', NGAUTH_BODY_LIMIT_TOKEN: '1mb', NGAUTH_BODY_LIMIT_INTROSPECTION: '4096' })
+
+    expect(bodyLimits).toEqual({ default: 65536, token: 1048576, registration: 65536, introspection: 4096 })
+  })
+
+  test('should reject sizes below 1kb or without a known unit', () => {
+    expect(() => loadWith({ NGAUTH_BODY_LIMIT: '512' })).toThrow("NGAUTH_BODY_LIMIT must be a size of at least 1kb (e.g. 100kb or 1mb), got '512'")
+    expect(() => loadWith({ NGAUTH_BODY_LIMIT_TOKEN: '1gb' })).toThrow('NGAUTH_BODY_LIMIT_TOKEN must be a size of at least 1kb')
+  })
+})
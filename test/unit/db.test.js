@@ -13,9 +13,15 @@ const {
   addCode,
   getCode,
   deleteCode,
-  cleanupExpiredCodes
+  cleanupExpiredCodes,
+  addRefreshToken,
+  getRefreshToken,
+  getRefreshTokens,
+  deleteRefreshToken
 } = require('../../src/db')
 const { verifyPassword } = require('../../src/users')
+const { hashTokenValue } = require('../../src/storeCrypto')
+const config = require('../../src/config')
 
 describe('Database Operations', () => {
   let testDir
@@ -157,7 +163,16 @@ describe('Database Operations', () => {
       const codes = await getCodes()
 
       expect(codes).toHaveLength(1)
-      expect(codes[0].code).toBe('abc123')
+      expect(codes[0].codeHash).toBe(hashTokenValue('abc123'))
+      expect(codes[0].client_id).toBe('client1')
+    })
+
+    test('addCode should not store the code in plaintext', async () => {
+      await addCode({ code: 'abc123', client_id: 'client1', expiresAt: Date.now() + 600000 })
+
+      const raw = fs.readFileSync(path.join(testDir, 'codes.json'), 'utf8')
+      expect(raw).not.toContain('abc123')
+      expect(JSON.parse(raw)[0]).not.toHaveProperty('code')
     })
 
     test('getCode should retrieve by code value', async () => {
@@ -187,7 +202,8 @@ describe('Database Operations', () => {
 
       const codes = await getCodes()
       expect(codes).toHaveLength(1)
-      expect(codes[0].code).toBe('code2')
+      expect(await getCode('code1')).toBeUndefined()
+      expect(await getCode('code2')).toBeDefined()
     })
 
     test('deleteCode should handle non-existent code gracefully', async () => {
@@ -214,11 +230,11 @@ describe('Database Operations', () => {
       const codes = await getCodes()
       expect(codes).toHaveLength(2)
 
-      const codeValues = codes.map(c => c.code)
-      expect(codeValues).toContain('valid1')
-      expect(codeValues).toContain('valid2')
-      expect(codeValues).not.toContain('expired1')
-      expect(codeValues).not.toContain('expired2')
+      const codeHashes = codes.map(c => c.codeHash)
+      expect(codeHashes).toContain(hashTokenValue('valid1'))
+      expect(codeHashes).toContain(hashTokenValue('valid2'))
+      expect(codeHashes).not.toContain(hashTokenValue('expired1'))
+      expect(codeHashes).not.toContain(hashTokenValue('expired2'))
     })
 
     test('should keep all codes if none expired', async () => {
@@ -245,4 +261,81 @@ describe('Database Operations', () => {
       expect(codes).toHaveLength(0)
     })
   })
+
+  describe('Token storage at rest', () => {
+    const grant = {
+      client_id: 'client1',
+      userId: 'user1',
+      scope: 'openid offline_access',
+      authorization_details: [{ type: 'account_information', accounts: ['DE-1234'] }],
+      expiresAt: Date.now() + 600000
+    }
+
+    afterEach(() => {
+      config.storeEncryption.secret = null
+    })
+
+    test('should find a refresh token by its hash only', async () => {
+      await addRefreshToken({ ...grant, token: 'refresh-secret-value' })
+
+      const raw = fs.readFileSync(path.join(testDir, 'refresh_tokens.json'), 'utf8')
+      expect(raw).not.toContain('refresh-secret-value')
+
+      const stored = await getRefreshToken('refresh-secret-value')
+      expect(stored.client_id).toBe('client1')
+      expect(stored.authorization_details).toEqual(grant.authorization_details)
+      expect(await getRefreshToken('other-value')).toBeUndefined()
+    })
+
+    test('should delete a refresh token by value', async () => {
+      await addRefreshToken({ ...grant, token: 'refresh-1' })
+      await addRefreshToken({ ...grant, token: 'refresh-2' })
+
+      await deleteRefreshToken('refresh-1')
+
+      expect(await getRefreshTokens()).toHaveLength(1)
+      expect(await getRefreshToken('refresh-2')).toBeDefined()
+    })
+
+    test('should encrypt sensitive fields when a key is configured', async () => {
+      config.storeEncryption.secret = 'k'.repeat(32)
+
+      await addCode({ code: 'code-1', nonce: 'nonce-value', ...grant })
+      await addRefreshToken({ ...grant, token: 'refresh-1' })
+
+      const rawCodes = fs.readFileSync(path.join(testDir, 'codes.json'), 'utf8')
+      const rawTokens = fs.readFileSync(path.join(testDir, 'refresh_tokens.json'), 'utf8')
+      for (const raw of [rawCodes, rawTokens]) {
+        expect(raw).not.toContain('DE-1234')
+        expect(raw).toContain('enc:v1:')
+      }
+      expect(rawCodes).not.toContain('nonce-value')
+
+      const code = await getCode('code-1')
+      expect(code.nonce).toBe('nonce-value')
+      expect(code.authorization_details).toEqual(grant.authorization_details)
+      expect((await getRefreshToken('refresh-1')).authorization_details).toEqual(grant.authorization_details)
+    })
+
+    test('should fail to read encrypted fields without the key', async () => {
+      config.storeEncryption.secret = 'k'.repeat(32)
+      await addCode({ code: 'code-1', nonce: 'nonce-value', expiresAt: Date.now() + 600000 })
+
+      config.storeEncryption.secret = null
+      await expect(getCode('code-1')).rejects.toThrow('NGAUTH_STORE_ENCRYPTION_KEY')
+
+      config.storeEncryption.secret = 'x'.repeat(32)
+      await expect(getCode('code-1')).rejects.toThrow()
+    })
+
+    test('should still find records stored before hashing', async () => {
+      fs.writeFileSync(path.join(testDir, 'refresh_tokens.json'), JSON.stringify([
+        { token: 'legacy-refresh', client_id: 'client1', expiresAt: Date.now() + 600000 }
+      ]))
+
+      expect((await getRefreshToken('legacy-refresh')).client_id).toBe('client1')
+      await deleteRefreshToken('legacy-refresh')
+      expect(await getRefreshTokens()).toHaveLength(0)
+    })
+  })
 })
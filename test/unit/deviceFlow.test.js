@@ -0,0 +1,80 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const config = require('../../src/config')
+const { getCounterStore } = require('../../src/middleware/rateLimitStore')
+const { USER_CODE_CHARSET, generateUserCode, normalizeUserCode, countCodeEntry, refundCodeEntry } = require('../../src/deviceFlow')
+
+describe('Device flow', () => {
+  describe('user codes', () => {
+    test('should generate XXXX-XXXX codes from unambiguous consonants', () => {
+      for (let i = 0; i < 50; i++) {
+        const code = generateUserCode()
+        expect(code).toMatch(/^[A-Z]{4}-[A-Z]{4}$/)
+        expect([...code.replace('-', '')].every(c => USER_CODE_CHARSET.includes(c))).toBe(true)
+      }
+      expect(USER_CODE_CHARSET).not.toMatch(/[AEIOUY0-9]/)
+    })
+
+    test('should generate and accept codes of the configured length', () => {
+      const original = config.codes.userCodeLength
+      config.codes.userCodeLength = 10
+      try {
+        const code = generateUserCode()
+        expect(code).toMatch(/^[A-Z]{4}-[A-Z]{4}-[A-Z]{2}$/)
+        expect(normalizeUserCode(code)).toBe(code.replace(/-/g, ''))
+        expect(normalizeUserCode('BCDF-GHJK')).toBeNull()
+      } finally {
+        config.codes.userCodeLength = original
+      }
+    })
+
+    test('should ignore case, dashes and spaces', () => {
+      expect(normalizeUserCode('bcdf-ghjk')).toBe('BCDFGHJK')
+      expect(normalizeUserCode(' BCDF GHJK ')).toBe('BCDFGHJK')
+    })
+
+    test('should reject input that cannot be a code', () => {
+      expect(normalizeUserCode('BCDF-GHJ')).toBeNull()
+      expect(normalizeUserCode('BCDF-GHJ0')).toBeNull()
+      expect(normalizeUserCode('ABCD-EFGH')).toBeNull()
+      expect(normalizeUserCode(undefined)).toBeNull()
+      expect(normalizeUserCode(['BCDF-GHJK'])).toBeNull()
+    })
+  })
+
+  describe('entry limits', () => {
+    const original = { ...config.deviceFlow }
+    const req = (ip, sessionID) => ({ socket: { remoteAddress: ip }, headers: {}, sessionID })
+
+    beforeEach(() => {
+      config.deviceFlow.maxAttempts = 3
+    })
+
+    afterEach(async () => {
+      Object.assign(config.deviceFlow, original)
+      for (const key of ['device-ip:192.0.2.1', 'device-ip:192.0.2.2', 'device-session:s1', 'device-session:s2']) {
+        await getCounterStore().reset(key)
+      }
+    })
+
+    test('should lock out an IP after the allowed entries', async () => {
+      for (let i = 0; i < 3; i++) {
+        expect(await countCodeEntry(req('192.0.2.1', 's1'))).toBe(true)
+      }
+      expect(await countCodeEntry(req('192.0.2.1', 's2'))).toBe(false)
+    })
+
+    test('should lock out a session across IPs', async () => {
+      for (let i = 0; i < 3; i++) {
+        expect(await countCodeEntry(req(i % 2 ? '192.0.2.1' : '192.0.2.2', 's1'))).toBe(true)
+      }
+      expect(await countCodeEntry(req('192.0.2.2', 's1'))).toBe(false)
+    })
+
+    test('should not count refunded correct entries', async () => {
+      for (let i = 0; i < 5; i++) {
+        expect(await countCodeEntry(req('192.0.2.1', 's1'))).toBe(true)
+        await refundCodeEntry(req('192.0.2.1', 's1'))
+      }
+    })
+  })
+})
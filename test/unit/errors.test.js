@@ -107,6 +107,33 @@ describe('OAuth Error Handling', () => {
       })
     })
 
+    test('should map malformed JSON bodies to invalid_request', () => {
+      const error = new SyntaxError('Unexpected token } in JSON at position 12')
+      error.type = 'entity.parse.failed'
+      error.status = 400
+
+      errorHandler(error, req, res, next)
+
+      expect(res.status).toHaveBeenCalledWith(400)
+      expect(res.json).toHaveBeenCalledWith({
+        error: 'invalid_request',
+        error_description: 'Request body is not valid JSON'
+      })
+    })
+
+    test('should map oversized bodies to 413', () => {
+      const error = new Error('request entity too large')
+      error.type = 'entity.too.large'
+
+      errorHandler(error, req, res, next)
+
+      expect(res.status).toHaveBeenCalledWith(413)
+      expect(res.json).toHaveBeenCalledWith({
+        error: 'invalid_request',
+        error_description: 'Request body is too large'
+      })
+    })
+
     test('should not call next middleware', () => {
       const error = new OAuthError('invalid_request', 'Test')
 
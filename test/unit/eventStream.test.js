@@ -0,0 +1,94 @@
+/* global describe, test, expect, afterEach */
+const { publishEvent, subscribeEvents, redactEvent, closeSubscriptions } = require('../../src/eventStream')
+
+describe('Event stream', () => {
+  let subscription
+
+  afterEach(() => {
+    if (subscription) {
+      subscription.unsubscribe()
+      subscription = null
+    }
+  })
+
+  test('should redact secrets and embedded JWTs', () => {
+    const event = redactEvent({
+      type: 'TOKEN_ISSUED',
+      client_id: 'app',
+      client_secret: 's3cret',
+      refresh_token: 'abc',
+      code: 'xyz',
+      secret_id: 'primary',
+      detail: 'Bearer eyJhbGciOi.eyJzdWIiOi.c2ln rejected',
+      nested: { password: 'hunter2' }
+    })
+
+    expect(event).toEqual({
+      type: 'TOKEN_ISSUED',
+      client_id: 'app',
+      client_secret: '[REDACTED]',
+      refresh_token: '[REDACTED]',
+      code: '[REDACTED]',
+      secret_id: 'primary',
+      detail: 'Bearer [REDACTED] rejected',
+      nested: { password: '[REDACTED]' }
+    })
+  })
+
+  test('should deliver only the subscribed event types', () => {
+    const received = []
+    subscription = subscribeEvents({ types: ['LOGIN_SUCCEEDED'], write: (event) => received.push(event) })
+
+    publishEvent({ type: 'LOGIN_FAILED', username: 'alice' })
+    publishEvent({ type: 'LOGIN_SUCCEEDED', userId: 'u1' })
+
+    expect(received).toEqual([{ type: 'LOGIN_SUCCEEDED', userId: 'u1' }])
+  })
+
+  test('should stop delivering after unsubscribe', () => {
+    const received = []
+    subscription = subscribeEvents({ types: [], write: (event) => received.push(event) })
+    subscription.unsubscribe()
+
+    publishEvent({ type: 'LOGIN_SUCCEEDED' })
+
+    expect(received).toEqual([])
+  })
+
+  test('should queue for a slow consumer, drop the oldest and report the drop', () => {
+    const received = []
+    let writable = false
+    subscription = subscribeEvents({
+      types: [],
+      bufferSize: 2,
+      write: (event) => {
+        received.push(event)
+        return writable
+      }
+    })
+
+    // The first write backs the consumer up; the rest queue with the oldest dropped
+    for (let i = 1; i <= 5; i++) {
+      publishEvent({ type: 'TOKEN_ISSUED', n: i })
+    }
+    expect(received.map(e => e.n)).toEqual([1])
+
+    writable = true
+    subscription.drained()
+
+    expect(received[1]).toMatchObject({ type: 'EVENTS_DROPPED', count: 2 })
+    expect(received.slice(2).map(e => e.n)).toEqual([4, 5])
+  })
+
+  test('should close every subscriber and stop delivering to it', () => {
+    const received = []
+    let closed = 0
+    subscription = subscribeEvents({ types: [], write: (event) => received.push(event), close: () => closed++ })
+
+    closeSubscriptions()
+    publishEvent({ type: 'LOGIN_SUCCEEDED' })
+
+    expect(closed).toBe(1)
+    expect(received).toEqual([])
+  })
+})
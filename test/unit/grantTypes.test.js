@@ -0,0 +1,30 @@
+/* global describe, test, expect, afterEach */
+const config = require('../../src/config')
+const { DEVICE_CODE_GRANT } = require('../../src/deviceFlow')
+const { grantTypeEnabled, enabledGrantTypes } = require('../../src/grantTypes')
+
+describe('Grant type switches', () => {
+  const original = { ...config.features }
+
+  afterEach(() => {
+    Object.assign(config.features, original)
+  })
+
+  test('should enable every implemented grant type by default', () => {
+    expect(enabledGrantTypes()).toEqual(['authorization_code', 'client_credentials', 'refresh_token', DEVICE_CODE_GRANT])
+  })
+
+  test('should follow the feature flags', () => {
+    Object.assign(config.features, { clientCredentialsGrant: false, deviceCodeGrant: false, refreshTokens: false })
+
+    expect(enabledGrantTypes()).toEqual(['authorization_code'])
+    expect(grantTypeEnabled('client_credentials')).toBe(false)
+    expect(grantTypeEnabled(DEVICE_CODE_GRANT)).toBe(false)
+  })
+
+  test('should treat unknown grant types as disabled', () => {
+    expect(grantTypeEnabled('password')).toBe(false)
+    expect(grantTypeEnabled('implicit')).toBe(false)
+    expect(grantTypeEnabled('constructor')).toBe(false)
+  })
+})
@@ -0,0 +1,12 @@
+/* global describe, test, expect */
+const { escapeHtml } = require('../../src/html')
+
+describe('escapeHtml', () => {
+  test('should escape markup and both quote styles', () => {
+    expect(escapeHtml(`"><script>alert('x')</script>&`)).toBe('&quot;&gt;&lt;script&gt;alert(&#39;x&#39;)&lt;/script&gt;&amp;')
+  })
+
+  test('should convert non-strings', () => {
+    expect(escapeHtml(42)).toBe('42')
+  })
+})
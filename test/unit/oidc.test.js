@@ -1,13 +1,19 @@
 /* eslint-env jest */
+/* eslint camelcase: "off" */
 
 /**
  * OIDC Claims Module Unit Tests
  */
 
+const config = require('../../src/config')
 const {
   getClaimsForScope,
   buildIdTokenClaims,
-  buildUserinfoResponse
+  buildUserinfoResponse,
+  setClaimsEnricher,
+  parseClaimsRequest,
+  essentialClaims,
+  unavailableEssentialClaims
 } = require('../../src/oidc')
 
 describe('OIDC Claims Module', () => {
@@ -172,4 +178,134 @@ describe('OIDC Claims Module', () => {
       expect(Object.keys(userinfo)).toEqual(['sub'])
     })
   })
+
+  describe('claim source precedence', () => {
+    const upstreamUser = {
+      ...mockUser,
+      upstream_claims: { email: 'upstream@example.com', department: 'sales' }
+    }
+    let originalPrecedence
+
+    beforeEach(() => {
+      originalPrecedence = config.claims.sourcePrecedence
+      setClaimsEnricher(() => ({ email: 'enriched@example.com' }))
+    })
+
+    afterEach(() => {
+      config.claims.sourcePrecedence = originalPrecedence
+      setClaimsEnricher(null)
+    })
+
+    test('should resolve a conflicting email by the default precedence', () => {
+      config.claims.sourcePrecedence = ['enrichment', 'user', 'upstream']
+      expect(getClaimsForScope('openid email', upstreamUser).email).toBe('enriched@example.com')
+    })
+
+    test('should let the user record win when listed first', () => {
+      config.claims.sourcePrecedence = ['user', 'upstream', 'enrichment']
+      const claims = buildIdTokenClaims(upstreamUser, 'client-123', 'https://auth.example.com', 'openid email')
+      expect(claims.email).toBe(mockUser.email)
+      // Claims only one source provides are kept
+      expect(claims.department).toBe('sales')
+    })
+
+    test('should let the upstream provider win when listed first', () => {
+      config.claims.sourcePrecedence = ['upstream', 'enrichment', 'user']
+      expect(buildUserinfoResponse(upstreamUser, 'openid email', 'client-123').email).toBe('upstream@example.com')
+    })
+
+    test('should fall back to a lower source when a higher one has no value', () => {
+      config.claims.sourcePrecedence = ['user', 'upstream']
+      const claims = getClaimsForScope('openid email', { ...upstreamUser, email: undefined })
+      expect(claims.email).toBe('upstream@example.com')
+    })
+
+    test('should drop sources left out of the precedence', () => {
+      config.claims.sourcePrecedence = ['user']
+      const claims = getClaimsForScope('openid email', upstreamUser)
+      expect(claims.email).toBe(mockUser.email)
+      expect(claims).not.toHaveProperty('department')
+    })
+
+    test('should only release standard claims for their scope', () => {
+      const claims = getClaimsForScope('openid profile', upstreamUser)
+      expect(claims).not.toHaveProperty('email')
+      expect(claims.department).toBe('sales')
+    })
+
+    test('should never let a source override iss, sub or exp', () => {
+      setClaimsEnricher(() => ({ iss: 'https://evil.example.com', sub: 'admin', exp: 9999999999 }))
+      const user = { ...mockUser, upstream_claims: { sub: 'root', aud: 'other-client' } }
+
+      const claims = buildIdTokenClaims(user, 'client-123', 'https://auth.example.com', 'openid profile')
+
+      expect(claims.iss).toBe('https://auth.example.com')
+      expect(claims.sub).toBe(mockUser.id)
+      expect(claims.aud).toBe('client-123')
+      expect(claims.exp).toBeLessThan(9999999999)
+      expect(buildUserinfoResponse(user, 'openid profile').sub).toBe(mockUser.id)
+    })
+
+    test('should pass the client and target to the enricher', () => {
+      const calls = []
+      setClaimsEnricher((ctx) => { calls.push(ctx); return {} })
+
+      buildIdTokenClaims(mockUser, 'client-123', 'https://auth.example.com', 'openid')
+      buildUserinfoResponse(mockUser, 'openid', 'client-123')
+
+      expect(calls.map(c => [c.clientId, c.target, c.scope])).toEqual([
+        ['client-123', 'id_token', 'openid'],
+        ['client-123', 'userinfo', 'openid']
+      ])
+    })
+  })
+
+  describe('claims request', () => {
+    test('should parse a JSON string or an object', () => {
+      const request = { userinfo: { email: { essential: true }, name: null } }
+
+      expect(parseClaimsRequest(JSON.stringify(request))).toEqual(request)
+      expect(parseClaimsRequest(request)).toEqual(request)
+      expect(parseClaimsRequest(undefined)).toBeNull()
+      expect(parseClaimsRequest('')).toBeNull()
+    })
+
+    test('should reject malformed claims requests', () => {
+      expect(() => parseClaimsRequest('not json')).toThrow('claims must be valid JSON')
+      expect(() => parseClaimsRequest('[]')).toThrow('claims must be a JSON object')
+      expect(() => parseClaimsRequest('"email"')).toThrow('claims must be a JSON object')
+      expect(() => parseClaimsRequest('{"userinfo":[]}')).toThrow('claims.userinfo must be a JSON object')
+      expect(() => parseClaimsRequest('{"userinfo":{"email":true}}')).toThrow('claims.userinfo.email must be null or a JSON object')
+    })
+
+    test('should list only essential claims of the target', () => {
+      const request = {
+        userinfo: { email: { essential: true }, name: null, locale: { essential: false } },
+        id_token: { auth_time: { essential: true } }
+      }
+
+      expect(essentialClaims(request, 'userinfo')).toEqual(['email'])
+      expect(essentialClaims(request, 'id_token')).toEqual(['auth_time'])
+      expect(essentialClaims(null, 'userinfo')).toEqual([])
+    })
+
+    test('should accept essential userinfo claims the response carries', () => {
+      const request = { userinfo: { email: { essential: true } } }
+
+      expect(unavailableEssentialClaims(request, mockUser, 'openid email', 'client-123')).toEqual([])
+      expect(buildUserinfoResponse(mockUser, 'openid email', 'client-123').email).toBe(mockUser.email)
+    })
+
+    test('should report essential userinfo claims that cannot be provided', () => {
+      const request = { userinfo: { email: { essential: true }, name: { essential: true } } }
+      const userWithoutEmail = { ...mockUser, email: undefined }
+
+      // Scope not granted
+      expect(unavailableEssentialClaims(request, mockUser, 'openid', 'client-123')).toEqual(['email', 'name'])
+      // The user has no value
+      expect(unavailableEssentialClaims(request, userWithoutEmail, 'openid email profile', 'client-123')).toEqual(['email'])
+      // Voluntary claims never fail the flow
+      expect(unavailableEssentialClaims({ userinfo: { email: null } }, userWithoutEmail, 'openid', 'client-123')).toEqual([])
+    })
+  })
 })
@@ -0,0 +1,94 @@
+/* global describe, test, expect, beforeAll, afterAll, afterEach */
+const http = require('http')
+const config = require('../../src/config')
+const { subjectFor, resolveSectorIdentifier, sectorFromRedirectUris } = require('../../src/pairwise')
+
+describe('Pairwise subjects', () => {
+  const redirectUris = ['https://app.example.com/callback', 'https://m.example.com/callback']
+  let server
+  let baseUrl
+
+  beforeAll(async () => {
+    config.claims.pairwiseSecret = 'test-pairwise-secret'
+    // The test server is plain http on loopback
+    config.registration.allowPrivateSectorUris = true
+    server = http.createServer((req, res) => {
+      const body = req.url === '/sector.json' ? JSON.stringify(redirectUris) : '{"redirect_uris": []}'
+      res.writeHead(req.url === '/missing' ? 404 : 200, { 'Content-Type': 'application/json' })
+      res.end(body)
+    })
+    await new Promise(resolve => server.listen(0, '127.0.0.1', resolve))
+    baseUrl = `http://127.0.0.1:${server.address().port}`
+  })
+
+  afterAll(() => {
+    config.claims.pairwiseSecret = ''
+    config.registration.allowPrivateSectorUris = false
+    server.close()
+  })
+
+  afterEach(() => {
+    config.claims.pairwiseSecret = 'test-pairwise-secret'
+  })
+
+  const pairwise = (sector) => ({ subject_type: 'pairwise', sector_identifier: sector })
+
+  test('should give clients of one sector the same sub', () => {
+    const sub = subjectFor(pairwise('sector.example.com'), 'user1')
+
+    expect(sub).not.toBe('user1')
+    expect(subjectFor(pairwise('sector.example.com'), 'user1')).toBe(sub)
+    expect(subjectFor(pairwise('other.example.com'), 'user1')).not.toBe(sub)
+    expect(subjectFor(pairwise('sector.example.com'), 'user2')).not.toBe(sub)
+  })
+
+  test('should change with the pairwise secret', () => {
+    const sub = subjectFor(pairwise('sector.example.com'), 'user1')
+    config.claims.pairwiseSecret = 'rotated'
+
+    expect(subjectFor(pairwise('sector.example.com'), 'user1')).not.toBe(sub)
+  })
+
+  test('should keep the user ID for public clients', () => {
+    expect(subjectFor({ subject_type: 'public' }, 'user1')).toBe('user1')
+    expect(subjectFor({}, 'user1')).toBe('user1')
+    expect(subjectFor(null, 'user1')).toBe('user1')
+  })
+
+  test('should resolve a sector_identifier_uri listing every redirect URI to its host', async () => {
+    const sector = await resolveSectorIdentifier(`${baseUrl}/sector.json`, redirectUris)
+
+    expect(sector).toBe(new URL(baseUrl).host)
+  })
+
+  test('should reject a redirect URI missing from the sector document', async () => {
+    await expect(resolveSectorIdentifier(`${baseUrl}/sector.json`, [...redirectUris, 'https://evil.example.com/cb']))
+      .rejects.toThrow('redirect_uri https://evil.example.com/cb is not listed at the sector_identifier_uri')
+  })
+
+  test('should reject sector documents that are not a JSON array', async () => {
+    await expect(resolveSectorIdentifier(`${baseUrl}/object.json`, redirectUris))
+      .rejects.toThrow('must return a JSON array')
+    await expect(resolveSectorIdentifier(`${baseUrl}/missing`, redirectUris))
+      .rejects.toThrow('sector_identifier_uri could not be retrieved')
+  })
+
+  test('should only fetch https sector documents on public hosts', async () => {
+    config.registration.allowPrivateSectorUris = false
+    try {
+      await expect(resolveSectorIdentifier(`${baseUrl}/sector.json`, redirectUris))
+        .rejects.toThrow('must be an https URL')
+      for (const host of ['127.0.0.1', '10.0.0.1', '169.254.169.254', '[::1]', 'localhost']) {
+        await expect(resolveSectorIdentifier(`https://${host}/sector.json`, redirectUris))
+          .rejects.toThrow('must be on a public host')
+      }
+    } finally {
+      config.registration.allowPrivateSectorUris = true
+    }
+  })
+
+  test('should take the sector from redirect URIs sharing one host', () => {
+    expect(sectorFromRedirectUris(['https://app.example.com/a', 'https://app.example.com/b'])).toBe('app.example.com')
+    expect(() => sectorFromRedirectUris(redirectUris)).toThrow('must register a sector_identifier_uri')
+  })
+})
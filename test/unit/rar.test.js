@@ -0,0 +1,38 @@
+/* global describe, test, expect */
+const { parseAuthorizationDetails } = require('../../src/rar')
+
+describe('Rich Authorization Requests', () => {
+  const client = { authorization_details_types: ['payment_initiation'] }
+  const payment = { type: 'payment_initiation', instructedAmount: { currency: 'EUR', amount: '123.50' } }
+
+  test('should return null when absent', () => {
+    expect(parseAuthorizationDetails(undefined, client)).toBeNull()
+    expect(parseAuthorizationDetails('', client)).toBeNull()
+  })
+
+  test('should parse a JSON string', () => {
+    expect(parseAuthorizationDetails(JSON.stringify([payment]), client)).toEqual([payment])
+  })
+
+  test('should accept an array', () => {
+    expect(parseAuthorizationDetails([payment], client)).toEqual([payment])
+  })
+
+  test('should reject invalid JSON', () => {
+    expect(() => parseAuthorizationDetails('[{', client)).toThrow('valid JSON')
+  })
+
+  test('should reject non-arrays and empty arrays', () => {
+    expect(() => parseAuthorizationDetails('{"type":"payment_initiation"}', client)).toThrow('non-empty JSON array')
+    expect(() => parseAuthorizationDetails('[]', client)).toThrow('non-empty JSON array')
+  })
+
+  test('should reject entries without a type', () => {
+    expect(() => parseAuthorizationDetails([{ actions: ['read'] }], client)).toThrow('with a type')
+  })
+
+  test('should reject types not registered for the client', () => {
+    expect(() => parseAuthorizationDetails([{ type: 'account_information' }], client)).toThrow('Unsupported authorization_details type')
+    expect(() => parseAuthorizationDetails([payment], {})).toThrow('Unsupported authorization_details type')
+  })
+})
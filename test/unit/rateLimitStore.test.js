@@ -0,0 +1,188 @@
+/* global describe, test, expect */
+const {
+  MemoryCounterStore,
+  RedisCounterStore,
+  createRateLimitStore
+} = require('../../src/middleware/rateLimitStore')
+
+// Minimal in-process stand-in for a Redis server: just enough of the
+// node-redis client API (eval/del) to run the store's scripts. Several
+// clients may share one FakeRedis, like instances sharing a Redis cluster.
+class FakeRedis {
+  constructor () {
+    this.data = new Map()
+    this.now = Date.now()
+  }
+
+  client () {
+    const server = this
+    return {
+      async eval (script, { keys, arguments: args }) {
+        return server.run(script, keys[0], args)
+      },
+      async del (key) {
+        server.data.delete(key)
+      }
+    }
+  }
+
+  live (key) {
+    const entry = this.data.get(key)
+    if (entry && entry.expiresAt !== null && entry.expiresAt <= this.now) {
+      this.data.delete(key)
+      return undefined
+    }
+    return entry
+  }
+
+  run (script, key, args) {
+    const entry = this.live(key)
+    if (script.includes("'INCR'")) {
+      const next = entry || { value: 0, expiresAt: null }
+      next.value++
+      if (next.expiresAt === null) {
+        next.expiresAt = this.now + Number(args[0])
+      }
+      this.data.set(key, next)
+      return [next.value, next.expiresAt - this.now]
+    }
+    if (entry && entry.value > 0) {
+      entry.value--
+      return entry.value
+    }
+    return 0
+  }
+}
+
+// Count how many of n requests a limiter store would allow with the given max
+async function allowed (store, key, n, max) {
+  let count = 0
+  for (let i = 0; i < n; i++) {
+    const { totalHits } = await store.increment(key)
+    if (totalHits <= max) {
+      count++
+    }
+  }
+  return count
+}
+
+describe('Rate Limit Stores', () => {
+  describe('MemoryCounterStore', () => {
+    test('should count hits within a window', async () => {
+      const counters = new MemoryCounterStore()
+
+      const first = await counters.increment('ip', 1000, 0)
+      const second = await counters.increment('ip', 1000, 500)
+
+      expect(first.totalHits).toBe(1)
+      expect(second.totalHits).toBe(2)
+      expect(second.resetTime.getTime()).toBe(1000)
+    })
+
+    test('should start a new window once the old one expires', async () => {
+      const counters = new MemoryCounterStore()
+
+      await counters.increment('ip', 1000, 0)
+      const next = await counters.increment('ip', 1000, 1000)
+
+      expect(next.totalHits).toBe(1)
+      expect(next.resetTime.getTime()).toBe(2000)
+    })
+
+    test('should decrement and reset keys', async () => {
+      const counters = new MemoryCounterStore()
+
+      await counters.increment('ip', 1000, 0)
+      await counters.increment('ip', 1000, 0)
+      await counters.decrement('ip')
+      expect((await counters.increment('ip', 1000, 0)).totalHits).toBe(2)
+
+      await counters.reset('ip')
+      expect((await counters.increment('ip', 1000, 0)).totalHits).toBe(1)
+    })
+
+    test('should share the budget between limiters on one store', async () => {
+      const counters = new MemoryCounterStore()
+      const a = createRateLimitStore(counters, { prefix: 'login:' })
+      const b = createRateLimitStore(counters, { prefix: 'login:' })
+      a.init({ windowMs: 60000 })
+      b.init({ windowMs: 60000 })
+
+      const total = await allowed(a, '10.0.0.1', 3, 5) + await allowed(b, '10.0.0.1', 3, 5)
+      expect(total).toBe(5)
+    })
+
+    test('should keep limiters with different prefixes apart', async () => {
+      const counters = new MemoryCounterStore()
+      const login = createRateLimitStore(counters, { prefix: 'login:' })
+      const register = createRateLimitStore(counters, { prefix: 'register:' })
+      login.init({ windowMs: 60000 })
+      register.init({ windowMs: 60000 })
+
+      await login.increment('10.0.0.1')
+      expect((await register.increment('10.0.0.1')).totalHits).toBe(1)
+    })
+  })
+
+  describe('RedisCounterStore', () => {
+    test('should share one budget across instances', async () => {
+      const redis = new FakeRedis()
+      // Two server instances, each with its own client and limiter store
+      const instanceA = createRateLimitStore(new RedisCounterStore(redis.client()), { prefix: 'login:' })
+      const instanceB = createRateLimitStore(new RedisCounterStore(redis.client()), { prefix: 'login:' })
+      instanceA.init({ windowMs: 60000 })
+      instanceB.init({ windowMs: 60000 })
+
+      const total = await allowed(instanceA, '10.0.0.1', 4, 5) + await allowed(instanceB, '10.0.0.1', 4, 5)
+      expect(total).toBe(5)
+    })
+
+    test('should reset the budget when the window expires', async () => {
+      const redis = new FakeRedis()
+      const counters = new RedisCounterStore(redis.client())
+
+      await counters.increment('ip', 1000)
+      await counters.increment('ip', 1000)
+      redis.now += 1000
+
+      expect((await counters.increment('ip', 1000)).totalHits).toBe(1)
+    })
+
+    test('should not decrement below zero', async () => {
+      const redis = new FakeRedis()
+      const counters = new RedisCounterStore(redis.client())
+
+      await counters.decrement('ip')
+      expect((await counters.increment('ip', 1000)).totalHits).toBe(1)
+    })
+  })
+
+  describe('store failures', () => {
+    const broken = {
+      increment: async () => { throw new Error('ECONNREFUSED') },
+      decrement: async () => { throw new Error('ECONNREFUSED') },
+      reset: async () => { throw new Error('ECONNREFUSED') }
+    }
+
+    test('should allow requests when failing open', async () => {
+      const store = createRateLimitStore(broken, { failureMode: 'open' })
+      store.init({ windowMs: 60000 })
+
+      expect(await allowed(store, '10.0.0.1', 10, 5)).toBe(10)
+    })
+
+    test('should reject requests when failing closed', async () => {
+      const store = createRateLimitStore(broken, { failureMode: 'closed' })
+      store.init({ windowMs: 60000 })
+
+      expect(await allowed(store, '10.0.0.1', 10, 5)).toBe(0)
+    })
+
+    test('should swallow errors on decrement and reset', async () => {
+      const store = createRateLimitStore(broken, { failureMode: 'closed' })
+
+      await expect(store.decrement('10.0.0.1')).resolves.toBeUndefined()
+      await expect(store.resetKey('10.0.0.1')).resolves.toBeUndefined()
+    })
+  })
+})
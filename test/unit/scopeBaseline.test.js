@@ -0,0 +1,90 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const config = require('../../src/config')
+const { initDb, getScopeBaseline } = require('../../src/db')
+const { subscribeEvents } = require('../../src/eventStream')
+const { checkScopeBaseline } = require('../../src/scopeBaseline')
+
+describe('Scope baselines', () => {
+  const originalBaseline = { ...config.scopeBaseline }
+  const client = { client_id: 'reporting' }
+  let testDir
+  let events
+  let subscription
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+    Object.assign(config.scopeBaseline, { mode: 'monitor', learningRequests: 3, adoptAfter: 2, maxScopes: 50 })
+    events = []
+    subscription = subscribeEvents({ types: ['SCOPE_BASELINE_EXCEEDED', 'SCOPE_BASELINE_ADOPTED'], write: (event) => events.push(event) })
+  })
+
+  afterEach(() => {
+    Object.assign(config.scopeBaseline, originalBaseline)
+    subscription.unsubscribe()
+    fs.rmSync(testDir, { recursive: true, force: true })
+  })
+
+  const learn = async (...scopes) => {
+    for (const scope of scopes) {
+      await checkScopeBaseline(client, scope)
+    }
+  }
+
+  test('should do nothing when off', async () => {
+    config.scopeBaseline.mode = 'off'
+    await learn('read', 'read', 'read')
+
+    expect(await checkScopeBaseline(client, 'admin')).toEqual({ unusual: [], blocked: false })
+    expect(await getScopeBaseline('reporting')).toBeUndefined()
+  })
+
+  test('should stay silent while learning and for usual scopes', async () => {
+    await learn('read', 'read write', 'read')
+
+    expect(await checkScopeBaseline(client, 'write read')).toEqual({ unusual: [], blocked: false })
+    expect(events).toEqual([])
+    expect((await getScopeBaseline('reporting')).scopes).toEqual(['read', 'write'])
+  })
+
+  test('should audit scopes outside the baseline without blocking in monitor mode', async () => {
+    await learn('read', 'read', 'read')
+
+    const result = await checkScopeBaseline(client, 'read admin')
+
+    expect(result).toEqual({ unusual: ['admin'], blocked: false })
+    expect(events).toHaveLength(1)
+    expect(events[0]).toMatchObject({ type: 'SCOPE_BASELINE_EXCEEDED', client_id: 'reporting', unusual_scopes: ['admin'], mode: 'monitor' })
+  })
+
+  test('should adopt a scope granted often enough', async () => {
+    await learn('read', 'read', 'read', 'read export')
+
+    expect((await checkScopeBaseline(client, 'read export')).unusual).toEqual(['export'])
+    expect((await getScopeBaseline('reporting')).scopes).toEqual(['read', 'export'])
+    expect(events.map(e => e.type)).toEqual(['SCOPE_BASELINE_EXCEEDED', 'SCOPE_BASELINE_EXCEEDED', 'SCOPE_BASELINE_ADOPTED'])
+
+    expect((await checkScopeBaseline(client, 'read export')).unusual).toEqual([])
+  })
+
+  test('should not grow past maxScopes', async () => {
+    config.scopeBaseline.maxScopes = 1
+    await learn('read write', 'read', 'read', 'write', 'write')
+
+    expect((await getScopeBaseline('reporting')).scopes).toEqual(['read'])
+    expect((await checkScopeBaseline(client, 'write')).unusual).toEqual(['write'])
+  })
+
+  test('should block without learning in enforce mode', async () => {
+    config.scopeBaseline.mode = 'enforce'
+    await learn('read', 'read', 'read')
+
+    expect(await checkScopeBaseline(client, 'read admin')).toEqual({ unusual: ['admin'], blocked: true })
+    expect(await checkScopeBaseline(client, 'read admin')).toEqual({ unusual: ['admin'], blocked: true })
+    expect(events[0].mode).toBe('enforce')
+    expect((await getScopeBaseline('reporting')).requests).toBe(3)
+  })
+})
@@ -0,0 +1,142 @@
+/* global describe, test, expect */
+const { normalizeScope, scopeLimitError, expandScopes, splitUserScopes, findMachineOnlyScopes, adminScopeAllowed, adminScopeError, toScopeClaim, readTokenScope } = require('../../src/scopes')
+
+describe('expandScopes', () => {
+  const hierarchy = { admin: ['write'], write: ['read'] }
+
+  test('should expand implied scopes transitively', () => {
+    expect(expandScopes('admin', hierarchy)).toBe('admin write read')
+  })
+
+  test('should keep scopes without implications unchanged', () => {
+    expect(expandScopes('openid profile', hierarchy)).toBe('openid profile')
+  })
+
+  test('should not duplicate scopes already granted', () => {
+    expect(expandScopes('read admin', hierarchy)).toBe('read admin write')
+  })
+
+  test('should not imply coarser scopes', () => {
+    expect(expandScopes('read', hierarchy)).toBe('read')
+  })
+
+  test('should terminate on cycles', () => {
+    expect(expandScopes('a', { a: ['b'], b: ['a'] })).toBe('a b')
+  })
+
+  test('should handle empty scope', () => {
+    expect(expandScopes('', hierarchy)).toBe('')
+    expect(expandScopes(undefined, hierarchy)).toBe('')
+  })
+})
+
+describe('normalizeScope', () => {
+  test('should collapse duplicates and extra whitespace', () => {
+    expect(normalizeScope('  read  write read\tread ', false)).toBe('read write')
+  })
+
+  test('should keep commas as part of scope values by default', () => {
+    expect(normalizeScope('read,write', false)).toBe('read,write')
+  })
+
+  test('should split on commas under the compatibility flag', () => {
+    expect(normalizeScope('read,write, read ,,admin', true)).toBe('read write admin')
+  })
+
+  test('should leave non-string values alone', () => {
+    expect(normalizeScope(undefined, true)).toBeUndefined()
+  })
+})
+
+describe('scopeLimitError', () => {
+  const limits = { maxScopes: 3, maxScopeLength: 20 }
+
+  test('should accept a scope within both caps', () => {
+    expect(scopeLimitError('read write admin', limits)).toBeNull()
+  })
+
+  test('should reject too many scopes', () => {
+    expect(scopeLimitError('a b c d', limits)).toBe('At most 3 scopes may be requested, got 4')
+  })
+
+  test('should reject a scope parameter that is too long', () => {
+    expect(scopeLimitError('read ' + 'x'.repeat(20), limits)).toBe('The scope parameter may be at most 20 characters, got 25')
+  })
+
+  test('should count scopes after duplicates are collapsed', () => {
+    expect(scopeLimitError(normalizeScope('read read read write write admin', false), limits)).toBeNull()
+  })
+
+  test('should treat 0 as unlimited', () => {
+    expect(scopeLimitError('a b c d ' + 'x'.repeat(100), { maxScopes: 0, maxScopeLength: 0 })).toBeNull()
+  })
+})
+
+describe('splitUserScopes', () => {
+  test('should separate user-identity scopes', () => {
+    expect(splitUserScopes('openid read profile write offline_access')).toEqual({
+      scope: 'read write',
+      userScopes: ['openid', 'profile', 'offline_access']
+    })
+  })
+
+  test('should handle empty scope', () => {
+    expect(splitUserScopes(undefined)).toEqual({ scope: '', userScopes: [] })
+  })
+})
+
+describe('findMachineOnlyScopes', () => {
+  test('should return the requested machine-only scopes', () => {
+    expect(findMachineOnlyScopes('read jobs:run metrics:push', ['jobs:run', 'metrics:push'])).toEqual(['jobs:run', 'metrics:push'])
+    expect(findMachineOnlyScopes('read', ['jobs:run'])).toEqual([])
+  })
+})
+
+describe('toScopeClaim', () => {
+  test('should keep a space-delimited string by default', () => {
+    expect(toScopeClaim('read write', { scopeClaimName: 'scope', scopeFormat: 'string' }))
+      .toEqual({ name: 'scope', value: 'read write' })
+  })
+
+  test('should split into an array under the configured name', () => {
+    expect(toScopeClaim('read write', { scopeClaimName: 'scp', scopeFormat: 'array' }))
+      .toEqual({ name: 'scp', value: ['read', 'write'] })
+  })
+
+  test('should give an empty array for no scopes', () => {
+    expect(toScopeClaim('', { scopeClaimName: 'scope', scopeFormat: 'array' }).value).toEqual([])
+  })
+})
+
+describe('readTokenScope', () => {
+  test('should read a string claim', () => {
+    expect(readTokenScope({ scope: 'read write' }, { scopeClaimName: 'scope' })).toBe('read write')
+  })
+
+  test('should join an array claim', () => {
+    expect(readTokenScope({ scp: ['read', 'write'] }, { scopeClaimName: 'scp' })).toBe('read write')
+  })
+
+  test('should fall back to the scope claim for older tokens', () => {
+    expect(readTokenScope({ scope: 'read' }, { scopeClaimName: 'scp' })).toBe('read')
+  })
+
+  test('should return an empty string without scopes', () => {
+    expect(readTokenScope({}, { scopeClaimName: 'scope' })).toBe('')
+  })
+})
+
+describe('admin scope', () => {
+  test('should only allow listed or seeded clients', () => {
+    expect(adminScopeAllowed({ client_id: 'ops' }, ['ops'])).toBe(true)
+    expect(adminScopeAllowed({ client_id: 'seeded', admin_access: true }, [])).toBe(true)
+    expect(adminScopeAllowed({ client_id: 'registered' }, [])).toBe(false)
+    expect(adminScopeAllowed(null, ['ops'])).toBe(false)
+  })
+
+  test('should reject admin for other clients', () => {
+    expect(adminScopeError('read admin', { client_id: 'registered' })).toBe("Scope 'admin' is not available to this client")
+    expect(adminScopeError('read write', { client_id: 'registered' })).toBeNull()
+    expect(adminScopeError('admin', { client_id: 'seeded', admin_access: true })).toBeNull()
+  })
+})
@@ -0,0 +1,134 @@
+/* eslint camelcase: "off" */
+/* global describe, test, expect, beforeEach, afterEach */
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb, getClients, getClient, getUsers, getUser } = require('../../src/db')
+const { verifyPassword } = require('../../src/users')
+const { applySeed, seedFromFile } = require('../../src/seed')
+
+describe('Seeding', () => {
+  let testDir
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+  })
+
+  afterEach(() => {
+    delete process.env.SEED_TEST_SECRET
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  const seed = () => ({
+    clients: [{
+      client_id: 'web-app',
+      client_secret: 'web-app-secret',
+      client_name: 'Web App',
+      redirect_uris: ['https://app.example.com/callback'],
+      scope: 'openid profile'
+    }],
+    users: [{
+      username: 'admin',
+      email: 'admin@example.com',
+      password: 'Adm1n-Passw0rd'
+    }]
+  })
+
+  test('should create the seeded client and user', async () => {
+    const summary = await applySeed(seed())
+
+    expect(summary).toEqual({ clients: { created: 1, updated: 0 }, users: { created: 1, updated: 0 } })
+    const client = await getClient('web-app')
+    expect(client.client_secret).toBe('web-app-secret')
+    expect(client.grant_types).toEqual(['authorization_code'])
+    const user = await getUser('admin')
+    expect(await verifyPassword('Adm1n-Passw0rd', user.password)).toBe(true)
+  })
+
+  test('should be idempotent across startups', async () => {
+    await applySeed(seed())
+    const clients = await getClients()
+    const users = await getUsers()
+
+    const summary = await applySeed(seed())
+
+    expect(summary).toEqual({ clients: { created: 0, updated: 0 }, users: { created: 0, updated: 0 } })
+    expect(await getClients()).toEqual(clients)
+    expect(await getUsers()).toEqual(users)
+  })
+
+  test('should update an existing client when the seed changes', async () => {
+    await applySeed(seed())
+    const before = await getClient('web-app')
+
+    const changed = seed()
+    changed.clients[0].redirect_uris.push('https://app.example.com/callback2')
+    changed.clients[0].client_secret = 'rotated-secret'
+    const summary = await applySeed(changed)
+
+    expect(summary.clients).toEqual({ created: 0, updated: 1 })
+    const clients = await getClients()
+    expect(clients.filter(c => c.client_id === 'web-app')).toHaveLength(1)
+    const after = await getClient('web-app')
+    expect(after.redirect_uris).toEqual(['https://app.example.com/callback', 'https://app.example.com/callback2'])
+    expect(after.client_secret).toBe('rotated-secret')
+    expect(after.created_at).toBe(before.created_at)
+  })
+
+  test('should update a seeded user password', async () => {
+    await applySeed(seed())
+    const { id } = await getUser('admin')
+
+    const changed = seed()
+    changed.users[0].password = 'N3w-Passw0rd!'
+    const summary = await applySeed(changed)
+
+    expect(summary.users).toEqual({ created: 0, updated: 1 })
+    const user = await getUser('admin')
+    expect(user.id).toBe(id)
+    expect(await verifyPassword('N3w-Passw0rd!', user.password)).toBe(true)
+  })
+
+  test('should read secrets from the environment and from files', async () => {
+    process.env.SEED_TEST_SECRET = 'from-env'
+    const secretFile = path.join(testDir, 'user-password')
+    fs.writeFileSync(secretFile, 'Fr0m-File-Pass\n')
+
+    await applySeed({
+      clients: [{ client_id: 'env-app', client_secret_env: 'SEED_TEST_SECRET', redirect_uris: ['https://app.example.com/cb'] }],
+      users: [{ username: 'fileuser', email: 'file@example.com', password_file: secretFile }]
+    })
+
+    expect((await getClient('env-app')).client_secret).toBe('from-env')
+    expect(await verifyPassword('Fr0m-File-Pass', (await getUser('fileuser')).password)).toBe(true)
+  })
+
+  test('should fail when a referenced environment variable is missing', async () => {
+    let error
+    try {
+      await applySeed({ clients: [{ client_id: 'env-app', client_secret_env: 'SEED_TEST_SECRET', redirect_uris: [] }] })
+    } catch (err) {
+      error = err
+    }
+
+    expect(error.message).toContain('SEED_TEST_SECRET')
+  })
+
+  test('should not put seed file contents in errors', async () => {
+    const file = path.join(testDir, 'seed.json')
+    fs.writeFileSync(file, '{ "clients": [{ "client_secret": "do-not-leak" ')
+
+    let error
+    try {
+      await seedFromFile(file)
+    } catch (err) {
+      error = err
+    }
+
+    expect(error.message).toContain('invalid JSON')
+    expect(error.message).not.toContain('do-not-leak')
+  })
+})
@@ -0,0 +1,98 @@
+/* global describe, test, expect, beforeEach, afterEach */
+const fs = require('fs')
+const path = require('path')
+const os = require('os')
+const { initDb, addCode, getCodes } = require('../../src/db')
+const { runSweep, getSweeperStats } = require('../../src/sweeper')
+const { hashTokenValue } = require('../../src/storeCrypto')
+
+// Minimal express-session compatible store
+function createSessionStore (sessions) {
+  return {
+    sessions,
+    all (callback) {
+      callback(null, this.sessions)
+    },
+    destroy (sid, callback) {
+      delete this.sessions[sid]
+      callback()
+    }
+  }
+}
+
+describe('Expired Record Sweeper', () => {
+  let testDir
+  const now = Date.now()
+
+  beforeEach(async () => {
+    testDir = fs.mkdtempSync(path.join(os.tmpdir(), 'oauth-test-'))
+    await initDb(testDir)
+  })
+
+  afterEach(() => {
+    if (fs.existsSync(testDir)) {
+      fs.rmSync(testDir, { recursive: true, force: true })
+    }
+  })
+
+  test('should purge expired records and keep unexpired ones', async () => {
+    await addCode({ code: 'expired-code', expiresAt: now - 1000 })
+    await addCode({ code: 'valid-code', expiresAt: now + 60000 })
+
+    fs.writeFileSync(path.join(testDir, 'refresh_tokens.json'), JSON.stringify([
+      { token: 'expired-refresh', expiresAt: now - 1000 },
+      { token: 'valid-refresh', expiresAt: now + 60000 }
+    ]))
+
+    const store = createSessionStore({
+      'expired-session': { cookie: { expires: new Date(now - 1000).toISOString() } },
+      'valid-session': { cookie: { expires: new Date(now + 60000).toISOString() } },
+      'browser-session': { cookie: { expires: null } }
+    })
+
+    const purged = await runSweep({ sessionStore: store, now })
+
+    expect(purged.codes).toBe(1)
+    expect(purged.refreshTokens).toBe(1)
+    expect(purged.sessions).toBe(1)
+
+    const codes = await getCodes()
+    expect(codes.map(c => c.codeHash)).toEqual([hashTokenValue('valid-code')])
+
+    const refreshTokens = JSON.parse(fs.readFileSync(path.join(testDir, 'refresh_tokens.json'), 'utf8'))
+    expect(refreshTokens.map(t => t.token)).toEqual(['valid-refresh'])
+
+    expect(Object.keys(store.sessions).sort()).toEqual(['browser-session', 'valid-session'])
+  })
+
+  test('should respect the batch size', async () => {
+    await addCode({ code: 'expired-1', expiresAt: now - 3000 })
+    await addCode({ code: 'expired-2', expiresAt: now - 2000 })
+    await addCode({ code: 'expired-3', expiresAt: now - 1000 })
+
+    const first = await runSweep({ now, batchSize: 2 })
+    expect(first.codes).toBe(2)
+    expect(await getCodes()).toHaveLength(1)
+
+    const second = await runSweep({ now, batchSize: 2 })
+    expect(second.codes).toBe(1)
+    expect(await getCodes()).toHaveLength(0)
+  })
+
+  test('should tolerate a missing refresh token store', async () => {
+    const purged = await runSweep({ now })
+    expect(purged.refreshTokens).toBe(0)
+  })
+
+  test('should accumulate purge metrics across runs', async () => {
+    const before = getSweeperStats()
+    await addCode({ code: 'expired-code', expiresAt: now - 1000 })
+
+    await runSweep({ now })
+
+    const after = getSweeperStats()
+    expect(after.runs).toBe(before.runs + 1)
+    expect(after.purged.codes).toBe(before.purged.codes + 1)
+    expect(after.lastRunAt).toBe(new Date(now).toISOString())
+  })
+})
@@ -3,7 +3,29 @@ const crypto = require('crypto')
 const fs = require('fs')
 const path = require('path')
 const os = require('os')
-const { ensurePrivateKey, getPublicKeyJwk, generateToken, verifyToken, generateRandomToken } = require('../../src/tokens')
+const config = require('../../src/config')
+const jwt = require('jsonwebtoken')
+const {
+  ensurePrivateKey,
+  getPublicKeyJwk,
+  getPublicKeyJwks,
+  generateToken,
+  generateIdToken,
+  generateLogoutToken,
+  verifyToken,
+  verifyIdTokenHint,
+  generateRandomToken,
+  generateCode,
+  getSigningAlgorithms,
+  ensureClientKey,
+  getClientJwks,
+  defaultClaimsFor,
+  withDefaultClaims,
+  validateDefaultClaims,
+  rotateDefaultKey,
+  getKeyRotation,
+  getPublicKeyPem
+} = require('../../src/tokens')
 
 describe('Token Operations', () => {
   let testDir
@@ -87,6 +109,50 @@ describe('Token Operations', () => {
       expect(decoded.scope).toBe('read write')
     })
 
+    test('should stamp access tokens with the format version', async () => {
+      const token = generateToken({ sub: 'user123', token_type: 'access' }, '1h')
+      const decoded = verifyToken(token)
+
+      expect(decoded.ver).toBe('1')
+    })
+
+    test('should use the configured version and claim name', async () => {
+      const original = { ...config.tokenFormat }
+      config.tokenFormat.version = '2'
+      config.tokenFormat.claimName = 'https://ngauth.dev/token_version'
+
+      try {
+        const decoded = verifyToken(generateToken({ sub: 'user123', token_type: 'access' }, '1h'))
+        expect(decoded['https://ngauth.dev/token_version']).toBe('2')
+        expect(decoded.ver).toBeUndefined()
+      } finally {
+        Object.assign(config.tokenFormat, original)
+      }
+    })
+
+    test('should set typ at+jwt on access tokens only', () => {
+      const accessToken = jwt.decode(generateToken({ sub: 'user123', token_type: 'access' }), { complete: true })
+      const idToken = jwt.decode(generateIdToken({ sub: 'user123', aud: 'client456' }), { complete: true })
+
+      expect(accessToken.header.typ).toBe('at+jwt')
+      expect(idToken.header.typ).toBe('JWT')
+    })
+
+    test('should not stamp non-access tokens', async () => {
+      const decoded = verifyToken(generateToken({ sub: 'user123' }, '1h'))
+
+      expect(decoded.ver).toBeUndefined()
+      expect(decoded.jti).toBeUndefined()
+    })
+
+    test('should give each access token its own jti', () => {
+      const first = verifyToken(generateToken({ sub: 'user123', token_type: 'access' }))
+      const second = verifyToken(generateToken({ sub: 'user123', token_type: 'access' }))
+
+      expect(first.jti).toMatch(/^[0-9a-f]{32}$/)
+      expect(second.jti).not.toBe(first.jti)
+    })
+
     test('should set expiration time', async () => {
       const payload = { sub: 'user123' }
       const token = generateToken(payload, '1h')
@@ -125,6 +191,39 @@ describe('Token Operations', () => {
     })
   })
 
+  describe('verifyIdTokenHint', () => {
+    const issuer = 'https://auth.example.com'
+    const now = Math.floor(Date.now() / 1000)
+
+    beforeEach(async () => {
+      await ensurePrivateKey(testDir)
+    })
+
+    test('should accept an expired ID token with a valid signature', () => {
+      const hint = generateIdToken({ iss: issuer, sub: 'user1', aud: 'app', iat: now - 7200, exp: now - 3600 })
+
+      expect(verifyIdTokenHint(hint, [issuer])).toMatchObject({ sub: 'user1', aud: 'app' })
+    })
+
+    test('should reject a forged or foreign ID token', () => {
+      const { privateKey } = crypto.generateKeyPairSync('rsa', { modulusLength: 2048 })
+      const valid = jwt.decode(generateIdToken({ iss: issuer, sub: 'user1', aud: 'app' }), { complete: true })
+      const forged = jwt.sign({ iss: issuer, sub: 'admin', aud: 'app' }, privateKey, { algorithm: 'RS256', keyid: valid.header.kid })
+
+      expect(() => verifyIdTokenHint(forged, [issuer])).toThrow('invalid signature')
+      expect(() => verifyIdTokenHint(generateIdToken({ iss: 'https://other.example.com', sub: 'user1', aud: 'app' }), [issuer])).toThrow('jwt issuer invalid')
+      expect(() => verifyIdTokenHint('not-a-jwt', [issuer])).toThrow('id_token_hint is not a JWT')
+    })
+
+    test('should reject access and logout tokens', () => {
+      const accessToken = generateToken({ iss: issuer, sub: 'user1', aud: 'app', client_id: 'app', token_type: 'access' })
+      const logoutToken = generateLogoutToken({ iss: issuer, sub: 'user1', aud: 'app' })
+
+      expect(() => verifyIdTokenHint(accessToken, [issuer])).toThrow('id_token_hint is not an ID token')
+      expect(() => verifyIdTokenHint(logoutToken, [issuer])).toThrow('id_token_hint is not an ID token')
+    })
+  })
+
   describe('generateRandomToken', () => {
     test('should generate hex string of correct length', async () => {
       const token = generateRandomToken(16)
@@ -144,6 +243,49 @@ describe('Token Operations', () => {
     })
   })
 
+  describe('generateCode', () => {
+    const original = { ...config.codes }
+
+    afterEach(() => {
+      Object.assign(config.codes, original)
+    })
+
+    test('should use the configured number of random bytes per type', () => {
+      config.codes.authorizationCodeBytes = 16
+      config.codes.deviceCodeBytes = 24
+      config.codes.refreshTokenBytes = 48
+
+      expect(generateCode('authorization_code')).toHaveLength(32)
+      expect(generateCode('device_code')).toHaveLength(48)
+      expect(generateCode('refresh_token')).toHaveLength(96)
+    })
+
+    test('should put the configured prefix in front of the random part of refresh tokens', () => {
+      config.codes.refreshTokenPrefix = 'ngauth_rt_'
+
+      expect(generateCode('refresh_token')).toMatch(/^ngauth_rt_[0-9a-f]{64}$/)
+      expect(generateCode('authorization_code')).toMatch(/^[0-9a-f]{64}$/)
+    })
+
+    test('should generate distinct URL-safe codes', () => {
+      const codes = new Set()
+      for (let i = 0; i < 20; i++) {
+        const code = generateCode('authorization_code')
+        expect(code).toMatch(/^[A-Za-z0-9_-]+$/)
+        expect(encodeURIComponent(code)).toBe(code)
+        codes.add(code)
+      }
+      expect(codes.size).toBe(20)
+    })
+
+    test('should refuse lengths below the entropy floor', () => {
+      config.codes.authorizationCodeBytes = 8
+
+      expect(() => generateCode('authorization_code')).toThrow('authorization_code must use at least 16 random bytes, got 8')
+      expect(() => generateCode('session_code')).toThrow("Unknown code type 'session_code'")
+    })
+  })
+
   describe('getPublicKeyJwk', () => {
     beforeEach(async () => {
       await ensurePrivateKey(testDir)
@@ -166,4 +308,455 @@ describe('Token Operations', () => {
       expect(jwk.kid.length).toBe(16)
     })
   })
+
+  describe('default key rotation', () => {
+    const originalDelay = config.signingKeys.activationDelay
+    const kidOf = (token) => jwt.decode(token, { complete: true }).header.kid
+    const jwksKids = () => getPublicKeyJwks().map(k => k.kid)
+
+    beforeEach(async () => {
+      config.signingKeys.activationDelay = 900
+      await ensurePrivateKey(testDir)
+    })
+
+    afterEach(() => {
+      config.signingKeys.activationDelay = originalDelay
+    })
+
+    test('should publish the new key in the JWKS before signing with it', async () => {
+      const oldKid = getPublicKeyJwk().kid
+      const now = Date.now()
+
+      const { kid, activatesAt } = await rotateDefaultKey(now)
+
+      expect(activatesAt).toBe(now + 900 * 1000)
+      expect(jwksKids()).toEqual([oldKid, kid])
+      expect(kidOf(generateToken({ sub: 'user123', token_type: 'access' }))).toBe(oldKid)
+      expect(kidOf(generateIdToken({ sub: 'user123', aud: 'client456' }))).toBe(oldKid)
+    })
+
+    test('should sign with the new key once activated and keep verifying the old one', async () => {
+      const oldToken = generateToken({ sub: 'user123', token_type: 'access' })
+      const oldKid = kidOf(oldToken)
+      const { kid, activatesAt } = await rotateDefaultKey()
+
+      expect(getKeyRotation(activatesAt).current).toBe(kid)
+
+      const newToken = generateToken({ sub: 'user123', token_type: 'access' })
+      expect(kidOf(newToken)).toBe(kid)
+      expect(jwksKids()).toEqual([kid, oldKid])
+      expect(verifyToken(oldToken).sub).toBe('user123')
+      expect(verifyToken(newToken).sub).toBe('user123')
+      expect(getPublicKeyPem(oldKid)).not.toBe(getPublicKeyPem(kid))
+    })
+
+    test('should drop the old key once its tokens have expired', async () => {
+      const oldKid = getPublicKeyJwk().kid
+      const { activatesAt } = await rotateDefaultKey()
+      const retention = Math.max(config.tokens.accessTokenTTL, config.tokens.idTokenTTL) * 1000
+
+      expect(getKeyRotation(activatesAt + retention - 1).previous.map(k => k.kid)).toEqual([oldKid])
+      expect(getKeyRotation(activatesAt + retention).previous).toEqual([])
+      expect(jwksKids()).not.toContain(oldKid)
+    })
+
+    test('should refuse a second rotation while one is pending', async () => {
+      await rotateDefaultKey()
+
+      await expect(rotateDefaultKey()).rejects.toThrow('is already waiting to be activated')
+    })
+
+    test('should resume a pending rotation after a restart', async () => {
+      const oldKid = getPublicKeyJwk().kid
+      const { kid } = await rotateDefaultKey()
+
+      await ensurePrivateKey(testDir)
+
+      expect(getPublicKeyJwk().kid).toBe(oldKid)
+      expect(getKeyRotation().next.kid).toBe(kid)
+      expect(jwksKids()).toEqual([oldKid, kid])
+    })
+
+    test('should complete a rotation that activated while stopped', async () => {
+      config.signingKeys.activationDelay = 0
+      const oldKid = getPublicKeyJwk().kid
+      const { kid } = await rotateDefaultKey()
+
+      await ensurePrivateKey(testDir)
+
+      expect(getPublicKeyJwk().kid).toBe(kid)
+      expect(getKeyRotation().previous.map(k => k.kid)).toEqual([oldKid])
+      expect(fs.existsSync(path.join(testDir, `private-key.previous-${oldKid}.pem`))).toBe(true)
+      expect(fs.existsSync(path.join(testDir, 'private-key.next.pem'))).toBe(false)
+    })
+  })
+
+  describe('signing key purposes', () => {
+    let original
+
+    beforeEach(async () => {
+      original = { ...config.signingKeys }
+      config.signingKeys.idToken = 'id-token-key'
+      config.signingKeys.logoutToken = 'logout-token-key'
+      await ensurePrivateKey(testDir)
+    })
+
+    afterEach(async () => {
+      Object.assign(config.signingKeys, original)
+    })
+
+    test('should sign id_tokens and logout_tokens with their configured kids', () => {
+      const idToken = jwt.decode(generateIdToken({ sub: 'user123', aud: 'client456' }), { complete: true })
+      const logoutToken = jwt.decode(generateLogoutToken({ sub: 'user123', aud: 'client456' }), { complete: true })
+
+      expect(idToken.header.kid).toBe('id-token-key')
+      expect(logoutToken.header.kid).toBe('logout-token-key')
+      expect(logoutToken.header.typ).toBe('logout+jwt')
+      expect(logoutToken.payload.events).toHaveProperty('http://schemas.openid.net/event/backchannel-logout')
+      expect(logoutToken.payload.jti).toBeDefined()
+    })
+
+    test('should keep signing access tokens with the default key', () => {
+      const accessToken = jwt.decode(generateToken({ sub: 'user123' }), { complete: true })
+
+      expect(accessToken.header.kid).toBe(getPublicKeyJwk().kid)
+    })
+
+    test('should publish every signing key in the JWKS', () => {
+      const kids = getPublicKeyJwks().map(k => k.kid)
+
+      expect(kids).toEqual([getPublicKeyJwk().kid, 'id-token-key', 'logout-token-key'])
+      for (const jwk of getPublicKeyJwks()) {
+        expect(jwk.use).toBe('sig')
+        expect(jwk.alg).toBe('RS256')
+      }
+    })
+
+    test('should verify tokens by kid', () => {
+      expect(verifyToken(generateIdToken({ sub: 'user123' })).sub).toBe('user123')
+      expect(verifyToken(generateLogoutToken({ sub: 'user123' })).sub).toBe('user123')
+    })
+
+    test('should persist purpose keys across restarts', async () => {
+      const before = getPublicKeyJwks()
+      await ensurePrivateKey(testDir)
+
+      expect(fs.existsSync(path.join(testDir, 'signing-key-id-token-key.pem'))).toBe(true)
+      expect(getPublicKeyJwks()).toEqual(before)
+    })
+
+    test('should reject unsafe key IDs', async () => {
+      config.signingKeys.idToken = '../escape'
+
+      await expect(ensurePrivateKey(testDir)).rejects.toThrow('Invalid id_token signing key ID')
+    })
+  })
+
+  describe('per-client signing algorithms', () => {
+    let original
+
+    beforeEach(async () => {
+      original = { ...config.signingKeys }
+      config.signingKeys.ecKey = 'ec-key'
+      await ensurePrivateKey(testDir)
+    })
+
+    afterEach(async () => {
+      Object.assign(config.signingKeys, original)
+    })
+
+    test('should publish both the RSA and the EC key in the JWKS', () => {
+      const jwks = getPublicKeyJwks()
+
+      expect(jwks.map(k => [k.kid, k.alg, k.kty])).toEqual([
+        [getPublicKeyJwk().kid, 'RS256', 'RSA'],
+        ['ec-key', 'ES256', 'EC']
+      ])
+      expect(jwks[1].crv).toBe('P-256')
+      expect(getSigningAlgorithms()).toEqual(['RS256', 'ES256'])
+    })
+
+    test('should sign id_tokens for ES256 clients with the EC key', () => {
+      const token = generateIdToken({ sub: 'user123', aud: 'client456' }, '1h', 'ES256')
+      const { header } = jwt.decode(token, { complete: true })
+
+      expect(header.alg).toBe('ES256')
+      expect(header.kid).toBe('ec-key')
+      expect(verifyToken(token).sub).toBe('user123')
+    })
+
+    test('should keep RS256 as the default for id_tokens and access tokens', () => {
+      for (const token of [
+        generateIdToken({ sub: 'user123', aud: 'client456' }),
+        generateIdToken({ sub: 'user123', aud: 'client456' }, '1h', 'RS256'),
+        generateToken({ sub: 'user123', token_type: 'access' })
+      ]) {
+        const { header } = jwt.decode(token, { complete: true })
+        expect(header.alg).toBe('RS256')
+        expect(header.kid).toBe(getPublicKeyJwk().kid)
+      }
+    })
+
+    test('should keep a dedicated RSA id_token key for RS256 clients', async () => {
+      config.signingKeys.idToken = 'id-token-key'
+      await ensurePrivateKey(testDir)
+
+      const rsa = jwt.decode(generateIdToken({ sub: 'user123' }, '1h', 'RS256'), { complete: true })
+      const ec = jwt.decode(generateIdToken({ sub: 'user123' }, '1h', 'ES256'), { complete: true })
+
+      expect(rsa.header.kid).toBe('id-token-key')
+      expect(ec.header.kid).toBe('ec-key')
+    })
+
+    test('should refuse an algorithm without a key', async () => {
+      config.signingKeys.ecKey = null
+      await ensurePrivateKey(testDir)
+
+      expect(() => generateIdToken({ sub: 'user123' }, '1h', 'ES256')).toThrow('No signing key available for ES256')
+    })
+
+    test('should reject a non-EC key file for the EC key ID', async () => {
+      fs.copyFileSync(path.join(testDir, 'private-key.pem'), path.join(testDir, 'signing-key-ec-key.pem'))
+
+      await expect(ensurePrivateKey(testDir)).rejects.toThrow('must be an EC P-256 key')
+    })
+  })
+
+  describe('client signing keys', () => {
+    beforeEach(async () => {
+      await ensurePrivateKey(testDir)
+    })
+
+    test('should sign access tokens with the client key', async () => {
+      await ensureClientKey('tenant-a')
+      const token = generateToken({ sub: 'user123', token_type: 'access' }, '1h', 'tenant-a')
+      const { header } = jwt.decode(token, { complete: true })
+
+      expect(header.kid).toBe('tenant-a')
+      const [jwk] = await getClientJwks('tenant-a')
+      expect(jwk.kid).toBe('tenant-a')
+      expect(jwt.verify(token, crypto.createPublicKey({ key: jwk, format: 'jwk' })).sub).toBe('user123')
+      expect(verifyToken(token).sub).toBe('user123')
+    })
+
+    test('should keep client keys out of the server JWKS', async () => {
+      await ensureClientKey('tenant-a')
+
+      expect(getPublicKeyJwks().map(k => k.kid)).not.toContain('tenant-a')
+    })
+
+    test('should generate one key for concurrent first uses', async () => {
+      const [a, b] = await Promise.all([ensureClientKey('tenant-a'), ensureClientKey('tenant-a')])
+
+      expect(a).toBe(b)
+    })
+
+    test('should reload client keys after a restart', async () => {
+      await ensureClientKey('tenant-a')
+      const token = generateToken({ sub: 'user123', token_type: 'access' }, '1h', 'tenant-a')
+
+      await ensurePrivateKey(testDir)
+
+      expect(verifyToken(token).sub).toBe('user123')
+      expect(generateToken({ sub: 'user123' }, '1h', 'tenant-a')).toBeDefined()
+    })
+
+    test('should reject invalid and server key IDs', async () => {
+      await expect(ensureClientKey('../escape')).rejects.toThrow('Invalid client signing key ID')
+      await expect(ensureClientKey(getPublicKeyJwk().kid)).rejects.toThrow('used by a server signing key')
+    })
+
+    test('should refuse to sign with a key that is not loaded', () => {
+      expect(() => generateToken({ sub: 'user123' }, '1h', 'tenant-b')).toThrow('Client signing key tenant-b is not loaded')
+    })
+  })
+
+  describe('certificate chains', () => {
+    const fixtures = path.join(__dirname, '..', 'fixtures')
+
+    test('should publish x5c and x5t#S256 for a key with a certificate chain', async () => {
+      fs.copyFileSync(path.join(fixtures, 'signing-key.pem'), path.join(testDir, 'private-key.pem'))
+      fs.copyFileSync(path.join(fixtures, 'signing-key.crt'), path.join(testDir, 'private-key.crt'))
+      await ensurePrivateKey(testDir)
+
+      const jwk = getPublicKeyJwk()
+      expect(jwk.x5c).toHaveLength(2)
+
+      const [leaf, ca] = jwk.x5c.map(der => new crypto.X509Certificate(Buffer.from(der, 'base64')))
+      expect(leaf.publicKey.equals(crypto.createPublicKey({ key: jwk, format: 'jwk' }))).toBe(true)
+      expect(leaf.checkIssued(ca)).toBe(true)
+      expect(leaf.verify(ca.publicKey)).toBe(true)
+      expect(jwk['x5t#S256']).toBe(crypto.createHash('sha256').update(leaf.raw).digest('base64url'))
+    })
+
+    test('should keep the raw-parameter form for keys without certificates', async () => {
+      await ensurePrivateKey(testDir)
+
+      const jwk = getPublicKeyJwk()
+      expect(jwk.n).toBeDefined()
+      expect(jwk.x5c).toBeUndefined()
+      expect(jwk['x5t#S256']).toBeUndefined()
+    })
+
+    test('should reject a certificate that does not match the key', async () => {
+      await ensurePrivateKey(testDir)
+      fs.copyFileSync(path.join(fixtures, 'signing-key.crt'), path.join(testDir, 'private-key.crt'))
+
+      await expect(ensurePrivateKey(testDir)).rejects.toThrow('does not match its signing key')
+    })
+  })
+
+  describe('client_id claim', () => {
+    beforeEach(async () => {
+      await ensurePrivateKey(testDir)
+    })
+
+    afterEach(() => {
+      config.tokens.includeClientId = true
+    })
+
+    test('should keep client_id in access tokens by default', () => {
+      const decoded = jwt.decode(generateToken({ sub: 'user123', client_id: 'client456', token_type: 'access' }))
+
+      expect(decoded.sub).toBe('user123')
+      expect(decoded.client_id).toBe('client456')
+    })
+
+    test('should drop client_id from access tokens only when disabled', () => {
+      config.tokens.includeClientId = false
+
+      const access = jwt.decode(generateToken({ sub: 'user123', client_id: 'client456', token_type: 'access' }))
+      const refresh = jwt.decode(generateToken({ sub: 'user123', client_id: 'client456', token_type: 'refresh' }))
+
+      expect(access.client_id).toBeUndefined()
+      expect(access.sub).toBe('user123')
+      expect(refresh.client_id).toBe('client456')
+    })
+  })
+
+  describe('time claims', () => {
+    const issueAll = () => [
+      generateToken({ sub: 'user123', token_type: 'access' }),
+      generateIdToken({ sub: 'user123', aud: 'client456' }),
+      generateLogoutToken({ sub: 'user123', aud: 'client456' })
+    ].map(token => jwt.decode(token))
+
+    beforeEach(async () => {
+      await ensurePrivateKey(testDir)
+    })
+
+    afterEach(() => {
+      config.tokens.notBefore = false
+    })
+
+    test('should include iat in every token type and no nbf by default', () => {
+      const now = Math.floor(Date.now() / 1000)
+
+      for (const decoded of issueAll()) {
+        expect(decoded.iat).toBeGreaterThanOrEqual(now - 1)
+        expect(decoded.iat).toBeLessThanOrEqual(now + 1)
+        expect(decoded.exp).toBeGreaterThan(decoded.iat)
+        expect(decoded.nbf).toBeUndefined()
+      }
+    })
+
+    test('should set nbf equal to iat when enabled', () => {
+      config.tokens.notBefore = true
+
+      for (const decoded of issueAll()) {
+        expect(decoded.nbf).toBe(decoded.iat)
+      }
+    })
+
+    test('should keep iat and exp already present in the claims', () => {
+      const iat = Math.floor(Date.now() / 1000) - 10
+      const decoded = jwt.decode(generateIdToken({ sub: 'user123', aud: 'client456', iat, exp: iat + 3600 }, '1h'))
+
+      expect(decoded.iat).toBe(iat)
+      expect(decoded.exp).toBe(iat + 3600)
+    })
+  })
+
+  describe('JWT header', () => {
+    const headerOf = (token) => jwt.decode(token, { complete: true }).header
+
+    beforeEach(async () => {
+      await ensurePrivateKey(testDir)
+    })
+
+    afterEach(() => {
+      config.tokens.jkuHeader = false
+    })
+
+    test('should set kid and typ for every token type', () => {
+      const kid = getPublicKeyJwk().kid
+
+      expect(headerOf(generateToken({ sub: 'user123', token_type: 'access' }))).toEqual({ alg: 'RS256', typ: 'at+jwt', kid })
+      expect(headerOf(generateIdToken({ sub: 'user123', aud: 'client456' }))).toEqual({ alg: 'RS256', typ: 'JWT', kid })
+      expect(headerOf(generateLogoutToken({ sub: 'user123', aud: 'client456' }))).toEqual({ alg: 'RS256', typ: 'logout+jwt', kid })
+    })
+
+    test('should leave out jku unless enabled', () => {
+      for (const token of [generateToken({ sub: 'user123', token_type: 'access' }), generateIdToken({ sub: 'user123' })]) {
+        expect(headerOf(token)).not.toHaveProperty('jku')
+      }
+    })
+
+    test('should name the server JWKS in jku when enabled', () => {
+      config.tokens.jkuHeader = true
+      const jwksUri = `${config.issuer}${config.endpoints.jwks}`
+
+      expect(headerOf(generateToken({ sub: 'user123', token_type: 'access' })).jku).toBe(jwksUri)
+      expect(headerOf(generateIdToken({ sub: 'user123' })).jku).toBe(jwksUri)
+      expect(headerOf(generateLogoutToken({ sub: 'user123' })).jku).toBe(jwksUri)
+    })
+
+    test('should name the client JWKS for a dedicated key', async () => {
+      config.tokens.jkuHeader = true
+      await ensureClientKey('client-tenant-a')
+
+      const header = headerOf(generateToken({ sub: 'user123', client_id: 'tenant-a', token_type: 'access' }, '1h', 'client-tenant-a'))
+
+      expect(header.kid).toBe('client-tenant-a')
+      expect(header.jku).toBe(`${config.issuer}/.well-known/jwks/tenant-a.json`)
+    })
+
+    test('should still verify by kid with jku set', () => {
+      config.tokens.jkuHeader = true
+
+      expect(verifyToken(generateIdToken({ sub: 'user123' })).sub).toBe('user123')
+    })
+  })
+
+  describe('default claims', () => {
+    afterEach(() => {
+      config.claims.defaultClaims = {}
+    })
+
+    test('should merge client defaults over the issuer defaults', () => {
+      config.claims.defaultClaims = { tenant: 'acme', env: 'prod' }
+
+      expect(defaultClaimsFor(null)).toEqual({ tenant: 'acme', env: 'prod' })
+      expect(defaultClaimsFor({ client_id: 'c1', default_claims: { env: 'staging' } })).toEqual({ tenant: 'acme', env: 'staging' })
+    })
+
+    test('should drop protected and grant claims', () => {
+      config.claims.defaultClaims = { iss: 'x', sub: 'x', aud: 'x', exp: 1, cnf: {}, client_id: 'x', scope: 'admin', token_type: 'id', tenant: 'acme' }
+
+      expect(defaultClaimsFor(null)).toEqual({ tenant: 'acme' })
+    })
+
+    test('should never override the payload', () => {
+      const payload = withDefaultClaims({ sub: 'user123', token_type: 'access', env: 'from-payload' }, { default_claims: { env: 'default', team: 'core' } })
+
+      expect(payload).toEqual({ team: 'core', sub: 'user123', token_type: 'access', env: 'from-payload' })
+    })
+
+    test('should reject unusable client defaults', () => {
+      expect(() => validateDefaultClaims({ tenant: 'acme' })).not.toThrow()
+      expect(() => validateDefaultClaims(['tenant'])).toThrow('default_claims must be a JSON object')
+      expect(() => validateDefaultClaims({ sub: 'admin' })).toThrow("default_claims must not set the 'sub' claim")
+      expect(() => validateDefaultClaims({ scope: 'admin' })).toThrow("default_claims must not set the 'scope' claim")
+    })
+  })
 })
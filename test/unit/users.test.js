@@ -1,5 +1,19 @@
-/* global describe, expect, it */
-const { hashPassword, verifyPassword, validatePassword, validateUsername, validateEmail } = require('../../src/users')
+/* global describe, expect, it, beforeEach, afterEach */
+/* eslint camelcase: "off" */
+const bcrypt = require('bcrypt')
+const config = require('../../src/config')
+const {
+  hashPassword,
+  verifyPassword,
+  needsRehash,
+  validatePassword,
+  validateUsername,
+  validateEmail,
+  validateLocale,
+  setEmailVerificationSender,
+  requestEmailVerification,
+  matchEmailVerification
+} = require('../../src/users')
 
 describe('User utilities', () => {
   describe('hashPassword', () => {
@@ -34,6 +48,19 @@ describe('User utilities', () => {
     })
   })
 
+  describe('bcrypt cost', () => {
+    it('should hash at the configured cost', async () => {
+      const hash = await hashPassword('testpassword123')
+      expect(bcrypt.getRounds(hash)).toBe(config.passwords.bcryptCost)
+    })
+
+    it('should flag hashes below the configured cost for rehashing', async () => {
+      expect(needsRehash(await bcrypt.hash('testpassword123', 4), 10)).toBe(true)
+      expect(needsRehash(await bcrypt.hash('testpassword123', 10), 10)).toBe(false)
+      expect(needsRehash('not-a-bcrypt-hash', 10)).toBe(false)
+    })
+  })
+
   describe('validatePassword', () => {
     it('should accept valid password', () => {
       expect(() => validatePassword('ValidPass123!')).not.toThrow()
@@ -83,4 +110,59 @@ describe('User utilities', () => {
       expect(() => validateEmail('')).toThrow()
     })
   })
+
+  describe('validateLocale', () => {
+    it('should accept language tags', () => {
+      expect(() => validateLocale('en')).not.toThrow()
+      expect(() => validateLocale('de-CH')).not.toThrow()
+      expect(() => validateLocale('zh-Hant-TW')).not.toThrow()
+    })
+
+    it('should reject anything else', () => {
+      expect(() => validateLocale('english please')).toThrow()
+      expect(() => validateLocale('<script>')).toThrow()
+      expect(() => validateLocale(42)).toThrow()
+    })
+  })
+
+  describe('email verification', () => {
+    const user = { id: 'user_1', username: 'alice' }
+    let sent
+
+    beforeEach(() => {
+      sent = []
+      setEmailVerificationSender(async (message) => { sent.push(message) })
+    })
+
+    afterEach(() => {
+      setEmailVerificationSender(null)
+    })
+
+    it('should mark the new address unverified and send it a token', async () => {
+      const changes = await requestEmailVerification(user, 'new@example.com')
+
+      expect(changes.email).toBe('new@example.com')
+      expect(changes.email_verified).toBe(false)
+      expect(sent).toHaveLength(1)
+      expect(sent[0].email).toBe('new@example.com')
+      // Only a hash of the token is stored
+      expect(JSON.stringify(changes)).not.toContain(sent[0].token)
+    })
+
+    it('should match only the sent token', async () => {
+      const changes = await requestEmailVerification(user, 'new@example.com')
+      const pending = { ...user, ...changes }
+
+      expect(matchEmailVerification(pending, sent[0].token)).toBe(true)
+      expect(matchEmailVerification(pending, 'guessed')).toBe(false)
+      expect(matchEmailVerification(user, sent[0].token)).toBe(false)
+    })
+
+    it('should not match an expired token', async () => {
+      const changes = await requestEmailVerification(user, 'new@example.com')
+      const expired = { ...user, ...changes, emailVerification: { ...changes.emailVerification, expiresAt: Date.now() - 1 } }
+
+      expect(matchEmailVerification(expired, sent[0].token)).toBe(false)
+    })
+  })
 })
@@ -0,0 +1,174 @@
+/* global describe, test, expect, beforeAll, jest */
+const crypto = require('crypto')
+const config = require('../../src/config')
+const { validateConfig, assertValidConfig } = require('../../src/config/validate')
+
+const publicPem = (type, options) => crypto.generateKeyPairSync(type, {
+  ...options,
+  publicKeyEncoding: { type: 'spki', format: 'pem' },
+  privateKeyEncoding: { type: 'pkcs8', format: 'pem' }
+}).publicKey
+
+// The loaded configuration with overrides applied per section
+function buildConfig (overrides = {}) {
+  const copy = JSON.parse(JSON.stringify(config))
+  for (const [key, value] of Object.entries(overrides)) {
+    copy[key] = value && typeof value === 'object' && !Array.isArray(value)
+      ? { ...copy[key], ...value }
+      : value
+  }
+  return copy
+}
+
+const errorPaths = (problems) => problems.filter(p => p.severity === 'error').map(p => p.path)
+
+describe('Configuration Validation', () => {
+  let rsaKey
+  let weakRsaKey
+  let ecKey
+
+  beforeAll(() => {
+    rsaKey = { kid: 'default', alg: 'RS256', publicKey: publicPem('rsa', { modulusLength: 2048 }) }
+    weakRsaKey = { kid: 'weak', alg: 'RS256', publicKey: publicPem('rsa', { modulusLength: 1024 }) }
+    ecKey = { kid: 'ec', alg: 'ES256', publicKey: publicPem('ec', { namedCurve: 'P-256' }) }
+  })
+
+  test('should accept the default configuration', () => {
+    const problems = validateConfig(buildConfig(), {
+      signingKeys: [rsaKey, ecKey],
+      sessionSecret: 'x'.repeat(32)
+    })
+
+    expect(problems).toEqual([])
+  })
+
+  test('should reject an issuer that is not a URL', () => {
+    expect(errorPaths(validateConfig(buildConfig({ issuer: 'auth.example.com' })))).toEqual(['issuer'])
+    expect(errorPaths(validateConfig(buildConfig({ issuer: 'ftp://auth.example.com' })))).toEqual(['issuer'])
+    expect(errorPaths(validateConfig(buildConfig({ issuer: 'https://auth.example.com?tenant=a' })))).toEqual(['issuer'])
+  })
+
+  test('should reject endpoint paths without a leading slash', () => {
+    const problems = validateConfig(buildConfig({ endpoints: { token: 'oauth/token' } }))
+
+    expect(errorPaths(problems)).toEqual(['endpoints.token'])
+  })
+
+  test('should reject a redis store without a redis URL', () => {
+    const problems = validateConfig(buildConfig({ rateLimit: { store: 'redis', redisUrl: 'localhost:6379' } }))
+
+    expect(errorPaths(problems)).toEqual(['rateLimit.redisUrl'])
+  })
+
+  test('should require a signing key for the configured algorithm', () => {
+    expect(errorPaths(validateConfig(buildConfig(), { signingKeys: [] }))).toEqual(['signingKeys'])
+    expect(errorPaths(validateConfig(buildConfig({ tokens: { signingAlgorithm: 'ES256' } }), { signingKeys: [rsaKey] })))
+      .toEqual(['tokens.signingAlgorithm'])
+  })
+
+  test('should reject weak or mismatched signing keys', () => {
+    const problems = validateConfig(buildConfig(), {
+      signingKeys: [rsaKey, weakRsaKey, { kid: 'mislabeled', alg: 'RS256', publicKey: ecKey.publicKey }]
+    })
+
+    expect(problems.filter(p => p.severity === 'error').map(p => p.message)).toEqual([
+      "RSA key 'weak' is 1024 bits; at least 2048 are required",
+      "key 'mislabeled' must be an RSA key for RS256"
+    ])
+  })
+
+  test('should reject offline access without refresh tokens', () => {
+    const problems = validateConfig(buildConfig({ features: { refreshTokens: false, offlineAccess: true } }))
+
+    expect(errorPaths(problems)).toEqual(['features.offlineAccess'])
+  })
+
+  test('should warn about inconsistent grant settings', () => {
+    const problems = validateConfig(buildConfig({
+      features: { refreshTokens: false, offlineAccess: false },
+      tokens: { maxRefreshRotations: 5 },
+      dpop: { enabled: false, requireNonce: true }
+    }))
+
+    expect(errorPaths(problems)).toEqual([])
+    expect(problems.map(p => p.path)).toEqual(['tokens.maxRefreshRotations', 'dpop.requireNonce'])
+  })
+
+  test('should warn when every grant type is disabled', () => {
+    const problems = validateConfig(buildConfig({
+      features: { authorizationCodeGrant: false, clientCredentialsGrant: false, deviceCodeGrant: false }
+    }))
+
+    expect(errorPaths(problems)).toEqual([])
+    expect(problems.map(p => p.path)).toEqual(['features'])
+    expect(validateConfig(buildConfig({ features: { authorizationCodeGrant: false, clientCredentialsGrant: false } }))).toEqual([])
+  })
+
+  test('should reject unknown values and invalid numbers', () => {
+    const problems = validateConfig(buildConfig({
+      port: 70000,
+      sessions: { limitPolicy: 'evict-newest' },
+      tokens: { accessTokenTTL: NaN },
+      deviceFlow: { interval: 0 }
+    }))
+
+    expect(errorPaths(problems)).toEqual(['sessions.limitPolicy', 'port', 'tokens.accessTokenTTL', 'deviceFlow.interval'])
+    expect(problems[0].message).toBe("must be one of evict-oldest, deny-new, got 'evict-newest'")
+  })
+
+  test('should reject short secrets and missing challenge credentials', () => {
+    const problems = validateConfig(buildConfig({
+      storeEncryption: { secret: 'too-short' },
+      challenge: { provider: 'turnstile', secret: null, siteKey: 'site-key' }
+    }), { sessionSecret: 'secret' })
+
+    expect(errorPaths(problems)).toEqual(['SESSION_SECRET', 'storeEncryption.secret', 'challenge.secret'])
+  })
+
+  test('should flag a SameSite=Strict session cookie as breaking redirects', () => {
+    const problems = validateConfig(buildConfig({ sessionCookie: { sameSite: 'strict' } }))
+
+    expect(errorPaths(problems)).toEqual([])
+    expect(problems.map(p => p.path)).toEqual(['sessionCookie.sameSite'])
+    expect(problems[0].message).toContain('prompt=none fails with login_required')
+  })
+
+  test('should reject session cookie attributes browsers would drop', () => {
+    const problems = validateConfig(buildConfig({
+      issuer: 'https://auth.example.com/tenant',
+      basePath: '/tenant',
+      sessionCookie: { name: '__Host-ngauth', sameSite: 'none', secure: false, domain: 'other.example.com', path: '/admin' }
+    }))
+
+    expect(errorPaths(problems)).toEqual(['sessionCookie.name', 'sessionCookie.sameSite', 'sessionCookie.domain', 'sessionCookie.path'])
+  })
+
+  test('should reject malformed trusted proxies', () => {
+    const problems = validateConfig(buildConfig({ trustedProxies: ['10.0.0.0/8', '10.0.0.0/abc'] }))
+
+    expect(errorPaths(problems)).toEqual(['trustedProxies'])
+    expect(problems[0].message).toContain('10.0.0.0/abc')
+  })
+
+  describe('assertValidConfig', () => {
+    test('should list every error in one exception', () => {
+      const invalid = buildConfig({ issuer: 'not a url', features: { refreshTokens: false, offlineAccess: true } })
+
+      expect(() => assertValidConfig(invalid)).toThrow(
+        "Invalid configuration:\n  - issuer must be an http or https URL, got 'not a url'\n  - features.offlineAccess offline_access needs refresh tokens to be enabled"
+      )
+    })
+
+    test('should log warnings without failing', () => {
+      const warn = jest.spyOn(console, 'warn').mockImplementation(() => {})
+      try {
+        const problems = assertValidConfig(buildConfig({ dpop: { enabled: false, requireNonce: true } }))
+
+        expect(problems.map(p => p.path)).toEqual(['dpop.requireNonce'])
+        expect(warn).toHaveBeenCalledWith(expect.stringContaining('dpop.requireNonce has no effect'))
+      } finally {
+        warn.mockRestore()
+      }
+    })
+  })
+})